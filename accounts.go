@@ -0,0 +1,627 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// User accounts are optional, enabled with "apec web --accounts". Users and
+// their sessions live in a bolt database owned by the web process, apart
+// from the offers store which may be a read-only replica. Passwords are
+// hashed with PBKDF2-SHA256, session tokens are stored hashed as well. When
+// accounts are enabled, admin handlers require the admin role.
+
+var (
+	usersBucket    = []byte("users")
+	sessionsBucket = []byte("sessions")
+	// Users changes made on replicas, which cannot write the store audit log
+	accountsAuditBucket = []byte("audit")
+
+	accountsBuckets = [][]byte{
+		usersBucket,
+		sessionsBucket,
+		accountsAuditBucket,
+	}
+)
+
+const (
+	// Viewers can search offers, admins can use admin handlers as well
+	roleViewer = "viewer"
+	roleAdmin  = "admin"
+
+	sessionCookie      = "apec_session"
+	sessionLifetime    = 30 * 24 * time.Hour
+	passwordIterations = 100000
+	minPasswordLength  = 8
+)
+
+type Accounts struct {
+	db *bolt.DB
+}
+
+// OpenAccounts opens or creates the accounts database at path. It fails if
+// another process holds it, like a running "apec web".
+func OpenAccounts(path string) (*Accounts, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		if err == bolt.ErrTimeout {
+			return nil, fmt.Errorf("accounts database %s is locked, is apec web "+
+				"running?", path)
+		}
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range accountsBuckets {
+			_, err := tx.CreateBucketIfNotExists(bucket)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Accounts{
+		db: db,
+	}, nil
+}
+
+func (a *Accounts) Close() error {
+	return a.db.Close()
+}
+
+// AppendAudit records entry in the accounts audit log and sets its
+// identifier.
+func (a *Accounts) AppendAudit(entry *AuditEntry) error {
+	return a.db.Update(func(tx *bolt.Tx) error {
+		return appendAuditEntry(boltBucket{tx.Bucket(accountsAuditBucket)}, entry)
+	})
+}
+
+// ListAudit returns at most max accounts audit entries older than before,
+// most recent first. before and max are ignored when zero.
+func (a *Accounts) ListAudit(before uint64, max int) ([]*AuditEntry, error) {
+	var entries []*AuditEntry
+	err := a.db.View(func(tx *bolt.Tx) error {
+		var err error
+		entries, err = listAuditEntries(boltBucket{tx.Bucket(accountsAuditBucket)},
+			before, max)
+		return err
+	})
+	return entries, err
+}
+
+type User struct {
+	Email      string    `json:"email"`
+	Salt       string    `json:"salt"`
+	Hash       string    `json:"hash"`
+	Iterations int       `json:"iterations"`
+	Created    time.Time `json:"created"`
+	// Empty for viewers
+	Role string `json:"role,omitempty"`
+}
+
+// pbkdf2 derives a keyLen bytes key from password and salt, as described in
+// RFC 2898, with HMAC-SHA256.
+func pbkdf2(password, salt []byte, iterations, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	key := []byte{}
+	buf := make([]byte, 4)
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(buf, block)
+		prf.Write(buf)
+		u := prf.Sum(nil)
+		t := append([]byte{}, u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
+
+func randomHex(n int) (string, error) {
+	buf := make([]byte, n)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// normalizeEmail returns email in lowercase, or an error if it does not look
+// like an email address.
+func normalizeEmail(email string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	at := strings.IndexByte(email, '@')
+	if at <= 0 || at == len(email)-1 || strings.ContainsAny(email, " \t\r\n") {
+		return "", fmt.Errorf("invalid email address: %q", email)
+	}
+	return email, nil
+}
+
+func checkRole(role string) error {
+	if role != roleViewer && role != roleAdmin {
+		return fmt.Errorf("unknown role: %q", role)
+	}
+	return nil
+}
+
+// NewUser returns a user identified by email and password, with role.
+func NewUser(email, password, role string, now time.Time) (*User, error) {
+	email, err := normalizeEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	err = checkRole(role)
+	if err != nil {
+		return nil, err
+	}
+	if len(password) < minPasswordLength {
+		return nil, fmt.Errorf("password must have at least %d characters",
+			minPasswordLength)
+	}
+	salt, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+	u := &User{
+		Email:      email,
+		Salt:       salt,
+		Iterations: passwordIterations,
+		Created:    now,
+	}
+	if role != roleViewer {
+		u.Role = role
+	}
+	u.Hash = hex.EncodeToString(pbkdf2([]byte(password), []byte(salt),
+		u.Iterations, sha256.Size))
+	return u, nil
+}
+
+// GetRole returns the user role, viewer by default.
+func (u *User) GetRole() string {
+	if u.Role == "" {
+		return roleViewer
+	}
+	return u.Role
+}
+
+// HasRole returns true if the user is granted role. Admins are viewers too.
+func (u *User) HasRole(role string) bool {
+	return u.GetRole() == roleAdmin || role == roleViewer
+}
+
+// CheckPassword returns true if password is the user one. Users created by
+// OAuth logins have no password.
+func (u *User) CheckPassword(password string) bool {
+	expected, err := hex.DecodeString(u.Hash)
+	if err != nil || len(expected) == 0 {
+		return false
+	}
+	hash := pbkdf2([]byte(password), []byte(u.Salt), u.Iterations, len(expected))
+	return hmac.Equal(hash, expected)
+}
+
+func (a *Accounts) PutUser(u *User) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return a.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(usersBucket).Put([]byte(u.Email), data)
+	})
+}
+
+// GetUser returns the user identified by email, or nil.
+func (a *Accounts) GetUser(email string) (*User, error) {
+	var user *User
+	err := a.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(usersBucket).Get([]byte(email))
+		if data == nil {
+			return nil
+		}
+		user = &User{}
+		return json.Unmarshal(data, user)
+	})
+	return user, err
+}
+
+// DeleteUser removes a user and its sessions. It returns false if the user
+// does not exist.
+func (a *Accounts) DeleteUser(email string) (bool, error) {
+	found := false
+	err := a.db.Update(func(tx *bolt.Tx) error {
+		key := []byte(email)
+		found = tx.Bucket(usersBucket).Get(key) != nil
+		if !found {
+			return nil
+		}
+		err := tx.Bucket(usersBucket).Delete(key)
+		if err != nil {
+			return err
+		}
+		return deleteSessions(tx, func(s *Session) bool {
+			return s.Email == email
+		})
+	})
+	return found, err
+}
+
+// ListUsers returns users sorted by email.
+func (a *Accounts) ListUsers() ([]*User, error) {
+	users := []*User{}
+	err := a.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(usersBucket).ForEach(func(k, v []byte) error {
+			u := &User{}
+			err := json.Unmarshal(v, u)
+			if err != nil {
+				return err
+			}
+			users = append(users, u)
+			return nil
+		})
+	})
+	return users, err
+}
+
+type Session struct {
+	Email   string    `json:"email"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+// sessionKey returns the storage key of a session token, so a leaked
+// database does not leak valid tokens.
+func sessionKey(token string) []byte {
+	h := sha256.Sum256([]byte(token))
+	return []byte(hex.EncodeToString(h[:]))
+}
+
+// deleteSessions removes sessions matching fn.
+func deleteSessions(tx *bolt.Tx, fn func(s *Session) bool) error {
+	b := tx.Bucket(sessionsBucket)
+	keys := [][]byte{}
+	err := b.ForEach(func(k, v []byte) error {
+		s := &Session{}
+		err := json.Unmarshal(v, s)
+		if err != nil || fn(s) {
+			keys = append(keys, append([]byte{}, k...))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		err = b.Delete(k)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateSession opens a session for email and returns its token. Expired
+// sessions are removed.
+func (a *Accounts) CreateSession(email string, now time.Time) (string, error) {
+	token, err := randomHex(32)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(&Session{
+		Email:   email,
+		Created: now,
+		Expires: now.Add(sessionLifetime),
+	})
+	if err != nil {
+		return "", err
+	}
+	err = a.db.Update(func(tx *bolt.Tx) error {
+		err := deleteSessions(tx, func(s *Session) bool {
+			return !now.Before(s.Expires)
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(sessionsBucket).Put(sessionKey(token), data)
+	})
+	return token, err
+}
+
+// GetSession returns the session of token, or nil if it does not exist or
+// expired.
+func (a *Accounts) GetSession(token string, now time.Time) (*Session, error) {
+	var session *Session
+	err := a.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(sessionsBucket).Get(sessionKey(token))
+		if data == nil {
+			return nil
+		}
+		s := &Session{}
+		err := json.Unmarshal(data, s)
+		if err != nil {
+			return err
+		}
+		if now.Before(s.Expires) {
+			session = s
+		}
+		return nil
+	})
+	return session, err
+}
+
+func (a *Accounts) DeleteSession(token string) error {
+	return a.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).Delete(sessionKey(token))
+	})
+}
+
+// sessionUser returns the user logged in by r session cookie, or nil.
+func sessionUser(accounts *Accounts, r *http.Request) (*User, error) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil || cookie.Value == "" {
+		return nil, nil
+	}
+	session, err := accounts.GetSession(cookie.Value, time.Now())
+	if err != nil || session == nil {
+		return nil, err
+	}
+	return accounts.GetUser(session.Email)
+}
+
+func setSessionCookie(w http.ResponseWriter, r *http.Request, path,
+	token string, maxAge int) {
+
+	if path == "" {
+		path = "/"
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     path,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// loginRedirect returns next if it is a path under publicURL, to avoid
+// redirecting users to other sites, or publicURL home otherwise.
+func loginRedirect(publicURL, next string) string {
+	if strings.HasPrefix(next, publicURL+"/") && !strings.HasPrefix(next, "//") &&
+		!strings.Contains(next, "\\") {
+		return next
+	}
+	return publicURL + "/"
+}
+
+// RequireRole serves handler to users logged in with role, identified by
+// the actor header. Anonymous GET requests are redirected to the login page,
+// other ones are rejected.
+func RequireRole(accounts *Accounts, role, publicURL string,
+	handler http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := sessionUser(accounts, r)
+		if err != nil {
+			log.Printf("error: cannot read session: %s", err)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		if user == nil {
+			if r.Method == "GET" || r.Method == "HEAD" {
+				u := publicURL + "/login?" + url.Values{
+					"next": {r.URL.RequestURI()},
+				}.Encode()
+				http.Redirect(w, r, u, http.StatusSeeOther)
+				return
+			}
+			http.Error(w, "login required", http.StatusUnauthorized)
+			return
+		}
+		if !user.HasRole(role) {
+			http.Error(w, role+" role required", http.StatusForbidden)
+			return
+		}
+		r.Header.Set(actorHeader, user.Email)
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// requireViewer restricts handler to logged in users, except for the login
+// pages, robots.txt, static files under publicURL and the offer check
+// handler, which checks its own token.
+func requireViewer(accounts *Accounts, publicURL string,
+	handler http.Handler) http.Handler {
+
+	viewers := RequireRole(accounts, roleViewer, publicURL, handler)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == publicURL+"/login" ||
+			r.URL.Path == publicURL+"/login/oauth" ||
+			r.URL.Path == publicURL+"/login/oauth/callback" ||
+			r.URL.Path == publicURL+"/robots.txt" ||
+			strings.HasPrefix(r.URL.Path, publicURL+"/js/") ||
+			strings.HasPrefix(r.URL.Path, publicURL+apecIdPath) {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		viewers.ServeHTTP(w, r)
+	})
+}
+
+// handleLogin displays the login form, and opens a session on valid POSTed
+// credentials before redirecting to the next parameter. The form links to
+// the OAuth provider if not nil.
+func handleLogin(templ *Templates, accounts *Accounts, oauth *OAuthProvider,
+	publicURL string, w http.ResponseWriter, r *http.Request) error {
+
+	data := struct {
+		Email string
+		Next  string
+		Error string
+		OAuth string
+	}{
+		Email: r.FormValue("email"),
+		Next:  r.FormValue("next"),
+	}
+	if oauth != nil {
+		data.OAuth = oauth.Name
+	}
+	if r.Method == "POST" {
+		var user *User
+		email, err := normalizeEmail(data.Email)
+		if err == nil {
+			user, err = accounts.GetUser(email)
+			if err != nil {
+				return err
+			}
+		}
+		if user != nil && user.CheckPassword(r.FormValue("password")) {
+			token, err := accounts.CreateSession(user.Email, time.Now())
+			if err != nil {
+				return err
+			}
+			setSessionCookie(w, r, publicURL, token, int(sessionLifetime/time.Second))
+			http.Redirect(w, r, loginRedirect(publicURL, data.Next), http.StatusSeeOther)
+			return nil
+		}
+		log.Printf("login failed for %q", data.Email)
+		data.Error = "Invalid email or password"
+		w.WriteHeader(http.StatusForbidden)
+	}
+	return templ.Login.Execute(w, &data)
+}
+
+// handleLogout closes the current session.
+func handleLogout(accounts *Accounts, publicURL string, w http.ResponseWriter,
+	r *http.Request) error {
+
+	cookie, err := r.Cookie(sessionCookie)
+	if err == nil && cookie.Value != "" {
+		err = accounts.DeleteSession(cookie.Value)
+		if err != nil {
+			return err
+		}
+	}
+	setSessionCookie(w, r, publicURL, "", -1)
+	http.Redirect(w, r, publicURL+"/", http.StatusSeeOther)
+	return nil
+}
+
+// handleAdminUsers lists users on GET. On POST, action=add creates or
+// resets the account of email with password and role, viewer by default, and
+// action=delete removes it.
+func handleAdminUsers(accounts *Accounts, w http.ResponseWriter,
+	r *http.Request) error {
+
+	if r.Method != "POST" {
+		users, err := accounts.ListUsers()
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, u := range users {
+			_, err = fmt.Fprintf(w, "%s\t%s\t%s\n", u.Email, u.GetRole(),
+				u.Created.Format(time.RFC3339))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	email, err := normalizeEmail(r.FormValue("email"))
+	if err != nil {
+		return err
+	}
+	var msg string
+	switch action := r.FormValue("action"); action {
+	case "add":
+		role := r.FormValue("role")
+		if role == "" {
+			role = roleViewer
+		}
+		user, err := NewUser(email, r.FormValue("password"), role, time.Now())
+		if err != nil {
+			return err
+		}
+		err = accounts.PutUser(user)
+		if err != nil {
+			return err
+		}
+		msg = fmt.Sprintf("user %s added as %s", email, role)
+	case "delete":
+		found, err := accounts.DeleteUser(email)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("unknown user: %s", email)
+		}
+		msg = fmt.Sprintf("user %s deleted", email)
+	default:
+		return fmt.Errorf("unknown action: %q", action)
+	}
+	log.Printf("admin: %s", msg)
+	w.Header().Set("Content-Type", "text/plain")
+	_, err = fmt.Fprintf(w, "OK: %s\n", msg)
+	return err
+}
+
+var (
+	userAddCmd = app.Command("useradd", `create or reset a web user account
+
+The password is read from the first line of standard input. The accounts
+database cannot be updated while "apec web" runs, use POST /admin/users then.
+`)
+	userAddEmail = userAddCmd.Arg("email", "user email address").Required().String()
+	userAddRole  = userAddCmd.Flag("role", "user role").Default(roleViewer).
+			Enum(roleViewer, roleAdmin)
+)
+
+func userAddFn(cfg *Config) error {
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Scan()
+	err := scanner.Err()
+	if err != nil {
+		return err
+	}
+	user, err := NewUser(*userAddEmail, scanner.Text(), *userAddRole, time.Now())
+	if err != nil {
+		return err
+	}
+	accounts, err := OpenAccounts(cfg.Accounts())
+	if err != nil {
+		return err
+	}
+	defer accounts.Close()
+	err = accounts.PutUser(user)
+	if err != nil {
+		return err
+	}
+	return accounts.Close()
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPBKDF2(t *testing.T) {
+	// RFC 7914 section 11 test vectors
+	tests := []struct {
+		Password   string
+		Salt       string
+		Iterations int
+		KeyLen     int
+		Expected   string
+	}{
+		{"passwd", "salt", 1, 64, "55ac046e56e3089fec1691c22544b605" +
+			"f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef31" +
+			"7c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, 64, "4ddcd8f60b98be21830cee5ef22701f9" +
+			"641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b317" +
+			"6a272bdebba1d078478f62b397f33c8d"},
+	}
+	for _, test := range tests {
+		key := hex.EncodeToString(pbkdf2([]byte(test.Password),
+			[]byte(test.Salt), test.Iterations, test.KeyLen))
+		if key != test.Expected {
+			t.Fatalf("%s: expected %s, got %s", test.Password, test.Expected, key)
+		}
+	}
+}
+
+func openTempAccounts(t *testing.T, env *testEnv) *Accounts {
+	accounts, err := OpenAccounts(env.Config.Accounts())
+	if err != nil {
+		t.Fatalf("could not open accounts: %s", err)
+	}
+	return accounts
+}
+
+func TestAccounts(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+	accounts := openTempAccounts(t, env)
+	defer accounts.Close()
+
+	now := time.Date(2017, 1, 2, 0, 0, 0, 0, time.UTC)
+	for _, test := range [][]string{
+		{"not an email", "password"},
+		{"@example.com", "password"},
+		{"jane@example.com", "short"},
+	} {
+		_, err := NewUser(test[0], test[1], roleViewer, now)
+		if err == nil {
+			t.Fatalf("invalid user accepted: %v", test)
+		}
+	}
+	_, err := NewUser("jane@example.com", "correct horse", "root", now)
+	if err == nil {
+		t.Fatalf("unknown role accepted")
+	}
+	user, err := NewUser(" Jane@Example.com", "correct horse", roleViewer, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Email != "jane@example.com" || user.CheckPassword("Correct horse") ||
+		!user.CheckPassword("correct horse") {
+		t.Fatalf("unexpected user: %+v", user)
+	}
+	if user.GetRole() != roleViewer || !user.HasRole(roleViewer) ||
+		user.HasRole(roleAdmin) {
+		t.Fatalf("unexpected viewer roles: %+v", user)
+	}
+	admin, err := NewUser("root@example.com", "correct horse", roleAdmin, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if admin.GetRole() != roleAdmin || !admin.HasRole(roleViewer) ||
+		!admin.HasRole(roleAdmin) {
+		t.Fatalf("unexpected admin roles: %+v", admin)
+	}
+	err = accounts.PutUser(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := accounts.CreateSession(user.Email, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := accounts.GetSession(token, now.Add(time.Hour))
+	if err != nil || session == nil || session.Email != user.Email {
+		t.Fatalf("session not found: %+v, %v", session, err)
+	}
+	session, err = accounts.GetSession(token, now.Add(sessionLifetime))
+	if err != nil || session != nil {
+		t.Fatalf("expired session returned: %+v, %v", session, err)
+	}
+	// Creating a session removes expired ones
+	_, err = accounts.CreateSession(user.Email, now.Add(sessionLifetime))
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err = accounts.GetSession(token, now)
+	if err != nil || session != nil {
+		t.Fatalf("expired session was not removed: %+v, %v", session, err)
+	}
+
+	found, err := accounts.DeleteUser(user.Email)
+	if err != nil || !found {
+		t.Fatalf("could not delete user: %v", err)
+	}
+	user, err = accounts.GetUser(user.Email)
+	if err != nil || user != nil {
+		t.Fatalf("user was not deleted: %+v, %v", user, err)
+	}
+}
+
+func TestHandleLogin(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+	accounts := openTempAccounts(t, env)
+	defer accounts.Close()
+
+	user, err := NewUser("jane@example.com", "correct horse", roleViewer,
+		time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = accounts.PutUser(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	login := func(email, password, next string) *httptest.ResponseRecorder {
+		values := url.Values{
+			"email":    {email},
+			"password": {password},
+			"next":     {next},
+		}
+		rq := httptest.NewRequest("POST", "/apec/login",
+			strings.NewReader(values.Encode()))
+		rq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		err := handleLogin(env.Templates, accounts, nil, "/apec", w, rq)
+		if err != nil {
+			t.Fatalf("login failed: %s", err)
+		}
+		return w
+	}
+
+	w := login("jane@example.com", "wrong password", "")
+	if w.Code != http.StatusForbidden || len(w.Result().Cookies()) > 0 ||
+		!strings.Contains(w.Body.String(), "Invalid email or password") {
+		t.Fatalf("invalid credentials accepted: %d\n%s", w.Code, w.Body.String())
+	}
+
+	for _, test := range []struct {
+		Next     string
+		Location string
+	}{
+		{"/apec/search?what=python", "/apec/search?what=python"},
+		{"", "/apec/"},
+		{"http://example.com/apec/", "/apec/"},
+		{"/other", "/apec/"},
+	} {
+		w = login("Jane@example.com", "correct horse", test.Next)
+		if w.Code != http.StatusSeeOther || w.Header().Get("Location") != test.Location {
+			t.Fatalf("%q: unexpected redirection: %d %s", test.Next, w.Code,
+				w.Header().Get("Location"))
+		}
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != sessionCookie ||
+		!cookies[0].HttpOnly || cookies[0].Path != "/apec" {
+		t.Fatalf("unexpected session cookie: %+v", cookies)
+	}
+
+	rq := httptest.NewRequest("GET", "/apec/search", nil)
+	rq.AddCookie(cookies[0])
+	logged, err := sessionUser(accounts, rq)
+	if err != nil || logged == nil || logged.Email != "jane@example.com" {
+		t.Fatalf("session user not found: %+v, %v", logged, err)
+	}
+
+	rq = httptest.NewRequest("POST", "/apec/logout", nil)
+	rq.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	err = handleLogout(accounts, "/apec", w, rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logged, err = sessionUser(accounts, rq)
+	if err != nil || logged != nil {
+		t.Fatalf("session was not closed: %+v, %v", logged, err)
+	}
+}
+
+func TestHandleAdminUsers(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+	accounts := openTempAccounts(t, env)
+	defer accounts.Close()
+
+	post := func(values url.Values) string {
+		rq := httptest.NewRequest("POST", "/users",
+			strings.NewReader(values.Encode()))
+		rq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		err := handleAdminUsers(accounts, w, rq)
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		return w.Body.String()
+	}
+	for _, test := range []struct {
+		Values   url.Values
+		Expected string
+	}{
+		{url.Values{"action": {"add"}, "email": {"jane@example.com"},
+			"password": {"correct horse"}},
+			"OK: user jane@example.com added as viewer\n"},
+		{url.Values{"action": {"add"}, "email": {"john@example.com"},
+			"password": {"battery staple"}, "role": {"admin"}},
+			"OK: user john@example.com added as admin\n"},
+		{url.Values{"action": {"add"}, "email": {"john@example.com"},
+			"password": {"battery staple"}, "role": {"root"}},
+			"error: unknown role: \"root\""},
+		{url.Values{"action": {"delete"}, "email": {"John@example.com"}},
+			"OK: user john@example.com deleted\n"},
+		{url.Values{"action": {"delete"}, "email": {"john@example.com"}},
+			"error: unknown user: john@example.com"},
+		{url.Values{"action": {"add"}, "email": {"john@example.com"},
+			"password": {"short"}}, "error: password must have at least 8 characters"},
+		{url.Values{"action": {"rename"}, "email": {"jane@example.com"}},
+			"error: unknown action: \"rename\""},
+	} {
+		body := post(test.Values)
+		if body != test.Expected {
+			t.Fatalf("%v: expected %q, got %q", test.Values, test.Expected, body)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	err := handleAdminUsers(accounts, w, httptest.NewRequest("GET", "/users", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(w.Body.String(), "jane@example.com\tviewer\t") ||
+		strings.Count(w.Body.String(), "\n") != 1 {
+		t.Fatalf("unexpected users listing:\n%s", w.Body.String())
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+	accounts := openTempAccounts(t, env)
+	defer accounts.Close()
+
+	now := time.Now()
+	cookies := map[string]*http.Cookie{}
+	for _, role := range []string{roleViewer, roleAdmin} {
+		user, err := NewUser(role+"@example.com", "correct horse", role, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = accounts.PutUser(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := accounts.CreateSession(user.Email, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cookies[role] = &http.Cookie{Name: sessionCookie, Value: token}
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})
+	admin := RequireRole(accounts, roleAdmin, "/apec", ok)
+	private := requireViewer(accounts, "/apec", ok)
+
+	tests := []struct {
+		Handler  http.Handler
+		Method   string
+		Path     string
+		Role     string
+		Code     int
+		Location string
+	}{
+		{admin, "GET", "/admin/status", roleAdmin, 200, ""},
+		{admin, "POST", "/admin/crawl", roleViewer, 403, ""},
+		{admin, "POST", "/admin/crawl", "", 401, ""},
+		{admin, "GET", "/admin/status?x=1", "", 303,
+			"/apec/login?next=%2Fadmin%2Fstatus%3Fx%3D1"},
+		{private, "GET", "/apec/search", roleViewer, 200, ""},
+		{private, "GET", "/apec/search", roleAdmin, 200, ""},
+		{private, "GET", "/apec/search", "", 303,
+			"/apec/login?next=%2Fapec%2Fsearch"},
+		{private, "GET", "/apec/login", "", 200, ""},
+		{private, "POST", "/apec/login", "", 200, ""},
+		{private, "GET", "/apec/js/jquery.js", "", 200, ""},
+		{private, "GET", "/apec/robots.txt", "", 200, ""},
+		{private, "GET", "/apec" + apecIdPath + "1001", "", 200, ""},
+	}
+	for _, test := range tests {
+		rq := httptest.NewRequest(test.Method, test.Path, nil)
+		if test.Role != "" {
+			rq.AddCookie(cookies[test.Role])
+		}
+		w := httptest.NewRecorder()
+		test.Handler.ServeHTTP(w, rq)
+		if w.Code != test.Code || w.Header().Get("Location") != test.Location {
+			t.Fatalf("%s %s as %q: expected %d %s, got %d %s", test.Method,
+				test.Path, test.Role, test.Code, test.Location, w.Code,
+				w.Header().Get("Location"))
+		}
+	}
+}
+
+func TestAccountsAudit(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+	accounts := openTempAccounts(t, env)
+	defer accounts.Close()
+
+	// Replicas record users changes with the accounts
+	users := Audited(accounts, "/admin", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			err := handleAdminUsers(accounts, w, r)
+			if err != nil {
+				w.WriteHeader(400)
+				fmt.Fprintf(w, "error: %s\n", err)
+			}
+		}))
+	for _, password := range []string{"correct horse", "short"} {
+		values := url.Values{"action": {"add"}, "email": {"jane@example.com"},
+			"password": {password}}
+		rq := httptest.NewRequest("POST", "/admin/users",
+			strings.NewReader(values.Encode()))
+		rq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rq.Header.Set(actorHeader, "john@example.com")
+		users.ServeHTTP(httptest.NewRecorder(), rq)
+	}
+	entries, err := accounts.ListAudit(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("unexpected audit entries: %+v", entries)
+	}
+	for i, outcome := range []string{
+		"error: 400 password must have at least 8 characters",
+		"ok",
+	} {
+		e := entries[i]
+		if e.Id != uint64(2-i) || e.Actor != "john@example.com" ||
+			e.Action != "users" || e.Outcome != outcome ||
+			strings.Contains(e.Params, "password") {
+			t.Fatalf("unexpected audit entry: %+v", e)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	err = handleAdminAudit(accounts, w, httptest.NewRequest("GET",
+		"/admin/audit?max=1", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(w.Body.String(), "2\t") ||
+		strings.Count(w.Body.String(), "\n") != 1 {
+		t.Fatalf("unexpected audit listing:\n%s", w.Body.String())
+	}
+}
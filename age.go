@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search/query"
+)
+
+// Offers ages are counted in calendar days in a configurable timezone. APEC
+// publication dates are UTC timestamps: an offer published on Monday at
+// 23:30 UTC was published on Tuesday in Paris, and is one day old on
+// Wednesday there whatever the hour.
+
+var (
+	reMaxAge = regexp.MustCompile(`(?i)(?:^|\s)age<=(\d+)([dw])\b`)
+)
+
+// offerAgeDays returns the number of calendar days between the publication
+// day of an offer and the day of now, both taken in now location.
+func offerAgeDays(published, now time.Time) int {
+	y, m, d := published.In(now.Location()).Date()
+	first := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	y, m, d = now.Date()
+	today := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	days := int(today.Sub(first) / (24 * time.Hour))
+	if days < 0 {
+		return 0
+	}
+	return days
+}
+
+// formatOfferAge returns the age of search results, like "  3j".
+func formatOfferAge(days int) string {
+	return fmt.Sprintf("%3dj", days)
+}
+
+// formatAgeDetails describes the publication history of an offer initially
+// published on initialDate, in now location, and reposted duplicates times.
+func formatAgeDetails(initialDate time.Time, duplicates int,
+	now time.Time) string {
+
+	s := "first published on " +
+		initialDate.In(now.Location()).Format("2006-01-02")
+	if duplicates > 0 {
+		s += fmt.Sprintf(", reposted %d times", duplicates)
+	}
+	return s
+}
+
+// parseMaxAge extracts "age<=14d" or "age<=2w" filters from a text query. It
+// returns the remaining query, the filter or an empty string, and the maximum
+// age in days.
+func parseMaxAge(what string) (string, string, int, error) {
+	matches := reMaxAge.FindAllStringSubmatchIndex(what, -1)
+	if len(matches) == 0 {
+		return what, "", 0, nil
+	}
+	if len(matches) > 1 {
+		return "", "", 0, fmt.Errorf("only one age filter is allowed: %s", what)
+	}
+	m := matches[0]
+	days, err := strconv.Atoi(what[m[2]:m[3]])
+	if err != nil {
+		return "", "", 0, fmt.Errorf("invalid age filter: %s", err)
+	}
+	if strings.ToLower(what[m[4]:m[5]]) == "w" {
+		days *= 7
+	}
+	filter := what[m[2]-len("age<=") : m[5]]
+	rest := strings.TrimSpace(what[:m[0]] + " " + what[m[1]:])
+	return rest, filter, days, nil
+}
+
+// maxAgeCutoff returns the start of the oldest publication day of offers at
+// most maxDays old at now, in now location.
+func maxAgeCutoff(maxDays int, now time.Time) time.Time {
+	y, m, d := now.Date()
+	return time.Date(y, m, d-maxDays, 0, 0, 0, 0, now.Location())
+}
+
+// searchIdsSince returns the subset of ids documents of index published at or
+// after cutoff.
+func searchIdsSince(index bleve.Index, ids []string, cutoff time.Time) (
+	map[string]bool, error) {
+
+	published := query.NewDateRangeQuery(cutoff, time.Time{})
+	published.SetField("date")
+	found, err := searchIds(index, query.NewConjunctionQuery([]query.Query{
+		query.NewDocIDQuery(ids), published}))
+	if err != nil {
+		return nil, err
+	}
+	kept := map[string]bool{}
+	for _, id := range found {
+		kept[id] = true
+	}
+	return kept, nil
+}
+
+// filterMaxAge returns offers whose age at now is at most maxDays, in their
+// original order. Publication dates are filtered by a date range query on
+// index, or deleted for deleted offers versions, then live offers first
+// published before are dropped. Offers missing from the indexes are dropped.
+func filterMaxAge(store *Store, index bleve.Index, deleted *DeletedIndex,
+	offers []datedOffer, maxDays int, now time.Time) ([]datedOffer, error) {
+
+	cutoff := maxAgeCutoff(maxDays, now)
+	ids, deletedIds := []string{}, []string{}
+	for _, o := range offers {
+		if o.Deleted {
+			deletedIds = append(deletedIds, o.Id)
+		} else {
+			ids = append(ids, o.Id)
+		}
+	}
+	kept := map[string]bool{}
+	if len(ids) > 0 {
+		found, err := searchIdsSince(index, ids, cutoff)
+		if err != nil {
+			return nil, err
+		}
+		kept = found
+	}
+	keptDeleted := map[string]bool{}
+	if len(deletedIds) > 0 {
+		deletedIndex, err := deleted.Get()
+		if err != nil {
+			return nil, err
+		}
+		keptDeleted, err = searchIdsSince(deletedIndex, deletedIds, cutoff)
+		if err != nil {
+			return nil, err
+		}
+	}
+	filtered := []datedOffer{}
+	for _, o := range offers {
+		if o.Deleted {
+			if keptDeleted[o.Id] {
+				filtered = append(filtered, o)
+			}
+			continue
+		}
+		if !kept[o.Id] {
+			continue
+		}
+		// Reposts are as old as their initial version
+		initialDate, err := store.GetInitialDate(o.Id)
+		if err != nil {
+			return nil, err
+		}
+		if initialDate.IsZero() || !initialDate.Before(cutoff) {
+			filtered = append(filtered, o)
+		}
+	}
+	return filtered, nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pmezard/apec/jstruct"
+)
+
+func TestOfferAgeDays(t *testing.T) {
+	cet := time.FixedZone("CET", 3600)
+	published := time.Date(2017, 1, 2, 23, 30, 0, 0, time.UTC)
+	now := time.Date(2017, 1, 4, 8, 0, 0, 0, cet)
+	// Published on January 3rd in Paris
+	if d := offerAgeDays(published, now); d != 1 {
+		t.Fatalf("unexpected age in CET: %d", d)
+	}
+	if d := offerAgeDays(published, now.UTC()); d != 2 {
+		t.Fatalf("unexpected age in UTC: %d", d)
+	}
+	if d := offerAgeDays(published.Add(48*time.Hour), now); d != 0 {
+		t.Fatalf("future offers should have no age: %d", d)
+	}
+	details := formatAgeDetails(published, 2, now)
+	if details != "first published on 2017-01-03, reposted 2 times" {
+		t.Fatalf("unexpected age details: %s", details)
+	}
+}
+
+func TestParseMaxAge(t *testing.T) {
+	for _, test := range []struct {
+		Query  string
+		Rest   string
+		Filter string
+		Days   int
+	}{
+		{"python", "python", "", 0},
+		{"python age<=14d", "python", "age<=14d", 14},
+		{"AGE<=2W java or go", "java or go", "AGE<=2W", 14},
+		{"age<=0d", "", "age<=0d", 0},
+		{"page<=3d", "page<=3d", "", 0},
+	} {
+		rest, filter, days, err := parseMaxAge(test.Query)
+		if err != nil {
+			t.Fatalf("%q: %s", test.Query, err)
+		}
+		if rest != test.Rest || filter != test.Filter || days != test.Days {
+			t.Fatalf("%q: unexpected filter: %q, %q, %d", test.Query, rest, filter,
+				days)
+		}
+	}
+	_, _, _, err := parseMaxAge("age<=1d age<=2d")
+	if err == nil {
+		t.Fatalf("several age filters should be rejected")
+	}
+}
+
+func TestSearchMaxAge(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	data, err := env.Store.Get("apec:1002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = putOfferDate(env.Store, data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Fixture offers were published in 2017
+	w := env.QueryValues(url.Values{"what": {"python age<=36500d"}})
+	body := w.Body.String()
+	if w.Code != 200 || !strings.Contains(body, "3/3 offers") ||
+		!strings.Contains(body, `value="python age&lt;=36500d"`) {
+		t.Fatalf("unexpected results: %d %s", w.Code, body)
+	}
+	if !strings.Contains(body, `<span title="first published on 2017-01-03">`) {
+		t.Fatalf("age details are missing: %s", body)
+	}
+	w = env.QueryValues(url.Values{"what": {"python age<=14d"}})
+	body = w.Body.String()
+	if w.Code != 200 || !strings.Contains(body, "0/0 offers") {
+		t.Fatalf("unexpected results: %d %s", w.Code, body)
+	}
+
+	// The JSON API and exports filter results alike
+	for _, test := range []struct {
+		What  string
+		Total int
+	}{
+		{"python age<=36500d", 3},
+		{"python age<=14d", 0},
+	} {
+		w = env.SearchAPI(url.Values{"what": {test.What}})
+		page := &SearchResultsPage{}
+		err = json.Unmarshal(w.Body.Bytes(), page)
+		if err != nil {
+			t.Fatalf("%q: %s: %s", test.What, err, w.Body.String())
+		}
+		if page.Total != test.Total || page.What != test.What {
+			t.Fatalf("%q: unexpected API results: %s", test.What, w.Body.String())
+		}
+		w = env.Export(url.Values{"what": {test.What}})
+		total := w.Header().Get("X-Export-Total")
+		if w.Code != 200 || total != fmt.Sprint(test.Total) {
+			t.Fatalf("%q: unexpected export total: %d %s", test.What, w.Code,
+				total)
+		}
+	}
+}
+
+func TestFilterMaxAge(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	// apec:1004 reposts an offer first published in 2016
+	data, err := env.Store.Get("apec:1004")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = putOfferDate(env.Store, data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	js := &jstruct.JsonOffer{}
+	err = json.Unmarshal(data, js)
+	if err != nil {
+		t.Fatal(err)
+	}
+	js.Id = "1000"
+	js.Date = "2016-12-30T10:00:00.000+0000"
+	data, err = json.Marshal(js)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = putOfferDate(env.Store, data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = env.Store.Delete("apec:1005", time.Date(2017, 1, 8, 12, 0, 0, 0,
+		time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted, err := env.Deleted.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = syncDeletedIndex(env.Store, deleted, IndexOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offers := []datedOffer{
+		{Id: "apec:1006", Date: "2017-01-07T10:00:00Z"},
+		{Id: "apec:9999", Date: "2017-01-08T10:00:00Z"},
+		{Id: "apec:1001", Date: "2017-01-02T10:00:00Z"},
+		{Id: "apec:1005/1", Date: "2017-01-06T10:00:00Z", Deleted: true},
+		{Id: "apec:1004", Date: "2017-01-05T10:00:00Z"},
+		{Id: "apec:1003", Date: "2017-01-04T10:00:00Z"},
+	}
+	// At most 2 days old on January 6th in CET: published since January 3rd
+	// 23:00 UTC
+	cet := time.FixedZone("CET", 3600)
+	now := time.Date(2017, 1, 6, 8, 0, 0, 0, cet)
+	filtered, err := filterMaxAge(env.Store, env.Index, env.Deleted, offers, 2,
+		now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for _, o := range filtered {
+		ids = append(ids, o.Id)
+	}
+	if fmt.Sprint(ids) != "[apec:1006 apec:1005/1 apec:1003]" {
+		t.Fatalf("unexpected filtered offers: %v", ids)
+	}
+	if c := maxAgeCutoff(2, now); !c.Equal(time.Date(2017, 1, 3, 23, 0, 0, 0,
+		time.UTC)) {
+		t.Fatalf("unexpected cutoff: %s", c)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/blevesearch/bleve/analysis"
+)
+
+var (
+	analyzeCorpusCmd = app.Command("analyze-corpus", `report analyzed tokens statistics
+
+Run a sample of stored offers through the analyzer of the indexed field, as
+the current index mapping and search.json index options would, and report
+the most frequent tokens, the offers without any token and the average number
+of tokens per offer. Useful to tune stop words or synonyms before rebuilding
+the index. Samples are evenly spaced over offer identifiers, so successive
+runs analyze the same offers.
+`)
+	analyzeCorpusSample = analyzeCorpusCmd.Flag("sample",
+		"number of analyzed offers, 0 for all").Default("1000").Int()
+	analyzeCorpusField = analyzeCorpusCmd.Flag("field", "analyzed field").
+				Default("html").Enum("html", "title")
+	analyzeCorpusTop = analyzeCorpusCmd.Flag("top", "number of tokens to list").
+				Default("50").Int()
+)
+
+// Number of offers without token listed by identifier
+const maxEmptyOffers = 10
+
+type TokenCount struct {
+	Term string
+	// Number of occurrences
+	Count int
+	// Number of offers with the token
+	Offers int
+}
+
+type sortedTokenCounts []TokenCount
+
+func (s sortedTokenCounts) Len() int {
+	return len(s)
+}
+
+func (s sortedTokenCounts) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s sortedTokenCounts) Less(i, j int) bool {
+	if s[i].Count != s[j].Count {
+		return s[i].Count > s[j].Count
+	}
+	return s[i].Term < s[j].Term
+}
+
+type CorpusStats struct {
+	Field    string
+	Analyzer string
+	Offers   int
+	Tokens   int
+	Distinct int
+	// Identifiers of offers without token
+	Empty []string
+	// Most frequent tokens, by decreasing count
+	Top []TokenCount
+}
+
+func (s *CorpusStats) AverageTokens() float64 {
+	if s.Offers == 0 {
+		return 0
+	}
+	return float64(s.Tokens) / float64(s.Offers)
+}
+
+// sampleIds returns at most size identifiers evenly spaced in ids, or all of
+// them if size is zero.
+func sampleIds(ids []string, size int) []string {
+	if size <= 0 || size >= len(ids) {
+		return ids
+	}
+	sampled := make([]string, 0, size)
+	for i := 0; i < size; i++ {
+		sampled = append(sampled, ids[i*len(ids)/size])
+	}
+	return sampled
+}
+
+// analyzeCorpus analyzes field of a sample of stored offers and returns the
+// top most frequent tokens.
+func analyzeCorpus(store *Store, field string, options IndexOptions, sample,
+	top int) (*CorpusStats, error) {
+
+	m, err := NewOfferMapping()
+	if err != nil {
+		return nil, err
+	}
+	name := m.AnalyzerNameForPath(field)
+	analyzer := m.AnalyzerNamed(name)
+	if analyzer == nil {
+		return nil, fmt.Errorf("unknown analyzer for field %s: %s", field, name)
+	}
+	ids, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(ids)
+	stats := &CorpusStats{
+		Field:    field,
+		Analyzer: name,
+		Empty:    []string{},
+		Top:      []TokenCount{},
+	}
+	counts := map[string]*TokenCount{}
+	for _, id := range sampleIds(ids, sample) {
+		js, err := getStoreJsonOffer(store, id)
+		if err != nil {
+			return nil, err
+		}
+		if js == nil {
+			continue
+		}
+		offer, err := convertOffer(js)
+		if err != nil {
+			return nil, err
+		}
+		prepareIndexedOffer(offer, options)
+		text := offer.HTML
+		if field == "title" {
+			text = offer.Title
+		}
+		var tokens analysis.TokenStream
+		if text != "" {
+			tokens = analyzer.Analyze([]byte(text))
+		}
+		stats.Offers++
+		stats.Tokens += len(tokens)
+		if len(tokens) == 0 {
+			stats.Empty = append(stats.Empty, offer.Id)
+			continue
+		}
+		seen := map[string]bool{}
+		for _, token := range tokens {
+			term := string(token.Term)
+			c := counts[term]
+			if c == nil {
+				c = &TokenCount{Term: term}
+				counts[term] = c
+			}
+			c.Count++
+			if !seen[term] {
+				seen[term] = true
+				c.Offers++
+			}
+		}
+	}
+	stats.Distinct = len(counts)
+	for _, c := range counts {
+		stats.Top = append(stats.Top, *c)
+	}
+	sort.Sort(sortedTokenCounts(stats.Top))
+	if top > 0 && len(stats.Top) > top {
+		stats.Top = stats.Top[:top]
+	}
+	return stats, nil
+}
+
+func writeCorpusStats(w io.Writer, stats *CorpusStats) error {
+	_, err := fmt.Fprintf(w, "field: %s, analyzer: %s\n"+
+		"offers: %d, tokens: %d, distinct: %d, tokens per offer: %.1f\n"+
+		"offers without token: %d\n", stats.Field, stats.Analyzer, stats.Offers,
+		stats.Tokens, stats.Distinct, stats.AverageTokens(), len(stats.Empty))
+	if err != nil {
+		return err
+	}
+	for i, id := range stats.Empty {
+		if i >= maxEmptyOffers {
+			_, err = fmt.Fprintf(w, "  ...\n")
+			if err != nil {
+				return err
+			}
+			break
+		}
+		_, err = fmt.Fprintf(w, "  %s\n", id)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "\n%8s %8s %8s  %s\n", "count", "offers", "offers%",
+		"token")
+	if err != nil {
+		return err
+	}
+	for _, c := range stats.Top {
+		_, err = fmt.Fprintf(w, "%8d %8d %8.1f  %s\n", c.Count, c.Offers,
+			100*float64(c.Offers)/float64(stats.Offers), c.Term)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func analyzeCorpusFn(cfg *Config) error {
+	store, err := OpenStoreReadOnly(cfg.Store())
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	searchCfg, err := loadSearchConfig(cfg.Search())
+	if err != nil {
+		return err
+	}
+	stats, err := analyzeCorpus(store, *analyzeCorpusField, searchCfg.Index,
+		*analyzeCorpusSample, *analyzeCorpusTop)
+	if err != nil {
+		return err
+	}
+	return writeCorpusStats(os.Stdout, stats)
+}
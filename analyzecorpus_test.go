@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSampleIds(t *testing.T) {
+	ids := []string{"a", "b", "c", "d", "e", "f"}
+	for _, test := range []struct {
+		Size     int
+		Expected string
+	}{
+		{0, "[a b c d e f]"},
+		{3, "[a c e]"},
+		{4, "[a b d e]"},
+		{10, "[a b c d e f]"},
+	} {
+		s := fmt.Sprint(sampleIds(ids, test.Size))
+		if s != test.Expected {
+			t.Fatalf("%d: expected %s, got %s", test.Size, test.Expected, s)
+		}
+	}
+}
+
+func TestAnalyzeCorpus(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	stats, err := analyzeCorpus(env.Store, "title", IndexOptions{}, 0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	top := fmt.Sprint(stats.Top)
+	if stats.Offers != 6 || stats.Tokens != 11 || stats.Distinct != 9 ||
+		len(stats.Empty) != 0 ||
+		top != "[{developeu 2 2} {python 2 2} {architect 1 1}]" {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	buf := &bytes.Buffer{}
+	err = writeCorpusStats(buf, stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"offers: 6, tokens: 11, distinct: 9, tokens per offer: 1.8\n",
+		"       2        2     33.3  python\n",
+	} {
+		if !strings.Contains(buf.String(), s) {
+			t.Fatalf("%q is missing from:\n%s", s, buf.String())
+		}
+	}
+
+	// Offers without indexed description have no token
+	stats, err = analyzeCorpus(env.Store, "html", IndexOptions{SkipHTML: true},
+		2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Offers != 2 || stats.Tokens != 0 || len(stats.Empty) != 2 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
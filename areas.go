@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jonas-p/go-shp"
+)
+
+// Geocoded offers are assigned to a French department and region, looked up
+// from their coordinates in the departements and regions shapefiles when they
+// were fetched, or taken from the county and state of their geocoded
+// location otherwise, like gazetteer locations. Areas are cached in the store
+// areas bucket, indexed as keywords and matched with "department:gironde",
+// "department:33" or "region:ile-de-france" query terms.
+
+const (
+	departmentField       = "department"
+	regionField           = "region"
+	departmentQueryPrefix = "department:"
+	regionQueryPrefix     = "region:"
+)
+
+var (
+	reAreaSeparators = regexp.MustCompile(`[^\p{L}\p{N}]+`)
+)
+
+// normalizeAreaTerm returns name in lowercase without diacritics, with every
+// sequence of other characters than letters and digits replaced by a dash.
+func normalizeAreaTerm(name string) string {
+	name = strings.ToLower(removeDiacritics(nfdString(name)))
+	name = reAreaSeparators.ReplaceAllString(name, "-")
+	return strings.Trim(name, "-")
+}
+
+// areaTerms returns the indexed terms of an area name and code.
+func areaTerms(name, code string) []string {
+	terms := []string{}
+	for _, s := range []string{name, code} {
+		if t := normalizeAreaTerm(s); t != "" {
+			terms = append(terms, t)
+		}
+	}
+	return terms
+}
+
+// Area is a department or region border.
+type Area struct {
+	Code    string
+	Name    string
+	box     shp.Box
+	polygon *shp.Polygon
+}
+
+// Contains returns true if lat/lon is inside the area. Parts of the polygon
+// are combined with the even-odd rule, so holes are excluded.
+func (a *Area) Contains(lat, lon float64) bool {
+	if lon < a.box.MinX || lon > a.box.MaxX || lat < a.box.MinY || lat > a.box.MaxY {
+		return false
+	}
+	poly := a.polygon
+	inside := false
+	for i, start := range poly.Parts {
+		end := len(poly.Points)
+		if i+1 < len(poly.Parts) {
+			end = int(poly.Parts[i+1])
+		}
+		part := poly.Points[start:end]
+		for j, k := 0, len(part)-1; j < len(part); k, j = j, j+1 {
+			p, q := part[j], part[k]
+			if (p.Y > lat) != (q.Y > lat) &&
+				lon < (q.X-p.X)*(lat-p.Y)/(q.Y-p.Y)+p.X {
+				inside = !inside
+			}
+		}
+	}
+	return inside
+}
+
+func shapeFieldIndex(fields []shp.Field, name string) int {
+	for i, f := range fields {
+		n := strings.TrimRight(string(f.Name[:]), "\x00")
+		if strings.EqualFold(n, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// trimAttribute removes the padding of dbf values, spaces or zeros depending
+// on the writer.
+func trimAttribute(s string) string {
+	return strings.Trim(s, " \x00")
+}
+
+// loadAreas reads the polygons of a departments or regions shapefile, with
+// their code_insee and nom attributes.
+func loadAreas(path string) ([]*Area, error) {
+	reader, err := shp.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	fields := reader.Fields()
+	codeField := shapeFieldIndex(fields, "code_insee")
+	nameField := shapeFieldIndex(fields, "nom")
+	if codeField < 0 || nameField < 0 {
+		return nil, fmt.Errorf("%s has no code_insee or nom attribute", path)
+	}
+	areas := []*Area{}
+	for reader.Next() {
+		n, s := reader.Shape()
+		poly, ok := s.(*shp.Polygon)
+		if !ok {
+			continue
+		}
+		areas = append(areas, &Area{
+			Code:    trimAttribute(reader.ReadAttribute(n, codeField)),
+			Name:    trimAttribute(reader.ReadAttribute(n, nameField)),
+			box:     poly.BBox(),
+			polygon: poly,
+		})
+	}
+	return areas, nil
+}
+
+func locateArea(areas []*Area, lat, lon float64) *Area {
+	for _, a := range areas {
+		if a.Contains(lat, lon) {
+			return a
+		}
+	}
+	return nil
+}
+
+// Areas holds departments and regions borders, either can be empty.
+type Areas struct {
+	Departments []*Area
+	Regions     []*Area
+}
+
+// LoadAreas reads the departements and regions shapefiles fetched in dir,
+// ignoring missing ones.
+func LoadAreas(dir string) (*Areas, error) {
+	areas := &Areas{}
+	for _, name := range []string{"departements", "regions"} {
+		s, err := findShapeSource(name)
+		if err != nil {
+			return nil, err
+		}
+		path := s.Path(dir, ".shp")
+		ok, err := isFile(path)
+		if err != nil || !ok {
+			continue
+		}
+		loaded, err := loadAreas(path)
+		if err != nil {
+			return nil, err
+		}
+		if name == "departements" {
+			areas.Departments = loaded
+		} else {
+			areas.Regions = loaded
+		}
+	}
+	return areas, nil
+}
+
+// departmentFromPostCode returns the department code of a French postcode,
+// or an empty string.
+func departmentFromPostCode(postCode string) string {
+	if len(postCode) != 5 || strings.Trim(postCode, "0123456789") != "" {
+		return ""
+	}
+	switch {
+	case strings.HasPrefix(postCode, "97"), strings.HasPrefix(postCode, "98"):
+		return postCode[:3]
+	case strings.HasPrefix(postCode, "20"):
+		// Corsica postcodes do not follow its departments codes
+		if postCode < "20200" {
+			return "2A"
+		}
+		return "2B"
+	}
+	return postCode[:2]
+}
+
+// assignArea returns the department and region of loc, from areas borders if
+// not nil, or its geocoded components. It returns nil for nationwide or
+// unknown areas.
+func assignArea(areas *Areas, loc *Location) *OfferArea {
+	if loc == nil || loc.Nationwide {
+		return nil
+	}
+	area := &OfferArea{
+		Department:     loc.County,
+		DepartmentCode: departmentFromPostCode(loc.PostCode),
+		Region:         loc.State,
+		Lat:            loc.Lat,
+		Lon:            loc.Lon,
+	}
+	if areas != nil {
+		if a := locateArea(areas.Departments, loc.Lat, loc.Lon); a != nil {
+			area.Department, area.DepartmentCode = a.Name, a.Code
+		}
+		if a := locateArea(areas.Regions, loc.Lat, loc.Lon); a != nil {
+			area.Region, area.RegionCode = a.Name, a.Code
+		}
+	}
+	if area.Department == "" && area.Region == "" {
+		return nil
+	}
+	return area
+}
+
+// computeOfferArea returns the area of offer id, and true if it differs from
+// the cached one. The cached area is returned if it is up-to-date and force
+// is false.
+func computeOfferArea(store *Store, areas *Areas, id string,
+	force bool) (*OfferArea, bool, error) {
+
+	loc, _, err := store.GetLocation(id)
+	if err != nil {
+		return nil, false, err
+	}
+	cached, err := store.GetOfferArea(id)
+	if err != nil {
+		return nil, false, err
+	}
+	if !force && cached != nil && loc != nil && !loc.Nationwide &&
+		cached.Lat == loc.Lat && cached.Lon == loc.Lon {
+		return cached, false, nil
+	}
+	area := assignArea(areas, loc)
+	if area == nil && cached == nil {
+		return nil, false, nil
+	}
+	return area, true, nil
+}
+
+// updateOfferArea returns the area of offer id, assigning and caching it
+// unless an up-to-date one is already cached and force is false.
+func updateOfferArea(store *Store, areas *Areas, id string,
+	force bool) (*OfferArea, error) {
+
+	area, changed, err := computeOfferArea(store, areas, id, force)
+	if err != nil || !changed {
+		return area, err
+	}
+	return area, store.PutOfferArea(id, area)
+}
+
+var (
+	areasCmd = app.Command("areas", `assign offers to departments and regions
+
+Cache the department and region of every geocoded offer, from the departements
+and regions shapefiles downloaded by fetch-shapes, or from geocoded locations
+otherwise. Areas are assigned when offers are indexed, run it with --force
+after fetching shapefiles, then rebuild the index.
+`)
+	areasForce = areasCmd.Flag("force", "assign cached areas again").Bool()
+)
+
+func areasFn(cfg *Config) error {
+	areas, err := LoadAreas(cfg.ShapesDir)
+	if err != nil {
+		return err
+	}
+	store, err := OpenStore(cfg.Store())
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	ids, err := store.List()
+	if err != nil {
+		return err
+	}
+	assigned := 0
+	departments := map[string]bool{}
+	progress := NewProgress("areas", len(ids))
+	for _, id := range ids {
+		progress.Add(1)
+		area, err := updateOfferArea(store, areas, id, *areasForce)
+		if err != nil {
+			return err
+		}
+		if area != nil {
+			assigned++
+			departments[area.Department] = true
+		}
+	}
+	progress.Done()
+	fmt.Printf("%d departments and %d regions borders, %d offers assigned to "+
+		"%d departments\n", len(areas.Departments), len(areas.Regions), assigned,
+		len(departments))
+	return nil
+}
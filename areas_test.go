@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jonas-p/go-shp"
+)
+
+// writeAreasShapefile writes square areas of side 2 degrees centered on
+// supplied points, with code_insee and nom attributes.
+func writeAreasShapefile(t *testing.T, path string, areas [][4]string) {
+	w, err := shp.Create(path, shp.POLYGON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = w.SetFields([]shp.Field{
+		shp.StringField("code_insee", 8),
+		shp.StringField("nom", 40),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, a := range areas {
+		lat, lon := 0.0, 0.0
+		fmt.Sscanf(a[2]+" "+a[3], "%f %f", &lat, &lon)
+		poly := shp.NewPolyLine([][]shp.Point{{
+			{X: lon - 1, Y: lat - 1},
+			{X: lon - 1, Y: lat + 1},
+			{X: lon + 1, Y: lat + 1},
+			{X: lon + 1, Y: lat - 1},
+			{X: lon - 1, Y: lat - 1},
+		}})
+		n := w.Write(&shp.Polygon{Box: poly.Box, NumParts: poly.NumParts,
+			NumPoints: poly.NumPoints, Parts: poly.Parts, Points: poly.Points})
+		if int(n) != i {
+			t.Fatalf("unexpected shape number %d", n)
+		}
+		w.WriteAttribute(i, 0, a[0])
+		w.WriteAttribute(i, 1, a[1])
+	}
+	w.Close()
+	// go-shp writers forget the dot before the dbf extension
+	base := strings.TrimSuffix(path, ".shp")
+	err = os.Rename(base+"dbf", base+".dbf")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAssignAreas(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	// Without shapefiles, areas come from geocoded locations
+	for _, test := range []struct {
+		Query    string
+		Expected string
+	}{
+		{"department:gironde", "[apec:1004]"},
+		{"department:Rhône", "[apec:1003]"},
+		{"department:rhone", "[apec:1003]"},
+		{"region:Île-de-France", "[apec:1001 apec:1002]"},
+		{"region:france", "[]"},
+		{"java and region:nouvelle-aquitaine", "[apec:1004]"},
+	} {
+		q, err := makeSearchQuery(test.Query, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids, err := searchIds(env.Index, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(ids)
+		if fmt.Sprint(ids) != test.Expected {
+			t.Fatalf("%s: expected %s, got %v", test.Query, test.Expected, ids)
+		}
+	}
+	offers := []datedOffer{}
+	for _, id := range []string{"apec:1001", "apec:1002", "apec:1003",
+		"apec:1005", "apec:1006"} {
+		offers = append(offers, datedOffer{Id: id})
+	}
+	facets, _, err := filterFacets(env.Store, env.Facets, offers, url.Values{},
+		1, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	areaFacets := []string{}
+	for _, f := range facets {
+		if f.Name == facetDepartment || f.Name == facetRegion {
+			areaFacets = append(areaFacets, fmt.Sprint(f.Values[0].Key, " ",
+				f.Values[0].Name, " ", f.Values[0].Count))
+		}
+	}
+	if fmt.Sprint(areaFacets) != "[paris Paris 2 ile-de-france Ile-de-France 2]" {
+		t.Fatalf("unexpected facets: %v", areaFacets)
+	}
+	// Areas are listed once, by the sidebar facets
+	body := env.Query("", "").Body.String()
+	if !strings.Contains(body, `<a href="?region=nouvelle-aquitaine">Nouvelle-Aquitaine</a> (1)`) ||
+		strings.Count(body, ">Gironde</a>") != 1 {
+		t.Fatalf("areas facets are missing or repeated:\n%s", body)
+	}
+
+	// Shapefiles borders take precedence, and are cached with locations
+	dir, err := ioutil.TempDir("", "apec-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeAreasShapefile(t, filepath.Join(dir, "departements-20180101.shp"),
+		[][4]string{{"69", "Rhône", "45.75", "4.83"}, {"75", "Paris", "48.85", "2.35"}})
+	writeAreasShapefile(t, filepath.Join(dir, "regions-20180101.shp"),
+		[][4]string{{"84", "Auvergne-Rhône-Alpes", "45.75", "4.83"}})
+	areas, err := LoadAreas(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(areas.Departments) != 2 || len(areas.Regions) != 1 {
+		t.Fatalf("unexpected areas: %+v", areas)
+	}
+	area, err := updateOfferArea(env.Store, areas, "apec:1003", false)
+	if err != nil || area.DepartmentCode != "" {
+		t.Fatalf("cached area was not used: %+v, %v", area, err)
+	}
+	area, err = updateOfferArea(env.Store, areas, "apec:1003", true)
+	if err != nil || area.DepartmentCode != "69" || area.RegionCode != "84" {
+		t.Fatalf("unexpected shapefile area: %+v, %v", area, err)
+	}
+	// Bordeaux is outside the borders
+	area, err = updateOfferArea(env.Store, areas, "apec:1004", true)
+	if err != nil || area.Department != "Gironde" || area.DepartmentCode != "" {
+		t.Fatalf("unexpected geocoded area: %+v, %v", area, err)
+	}
+	for _, id := range []string{"apec:1005", "apec:1006"} {
+		area, err = updateOfferArea(env.Store, areas, id, true)
+		if err != nil || area != nil {
+			t.Fatalf("%s should have no area: %+v, %v", id, area, err)
+		}
+	}
+	offer, err := getExportedOffer(env.Store, "apec:1003")
+	if err != nil || offer.Area == nil || offer.Area.Department != "Rhône" {
+		t.Fatalf("area is not exported: %+v, %v", offer, err)
+	}
+}
+
+func TestAreaContains(t *testing.T) {
+	// A square with a square hole
+	poly := shp.NewPolyLine([][]shp.Point{
+		{{X: 0, Y: 0}, {X: 0, Y: 4}, {X: 4, Y: 4}, {X: 4, Y: 0}, {X: 0, Y: 0}},
+		{{X: 1, Y: 1}, {X: 3, Y: 1}, {X: 3, Y: 3}, {X: 1, Y: 3}, {X: 1, Y: 1}},
+	})
+	a := &Area{
+		box: poly.Box,
+		polygon: &shp.Polygon{Box: poly.Box, NumParts: poly.NumParts,
+			NumPoints: poly.NumPoints, Parts: poly.Parts, Points: poly.Points},
+	}
+	for _, test := range []struct {
+		Lat, Lon float64
+		Inside   bool
+	}{
+		{0.5, 0.5, true},
+		{3.5, 2, true},
+		{2, 2, false},
+		{5, 2, false},
+		{2, -1, false},
+	} {
+		if a.Contains(test.Lat, test.Lon) != test.Inside {
+			t.Fatalf("%v,%v: expected inside=%v", test.Lat, test.Lon, test.Inside)
+		}
+	}
+
+	for _, test := range [][2]string{
+		{"33000", "33"},
+		{"97400", "974"},
+		{"20090", "2A"},
+		{"20200", "2B"},
+		{"3300", ""},
+		{"", ""},
+	} {
+		if code := departmentFromPostCode(test[0]); code != test[1] {
+			t.Fatalf("%q: expected %q, got %q", test[0], test[1], code)
+		}
+	}
+}
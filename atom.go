@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Searches can be subscribed to as Atom feeds listing the most recent
+// matching offers, so feed readers report new ones.
+
+const (
+	atomXmlns = "http://www.w3.org/2005/Atom"
+	// Number of offers listed in feeds
+	maxFeedEntries = 50
+)
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	Id        string      `xml:"id"`
+	Title     string      `xml:"title"`
+	Link      atomLink    `xml:"link"`
+	Published string      `xml:"published"`
+	Updated   string      `xml:"updated"`
+	Author    *atomAuthor `xml:"author,omitempty"`
+	Summary   *atomText   `xml:"summary,omitempty"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name     `xml:"feed"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	Id      string       `xml:"id"`
+	Title   string       `xml:"title"`
+	Updated string       `xml:"updated"`
+	Links   []atomLink   `xml:"link"`
+	Author  atomAuthor   `xml:"author"`
+	Entries []*atomEntry `xml:"entry"`
+}
+
+// formatSalaryLine returns offer location and salary range, like
+// "Paris, 45-55 kEUR".
+func formatSalaryLine(offer *Offer) string {
+	line := offer.Location
+	if offer.MinSalary > 0 {
+		if line != "" {
+			line += ", "
+		}
+		if offer.MaxSalary != offer.MinSalary {
+			line += fmt.Sprintf("%d-%d kEUR", offer.MinSalary, offer.MaxSalary)
+		} else {
+			line += fmt.Sprintf("%d kEUR", offer.MinSalary)
+		}
+	}
+	return line
+}
+
+// buildSearchFeed returns the feed of the most recent offers, whose
+// search page is searchURL. Its identifier is the feed URL.
+func buildSearchFeed(store *Store, offers []datedOffer, what, where,
+	searchURL, feedURL string) (*atomFeed, error) {
+
+	sorted := append(exportedOffers{}, offers...)
+	sort.Sort(sorted)
+	title := "APEC offers"
+	if terms := strings.TrimSpace(what + " " + where); terms != "" {
+		title += ": " + terms
+	}
+	feed := &atomFeed{
+		Xmlns: atomXmlns,
+		Id:    feedURL,
+		Title: title,
+		Links: []atomLink{
+			{Href: feedURL, Rel: "self", Type: "application/atom+xml"},
+			{Href: searchURL, Rel: "alternate", Type: "text/html"},
+		},
+		Author:  atomAuthor{Name: "APEC"},
+		Entries: []*atomEntry{},
+	}
+	updated := time.Time{}
+	for _, o := range sorted {
+		if len(feed.Entries) >= maxFeedEntries {
+			break
+		}
+		offer, err := getStoreOffer(store, o.Id)
+		if err != nil {
+			return nil, err
+		}
+		if offer == nil {
+			continue
+		}
+		if offer.Date.After(updated) {
+			updated = offer.Date
+		}
+		date := offer.Date.UTC().Format(time.RFC3339)
+		entry := &atomEntry{
+			Id:        offer.URL,
+			Title:     offer.Title,
+			Link:      atomLink{Href: offer.URL},
+			Published: date,
+			Updated:   date,
+		}
+		if offer.Account != "" {
+			entry.Author = &atomAuthor{Name: offer.Account}
+		}
+		if line := formatSalaryLine(offer); line != "" {
+			entry.Summary = &atomText{Type: "text", Body: line}
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+	// Feeds must have an update date, even empty ones
+	if updated.IsZero() {
+		updated = time.Unix(0, 0)
+	}
+	feed.Updated = updated.UTC().Format(time.RFC3339)
+	return feed, nil
+}
+
+func writeAtomFeed(w io.Writer, feed *atomFeed) error {
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	err = enc.Encode(feed)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
+
+// serveSearchFeed writes the Atom feed of offers matching "what", "where"
+// and "include_remote" parameters. Feed links are absolute, on baseURL, or
+// publicURL on the requested host if it is empty.
+func serveSearchFeed(sc *SearchContext, baseURL, publicURL string,
+	w http.ResponseWriter, r *http.Request) error {
+
+	rep := sc.Replica
+	store := rep.Store
+
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		return err
+	}
+	what := strings.TrimSpace(values.Get("what"))
+	where := strings.TrimSpace(values.Get("where"))
+	includeRemote := values.Get("include_remote") == "1"
+	offers, err := findExportedOffers(store, rep.Index.Get(), rep.Spatial,
+		rep.Geocoder, sc.Router, sc.Limits, sc.Fields, sc.Backend, what, where,
+		includeRemote, time.Now().In(sc.Loc))
+	if err != nil {
+		return err
+	}
+	if baseURL == "" {
+		baseURL = requestBaseURL(r, publicURL)
+	}
+	baseURL = strings.TrimRight(baseURL, "/")
+	query := url.Values{}
+	query.Set("what", what)
+	query.Set("where", where)
+	if includeRemote {
+		query.Set("include_remote", "1")
+	}
+	feed, err := buildSearchFeed(store, offers, what, where,
+		baseURL+"/search?"+query.Encode(), baseURL+"/search.atom?"+query.Encode())
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	return writeAtomFeed(w, feed)
+}
+
+func handleSearchFeed(sc *SearchContext, baseURL, publicURL string,
+	w http.ResponseWriter, r *http.Request) {
+
+	err := serveSearchFeed(sc, baseURL, publicURL, w, r)
+	if err != nil {
+		log.Printf("error: search feed failed with: %s", err)
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "error: %s\n", err)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestSearchFeed(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	rsp := env.Get(func(w http.ResponseWriter, r *http.Request) {
+		handleSearchFeed(env.SearchContext(), "", "/apec", w, r)
+	}, "/apec/search.atom", url.Values{"what": {"python"}})
+	if rsp.Code != 200 {
+		t.Fatalf("feed failed: %d %s", rsp.Code, rsp.Body.String())
+	}
+	feed := &atomFeed{}
+	err := xml.Unmarshal(rsp.Body.Bytes(), feed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	titles := []string{}
+	for _, e := range feed.Entries {
+		titles = append(titles, e.Title)
+	}
+	if feed.Title != "APEC offers: python" ||
+		feed.Id != "http://example.com/apec/search.atom?what=python&where=" ||
+		feed.Updated != "2017-01-05T10:00:00Z" ||
+		fmt.Sprint(titles) != "[Ingénieur Java H/F Développeur Python H/F "+
+			"Développeur Go H/F]" {
+		t.Fatalf("unexpected feed:\n%s", rsp.Body.String())
+	}
+	e := feed.Entries[2]
+	if e.Link.Href != ApecURL+"1001" || e.Published != "2017-01-02T10:00:00Z" ||
+		e.Author == nil || e.Author.Name != "ACME" || e.Summary == nil ||
+		e.Summary.Body != "Paris, 45-55 kEUR" {
+		t.Fatalf("unexpected entry:\n%s", rsp.Body.String())
+	}
+
+	body := env.Query("python", "paris").Body.String()
+	link := `href="search.atom?what=python&amp;where=paris"`
+	if !strings.Contains(body, link) {
+		t.Fatalf("feed link is missing:\n%s", body)
+	}
+}
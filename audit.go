@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Admin actions, like crawling, reindexing, deleting offers or scrubbing
+// them, are recorded in the store audit bucket, so teams sharing a
+// deployment can tell who did what. Web replicas cannot write the store,
+// they record users changes in the accounts database audit bucket.
+
+const (
+	// actorHeader carries the logged in user performing an admin request. web
+	// sets it when accounts are enabled, and removes it from incoming
+	// requests otherwise.
+	actorHeader = "X-Apec-Actor"
+	// Error responses are truncated to this size in audit entries
+	maxAuditOutcome = 256
+)
+
+type AuditEntry struct {
+	Id     uint64    `json:"id"`
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	Action string    `json:"action"`
+	Params string    `json:"params,omitempty"`
+	// "ok" or an error message
+	Outcome string `json:"outcome"`
+}
+
+// AuditLog records audit entries, like Store and Accounts.
+type AuditLog interface {
+	AppendAudit(entry *AuditEntry) error
+	ListAudit(before uint64, max int) ([]*AuditEntry, error)
+}
+
+// appendAuditEntry stores entry in audit bucket b and sets its identifier.
+func appendAuditEntry(b kvBucket, entry *AuditEntry) error {
+	id, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+	entry.Id = id
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	// Big-endian keys iterate in insertion order
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return b.Put(key, data)
+}
+
+// listAuditEntries returns at most max entries of audit bucket b older than
+// before, most recent first. before and max are ignored when zero.
+func listAuditEntries(b kvBucket, before uint64, max int) ([]*AuditEntry, error) {
+	entries := []*AuditEntry{}
+	c := b.Cursor()
+	k, v := c.Last()
+	if before > 0 {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, before)
+		k, v = c.Seek(key)
+		if k == nil {
+			k, v = c.Last()
+		} else {
+			k, v = c.Prev()
+		}
+	}
+	for ; k != nil && (max <= 0 || len(entries) < max); k, v = c.Prev() {
+		entry := &AuditEntry{}
+		err := json.Unmarshal(v, entry)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// NewAuditEntry returns an entry for action performed by actor, which
+// failed if err is not nil.
+func NewAuditEntry(actor, action, params string, err error,
+	now time.Time) *AuditEntry {
+
+	outcome := "ok"
+	if err != nil {
+		outcome = "error: " + err.Error()
+	}
+	return &AuditEntry{
+		Time:    now,
+		Actor:   actor,
+		Action:  action,
+		Params:  params,
+		Outcome: outcome,
+	}
+}
+
+// cliActor identifies the user running a command.
+func cliActor() string {
+	user := os.Getenv("USER")
+	if user == "" {
+		user = "unknown"
+	}
+	return "cli:" + user
+}
+
+// requestActor identifies the user performing r by the actor header, only
+// set on authenticated requests, or by the client address. Behind a local
+// reverse proxy, the client is the last X-Forwarded-For hop, the one
+// appended by the proxy, previous ones are sent by clients and can be forged.
+func requestActor(r *http.Request) string {
+	actor := r.Header.Get(actorHeader)
+	if actor != "" {
+		return actor
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip != nil && ip.IsLoopback() {
+		hops := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+		last := strings.TrimSpace(hops[len(hops)-1])
+		if last != "" {
+			return last
+		}
+	}
+	return host
+}
+
+type auditOutcomeKey struct{}
+
+// setAuditOutcome replaces the "ok" outcome recorded by Audited for r, like
+// "started" for requests starting background jobs.
+func setAuditOutcome(r *http.Request, outcome string) {
+	if p, ok := r.Context().Value(auditOutcomeKey{}).(*string); ok {
+		*p = outcome
+	}
+}
+
+// auditParams returns r form values, except passwords.
+func auditParams(r *http.Request) string {
+	r.ParseForm()
+	params := url.Values{}
+	for k, v := range r.Form {
+		if k != "password" {
+			params[k] = v
+		}
+	}
+	return params.Encode()
+}
+
+// auditJob returns a function recording the outcome of the background job
+// started by r in store audit log, under action.
+func auditJob(store *Store, action string, r *http.Request) func(error) {
+	actor := requestActor(r)
+	params := auditParams(r)
+	return func(err error) {
+		if err != nil {
+			log.Printf("%s started by %s failed: %s", action, actor, err)
+		} else {
+			log.Printf("%s started by %s done", action, actor)
+		}
+		err = store.AppendAudit(NewAuditEntry(actor, action, params, err,
+			time.Now()))
+		if err != nil {
+			log.Printf("error: cannot record audit entry: %s", err)
+		}
+	}
+}
+
+// auditRecorder captures the status code and the beginning of error
+// responses.
+type auditRecorder struct {
+	http.ResponseWriter
+	code int
+	body bytes.Buffer
+}
+
+func (r *auditRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *auditRecorder) Write(data []byte) (int, error) {
+	if r.code >= 400 && r.body.Len() < maxAuditOutcome {
+		r.body.Write(data)
+	}
+	return r.ResponseWriter.Write(data)
+}
+
+// Audited records POST requests served by handler in auditLog. The action is
+// the request path relative to prefix. Passwords are not recorded. Handlers
+// starting background jobs report their outcome with auditJob.
+func Audited(auditLog AuditLog, prefix string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		params := auditParams(r)
+		outcome := ""
+		r = r.WithContext(context.WithValue(r.Context(), auditOutcomeKey{},
+			&outcome))
+		rec := &auditRecorder{
+			ResponseWriter: w,
+			code:           http.StatusOK,
+		}
+		handler.ServeHTTP(rec, r)
+		var err error
+		if rec.code >= 400 {
+			msg := strings.TrimSpace(rec.body.String())
+			if len(msg) > maxAuditOutcome {
+				msg = msg[:maxAuditOutcome]
+			}
+			err = fmt.Errorf("%d %s", rec.code, strings.TrimPrefix(msg, "error: "))
+		}
+		entry := NewAuditEntry(requestActor(r),
+			strings.TrimPrefix(r.URL.Path, prefix+"/"), params, err, time.Now())
+		if err == nil && outcome != "" {
+			entry.Outcome = outcome
+		}
+		err = auditLog.AppendAudit(entry)
+		if err != nil {
+			log.Printf("error: cannot record audit entry: %s", err)
+		}
+	})
+}
+
+// handleAdminAudit lists audit entries, most recent first. The before
+// parameter pages through older entries, max bounds their number, 100 by
+// default and unlimited if zero. format=json exports them as JSON lines.
+func handleAdminAudit(auditLog AuditLog, w http.ResponseWriter,
+	r *http.Request) error {
+
+	var before uint64
+	var err error
+	if s := r.FormValue("before"); s != "" {
+		before, err = strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid before: %s", err)
+		}
+	}
+	max := 100
+	if s := r.FormValue("max"); s != "" {
+		max, err = strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("invalid max: %s", err)
+		}
+	}
+	entries, err := auditLog.ListAudit(before, max)
+	if err != nil {
+		return err
+	}
+	if r.FormValue("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="audit.json"`)
+		for _, e := range entries {
+			data, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(append(data, '\n'))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, e := range entries {
+		_, err = fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", e.Id,
+			e.Time.Format(time.RFC3339), e.Actor, e.Action, e.Params, e.Outcome)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
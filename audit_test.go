@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListAudit(t *testing.T) {
+	store := openTempStore(t)
+	defer closeAndDeleteStore(t, store)
+
+	now := time.Date(2017, 1, 2, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 300; i++ {
+		err := store.AppendAudit(NewAuditEntry("jane", "crawl", "", nil, now))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids := func(entries []*AuditEntry) string {
+		s := []string{}
+		for _, e := range entries {
+			s = append(s, fmt.Sprint(e.Id))
+		}
+		return strings.Join(s, ",")
+	}
+	tests := []struct {
+		Before   uint64
+		Max      int
+		Expected string
+	}{
+		{0, 3, "300,299,298"},
+		{299, 2, "298,297"},
+		{3, 0, "2,1"},
+		{1, 0, ""},
+		{1000, 1, "300"},
+	}
+	for _, test := range tests {
+		entries, err := store.ListAudit(test.Before, test.Max)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ids(entries); got != test.Expected {
+			t.Fatalf("%d, %d: expected %s, got %s", test.Before, test.Max,
+				test.Expected, got)
+		}
+	}
+	entries, err := store.ListAudit(0, 0)
+	if err != nil || len(entries) != 300 {
+		t.Fatalf("unexpected entries: %d, %v", len(entries), err)
+	}
+}
+
+func TestAudited(t *testing.T) {
+	store := openTempStore(t)
+	defer closeAndDeleteStore(t, store)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("action") == "fail" {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "error: cannot %s\n", r.URL.Path)
+			return
+		}
+		w.Write([]byte("OK"))
+	})
+	audited := Audited(store, "/admin", handler)
+	do := func(method, path, actor string, values url.Values) {
+		rq := httptest.NewRequest(method, path, strings.NewReader(values.Encode()))
+		rq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if actor != "" {
+			rq.Header.Set(actorHeader, actor)
+		}
+		w := httptest.NewRecorder()
+		audited.ServeHTTP(w, rq)
+	}
+	do("POST", "/admin/crawl", "jane@example.com", url.Values{"html": {"1"}})
+	do("GET", "/admin/status", "jane@example.com", nil)
+	do("POST", "/admin/offer/1001", "", url.Values{"action": {"fail"}})
+	do("POST", "/admin/users", "jane@example.com", url.Values{
+		"action":   {"add"},
+		"email":    {"john@example.com"},
+		"password": {"correct horse"},
+	})
+
+	entries, err := store.ListAudit(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, e := range entries {
+		got = append(got, fmt.Sprintf("%s|%s|%s|%s", e.Actor, e.Action, e.Params,
+			e.Outcome))
+	}
+	expected := []string{
+		"jane@example.com|users|action=add&email=john%40example.com|ok",
+		"192.0.2.1|offer/1001|action=fail|error: 400 cannot /admin/offer/1001",
+		"jane@example.com|crawl|html=1|ok",
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected audit entries:\n%s\n!=\n%s", strings.Join(got, "\n"),
+			strings.Join(expected, "\n"))
+	}
+
+	w := httptest.NewRecorder()
+	err = handleAdminAudit(store, w, httptest.NewRequest("GET",
+		"/admin/audit?format=json&max=1&before=3", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := &AuditEntry{}
+	err = json.Unmarshal(w.Body.Bytes(), entry)
+	if err != nil || entry.Id != 2 || entry.Action != "offer/1001" {
+		t.Fatalf("unexpected exported entry: %v\n%s", err, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	err = handleAdminAudit(store, w, httptest.NewRequest("GET", "/admin/audit", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(w.Body.String(), "\n") != 3 ||
+		!strings.HasPrefix(w.Body.String(), "3\t") {
+		t.Fatalf("unexpected audit listing:\n%s", w.Body.String())
+	}
+}
+
+func TestRequestActor(t *testing.T) {
+	for _, test := range []struct {
+		Remote    string
+		Actor     string
+		Forwarded []string
+		Expected  string
+	}{
+		{"192.0.2.1:1234", "jane@example.com", nil, "jane@example.com"},
+		{"192.0.2.1:1234", "", nil, "192.0.2.1"},
+		// Only a local proxy is trusted, and only for the hop it appended
+		{"192.0.2.1:1234", "", []string{"198.51.100.1"}, "192.0.2.1"},
+		{"127.0.0.1:1234", "", []string{"10.0.0.1, 198.51.100.1"},
+			"198.51.100.1"},
+		{"[::1]:1234", "", []string{"10.0.0.1", "198.51.100.2"}, "198.51.100.2"},
+		{"127.0.0.1:1234", "", nil, "127.0.0.1"},
+	} {
+		rq := httptest.NewRequest("POST", "/admin/crawl", nil)
+		rq.RemoteAddr = test.Remote
+		if test.Actor != "" {
+			rq.Header.Set(actorHeader, test.Actor)
+		}
+		for _, f := range test.Forwarded {
+			rq.Header.Add("X-Forwarded-For", f)
+		}
+		actor := requestActor(rq)
+		if actor != test.Expected {
+			t.Fatalf("%+v: unexpected actor: %s", test, actor)
+		}
+	}
+}
+
+func TestAuditedJob(t *testing.T) {
+	store := openTempStore(t)
+	defer closeAndDeleteStore(t, store)
+
+	served := make(chan bool)
+	done := make(chan bool)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		finished := auditJob(store, "crawl", r)
+		setAuditOutcome(r, "started")
+		go func() {
+			<-served
+			finished(fmt.Errorf("site unavailable"))
+			close(done)
+		}()
+		w.Write([]byte("OK"))
+	})
+	rq := httptest.NewRequest("POST", "/admin/crawl",
+		strings.NewReader("html=1"))
+	rq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rq.Header.Set(actorHeader, "jane@example.com")
+	Audited(store, "/admin", handler).ServeHTTP(httptest.NewRecorder(), rq)
+	close(served)
+	<-done
+
+	entries, err := store.ListAudit(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, e := range entries {
+		got = append(got, fmt.Sprintf("%s|%s|%s|%s", e.Actor, e.Action, e.Params,
+			e.Outcome))
+	}
+	expected := []string{
+		"jane@example.com|crawl|html=1|error: site unavailable",
+		"jane@example.com|crawl|html=1|started",
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("unexpected audit entries:\n%s", strings.Join(got, "\n"))
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/jonas-p/go-shp"
+)
+
+// Benchmarks of search and density hot paths. They are shared by "apec bench",
+// running them against a real data directory, and go test -bench running them
+// against the test fixtures. A benchmark runs its operation n times.
+
+type benchFunc func(n int) error
+
+func benchSearch(index bleve.Index, what string) benchFunc {
+	return func(n int) error {
+		for i := 0; i < n; i++ {
+			_, _, err := findOffersFromText(index, what, nil, nil, defaultSearchLimits)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func benchFindNearest(spatial *SpatialIndex, lat, lon, radius float64) benchFunc {
+	return func(n int) error {
+		for i := 0; i < n; i++ {
+			_, err := spatial.FindNearest(lat, lon, radius)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func benchFormatOffers(templ *Templates, store *Store,
+	offers []datedOffer) benchFunc {
+
+	return func(n int) error {
+		rq, err := http.NewRequest("GET", "/search", nil)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			w := newDiscardResponse()
+			err := formatOffers(templ, store, nil, nil,
+				&searchResults{Offers: offers}, time.UTC, w, rq)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func benchDensityMap(store *Store, index bleve.Index, spatial *SpatialIndex,
+	box shp.Box, shapes []shp.Shape, what string, size int) benchFunc {
+
+	return func(n int) error {
+		for i := 0; i < n; i++ {
+			points, err := listPoints(store, index, spatial, what, weightCount,
+				time.Now())
+			if err != nil {
+				return err
+			}
+			grid := makeMapGrid(points, box, size, size)
+			grid = convolveGrid(grid)
+			img := drawGrid(grid)
+			err = drawShapes(box, shapes, img)
+			if err != nil {
+				return err
+			}
+			err = png.Encode(ioutil.Discard, img)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// BenchResult is the outcome of runBenchmark, per operation.
+type BenchResult struct {
+	N        int
+	Duration time.Duration
+	Bytes    uint64
+	Allocs   uint64
+}
+
+func (r BenchResult) String() string {
+	n := uint64(r.N)
+	return fmt.Sprintf("%8d %12d ns/op %10d B/op %8d allocs/op", r.N,
+		r.Duration.Nanoseconds()/int64(r.N), r.Bytes/n, r.Allocs/n)
+}
+
+// runBenchmark runs fn with growing iterations counts, like go test -bench,
+// until it takes at least minDuration.
+func runBenchmark(fn benchFunc, minDuration time.Duration) (BenchResult, error) {
+	n := 1
+	for {
+		runtime.GC()
+		before := &runtime.MemStats{}
+		runtime.ReadMemStats(before)
+		start := time.Now()
+		err := fn(n)
+		elapsed := time.Since(start)
+		if err != nil {
+			return BenchResult{}, err
+		}
+		after := &runtime.MemStats{}
+		runtime.ReadMemStats(after)
+		if elapsed >= minDuration || n >= 1e9 {
+			return BenchResult{
+				N:        n,
+				Duration: elapsed,
+				Bytes:    after.TotalAlloc - before.TotalAlloc,
+				Allocs:   after.Mallocs - before.Mallocs,
+			}, nil
+		}
+		// Aim past minDuration, growing at most 100x per round
+		next := n * 100
+		if elapsed > 0 {
+			predicted := int(int64(n) * int64(minDuration) * 6 / 5 /
+				int64(elapsed))
+			if predicted < next {
+				next = predicted
+			}
+		}
+		if next <= n {
+			next = n + 1
+		}
+		n = next
+	}
+}
+
+var (
+	benchCmd = app.Command("bench", `benchmark search and density hot paths
+
+Measure full text search, spatial lookups, search results rendering and density
+map rendering against the data directory, reporting allocations.
+`)
+	benchWhat   = benchCmd.Flag("what", "full text query").Default("python").String()
+	benchWhere  = benchCmd.Flag("where", "spatial query location").Default("paris").String()
+	benchRadius = benchCmd.Flag("radius", "spatial query radius in meters").
+			Default("30000").Float64()
+	benchSize = benchCmd.Flag("size", "density map size in pixels").Default("500").Int()
+	benchRun  = benchCmd.Flag("run", "only run benchmarks containing this string").
+			String()
+)
+
+func benchFn(cfg *Config) error {
+	store, err := OpenStore(cfg.Store())
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	index, err := OpenOfferIndex(cfg.Index())
+	if err != nil {
+		return err
+	}
+	defer index.Close()
+	geocoder, err := openGeocoder(cfg)
+	if err != nil {
+		return err
+	}
+	defer geocoder.Close()
+	templ, err := loadTemplates(cfg.TemplatesDir)
+	if err != nil {
+		return err
+	}
+	box := makeFranceBox()
+	shapes, err := loadBorders(cfg, box)
+	if err != nil {
+		return err
+	}
+	spatial, err := buildSpatialIndex(store, geocoder)
+	if err != nil {
+		return err
+	}
+	loc, _, err := geocoder.GetCachedLocation(strings.ToLower(*benchWhere), "fr")
+	if err != nil {
+		return err
+	}
+	if loc == nil {
+		return fmt.Errorf("could not geocode %s", *benchWhere)
+	}
+	offers, err := spatial.FindNearest(loc.Lat, loc.Lon, *benchRadius)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d offers, %d located, %d near %s\n", store.Size(),
+		len(spatial.List()), len(offers), *benchWhere)
+
+	benchmarks := []struct {
+		Name string
+		Fn   benchFunc
+	}{
+		{"search", benchSearch(index, *benchWhat)},
+		{"findnearest", benchFindNearest(spatial, loc.Lat, loc.Lon, *benchRadius)},
+		{"formatoffers", benchFormatOffers(templ, store, offers)},
+		{"densitymap", benchDensityMap(store, index, spatial, box, shapes, "",
+			*benchSize)},
+		{"densitymap-query", benchDensityMap(store, index, spatial, box, shapes,
+			*benchWhat, *benchSize)},
+	}
+	for _, bm := range benchmarks {
+		if !strings.Contains(bm.Name, *benchRun) {
+			continue
+		}
+		r, err := runBenchmark(bm.Fn, time.Second)
+		if err != nil {
+			return fmt.Errorf("benchmark %s failed: %s", bm.Name, err)
+		}
+		fmt.Printf("%-20s %s\n", bm.Name, r)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// runTestBenchmark runs fn b.N times, reporting allocations.
+func runTestBenchmark(b *testing.B, fn benchFunc) {
+	b.ReportAllocs()
+	err := fn(b.N)
+	if err != nil {
+		b.Fatal(err)
+	}
+}
+
+// makeBenchSpatial returns a spatial index of count offers randomly located
+// in France bounding box.
+func makeBenchSpatial(b *testing.B, count int) *SpatialIndex {
+	box := makeFranceBox()
+	r := rand.New(rand.NewSource(1))
+	spatial := NewSpatialIndex()
+	date := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < count; i++ {
+		loc, err := makeOfferLocation(fmt.Sprintf("%d", i), date, &Location{
+			Lon: box.MinX + r.Float64()*(box.MaxX-box.MinX),
+			Lat: box.MinY + r.Float64()*(box.MaxY-box.MinY),
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		spatial.Add(loc)
+	}
+	return spatial
+}
+
+func BenchmarkSearch(b *testing.B) {
+	env := newTestEnv(b)
+	defer env.Close()
+	b.ResetTimer()
+	runTestBenchmark(b, benchSearch(env.Index, "python or (java and golang)"))
+}
+
+func BenchmarkFindNearest(b *testing.B) {
+	spatial := makeBenchSpatial(b, 20000)
+	b.ResetTimer()
+	runTestBenchmark(b, benchFindNearest(spatial, 48.8565056, 2.3521334, 30000))
+}
+
+func BenchmarkFormatOffers(b *testing.B) {
+	env := newTestEnv(b)
+	defer env.Close()
+	offers := env.Spatial.FindAll()
+	b.ResetTimer()
+	runTestBenchmark(b, benchFormatOffers(env.Templates, env.Store, offers))
+}
+
+func BenchmarkDensityMap(b *testing.B) {
+	spatial := makeBenchSpatial(b, 20000)
+	b.ResetTimer()
+	runTestBenchmark(b, benchDensityMap(nil, nil, spatial, makeFranceBox(), nil,
+		"", 500))
+}
+
+func TestRunBenchmark(t *testing.T) {
+	calls := 0
+	r, err := runBenchmark(func(n int) error {
+		calls++
+		time.Sleep(time.Duration(n) * time.Millisecond)
+		return nil
+	}, 20*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls < 2 || r.N < 20 || r.Duration < 20*time.Millisecond {
+		t.Fatalf("unexpected benchmark result after %d calls: %+v", calls, r)
+	}
+}
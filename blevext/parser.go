@@ -1,48 +1,142 @@
-//go:generate go tool yacc -o parser.y.go parser.y
+//go:generate goyacc -o parser.y.go parser.y
 
 package blevext
 
 import (
-	"errors"
+	"encoding/json"
 	"fmt"
+	"strconv"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 )
 
 var (
 	traceParser = false
 )
 
+const (
+	precedenceHint = "operators bind from tightest to loosest: not, near, and, " +
+		"or; use parentheses to group terms"
+)
+
+// ParseError reports an invalid query expression and where it was detected.
+type ParseError struct {
+	Input string
+	// Byte offset of the error in Input
+	Pos int
+	Msg string
+	// Optional help line
+	Hint string
+}
+
+// Error returns the error message, followed by the input and a caret
+// pointing at the error position.
+func (e *ParseError) Error() string {
+	col := utf8.RuneCountInString(e.Input[:e.Pos])
+	msg := fmt.Sprintf("%s at position %d\n%s\n%s^", e.Msg, col+1, e.Input,
+		strings.Repeat(" ", col))
+	if e.Hint != "" {
+		msg += "\n" + e.Hint
+	}
+	return msg
+}
+
 // queryLexer implements yacc yyLexer interface as a small wrapper around
 // []*yySimType.
 type queryLexer struct {
+	input  string
 	tokens []*yySymType
-	err    string
+	// Last returned token, nil at the end of input, and its predecessor
+	last   *yySymType
+	prev   *yySymType
+	err    *ParseError
 	result *Node
 }
 
 func (lex *queryLexer) Lex(lval *yySymType) int {
+	lex.prev = lex.last
 	if len(lex.tokens) == 0 {
+		lex.last = nil
 		return 0
 	}
 	token := lex.tokens[0]
 	lex.tokens = lex.tokens[1:]
+	lex.last = token
 	lval.s = token.s
+	lval.pos = token.pos
 	return token.yys
 }
 
+func tokenName(token *yySymType) string {
+	if token == nil {
+		return "end of query"
+	}
+	switch token.yys {
+	case tAND:
+		return "'and'"
+	case tOR:
+		return "'or'"
+	case tNOT:
+		return "'not'"
+	case tNEAR:
+		return "'near/" + token.s + "'"
+	case tLPARENS:
+		return "'('"
+	case tRPARENS:
+		return "')'"
+	case tSTRING:
+		return "word " + strconv.Quote(token.s)
+	case tPHRASE:
+		return "phrase " + strconv.Quote(token.s)
+	case tEXACT:
+		return "exact word " + strconv.Quote(token.s)
+	}
+	return fmt.Sprintf("token %d", token.yys)
+}
+
+// Error replaces yacc messages with the unexpected token and what could have
+// been accepted instead, inferred from the preceding token.
 func (lex *queryLexer) Error(s string) {
-	lex.err = s
+	pos := len(lex.input)
+	if lex.last != nil {
+		pos = lex.last.pos
+	}
+	expected := "a word, a phrase, 'not' or '('"
+	if lex.prev != nil {
+		switch lex.prev.yys {
+		case tNEAR:
+			expected = "a word or a phrase"
+		case tSTRING, tPHRASE:
+			expected = "'and', 'or', 'near/N', ')' or end of query"
+		case tRPARENS, tEXACT:
+			expected = "'and', 'or', ')' or end of query"
+		}
+	}
+	msg := fmt.Sprintf("unexpected %s, expecting %s", tokenName(lex.last), expected)
+	if lex.last != nil && lex.last.yys == tNEAR {
+		msg = fmt.Sprintf("unexpected %s, near operands must be words or phrases",
+			tokenName(lex.last))
+	}
+	lex.err = &ParseError{
+		Input: lex.input,
+		Pos:   pos,
+		Msg:   msg,
+		Hint:  precedenceHint,
+	}
 }
 
-// Lex extracts tokens from input string.
+// Lex extracts tokens from input string. Invalid inputs return a
+// *ParseError.
 func Lex(input string) ([]*yySymType, error) {
 	tokens := []*yySymType{}
+	full := input
 	for {
 		input = strings.TrimLeftFunc(input, unicode.IsSpace)
 		if input == "" {
 			break
 		}
+		pos := len(full) - len(input)
 		if input[0] == '(' || input[0] == ')' {
 			typ := tLPARENS
 			if input[0] == ')' {
@@ -51,44 +145,92 @@ func Lex(input string) ([]*yySymType, error) {
 			tokens = append(tokens, &yySymType{
 				yys: typ,
 				s:   input[:1],
+				pos: pos,
 			})
 			input = input[1:]
 		} else if input[0] == '"' {
-			pos := strings.IndexByte(input[1:], '"')
-			if pos < 0 {
-				return nil, fmt.Errorf("unclosed literal string: %q", input)
+			end := strings.IndexByte(input[1:], '"')
+			if end < 0 {
+				return nil, &ParseError{
+					Input: full,
+					Pos:   pos,
+					Msg:   "unclosed phrase",
+				}
 			}
-			pos += 1
+			end += 1
 			tokens = append(tokens, &yySymType{
 				yys: tPHRASE,
-				s:   input[1:pos],
+				s:   input[1:end],
+				pos: pos,
 			})
-			input = input[pos+1:]
+			input = input[end+1:]
 		} else {
-			pos := strings.IndexFunc(input, func(r rune) bool {
+			end := strings.IndexFunc(input, func(r rune) bool {
 				return unicode.IsSpace(r) || r == ')' || r == '('
 			})
-			if pos < 0 {
-				pos = len(input)
+			if end < 0 {
+				end = len(input)
 			}
-			s := input[:pos]
-			input = input[pos:]
+			s := input[:end]
+			input = input[end:]
 			typ := tSTRING
 			switch s {
 			case "and":
 				typ = tAND
 			case "or":
 				typ = tOR
+			case "not":
+				typ = tNOT
+			}
+			if len(s) > 1 && s[0] == '=' {
+				typ = tEXACT
+				s = s[1:]
+			} else if strings.HasPrefix(s, "near/") {
+				typ = tNEAR
+				s = s[len("near/"):]
+				distance, err := strconv.Atoi(s)
+				if err != nil || distance < 0 || distance > MaxNearDistance {
+					return nil, &ParseError{
+						Input: full,
+						Pos:   pos,
+						Msg: fmt.Sprintf("invalid near distance, expected "+
+							"an integer between 0 and %d: %q", MaxNearDistance, s),
+					}
+				}
 			}
 			tokens = append(tokens, &yySymType{
 				yys: typ,
 				s:   s,
+				pos: pos,
 			})
 		}
 	}
 	return tokens, nil
 }
 
+// Term is a plain search word of a query, starting at byte offset Pos of
+// the query string.
+type Term struct {
+	Value string
+	Pos   int
+}
+
+// Terms returns the plain words of input, leaving out operators, phrases and
+// exact words. Invalid inputs return a *ParseError.
+func Terms(input string) ([]Term, error) {
+	tokens, err := Lex(input)
+	if err != nil {
+		return nil, err
+	}
+	terms := []Term{}
+	for _, token := range tokens {
+		if token.yys == tSTRING {
+			terms = append(terms, Term{Value: token.s, Pos: token.pos})
+		}
+	}
+	return terms, nil
+}
+
 type NodeKind int
 
 const (
@@ -96,27 +238,62 @@ const (
 	NodeOr
 	NodeString
 	NodePhrase
+	NodeNear
+	NodeNot
+	NodeExact
 )
 
+var (
+	nodeKindNames = map[NodeKind]string{
+		NodeAnd:    "and",
+		NodeOr:     "or",
+		NodeString: "string",
+		NodePhrase: "phrase",
+		NodeNear:   "near",
+		NodeNot:    "not",
+		NodeExact:  "exact",
+	}
+)
+
+func (k NodeKind) String() string {
+	if name, ok := nodeKindNames[k]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", int(k))
+}
+
+func (k NodeKind) MarshalJSON() ([]byte, error) {
+	return json.Marshal(k.String())
+}
+
 type Node struct {
-	Kind     NodeKind
-	Children []*Node
-	Value    string
+	Kind     NodeKind `json:"kind"`
+	Children []*Node  `json:"children,omitempty"`
+	Value    string   `json:"value,omitempty"`
+	// Maximum number of words between NodeNear children
+	Distance int `json:"distance,omitempty"`
 }
 
 // Parse takes an input query expression and return the parsed node tree, or
-// nil if the expression is empty, or an error. A query expression supports the
-// following constructs (without the single quotes):
+// nil if the expression is empty, or a *ParseError. A query expression
+// supports the following constructs (without the single quotes):
 // - query strings: 'symbols_without_spaces_or_parenthesis'
 // - query phrases: '"words withing double quotes"
 // - 'a and b' or 'a or b'
 // - '(a or b) and c'
+// - 'a near/5 "b c"': a within 5 words of "b c", in any order
+// - 'not a', 'a and not (b or c)'
+// - '=a': a as typed, without stemming
+//
+// Operators bind from tightest to loosest: not, near, and, or. Chained
+// binary operators associate to the left.
 func Parse(input string) (*Node, error) {
 	tokens, err := Lex(input)
 	if err != nil {
 		return nil, err
 	}
 	lexer := &queryLexer{
+		input:  input,
 		tokens: tokens,
 	}
 	if traceParser {
@@ -127,7 +304,10 @@ func Parse(input string) (*Node, error) {
 		traceRule("END>\n")
 	}
 	if res != 0 {
-		return nil, errors.New(lexer.err)
+		if lexer.err == nil {
+			return nil, &ParseError{Input: input, Pos: len(input), Msg: "syntax error"}
+		}
+		return nil, lexer.err
 	}
 	return lexer.result, nil
 }
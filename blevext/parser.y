@@ -1,7 +1,10 @@
 %{
 package blevext
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+)
 
 func traceRule(format string, args ...interface{}) {
 	if traceParser {
@@ -13,18 +16,25 @@ func traceRule(format string, args ...interface{}) {
 %union {
     s string
 	n *Node
+	// Token byte offset in the input
+	pos int
 }
 
 %token tAND
 %token tOR
+%token tNOT
+%token <s> tNEAR
 %token tLPARENS
 %token tRPARENS
 %token <s> tSTRING
 %token <s> tPHRASE
+%token <s> tEXACT
 
 %left tOR
 %left tAND
+%right tNOT
 
+%type <n> term
 %type <n> queryPart
 %type <n> query
 
@@ -68,8 +78,46 @@ queryPart tOR queryPart {
 	}
 }
 |
+tNOT queryPart {
+	traceRule("tNOT queryPart -> queryPart\n")
+	$$ = &Node{
+		Kind: NodeNot,
+		Children: []*Node{
+			$2,
+		},
+	}
+}
+|
+term tNEAR term {
+	traceRule("term tNEAR[%s] term -> queryPart\n", $2)
+	// Distance was validated by the lexer
+	distance, _ := strconv.Atoi($2)
+	$$ = &Node{
+		Kind: NodeNear,
+		Distance: distance,
+		Children: []*Node{
+			$1,
+			$3,
+		},
+	}
+}
+|
+term {
+	traceRule("term -> queryPart\n")
+	$$ = $1
+}
+|
+tEXACT {
+	traceRule("tEXACT[%s] -> queryPart\n", $1)
+	$$ = &Node{
+		Kind: NodeExact,
+		Value: $1,
+	}
+};
+
+term:
 tPHRASE {
-	traceRule("tPHRASE[%s] -> queryPart\n", $1)
+	traceRule("tPHRASE[%s] -> term\n", $1)
     $$ = &Node{
         Kind: NodePhrase,
         Value: $1,
@@ -77,7 +125,7 @@ tPHRASE {
 }
 |
 tSTRING {
-	traceRule("tSTRING[%s] -> queryPart\n", $1)
+	traceRule("tSTRING[%s] -> term\n", $1)
 	$$ = &Node{
 		Kind: NodeString,
 		Value: $1,
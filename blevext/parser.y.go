@@ -1,10 +1,16 @@
+// Code generated by goyacc -o parser.y.go parser.y. DO NOT EDIT.
+
 //line parser.y:2
 package blevext
 
 import __yyfmt__ "fmt"
 
 //line parser.y:2
-import "fmt"
+
+import (
+	"fmt"
+	"strconv"
+)
 
 func traceRule(format string, args ...interface{}) {
 	if traceParser {
@@ -12,19 +18,24 @@ func traceRule(format string, args ...interface{}) {
 	}
 }
 
-//line parser.y:13
+//line parser.y:16
 type yySymType struct {
 	yys int
 	s   string
 	n   *Node
+	// Token byte offset in the input
+	pos int
 }
 
 const tAND = 57346
 const tOR = 57347
-const tLPARENS = 57348
-const tRPARENS = 57349
-const tSTRING = 57350
-const tPHRASE = 57351
+const tNOT = 57348
+const tNEAR = 57349
+const tLPARENS = 57350
+const tRPARENS = 57351
+const tSTRING = 57352
+const tPHRASE = 57353
+const tEXACT = 57354
 
 var yyToknames = [...]string{
 	"$end",
@@ -32,73 +43,77 @@ var yyToknames = [...]string{
 	"$unk",
 	"tAND",
 	"tOR",
+	"tNOT",
+	"tNEAR",
 	"tLPARENS",
 	"tRPARENS",
 	"tSTRING",
 	"tPHRASE",
+	"tEXACT",
 }
+
 var yyStatenames = [...]string{}
 
 const yyEofCode = 1
 const yyErrCode = 2
-const yyMaxDepth = 200
+const yyInitialStackSize = 16
 
 //line yacctab:1
-var yyExca = [...]int{
+var yyExca = [...]int8{
 	-1, 1,
 	1, -1,
 	-2, 0,
 }
 
-const yyNprod = 8
 const yyPrivate = 57344
 
-var yyTokenNames []string
-var yyStates []string
-
-const yyLast = 14
+const yyLast = 22
 
-var yyAct = [...]int{
-
-	3, 2, 5, 4, 6, 8, 6, 7, 9, 10,
-	6, 7, 1, 11,
+var yyAct = [...]int8{
+	4, 5, 3, 2, 8, 7, 6, 11, 12, 8,
+	7, 9, 10, 14, 15, 17, 16, 13, 9, 10,
+	9, 1,
 }
-var yyPact = [...]int{
 
-	-6, -1000, 2, -6, -1000, -1000, -6, -6, 6, -1000,
-	0, -1000,
+var yyPact = [...]int16{
+	-6, -1000, 14, -6, -6, 10, -1000, -1000, -1000, -6,
+	-6, 7, -1000, -1, -1000, 16, -1000, -1000,
 }
-var yyPgo = [...]int{
 
-	0, 1, 12,
+var yyPgo = [...]int8{
+	0, 1, 3, 21,
 }
-var yyR1 = [...]int{
 
-	0, 2, 2, 1, 1, 1, 1, 1,
+var yyR1 = [...]int8{
+	0, 3, 3, 2, 2, 2, 2, 2, 2, 2,
+	1, 1,
 }
-var yyR2 = [...]int{
 
-	0, 1, 0, 3, 3, 3, 1, 1,
+var yyR2 = [...]int8{
+	0, 1, 0, 3, 3, 3, 2, 3, 1, 1,
+	1, 1,
 }
-var yyChk = [...]int{
 
-	-1000, -2, -1, 6, 9, 8, 4, 5, -1, -1,
-	-1, 7,
+var yyChk = [...]int16{
+	-1000, -3, -2, 8, 6, -1, 12, 11, 10, 4,
+	5, -2, -2, 7, -2, -2, 9, -1,
 }
-var yyDef = [...]int{
 
-	2, -2, 1, 0, 6, 7, 0, 0, 0, 4,
-	5, 3,
+var yyDef = [...]int8{
+	2, -2, 1, 0, 0, 8, 9, 10, 11, 0,
+	0, 0, 6, 0, 4, 5, 3, 7,
 }
-var yyTok1 = [...]int{
 
+var yyTok1 = [...]int8{
 	1,
 }
-var yyTok2 = [...]int{
 
-	2, 3, 4, 5, 6, 7, 8, 9,
+var yyTok2 = [...]int8{
+	2, 3, 4, 5, 6, 7, 8, 9, 10, 11,
+	12,
 }
-var yyTok3 = [...]int{
+
+var yyTok3 = [...]int8{
 	0,
 }
 
@@ -128,18 +143,17 @@ type yyParser interface {
 }
 
 type yyParserImpl struct {
-	lookahead func() int
+	lval  yySymType
+	stack [yyInitialStackSize]yySymType
+	char  int
 }
 
 func (p *yyParserImpl) Lookahead() int {
-	return p.lookahead()
+	return p.char
 }
 
 func yyNewParser() yyParser {
-	p := &yyParserImpl{
-		lookahead: func() int { return -1 },
-	}
-	return p
+	return &yyParserImpl{}
 }
 
 const yyFlag = -1000
@@ -181,9 +195,9 @@ func yyErrorMessage(state, lookAhead int) string {
 	expected := make([]int, 0, 4)
 
 	// Look for shiftable tokens.
-	base := yyPact[state]
+	base := int(yyPact[state])
 	for tok := TOKSTART; tok-1 < len(yyToknames); tok++ {
-		if n := base + tok; n >= 0 && n < yyLast && yyChk[yyAct[n]] == tok {
+		if n := base + tok; n >= 0 && n < yyLast && int(yyChk[int(yyAct[n])]) == tok {
 			if len(expected) == cap(expected) {
 				return res
 			}
@@ -193,13 +207,13 @@ func yyErrorMessage(state, lookAhead int) string {
 
 	if yyDef[state] == -2 {
 		i := 0
-		for yyExca[i] != -1 || yyExca[i+1] != state {
+		for yyExca[i] != -1 || int(yyExca[i+1]) != state {
 			i += 2
 		}
 
 		// Look for tokens that we accept or reduce.
 		for i += 2; yyExca[i] >= 0; i += 2 {
-			tok := yyExca[i]
+			tok := int(yyExca[i])
 			if tok < TOKSTART || yyExca[i+1] == 0 {
 				continue
 			}
@@ -230,30 +244,30 @@ func yylex1(lex yyLexer, lval *yySymType) (char, token int) {
 	token = 0
 	char = lex.Lex(lval)
 	if char <= 0 {
-		token = yyTok1[0]
+		token = int(yyTok1[0])
 		goto out
 	}
 	if char < len(yyTok1) {
-		token = yyTok1[char]
+		token = int(yyTok1[char])
 		goto out
 	}
 	if char >= yyPrivate {
 		if char < yyPrivate+len(yyTok2) {
-			token = yyTok2[char-yyPrivate]
+			token = int(yyTok2[char-yyPrivate])
 			goto out
 		}
 	}
 	for i := 0; i < len(yyTok3); i += 2 {
-		token = yyTok3[i+0]
+		token = int(yyTok3[i+0])
 		if token == char {
-			token = yyTok3[i+1]
+			token = int(yyTok3[i+1])
 			goto out
 		}
 	}
 
 out:
 	if token == 0 {
-		token = yyTok2[1] /* unknown char */
+		token = int(yyTok2[1]) /* unknown char */
 	}
 	if yyDebug >= 3 {
 		__yyfmt__.Printf("lex %s(%d)\n", yyTokname(token), uint(char))
@@ -267,22 +281,20 @@ func yyParse(yylex yyLexer) int {
 
 func (yyrcvr *yyParserImpl) Parse(yylex yyLexer) int {
 	var yyn int
-	var yylval yySymType
 	var yyVAL yySymType
 	var yyDollar []yySymType
 	_ = yyDollar // silence set and not used
-	yyS := make([]yySymType, yyMaxDepth)
+	yyS := yyrcvr.stack[:]
 
 	Nerrs := 0   /* number of errors */
 	Errflag := 0 /* error recovery flag */
 	yystate := 0
-	yychar := -1
-	yytoken := -1 // yychar translated into internal numbering
-	yyrcvr.lookahead = func() int { return yychar }
+	yyrcvr.char = -1
+	yytoken := -1 // yyrcvr.char translated into internal numbering
 	defer func() {
 		// Make sure we report no lookahead when not parsing.
 		yystate = -1
-		yychar = -1
+		yyrcvr.char = -1
 		yytoken = -1
 	}()
 	yyp := -1
@@ -310,22 +322,22 @@ yystack:
 	yyS[yyp].yys = yystate
 
 yynewstate:
-	yyn = yyPact[yystate]
+	yyn = int(yyPact[yystate])
 	if yyn <= yyFlag {
 		goto yydefault /* simple state */
 	}
-	if yychar < 0 {
-		yychar, yytoken = yylex1(yylex, &yylval)
+	if yyrcvr.char < 0 {
+		yyrcvr.char, yytoken = yylex1(yylex, &yyrcvr.lval)
 	}
 	yyn += yytoken
 	if yyn < 0 || yyn >= yyLast {
 		goto yydefault
 	}
-	yyn = yyAct[yyn]
-	if yyChk[yyn] == yytoken { /* valid shift */
-		yychar = -1
+	yyn = int(yyAct[yyn])
+	if int(yyChk[yyn]) == yytoken { /* valid shift */
+		yyrcvr.char = -1
 		yytoken = -1
-		yyVAL = yylval
+		yyVAL = yyrcvr.lval
 		yystate = yyn
 		if Errflag > 0 {
 			Errflag--
@@ -335,27 +347,27 @@ yynewstate:
 
 yydefault:
 	/* default state action */
-	yyn = yyDef[yystate]
+	yyn = int(yyDef[yystate])
 	if yyn == -2 {
-		if yychar < 0 {
-			yychar, yytoken = yylex1(yylex, &yylval)
+		if yyrcvr.char < 0 {
+			yyrcvr.char, yytoken = yylex1(yylex, &yyrcvr.lval)
 		}
 
 		/* look through exception table */
 		xi := 0
 		for {
-			if yyExca[xi+0] == -1 && yyExca[xi+1] == yystate {
+			if yyExca[xi+0] == -1 && int(yyExca[xi+1]) == yystate {
 				break
 			}
 			xi += 2
 		}
 		for xi += 2; ; xi += 2 {
-			yyn = yyExca[xi+0]
+			yyn = int(yyExca[xi+0])
 			if yyn < 0 || yyn == yytoken {
 				break
 			}
 		}
-		yyn = yyExca[xi+1]
+		yyn = int(yyExca[xi+1])
 		if yyn < 0 {
 			goto ret0
 		}
@@ -377,10 +389,10 @@ yydefault:
 
 			/* find a state where "error" is a legal shift action */
 			for yyp >= 0 {
-				yyn = yyPact[yyS[yyp].yys] + yyErrCode
+				yyn = int(yyPact[yyS[yyp].yys]) + yyErrCode
 				if yyn >= 0 && yyn < yyLast {
-					yystate = yyAct[yyn] /* simulate a shift of "error" */
-					if yyChk[yystate] == yyErrCode {
+					yystate = int(yyAct[yyn]) /* simulate a shift of "error" */
+					if int(yyChk[yystate]) == yyErrCode {
 						goto yystack
 					}
 				}
@@ -401,7 +413,7 @@ yydefault:
 			if yytoken == yyEofCode {
 				goto ret1
 			}
-			yychar = -1
+			yyrcvr.char = -1
 			yytoken = -1
 			goto yynewstate /* try again in the same state */
 		}
@@ -416,7 +428,7 @@ yydefault:
 	yypt := yyp
 	_ = yypt // guard against "declared and not used"
 
-	yyp -= yyR2[yyn]
+	yyp -= int(yyR2[yyn])
 	// yyp is now the index of $0. Perform the default action. Iff the
 	// reduced production is ε, $1 is possibly out of range.
 	if yyp+1 >= len(yyS) {
@@ -427,16 +439,16 @@ yydefault:
 	yyVAL = yyS[yyp+1]
 
 	/* consult goto table to find next state */
-	yyn = yyR1[yyn]
-	yyg := yyPgo[yyn]
+	yyn = int(yyR1[yyn])
+	yyg := int(yyPgo[yyn])
 	yyj := yyg + yyS[yyp].yys + 1
 
 	if yyj >= yyLast {
-		yystate = yyAct[yyg]
+		yystate = int(yyAct[yyg])
 	} else {
-		yystate = yyAct[yyj]
-		if yyChk[yystate] != -yyn {
-			yystate = yyAct[yyg]
+		yystate = int(yyAct[yyj])
+		if int(yyChk[yystate]) != -yyn {
+			yystate = int(yyAct[yyg])
 		}
 	}
 	// dummy call; replaced with literal code
@@ -444,27 +456,27 @@ yydefault:
 
 	case 1:
 		yyDollar = yyS[yypt-1 : yypt+1]
-		//line parser.y:34
+//line parser.y:44
 		{
 			traceRule("queryPart -> query")
 			yylex.(*queryLexer).result = yyDollar[1].n
 		}
 	case 2:
 		yyDollar = yyS[yypt-0 : yypt+1]
-		//line parser.y:39
+//line parser.y:49
 		{
 
 		}
 	case 3:
 		yyDollar = yyS[yypt-3 : yypt+1]
-		//line parser.y:44
+//line parser.y:54
 		{
 			traceRule("tLPARENS queryPart tRPARENS -> queryPart\n")
 			yyVAL.n = yyDollar[2].n
 		}
 	case 4:
 		yyDollar = yyS[yypt-3 : yypt+1]
-		//line parser.y:49
+//line parser.y:59
 		{
 			traceRule("tAND -> queryPart\n")
 			yyVAL.n = &Node{
@@ -477,7 +489,7 @@ yydefault:
 		}
 	case 5:
 		yyDollar = yyS[yypt-3 : yypt+1]
-		//line parser.y:60
+//line parser.y:70
 		{
 			traceRule("tOR -> queryPart\n")
 			yyVAL.n = &Node{
@@ -489,20 +501,65 @@ yydefault:
 			}
 		}
 	case 6:
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line parser.y:81
+		{
+			traceRule("tNOT queryPart -> queryPart\n")
+			yyVAL.n = &Node{
+				Kind: NodeNot,
+				Children: []*Node{
+					yyDollar[2].n,
+				},
+			}
+		}
+	case 7:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.y:91
+		{
+			traceRule("term tNEAR[%s] term -> queryPart\n", yyDollar[2].s)
+			// Distance was validated by the lexer
+			distance, _ := strconv.Atoi(yyDollar[2].s)
+			yyVAL.n = &Node{
+				Kind:     NodeNear,
+				Distance: distance,
+				Children: []*Node{
+					yyDollar[1].n,
+					yyDollar[3].n,
+				},
+			}
+		}
+	case 8:
 		yyDollar = yyS[yypt-1 : yypt+1]
-		//line parser.y:71
+//line parser.y:105
 		{
-			traceRule("tPHRASE[%s] -> queryPart\n", yyDollar[1].s)
+			traceRule("term -> queryPart\n")
+			yyVAL.n = yyDollar[1].n
+		}
+	case 9:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.y:110
+		{
+			traceRule("tEXACT[%s] -> queryPart\n", yyDollar[1].s)
+			yyVAL.n = &Node{
+				Kind:  NodeExact,
+				Value: yyDollar[1].s,
+			}
+		}
+	case 10:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.y:119
+		{
+			traceRule("tPHRASE[%s] -> term\n", yyDollar[1].s)
 			yyVAL.n = &Node{
 				Kind:  NodePhrase,
 				Value: yyDollar[1].s,
 			}
 		}
-	case 7:
+	case 11:
 		yyDollar = yyS[yypt-1 : yypt+1]
-		//line parser.y:79
+//line parser.y:127
 		{
-			traceRule("tSTRING[%s] -> queryPart\n", yyDollar[1].s)
+			traceRule("tSTRING[%s] -> term\n", yyDollar[1].s)
 			yyVAL.n = &Node{
 				Kind:  NodeString,
 				Value: yyDollar[1].s,
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"strings"
 	"testing"
 )
 
@@ -34,6 +35,15 @@ func nodeToString(n *Node) (string, error) {
 			write(w, prefix+"OR\n")
 			toString(w, n.Children[0], prefix+"  ")
 			toString(w, n.Children[1], prefix+"  ")
+		case NodeExact:
+			write(w, prefix+"="+n.Value+"\n")
+		case NodeNot:
+			write(w, prefix+"NOT\n")
+			toString(w, n.Children[0], prefix+"  ")
+		case NodeNear:
+			write(w, prefix+"NEAR/%d\n", n.Distance)
+			toString(w, n.Children[0], prefix+"  ")
+			toString(w, n.Children[1], prefix+"  ")
 		default:
 			return fmt.Errorf("unsuported node type: %d", n.Kind)
 		}
@@ -112,3 +122,134 @@ func TestLexerParens(t *testing.T) {
   'c'
 `)
 }
+
+func TestLexerNear(t *testing.T) {
+	testLexer(t, `"data" near/5 "big platform"`, `NEAR/5
+  'data'
+  'big platform'
+`)
+	testLexer(t, `a and b near/0 c or d`, `OR
+  AND
+    a
+    NEAR/0
+      b
+      c
+  d
+`)
+	testLexer(t, `near`, "near\n")
+	for _, input := range []string{
+		`a near/x b`,
+		`a near/-1 b`,
+		`a near/51 b`,
+		`(a or b) near/2 c`,
+		`a near/1 b near/2 c`,
+	} {
+		_, err := Parse(input)
+		if err == nil {
+			t.Fatalf("%s: parsing should have failed", input)
+		}
+	}
+}
+
+func TestLexerChained(t *testing.T) {
+	testLexer(t, `a or b or c`, `OR
+  OR
+    a
+    b
+  c
+`)
+	testLexer(t, `a and b and c`, `AND
+  AND
+    a
+    b
+  c
+`)
+}
+
+func TestLexerNot(t *testing.T) {
+	testLexer(t, `not a and b`, `AND
+  NOT
+    a
+  b
+`)
+	testLexer(t, `a and not (b or "c")`, `AND
+  a
+  NOT
+    OR
+      b
+      'c'
+`)
+	testLexer(t, `not a near/2 b`, `NOT
+  NEAR/2
+    a
+    b
+`)
+	testLexer(t, `not not a`, `NOT
+  NOT
+    a
+`)
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		Input string
+		Error string
+	}{
+		{`a or`, "unexpected end of query, expecting a word, a phrase, " +
+			"'not' or '(' at position 5\na or\n    ^\n" + precedenceHint},
+		{`(a or b`, "unexpected end of query, expecting 'and', 'or', " +
+			"'near/N', ')' or end of query at position 8"},
+		{`a or ) b`, "unexpected ')', expecting a word, a phrase, 'not' or '(' " +
+			"at position 6\na or ) b\n     ^\n"},
+		{`(a) b`, "unexpected word \"b\", expecting 'and', 'or', ')' or end " +
+			"of query at position 5"},
+		{`a near/1 not b`, "unexpected 'not', expecting a word or a phrase " +
+			"at position 10"},
+		{`a near/1 b near/2 c`, "unexpected 'near/2', near operands must be " +
+			"words or phrases at position 12"},
+		{`été and "ab`, "unclosed phrase at position 9\nété and \"ab\n        ^"},
+		{`=a b`, "unexpected word \"b\", expecting 'and', 'or', ')' or end " +
+			"of query at position 4"},
+		{`=a near/1 b`, "unexpected 'near/1', near operands must be words or " +
+			"phrases at position 4"},
+		{`a near/x b`, "invalid near distance, expected an integer between 0 " +
+			"and 50: \"x\" at position 3"},
+	}
+	for _, test := range tests {
+		_, err := Parse(test.Input)
+		if err == nil {
+			t.Fatalf("%s: parsing should have failed", test.Input)
+		}
+		if _, ok := err.(*ParseError); !ok {
+			t.Fatalf("%s: unexpected error type: %T", test.Input, err)
+		}
+		if !strings.HasPrefix(err.Error(), test.Error) {
+			t.Fatalf("%s: unexpected error:\n%s\nexpected:\n%s", test.Input,
+				err, test.Error)
+		}
+	}
+}
+
+func TestLexerExact(t *testing.T) {
+	testLexer(t, `=architecte and not =near/2`, `AND
+  =architecte
+  NOT
+    =near/2
+`)
+	testLexer(t, `=`, "=\n")
+}
+
+func TestTerms(t *testing.T) {
+	terms, err := Terms(`(golang or "big data") near/2 =java not dévelopeur`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := fmt.Sprint(terms)
+	if s != "[{golang 1} {dévelopeur 40}]" {
+		t.Fatalf("unexpected terms: %s", s)
+	}
+	_, err = Terms(`"unclosed`)
+	if err == nil {
+		t.Fatal("unclosed phrase should fail")
+	}
+}
@@ -38,7 +38,7 @@ func (q *allMatchQuery) SetField(f string) {
 	q.FieldVal = f
 }
 
-func (q *allMatchQuery) Searcher(i index.IndexReader, m mapping.IndexMapping, explain bool) (search.Searcher, error) {
+func (q *allMatchQuery) Searcher(i index.IndexReader, m mapping.IndexMapping, options search.SearcherOptions) (search.Searcher, error) {
 
 	field := q.FieldVal
 	if q.FieldVal == "" {
@@ -49,7 +49,7 @@ func (q *allMatchQuery) Searcher(i index.IndexReader, m mapping.IndexMapping, ex
 	tokens := analyzer.Analyze([]byte(q.Match))
 	if len(tokens) == 0 {
 		noneQuery := bleve.NewMatchNoneQuery()
-		return noneQuery.Searcher(i, m, explain)
+		return noneQuery.Searcher(i, m, options)
 	}
 
 	tqs := make([]query.Query, len(tokens))
@@ -61,7 +61,7 @@ func (q *allMatchQuery) Searcher(i index.IndexReader, m mapping.IndexMapping, ex
 	}
 	allQuery := bleve.NewConjunctionQuery(tqs...)
 	allQuery.SetBoost(q.BoostVal)
-	return allQuery.Searcher(i, m, explain)
+	return allQuery.Searcher(i, m, options)
 }
 
 func (q *allMatchQuery) Validate() error {
@@ -0,0 +1,110 @@
+package blevext
+
+import (
+	"fmt"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/analysis"
+	"github.com/blevesearch/bleve/index"
+	"github.com/blevesearch/bleve/mapping"
+	"github.com/blevesearch/bleve/search"
+	"github.com/blevesearch/bleve/search/query"
+)
+
+const (
+	// MaxNearDistance bounds NEAR queries distance, each allowed distance
+	// adds two phrase queries.
+	MaxNearDistance = 50
+)
+
+type nearQuery struct {
+	Left     string  `json:"left"`
+	Right    string  `json:"right"`
+	Distance int     `json:"distance"`
+	FieldVal string  `json:"field,omitempty"`
+	BoostVal float64 `json:"boost,omitempty"`
+}
+
+// NewNearQuery matches documents where left and right analyzed texts appear
+// as phrases separated by at most distance words, in any order. Indexed
+// fields must include term vectors.
+func NewNearQuery(left, right string, distance int) *nearQuery {
+	return &nearQuery{
+		Left:     left,
+		Right:    right,
+		Distance: distance,
+		BoostVal: 1.0,
+	}
+}
+
+func (q *nearQuery) Boost() float64 {
+	return q.BoostVal
+}
+
+func (q *nearQuery) SetBoost(b float64) {
+	q.BoostVal = b
+}
+
+func (q *nearQuery) Field() string {
+	return q.FieldVal
+}
+
+func (q *nearQuery) SetField(f string) {
+	q.FieldVal = f
+}
+
+// phraseTerms returns tokens terms at their relative positions, removed stop
+// words being replaced with empty placeholders.
+func phraseTerms(tokens analysis.TokenStream) []string {
+	if len(tokens) == 0 {
+		return nil
+	}
+	first := tokens[0].Position
+	last := tokens[len(tokens)-1].Position
+	terms := make([]string, last-first+1)
+	for _, token := range tokens {
+		terms[token.Position-first] = string(token.Term)
+	}
+	return terms
+}
+
+func (q *nearQuery) Searcher(i index.IndexReader, m mapping.IndexMapping, options search.SearcherOptions) (search.Searcher, error) {
+
+	field := q.FieldVal
+	if q.FieldVal == "" {
+		field = m.DefaultSearchField()
+	}
+	analyzerName := m.AnalyzerNameForPath(field)
+	analyzer := m.AnalyzerNamed(analyzerName)
+	left := phraseTerms(analyzer.Analyze([]byte(q.Left)))
+	right := phraseTerms(analyzer.Analyze([]byte(q.Right)))
+	if len(left) == 0 || len(right) == 0 {
+		noneQuery := bleve.NewMatchNoneQuery()
+		return noneQuery.Searcher(i, m, options)
+	}
+
+	phrases := []query.Query{}
+	for d := 0; d <= q.Distance; d++ {
+		gap := make([]string, d)
+		for _, parts := range [][][]string{{left, right}, {right, left}} {
+			terms := []string{}
+			terms = append(terms, parts[0]...)
+			terms = append(terms, gap...)
+			terms = append(terms, parts[1]...)
+			pq := bleve.NewPhraseQuery(terms, field)
+			pq.SetBoost(q.BoostVal)
+			phrases = append(phrases, pq)
+		}
+	}
+	nearQuery := bleve.NewDisjunctionQuery(phrases...)
+	nearQuery.SetBoost(q.BoostVal)
+	return nearQuery.Searcher(i, m, options)
+}
+
+func (q *nearQuery) Validate() error {
+	if q.Distance < 0 || q.Distance > MaxNearDistance {
+		return fmt.Errorf("near distance must be between 0 and %d: %d",
+			MaxNearDistance, q.Distance)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Consecutive blocking responses opening the crawl circuit breaker
+	breakerThreshold = 3
+	// Crawling requests are refused this long once the breaker is open
+	breakerCooldown = 30 * time.Minute
+	// Minimum delay before retrying a rate limited request
+	rateLimitDelay = time.Minute
+)
+
+// isBlockingStatus returns true for status codes returned by APEC when it
+// rate limits or blocks the crawler.
+func isBlockingStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code == http.StatusForbidden
+}
+
+// parseRetryAfter parses Retry-After header values, in seconds or as HTTP
+// dates. It returns zero for missing or invalid values.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if n, err := strconv.Atoi(value); err == nil && n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// BlockedError is returned by crawling requests while the circuit breaker
+// is open.
+type BlockedError struct {
+	Until  time.Time
+	Status string
+}
+
+func (e *BlockedError) Error() string {
+	return fmt.Sprintf("crawling is paused until %s after repeated %s responses",
+		e.Until.Format(time.RFC3339), e.Status)
+}
+
+// BreakerStatus describes the circuit breaker state.
+type BreakerStatus struct {
+	Open bool
+	// Open until this time, when open
+	Until time.Time
+	// Consecutive blocking responses
+	Failures int
+	// Last blocking response status
+	Status string
+	// Number of times the breaker opened
+	Trips int
+}
+
+// CircuitBreaker stops crawling requests after consecutive blocking
+// responses, instead of hammering a server refusing them. Once the cooldown
+// expires, a single blocking response opens it again.
+type CircuitBreaker struct {
+	lock      sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+	failures  int
+	until     time.Time
+	status    string
+	trips     int
+}
+
+func NewCircuitBreaker(threshold int, cooldown time.Duration,
+	now func() time.Time) *CircuitBreaker {
+
+	return &CircuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       now,
+	}
+}
+
+// crawlBreaker guards all crawling requests.
+var crawlBreaker = NewCircuitBreaker(breakerThreshold, breakerCooldown, time.Now)
+
+// Allow returns a BlockedError if the breaker is open.
+func (b *CircuitBreaker) Allow() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.now().Before(b.until) {
+		return &BlockedError{
+			Until:  b.until,
+			Status: b.status,
+		}
+	}
+	return nil
+}
+
+// Success closes the breaker.
+func (b *CircuitBreaker) Success() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.failures = 0
+	b.until = time.Time{}
+}
+
+// Blocked records a blocking response with status, asking to retry after
+// retryAfter if not zero. It returns a BlockedError if the breaker opened.
+func (b *CircuitBreaker) Blocked(status string, retryAfter time.Duration) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.failures++
+	b.status = status
+	tripped := b.failures >= b.threshold || !b.until.IsZero()
+	if !tripped {
+		return nil
+	}
+	cooldown := b.cooldown
+	if retryAfter > cooldown {
+		cooldown = retryAfter
+	}
+	b.until = b.now().Add(cooldown)
+	b.trips++
+	return &BlockedError{
+		Until:  b.until,
+		Status: status,
+	}
+}
+
+func (b *CircuitBreaker) Status() BreakerStatus {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return BreakerStatus{
+		Open:     b.now().Before(b.until),
+		Until:    b.until,
+		Failures: b.failures,
+		Status:   b.status,
+		Trips:    b.trips,
+	}
+}
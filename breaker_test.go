@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2017, 1, 2, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		Value    string
+		Expected time.Duration
+	}{
+		{"", 0},
+		{"120", 2 * time.Minute},
+		{"-1", 0},
+		{"Mon, 02 Jan 2017 10:05:00 GMT", 5 * time.Minute},
+		{"Mon, 02 Jan 2017 09:00:00 GMT", 0},
+		{"soon", 0},
+	}
+	for _, test := range tests {
+		d := parseRetryAfter(test.Value, now)
+		if d != test.Expected {
+			t.Fatalf("%q: expected %s, got %s", test.Value, test.Expected, d)
+		}
+	}
+}
+
+func TestCrawlBreaker(t *testing.T) {
+	now := time.Date(2017, 1, 2, 10, 0, 0, 0, time.UTC)
+	clock := func() time.Time {
+		return now
+	}
+	breaker, sleep := crawlBreaker, crawlSleep
+	defer func() {
+		crawlBreaker, crawlSleep = breaker, sleep
+	}()
+	crawlBreaker = NewCircuitBreaker(3, time.Hour, clock)
+	sleeps := []time.Duration{}
+	crawlSleep = func(d time.Duration) {
+		sleeps = append(sleeps, d)
+	}
+
+	requests := 0
+	codes := []int{429, 403, 200}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code := codes[requests%len(codes)]
+		requests++
+		if code == 429 {
+			w.Header().Set("Retry-After", "300")
+		}
+		w.WriteHeader(code)
+	}))
+	defer server.Close()
+
+	// Rate limited requests honor Retry-After, successes reset the breaker
+	output, err := tryHTTP(server.URL, time.Second, 5, nil)
+	if err != nil {
+		t.Fatalf("request failed: %s", err)
+	}
+	output.Close()
+	if len(sleeps) != 2 || sleeps[0] != 5*time.Minute || sleeps[1] != 2*time.Second {
+		t.Fatalf("unexpected delays: %v", sleeps)
+	}
+	if st := crawlBreaker.Status(); st.Failures != 0 || st.Open {
+		t.Fatalf("breaker was not reset: %+v", st)
+	}
+
+	// Repeated blocking responses open the breaker
+	codes = []int{403}
+	_, err = tryHTTP(server.URL, time.Second, 5, nil)
+	blocked, ok := err.(*BlockedError)
+	if !ok || requests != 6 || !blocked.Until.Equal(now.Add(time.Hour)) {
+		t.Fatalf("breaker did not open after %d requests: %v", requests, err)
+	}
+	_, err = tryHTTP(server.URL, time.Second, 5, nil)
+	if _, ok := err.(*BlockedError); !ok || requests != 6 {
+		t.Fatalf("open breaker let requests through: %d, %v", requests, err)
+	}
+	if st := crawlBreaker.Status(); !st.Open || st.Trips != 1 ||
+		st.Status != "403 Forbidden" {
+		t.Fatalf("unexpected breaker status: %+v", st)
+	}
+
+	// A single blocking response opens it again after the cooldown
+	now = now.Add(time.Hour)
+	_, err = tryHTTP(server.URL, time.Second, 5, nil)
+	if _, ok := err.(*BlockedError); !ok || requests != 7 {
+		t.Fatalf("breaker did not open again: %d, %v", requests, err)
+	}
+}
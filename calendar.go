@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pmezard/apec/jstruct"
+	"github.com/pquerna/ffjson/ffjson"
+)
+
+// Selected offers can be exported as an iCalendar file, with an event on the
+// day they are expected to be withdrawn. The estimate is the offer initial
+// date plus the median lifetime of deleted offers of the same account, or of
+// all accounts when there is not enough history.
+
+const (
+	// Accounts with fewer deleted offers use the global median lifetime
+	minLifetimeSamples = 5
+	// Lifetimes are recomputed from the store after this delay
+	lifetimesTTL = 24 * time.Hour
+)
+
+type sortedDurations []time.Duration
+
+func (s sortedDurations) Len() int {
+	return len(s)
+}
+
+func (s sortedDurations) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s sortedDurations) Less(i, j int) bool {
+	return s[i] < s[j]
+}
+
+func medianDuration(values []time.Duration) time.Duration {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration{}, values...)
+	sort.Sort(sortedDurations(sorted))
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// OfferLifetimes holds median lifetimes of deleted offers, per account and
+// for all accounts.
+type OfferLifetimes struct {
+	Accounts map[string]time.Duration
+	All      time.Duration
+}
+
+// Estimate returns how long offers of account usually stay online, or zero if
+// no offer was ever deleted.
+func (l *OfferLifetimes) Estimate(account string) time.Duration {
+	if d, ok := l.Accounts[account]; ok {
+		return d
+	}
+	return l.All
+}
+
+// computeOfferLifetimes measures deleted offers lifetimes, from their initial
+// date, or publication date, to their deletion.
+func computeOfferLifetimes(store *Store) (*OfferLifetimes, error) {
+	ids, err := store.ListDeletedIds()
+	if err != nil {
+		return nil, err
+	}
+	all := []time.Duration{}
+	accounts := map[string][]time.Duration{}
+	for _, id := range ids {
+		deleted, err := store.ListDeletedOffers(id)
+		if err != nil {
+			return nil, err
+		}
+		initialDate, err := store.GetInitialDate(id)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range deleted {
+			data, err := store.GetDeleted(d.Id)
+			if err != nil {
+				return nil, err
+			}
+			js := &jstruct.JsonOffer{}
+			err = ffjson.Unmarshal(data, js)
+			if err != nil {
+				return nil, err
+			}
+			start := initialDate
+			if start.IsZero() {
+				start, err = time.Parse(offerDateLayout, js.Date)
+				if err != nil {
+					return nil, fmt.Errorf("cannot parse offer date: %s", err)
+				}
+			}
+			end, err := time.Parse(time.RFC3339, d.Date)
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse deleted offer date: %s", err)
+			}
+			lifetime := end.Sub(start)
+			if lifetime < 0 {
+				continue
+			}
+			all = append(all, lifetime)
+			accounts[js.Account] = append(accounts[js.Account], lifetime)
+		}
+	}
+	lifetimes := &OfferLifetimes{
+		Accounts: map[string]time.Duration{},
+		All:      medianDuration(all),
+	}
+	for account, values := range accounts {
+		if len(values) >= minLifetimeSamples {
+			lifetimes.Accounts[account] = medianDuration(values)
+		}
+	}
+	return lifetimes, nil
+}
+
+// LifetimesCache computes offer lifetimes on demand and keeps them for
+// lifetimesTTL.
+type LifetimesCache struct {
+	store     *Store
+	lock      sync.Mutex
+	lifetimes *OfferLifetimes
+	updated   time.Time
+}
+
+func NewLifetimesCache(store *Store) *LifetimesCache {
+	return &LifetimesCache{
+		store: store,
+	}
+}
+
+func (c *LifetimesCache) Get(now time.Time) (*OfferLifetimes, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.lifetimes == nil || now.Sub(c.updated) > lifetimesTTL {
+		lifetimes, err := computeOfferLifetimes(c.store)
+		if err != nil {
+			return nil, err
+		}
+		c.lifetimes = lifetimes
+		c.updated = now
+	}
+	return c.lifetimes, nil
+}
+
+// escapeICalText escapes TEXT property values as described in RFC 5545.
+func escapeICalText(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, ";", `\;`, -1)
+	s = strings.Replace(s, ",", `\,`, -1)
+	s = strings.Replace(s, "\r\n", `\n`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	return s
+}
+
+// writeICalLine writes a content line, folded in lines of at most 75 bytes
+// without splitting UTF-8 sequences.
+func writeICalLine(w io.Writer, line string) error {
+	buf := &bytes.Buffer{}
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		buf.WriteString(line[:cut])
+		buf.WriteString("\r\n ")
+		line = line[cut:]
+		// The leading space counts
+		limit = 74
+	}
+	buf.WriteString(line)
+	buf.WriteString("\r\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// CalendarOffer is an offer with its estimated withdrawal date.
+type CalendarOffer struct {
+	Offer       *Offer
+	InitialDate time.Time
+	Lifetime    time.Duration
+	Expiry      time.Time
+}
+
+func makeCalendarOffer(store *Store, lifetimes *OfferLifetimes, id string,
+	now time.Time) (*CalendarOffer, error) {
+
+	offer, err := getStoreOffer(store, id)
+	if err != nil || offer == nil {
+		return nil, err
+	}
+	initialDate, err := store.GetInitialDate(id)
+	if err != nil {
+		return nil, err
+	}
+	if initialDate.IsZero() {
+		initialDate = offer.Date
+	}
+	lifetime := lifetimes.Estimate(offer.Account)
+	if lifetime == 0 {
+		lifetime = 30 * 24 * time.Hour
+	}
+	expiry := initialDate.Add(lifetime)
+	if expiry.Before(now) {
+		// Overdue offers may disappear any day now
+		expiry = now.Add(24 * time.Hour)
+	}
+	return &CalendarOffer{
+		Offer:       offer,
+		InitialDate: initialDate,
+		Lifetime:    lifetime,
+		Expiry:      expiry,
+	}, nil
+}
+
+// writeICal writes offers expiry events, dated in now location.
+func writeICal(w io.Writer, offers []*CalendarOffer, now time.Time) error {
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//apec//offers//FR",
+		"CALSCALE:GREGORIAN",
+	}
+	stamp := now.UTC().Format("20060102T150405Z")
+	days := func(d time.Duration) int {
+		return int(d / (24 * time.Hour))
+	}
+	for _, o := range offers {
+		initialDate := o.InitialDate.In(now.Location())
+		expiry := o.Expiry.In(now.Location())
+		desc := fmt.Sprintf("%s (%s)\nOnline since %s (%d days), offers of %s "+
+			"usually stay online %d days.\n%s", o.Offer.Title, o.Offer.Location,
+			initialDate.Format("2006-01-02"), offerAgeDays(initialDate, now),
+			o.Offer.Account, days(o.Lifetime), o.Offer.URL)
+		lines = append(lines,
+			"BEGIN:VEVENT",
+			"UID:"+o.Offer.Id+"@apec",
+			"DTSTAMP:"+stamp,
+			"DTSTART;VALUE=DATE:"+expiry.Format("20060102"),
+			"DTEND;VALUE=DATE:"+expiry.AddDate(0, 0, 1).Format("20060102"),
+			"SUMMARY:"+escapeICalText("Expires soon: "+o.Offer.Title+
+				" - "+o.Offer.Account),
+			"DESCRIPTION:"+escapeICalText(desc),
+			"URL:"+o.Offer.URL,
+			"BEGIN:VALARM",
+			"ACTION:DISPLAY",
+			"DESCRIPTION:"+escapeICalText(o.Offer.Title),
+			"TRIGGER:-P2D",
+			"END:VALARM",
+			"END:VEVENT",
+		)
+	}
+	lines = append(lines, "END:VCALENDAR")
+	for _, line := range lines {
+		err := writeICalLine(w, line)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleCalendar writes the expiry events of "id" offers, dated in loc.
+func handleCalendar(store *Store, lifetimes *LifetimesCache, loc *time.Location,
+	w http.ResponseWriter, r *http.Request) error {
+
+	err := r.ParseForm()
+	if err != nil {
+		return err
+	}
+	ids := normalizeOfferIds(r.Form["id"])
+	if len(ids) == 0 {
+		return fmt.Errorf("no offer selected")
+	}
+	if len(ids) > 1000 {
+		return fmt.Errorf("too many offers selected: %d", len(ids))
+	}
+	now := time.Now().In(loc)
+	lt, err := lifetimes.Get(now)
+	if err != nil {
+		return err
+	}
+	offers := []*CalendarOffer{}
+	for _, id := range ids {
+		offer, err := makeCalendarOffer(store, lt, id, now)
+		if err != nil {
+			return err
+		}
+		if offer != nil {
+			offers = append(offers, offer)
+		}
+	}
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="offers.ics"`)
+	return writeICal(w, offers, now)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteICalLine(t *testing.T) {
+	long := escapeICalText("SUMMARY:Développeur; C, C++\\Go\n" +
+		strings.Repeat("é", 80))
+	buf := &bytes.Buffer{}
+	err := writeICalLine(buf, long)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(buf.String(), "\r\n")
+	if len(lines) != 4 || lines[3] != "" {
+		t.Fatalf("unexpected folding: %q", lines)
+	}
+	unfolded := ""
+	for i, line := range lines[:3] {
+		if len(line) > 75 {
+			t.Fatalf("line is too long: %q", line)
+		}
+		if i > 0 {
+			if !strings.HasPrefix(line, " ") {
+				t.Fatalf("continuation line does not start with a space: %q", line)
+			}
+			line = line[1:]
+		}
+		unfolded += line
+	}
+	if unfolded != long {
+		t.Fatalf("unexpected unfolded line: %q", unfolded)
+	}
+	if !strings.HasPrefix(long, `SUMMARY:Développeur\; C\, C++\\Go\néé`) {
+		t.Fatalf("unexpected escaping: %q", long)
+	}
+}
+
+func TestWriteICalTimezone(t *testing.T) {
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Published and expiring late on Monday UTC, on Tuesday in Paris
+	offer := &CalendarOffer{
+		Offer: &Offer{
+			Id:      "apec:1001",
+			Title:   "Développeur Go",
+			Account: "Hooli",
+		},
+		InitialDate: time.Date(2017, 1, 2, 23, 30, 0, 0, time.UTC),
+		Lifetime:    7 * 24 * time.Hour,
+		Expiry:      time.Date(2017, 1, 9, 23, 30, 0, 0, time.UTC),
+	}
+	buf := &bytes.Buffer{}
+	err = writeICal(buf, []*CalendarOffer{offer},
+		time.Date(2017, 1, 5, 12, 0, 0, 0, paris))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := buf.String()
+	for _, s := range []string{
+		"DTSTART;VALUE=DATE:20170110\r\n",
+		"DTEND;VALUE=DATE:20170111\r\n",
+		"Online since 2017-01-03 (2 days)",
+	} {
+		if !strings.Contains(body, s) {
+			t.Fatalf("%q not found in:\n%s", s, body)
+		}
+	}
+}
+
+func TestMedianDuration(t *testing.T) {
+	tests := []struct {
+		Values []time.Duration
+		Median time.Duration
+	}{
+		{nil, 0},
+		{[]time.Duration{3}, 3},
+		{[]time.Duration{5, 1, 3}, 3},
+		{[]time.Duration{4, 1, 2, 10}, 3},
+	}
+	for _, test := range tests {
+		median := medianDuration(test.Values)
+		if median != test.Median {
+			t.Fatalf("%v: expected %d, got %d", test.Values, test.Median, median)
+		}
+	}
+}
+
+func addDeletedOffers(t *testing.T, store *Store, start int, account string,
+	count int, lifetime time.Duration) {
+
+	published := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < count; i++ {
+		id := fmt.Sprintf("%d", start+i)
+		err := store.Put(id, []byte(fmt.Sprintf(`{"numeroOffre":"%s",`+
+			`"datePublication":"2017-01-01T00:00:00.000+0000",`+
+			`"nomCompteEtablissement":"%s"}`, id, account)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = store.Delete(id, published.Add(lifetime))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestHandleCalendar(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	day := 24 * time.Hour
+	addDeletedOffers(t, env.Store, 2000, "ACME", 5, 10*day)
+	addDeletedOffers(t, env.Store, 3000, "Hooli", 4, 40*day)
+	addDeletedOffers(t, env.Store, 4000, "Globex", 2, 50*day)
+	lifetimes, err := computeOfferLifetimes(env.Store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lifetimes.Estimate("ACME") != 10*day || lifetimes.Estimate("Hooli") != 40*day ||
+		lifetimes.Estimate("unknown") != 40*day {
+		t.Fatalf("unexpected lifetimes: %+v", lifetimes)
+	}
+
+	now := time.Date(2017, 1, 5, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		Id     string
+		Expiry string
+	}{
+		{"apec:1001", "2017-01-12"},
+		{"apec:1005", "2017-02-15"},
+	}
+	for _, test := range tests {
+		offer, err := makeCalendarOffer(env.Store, lifetimes, test.Id, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if offer.Expiry.Format("2006-01-02") != test.Expiry {
+			t.Fatalf("%s: expected expiry on %s, got %s", test.Id, test.Expiry,
+				offer.Expiry)
+		}
+	}
+	// Overdue
+	offer, err := makeCalendarOffer(env.Store, lifetimes, "apec:1001",
+		time.Date(2017, 3, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offer.Expiry.Format("2006-01-02") != "2017-03-02" {
+		t.Fatalf("unexpected overdue expiry: %s", offer.Expiry)
+	}
+
+	cache := NewLifetimesCache(env.Store)
+	values := url.Values{}
+	values["id"] = []string{"1001", "apec:1005", "9999"}
+	w := env.Get(func(w http.ResponseWriter, r *http.Request) {
+		err := handleCalendar(env.Store, cache, time.UTC, w, r)
+		if err != nil {
+			t.Fatalf("calendar failed: %s", err)
+		}
+	}, "/calendar.ics", values)
+	body := w.Body.String()
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/calendar") {
+		t.Fatalf("unexpected content type: %s", ct)
+	}
+	if strings.Count(body, "BEGIN:VEVENT\r\n") != 2 {
+		t.Fatalf("unexpected events:\n%s", body)
+	}
+	for _, s := range []string{
+		"BEGIN:VCALENDAR\r\n",
+		"UID:apec:1001@apec\r\n",
+		"UID:apec:1005@apec\r\n",
+		"SUMMARY:Expires soon: Architecte H/F - Hooli\r\n",
+		"TRIGGER:-P2D\r\n",
+		"END:VCALENDAR\r\n",
+	} {
+		if !strings.Contains(body, s) {
+			t.Fatalf("%q not found in:\n%s", s, body)
+		}
+	}
+}
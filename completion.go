@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/alecthomas/kingpin"
+)
+
+// completionCommand is a command of the completion tree, with its visible
+// flags and subcommands.
+type completionCommand struct {
+	Name     string
+	Help     string
+	Flags    []completionFlag
+	Commands []*completionCommand
+}
+
+type completionFlag struct {
+	Name string
+	Help string
+}
+
+// firstLine returns the first line of multi-line commands help.
+func firstLine(s string) string {
+	return strings.TrimSpace(strings.SplitN(s, "\n", 2)[0])
+}
+
+func completionFlags(group *kingpin.FlagGroupModel) []completionFlag {
+	flags := []completionFlag{}
+	if group == nil {
+		return flags
+	}
+	for _, f := range group.Flags {
+		if f.Hidden {
+			continue
+		}
+		flags = append(flags, completionFlag{
+			Name: f.Name,
+			Help: firstLine(f.Help),
+		})
+	}
+	return flags
+}
+
+func completionCommands(commands []*kingpin.CmdModel) []*completionCommand {
+	result := []*completionCommand{}
+	for _, cmd := range commands {
+		if cmd.Hidden {
+			continue
+		}
+		result = append(result, &completionCommand{
+			Name:     cmd.Name,
+			Help:     firstLine(cmd.Help),
+			Flags:    completionFlags(cmd.FlagGroupModel),
+			Commands: completionCommands(cmd.Commands),
+		})
+	}
+	return result
+}
+
+// completionTree returns the visible commands and flags of app.
+func completionTree(app *kingpin.Application) *completionCommand {
+	model := app.Model()
+	return &completionCommand{
+		Name:     "apec",
+		Flags:    completionFlags(model.FlagGroupModel),
+		Commands: completionCommands(model.Commands),
+	}
+}
+
+// walkCompletion calls fn on root and its subcommands, with their full
+// command path and the flags inherited from their parents.
+func walkCompletion(root *completionCommand,
+	fn func(path []string, cmd *completionCommand, inherited []completionFlag)) {
+
+	var walk func(path []string, cmd *completionCommand, inherited []completionFlag)
+	walk = func(path []string, cmd *completionCommand, inherited []completionFlag) {
+		fn(path, cmd, inherited)
+		flags := append(append([]completionFlag{}, inherited...), cmd.Flags...)
+		for _, sub := range cmd.Commands {
+			walk(append(append([]string{}, path...), sub.Name), sub, flags)
+		}
+	}
+	walk(nil, root, nil)
+}
+
+func writeBashCompletion(w io.Writer, root *completionCommand) error {
+	paths := []string{}
+	words := map[string][]string{}
+	walkCompletion(root, func(path []string, cmd *completionCommand,
+		inherited []completionFlag) {
+
+		p := strings.Join(path, " ")
+		if p != "" {
+			paths = append(paths, p)
+		}
+		for _, sub := range cmd.Commands {
+			words[p] = append(words[p], sub.Name)
+		}
+		for _, f := range append(append([]completionFlag{}, inherited...), cmd.Flags...) {
+			words[p] = append(words[p], "--"+f.Name)
+		}
+	})
+	sort.Strings(paths)
+
+	fmt.Fprintf(w, `_%[1]s() {
+	local cur cmd word words i
+	cur="${COMP_WORDS[COMP_CWORD]}"
+	cmd=""
+	for ((i=1; i<COMP_CWORD; i++)); do
+		word="${cmd:+$cmd }${COMP_WORDS[i]}"
+		case "$word" in
+`, root.Name)
+	for _, p := range paths {
+		fmt.Fprintf(w, "\t\t%q) cmd=\"$word\" ;;\n", p)
+	}
+	fmt.Fprintf(w, "\t\tesac\n\tdone\n\tcase \"$cmd\" in\n")
+	for _, p := range append([]string{""}, paths...) {
+		fmt.Fprintf(w, "\t%q) words=%q ;;\n", p, strings.Join(words[p], " "))
+	}
+	_, err := fmt.Fprintf(w, `	esac
+	COMPREPLY=($(compgen -W "$words" -- "$cur"))
+}
+complete -o default -F _%[1]s %[1]s
+`, root.Name)
+	return err
+}
+
+func writeZshCompletion(w io.Writer, root *completionCommand) error {
+	_, err := fmt.Fprintf(w, "autoload -U +X bashcompinit && bashcompinit\n")
+	if err != nil {
+		return err
+	}
+	return writeBashCompletion(w, root)
+}
+
+// fishQuote quotes s as a fish single quoted string.
+func fishQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return "'" + strings.Replace(s, "'", `\'`, -1) + "'"
+}
+
+func writeFishCompletion(w io.Writer, root *completionCommand) error {
+	fmt.Fprintf(w, "complete -c %s -f\n", root.Name)
+	walkCompletion(root, func(path []string, cmd *completionCommand,
+		inherited []completionFlag) {
+
+		// Match commands by their last word, fish has no better primitive
+		condition := "__fish_use_subcommand"
+		if len(path) > 0 {
+			condition = "__fish_seen_subcommand_from " + path[len(path)-1]
+		}
+		for _, sub := range cmd.Commands {
+			fmt.Fprintf(w, "complete -c %s -n %s -a %s -d %s\n", root.Name,
+				fishQuote(condition), sub.Name, fishQuote(sub.Help))
+		}
+		for _, f := range cmd.Flags {
+			if len(path) == 0 {
+				fmt.Fprintf(w, "complete -c %s -l %s -d %s\n", root.Name, f.Name,
+					fishQuote(f.Help))
+				continue
+			}
+			fmt.Fprintf(w, "complete -c %s -n %s -l %s -d %s\n", root.Name,
+				fishQuote(condition), f.Name, fishQuote(f.Help))
+		}
+	})
+	return nil
+}
+
+var (
+	completionCmd = app.Command("completion", `print a shell completion script
+
+Load it with:
+
+  $ source <(apec completion bash)
+`)
+	completionShell = completionCmd.Arg("shell", "bash, zsh or fish").
+			Required().Enum("bash", "zsh", "fish")
+)
+
+func completionFn(cfg *Config) error {
+	root := completionTree(app)
+	switch *completionShell {
+	case "zsh":
+		return writeZshCompletion(os.Stdout, root)
+	case "fish":
+		return writeFishCompletion(os.Stdout, root)
+	}
+	return writeBashCompletion(os.Stdout, root)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func newTestCompletionTree() *completionCommand {
+	return &completionCommand{
+		Name:  "apec",
+		Flags: []completionFlag{{"data", "data directory"}},
+		Commands: []*completionCommand{
+			{
+				Name:  "search",
+				Help:  "search APEC index",
+				Flags: []completionFlag{{"as-of", "search offers active on date"}},
+			},
+			{
+				Name: "export",
+				Help: "export offers data",
+				Commands: []*completionCommand{
+					{
+						Name:  "context",
+						Help:  "export an offer's context",
+						Flags: []completionFlag{{"format", "output format"}},
+					},
+				},
+			},
+		},
+	}
+}
+
+func checkContains(t *testing.T, script string, expected []string) {
+	for _, s := range expected {
+		if !strings.Contains(script, s) {
+			t.Fatalf("%q not found in:\n%s", s, script)
+		}
+	}
+}
+
+func TestBashCompletion(t *testing.T) {
+	buf := &bytes.Buffer{}
+	err := writeZshCompletion(buf, newTestCompletionTree())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkContains(t, buf.String(), []string{
+		"bashcompinit\n",
+		"\t\t\"export context\") cmd=\"$word\" ;;\n",
+		"\t\"\") words=\"search export --data\" ;;\n",
+		"\t\"search\") words=\"--data --as-of\" ;;\n",
+		"\t\"export\") words=\"context --data\" ;;\n",
+		"\t\"export context\") words=\"--data --format\" ;;\n",
+		"complete -o default -F _apec apec\n",
+	})
+}
+
+func TestFishCompletion(t *testing.T) {
+	buf := &bytes.Buffer{}
+	err := writeFishCompletion(buf, newTestCompletionTree())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkContains(t, buf.String(), []string{
+		"complete -c apec -l data -d 'data directory'\n",
+		"complete -c apec -n '__fish_use_subcommand' -a search -d 'search APEC index'\n",
+		"complete -c apec -n '__fish_seen_subcommand_from export' -a context " +
+			"-d 'export an offer\\'s context'\n",
+		"complete -c apec -n '__fish_seen_subcommand_from context' -l format " +
+			"-d 'output format'\n",
+	})
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Text responses like search pages, feeds or exports are gzipped for clients
+// accepting it. Images are already compressed and served as is.
+
+const (
+	compressionGzip = "gzip"
+	compressionNone = "none"
+
+	defaultCompressMinSize = 1024
+)
+
+// compressedTypes lists the compressible media types, or their prefixes
+// when ending with a slash.
+var compressedTypes = []string{
+	"text/",
+	"application/json",
+	"application/geo+json",
+	"application/javascript",
+	"application/xml",
+	"application/atom+xml",
+	"application/opensearchdescription+xml",
+	"image/svg+xml",
+}
+
+func isCompressedType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range compressedTypes {
+		if mediaType == t ||
+			(strings.HasSuffix(t, "/") && strings.HasPrefix(mediaType, t)) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsGzip returns true if the request Accept-Encoding header allows gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		// "gzip;q=0" explicitly refuses it
+		if len(fields) > 1 {
+			param := strings.TrimSpace(fields[1])
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				if err == nil && q <= 0 {
+					continue
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipResponseWriter buffers the first minSize bytes of a response, then
+// decides whether to compress it from its status, headers and size.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	minSize int
+	// False if the client cannot receive a compressed response, which still
+	// varies with the encoding
+	compress bool
+	status   int
+	buf      bytes.Buffer
+	// Set once the response headers were sent
+	started bool
+	gz      *gzip.Writer
+}
+
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// shouldCompress returns true if the response must be compressed. It adds
+// the Vary header to every compressible response, compressed or not, so
+// caches do not serve one encoding to clients asking for the other.
+func (w *gzipResponseWriter) shouldCompress() bool {
+	h := w.Header()
+	contentType := h.Get("Content-Type")
+	if contentType == "" && w.buf.Len() > 0 {
+		contentType = http.DetectContentType(w.buf.Bytes())
+		h.Set("Content-Type", contentType)
+	}
+	if !isCompressedType(contentType) {
+		return false
+	}
+	addVary(h, "Accept-Encoding")
+	return w.compress && w.status == http.StatusOK &&
+		h.Get("Content-Encoding") == "" && h.Get("Content-Range") == "" &&
+		w.buf.Len() >= w.minSize
+}
+
+// addVary adds name to the Vary header, unless it is already listed.
+func addVary(h http.Header, name string) {
+	for _, v := range h["Vary"] {
+		for _, field := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), name) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", name)
+}
+
+// start sends the response headers and buffered data.
+func (w *gzipResponseWriter) start() error {
+	w.started = true
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.shouldCompress() {
+		w.Header().Del("Content-Length")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	var err error
+	if w.gz != nil {
+		_, err = w.gz.Write(w.buf.Bytes())
+	} else {
+		_, err = w.ResponseWriter.Write(w.buf.Bytes())
+	}
+	w.buf.Reset()
+	return err
+}
+
+func (w *gzipResponseWriter) Write(data []byte) (int, error) {
+	if !w.started {
+		w.buf.Write(data)
+		if w.compress && w.buf.Len() < w.minSize {
+			return len(data), nil
+		}
+		return len(data), w.start()
+	}
+	if w.gz != nil {
+		return w.gz.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+// Flush sends buffered data, then flushes the compressed stream and the
+// underlying writer. Responses flushed before minSize bytes are written are
+// not compressed.
+func (w *gzipResponseWriter) Flush() {
+	if !w.started {
+		err := w.start()
+		if err != nil {
+			return
+		}
+	}
+	if w.gz != nil {
+		err := w.gz.Flush()
+		if err != nil {
+			return
+		}
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close sends buffered data and terminates the compressed stream.
+func (w *gzipResponseWriter) Close() error {
+	if !w.started {
+		err := w.start()
+		if err != nil {
+			return err
+		}
+	}
+	if w.gz != nil {
+		return w.gz.Close()
+	}
+	return nil
+}
+
+// Compressed wraps handler so its compressible responses of at least
+// minSize bytes are gzipped, for clients accepting it.
+func Compressed(minSize int, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gw := &gzipResponseWriter{
+			ResponseWriter: w,
+			minSize:        minSize,
+			compress: r.Method != "HEAD" && r.Header.Get("Range") == "" &&
+				acceptsGzip(r),
+		}
+		defer gw.Close()
+		handler.ServeHTTP(gw, r)
+	})
+}
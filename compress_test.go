@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	for _, c := range []struct {
+		Header   string
+		Expected bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"deflate, gzip;q=1.0, br", true},
+		{"GZIP", true},
+		{"*", true},
+		{"identity", false},
+		{"gzip;q=0", false},
+		{"gzip; q=0.000, deflate", false},
+		{"br, gzip;q=0.5", true},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", c.Header)
+		if acceptsGzip(r) != c.Expected {
+			t.Errorf("unexpected result for %q: %v", c.Header, !c.Expected)
+		}
+	}
+}
+
+func TestCompressed(t *testing.T) {
+	page := strings.Repeat("<p>Développeur Go</p>\n", 100)
+	handler := Compressed(1024, http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/search":
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				w.Write([]byte(page[:len(page)/2]))
+				w.Write([]byte(page[len(page)/2:]))
+			case "/small":
+				w.Header().Set("Content-Type", "text/plain")
+				w.Write([]byte("OK"))
+			case "/densitymap":
+				w.Header().Set("Content-Type", "image/png")
+				w.Write([]byte(page))
+			case "/error":
+				w.Header().Set("Content-Type", "text/plain")
+				w.WriteHeader(400)
+				w.Write([]byte(page))
+			}
+		}))
+	get := func(path, encoding string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path, nil)
+		if encoding != "" {
+			r.Header.Set("Accept-Encoding", encoding)
+		}
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := get("/search", "gzip, deflate")
+	if w.Code != 200 || w.Header().Get("Content-Encoding") != "gzip" ||
+		w.Header().Get("Vary") != "Accept-Encoding" ||
+		w.Body.Len() >= len(page) {
+		t.Fatalf("page was not compressed: %d %v %d", w.Code, w.Header(),
+			w.Body.Len())
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(w.Body.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != page {
+		t.Fatalf("unexpected decompressed page:\n%s", data)
+	}
+
+	// Other responses are left unchanged
+	for _, c := range []struct {
+		Path     string
+		Encoding string
+		Code     int
+		Body     string
+	}{
+		{"/search", "", 200, page},
+		{"/search", "gzip;q=0", 200, page},
+		{"/small", "gzip", 200, "OK"},
+		{"/densitymap", "gzip", 200, page},
+		{"/error", "gzip", 400, page},
+	} {
+		w := get(c.Path, c.Encoding)
+		if w.Code != c.Code || w.Header().Get("Content-Encoding") != "" ||
+			w.Body.String() != c.Body {
+			t.Fatalf("unexpected response for %s with %q: %d %v", c.Path,
+				c.Encoding, w.Code, w.Header())
+		}
+	}
+	for _, c := range []struct {
+		Path     string
+		Encoding string
+		Vary     string
+	}{
+		{"/small", "gzip", "Accept-Encoding"},
+		{"/search", "", "Accept-Encoding"},
+		{"/error", "gzip", "Accept-Encoding"},
+		{"/densitymap", "gzip", ""},
+	} {
+		v := get(c.Path, c.Encoding).Header()["Vary"]
+		if strings.Join(v, ",") != c.Vary {
+			t.Fatalf("unexpected Vary for %s with %q: %q", c.Path, c.Encoding, v)
+		}
+	}
+}
+
+func TestCompressedFlush(t *testing.T) {
+	page := strings.Repeat("<p>Développeur Go</p>\n", 100)
+	flushed := make(chan []byte)
+	handler := Compressed(1024, http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte(page))
+			w.(http.Flusher).Flush()
+			flushed <- nil
+			<-flushed
+			w.Write([]byte(page))
+		}))
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/export", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	done := make(chan bool)
+	go func() {
+		handler.ServeHTTP(w, r)
+		close(done)
+	}()
+	<-flushed
+	// Data written before Flush can be decompressed without the stream end
+	if !w.Flushed || w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("response was not flushed: %v %v", w.Flushed, w.Header())
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(w.Body.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, len(page))
+	_, err = io.ReadFull(gz, data)
+	if err != nil || string(data) != page {
+		t.Fatalf("unexpected flushed data: %q, %v", data, err)
+	}
+	flushed <- nil
+	<-done
+	gz, err = gzip.NewReader(bytes.NewReader(w.Body.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err = ioutil.ReadAll(gz)
+	if err != nil || string(data) != page+page {
+		t.Fatalf("unexpected decompressed response: %v", err)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/blevesearch/bleve"
+)
+
+// ConsistencyReport compares the store with the indexes serving it.
+type ConsistencyReport struct {
+	Stored   int
+	Geocoded int
+	Indexed  int
+	Spatial  int
+	Queued   int
+	// Time the indexing queue has been lagging, zero if it is empty or
+	// unknown
+	QueueAge time.Duration
+}
+
+// probeConsistency counts stored, geocoded and indexed offers. queue is
+// optional, replicas have none.
+func probeConsistency(store *Store, index bleve.Index, spatial *SpatialIndex,
+	queue *IndexQueue, now time.Time) (*ConsistencyReport, error) {
+
+	ids, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	report := &ConsistencyReport{
+		Stored:  len(ids),
+		Spatial: len(spatial.List()),
+	}
+	for _, id := range ids {
+		loc, _, err := store.GetLocation(id)
+		if err != nil {
+			return nil, err
+		}
+		if loc != nil {
+			report.Geocoded++
+		}
+	}
+	count, err := index.DocCount()
+	if err != nil {
+		return nil, err
+	}
+	report.Indexed = int(count)
+	if queue != nil {
+		report.Queued = queue.Size()
+		since, err := queue.Since()
+		if err != nil {
+			return nil, err
+		}
+		if !since.IsZero() && now.After(since) {
+			report.QueueAge = now.Sub(since)
+		}
+	}
+	return report, nil
+}
+
+func drifted(expected, actual int, maxDrift float64) bool {
+	diff := expected - actual
+	if diff < 0 {
+		diff = -diff
+	}
+	return float64(diff) > float64(expected)*maxDrift/100
+}
+
+// Drifts describes the counts differing by more than maxDrift percents of
+// the stored ones, and a queue lagging for more than maxAge.
+func (r *ConsistencyReport) Drifts(maxDrift float64,
+	maxAge time.Duration) []string {
+
+	drifts := []string{}
+	if drifted(r.Stored, r.Indexed, maxDrift) {
+		drifts = append(drifts, fmt.Sprintf("%d offers stored but %d indexed",
+			r.Stored, r.Indexed))
+	}
+	if drifted(r.Geocoded, r.Spatial, maxDrift) {
+		drifts = append(drifts, fmt.Sprintf("%d offers geocoded but %d "+
+			"spatially indexed", r.Geocoded, r.Spatial))
+	}
+	if maxAge > 0 && r.QueueAge > maxAge {
+		drifts = append(drifts, fmt.Sprintf("%d queued operations, lagging "+
+			"for %s", r.Queued, r.QueueAge.Truncate(time.Second)))
+	}
+	return drifts
+}
+
+// checkConsistency probes replica and queue consistency and calls sync if
+// they drifted beyond maxDrift and maxAge.
+func checkConsistency(replica *Replica, queue *IndexQueue, maxDrift float64,
+	maxAge time.Duration, sync func() error) error {
+
+	report, err := probeConsistency(replica.Store, replica.Index.Get(),
+		replica.Spatial, queue, time.Now())
+	if err != nil {
+		return err
+	}
+	drifts := report.Drifts(maxDrift, maxAge)
+	if len(drifts) == 0 {
+		log.Printf("store and indexes are consistent: %d offers, %d indexed, "+
+			"%d spatially indexed", report.Stored, report.Indexed, report.Spatial)
+		return nil
+	}
+	banner := strings.Repeat("*", 72)
+	log.Printf("%s", banner)
+	log.Printf("warning: indexes are out of sync with the store, search " +
+		"results may be stale:")
+	for _, drift := range drifts {
+		log.Printf("warning:   %s", drift)
+	}
+	log.Printf("%s", banner)
+	err = sync()
+	if err != nil {
+		return fmt.Errorf("cannot synchronize indexes: %s", err)
+	}
+	log.Printf("indexes synchronization requested")
+	return nil
+}
+
+// requestWorkerSync asks the worker at workerURL to synchronize its indexes.
+func requestWorkerSync(workerURL, adminURL string) error {
+	rsp, err := http.Post(strings.TrimRight(workerURL, "/")+adminURL+"/sync",
+		"text/plain", nil)
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("worker sync failed: %s", rsp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConsistency(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	queue, err := OpenIndexQueue(env.Config.Queue())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Close()
+
+	replica := &Replica{
+		Store:   env.Store,
+		Index:   NewIndexHolder(env.Index),
+		Spatial: env.Spatial,
+	}
+	synced := 0
+	sync := func() error {
+		synced++
+		return nil
+	}
+	err = checkConsistency(replica, queue, 1, time.Hour, sync)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if synced != 0 {
+		t.Fatalf("consistent indexes were synchronized")
+	}
+
+	err = env.Index.Delete("apec:1001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Spatial.Remove("apec:1002")
+	err = queue.QueueMany([]Queued{{Id: "apec:1001", Op: AddOp}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := probeConsistency(env.Store, env.Index, env.Spatial, queue,
+		time.Now().Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	drifts := strings.Join(report.Drifts(1, time.Hour), "\n")
+	if !strings.Contains(drifts, "6 offers stored but 5 indexed\n") ||
+		!strings.Contains(drifts, " geocoded but ") ||
+		!strings.HasPrefix(strings.SplitN(drifts, "\n", 3)[2],
+			"1 queued operations, lagging for 2h") {
+		t.Fatalf("unexpected drifts:\n%s", drifts)
+	}
+	// Tolerated drift
+	if d := report.Drifts(50, 0); len(d) != 0 {
+		t.Fatalf("unexpected drifts: %v", d)
+	}
+
+	err = checkConsistency(replica, queue, 1, time.Hour, sync)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if synced != 1 {
+		t.Fatalf("drifting indexes were not synchronized")
+	}
+}
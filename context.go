@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// An offer context bundles what one needs to write a cover letter: offer
+// summary, extracted skills and full text, as markdown or JSON.
+
+type OfferContext struct {
+	Id        string        `json:"id"`
+	Title     string        `json:"title"`
+	Company   string        `json:"company"`
+	Location  string        `json:"location"`
+	Salary    string        `json:"salary"`
+	MinSalary int           `json:"min_salary"`
+	MaxSalary int           `json:"max_salary"`
+	Date      string        `json:"date"`
+	URL       string        `json:"url"`
+	Skills    []string      `json:"skills"`
+	Text      string        `json:"text"`
+	Sections  []HTMLSection `json:"sections,omitempty"`
+}
+
+type skill struct {
+	Name string
+	Re   *regexp.Regexp
+}
+
+func makeSkill(name string, patterns ...string) skill {
+	quoted := []string{}
+	for _, p := range patterns {
+		quoted = append(quoted, regexp.QuoteMeta(p))
+	}
+	// Skills like "c++" or ".net" start or end with punctuation, word
+	// boundaries cannot be used.
+	return skill{
+		Name: name,
+		Re: regexp.MustCompile(`(?:^|[^a-z0-9+#.])(?:` + strings.Join(quoted, "|") +
+			`)(?:$|[^a-z0-9+#])`),
+	}
+}
+
+var (
+	knownSkills = []skill{
+		makeSkill("Go", "golang"),
+		makeSkill("Python", "python"),
+		makeSkill("Java", "java", "j2ee", "jee"),
+		makeSkill("JavaScript", "javascript", "js"),
+		makeSkill("TypeScript", "typescript"),
+		makeSkill("C", "langage c", "c/c++"),
+		makeSkill("C++", "c++"),
+		makeSkill("C#", "c#"),
+		makeSkill(".NET", ".net", "dotnet"),
+		makeSkill("PHP", "php"),
+		makeSkill("Ruby", "ruby"),
+		makeSkill("Scala", "scala"),
+		makeSkill("Rust", "rust"),
+		makeSkill("Kotlin", "kotlin"),
+		makeSkill("Swift", "swift"),
+		makeSkill("SQL", "sql"),
+		makeSkill("PostgreSQL", "postgresql", "postgres"),
+		makeSkill("MySQL", "mysql"),
+		makeSkill("Oracle", "oracle"),
+		makeSkill("MongoDB", "mongodb"),
+		makeSkill("Elasticsearch", "elasticsearch"),
+		makeSkill("Kafka", "kafka"),
+		makeSkill("Spark", "spark"),
+		makeSkill("Hadoop", "hadoop"),
+		makeSkill("Docker", "docker"),
+		makeSkill("Kubernetes", "kubernetes", "k8s"),
+		makeSkill("AWS", "aws", "amazon web services"),
+		makeSkill("Azure", "azure"),
+		makeSkill("GCP", "gcp", "google cloud"),
+		makeSkill("Linux", "linux", "unix"),
+		makeSkill("Git", "git"),
+		makeSkill("Jenkins", "jenkins"),
+		makeSkill("Terraform", "terraform"),
+		makeSkill("Ansible", "ansible"),
+		makeSkill("React", "react", "reactjs", "react.js"),
+		makeSkill("Angular", "angular", "angularjs"),
+		makeSkill("Vue.js", "vue", "vuejs", "vue.js"),
+		makeSkill("Node.js", "node", "nodejs", "node.js"),
+		makeSkill("Django", "django"),
+		makeSkill("Spring", "spring"),
+		makeSkill("SAP", "sap"),
+		makeSkill("Salesforce", "salesforce"),
+		makeSkill("Excel", "excel"),
+		makeSkill("Agile", "agile", "scrum", "kanban"),
+		makeSkill("DevOps", "devops"),
+		makeSkill("Machine learning", "machine learning", "deep learning"),
+		makeSkill("Big data", "big data"),
+		makeSkill("English", "anglais", "english"),
+	}
+)
+
+// extractSkills returns known skills mentioned in text, in knownSkills order.
+func extractSkills(text string) []string {
+	text = removeDiacritics(nfdString(strings.ToLower(text)))
+	skills := []string{}
+	for _, s := range knownSkills {
+		if s.Re.MatchString(text) {
+			skills = append(skills, s.Name)
+		}
+	}
+	return skills
+}
+
+var (
+	reHTMLBlock = regexp.MustCompile(`(?is)<(?:br|p|/p|div|/div|li|/li|ul|/ul|h[1-6]|/h[1-6])(?:\s[^>]*)?/?>`)
+)
+
+// htmlParagraphs converts an HTML fragment into text, keeping paragraphs and
+// list items on their own lines.
+func htmlParagraphs(s string) string {
+	s = reHTMLIgnore.ReplaceAllString(s, " ")
+	// Source line breaks are not significant
+	s = reHTMLSpaces.ReplaceAllString(s, " ")
+	s = reHTMLBlock.ReplaceAllString(s, "\n")
+	s = reHTMLTag.ReplaceAllString(s, " ")
+	s = strings.Replace(html.UnescapeString(s), "\u00a0", " ", -1)
+	lines := []string{}
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(reHTMLSpaces.ReplaceAllString(line, " "))
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n\n")
+}
+
+// makeOfferContext returns the context of a live offer, or nil if it does not
+// exist. Sections of the stored HTML page, if any, are included.
+func makeOfferContext(store *Store, id string) (*OfferContext, error) {
+	js, err := getStoreJsonOffer(store, id)
+	if err != nil || js == nil {
+		return nil, err
+	}
+	offer, err := convertOffer(js)
+	if err != nil {
+		return nil, err
+	}
+	ctx := &OfferContext{
+		Id:        offer.Id,
+		Title:     offer.Title,
+		Company:   offer.Account,
+		Location:  offer.Location,
+		Salary:    js.Salary,
+		MinSalary: offer.MinSalary,
+		MaxSalary: offer.MaxSalary,
+		Date:      offer.Date.Format("2006-01-02"),
+		URL:       offer.URL,
+		Text:      htmlParagraphs(offer.HTML),
+	}
+	page, err := store.GetHTML(id)
+	if err != nil {
+		return nil, err
+	}
+	if page != nil {
+		ctx.Sections = parseOfferHTML(page).Sections
+	}
+	all := []string{ctx.Title, ctx.Text}
+	for _, s := range ctx.Sections {
+		all = append(all, s.Text)
+	}
+	ctx.Skills = extractSkills(strings.Join(all, "\n"))
+	return ctx, nil
+}
+
+func writeContextMarkdown(w io.Writer, ctx *OfferContext) error {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "# %s\n\n", ctx.Title)
+	fields := []struct {
+		Name  string
+		Value string
+	}{
+		{"Company", ctx.Company},
+		{"Location", ctx.Location},
+		{"Salary", ctx.Salary},
+		{"Published", ctx.Date},
+		{"Reference", ctx.Id},
+		{"URL", ctx.URL},
+		{"Skills", strings.Join(ctx.Skills, ", ")},
+	}
+	for _, f := range fields {
+		if f.Value != "" {
+			fmt.Fprintf(buf, "- %s: %s\n", f.Name, f.Value)
+		}
+	}
+	fmt.Fprintf(buf, "\n## Description\n\n%s\n", ctx.Text)
+	for _, s := range ctx.Sections {
+		fmt.Fprintf(buf, "\n## %s\n\n%s\n", s.Title, s.Text)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func writeOfferContext(w io.Writer, ctx *OfferContext, format string) error {
+	if format == "json" {
+		data, err := json.MarshalIndent(ctx, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(append(data, '\n'))
+		return err
+	}
+	return writeContextMarkdown(w, ctx)
+}
+
+var (
+	exportCmd        = app.Command("export", "export offers data")
+	exportContextCmd = exportCmd.Command("context", `export an offer cover letter context
+
+Print offer title, company, location, salary, extracted skills and full text,
+as markdown or JSON, to feed letter templates or text generation prompts.
+`)
+	exportContextId     = exportContextCmd.Arg("id", "offer identifier").Required().String()
+	exportContextFormat = exportContextCmd.Flag("format", "output format").
+				Default("markdown").Enum("markdown", "json")
+	exportContextOutput = exportContextCmd.Flag("output", "output file, stdout by default").
+				Short('o').String()
+)
+
+func exportContextFn(cfg *Config) error {
+	store, err := OpenStore(cfg.Store())
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	ctx, err := makeOfferContext(store, normalizeOfferId(*exportContextId))
+	if err != nil {
+		return err
+	}
+	if ctx == nil {
+		return fmt.Errorf("unknown offer: %s", *exportContextId)
+	}
+	if *exportContextOutput == "" {
+		return writeOfferContext(os.Stdout, ctx, *exportContextFormat)
+	}
+	fp, err := os.Create(*exportContextOutput)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	err = writeOfferContext(fp, ctx, *exportContextFormat)
+	if err != nil {
+		return err
+	}
+	return fp.Close()
+}
+
+func handleOfferContext(store *Store, w http.ResponseWriter, r *http.Request) error {
+	id := normalizeOfferId(r.FormValue("id"))
+	format := r.FormValue("format")
+	ctx, err := makeOfferContext(store, id)
+	if err != nil {
+		return err
+	}
+	if ctx == nil {
+		http.NotFound(w, r)
+		return nil
+	}
+	// Colons are not allowed in Windows file names
+	name := "offer-" + strings.Replace(ctx.Id, ":", "-", -1)
+	filename := name + ".md"
+	contentType := "text/markdown; charset=utf-8"
+	if format == "json" {
+		filename = name + ".json"
+		contentType = "application/json"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	return writeOfferContext(w, ctx, format)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExtractSkills(t *testing.T) {
+	tests := []struct {
+		Input  string
+		Skills []string
+	}{
+		{"Développeur Golang / PYTHON", []string{"Go", "Python"}},
+		{"JavaScript, Node.js et React", []string{"JavaScript", "React", "Node.js"}},
+		{"Java/J2EE, C++ et C#, .NET", []string{"Java", "C++", "C#", ".NET"}},
+		{"Excellent relationnel, digital, sapeur", []string{}},
+		{"Anglais courant, méthodes agiles et Scrum", []string{"Agile", "English"}},
+	}
+	for _, test := range tests {
+		skills := extractSkills(test.Input)
+		if !reflect.DeepEqual(skills, test.Skills) {
+			t.Fatalf("%q: expected %v, got %v", test.Input, test.Skills, skills)
+		}
+	}
+}
+
+func TestHTMLParagraphs(t *testing.T) {
+	text := htmlParagraphs("<p>Missions :</p><ul><li>coder&nbsp;en Go</li>" +
+		"<li>relire  le\ncode</li></ul>Profil<br/>curieux")
+	expected := "Missions :\n\ncoder en Go\n\nrelire le code\n\nProfil\n\ncurieux"
+	if text != expected {
+		t.Fatalf("unexpected text: %q", text)
+	}
+}
+
+func TestHandleOfferContext(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	get := func(values url.Values) (int, string) {
+		w := env.Get(func(w http.ResponseWriter, r *http.Request) {
+			err := handleOfferContext(env.Store, w, r)
+			if err != nil {
+				t.Fatalf("context export failed: %s", err)
+			}
+		}, "/context", values)
+		return w.Code, w.Body.String()
+	}
+
+	code, body := get(url.Values{"id": {"1001"}})
+	if code != 200 {
+		t.Fatalf("markdown export failed with %d: %s", code, body)
+	}
+	for _, s := range []string{
+		"# Développeur Go H/F\n",
+		"- Company: ACME\n",
+		"- Salary: 45 - 55 k€ brut annuel\n",
+		"- Skills: Go, Python\n",
+		"## Description\n\nVous développerez des services en golang et python.\n",
+	} {
+		if !strings.Contains(body, s) {
+			t.Fatalf("%q not found in:\n%s", s, body)
+		}
+	}
+
+	code, body = get(url.Values{"id": {"1001"}, "format": {"json"}})
+	if code != 200 {
+		t.Fatalf("JSON export failed with %d: %s", code, body)
+	}
+	ctx := &OfferContext{}
+	err := json.Unmarshal([]byte(body), ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ctx.Company != "ACME" || ctx.MinSalary != 45 || ctx.MaxSalary != 55 ||
+		!reflect.DeepEqual(ctx.Skills, []string{"Go", "Python"}) {
+		t.Fatalf("unexpected context: %+v", ctx)
+	}
+
+	code, _ = get(url.Values{"id": {"9999"}})
+	if code != 404 {
+		t.Fatalf("unknown offer export returned %d", code)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"sort"
+
+	"github.com/llgcode/draw2d"
+	"github.com/llgcode/draw2d/draw2dimg"
+)
+
+// Contour lines are traced with marching squares over the convolved density
+// grid. Every square of 4 neighbouring cells is classified by which corners
+// are above the level, and crossed by 0, 1 or 2 segments joining its edges
+// at interpolated positions.
+
+const maxContours = 20
+
+type contourSegment struct {
+	X0, Y0 float64
+	X1, Y1 float64
+}
+
+// contourLevels returns at most levels increasing levels splitting positive
+// grid values in groups of equal size, like drawGrid colors do.
+func contourLevels(grid *Grid, levels int) []float64 {
+	values := []int{}
+	for _, v := range grid.Values {
+		if v > 0 {
+			values = append(values, v)
+		}
+	}
+	if len(values) == 0 || levels <= 0 {
+		return nil
+	}
+	sort.Ints(values)
+	result := []float64{}
+	for k := 1; k <= levels; k++ {
+		v := float64(values[k*len(values)/(levels+1)])
+		if len(result) > 0 && result[len(result)-1] >= v {
+			continue
+		}
+		result = append(result, v)
+	}
+	return result
+}
+
+// Edges crossed by contour segments, indexed by square case. Corners are
+// numbered counterclockwise from (i, j), edge k joins corners k and k+1.
+// Saddle cases 5 and 10 are resolved separately.
+var contourEdges = [16][]int{
+	{},
+	{3, 0},
+	{0, 1},
+	{3, 1},
+	{1, 2},
+	nil,
+	{0, 2},
+	{3, 2},
+	{2, 3},
+	{0, 2},
+	nil,
+	{1, 2},
+	{1, 3},
+	{0, 1},
+	{3, 0},
+	{},
+}
+
+// traceContour returns the segments of level contour line, in grid
+// coordinates.
+func traceContour(grid *Grid, level float64) []contourSegment {
+	segments := []contourSegment{}
+	for j := 0; j+1 < grid.Height; j++ {
+		for i := 0; i+1 < grid.Width; i++ {
+			x := [4]float64{float64(i), float64(i + 1), float64(i + 1), float64(i)}
+			y := [4]float64{float64(j), float64(j), float64(j + 1), float64(j + 1)}
+			v := [4]float64{
+				float64(grid.Get(i, j)),
+				float64(grid.Get(i+1, j)),
+				float64(grid.Get(i+1, j+1)),
+				float64(grid.Get(i, j+1)),
+			}
+			index := 0
+			for k := 0; k < 4; k++ {
+				if v[k] >= level {
+					index |= 1 << uint(k)
+				}
+			}
+			edges := contourEdges[index]
+			if edges == nil {
+				// Saddle, separate high corners unless the center is high
+				center := (v[0]+v[1]+v[2]+v[3])/4 >= level
+				if (index == 5) == center {
+					edges = []int{0, 1, 2, 3}
+				} else {
+					edges = []int{3, 0, 1, 2}
+				}
+			}
+			for n := 0; n+1 < len(edges); n += 2 {
+				seg := contourSegment{}
+				seg.X0, seg.Y0 = interpolateEdge(x, y, v, edges[n], level)
+				seg.X1, seg.Y1 = interpolateEdge(x, y, v, edges[n+1], level)
+				segments = append(segments, seg)
+			}
+		}
+	}
+	return segments
+}
+
+// interpolateEdge returns where level crosses edge k of a square.
+func interpolateEdge(x, y, v [4]float64, k int, level float64) (float64, float64) {
+	a, b := k, (k+1)%4
+	t := 0.5
+	if v[a] != v[b] {
+		t = (level - v[a]) / (v[b] - v[a])
+	}
+	return x[a] + t*(x[b]-x[a]), y[a] + t*(y[b]-y[a])
+}
+
+// drawContours strokes levels contour lines of grid on img. They are black
+// over the heatmap, or colored by level otherwise.
+func drawContours(img *image.RGBA, grid *Grid, levels int, filled bool) {
+	values := contourLevels(grid, levels)
+	gc := draw2dimg.NewGraphicContext(img)
+	gc.SetLineWidth(1)
+	for k, level := range values {
+		col := color.RGBA{0, 0, 0, 255}
+		if !filled {
+			col = getColor(float64(k+1) / float64(len(values)))
+		}
+		gc.SetStrokeColor(col)
+		path := draw2d.Path{}
+		for _, s := range traceContour(grid, level) {
+			// Cells are drawn upside down, centered on pixels
+			path.MoveTo(s.X0+0.5, float64(grid.Height)-s.Y0-0.5)
+			path.LineTo(s.X1+0.5, float64(grid.Height)-s.Y1-0.5)
+		}
+		gc.Stroke(&path)
+	}
+}
+
+// drawDensity renders grid heatmap, or a blank image if opts disables it,
+// then its contour lines.
+func drawDensity(grid *Grid, opts *DensityOptions) *image.RGBA {
+	var img *image.RGBA
+	if opts.Fill {
+		img = drawGrid(grid)
+	} else {
+		img = image.NewRGBA(image.Rect(0, 0, grid.Width, grid.Height))
+		draw.Draw(img, img.Bounds(), &image.Uniform{getColor(0)}, image.Point{},
+			draw.Src)
+	}
+	if opts.Contours > 0 {
+		drawContours(img, grid, opts.Contours, opts.Fill)
+	}
+	return img
+}
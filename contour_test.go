@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestTraceContour(t *testing.T) {
+	grid := NewGrid(3, 3)
+	grid.Set(1, 1, 10)
+	segments := traceContour(grid, 5)
+	if len(segments) != 4 {
+		t.Fatalf("expected a diamond around the peak, got %+v", segments)
+	}
+	for _, s := range segments {
+		for _, p := range [][2]float64{{s.X0, s.Y0}, {s.X1, s.Y1}} {
+			dx, dy := p[0]-1, p[1]-1
+			if dx*dx+dy*dy != 0.25 {
+				t.Fatalf("segment point is not halfway to the peak: %+v", s)
+			}
+		}
+	}
+	if len(traceContour(grid, 20)) != 0 {
+		t.Fatalf("contour above the peak should be empty")
+	}
+
+	// Saddles with a low center separate the high corners
+	grid = NewGrid(2, 2)
+	grid.Set(0, 0, 10)
+	grid.Set(1, 1, 10)
+	segments = traceContour(grid, 6)
+	if len(segments) != 2 || segments[0].X0 != 0 || segments[1].X0 != 1 {
+		t.Fatalf("unexpected saddle segments: %+v", segments)
+	}
+}
+
+func TestContourLevels(t *testing.T) {
+	grid := NewGrid(4, 2)
+	copy(grid.Values, []int{0, 1, 2, 3, 4, 5, 6, 0})
+	levels := contourLevels(grid, 2)
+	if len(levels) != 2 || levels[0] != 3 || levels[1] != 5 {
+		t.Fatalf("unexpected levels: %v", levels)
+	}
+	levels = contourLevels(grid, 20)
+	for i := 1; i < len(levels); i++ {
+		if levels[i] <= levels[i-1] {
+			t.Fatalf("levels are not increasing: %v", levels)
+		}
+	}
+	if contourLevels(NewGrid(2, 2), 3) != nil {
+		t.Fatalf("empty grids have no levels")
+	}
+}
+
+func TestDrawDensityContours(t *testing.T) {
+	grid := NewGrid(20, 20)
+	for j := 5; j < 15; j++ {
+		for i := 5; i < 15; i++ {
+			grid.Set(i, j, 10-abs(i-10)-abs(j-10))
+		}
+	}
+	for _, fill := range []bool{true, false} {
+		// Contours are drawn over the heatmap or a blank image
+		expected := drawDensity(grid, &DensityOptions{Fill: true})
+		if !fill {
+			expected = drawDensity(NewGrid(20, 20), &DensityOptions{Contours: 1})
+		}
+		img := drawDensity(grid, &DensityOptions{
+			Weight:   weightCount,
+			Contours: 3,
+			Fill:     fill,
+		})
+		drawn := 0
+		for y := 0; y < 20; y++ {
+			for x := 0; x < 20; x++ {
+				if img.RGBAAt(x, y) != expected.RGBAAt(x, y) {
+					drawn++
+				}
+			}
+		}
+		if drawn == 0 {
+			t.Fatalf("no contour drawn with fill=%v", fill)
+		}
+	}
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func TestParseDensityOptions(t *testing.T) {
+	tests := []struct {
+		Query string
+		Key   string
+		Error bool
+	}{
+		{"", "", false},
+		{"weight=salary&contours=5", "-salary-c5", false},
+		{"contours=3&fill=0", "-c3-nofill", false},
+		{"fill=0", "", true},
+		{"contours=21", "", true},
+		{"contours=-1", "", true},
+		{"contours=x", "", true},
+		{"weight=distance", "", true},
+	}
+	for _, test := range tests {
+		values, err := url.ParseQuery(test.Query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts, err := parseDensityOptions(values)
+		if test.Error {
+			if err == nil {
+				t.Fatalf("%q: expected an error", test.Query)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %s", test.Query, err)
+		}
+		if key := opts.CacheKey(); key != test.Key {
+			t.Fatalf("%q: expected cache key %q, got %q", test.Query, test.Key, key)
+		}
+	}
+}
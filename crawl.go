@@ -7,7 +7,10 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pmezard/apec/jstruct"
@@ -18,12 +21,71 @@ type HTTPError struct {
 	URL    string
 	Code   int
 	Status string
+	// Delay requested by the Retry-After header, zero if missing
+	RetryAfter time.Duration
 }
 
 func (e *HTTPError) Error() string {
 	return fmt.Sprintf("got %s fetching %s", e.Status, e.URL)
 }
 
+// OversizedError is returned when a response is larger than the allowed
+// size. Data holds its first bytes.
+type OversizedError struct {
+	URL   string
+	Limit int64
+	Data  []byte
+}
+
+func (e *OversizedError) Error() string {
+	return fmt.Sprintf("%s is larger than %d bytes", e.URL, e.Limit)
+}
+
+// downloadedBytes counts response bytes read by crawling requests.
+var downloadedBytes int64
+
+type countingReader struct {
+	io.ReadCloser
+	count *int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	atomic.AddInt64(r.count, int64(n))
+	return n, err
+}
+
+// readLimited reads r content fetched from url, or fails with an
+// OversizedError if it is larger than limit bytes. Zero means no limit.
+func readLimited(url string, r io.Reader, limit int64) ([]byte, error) {
+	if limit <= 0 {
+		return ioutil.ReadAll(r)
+	}
+	data, err := ioutil.ReadAll(&io.LimitedReader{
+		R: r,
+		N: limit + 1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, &OversizedError{
+			URL:   url,
+			Limit: limit,
+			Data:  data[:limit],
+		}
+	}
+	return data, nil
+}
+
+// httpClient performs all crawling requests. Its transport can be replaced to
+// record or replay exchanges.
+var httpClient = &http.Client{}
+
+// crawlSleep pauses between crawling requests, it is disabled when replaying
+// recorded exchanges.
+var crawlSleep = time.Sleep
+
 // doHTTP performs a single GET (or POST if input is not nil) and returns
 // response data if any. It is the caller responsibility to close returned
 // reader.
@@ -36,33 +98,67 @@ func doHTTP(url string, input io.Reader) (io.ReadCloser, error) {
 	if err != nil {
 		return nil, err
 	}
-	rq.Header.Set("User-Agent", "Mozilla/4.0 (compatible; MSIE 7.0; Windows NT 6.0)")
+	rq.Header.Set("User-Agent", userAgent())
 	if input != nil {
 		rq.Header.Set("Content-Type", "application/json")
 	}
-	rsp, err := http.DefaultClient.Do(rq)
+	rsp, err := httpClient.Do(rq)
 	if err != nil {
 		return nil, err
 	}
 	if rsp.StatusCode != http.StatusOK {
 		rsp.Body.Close()
 		err := &HTTPError{
-			URL:    url,
-			Code:   rsp.StatusCode,
-			Status: rsp.Status,
+			URL:        url,
+			Code:       rsp.StatusCode,
+			Status:     rsp.Status,
+			RetryAfter: parseRetryAfter(rsp.Header.Get("Retry-After"), time.Now()),
 		}
 		return nil, err
 	}
-	return rsp.Body, nil
+	return &countingReader{
+		ReadCloser: rsp.Body,
+		count:      &downloadedBytes,
+	}, nil
+}
+
+// retryPolicy adapts retryHTTP to a remote service.
+type retryPolicy struct {
+	// Records blocking responses and fails requests with a BlockedError once
+	// open, optional
+	Breaker *CircuitBreaker
+	// Returns a non-nil error for failed responses which must not be
+	// retried, optional. 404 responses are never retried.
+	Permanent func(h *HTTPError) error
+	// Removes secrets from logged errors, optional
+	Redact func(s string) string
 }
 
 // tryHTTP performs a GET or POST with exponential backoff, with specified
-// delay and maximum retry count.
+// delay and maximum retry count. Rate limited requests wait at least
+// rateLimitDelay or what Retry-After asks. Blocking responses are reported
+// to crawlBreaker, which fails requests with a BlockedError once open.
 func tryHTTP(url string, baseDelay time.Duration, loops int,
 	input io.ReadSeeker) (io.ReadCloser, error) {
 
+	return retryHTTP(url, baseDelay, loops, input, &retryPolicy{
+		Breaker: crawlBreaker,
+	})
+}
+
+// retryHTTP is tryHTTP with a retry policy.
+func retryHTTP(url string, baseDelay time.Duration, loops int,
+	input io.ReadSeeker, policy *retryPolicy) (io.ReadCloser, error) {
+
+	breaker := policy.Breaker
 	delay := baseDelay
 	for {
+		if breaker != nil {
+			err := breaker.Allow()
+			if err != nil {
+				return nil, err
+			}
+		}
 		if input != nil {
 			_, err := input.Seek(0, 0)
 			if err != nil {
@@ -71,17 +167,50 @@ func tryHTTP(url string, baseDelay time.Duration, loops int,
 		}
 		output, err := doHTTP(url, input)
 		if err == nil {
+			if breaker != nil {
+				breaker.Success()
+			}
 			return output, nil
 		}
-		if h, ok := err.(*HTTPError); ok && h.Code == http.StatusNotFound {
-			return nil, err
+		wait := delay
+		if h, ok := err.(*HTTPError); ok {
+			permanent := error(nil)
+			if h.Code == http.StatusNotFound {
+				permanent = err
+			} else if policy.Permanent != nil {
+				permanent = policy.Permanent(h)
+			}
+			if permanent != nil {
+				if breaker != nil {
+					breaker.Success()
+				}
+				return nil, permanent
+			}
+			if isBlockingStatus(h.Code) {
+				if breaker != nil {
+					blocked := breaker.Blocked(h.Status, h.RetryAfter)
+					if blocked != nil {
+						return nil, blocked
+					}
+				}
+				if h.Code == http.StatusTooManyRequests && wait < rateLimitDelay {
+					wait = rateLimitDelay
+				}
+				if h.RetryAfter > wait {
+					wait = h.RetryAfter
+				}
+			}
+		}
+		msg := err.Error()
+		if policy.Redact != nil {
+			msg = policy.Redact(msg)
 		}
-		fmt.Printf("fetching failed with: %s\n", err)
+		fmt.Printf("fetching failed with: %s\n", msg)
 		loops -= 1
 		if loops <= 0 {
 			return nil, err
 		}
-		time.Sleep(delay)
+		crawlSleep(wait)
 		delay *= 2
 	}
 }
@@ -136,9 +265,9 @@ type SearchFilters struct {
 }
 
 // searchOffers returns the list of offer identifiers matching supplied conditions:
-//  - start and count are used to page results
-//  - minSalary: the minimum salary for returned offers
-//  - locations: APEC internal location identifiers, can be empty
+//   - start and count are used to page results
+//   - minSalary: the minimum salary for returned offers
+//   - locations: APEC internal location identifiers, can be empty
 func searchOffers(start, count, minSalary int, locations []int) ([]string, error) {
 	if locations == nil {
 		locations = []int{}
@@ -181,16 +310,18 @@ func searchOffers(start, count, minSalary int, locations []int) ([]string, error
 		if len(parts) != 2 {
 			return nil, fmt.Errorf("invalid offer identifier: %s", uri.URI)
 		}
-		ids = append(ids, parts[1])
+		ids = append(ids, makeOfferId(apecSource, parts[1]))
 	}
 	return ids, nil
 }
 
 // getOffer returns the byte content of an offer document (theorically in JSON
 // format). It may return nil without an error if the offer does not exist,
-// which could happen with concurrent site updates.
-func getOffer(id string) ([]byte, error) {
-	u := "https://cadres.apec.fr/cms/webservices/offre/public?numeroOffre=" + id
+// which could happen with concurrent site updates. Documents larger than
+// maxSize bytes fail with an OversizedError, zero means no limit.
+func getOffer(id string, maxSize int64) ([]byte, error) {
+	_, apecId := splitOfferId(id)
+	u := "https://cadres.apec.fr/cms/webservices/offre/public?numeroOffre=" + apecId
 	output, err := tryHTTP(u, time.Second, 5, nil)
 	if err != nil {
 		if h, ok := err.(*HTTPError); ok && h.Code == http.StatusNotFound {
@@ -199,25 +330,129 @@ func getOffer(id string) ([]byte, error) {
 		return nil, err
 	}
 	defer output.Close()
-	return ioutil.ReadAll(output)
+	return readLimited(u, output, maxSize)
+}
+
+// CrawlLimits bound the amount of data crawled, zero values mean no limit.
+type CrawlLimits struct {
+	// Maximum number of offers fetched
+	MaxOffers int
+	// Maximum number of search result pages enumerated
+	MaxPages int
+	// Maximum crawl duration
+	MaxDuration time.Duration
+	// Offers larger than this many bytes are quarantined instead of stored
+	MaxOfferSize int64
+	// Closed to interrupt the crawl, like when other limits are reached
+	Stop <-chan struct{}
+}
+
+// crawlBudget enforces CrawlLimits across crawling goroutines. Once a limit is
+// reached, every further request is refused, except for the pages limit
+// which only stops the enumeration: listed offers are still fetched.
+type crawlBudget struct {
+	lock      sync.Mutex
+	limits    CrawlLimits
+	now       func() time.Time
+	deadline  time.Time
+	pages     int
+	offers    int
+	exceeded  string
+	truncated string
+}
+
+func newCrawlBudget(limits CrawlLimits, now func() time.Time) *crawlBudget {
+	b := &crawlBudget{
+		limits: limits,
+		now:    now,
+	}
+	if limits.MaxDuration > 0 {
+		b.deadline = now().Add(limits.MaxDuration)
+	}
+	return b
+}
+
+// spend returns true if another request is allowed, after checking its
+// count against max and the deadline. Reaching max sets reason. The lock
+// must be held.
+func (b *crawlBudget) spend(count *int, max int, name string,
+	reason *string) bool {
+
+	if b.exceeded != "" || *reason != "" {
+		return false
+	}
+	select {
+	case <-b.limits.Stop:
+		b.exceeded = "crawl was interrupted"
+		return false
+	default:
+	}
+	if !b.deadline.IsZero() && !b.now().Before(b.deadline) {
+		b.exceeded = fmt.Sprintf("duration limit of %s reached",
+			b.limits.MaxDuration)
+		return false
+	}
+	if max > 0 && *count >= max {
+		*reason = fmt.Sprintf("%s limit of %d reached", name, max)
+		return false
+	}
+	*count++
+	return true
+}
+
+// Page returns true if another search page can be fetched.
+func (b *crawlBudget) Page() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.spend(&b.pages, b.limits.MaxPages, "pages", &b.truncated)
+}
+
+// Offer returns true if another offer can be fetched.
+func (b *crawlBudget) Offer() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.spend(&b.offers, b.limits.MaxOffers, "offers", &b.exceeded)
+}
+
+// Exceeded returns the reason why fetching offers was stopped, or an empty
+// string.
+func (b *crawlBudget) Exceeded() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.exceeded
+}
+
+// Truncated returns the reason why the enumeration may be incomplete, or an
+// empty string.
+func (b *crawlBudget) Truncated() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.exceeded != "" {
+		return b.exceeded
+	}
+	return b.truncated
 }
 
 // enumerateOffers search offers satisfying the minSalary and locations
 // constraints and repeatedly calls callback with slices of offers identifiers.
 // The enumeration is not atomic, there is no guarantee a value is returned
-// only once.
-func enumerateOffers(minSalary int, locations []int, callback func([]string) error) error {
+// only once. It stops early when budget refuses more pages.
+func enumerateOffers(minSalary int, locations []int, budget *crawlBudget,
+	progress *Progress, callback func([]string) error) error {
 	start := 0
 	overlap := 5
 	count := 100
 	delay := 5 * time.Second
-	for ; ; time.Sleep(delay) {
-		fmt.Printf("fetching from %d to %d\n", start, start+count)
+	for ; ; crawlSleep(delay) {
+		if !budget.Page() {
+			break
+		}
+		progress.Verbosef("fetching from %d to %d\n", start, start+count)
 		ids, err := searchOffers(start, count, minSalary, locations)
 		if err != nil {
 			return err
 		}
-		fmt.Printf("pushing %d ids\n", len(ids))
+		progress.Verbosef("pushing %d ids\n", len(ids))
 		start += (count - overlap)
 		err = callback(ids)
 		if err != nil {
@@ -230,66 +465,204 @@ func enumerateOffers(minSalary int, locations []int, callback func([]string) err
 	return nil
 }
 
-func putOfferDate(store *Store, data []byte, deletedId uint64) error {
+// makeOfferAge returns the content hash of offer data and its dates entry.
+func makeOfferAge(data []byte, deletedId uint64) (string, OfferAge, error) {
 	js := &jstruct.JsonOffer{}
 	err := ffjson.Unmarshal(data, js)
 	if err != nil {
-		return err
+		return "", OfferAge{}, err
 	}
 	dateLayout := "2006-01-02T15:04:05.000+0000"
 	date, err := time.Parse(dateLayout, js.Date)
 	if err != nil {
-		return fmt.Errorf("cannot parse offer date: %s", err)
+		return "", OfferAge{}, fmt.Errorf("cannot parse offer date: %s", err)
 	}
 	age := OfferAge{
-		Id:              js.Id,
+		Id:              makeOfferId(apecSource, js.Id),
 		DeletedId:       deletedId,
 		PublicationDate: date,
 	}
 	if deletedId != 0 {
 		age.DeletionDate = time.Now()
 	}
-	return store.PutOfferDate(hashOffer(js), age)
+	return hashOffer(js), age, nil
+}
+
+func putOfferDate(store *Store, data []byte, deletedId uint64) error {
+	hash, age, err := makeOfferAge(data, deletedId)
+	if err != nil {
+		return err
+	}
+	return store.PutOfferDate(hash, age)
+}
+
+const (
+	// Fetched offers are committed by batches to amortize fsyncs
+	crawlBatchSize = 100
+	// Offers are a few kB, larger ones are likely error pages or garbage
+	defaultMaxOfferKB = 1024
+)
+
+// crawledOffer is a fetched offer waiting to be committed.
+type crawledOffer struct {
+	Id      string
+	Data    []byte
+	Unknown []string
+	Hash    string
+	Age     *OfferAge
+}
+
+// storeCrawledOffers stores offers with their schema fields and dates in a
+// single transaction.
+func storeCrawledOffers(store *Store, offers []crawledOffer, now time.Time) error {
+	data := map[string][]byte{}
+	for _, o := range offers {
+		data[o.Id] = o.Data
+	}
+	return store.Update(func(stx *StoreTx) error {
+		err := stx.PutMany(data)
+		if err != nil {
+			return err
+		}
+		for _, o := range offers {
+			err = stx.PutSchemaFields(o.Id, o.Unknown, now)
+			if err != nil {
+				return err
+			}
+			if o.Age == nil {
+				continue
+			}
+			err = stx.PutOfferDate(o.Hash, *o.Age)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 // crawlOffers fetches specified offers and store their binary representation
 // in the store. It returns the number of offers actually stored. Already
-// fetched offers, or missing remote offers are ignored.
-func crawlOffers(store *Store, ids []string) (int, int, error) {
+// fetched offers, or missing remote offers are ignored. If fetchHTML is set,
+// offers HTML pages are fetched as well, including for already stored offers.
+// Fetched offers are committed by batches of crawlBatchSize. Processed
+// offers are reported to progress. Quarantined offers are skipped. It stops
+// early when budget refuses more offers.
+func crawlOffers(store *Store, ids []string, fetchHTML bool,
+	budget *crawlBudget, progress *Progress) (int, int, error) {
 	added := 0
 	ageErrors := 0
-	for _, id := range ids {
-		ok, err := store.Has(id)
-		if err != nil {
-			return added, 0, err
-		}
-		if ok {
-			continue
-		}
-		fmt.Printf("fetching %s\n", id)
-		data, err := getOffer(id)
-		if err != nil {
-			return added, 0, err
-		}
-		time.Sleep(time.Second)
-		if data == nil {
-			fmt.Printf("could not find %s\n", id)
-			continue
+	pending := []crawledOffer{}
+	flush := func() error {
+		if len(pending) == 0 {
+			return nil
 		}
-		err = store.Put(id, data)
+		err := storeCrawledOffers(store, pending, time.Now())
 		if err != nil {
-			return added, 0, err
+			return err
 		}
-		added += 1
-		err = putOfferDate(store, data, 0)
-		if err != nil {
-			ageErrors += 1
+		added += len(pending)
+		pending = pending[:0]
+		return nil
+	}
+	err := func() error {
+		for _, id := range ids {
+			if budget.Exceeded() != "" {
+				return nil
+			}
+			progress.Add(1)
+			ok, err := store.Has(id)
+			if err != nil {
+				return err
+			}
+			if ok {
+				if fetchHTML {
+					err = crawlOfferHTML(store, id)
+					if err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			quarantined, err := store.IsQuarantined(id)
+			if err != nil {
+				return err
+			}
+			if quarantined {
+				progress.Verbosef("skipping quarantined %s\n", id)
+				continue
+			}
+			if !budget.Offer() {
+				return nil
+			}
+			progress.Verbosef("fetching %s\n", id)
+			data, err := getOffer(id, budget.limits.MaxOfferSize)
+			if o, ok := err.(*OversizedError); ok {
+				progress.Printf("quarantining %s: %s\n", id, err)
+				err = store.PutQuarantined(&QuarantinedOffer{
+					Id:     id,
+					Time:   time.Now(),
+					Reason: err.Error(),
+					Data:   o.Data,
+				})
+				if err != nil {
+					return err
+				}
+				crawlSleep(time.Second)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			crawlSleep(time.Second)
+			if data == nil {
+				progress.Verbosef("could not find %s\n", id)
+				continue
+			}
+			offer := crawledOffer{
+				Id:      id,
+				Data:    data,
+				Unknown: checkCrawledOffer(id, data),
+			}
+			hash, age, err := makeOfferAge(data, 0)
+			if err == nil {
+				offer.Hash = hash
+				offer.Age = &age
+			} else {
+				ageErrors += 1
+			}
+			pending = append(pending, offer)
+			if fetchHTML {
+				err = crawlOfferHTML(store, id)
+				if err != nil {
+					return err
+				}
+			}
+			if len(pending) >= crawlBatchSize {
+				err = flush()
+				if err != nil {
+					return err
+				}
+			}
 		}
+		return nil
+	}()
+	// Do not lose fetched offers when crawling fails
+	flushErr := flush()
+	if err != nil {
+		return added, 0, err
+	}
+	if flushErr != nil {
+		return added, 0, flushErr
 	}
 	return added, ageErrors, nil
 }
 
-func crawl(store *Store, minSalary int, locations []int) error {
+// crawl fetches offers matching minSalary and locations, within limits.
+// Stored offers which were not listed are deleted, unless a limit stopped
+// the crawl.
+func crawl(store *Store, minSalary int, locations []int, fetchHTML bool,
+	limits CrawlLimits) error {
 	idsChan := make(chan []string)
 	stopListing := make(chan bool)
 	listingDone := make(chan error)
@@ -299,15 +672,22 @@ func crawl(store *Store, minSalary int, locations []int) error {
 	// waiting for offers to be fetched reduces the races between our
 	// enumeration and possible web site updates.
 	seen := map[string]bool{}
+	progress := NewProgress("crawl", 0)
+	budget := newCrawlBudget(limits, time.Now)
+	startBytes := atomic.LoadInt64(&downloadedBytes)
+	downloaded := func() string {
+		return formatSize(atomic.LoadInt64(&downloadedBytes) - startBytes)
+	}
 	go func() {
 		pending := []string{}
-		err := enumerateOffers(minSalary, locations, func(ids []string) error {
+		err := enumerateOffers(minSalary, locations, budget, progress, func(ids []string) error {
 			for _, id := range ids {
 				if !seen[id] {
 					pending = append(pending, id)
 				}
 				seen[id] = true
 			}
+			progress.SetTotal(len(seen))
 			select {
 			case <-stopListing:
 				return fmt.Errorf("offer enumeration was interrupted")
@@ -318,7 +698,10 @@ func crawl(store *Store, minSalary int, locations []int) error {
 			return nil
 		})
 		if len(pending) > 0 {
-			idsChan <- pending
+			select {
+			case <-stopListing:
+			case idsChan <- pending:
+			}
 		}
 		close(idsChan)
 		listingDone <- err
@@ -329,16 +712,19 @@ func crawl(store *Store, minSalary int, locations []int) error {
 	ageErrors := 0
 	go func() {
 		for ids := range idsChan {
-			n, e, err := crawlOffers(store, ids)
+			n, e, err := crawlOffers(store, ids, fetchHTML, budget, progress)
 			added += n
 			ageErrors += e
 			if n < len(ids) {
-				fmt.Printf("%d known offers ignored\n", len(ids)-n)
+				progress.Verbosef("%d known offers ignored\n", len(ids)-n)
 			}
 			if err != nil {
 				crawlingDone <- err
 				break
 			}
+			if budget.Exceeded() != "" {
+				break
+			}
 		}
 		close(crawlingDone)
 	}()
@@ -347,12 +733,24 @@ func crawl(store *Store, minSalary int, locations []int) error {
 	crawlingErr := <-crawlingDone
 	close(stopListing)
 	listingErr := <-listingDone
-	if listingErr != nil {
-		return listingErr
-	}
+	progress.Done()
 	if crawlingErr != nil {
 		return crawlingErr
 	}
+	if reason := budget.Truncated(); reason != "" {
+		// The enumeration is incomplete, unseen offers may still exist
+		fmt.Printf("crawl stopped early: %s, unseen offers were not deleted\n",
+			reason)
+		fmt.Printf("%d added, %d total, %s downloaded\n", added, store.Size(),
+			downloaded())
+		if ageErrors > 0 {
+			return fmt.Errorf("failed to compute %d offer age", ageErrors)
+		}
+		return nil
+	}
+	if listingErr != nil {
+		return listingErr
+	}
 
 	// Delete unseen offers
 	deleted := 0
@@ -365,27 +763,30 @@ func crawl(store *Store, minSalary int, locations []int) error {
 		if seen[id] {
 			continue
 		}
-		fmt.Printf("deleting %s\n", id)
-		var offer []byte
-		d, err := store.Get(id)
-		if err == nil {
-			offer = d
-		} else {
-			ageErrors += 1
-		}
-		deletedId, err := store.Delete(id, now)
-		if err != nil {
-			return fmt.Errorf("could not delete %s: %s\n", id, err)
-		}
-		if offer != nil {
-			err = putOfferDate(store, offer, deletedId)
+		progress.Verbosef("deleting %s\n", id)
+		err := store.Update(func(stx *StoreTx) error {
+			offer := stx.Get(id)
+			deletedId, err := stx.Delete(id, now)
+			if err != nil {
+				return err
+			}
+			if offer == nil {
+				return nil
+			}
+			hash, age, err := makeOfferAge(offer, deletedId)
 			if err != nil {
 				ageErrors += 1
+				return nil
 			}
+			return stx.PutOfferDate(hash, age)
+		})
+		if err != nil {
+			return fmt.Errorf("could not delete %s: %s\n", id, err)
 		}
 		deleted += 1
 	}
-	fmt.Printf("%d added, %d deleted, %d total\n", added, deleted, store.Size())
+	fmt.Printf("%d added, %d deleted, %d total, %s downloaded\n", added, deleted,
+		store.Size(), downloaded())
 	if ageErrors > 0 {
 		return fmt.Errorf("failed to compute %d offer age", ageErrors)
 	}
@@ -396,6 +797,29 @@ var (
 	crawlCmd       = app.Command("crawl", "crawl APEC offers")
 	crawlMinSalary = crawlCmd.Flag("min-salary", "minimum salary in kEUR").Default("0").Int()
 	crawlLocations = crawlCmd.Flag("location", "offer location code").Ints()
+	crawlHTML      = crawlCmd.Flag("html", "also fetch offers HTML pages").Bool()
+	crawlWARC      = crawlCmd.Flag("warc",
+		"record HTTP exchanges in WARC files in this directory").String()
+	crawlWARCSize = crawlCmd.Flag("warc-size",
+		"rotate WARC files after this size in MB").Default("1024").Int()
+	crawlMaxOffers = crawlCmd.Flag("max-offers",
+		"stop after fetching this many offers, zero means no limit").
+		Default("0").Int()
+	crawlMaxPages = crawlCmd.Flag("max-pages",
+		"stop listing after this many search result pages, listed offers "+
+			"are still fetched, zero means no limit").Default("0").Int()
+	crawlMaxDuration = crawlCmd.Flag("max-duration",
+		"stop crawling after this duration, zero means no limit").
+		Default("0").Duration()
+	crawlMaxOfferSize = crawlCmd.Flag("max-offer-size",
+		"quarantine offers larger than this size in kB instead of storing "+
+			"them, zero means no limit").Default(strconv.Itoa(defaultMaxOfferKB)).
+		Int()
+	crawlRetryQuarantined = crawlCmd.Flag("retry-quarantined",
+		"fetch quarantined offers again instead of skipping them").Bool()
+	crawlReplay = crawlCmd.Flag("replay",
+		"replay HTTP exchanges recorded in WARC or JSON fixtures in this directory").
+		String()
 )
 
 func crawlFn(cfg *Config) error {
@@ -407,7 +831,37 @@ func crawlFn(cfg *Config) error {
 	defer func() {
 		closeErr = store.Close()
 	}()
-	err = crawl(store, *crawlMinSalary, *crawlLocations)
+	if *crawlReplay != "" {
+		replay, err := LoadReplayTransport(*crawlReplay)
+		if err != nil {
+			return err
+		}
+		httpClient.Transport = replay
+		crawlSleep = func(time.Duration) {}
+	}
+	if *crawlWARC != "" {
+		writer, err := NewWARCWriter(*crawlWARC, "apec",
+			int64(*crawlWARCSize)*1024*1024)
+		if err != nil {
+			return err
+		}
+		defer writer.Close()
+		httpClient.Transport = NewWARCTransport(httpClient.Transport, writer)
+	}
+	limits := CrawlLimits{
+		MaxOffers:    *crawlMaxOffers,
+		MaxPages:     *crawlMaxPages,
+		MaxDuration:  *crawlMaxDuration,
+		MaxOfferSize: int64(*crawlMaxOfferSize) * 1024,
+	}
+	if *crawlRetryQuarantined {
+		n, err := store.ClearQuarantined()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d quarantined offers will be fetched again\n", n)
+	}
+	err = crawl(store, *crawlMinSalary, *crawlLocations, *crawlHTML, limits)
 	if err != nil {
 		return err
 	}
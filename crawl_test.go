@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+// replayCrawl installs the replay transport loaded from testdata/replay and
+// returns a function restoring the live crawling settings.
+func replayCrawl(t *testing.T) func() {
+	replay, err := LoadReplayTransport(filepath.Join("testdata", "replay"))
+	if err != nil {
+		t.Fatalf("could not load replay fixtures: %s", err)
+	}
+	transport, sleep := httpClient.Transport, crawlSleep
+	httpClient.Transport = replay
+	crawlSleep = func(time.Duration) {}
+	return func() {
+		httpClient.Transport = transport
+		crawlSleep = sleep
+	}
+}
+
+func TestCrawlReplay(t *testing.T) {
+	defer replayCrawl(t)()
+	store := openTempStore(t)
+	defer closeAndDeleteStore(t, store)
+
+	// First crawl lists 101, 102 and 103 which cannot be fetched
+	err := crawl(store, 0, nil, false, CrawlLimits{})
+	if err != nil {
+		t.Fatalf("first crawl failed: %s", err)
+	}
+	ids, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(ids) != "[apec:101 apec:102]" {
+		t.Fatalf("unexpected offers after first crawl: %v", ids)
+	}
+
+	// Second crawl removes 102
+	err = crawl(store, 0, nil, false, CrawlLimits{})
+	if err != nil {
+		t.Fatalf("second crawl failed: %s", err)
+	}
+	ids, err = store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(ids) != "[apec:101]" {
+		t.Fatalf("unexpected offers after second crawl: %v", ids)
+	}
+	deleted, err := store.ListDeletedIds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(deleted) != "[apec:102]" {
+		t.Fatalf("unexpected deleted offers: %v", deleted)
+	}
+
+	// Index the store and search it
+	dir, err := ioutil.TempDir("", "apec-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	index, err := NewOfferIndex(filepath.Join(dir, "index"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	queue, err := OpenIndexQueue(filepath.Join(dir, "queue"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Close()
+	indexer := &Indexer{
+		store: store,
+		index: NewIndexHolder(index),
+		queue: queue,
+		work:  make(chan bool, 1),
+	}
+	err = indexer.resetQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The offer is indexed and its dates refreshed
+	n, err := indexer.indexSome()
+	if err != nil || n != 2 {
+		t.Fatalf("could not index offers: %d, %v", n, err)
+	}
+	q, err := makeSearchQuery("golang", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found, err := searchIds(index, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(found)
+	if fmt.Sprint(found) != "[apec:101]" {
+		t.Fatalf("unexpected search results: %v", found)
+	}
+}
+
+func TestReplayUnknownRequest(t *testing.T) {
+	client := &http.Client{
+		Transport: NewReplayTransport(),
+	}
+	_, err := client.Get("https://cadres.apec.fr/unknown")
+	if err == nil {
+		t.Fatalf("unknown request was replayed")
+	}
+}
+
+func TestCrawlLimits(t *testing.T) {
+	defer replayCrawl(t)()
+	store := openTempStore(t)
+	defer closeAndDeleteStore(t, store)
+
+	err := store.Put("apec:999", []byte(`{"numeroOffre": "999", "datePublication": "2017-01-01T10:00:00.000+0000"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only 101 is fetched and unseen 999 is kept
+	err = crawl(store, 0, nil, false, CrawlLimits{MaxOffers: 1})
+	if err != nil {
+		t.Fatalf("limited crawl failed: %s", err)
+	}
+	ids, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(ids) != "[apec:101 apec:999]" {
+		t.Fatalf("unexpected offers after limited crawl: %v", ids)
+	}
+
+	// Complete crawls delete unseen offers
+	err = crawl(store, 0, nil, false, CrawlLimits{})
+	if err != nil {
+		t.Fatalf("crawl failed: %s", err)
+	}
+	ids, err = store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(ids) != "[apec:101]" {
+		t.Fatalf("unexpected offers after complete crawl: %v", ids)
+	}
+}
+
+func TestCrawlBudget(t *testing.T) {
+	now := time.Date(2017, 1, 2, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time {
+		return now
+	}
+	b := newCrawlBudget(CrawlLimits{MaxPages: 2, MaxDuration: time.Minute}, clock)
+	if !b.Page() || !b.Page() || b.Truncated() != "" {
+		t.Fatalf("pages refused before the limit")
+	}
+	if b.Page() || b.Truncated() != "pages limit of 2 reached" {
+		t.Fatalf("pages limit not enforced: %q", b.Truncated())
+	}
+	// Listed offers are still fetched
+	if !b.Offer() || b.Exceeded() != "" {
+		t.Fatalf("pages limit refused offers: %q", b.Exceeded())
+	}
+	now = now.Add(time.Minute)
+	if b.Offer() || b.Truncated() != "duration limit of 1m0s reached" {
+		t.Fatalf("duration limit not reported: %q", b.Truncated())
+	}
+	now = now.Add(-time.Minute)
+
+	b = newCrawlBudget(CrawlLimits{MaxDuration: time.Minute}, clock)
+	for i := 0; i < 1000; i++ {
+		if !b.Offer() {
+			t.Fatalf("offer refused before the deadline")
+		}
+	}
+	now = now.Add(time.Minute)
+	if b.Offer() || b.Exceeded() != "duration limit of 1m0s reached" {
+		t.Fatalf("duration limit not enforced: %q", b.Exceeded())
+	}
+
+	stop := make(chan struct{})
+	b = newCrawlBudget(CrawlLimits{Stop: stop}, clock)
+	if !b.Offer() || !b.Page() {
+		t.Fatalf("requests refused before stopping")
+	}
+	close(stop)
+	if b.Offer() || b.Exceeded() != "crawl was interrupted" {
+		t.Fatalf("stop not enforced: %q", b.Exceeded())
+	}
+}
+
+func TestCrawlQuarantine(t *testing.T) {
+	defer replayCrawl(t)()
+	store := openTempStore(t)
+	defer closeAndDeleteStore(t, store)
+
+	before := downloadedBytes
+	err := crawl(store, 0, nil, false, CrawlLimits{MaxOfferSize: 16})
+	if err != nil {
+		t.Fatalf("crawl failed: %s", err)
+	}
+	if downloadedBytes <= before {
+		t.Fatalf("downloaded bytes were not counted")
+	}
+	ids, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 0 {
+		t.Fatalf("oversized offers were stored: %v", ids)
+	}
+	quarantined, err := store.ListQuarantined()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(quarantined) != 2 || quarantined[0].Id != "apec:101" ||
+		quarantined[1].Id != "apec:102" || len(quarantined[0].Data) != 16 {
+		t.Fatalf("unexpected quarantined offers: %+v", quarantined)
+	}
+
+	// Quarantined offers are not fetched again, until cleared
+	err = crawl(store, 0, nil, false, CrawlLimits{})
+	if err != nil {
+		t.Fatalf("crawl failed: %s", err)
+	}
+	ids, err = store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 0 {
+		t.Fatalf("quarantined offers were fetched: %v", ids)
+	}
+	n, err := store.ClearQuarantined()
+	if err != nil || n != 2 {
+		t.Fatalf("could not clear quarantine: %d, %v", n, err)
+	}
+	err = crawl(store, 0, nil, false, CrawlLimits{})
+	if err != nil {
+		t.Fatalf("crawl failed: %s", err)
+	}
+	ids, err = store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(ids) != "[apec:101]" {
+		t.Fatalf("unexpected offers after clearing quarantine: %v", ids)
+	}
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/analysis/analyzer/keyword"
+	"github.com/blevesearch/bleve/mapping"
+	"github.com/blevesearch/bleve/search/query"
+	"github.com/pmezard/apec/jstruct"
+	"github.com/pquerna/ffjson/ffjson"
+)
+
+// Deleted offers versions are indexed in a secondary full text index, so
+// searches can include the historical corpus. Documents are identified by
+// deletedDocId and carry their deletion date. Deleted offers lose their
+// cached location, their geopoint and areas come from the area assigned
+// while they were live, when there is one. The Indexer updates the index
+// when dequeuing DeletedOp operations, queued along offers deletions and
+// restorations, or by store and index synchronizations.
+
+// Upper bound on the number of deleted versions of a single offer
+const maxDeletedVersions = 1000
+
+// deletedDocId returns the document identifier of deleted version deletedId
+// of offer id.
+func deletedDocId(id string, deletedId uint64) string {
+	return id + "/" + strconv.FormatUint(deletedId, 10)
+}
+
+// parseDeletedDocId returns the offer identifier and deleted identifier of a
+// deleted offers index document.
+func parseDeletedDocId(docId string) (string, uint64, error) {
+	pos := strings.LastIndex(docId, "/")
+	if pos > 0 {
+		deletedId, err := strconv.ParseUint(docId[pos+1:], 10, 64)
+		if err == nil {
+			return docId[:pos], deletedId, nil
+		}
+	}
+	return "", 0, fmt.Errorf("invalid deleted document identifier: %s", docId)
+}
+
+// NewDeletedOfferMapping returns the offer mapping, with the offer
+// identifier and deletion date indexed as well.
+func NewDeletedOfferMapping() (*mapping.IndexMappingImpl, error) {
+	m, err := NewOfferMapping()
+	if err != nil {
+		return nil, err
+	}
+	// Lists the deleted versions of an offer
+	id := bleve.NewTextFieldMapping()
+	id.Store = false
+	id.IncludeInAll = false
+	id.IncludeTermVectors = false
+	id.Analyzer = keyword.Name
+
+	deleted := bleve.NewDateTimeFieldMapping()
+	deleted.Store = true
+	deleted.IncludeInAll = false
+	deleted.IncludeTermVectors = false
+
+	m.DefaultMapping.AddFieldMappingsAt("id", id)
+	m.DefaultMapping.AddFieldMappingsAt("deleted", deleted)
+	return m, nil
+}
+
+func NewDeletedOfferIndex(dir string) (bleve.Index, error) {
+	m, err := NewDeletedOfferMapping()
+	if err != nil {
+		return nil, err
+	}
+	return newIndexUsing(dir, m)
+}
+
+// openDeletedIndex opens the deleted offers index in dir, creating it if
+// necessary. New indexes are filled by the next Indexer synchronization.
+func openDeletedIndex(dir string) (bleve.Index, error) {
+	exists, err := isFile(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return NewDeletedOfferIndex(dir)
+	}
+	return OpenOfferIndex(dir)
+}
+
+// DeletedIndex opens the deleted offers index on first use, so processes
+// neither searching nor updating it do not pay for it. A nil DeletedIndex
+// means deleted offers are not indexed.
+type DeletedIndex struct {
+	dir string
+	// Open the index read-only, and fail instead of creating it
+	ReadOnly bool
+	lock     sync.Mutex
+	index    bleve.Index
+}
+
+func NewDeletedIndex(dir string) *DeletedIndex {
+	return &DeletedIndex{
+		dir: dir,
+	}
+}
+
+// Get returns the deleted offers index, opening or creating it if necessary.
+func (d *DeletedIndex) Get() (bleve.Index, error) {
+	if d == nil {
+		return nil, fmt.Errorf("deleted offers are not indexed here")
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.index == nil {
+		var index bleve.Index
+		var err error
+		if d.ReadOnly {
+			index, err = OpenOfferIndexReadOnly(d.dir)
+		} else {
+			index, err = openDeletedIndex(d.dir)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot open deleted offers index: %s", err)
+		}
+		d.index = index
+	}
+	return d.index, nil
+}
+
+// Opened returns the deleted offers index if it is open, nil otherwise.
+func (d *DeletedIndex) Opened() bleve.Index {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.index
+}
+
+// Close closes the index, if it was opened.
+func (d *DeletedIndex) Close() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.index == nil {
+		return nil
+	}
+	err := d.index.Close()
+	d.index = nil
+	return err
+}
+
+// getDeletedJsonOffer returns deleted version deletedId of offer id and its
+// deletion date, or nil if it does not exist.
+func getDeletedJsonOffer(store *Store, id string, deletedId uint64) (
+	*jstruct.JsonOffer, string, error) {
+
+	deleted, err := store.ListDeletedOffers(id)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, d := range deleted {
+		if d.Id != deletedId {
+			continue
+		}
+		data, err := store.GetDeleted(d.Id)
+		if err != nil || data == nil {
+			return nil, "", err
+		}
+		js := &jstruct.JsonOffer{}
+		err = ffjson.Unmarshal(data, js)
+		if err != nil {
+			return nil, "", err
+		}
+		return js, d.Date, nil
+	}
+	return nil, "", nil
+}
+
+// prepareDeletedOffer returns the indexed document of deleted version d of
+// offer id, or nil if it does not exist.
+func prepareDeletedOffer(store *Store, options IndexOptions, id string,
+	d DeletedOffer) (*Offer, error) {
+
+	js, date, err := getDeletedJsonOffer(store, id, d.Id)
+	if err != nil || js == nil {
+		return nil, err
+	}
+	offer, err := convertOffer(js)
+	if err != nil {
+		return nil, err
+	}
+	offer.Id = id
+	deleted, err := time.Parse(time.RFC3339, date)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse %s deletion date: %s", id, err)
+	}
+	offer.Deleted = &deleted
+	err = setOfferTags(store, offer)
+	if err != nil {
+		return nil, err
+	}
+	area, err := store.GetOfferArea(id)
+	if err != nil {
+		return nil, err
+	}
+	if area != nil {
+		offer.Geo = &GeoPoint{Lat: area.Lat, Lon: area.Lon}
+	}
+	setAreaTerms(offer, area)
+	prepareIndexedOffer(offer, options)
+	return offer, nil
+}
+
+// listDeletedDocIds returns the identifiers of indexed deleted versions of
+// offer id.
+func listDeletedDocIds(index bleve.Index, id string) ([]string, error) {
+	q := query.NewTermQuery(id)
+	q.SetField("id")
+	rq := bleve.NewSearchRequest(q)
+	rq.Size = maxDeletedVersions
+	res, err := index.Search(rq)
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, doc := range res.Hits {
+		ids = append(ids, doc.ID)
+	}
+	return ids, nil
+}
+
+// syncDeletedOffer indexes the deleted versions of offer id and removes
+// those restored or purged since.
+func syncDeletedOffer(store *Store, index bleve.Index, options IndexOptions,
+	id string) error {
+
+	deleted, err := store.ListDeletedOffers(id)
+	if err != nil {
+		return err
+	}
+	batch := index.NewBatch()
+	kept := map[string]bool{}
+	for _, d := range deleted {
+		offer, err := prepareDeletedOffer(store, options, id, d)
+		if err != nil {
+			return err
+		}
+		if offer == nil {
+			continue
+		}
+		docId := deletedDocId(id, d.Id)
+		kept[docId] = true
+		err = batch.Index(docId, offer)
+		if err != nil {
+			return err
+		}
+	}
+	indexed, err := listDeletedDocIds(index, id)
+	if err != nil {
+		return err
+	}
+	for _, docId := range indexed {
+		if !kept[docId] {
+			batch.Delete(docId)
+		}
+	}
+	if batch.Size() == 0 {
+		return nil
+	}
+	return index.Batch(batch)
+}
+
+// listChangedDeletedIds compares the deleted offers versions of store and
+// index and returns the identifiers of offers whose versions differ.
+func listChangedDeletedIds(store *Store, index bleve.Index) ([]string, error) {
+	offerIds, err := store.ListDeletedIds()
+	if err != nil {
+		return nil, err
+	}
+	stored := []string{}
+	for _, id := range offerIds {
+		deleted, err := store.ListDeletedOffers(id)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range deleted {
+			stored = append(stored, deletedDocId(id, d.Id))
+		}
+	}
+	indexed, err := listIndexIds(index)
+	if err != nil {
+		return nil, err
+	}
+	added, removed := diffIds(stored, indexed)
+	log.Printf("indexing %d deleted versions, removing %d", len(added),
+		len(removed))
+	changed := map[string]bool{}
+	for _, docId := range append(added, removed...) {
+		id, _, err := parseDeletedDocId(docId)
+		if err != nil {
+			return nil, err
+		}
+		changed[id] = true
+	}
+	ids := []string{}
+	for id := range changed {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// syncDeletedIndex compares the deleted offers versions of store and index
+// and updates the index accordingly.
+func syncDeletedIndex(store *Store, index bleve.Index,
+	options IndexOptions) error {
+
+	ids, err := listChangedDeletedIds(store, index)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		err := syncDeletedOffer(store, index, options, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findDeletedOffers returns deleted offers versions matching what and
+// located around where, like findOffersFromIndex. Everything matches empty
+// queries. It also reports whether results were truncated to limits.MaxHits.
+func findDeletedOffers(index bleve.Index, what, where string,
+	geocoder *Geocoder, fields []SearchField, limits SearchLimits) (
+	[]datedOffer, bool, error) {
+
+	queries := []query.Query{}
+	if where != "" {
+		if strings.HasPrefix(where, "isochrone:") {
+			return nil, false, fmt.Errorf("deleted offers cannot be searched " +
+				"with isochrones")
+		}
+		points, radius, err := parseLocationQuery(where, geocoder)
+		if err != nil {
+			return nil, false, err
+		}
+		queries = append(queries, makeGeoQuery(points, radius))
+	}
+	if what != "" {
+		text, err := makeSearchQuery(what, nil, fields)
+		if err != nil {
+			return nil, false, err
+		}
+		queries = append(queries, text)
+	}
+	var q query.Query = query.NewMatchAllQuery()
+	if len(queries) > 0 {
+		q = query.NewConjunctionQuery(queries)
+	}
+	offers, partial, err := searchDatedOffers(index, q, nil, limits)
+	if err != nil {
+		return nil, false, err
+	}
+	markDeleted(offers)
+	return offers, partial, nil
+}
+
+// findDeletedJsonOffers returns the deleted offers versions of index
+// matching queryString.
+func findDeletedJsonOffers(store *Store, index bleve.Index,
+	fields []SearchField, queryString string) ([]*jstruct.JsonOffer, error) {
+
+	q, err := makeSearchQuery(queryString, nil, fields)
+	if err != nil {
+		return nil, err
+	}
+	docIds, err := searchIds(index, q)
+	if err != nil {
+		return nil, err
+	}
+	offers := []*jstruct.JsonOffer{}
+	for _, docId := range docIds {
+		id, deletedId, err := parseDeletedDocId(docId)
+		if err != nil {
+			return nil, err
+		}
+		js, _, err := getDeletedJsonOffer(store, id, deletedId)
+		if err != nil {
+			return nil, err
+		}
+		if js != nil {
+			offers = append(offers, js)
+		}
+	}
+	return offers, nil
+}
+
+func markDeleted(offers []datedOffer) {
+	for i := range offers {
+		offers[i].Deleted = true
+	}
+}
+
+// resultOfferId returns the offer identifier of a live or deleted search
+// result.
+func resultOfferId(offer datedOffer) string {
+	if offer.Deleted {
+		id, _, err := parseDeletedDocId(offer.Id)
+		if err == nil {
+			return id
+		}
+	}
+	return offer.Id
+}
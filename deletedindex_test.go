@@ -0,0 +1,217 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeletedDocId(t *testing.T) {
+	docId := deletedDocId("apec:1001", 12)
+	id, deletedId, err := parseDeletedDocId(docId)
+	if err != nil || id != "apec:1001" || deletedId != 12 {
+		t.Fatalf("unexpected parsed %s: %s, %d, %v", docId, id, deletedId, err)
+	}
+	for _, invalid := range []string{"apec:1001", "/12", "apec:1001/x"} {
+		_, _, err := parseDeletedDocId(invalid)
+		if err == nil {
+			t.Fatalf("%s should not be a deleted document identifier", invalid)
+		}
+	}
+}
+
+func TestDeletedIndexSearch(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	// Deleted offers keep the area assigned while they were live
+	id := "apec:1002"
+	err := env.Store.PutOfferArea(id, &OfferArea{
+		Department: "Paris",
+		Region:     "Île-de-France",
+		Lat:        48.8566,
+		Lon:        2.3522,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cet := time.FixedZone("CET", 3600)
+	_, err = env.Store.Delete(id, time.Date(2017, 1, 9, 12, 0, 0, 0, cet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = env.Index.Delete(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Spatial.Remove(id)
+	deleted, err := env.Deleted.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = syncDeletedIndex(env.Store, deleted, IndexOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexed, err := listIndexIds(deleted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(indexed, []string{"apec:1002/1"}) {
+		t.Fatalf("unexpected deleted documents: %v", indexed)
+	}
+	env.Generation.Bump()
+
+	query := func(what, where string, includeDeleted bool) string {
+		values := url.Values{"what": {what}, "where": {where}}
+		if includeDeleted {
+			values.Set("include_deleted", "1")
+		}
+		w := env.QueryValues(values)
+		if w.Code != 200 {
+			t.Fatalf("query %q, %q failed with %d: %s", what, where, w.Code,
+				w.Body.String())
+		}
+		return w.Body.String()
+	}
+	marker := "[deleted 2017-01-09]"
+	body := query("python", "paris", false)
+	if strings.Contains(body, marker) || !strings.Contains(body, "1/1 offers") {
+		t.Fatalf("deleted offers should be excluded by default: %s", body)
+	}
+	body = query("python", "paris", true)
+	if !strings.Contains(body, marker) || !strings.Contains(body, "2/2 offers") ||
+		!strings.Contains(body, "Développeur Python") {
+		t.Fatalf("deleted offer not found: %s", body)
+	}
+	// Refined results keep matching deleted offers
+	m := regexp.MustCompile(`name="refine" value="([^"]+)"`).FindStringSubmatch(body)
+	if m == nil {
+		t.Fatalf("refine token not found: %s", body)
+	}
+	w := env.QueryValues(url.Values{"refine": {m[1]}, "what": {"développeur"}})
+	if w.Code != 200 || !strings.Contains(w.Body.String(), marker) ||
+		!strings.Contains(w.Body.String(), "2/2 offers") {
+		t.Fatalf("refined deleted offer not found: %s", w.Body.String())
+	}
+	body = query("python", "", true)
+	if !strings.Contains(body, marker) {
+		t.Fatalf("deleted offer not found without location: %s", body)
+	}
+	body = query("python", "lyon", true)
+	if strings.Contains(body, marker) {
+		t.Fatalf("deleted offer should not be located in lyon: %s", body)
+	}
+	body = query("java", "", true)
+	if strings.Contains(body, marker) {
+		t.Fatalf("deleted offer should not match java: %s", body)
+	}
+
+	// Restored offers are removed from the deleted offers index
+	_, err = env.Store.Undelete(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = syncDeletedOffer(env.Store, deleted, IndexOptions{}, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexed, err = listIndexIds(deleted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(indexed) != 0 {
+		t.Fatalf("restored offer is still indexed as deleted: %v", indexed)
+	}
+}
+
+func TestDeletedIndexLazyOpen(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	exists, err := isFile(env.Config.DeletedIndex())
+	if err != nil || exists {
+		t.Fatalf("deleted offers index should not be created yet: %v", err)
+	}
+	id := "apec:1003"
+	cet := time.FixedZone("CET", 3600)
+	_, err = env.Store.Delete(id, time.Date(2017, 1, 9, 12, 0, 0, 0, cet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue, err := OpenIndexQueue(env.Config.Queue())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Close()
+	indexer := &Indexer{
+		store:   env.Store,
+		index:   NewIndexHolder(env.Index),
+		deleted: env.Deleted,
+		queue:   queue,
+	}
+	// Synchronizations queue deleted versions updates
+	err = indexer.resetQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	queued, err := queue.FetchMany(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ops := []Queued{}
+	for _, q := range queued {
+		ops = append(ops, Queued{Id: q.Id, Op: q.Op})
+	}
+	expected := []Queued{
+		{Id: id, Op: RemoveOp},
+		{Id: id, Op: DatesOp},
+		{Id: id, Op: DeletedOp},
+	}
+	if !reflect.DeepEqual(ops, expected) {
+		t.Fatalf("unexpected queued operations: %+v", ops)
+	}
+	exists, err = isFile(env.Config.DeletedIndex())
+	if err != nil || exists {
+		t.Fatalf("deleted offers index opened before dequeuing: %v", err)
+	}
+	deleted, err := env.Deleted.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range queued {
+		err = indexer.indexOne(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	indexed, err := listIndexIds(deleted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(indexed, []string{"apec:1003/1"}) {
+		t.Fatalf("unexpected deleted documents: %v", indexed)
+	}
+
+	// Closed indexes are opened again on demand
+	err = env.Deleted.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted, err = env.Deleted.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := deleted.DocCount()
+	if err != nil || count != 1 {
+		t.Fatalf("unexpected reopened index size: %d, %v", count, err)
+	}
+	var missing *DeletedIndex
+	_, err = missing.Get()
+	if err == nil {
+		t.Fatalf("nil deleted offers index should fail")
+	}
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"fmt"
 	"image"
 	"image/color"
-	"image/png"
+	"math"
+	"net/url"
 	"os"
 	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/blevesearch/bleve"
 	"github.com/jonas-p/go-shp"
@@ -63,12 +68,170 @@ type Point struct {
 	Lon float64
 }
 
+const (
+	// Density map points count for one offer, their minimum salary or a
+	// freshness decay
+	weightCount   = "count"
+	weightSalary  = "salary"
+	weightRecency = "recency"
+
+	// Offers weight halves every recencyHalfLife with recency weighting
+	recencyHalfLife = 30 * 24 * time.Hour
+)
+
+// MapPoint is an offer location contributing Weight to the density map.
+type MapPoint struct {
+	Point
+	Weight int
+}
+
+// parseDensityWeight validates a density map weighting, counting offers by
+// default.
+func parseDensityWeight(s string) (string, error) {
+	switch s {
+	case "":
+		return weightCount, nil
+	case weightCount, weightSalary, weightRecency:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown weight: %q", s)
+}
+
+// DensityOptions control how density maps are computed and drawn.
+type DensityOptions struct {
+	Weight string
+	// Number of contour lines, none if zero
+	Contours int
+	// Draw the heatmap, or only contour lines
+	Fill bool
+	// Blank border around the map, in pixels
+	Margin int
+	// Title and query caption drawn above the map, if set
+	Title   string
+	Caption bool
+	// PNG resolution in dots per inch, unset if zero
+	DPI int
+}
+
+func defaultDensityOptions() *DensityOptions {
+	return &DensityOptions{
+		Weight: weightCount,
+		Fill:   true,
+	}
+}
+
+// parseDensityOptions reads "weight", "contours", "fill", "margin", "title",
+// "caption" and "dpi" parameters.
+func parseDensityOptions(values url.Values) (*DensityOptions, error) {
+	opts := defaultDensityOptions()
+	weight, err := parseDensityWeight(values.Get("weight"))
+	if err != nil {
+		return nil, err
+	}
+	opts.Weight = weight
+	if s := values.Get("contours"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid contours: %q", s)
+		}
+		opts.Contours = n
+	}
+	opts.Fill = values.Get("fill") != "0"
+	if s := values.Get("margin"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid margin: %q", s)
+		}
+		opts.Margin = n
+	}
+	opts.Title = strings.TrimSpace(values.Get("title"))
+	opts.Caption = values.Get("caption") == "1"
+	if s := values.Get("dpi"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dpi: %q", s)
+		}
+		opts.DPI = n
+	}
+	err = opts.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+func (o *DensityOptions) Validate() error {
+	if o.Contours < 0 || o.Contours > maxContours {
+		return fmt.Errorf("contours must be in 0-%d", maxContours)
+	}
+	if !o.Fill && o.Contours == 0 {
+		return fmt.Errorf("maps without heatmap require contours")
+	}
+	if o.Margin < 0 || o.Margin > maxDensityMargin {
+		return fmt.Errorf("margin must be in 0-%d", maxDensityMargin)
+	}
+	if len(o.Title) > maxDensityTitle {
+		return fmt.Errorf("title is too long")
+	}
+	if o.DPI < 0 || o.DPI > maxDensityDPI {
+		return fmt.Errorf("dpi must be in 0-%d", maxDensityDPI)
+	}
+	return nil
+}
+
+// CacheKey identifies the options in density maps caches, default ones
+// being empty. Labeled maps must not be cached, their caption is dated.
+func (o *DensityOptions) CacheKey() string {
+	key := ""
+	if o.Weight != weightCount {
+		key += "-" + o.Weight
+	}
+	if o.Contours > 0 {
+		key += fmt.Sprintf("-c%d", o.Contours)
+	}
+	if !o.Fill {
+		key += "-nofill"
+	}
+	if o.Margin > 0 {
+		key += fmt.Sprintf("-m%d", o.Margin)
+	}
+	if o.DPI > 0 {
+		key += fmt.Sprintf("-dpi%d", o.DPI)
+	}
+	return key
+}
+
+// pointWeight returns the contribution of offer id published on date to a
+// density map with specified weighting. Salaries are in kEUR, recency decays
+// from 1000 for offers published now.
+func pointWeight(store *Store, id string, date time.Time, weight string,
+	now time.Time) (int, error) {
+
+	switch weight {
+	case weightSalary:
+		offer, err := getStoreOffer(store, id)
+		if err != nil || offer == nil {
+			return 0, err
+		}
+		return offer.MinSalary, nil
+	case weightRecency:
+		age := now.Sub(date)
+		if age < 0 {
+			age = 0
+		}
+		decay := math.Pow(0.5, float64(age)/float64(recencyHalfLife))
+		return int(1000*decay + 0.5), nil
+	}
+	return 1, nil
+}
+
 // listPoints returns the location of offers satisfying specified full-text
-// query. If query is empty, it returns all locations. If not nil, spatial is
-// exploited as a cache to fetch indexed offers and their locations, which
-// avoid store lookups.
+// query, weighted by weight at now. If query is empty, it returns all
+// locations. Points with zero weight, like offers without salary, are
+// skipped. If not nil, spatial is exploited as a cache to fetch indexed
+// offers and their locations, which avoid store lookups.
 func listPoints(store *Store, index bleve.Index, spatial *SpatialIndex,
-	query string) ([]Point, error) {
+	query, weight string, now time.Time) ([]MapPoint, error) {
 
 	var ids []string
 	if query == "" {
@@ -82,7 +245,7 @@ func listPoints(store *Store, index bleve.Index, spatial *SpatialIndex,
 			ids = list
 		}
 	} else {
-		q, err := makeSearchQuery(query, nil)
+		q, err := makeSearchQuery(query, nil, nil)
 		if err != nil {
 			return nil, err
 		}
@@ -96,29 +259,45 @@ func listPoints(store *Store, index bleve.Index, spatial *SpatialIndex,
 			ids = append(ids, doc.ID)
 		}
 	}
-	points := make([]Point, 0, len(ids))
+	points := make([]MapPoint, 0, len(ids))
 	for _, id := range ids {
 		var p *Point
+		var date time.Time
 		if spatial != nil {
 			offer := spatial.Get(id)
 			if offer != nil {
+				if offer.Nationwide {
+					continue
+				}
 				p = &offer.Point
+				date = offer.Date
 			}
 		}
 		if p == nil {
-			loc, _, err := store.GetLocation(id)
+			loc, locDate, err := store.GetLocation(id)
 			if err != nil {
 				return nil, err
 			}
-			if loc == nil {
+			if loc == nil || loc.Nationwide {
 				continue
 			}
 			p = &Point{
 				Lat: loc.Lat,
 				Lon: loc.Lon,
 			}
+			date = locDate
+		}
+		w, err := pointWeight(store, id, date, weight, now)
+		if err != nil {
+			return nil, err
 		}
-		points = append(points, *p)
+		if w <= 0 {
+			continue
+		}
+		points = append(points, MapPoint{
+			Point:  *p,
+			Weight: w,
+		})
 	}
 	return points, nil
 }
@@ -137,8 +316,8 @@ func NewGrid(w, h int) *Grid {
 	}
 }
 
-func (g *Grid) Add(i, j int) {
-	g.Values[j*g.Width+i]++
+func (g *Grid) Add(i, j, v int) {
+	g.Values[j*g.Width+i] += v
 }
 
 func (g *Grid) Get(i, j int) int {
@@ -164,7 +343,7 @@ func makeFranceBox() shp.Box {
 	}
 }
 
-func makeMapGrid(points []Point, box shp.Box, w, h int) *Grid {
+func makeMapGrid(points []MapPoint, box shp.Box, w, h int) *Grid {
 	width := box.MaxX - box.MinX
 	height := box.MaxY - box.MinY
 
@@ -183,7 +362,7 @@ func makeMapGrid(points []Point, box shp.Box, w, h int) *Grid {
 		if j >= grid.Height {
 			j = grid.Height - 1
 		}
-		grid.Add(i, j)
+		grid.Add(i, j, p.Weight)
 	}
 	return grid
 }
@@ -278,13 +457,13 @@ func drawShapes(box shp.Box, shapes []shp.Shape, img *image.RGBA) error {
 	return nil
 }
 
-func writeImage(img image.Image, path string) error {
+func writeImage(img image.Image, path string, dpi int) error {
 	fp, err := os.Create(path)
 	if err != nil {
 		return err
 	}
 	defer fp.Close()
-	err = png.Encode(fp, img)
+	err = writeDensityPNG(fp, img, dpi)
 	if err != nil {
 		return err
 	}
@@ -296,10 +475,27 @@ var (
 
 Compute and return a PNG image representing the spatial density of selected
 offers. Each offers is assumed to have a spatial extent of roughtly 15km around
-its pinpointed location.
+its pinpointed location. Offers count for one, or with --weight, for their
+minimum salary or a freshness decay halving every 30 days. --contours draws
+contour lines over the heatmap, or alone with --no-fill. --title and
+--caption label the map with a title and the query and date, in a top margin.
 `)
-	densityFile  = densityCmd.Arg("file", "output image file").Required().String()
-	densityQuery = densityCmd.Arg("query", "query string").String()
+	densityFile   = densityCmd.Arg("file", "output image file").Required().String()
+	densityQuery  = densityCmd.Arg("query", "query string").String()
+	densityWeight = densityCmd.Flag("weight", "offers weight, count, salary or recency").
+			Default(weightCount).Enum(weightCount, weightSalary, weightRecency)
+	densityContours = densityCmd.Flag("contours", "number of contour lines").
+			Default("0").Int()
+	densityFill = densityCmd.Flag("fill", "draw the heatmap").Default("true").Bool()
+	densitySize = densityCmd.Flag("size", "map width and height in pixels").
+			Default("1000").Int()
+	densityMargin = densityCmd.Flag("margin", "border around the map in pixels").
+			Default("0").Int()
+	densityTitle   = densityCmd.Flag("title", "title drawn above the map").String()
+	densityCaption = densityCmd.Flag("caption", "describe the query and date "+
+		"above the map").Bool()
+	densityDPI = densityCmd.Flag("dpi", "resolution recorded in the PNG file").
+			Default("0").Int()
 )
 
 func densityFn(cfg *Config) error {
@@ -314,21 +510,39 @@ func densityFn(cfg *Config) error {
 		return err
 	}
 	box := makeFranceBox()
-	shapes, err := shpdraw.LoadAndFilterShapes("shp/TM_WORLD_BORDERS-0.3.shp", box)
+	shapes, err := loadBorders(cfg, box)
 	if err != nil {
 		return err
 	}
 
-	points, err := listPoints(store, index, nil, *densityQuery)
+	opts := &DensityOptions{
+		Weight:   *densityWeight,
+		Contours: *densityContours,
+		Fill:     *densityFill,
+		Margin:   *densityMargin,
+		Title:    *densityTitle,
+		Caption:  *densityCaption,
+		DPI:      *densityDPI,
+	}
+	err = opts.Validate()
+	if err != nil {
+		return err
+	}
+	if *densitySize <= 0 || *densitySize > maxDensitySize {
+		return fmt.Errorf("size must be in 1-%d", maxDensitySize)
+	}
+	now := time.Now()
+	points, err := listPoints(store, index, nil, *densityQuery, opts.Weight, now)
 	if err != nil {
 		return err
 	}
-	grid := makeMapGrid(points, box, 1000, 1000)
+	grid := makeMapGrid(points, box, *densitySize, *densitySize)
 	grid = convolveGrid(grid)
-	img := drawGrid(grid)
+	img := drawDensity(grid, opts)
 	err = drawShapes(box, shapes, img)
 	if err != nil {
 		return err
 	}
-	return writeImage(img, *densityFile)
+	labels := densityLabels(*densityQuery, opts, now)
+	return writeImage(frameDensity(img, labels, opts), *densityFile, opts.DPI)
 }
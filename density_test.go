@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestListPointsWeights(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	now := time.Date(2017, 1, 3, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		Weight   string
+		Expected []int
+	}{
+		// Paris, Paris, Lyon, Bordeaux
+		{weightCount, []int{1, 1, 1, 1}},
+		// Bordeaux has no salary
+		{weightSalary, []int{45, 40, 50}},
+		// Published one day before now, now, and in the future
+		{weightRecency, []int{977, 1000, 1000, 1000}},
+	}
+	for _, spatial := range []*SpatialIndex{nil, env.Spatial} {
+		for _, test := range tests {
+			points, err := listPoints(env.Store, env.Index, spatial, "",
+				test.Weight, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			weights := map[int]int{}
+			for _, p := range points {
+				weights[p.Weight]++
+			}
+			expected := map[int]int{}
+			for _, w := range test.Expected {
+				expected[w]++
+			}
+			if len(points) != len(test.Expected) || len(weights) != len(expected) {
+				t.Fatalf("%s: unexpected points: %+v", test.Weight, points)
+			}
+			for w, n := range expected {
+				if weights[w] != n {
+					t.Fatalf("%s: unexpected points: %+v", test.Weight, points)
+				}
+			}
+		}
+	}
+	_, err := parseDensityWeight("distance")
+	if err == nil {
+		t.Fatalf("unknown weight was accepted")
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"strings"
+	"time"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/inconsolata"
+	"golang.org/x/image/math/fixed"
+)
+
+// Density maps can be framed by a margin, with a title and a caption
+// describing the query in the top one, and saved with a resolution, so they
+// can be published as is. Labels are drawn with a bitmap font covering
+// Latin-1, enough for French titles and queries.
+
+const (
+	// Density maps grid and image grow with the square of their size
+	maxDensitySize   = 2000
+	maxDensityMargin = 200
+	maxDensityDPI    = 1200
+	maxDensityTitle  = 200
+	// Height of title and caption lines
+	labelHeight = 18
+)
+
+// describeDensity describes the offers of a density map drawn at now.
+func describeDensity(what string, opts *DensityOptions, now time.Time) string {
+	parts := []string{}
+	if what == "" {
+		parts = append(parts, "all offers")
+	} else {
+		parts = append(parts, fmt.Sprintf("offers matching %q", what))
+	}
+	if opts.Weight != weightCount {
+		parts = append(parts, "weighted by "+opts.Weight)
+	}
+	parts = append(parts, now.Format("2006-01-02"))
+	return strings.Join(parts, ", ")
+}
+
+// densityLabels returns the lines drawn above the map.
+func densityLabels(what string, opts *DensityOptions, now time.Time) []string {
+	labels := []string{}
+	if opts.Title != "" {
+		labels = append(labels, opts.Title)
+	}
+	if opts.Caption {
+		labels = append(labels, describeDensity(what, opts, now))
+	}
+	return labels
+}
+
+// densityOffset returns the position of the map in the framed image.
+func densityOffset(opts *DensityOptions, labels int) image.Point {
+	top := opts.Margin
+	if labels > 0 {
+		top += labels*labelHeight + labelHeight/2
+	}
+	return image.Point{X: opts.Margin, Y: top}
+}
+
+// frameDensity returns img surrounded by opts margin, with labels drawn in
+// the top one. img is returned unchanged if there is nothing to add.
+func frameDensity(img *image.RGBA, labels []string, opts *DensityOptions) *image.RGBA {
+	if opts.Margin == 0 && len(labels) == 0 {
+		return img
+	}
+	offset := densityOffset(opts, len(labels))
+	size := img.Bounds().Size()
+	framed := image.NewRGBA(image.Rect(0, 0, size.X+2*opts.Margin,
+		offset.Y+size.Y+opts.Margin))
+	draw.Draw(framed, framed.Bounds(), &image.Uniform{getColor(0)}, image.Point{},
+		draw.Src)
+	draw.Draw(framed, img.Bounds().Add(offset), img, img.Bounds().Min, draw.Src)
+	d := &font.Drawer{
+		Dst:  framed,
+		Src:  &image.Uniform{color.RGBA{255, 255, 255, 255}},
+		Face: inconsolata.Regular8x16,
+	}
+	for i, label := range labels {
+		d.Dot = fixed.P(opts.Margin+4, opts.Margin+(i+1)*labelHeight)
+		d.DrawString(label)
+	}
+	return framed
+}
+
+// writeDensityPNG encodes img as PNG, recording dpi resolution if not zero.
+func writeDensityPNG(w io.Writer, img image.Image, dpi int) error {
+	buf := &bytes.Buffer{}
+	err := png.Encode(buf, img)
+	if err != nil {
+		return err
+	}
+	data := buf.Bytes()
+	if dpi > 0 {
+		data, err = setPNGResolution(data, dpi)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// setPNGResolution inserts a pHYs chunk after the IHDR one of PNG data.
+func setPNGResolution(data []byte, dpi int) ([]byte, error) {
+	// Signature, then IHDR length, type, 13 bytes of data and CRC
+	ihdrEnd := 8 + 4 + 4 + 13 + 4
+	if len(data) < ihdrEnd || string(data[12:16]) != "IHDR" {
+		return nil, fmt.Errorf("invalid PNG header")
+	}
+	// Pixels per meter on both axes, then the unit, 1 for meters
+	ppm := uint32(float64(dpi)/0.0254 + 0.5)
+	chunk := make([]byte, 4+4+9+4)
+	binary.BigEndian.PutUint32(chunk[0:], 9)
+	copy(chunk[4:], "pHYs")
+	binary.BigEndian.PutUint32(chunk[8:], ppm)
+	binary.BigEndian.PutUint32(chunk[12:], ppm)
+	chunk[16] = 1
+	binary.BigEndian.PutUint32(chunk[17:], crc32.ChecksumIEEE(chunk[4:17]))
+
+	result := make([]byte, 0, len(data)+len(chunk))
+	result = append(result, data[:ihdrEnd]...)
+	result = append(result, chunk...)
+	return append(result, data[ihdrEnd:]...), nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/png"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestFrameDensity(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 50, 40))
+	opts := &DensityOptions{Weight: weightCount, Fill: true}
+	if frameDensity(img, nil, opts) != img {
+		t.Fatalf("unframed map was copied")
+	}
+
+	now := time.Date(2017, 1, 3, 10, 0, 0, 0, time.UTC)
+	opts.Weight = weightSalary
+	opts.Margin = 10
+	opts.Title = "Offers"
+	opts.Caption = true
+	labels := densityLabels("golang", opts, now)
+	if len(labels) != 2 || labels[0] != "Offers" ||
+		labels[1] != `offers matching "golang", weighted by salary, 2017-01-03` {
+		t.Fatalf("unexpected labels: %q", labels)
+	}
+	framed := frameDensity(img, labels, opts)
+	offset := densityOffset(opts, len(labels))
+	if offset.X != 10 || offset.Y != 10+2*labelHeight+labelHeight/2 {
+		t.Fatalf("unexpected map offset: %v", offset)
+	}
+	size := framed.Bounds().Size()
+	if size.X != 70 || size.Y != offset.Y+40+10 {
+		t.Fatalf("unexpected framed size: %v", size)
+	}
+	// Labels are drawn in the top margin
+	if !isDrawnAbove(framed, offset.Y) {
+		t.Fatalf("labels were not drawn")
+	}
+	// Latin-1 characters are not drawn like unsupported ones
+	missing := frameDensity(img, []string{"\u4e00"}, opts)
+	for _, label := range []string{"é", "ç", "Ô"} {
+		framed = frameDensity(img, []string{label}, opts)
+		if bytes.Equal(framed.Pix, missing.Pix) {
+			t.Fatalf("%q has no glyph", label)
+		}
+	}
+}
+
+// isDrawnAbove returns true if img has pixels differing from its top left
+// one above y.
+func isDrawnAbove(img *image.RGBA, y int) bool {
+	for j := 0; j < y; j++ {
+		for i := 0; i < img.Bounds().Dx(); i++ {
+			if img.RGBAAt(i, j) != img.RGBAAt(0, 0) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestWriteDensityPNG(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 20, 10))
+	buf := &bytes.Buffer{}
+	err := writeDensityPNG(buf, img, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	// pHYs follows the IHDR chunk
+	if len(data) < 49 || string(data[37:41]) != "pHYs" {
+		t.Fatalf("pHYs chunk is missing")
+	}
+	if ppm := binary.BigEndian.Uint32(data[41:]); ppm != 11811 {
+		t.Fatalf("unexpected resolution: %d pixels per meter", ppm)
+	}
+	decoded, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Bounds() != img.Bounds() {
+		t.Fatalf("unexpected bounds: %v", decoded.Bounds())
+	}
+	_, err = setPNGResolution([]byte("not a png"), 300)
+	if err == nil {
+		t.Fatalf("invalid PNG was accepted")
+	}
+}
+
+func TestParseDensityFrameOptions(t *testing.T) {
+	tests := []struct {
+		Query string
+		Key   string
+		Error bool
+	}{
+		{"margin=20&dpi=300&title=%20Jobs%20&caption=1", "-m20-dpi300", false},
+		{"margin=201", "", true},
+		{"margin=-1", "", true},
+		{"dpi=x", "", true},
+		{"dpi=1201", "", true},
+	}
+	for _, test := range tests {
+		values, err := url.ParseQuery(test.Query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts, err := parseDensityOptions(values)
+		if test.Error {
+			if err == nil {
+				t.Fatalf("%q: expected an error", test.Query)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %s", test.Query, err)
+		}
+		if key := opts.CacheKey(); key != test.Key {
+			t.Fatalf("%q: expected cache key %q, got %q", test.Query, test.Key, key)
+		}
+		if opts.Title != "Jobs" || !opts.Caption {
+			t.Fatalf("%q: unexpected labels: %+v", test.Query, opts)
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/jonas-p/go-shp"
+	"github.com/pmezard/apec/shpdraw"
+)
+
+// Offers matching a query are aggregated by department, see areas.go. The
+// statistics are served as JSON to the departments page, which renders them
+// as a sortable table, next to a choropleth map drawn from the departments
+// shapefile when it was fetched.
+
+const (
+	sortByOffers = "offers"
+	sortByName   = "name"
+	sortBySalary = "salary"
+	sortByChange = "change"
+)
+
+var departmentSorts = []string{sortByOffers, sortByName, sortBySalary,
+	sortByChange}
+
+type DepartmentStats struct {
+	Code string `json:"code,omitempty"`
+	Name string `json:"name"`
+	// Number of matching offers
+	Offers int `json:"offers"`
+	// Median of offers salary range middles in kEUR, zero if none has a
+	// salary
+	MedianSalary int `json:"median_salary"`
+	// Offers published during the last 7 days, and the 7 days before
+	LastWeek     int `json:"last_week"`
+	PreviousWeek int `json:"previous_week"`
+	// Percentage of change from PreviousWeek to LastWeek, nil if
+	// PreviousWeek is zero
+	Change *float64 `json:"change"`
+
+	salaries []int
+}
+
+// sortedDepartmentStats sorts departments by decreasing value of the "by"
+// criterion, or by name, then by name. Departments without salary or change
+// come last.
+type sortedDepartmentStats struct {
+	stats []*DepartmentStats
+	by    string
+}
+
+func (s *sortedDepartmentStats) Len() int {
+	return len(s.stats)
+}
+
+func (s *sortedDepartmentStats) Swap(i, j int) {
+	s.stats[i], s.stats[j] = s.stats[j], s.stats[i]
+}
+
+func (s *sortedDepartmentStats) Less(i, j int) bool {
+	a, b := s.stats[i], s.stats[j]
+	switch s.by {
+	case sortByOffers:
+		if a.Offers != b.Offers {
+			return a.Offers > b.Offers
+		}
+	case sortBySalary:
+		if a.MedianSalary != b.MedianSalary {
+			return a.MedianSalary > b.MedianSalary
+		}
+	case sortByChange:
+		if (a.Change == nil) != (b.Change == nil) {
+			return a.Change != nil
+		}
+		if a.Change != nil && *a.Change != *b.Change {
+			return *a.Change > *b.Change
+		}
+	}
+	return a.Name < b.Name
+}
+
+func sortDepartmentStats(stats []*DepartmentStats, by string) {
+	sort.Sort(&sortedDepartmentStats{stats: stats, by: by})
+}
+
+func medianInt(values []int) int {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]int{}, values...)
+	sort.Ints(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// listQueryIds returns the identifiers of offers matching query, or of all
+// offers if it is empty.
+func listQueryIds(store *Store, index bleve.Index, query string) ([]string, error) {
+	if query == "" {
+		return store.List()
+	}
+	q, err := makeSearchQuery(query, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return searchIds(index, q)
+}
+
+// collectDepartmentStats aggregates offers matching query by department,
+// sorted by decreasing number of offers. Weeks end at now.
+func collectDepartmentStats(store *Store, index bleve.Index, query string,
+	now time.Time) ([]*DepartmentStats, error) {
+
+	ids, err := listQueryIds(store, index, query)
+	if err != nil {
+		return nil, err
+	}
+	week := 7 * 24 * time.Hour
+	departments := map[string]*DepartmentStats{}
+	for _, id := range ids {
+		area, err := store.GetOfferArea(id)
+		if err != nil {
+			return nil, err
+		}
+		if area == nil || area.Department == "" {
+			continue
+		}
+		offer, err := getStoreOffer(store, id)
+		if err != nil {
+			return nil, err
+		}
+		if offer == nil {
+			continue
+		}
+		key := area.DepartmentCode
+		if key == "" {
+			key = normalizeAreaTerm(area.Department)
+		}
+		st := departments[key]
+		if st == nil {
+			st = &DepartmentStats{
+				Code: area.DepartmentCode,
+				Name: area.Department,
+			}
+			departments[key] = st
+		}
+		st.Offers++
+		if offer.MinSalary > 0 {
+			st.salaries = append(st.salaries, (offer.MinSalary+offer.MaxSalary)/2)
+		}
+		age := now.Sub(offer.Date)
+		if age >= 0 && age < week {
+			st.LastWeek++
+		} else if age >= week && age < 2*week {
+			st.PreviousWeek++
+		}
+	}
+	stats := []*DepartmentStats{}
+	for _, st := range departments {
+		st.MedianSalary = medianInt(st.salaries)
+		if st.PreviousWeek > 0 {
+			change := 100 * float64(st.LastWeek-st.PreviousWeek) /
+				float64(st.PreviousWeek)
+			st.Change = &change
+		}
+		stats = append(stats, st)
+	}
+	sortDepartmentStats(stats, sortByOffers)
+	return stats, nil
+}
+
+func parseDepartmentSort(values url.Values) (string, error) {
+	by := values.Get("sort")
+	if by == "" {
+		return sortByOffers, nil
+	}
+	for _, s := range departmentSorts {
+		if s == by {
+			return by, nil
+		}
+	}
+	return "", fmt.Errorf("unknown sort %q, expected one of %s", by,
+		strings.Join(departmentSorts, ", "))
+}
+
+// handleDepartmentStats writes the statistics of offers matching the "what"
+// parameter by department as JSON, sorted by the "sort" parameter.
+func handleDepartmentStats(store *Store, index bleve.Index,
+	w http.ResponseWriter, r *http.Request) error {
+
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		return err
+	}
+	what := strings.TrimSpace(values.Get("what"))
+	by, err := parseDepartmentSort(values)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	stats, err := collectDepartmentStats(store, index, what, now)
+	if err != nil {
+		return err
+	}
+	sortDepartmentStats(stats, by)
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(&struct {
+		What        string             `json:"what"`
+		Date        string             `json:"date"`
+		Sort        string             `json:"sort"`
+		Departments []*DepartmentStats `json:"departments"`
+	}{
+		What:        what,
+		Date:        now.Format("2006-01-02"),
+		Sort:        by,
+		Departments: stats,
+	})
+}
+
+// handleDepartments renders the departments page, listing the statistics
+// of offers matching the "what" parameter.
+func handleDepartments(templ *Templates, areas *Areas, w http.ResponseWriter,
+	r *http.Request) error {
+
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		return err
+	}
+	what := strings.TrimSpace(values.Get("what"))
+	data := struct {
+		What  string
+		Query string
+		Map   bool
+	}{
+		What:  what,
+		Query: url.Values{"what": {what}}.Encode(),
+		Map:   areas != nil && len(areas.Departments) > 0,
+	}
+	w.Header().Set("Content-Type", "text/html")
+	return templ.Departments.Execute(w, &data)
+}
+
+// drawChoropleth colors departments by their number of offers, within box,
+// and draws shapes borders over them.
+func drawChoropleth(stats []*DepartmentStats, areas *Areas, box shp.Box,
+	shapes []shp.Shape, size int) (*image.RGBA, error) {
+
+	counts := map[string]int{}
+	max := 0
+	for _, st := range stats {
+		counts[st.Code] += st.Offers
+		counts[normalizeAreaTerm(st.Name)] += st.Offers
+		if st.Offers > max {
+			max = st.Offers
+		}
+	}
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	for _, a := range areas.Departments {
+		n := counts[a.Code]
+		if n == 0 {
+			n = counts[normalizeAreaTerm(a.Name)]
+		}
+		v := 0.0
+		if max > 0 {
+			v = float64(n) / float64(max)
+		}
+		err := shpdraw.Fill(img, getColor(v), box, a.polygon)
+		if err != nil {
+			return nil, err
+		}
+	}
+	shapes = append([]shp.Shape{}, shapes...)
+	for _, a := range areas.Departments {
+		shapes = append(shapes, a.polygon)
+	}
+	err := drawShapes(box, shapes, img)
+	if err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// handleDepartmentsMap renders the choropleth of offers matching the "what"
+// parameter, "size" pixels wide.
+func handleDepartmentsMap(store *Store, index bleve.Index, areas *Areas,
+	box shp.Box, shapes []shp.Shape, w http.ResponseWriter,
+	r *http.Request) error {
+
+	if areas == nil || len(areas.Departments) == 0 {
+		return fmt.Errorf("departments shapefile is missing, run " +
+			"\"apec fetch-shapes departements\"")
+	}
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		return err
+	}
+	size := 500
+	if s := values.Get("size"); s != "" {
+		size, err = strconv.Atoi(s)
+		if err != nil || size <= 0 || size > 2000 {
+			return fmt.Errorf("invalid size: %q", s)
+		}
+	}
+	stats, err := collectDepartmentStats(store, index,
+		strings.TrimSpace(values.Get("what")), time.Now())
+	if err != nil {
+		return err
+	}
+	img, err := drawChoropleth(stats, areas, box, shapes, size)
+	if err != nil {
+		return err
+	}
+	buf := &bytes.Buffer{}
+	err = png.Encode(buf, img)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "image/png")
+	_, err = w.Write(buf.Bytes())
+	return err
+}
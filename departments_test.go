@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jonas-p/go-shp"
+)
+
+func formatDepartmentStats(stats []*DepartmentStats) string {
+	lines := []string{}
+	for _, st := range stats {
+		change := "-"
+		if st.Change != nil {
+			change = fmt.Sprintf("%.0f", *st.Change)
+		}
+		lines = append(lines, fmt.Sprintf("%s:%d:%d:%d:%d:%s", st.Name, st.Offers,
+			st.MedianSalary, st.LastWeek, st.PreviousWeek, change))
+	}
+	return strings.Join(lines, " ")
+}
+
+func TestDepartmentStats(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	for _, test := range []struct {
+		What     string
+		Now      string
+		Expected string
+	}{
+		{"", "2017-01-08", "Paris:2:45:2:0:- Gironde:1:0:1:0:- Rhône:1:55:1:0:-"},
+		{"", "2017-01-12", "Paris:2:45:0:2:-100 Gironde:1:0:1:0:- Rhône:1:55:0:1:-100"},
+		{"", "2017-03-01", "Paris:2:45:0:0:- Gironde:1:0:0:0:- Rhône:1:55:0:0:-"},
+		{"java", "2017-01-08", "Gironde:1:0:1:0:-"},
+		{"cobol", "2017-01-08", ""},
+	} {
+		now, err := time.Parse("2006-01-02", test.Now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats, err := collectDepartmentStats(env.Store, env.Index, test.What, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := formatDepartmentStats(stats)
+		if s != test.Expected {
+			t.Fatalf("%q at %s: expected\n%s\ngot\n%s", test.What, test.Now,
+				test.Expected, s)
+		}
+	}
+
+	stats, err := collectDepartmentStats(env.Store, env.Index, "",
+		time.Date(2017, 1, 12, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range [][2]string{
+		{sortByName, "Gironde Paris Rhône"},
+		{sortBySalary, "Rhône Paris Gironde"},
+		{sortByChange, "Paris Rhône Gironde"},
+		{sortByOffers, "Paris Gironde Rhône"},
+	} {
+		sortDepartmentStats(stats, test[0])
+		names := []string{}
+		for _, st := range stats {
+			names = append(names, st.Name)
+		}
+		if strings.Join(names, " ") != test[1] {
+			t.Fatalf("sort by %s: expected %s, got %v", test[0], test[1], names)
+		}
+	}
+
+	for _, test := range []struct {
+		Values []int
+		Median int
+	}{
+		{nil, 0},
+		{[]int{40}, 40},
+		{[]int{60, 40}, 50},
+		{[]int{60, 30, 40}, 40},
+	} {
+		if m := medianInt(test.Values); m != test.Median {
+			t.Fatalf("median of %v: expected %d, got %d", test.Values, test.Median, m)
+		}
+	}
+}
+
+func TestDepartmentStatsHandler(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	get := func(values url.Values) (int, string) {
+		rsp := env.Get(func(w http.ResponseWriter, r *http.Request) {
+			err := handleDepartmentStats(env.Store, env.Index, w, r)
+			if err != nil {
+				w.WriteHeader(400)
+				fmt.Fprintf(w, "error: %s\n", err)
+			}
+		}, "/api/stats/departments", values)
+		return rsp.Code, rsp.Body.String()
+	}
+	code, body := get(url.Values{"what": {"java"}, "sort": {"name"}})
+	if code != 200 {
+		t.Fatalf("unexpected status %d: %s", code, body)
+	}
+	result := struct {
+		What        string
+		Sort        string
+		Departments []*DepartmentStats
+	}{}
+	err := json.Unmarshal([]byte(body), &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.What != "java" || result.Sort != "name" ||
+		len(result.Departments) != 1 || result.Departments[0].Name != "Gironde" ||
+		result.Departments[0].Offers != 1 {
+		t.Fatalf("unexpected result: %s", body)
+	}
+	code, body = get(url.Values{"sort": {"population"}})
+	if code != 400 || !strings.Contains(body, "unknown sort") {
+		t.Fatalf("invalid sort was accepted: %d, %s", code, body)
+	}
+}
+
+func TestDrawChoropleth(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	dir, err := ioutil.TempDir("", "apec-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeAreasShapefile(t, filepath.Join(dir, "departements-20180101.shp"),
+		[][4]string{
+			{"75", "Paris", "48.85", "2.35"},
+			{"69", "Rhône", "45.75", "4.83"},
+			{"29", "Finistère", "42", "8"},
+		})
+	areas, err := LoadAreas(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := collectDepartmentStats(env.Store, env.Index, "", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	box := shp.Box{MinX: 0, MaxX: 10, MinY: 40, MaxY: 50}
+	img, err := drawChoropleth(stats, areas, box, nil, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		X, Y     int
+		Expected string
+	}{
+		{23, 11, fmt.Sprint(getColor(1))},   // Paris, 2 offers
+		{48, 42, fmt.Sprint(getColor(0.5))}, // Rhône, 1 offer
+		{80, 80, fmt.Sprint(getColor(0))},   // Finistère, no offer
+		{5, 95, "{0 0 0 0}"},
+	} {
+		c := fmt.Sprint(img.RGBAAt(test.X, test.Y))
+		if c != test.Expected {
+			t.Fatalf("%d,%d: expected %s, got %s", test.X, test.Y, test.Expected, c)
+		}
+	}
+
+	rsp := env.Get(func(w http.ResponseWriter, r *http.Request) {
+		err := handleDepartmentsMap(env.Store, env.Index, &Areas{}, box, nil, w, r)
+		if err == nil || !strings.Contains(err.Error(), "fetch-shapes") {
+			t.Fatalf("missing departments were not reported: %v", err)
+		}
+	}, "/departmentsmap", nil)
+	if rsp.Body.Len() != 0 {
+		t.Fatalf("unexpected map output: %d bytes", rsp.Body.Len())
+	}
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/jonas-p/go-shp"
+	"github.com/pmezard/apec/jstruct"
+	"github.com/pquerna/ffjson/ffjson"
+)
+
+// Weekly digests summarize offers matching a query over the 7 days ending
+// with a given day, as a standalone HTML page: the density thumbnail is
+// inlined, so it can be mailed or published as is.
+
+// DigestCompany counts an account offers published during the digest week
+// and the week before.
+type DigestCompany struct {
+	Account      string
+	Offers       int
+	PreviousWeek int
+}
+
+// sortedDigestCompanies sorts companies by decreasing number of offers, then
+// by increasing number of offers the week before, then account.
+type sortedDigestCompanies []*DigestCompany
+
+func (s sortedDigestCompanies) Len() int {
+	return len(s)
+}
+
+func (s sortedDigestCompanies) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s sortedDigestCompanies) Less(i, j int) bool {
+	if s[i].Offers != s[j].Offers {
+		return s[i].Offers > s[j].Offers
+	}
+	if s[i].PreviousWeek != s[j].PreviousWeek {
+		return s[i].PreviousWeek < s[j].PreviousWeek
+	}
+	return s[i].Account < s[j].Account
+}
+
+// sortedOffersByDate sorts offers by decreasing publication date, then id.
+type sortedOffersByDate []*Offer
+
+func (s sortedOffersByDate) Len() int {
+	return len(s)
+}
+
+func (s sortedOffersByDate) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s sortedOffersByDate) Less(i, j int) bool {
+	if !s[i].Date.Equal(s[j].Date) {
+		return s[i].Date.After(s[j].Date)
+	}
+	return s[i].Id < s[j].Id
+}
+
+type WeeklyDigest struct {
+	Query string
+	// Digest week is [Start, End)
+	Start time.Time
+	End   time.Time
+	// Offers published during the week. Reposted ones were first published
+	// before the week.
+	Published int
+	Reposted  int
+	Deleted   int
+	// Most recent new offers, and companies with the most published offers
+	Offers    []*Offer
+	Companies []*DigestCompany
+	Salaries  *SalaryReport
+	// Density thumbnail data URI, empty if not rendered
+	Map template.URL
+
+	ids []string
+}
+
+// countDeletedOffers returns the number of offers matching query deleted
+// during [start, end).
+func countDeletedOffers(store *Store, query string, start,
+	end time.Time) (int, error) {
+
+	ids, err := store.ListDeletedIds()
+	if err != nil {
+		return 0, err
+	}
+	offers := []*jstruct.JsonOffer{}
+	for _, id := range ids {
+		deleted, err := store.ListDeletedOffers(id)
+		if err != nil {
+			return 0, err
+		}
+		for _, do := range deleted {
+			date, err := time.Parse(time.RFC3339, do.Date)
+			if err != nil {
+				return 0, fmt.Errorf("cannot parse %s deletion date: %s", id, err)
+			}
+			if date.Before(start) || !date.Before(end) {
+				continue
+			}
+			data, err := store.GetDeleted(do.Id)
+			if err != nil {
+				return 0, err
+			}
+			js := &jstruct.JsonOffer{}
+			err = ffjson.Unmarshal(data, js)
+			if err != nil {
+				return 0, err
+			}
+			offers = append(offers, js)
+		}
+	}
+	if query == "" || len(offers) == 0 {
+		return len(offers), nil
+	}
+	q, err := makeSearchQuery(query, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	index, err := newMemOfferIndex(offers)
+	if err != nil {
+		return 0, err
+	}
+	defer index.Close()
+	matched, err := searchIds(index, q)
+	return len(matched), err
+}
+
+// collectDigest summarizes offers matching query for the week ending at end,
+// listing at most maxOffers new offers and maxCompanies companies.
+func collectDigest(store *Store, index bleve.Index, areas *Areas, query string,
+	end time.Time, maxOffers, maxCompanies int) (*WeeklyDigest, error) {
+
+	week := 7 * 24 * time.Hour
+	digest := &WeeklyDigest{
+		Query:  query,
+		Start:  end.Add(-week),
+		End:    end,
+		Offers: []*Offer{},
+	}
+	ids, err := listQueryIds(store, index, query)
+	if err != nil {
+		return nil, err
+	}
+	companies := map[string]*DigestCompany{}
+	company := func(account string) *DigestCompany {
+		c := companies[account]
+		if c == nil {
+			c = &DigestCompany{Account: account}
+			companies[account] = c
+		}
+		return c
+	}
+	for _, id := range ids {
+		offer, err := getStoreOffer(store, id)
+		if err != nil {
+			return nil, err
+		}
+		if offer == nil || !offer.Date.Before(end) {
+			continue
+		}
+		if offer.Date.Before(digest.Start) {
+			if !offer.Date.Before(digest.Start.Add(-week)) {
+				company(offer.Account).PreviousWeek++
+			}
+			continue
+		}
+		digest.Published++
+		digest.ids = append(digest.ids, id)
+		company(offer.Account).Offers++
+		initial, err := store.GetInitialDate(id)
+		if err != nil {
+			return nil, err
+		}
+		if !initial.IsZero() && initial.Before(digest.Start) {
+			digest.Reposted++
+			continue
+		}
+		digest.Offers = append(digest.Offers, offer)
+	}
+	sort.Sort(sortedOffersByDate(digest.Offers))
+	if len(digest.Offers) > maxOffers {
+		digest.Offers = digest.Offers[:maxOffers]
+	}
+	digest.Companies = []*DigestCompany{}
+	for _, c := range companies {
+		if c.Offers > 0 {
+			digest.Companies = append(digest.Companies, c)
+		}
+	}
+	sort.Sort(sortedDigestCompanies(digest.Companies))
+	if len(digest.Companies) > maxCompanies {
+		digest.Companies = digest.Companies[:maxCompanies]
+	}
+	digest.Deleted, err = countDeletedOffers(store, query, digest.Start, end)
+	if err != nil {
+		return nil, err
+	}
+	digest.Salaries, err = summarizeRegionSalaries(store, areas, query,
+		digest.ids)
+	if err != nil {
+		return nil, err
+	}
+	return digest, nil
+}
+
+// drawDigestMap renders the density of digest offers as a PNG data URI.
+func drawDigestMap(store *Store, digest *WeeklyDigest, box shp.Box,
+	shapes []shp.Shape, size int) (template.URL, error) {
+
+	points := []MapPoint{}
+	for _, id := range digest.ids {
+		loc, _, err := store.GetLocation(id)
+		if err != nil {
+			return "", err
+		}
+		if loc == nil || loc.Nationwide {
+			continue
+		}
+		points = append(points, MapPoint{
+			Point:  Point{Lat: loc.Lat, Lon: loc.Lon},
+			Weight: 1,
+		})
+	}
+	grid := makeMapGrid(points, box, size, size)
+	grid = convolveGrid(grid)
+	img := drawDensity(grid, defaultDensityOptions())
+	err := drawShapes(box, shapes, img)
+	if err != nil {
+		return "", err
+	}
+	buf := &bytes.Buffer{}
+	err = png.Encode(buf, img)
+	if err != nil {
+		return "", err
+	}
+	return template.URL("data:image/png;base64," +
+		base64.StdEncoding.EncodeToString(buf.Bytes())), nil
+}
+
+// loadDigestTemplate parses the digest template, from dir if it overrides
+// it.
+func loadDigestTemplate(dir string) (*template.Template, error) {
+	path, err := templatePath(dir, "digest.tmpl")
+	if err != nil {
+		return nil, err
+	}
+	return template.New("digest.tmpl").Funcs(template.FuncMap{
+		"day": func(t time.Time) string {
+			return t.Format("2006-01-02")
+		},
+	}).ParseFiles(path)
+}
+
+func writeDigest(w io.Writer, templ *template.Template,
+	digest *WeeklyDigest) error {
+
+	// The week ends at midnight, display its last day
+	data := struct {
+		*WeeklyDigest
+		Last time.Time
+	}{
+		WeeklyDigest: digest,
+		Last:         digest.End.Add(-24 * time.Hour),
+	}
+	return templ.Execute(w, &data)
+}
+
+var (
+	reportDigestCmd = reportCmd.Command("digest", `summarize a week of offers as HTML
+
+The digest covers the 7 days ending with --date: new and reposted offers,
+deletions, companies publishing the most offers, salaries by region and a
+density thumbnail. The page is self-contained.
+`)
+	reportDigestQuery = reportDigestCmd.Flag("query", "search query").String()
+	reportDigestOut   = reportDigestCmd.Flag("out", "output HTML file").
+				Required().String()
+	reportDigestDate = reportDigestCmd.Flag("date",
+		"last day of the week (YYYY-MM-DD), defaults to today").String()
+	reportDigestOffers = reportDigestCmd.Flag("offers",
+		"number of new offers listed").Default("20").Int()
+	reportDigestCompanies = reportDigestCmd.Flag("companies",
+		"number of companies listed").Default("10").Int()
+	reportDigestSize = reportDigestCmd.Flag("size",
+		"density thumbnail size in pixels, 0 to disable").Default("300").Int()
+)
+
+func reportDigestFn(cfg *Config) error {
+	day := time.Now()
+	if *reportDigestDate != "" {
+		d, err := parseDay(*reportDigestDate)
+		if err != nil {
+			return err
+		}
+		day = d
+	}
+	y, m, d := day.Date()
+	end := time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Add(24 * time.Hour)
+	if *reportDigestSize < 0 || *reportDigestSize > 2000 {
+		return fmt.Errorf("invalid thumbnail size: %d", *reportDigestSize)
+	}
+	templ, err := loadDigestTemplate(cfg.TemplatesDir)
+	if err != nil {
+		return err
+	}
+	areas, err := LoadAreas(cfg.ShapesDir)
+	if err != nil {
+		return err
+	}
+	store, err := OpenStore(cfg.Store())
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	var index bleve.Index
+	if *reportDigestQuery != "" {
+		index, err = OpenOfferIndex(cfg.Index())
+		if err != nil {
+			return err
+		}
+		defer index.Close()
+	}
+	digest, err := collectDigest(store, index, areas, *reportDigestQuery, end,
+		*reportDigestOffers, *reportDigestCompanies)
+	if err != nil {
+		return err
+	}
+	if *reportDigestSize > 0 {
+		box := makeFranceBox()
+		shapes, err := loadBorders(cfg, box)
+		if err != nil {
+			return err
+		}
+		digest.Map, err = drawDigestMap(store, digest, box, shapes,
+			*reportDigestSize)
+		if err != nil {
+			return err
+		}
+	}
+	buf := &bytes.Buffer{}
+	err = writeDigest(buf, templ, digest)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(*reportDigestOut, buf.Bytes(), 0644)
+}
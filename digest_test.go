@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWeeklyDigest(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	// Lyon offer was first published the week before
+	js, err := getStoreJsonOffer(env.Store, "apec:1003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reposted := *js
+	reposted.Id = "1008"
+	reposted.Date = "2016-12-28T10:00:00.000+0000"
+	data, err := json.Marshal(&reposted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = env.Store.Put("apec:1008", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = env.Store.Delete("apec:1005", time.Date(2017, 1, 6, 12, 0, 0, 0,
+		time.FixedZone("CET", 3600)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Reindex()
+	err = rebuildInitialDates(env.Store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	end := time.Date(2017, 1, 8, 0, 0, 0, 0, time.UTC)
+	digest, err := collectDigest(env.Store, env.Index, nil, "", end, 3, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest.Published != 5 || digest.Reposted != 1 || digest.Deleted != 1 {
+		t.Fatalf("unexpected counts: %d published, %d reposted, %d deleted",
+			digest.Published, digest.Reposted, digest.Deleted)
+	}
+	ids := []string{}
+	for _, o := range digest.Offers {
+		ids = append(ids, o.Id)
+	}
+	if fmt.Sprint(ids) != "[apec:1006 apec:1004 apec:1002]" {
+		t.Fatalf("unexpected new offers: %v", ids)
+	}
+	companies := []string{}
+	for _, c := range digest.Companies {
+		companies = append(companies, fmt.Sprintf("%s:%d:%d", c.Account, c.Offers,
+			c.PreviousWeek))
+	}
+	if fmt.Sprint(companies) != "[Initech:2:0 ACME:1:0 Umbrella:1:0 Globex:1:1]" {
+		t.Fatalf("unexpected companies: %v", companies)
+	}
+	if digest.Salaries.All.Offers != 5 || digest.Salaries.All.Median != 50 {
+		t.Fatalf("unexpected salaries: %+v", digest.Salaries.All)
+	}
+
+	digest.Map, err = drawDigestMap(env.Store, digest, makeFranceBox(), nil, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	templ, err := loadDigestTemplate("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	err = writeDigest(buf, templ, digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"Offers digest, 2017-01-01 to 2017-01-07",
+		"5 offers published, 1 of them reposted,\n\t1 offers deleted.",
+		`<img src="data:image/png;base64,`,
+		"Développeur Python H/F</a>, Initech, Paris, 40k€",
+		"<td>Ile-de-France</td><td class=\"n\">2</td>",
+	} {
+		if !strings.Contains(buf.String(), s) {
+			t.Fatalf("%q is missing from digest:\n%s", s, buf.String())
+		}
+	}
+
+	// Queries apply to deletions too
+	for _, test := range []struct {
+		Query     string
+		Published int
+		Deleted   int
+	}{
+		{"python", 4, 0},
+		{"architecte", 0, 1},
+	} {
+		digest, err = collectDigest(env.Store, env.Index, nil, test.Query, end, 3, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if digest.Published != test.Published || digest.Deleted != test.Deleted {
+			t.Fatalf("%s: unexpected counts: %d published, %d deleted", test.Query,
+				digest.Published, digest.Deleted)
+		}
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+const (
+	doctorOK      = "ok"
+	doctorWarning = "warning"
+	doctorError   = "error"
+
+	// Free space below which indexing and crawling may fail
+	minFreeDiskMB = 1024
+	// Holders of bolt databases locks are waited for this long
+	doctorLockTimeout = time.Second
+)
+
+// DoctorCheck is the outcome of an environment check, with an actionable fix
+// when it failed.
+type DoctorCheck struct {
+	Name   string
+	Status string
+	Detail string
+	Fix    string
+}
+
+func checkOK(name, detail string) *DoctorCheck {
+	return &DoctorCheck{
+		Name:   name,
+		Status: doctorOK,
+		Detail: detail,
+	}
+}
+
+func checkFailed(name, status, fix, format string, args ...interface{}) *DoctorCheck {
+	return &DoctorCheck{
+		Name:   name,
+		Status: status,
+		Detail: fmt.Sprintf(format, args...),
+		Fix:    fix,
+	}
+}
+
+func checkDataDir(dir string) *DoctorCheck {
+	name := "data directory"
+	st, err := os.Stat(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return checkFailed(name, doctorError,
+				"run \"apec crawl\" to create it, or pass --data=DIR",
+				"%s does not exist", dir)
+		}
+		return checkFailed(name, doctorError, "check the directory permissions",
+			"%s", err)
+	}
+	if !st.IsDir() {
+		return checkFailed(name, doctorError, "pass --data=DIR with a directory",
+			"%s is not a directory", dir)
+	}
+	fp, err := ioutil.TempFile(dir, "doctor")
+	if err != nil {
+		return checkFailed(name, doctorError,
+			fmt.Sprintf("make it writable with \"chmod u+w %s\"", dir),
+			"%s is not writable: %s", dir, err)
+	}
+	fp.Close()
+	os.Remove(fp.Name())
+	return checkOK(name, dir)
+}
+
+// openLockedBolt opens the bolt database at path for reading, and reports
+// missing, unreadable or locked databases as failed checks.
+func openLockedBolt(name, path, missingFix string) (*bolt.DB, *DoctorCheck) {
+	ok, err := isFile(path)
+	if err != nil {
+		return nil, checkFailed(name, doctorError, "check the file permissions",
+			"%s", err)
+	}
+	if !ok {
+		return nil, checkFailed(name, doctorWarning, missingFix, "%s does not exist",
+			path)
+	}
+	fp, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, checkFailed(name, doctorError,
+			fmt.Sprintf("make it writable with \"chmod u+rw %s\"", path),
+			"%s", err)
+	}
+	fp.Close()
+	db, err := bolt.Open(path, 0444, &bolt.Options{
+		ReadOnly: true,
+		Timeout:  doctorLockTimeout,
+	})
+	if err != nil {
+		if err == bolt.ErrTimeout {
+			return nil, checkFailed(name, doctorWarning,
+				"stop \"apec web\" or \"apec worker\" before running commands "+
+					"on the data directory, or use --server",
+				"%s is locked by another process", path)
+		}
+		return nil, checkFailed(name, doctorError,
+			"restore it from a backup or a replica", "cannot open %s: %s", path, err)
+	}
+	return db, nil
+}
+
+func checkStore(path string) *DoctorCheck {
+	name := "store"
+	backend, err := detectBackend(path)
+	if err != nil {
+		return checkFailed(name, doctorError, "check the file permissions",
+			"%s", err)
+	}
+	var store *Store
+	if backend == sqliteBackend {
+		// SQLite stores are not locked by writers
+		db, err := openSQLite(path, true)
+		if err != nil {
+			return checkFailed(name, doctorError,
+				"restore it from a backup or a replica", "cannot open %s: %s",
+				path, err)
+		}
+		store = &Store{db: db}
+	} else {
+		db, failed := openLockedBolt(name, path, "run \"apec crawl\" to create it")
+		if failed != nil {
+			return failed
+		}
+		store = &Store{db: boltDB{db}}
+	}
+	defer store.Close()
+	version, err := store.Version()
+	if err != nil {
+		return checkFailed(name, doctorError, "restore it from a backup",
+			"cannot read version: %s", err)
+	}
+	if version != storeVersion {
+		return checkFailed(name, doctorError, "run \"apec upgrade\"",
+			"version %d, expected %d", version, storeVersion)
+	}
+	return checkOK(name, fmt.Sprintf("version %d, %d offers", version, store.Size()))
+}
+
+func checkGeocoderCache(path string) *DoctorCheck {
+	name := "geocoder cache"
+	db, failed := openLockedBolt(name, path,
+		"run \"apec geocode\" to create it")
+	if failed != nil {
+		return failed
+	}
+	defer db.Close()
+	cache := &Cache{db: db}
+	version, err := cache.Version()
+	if err != nil {
+		return checkFailed(name, doctorError, "remove it, locations will be "+
+			"geocoded again", "cannot read version: %s", err)
+	}
+	if version != geocoderVersion {
+		return checkFailed(name, doctorError, "run \"apec upgrade\"",
+			"version %d, expected %d", version, geocoderVersion)
+	}
+	return checkOK(name, fmt.Sprintf("version %d", version))
+}
+
+func checkIndex(path string) *DoctorCheck {
+	name := "index"
+	// The index is a bolt database under the hood, check its lock first,
+	// bleve would wait forever.
+	db, failed := openLockedBolt(name, filepath.Join(path, "store"),
+		"run \"apec index\" to build it")
+	if failed != nil {
+		return failed
+	}
+	db.Close()
+	index, err := OpenOfferIndexReadOnly(path)
+	if err != nil {
+		return checkFailed(name, doctorError, "rebuild it with \"apec index\"",
+			"cannot open %s: %s", path, err)
+	}
+	defer index.Close()
+	version, err := getIndexSchemaVersion(index)
+	if err != nil {
+		return checkFailed(name, doctorError, "rebuild it with \"apec index\"",
+			"%s", err)
+	}
+	if version != indexSchemaVersion {
+		return checkFailed(name, doctorWarning, "rebuild it with \"apec index\" "+
+			"or POST /admin/reindex", "schema version %d, expected %d", version,
+			indexSchemaVersion)
+	}
+	count, err := index.DocCount()
+	if err != nil {
+		return checkFailed(name, doctorError, "rebuild it with \"apec index\"",
+			"%s", err)
+	}
+	return checkOK(name, fmt.Sprintf("schema version %d, %d documents", version,
+		count))
+}
+
+func checkDiskSpace(dir string) *DoctorCheck {
+	name := "disk space"
+	free, err := freeDiskSpace(dir)
+	if err != nil {
+		return checkFailed(name, doctorWarning, "", "cannot get free space: %s", err)
+	}
+	mb := free / (1024 * 1024)
+	if mb < minFreeDiskMB {
+		return checkFailed(name, doctorWarning, "free some space, indexing "+
+			"rewrites the whole index", "%dMB available", mb)
+	}
+	return checkOK(name, fmt.Sprintf("%dMB available", mb))
+}
+
+func checkSearchConfig(path string) *DoctorCheck {
+	name := "search configuration"
+	_, err := loadSearchConfig(path)
+	if err != nil {
+		return checkFailed(name, doctorError, "fix or remove "+path, "%s", err)
+	}
+	return checkOK(name, path)
+}
+
+// checkGeocodingKey issues a single geocoding call with key, unless offline.
+func checkGeocodingKey(key string, offline bool) *DoctorCheck {
+	name := "geocoding key"
+	if key == "" {
+		return checkFailed(name, doctorWarning, "get a key from "+
+			"https://geocoder.opencagedata.com/ and set APEC_GEOCODING_KEY",
+			"APEC_GEOCODING_KEY is not set, offers cannot be geocoded")
+	}
+	if offline {
+		return checkOK(name, "set, not checked")
+	}
+	g := &Geocoder{key: key}
+	r, err := g.rawGeocode("Paris", "fr")
+	if err != nil {
+		return geocodingFailed(name, err)
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(r, 1024*1024))
+	if err != nil {
+		return checkFailed(name, doctorError, "check network access", "%s", err)
+	}
+	loc, err := parseGeocoding(data)
+	if err != nil {
+		return geocodingFailed(name, err)
+	}
+	if loc.Rate.Limit == 0 {
+		return checkOK(name, "valid, no quota")
+	}
+	return checkOK(name, fmt.Sprintf("valid, quota %d/%d", loc.Rate.Remaining,
+		loc.Rate.Limit))
+}
+
+// geocodingFailed reports a geocoding error with a hint depending on its
+// category.
+func geocodingFailed(name string, err error) *DoctorCheck {
+	if err == QuotaError {
+		return checkFailed(name, doctorWarning, "wait for the quota reset",
+			"geocoding quota is exhausted")
+	}
+	if err == KeyError {
+		return checkFailed(name, doctorError, "check APEC_GEOCODING_KEY",
+			"%s", err)
+	}
+	if _, ok := err.(*OutageError); ok {
+		return checkFailed(name, doctorWarning, "retry later", "%s", err)
+	}
+	return checkFailed(name, doctorError, "", "%s", err)
+}
+
+// checkStations verifies the transit stations file, which is optional.
+func checkStations(path string) *DoctorCheck {
+	name := "stations"
+	ok, err := isFile(path)
+	if err != nil {
+		return checkFailed(name, doctorError, "check the file permissions",
+			"%s", err)
+	}
+	if !ok {
+		return checkFailed(name, doctorWarning, "run apec from its source "+
+			"directory to score offers transit access", "%s not found", path)
+	}
+	return checkOK(name, path)
+}
+
+// checkShapes verifies the border shapefiles drawn on density maps.
+func checkShapes(dir, borders string) *DoctorCheck {
+	name := "shapefiles"
+	s, err := findShapeSource(borders)
+	if err != nil {
+		return checkFailed(name, doctorError, "", "%s", err)
+	}
+	err = verifyShapes(dir, s)
+	if err != nil {
+		return checkFailed(name, doctorError, fmt.Sprintf(
+			"run \"apec fetch-shapes --force %s\"", s.Name), "%s", err)
+	}
+	return checkOK(name, s.Path(dir, ".shp"))
+}
+
+func checkTemplates(dir string) *DoctorCheck {
+	name := "templates"
+	_, err := loadTemplates(dir)
+	if err != nil {
+		return checkFailed(name, doctorError, "run apec from its source "+
+			"directory and check --templates", "%s", err)
+	}
+	if dir != "" {
+		return checkOK(name, filepath.Join(dir, "*.tmpl")+", web/*.tmpl")
+	}
+	return checkOK(name, "web/*.tmpl")
+}
+
+// runDoctor checks the data directory of cfg and the files apec needs to
+// run. The geocoding key is not checked if offline.
+func runDoctor(cfg *Config, offline bool) []*DoctorCheck {
+	checks := []*DoctorCheck{checkDataDir(cfg.RootDir)}
+	if checks[0].Status != doctorOK {
+		// Everything else would fail with the same cause
+		return checks
+	}
+	checks = append(checks,
+		checkStore(cfg.Store()),
+		checkGeocoderCache(cfg.Geocoder()),
+		checkIndex(cfg.Index()),
+		checkSearchConfig(cfg.Search()),
+		checkDiskSpace(cfg.RootDir),
+		checkGeocodingKey(cfg.GeocodingKey(), offline),
+		checkShapes(cfg.ShapesDir, cfg.Borders),
+		checkStations(defaultStationsPath),
+		checkTemplates(cfg.TemplatesDir),
+	)
+	return checks
+}
+
+func printDoctorChecks(w io.Writer, checks []*DoctorCheck) int {
+	failed := 0
+	for _, c := range checks {
+		fmt.Fprintf(w, "%-8s %s: %s\n", c.Status, c.Name, c.Detail)
+		if c.Fix != "" {
+			fmt.Fprintf(w, "         fix: %s\n", c.Fix)
+		}
+		if c.Status == doctorError {
+			failed++
+		}
+	}
+	return failed
+}
+
+var (
+	doctorCmd = app.Command("doctor", `diagnose the data directory and environment
+
+Checks the data directory layout and permissions, store, geocoder cache and
+index versions and locks, disk space, geocoding key, and files read from the
+working directory, then suggests fixes. Checking the geocoding key consumes
+one geocoding call.
+`)
+	doctorOffline = doctorCmd.Flag("offline", "do not check the geocoding key online").
+			Bool()
+)
+
+func doctorFn(cfg *Config) error {
+	failed := printDoctorChecks(os.Stdout, runDoctor(cfg, *doctorOffline))
+	if failed > 0 {
+		return fmt.Errorf("%d checks failed", failed)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func findCheck(t *testing.T, checks []*DoctorCheck, name string) *DoctorCheck {
+	for _, c := range checks {
+		if c.Name == name {
+			return c
+		}
+	}
+	t.Fatalf("check not found: %s", name)
+	return nil
+}
+
+func TestDoctor(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	checks := runDoctor(env.Config, true)
+	c := findCheck(t, checks, "store")
+	if c.Status != doctorWarning || !strings.Contains(c.Detail, "locked") {
+		t.Fatalf("locked store not reported: %+v", c)
+	}
+
+	env.Store.Close()
+	env.Store = nil
+	env.Geocoder.Close()
+	env.Geocoder = nil
+	env.Index.Close()
+	env.Index = nil
+	checks = runDoctor(env.Config, true)
+	for _, name := range []string{"data directory", "store", "geocoder cache",
+		"index", "search configuration", "shapefiles", "stations", "templates"} {
+		c := findCheck(t, checks, name)
+		if c.Status != doctorOK {
+			t.Fatalf("unexpected failed check: %+v", c)
+		}
+	}
+	c = findCheck(t, checks, "geocoding key")
+	if c.Status != doctorWarning || !strings.Contains(c.Fix, "APEC_GEOCODING_KEY") {
+		t.Fatalf("missing geocoding key not reported: %+v", c)
+	}
+
+	err := os.RemoveAll(env.Config.Index())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := OpenStore(env.Config.Store())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.SetVersion(storeVersion - 1)
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checks = runDoctor(env.Config, true)
+	buf := &bytes.Buffer{}
+	failed := printDoctorChecks(buf, checks)
+	output := buf.String()
+	if failed != 1 ||
+		!strings.Contains(output, "error    store: version 3, expected 4\n"+
+			"         fix: run \"apec upgrade\"\n") ||
+		!strings.Contains(output, "warning  index: "+
+			filepath.Join(env.Config.Index(), "store")+" does not exist\n") {
+		t.Fatalf("unexpected report, %d failed:\n%s", failed, output)
+	}
+
+	c = checkStations(filepath.Join(env.Config.RootDir, "stops.txt"))
+	if c.Status != doctorWarning {
+		t.Fatalf("missing stations should only warn: %+v", c)
+	}
+
+	checks = runDoctor(NewConfig(filepath.Join(env.Config.RootDir, "missing")), true)
+	if len(checks) != 1 || checks[0].Status != doctorError {
+		t.Fatalf("missing data directory not reported: %+v", checks)
+	}
+}
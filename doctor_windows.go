@@ -0,0 +1,9 @@
+package main
+
+import (
+	"fmt"
+)
+
+func freeDiskSpace(path string) (uint64, error) {
+	return 0, fmt.Errorf("not supported on windows")
+}
@@ -2,20 +2,29 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"hash"
 	"io"
+	"net/http"
 	"os"
-	"regexp"
+	"path/filepath"
 	"sort"
 	"strings"
 	"time"
 
 	"github.com/blevesearch/bleve"
-	"github.com/blevesearch/bleve/analysis/tokenizer/exception"
-	"github.com/blevesearch/bleve/analysis/tokenizer/unicode"
+	"github.com/blevesearch/bleve/analysis"
+	"github.com/blevesearch/bleve/analysis/analyzer/custom"
+	"github.com/blevesearch/bleve/mapping"
 	"github.com/blevesearch/bleve/search/query"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pmezard/apec/blevext"
 	"github.com/pmezard/apec/jstruct"
+	"github.com/pquerna/ffjson/ffjson"
 )
 
 var (
@@ -45,11 +54,17 @@ func dumpDeletedOffersFn(cfg *Config) error {
 	return nil
 }
 
-func printChanges(w io.Writer, store *Store, reverse bool) error {
-	changes := map[string]struct {
-		Added   int
-		Removed int
-	}{}
+// DayChanges counts offers published and deleted on a day.
+type DayChanges struct {
+	Date    string `json:"date"`
+	Added   int    `json:"added"`
+	Removed int    `json:"removed"`
+}
+
+// printChanges prints offers changes per day in format, in ascending date
+// order unless reverse is true.
+func printChanges(w io.Writer, store *Store, reverse bool, format string) error {
+	changes := map[string]DayChanges{}
 
 	// Collect publication dates (not really additions but...)
 	ids, err := store.List()
@@ -102,9 +117,14 @@ func printChanges(w io.Writer, store *Store, reverse bool) error {
 		}
 	}
 
+	out := NewOutputWriter(w, format)
 	for _, d := range dates {
 		ch := changes[d]
-		fmt.Fprintf(w, "%s: +%d, -%d offers\n", d, ch.Added, ch.Removed)
+		ch.Date = d
+		err := out.Write(&ch, "%s: +%d, -%d offers\n", d, ch.Added, ch.Removed)
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -114,46 +134,179 @@ var (
 )
 
 func changesFn(cfg *Config) error {
+	if *serverURL != "" {
+		client, err := NewRemoteClient(*serverURL, cfg.SessionToken())
+		if err != nil {
+			return err
+		}
+		return client.Changes(os.Stdout, *outputFormat)
+	}
 	store, err := OpenStore(cfg.Store())
 	if err != nil {
 		return err
 	}
-	return printChanges(os.Stdout, store, false)
+	return printChanges(os.Stdout, store, false, *outputFormat)
 }
 
 var (
-	debugQueryCmd   = app.Command("debugquery", "debug bleve queries")
+	debugQueryCmd = app.Command("debugquery", `debug bleve queries
+
+Print a JSON report with the parsed query expression, the bleve query it
+generates and the tokens extracted from every query term by searched fields
+analyzers.
+`)
 	debugQueryQuery = debugQueryCmd.Arg("query", "query to debug").Required().String()
 )
 
+type AnalyzedToken struct {
+	Term     string `json:"term"`
+	Position int    `json:"position"`
+}
+
+// TermAnalysis lists the tokens of a query term, as analyzed for one field.
+type TermAnalysis struct {
+	Text     string          `json:"text"`
+	Field    string          `json:"field"`
+	Analyzer string          `json:"analyzer"`
+	Tokens   []AnalyzedToken `json:"tokens"`
+}
+
+type QueryReport struct {
+	Query string          `json:"query"`
+	AST   *blevext.Node   `json:"ast"`
+	Bleve json.RawMessage `json:"bleve"`
+	Terms []TermAnalysis  `json:"terms"`
+}
+
+// makeQueryReport describes how input is parsed, converted into a bleve query
+// and analyzed for each of fields, defaultSearchFields if nil.
+func makeQueryReport(m mapping.IndexMapping, input string,
+	fields []SearchField) (*QueryReport, error) {
+
+	if len(fields) == 0 {
+		fields = defaultSearchFields
+	}
+	ast, err := blevext.Parse(input)
+	if err != nil {
+		return nil, err
+	}
+	q, err := makeSearchQuery(input, nil, fields)
+	if err != nil {
+		return nil, err
+	}
+	dump, err := query.DumpQuery(m, q)
+	if err != nil {
+		return nil, err
+	}
+	report := &QueryReport{
+		Query: input,
+		AST:   ast,
+		Bleve: json.RawMessage(dump),
+		Terms: []TermAnalysis{},
+	}
+	var walk func(n *blevext.Node)
+	walk = func(n *blevext.Node) {
+		if n == nil {
+			return
+		}
+		if n.Kind != blevext.NodeString && n.Kind != blevext.NodePhrase &&
+			n.Kind != blevext.NodeExact {
+			for _, child := range n.Children {
+				walk(child)
+			}
+			return
+		}
+		for _, f := range fields {
+			field := f.Name
+			if n.Kind == blevext.NodeExact {
+				field = exactField(field)
+			}
+			name := m.AnalyzerNameForPath(field)
+			analysis := TermAnalysis{
+				Text:     n.Value,
+				Field:    field,
+				Analyzer: name,
+				Tokens:   []AnalyzedToken{},
+			}
+			analyzer := m.AnalyzerNamed(name)
+			if analyzer != nil {
+				for _, token := range analyzer.Analyze([]byte(n.Value)) {
+					analysis.Tokens = append(analysis.Tokens, AnalyzedToken{
+						Term:     string(token.Term),
+						Position: token.Position,
+					})
+				}
+			}
+			report.Terms = append(report.Terms, analysis)
+		}
+	}
+	walk(ast)
+	return report, nil
+}
+
 func debugQueryFn(cfg *Config) error {
 	index, err := bleve.Open(cfg.Index())
 	if err != nil {
 		return err
 	}
 	defer index.Close()
-	q, err := makeSearchQuery(*debugQueryQuery, nil)
+	searchCfg, err := loadSearchConfig(cfg.Search())
+	if err != nil {
+		return err
+	}
+	report, err := makeQueryReport(index.Mapping(), *debugQueryQuery,
+		searchCfg.Fields)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
 	if err != nil {
 		return err
 	}
-	s, err := query.DumpQuery(index.Mapping(), q)
-	fmt.Println(s)
+	_, err = os.Stdout.Write(append(data, '\n'))
 	return err
 }
 
 var (
-	analyzeCmd = app.Command("analyze", "process input with bleve analyzer")
-	analyzeArg = analyzeCmd.Arg("text", "text to analyze").Required().String()
+	analyzeCmd = app.Command("analyze", `process input with bleve analyzer
+
+Analyzers are the ones of the index mapping: "fr" for offer titles, "fr_html"
+for offer descriptions, their unstemmed "fr_exact" and "fr_html_exact"
+variants, or "raw" for the tokenizer alone, without stemming and stop words
+removal.
+`)
+	analyzeArg      = analyzeCmd.Arg("text", "text to analyze").Required().String()
+	analyzeAnalyzer = analyzeCmd.Flag("analyzer", "analyzer name").
+			Default("fr").Enum("fr", "fr_html", "fr_exact", "fr_html_exact", "raw")
 )
 
+// analyzeText runs text through the named analyzer of the offer mapping.
+func analyzeText(name, text string) (analysis.TokenStream, error) {
+	m, err := NewOfferMapping()
+	if err != nil {
+		return nil, err
+	}
+	if name == "raw" {
+		err = m.AddCustomAnalyzer(name, map[string]interface{}{
+			"type":      custom.Name,
+			"tokenizer": apecTokenizer,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	analyzer := m.AnalyzerNamed(name)
+	if analyzer == nil {
+		return nil, fmt.Errorf("unknown analyzer: %s", name)
+	}
+	return analyzer.Analyze([]byte(text)), nil
+}
+
 func analyzeFn(cfg *Config) error {
-	reExc, err := regexp.Compile(`(?i)c\+\+`)
+	tokens, err := analyzeText(*analyzeAnalyzer, *analyzeArg)
 	if err != nil {
 		return err
 	}
-	uni := unicode.NewUnicodeTokenizer()
-	tokenizer := exception.NewExceptionsTokenizer(reExc, uni)
-	tokens := tokenizer.Tokenize([]byte(*analyzeArg))
 	for _, t := range tokens {
 		fmt.Println(t)
 	}
@@ -166,43 +319,105 @@ var (
 			Default("true").Bool()
 )
 
-func geocodedFn(cfg *Config) error {
-	store, err := OpenStore(cfg.Store())
-	if err != nil {
-		return err
-	}
-	defer store.Close()
+// GeocodedOffer is an offer location and its geocoding result, nil if
+// unknown.
+type GeocodedOffer struct {
+	Id       string    `json:"id"`
+	Place    string    `json:"place"`
+	Location *Location `json:"location,omitempty"`
+}
 
+func listGeocoded(store *Store) ([]*GeocodedOffer, error) {
 	ids, err := store.List()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	geocoded := []*GeocodedOffer{}
 	for _, id := range ids {
 		offer, err := getStoreJsonOffer(store, id)
+		if err != nil {
+			return nil, err
+		}
+		loc, _, err := store.GetLocation(id)
+		if err != nil {
+			return nil, err
+		}
+		geocoded = append(geocoded, &GeocodedOffer{
+			Id:       id,
+			Place:    offer.Location,
+			Location: loc,
+		})
+	}
+	return geocoded, nil
+}
+
+// handleAdminGeocoded writes stored offers geocoding results as JSON lines.
+func handleAdminGeocoded(store *Store, w http.ResponseWriter, r *http.Request) error {
+	geocoded, err := listGeocoded(store)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	for _, g := range geocoded {
+		err = writeJsonLine(w, g)
 		if err != nil {
 			return err
 		}
-		place := offer.Location
+	}
+	return nil
+}
 
-		loc, _, err := store.GetLocation(id)
+func geocodedFn(cfg *Config) error {
+	var geocoded []*GeocodedOffer
+	if *serverURL != "" {
+		client, err := NewRemoteClient(*serverURL, cfg.SessionToken())
+		if err != nil {
+			return err
+		}
+		geocoded, err = client.Geocoded()
+		if err != nil {
+			return err
+		}
+	} else {
+		store, err := OpenStore(cfg.Store())
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+		geocoded, err = listGeocoded(store)
 		if err != nil {
 			return err
 		}
+	}
+	out := NewOutputWriter(os.Stdout, *outputFormat)
+	for _, g := range geocoded {
 		result := "?"
-		if loc != nil {
-			result = loc.String()
+		if g.Location != nil {
+			result = g.Location.String()
 		}
+		var err error
 		if *geocodedIds {
-			fmt.Printf("%s: %q => %s\n", id, place, result)
+			err = out.Write(g, "%s: %q => %s\n", g.Id, g.Place, result)
 		} else {
-			fmt.Printf("%q => %s\n", place, result)
+			err = out.Write(g, "%q => %s\n", g.Place, result)
+		}
+		if err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
+// DeletedOffers lists the deletions of an offer.
+type DeletedOffers struct {
+	Id      string         `json:"id"`
+	Deleted []DeletedOffer `json:"deleted"`
+}
+
 var (
-	listDeletedCmd = app.Command("list-deleted", "list deleted offers")
+	listDeletedCmd     = app.Command("list-deleted", "list deleted offers")
+	listQuarantinedCmd = app.Command("list-quarantined",
+		"list crawled offers quarantined instead of being stored")
 )
 
 func listDeletedFn(cfg *Config) error {
@@ -216,19 +431,45 @@ func listDeletedFn(cfg *Config) error {
 	if err != nil {
 		return err
 	}
+	out := NewOutputWriter(os.Stdout, *outputFormat)
 	for _, id := range deleted {
 		entries, err := store.ListDeletedOffers(id)
 		if err != nil {
 			return err
 		}
-		fmt.Printf("%s: ", id)
-		for i, e := range entries {
-			if i > 0 {
-				fmt.Printf(", ")
-			}
-			fmt.Printf("%s", e.Date)
+		dates := []string{}
+		for _, e := range entries {
+			dates = append(dates, e.Date)
+		}
+		err = out.Write(&DeletedOffers{
+			Id:      id,
+			Deleted: entries,
+		}, "%s: %s\n", id, strings.Join(dates, ", "))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func listQuarantinedFn(cfg *Config) error {
+	store, err := OpenStore(cfg.Store())
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	offers, err := store.ListQuarantined()
+	if err != nil {
+		return err
+	}
+	out := NewOutputWriter(os.Stdout, *outputFormat)
+	for _, o := range offers {
+		err = out.Write(o, "%s: %s %s\n", o.Id, o.Time.Format(time.RFC3339),
+			o.Reason)
+		if err != nil {
+			return err
 		}
-		fmt.Println()
 	}
 	return nil
 }
@@ -236,9 +477,28 @@ func listDeletedFn(cfg *Config) error {
 var (
 	dumpOfferCmd = app.Command("dump-offer",
 		"print active and deleted versions of an offer")
-	dumpOfferIds = dumpOfferCmd.Arg("id", "offer identifier").Required().Strings()
+	dumpOfferIds  = dumpOfferCmd.Arg("id", "offer identifier").Required().Strings()
+	dumpOfferHTML = dumpOfferCmd.Flag("html",
+		"print information extracted from stored HTML page").Bool()
 )
 
+func printHTMLOffer(store *Store, id string) error {
+	data, err := store.GetHTML(id)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		fmt.Printf("no HTML page stored for %s\n", id)
+		return nil
+	}
+	s, err := json.MarshalIndent(parseOfferHTML(data), "", " ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Printf("%s\n", s)
+	return err
+}
+
 func printJsonOffer(store *Store, id string, deletedId uint64) error {
 	js := &jstruct.JsonOffer{}
 	var data []byte
@@ -270,7 +530,7 @@ func dumpOfferFn(cfg *Config) error {
 	}
 	defer store.Close()
 
-	for _, dumpOfferId := range *dumpOfferIds {
+	for _, dumpOfferId := range normalizeOfferIds(*dumpOfferIds) {
 		deletedIds, err := store.ListDeletedOffers(dumpOfferId)
 		if err != nil {
 			return err
@@ -291,15 +551,40 @@ func dumpOfferFn(cfg *Config) error {
 				return err
 			}
 		}
+		if *dumpOfferHTML {
+			err = printHTMLOffer(store, dumpOfferId)
+			if err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
 
 var (
-	dumpOffersCmd    = app.Command("offers", "dump all offers in jsonl")
+	dumpOffersCmd = app.Command("offers", `dump offers in jsonl
+
+Offers can be filtered with the same query syntax as the search command, by
+location like the web "where" parameter, and by publication date. Queries
+are evaluated on the offers index, and on the deleted offers one unless
+--active is passed. Deleted offers are located using cached geocoding results
+only.
+`)
 	dumpOffersActive = dumpOffersCmd.Flag("active", "dump only active offers").Bool()
 	dumpOffersPrefix = dumpOffersCmd.Flag("prefix", "output name prefix").
 				Default("offers").String()
+	dumpOffersQuery = dumpOffersCmd.Flag("query", "dump offers matching full text query").
+			String()
+	dumpOffersWhere = dumpOffersCmd.Flag("where",
+		"dump offers around location (city[,radius] or wgs84:lat,lon[,radius])").String()
+	dumpOffersFrom = dumpOffersCmd.Flag("from",
+		"dump offers published on or after date (YYYY-MM-DD)").String()
+	dumpOffersTo = dumpOffersCmd.Flag("to",
+		"dump offers published before date (YYYY-MM-DD)").String()
+	dumpOffersGzip    = dumpOffersCmd.Flag("gzip", "compress output with gzip").Bool()
+	dumpOffersZstd    = dumpOffersCmd.Flag("zstd", "compress output with zstd").Bool()
+	dumpOffersSplitBy = dumpOffersCmd.Flag("split-by",
+		"write one set of files per publication month").Enum("month")
 )
 
 func addDeletedDate(data []byte, date string) ([]byte, error) {
@@ -312,28 +597,30 @@ func addDeletedDate(data []byte, date string) ([]byte, error) {
 	return json.Marshal(&doc)
 }
 
-func enumerateOffersBytes(store *Store, callback func(data []byte) error) error {
+// enumerateOffersBytes calls callback with every stored offer, deleted ones
+// first unless active is set. key identifies the offer version, it is the
+// offer identifier for live offers and id/deletedId for deleted ones.
+func enumerateOffersBytes(store *Store, active bool,
+	callback func(key string, data []byte, deleted *DeletedOffer) error) error {
+
 	// Enumerate deleted offers
 	ids, err := store.ListDeletedIds()
 	if err != nil {
 		return err
 	}
-	if !*dumpOffersActive {
+	if !active {
 		for _, id := range ids {
 			deletedIds, err := store.ListDeletedOffers(id)
 			if err != nil {
 				return err
 			}
-			for _, deleted := range deletedIds {
+			for i, deleted := range deletedIds {
 				data, err := store.GetDeleted(deleted.Id)
 				if err != nil {
 					return err
 				}
-				data, err = addDeletedDate(data, deleted.Date)
-				if err != nil {
-					return err
-				}
-				err = callback(data)
+				key := fmt.Sprintf("%s/%d", id, deleted.Id)
+				err = callback(key, data, &deletedIds[i])
 				if err != nil {
 					return err
 				}
@@ -351,7 +638,7 @@ func enumerateOffersBytes(store *Store, callback func(data []byte) error) error
 			return err
 		}
 		if data != nil {
-			err = callback(data)
+			err = callback(id, data, nil)
 			if err != nil {
 				return err
 			}
@@ -360,19 +647,148 @@ func enumerateOffersBytes(store *Store, callback func(data []byte) error) error
 	return nil
 }
 
+type OfferFilter struct {
+	Query string
+	Where string
+	From  time.Time
+	To    time.Time
+}
+
+func (f *OfferFilter) IsEmpty() bool {
+	return f.Query == "" && f.Where == "" && f.From.IsZero() && f.To.IsZero()
+}
+
+// filterOfferKeys returns the keys of offer versions enumerated by
+// enumerateOffersBytes which satisfy the filter. Full text queries are
+// evaluated on the offers index, and on the deleted offers one unless
+// active is set, like searches including deleted offers. deleted is only
+// required then.
+func filterOfferKeys(store *Store, index, deleted bleve.Index,
+	geocoder *Geocoder, fields []SearchField, active bool,
+	filter *OfferFilter) (map[string]bool, error) {
+
+	var textMatched map[string]bool
+	if filter.Query != "" {
+		q, err := makeSearchQuery(filter.Query, nil, fields)
+		if err != nil {
+			return nil, err
+		}
+		indexes := []bleve.Index{index}
+		if !active {
+			if deleted == nil {
+				return nil, fmt.Errorf("deleted offers index is required " +
+					"to filter them by query")
+			}
+			indexes = append(indexes, deleted)
+		}
+		textMatched = map[string]bool{}
+		for _, idx := range indexes {
+			// Deleted documents identifiers are the keys of their versions
+			ids, err := searchIds(idx, q)
+			if err != nil {
+				return nil, err
+			}
+			for _, id := range ids {
+				textMatched[id] = true
+			}
+		}
+	}
+
+	keys := map[string]bool{}
+	spatial := NewSpatialIndex()
+	err := enumerateOffersBytes(store, active, func(key string, data []byte,
+		deleted *DeletedOffer) error {
+
+		if textMatched != nil && !textMatched[key] {
+			return nil
+		}
+		js := &jstruct.JsonOffer{}
+		err := ffjson.Unmarshal(data, js)
+		if err != nil {
+			return fmt.Errorf("cannot decode %s: %s", key, err)
+		}
+		date, err := time.Parse(offerDateLayout, js.Date)
+		if err != nil {
+			return fmt.Errorf("cannot parse %s publication date: %s", key, err)
+		}
+		if !filter.From.IsZero() && date.Before(filter.From) {
+			return nil
+		}
+		if !filter.To.IsZero() && !date.Before(filter.To) {
+			return nil
+		}
+		keys[key] = true
+		if filter.Where != "" {
+			var loc *Location
+			if deleted == nil {
+				loc, _, err = store.GetLocation(key)
+			} else {
+				loc, _, _, err = geocodeOffer(geocoder, js.Location, true, 0)
+			}
+			if err != nil {
+				return err
+			}
+			offerLoc, err := makeOfferLocation(key, date, loc)
+			if err != nil {
+				return err
+			}
+			if offerLoc != nil {
+				spatial.Add(offerLoc)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if filter.Where != "" {
+		located, err := findOffersFromLocation(filter.Where, spatial, geocoder, nil, false)
+		if err != nil {
+			return nil, err
+		}
+		near := map[string]bool{}
+		for _, o := range located {
+			near[o.Id] = true
+		}
+		for key := range keys {
+			if !near[key] {
+				delete(keys, key)
+			}
+		}
+	}
+	return keys, nil
+}
+
 type OfferWriter struct {
 	prefix     string
 	suffix     string
+	compress   string
 	fp         *os.File
+	w          io.WriteCloser
+	hash       hash.Hash
 	maxPerFile int
 	written    int
 	index      int
+	files      []ManifestFile
 }
 
-func NewOfferWriter(prefix, suffix string) (*OfferWriter, error) {
+// NewOfferWriter returns a writer creating files named after prefix and
+// suffix, rotated every 50000 offers. compress can be empty, "gzip" or
+// "zstd" in which case the compression extension is appended to the suffix.
+func NewOfferWriter(prefix, suffix, compress string) (*OfferWriter, error) {
+	switch compress {
+	case "":
+	case "gzip":
+		suffix += ".gz"
+	case "zstd":
+		suffix += ".zst"
+	default:
+		return nil, fmt.Errorf("unknown compression: %s", compress)
+	}
 	w := &OfferWriter{
 		prefix:     prefix,
 		suffix:     suffix,
+		compress:   compress,
 		maxPerFile: 50000,
 	}
 	err := w.rotate()
@@ -383,7 +799,10 @@ func NewOfferWriter(prefix, suffix string) (*OfferWriter, error) {
 }
 
 func (w *OfferWriter) rotate() error {
-	w.Close()
+	err := w.Close()
+	if err != nil {
+		return err
+	}
 	path := fmt.Sprintf("%s-%03d%s", w.prefix, w.index, w.suffix)
 	fmt.Println("opening", path)
 	fp, err := os.Create(path)
@@ -391,16 +810,60 @@ func (w *OfferWriter) rotate() error {
 		return err
 	}
 	w.fp = fp
+	w.w = fp
+	w.hash = sha256.New()
+	output := io.MultiWriter(fp, w.hash)
+	switch w.compress {
+	case "gzip":
+		w.w = gzip.NewWriter(output)
+	case "zstd":
+		enc, err := zstd.NewWriter(output)
+		if err != nil {
+			fp.Close()
+			return err
+		}
+		w.w = enc
+	default:
+		w.w = nopWriteCloser{output}
+	}
+	w.files = append(w.files, ManifestFile{
+		Name:        filepath.Base(path),
+		Compression: w.compress,
+	})
 	w.index += 1
 	w.written = 0
 	return nil
 }
 
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (w nopWriteCloser) Close() error {
+	return nil
+}
+
 func (w *OfferWriter) Close() error {
-	if w.fp != nil {
-		return w.fp.Close()
+	if w.fp == nil {
+		return nil
 	}
-	return nil
+	err := w.w.Close()
+	e := w.fp.Close()
+	if err == nil {
+		err = e
+	}
+	f := &w.files[len(w.files)-1]
+	f.Records = w.written
+	f.SHA256 = hex.EncodeToString(w.hash.Sum(nil))
+	w.fp = nil
+	w.w = nil
+	return err
+}
+
+// Files returns the files written so far. Their records count and checksum
+// are only valid once they are closed.
+func (w *OfferWriter) Files() []ManifestFile {
+	return w.files
 }
 
 func (w *OfferWriter) WriteBytes(data []byte) error {
@@ -412,7 +875,7 @@ func (w *OfferWriter) WriteBytes(data []byte) error {
 		[]byte("\n"),
 	}
 	for _, buf := range parts {
-		_, err := w.fp.Write(buf)
+		_, err := w.w.Write(buf)
 		if err != nil {
 			return err
 		}
@@ -427,19 +890,225 @@ func (w *OfferWriter) WriteBytes(data []byte) error {
 	return nil
 }
 
+// MonthlyOfferWriter dispatches offers to one OfferWriter per publication
+// month.
+type MonthlyOfferWriter struct {
+	prefix   string
+	suffix   string
+	compress string
+	writers  map[string]*OfferWriter
+}
+
+func NewMonthlyOfferWriter(prefix, suffix, compress string) *MonthlyOfferWriter {
+	return &MonthlyOfferWriter{
+		prefix:   prefix,
+		suffix:   suffix,
+		compress: compress,
+		writers:  map[string]*OfferWriter{},
+	}
+}
+
+func (w *MonthlyOfferWriter) WriteBytes(month string, data []byte) error {
+	ow := w.writers[month]
+	if ow == nil {
+		created, err := NewOfferWriter(w.prefix+"-"+month, w.suffix, w.compress)
+		if err != nil {
+			return err
+		}
+		w.writers[month] = created
+		ow = created
+	}
+	return ow.WriteBytes(data)
+}
+
+func (w *MonthlyOfferWriter) Close() error {
+	var err error
+	for _, ow := range w.writers {
+		e := ow.Close()
+		if err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (w *MonthlyOfferWriter) Files() []ManifestFile {
+	months := []string{}
+	for month := range w.writers {
+		months = append(months, month)
+	}
+	sort.Strings(months)
+	files := []ManifestFile{}
+	for _, month := range months {
+		files = append(files, w.writers[month].Files()...)
+	}
+	return files
+}
+
+// writeOfferDump writes offers versions enumerated by enumerateOffersBytes
+// and listed in keys, or all of them if keys is nil, to files named after
+// prefix. Files are compressed with compress, see NewOfferWriter, and split
+// by publication month if splitBy is "month". It returns the written files.
+func writeOfferDump(store *Store, keys map[string]bool, active bool,
+	prefix, compress, splitBy string) ([]ManifestFile, error) {
+
+	var write func(data []byte, js *jstruct.JsonOffer) error
+	var closeWriter func() error
+	var listFiles func() []ManifestFile
+	if splitBy == "month" {
+		w := NewMonthlyOfferWriter(prefix, ".jsonl", compress)
+		write = func(data []byte, js *jstruct.JsonOffer) error {
+			month := "unknown"
+			if len(js.Date) >= 7 {
+				month = js.Date[:7]
+			}
+			return w.WriteBytes(month, data)
+		}
+		closeWriter = w.Close
+		listFiles = w.Files
+	} else {
+		w, err := NewOfferWriter(prefix, ".jsonl", compress)
+		if err != nil {
+			return nil, err
+		}
+		write = func(data []byte, js *jstruct.JsonOffer) error {
+			return w.WriteBytes(data)
+		}
+		closeWriter = w.Close
+		listFiles = w.Files
+	}
+	err := enumerateOffersBytes(store, active, func(key string,
+		data []byte, deleted *DeletedOffer) error {
+
+		if keys != nil && !keys[key] {
+			return nil
+		}
+		js := &jstruct.JsonOffer{}
+		err := ffjson.Unmarshal(data, js)
+		if err != nil {
+			return err
+		}
+		if deleted != nil {
+			data, err = addDeletedDate(data, deleted.Date)
+			if err != nil {
+				return err
+			}
+		} else if bytes.ContainsAny(data, "\n") {
+			// Stored offers may be indented, dumps are JSON lines
+			buf := &bytes.Buffer{}
+			err = json.Compact(buf, data)
+			if err != nil {
+				return err
+			}
+			data = buf.Bytes()
+		}
+		return write(data, js)
+	})
+	closeErr := closeWriter()
+	if err != nil {
+		return nil, err
+	}
+	if closeErr != nil {
+		return nil, closeErr
+	}
+	return listFiles(), nil
+}
+
 func dumpOffersFn(cfg *Config) error {
+	compress := ""
+	if *dumpOffersGzip && *dumpOffersZstd {
+		return fmt.Errorf("--gzip and --zstd are mutually exclusive")
+	} else if *dumpOffersGzip {
+		compress = "gzip"
+	} else if *dumpOffersZstd {
+		compress = "zstd"
+	}
+	filter := &OfferFilter{
+		Query: *dumpOffersQuery,
+		Where: *dumpOffersWhere,
+	}
+	if *dumpOffersFrom != "" {
+		d, err := parseDay(*dumpOffersFrom)
+		if err != nil {
+			return err
+		}
+		filter.From = d
+	}
+	if *dumpOffersTo != "" {
+		d, err := parseDay(*dumpOffersTo)
+		if err != nil {
+			return err
+		}
+		filter.To = d
+	}
+
 	store, err := OpenStore(cfg.Store())
 	if err != nil {
 		return err
 	}
 	defer store.Close()
 
-	w, err := NewOfferWriter(*dumpOffersPrefix, ".jsonl")
+	var keys map[string]bool
+	if !filter.IsEmpty() {
+		geocoder, err := openGeocoder(cfg)
+		if err != nil {
+			return err
+		}
+		defer geocoder.Close()
+		var index, deletedIndex bleve.Index
+		var fields []SearchField
+		if filter.Query != "" {
+			searchCfg, err := loadSearchConfig(cfg.Search())
+			if err != nil {
+				return err
+			}
+			fields = searchCfg.Fields
+			index, err = bleve.Open(cfg.Index())
+			if err != nil {
+				return err
+			}
+			defer index.Close()
+			if !*dumpOffersActive {
+				deleted := NewDeletedIndex(cfg.DeletedIndex())
+				defer deleted.Close()
+				deletedIndex, err = deleted.Get()
+				if err != nil {
+					return err
+				}
+			}
+		}
+		keys, err = filterOfferKeys(store, index, deletedIndex, geocoder,
+			fields, *dumpOffersActive, filter)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d offers selected\n", len(keys))
+	}
+
+	files, err := writeOfferDump(store, keys, *dumpOffersActive,
+		*dumpOffersPrefix, compress, *dumpOffersSplitBy)
 	if err != nil {
 		return err
 	}
-	err = enumerateOffersBytes(store, func(data []byte) error {
-		return w.WriteBytes(data)
-	})
-	return w.Close()
+	version, err := store.Version()
+	if err != nil {
+		return err
+	}
+	manifest := &Manifest{
+		Version:      manifestVersion,
+		Created:      time.Now().UTC(),
+		StoreVersion: version,
+		Parameters: ManifestParameters{
+			Active:  *dumpOffersActive,
+			Query:   *dumpOffersQuery,
+			Where:   *dumpOffersWhere,
+			From:    *dumpOffersFrom,
+			To:      *dumpOffersTo,
+			SplitBy: *dumpOffersSplitBy,
+		},
+		Files: files,
+	}
+	path := *dumpOffersPrefix + "-manifest.json"
+	fmt.Println("writing", path)
+	return writeManifest(path, manifest)
 }
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMakeQueryReport(t *testing.T) {
+	m, err := NewOfferMapping()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := []SearchField{{Name: "title", Boost: 2}}
+	report, err := makeQueryReport(m, `Développeurs and not "les bases de données"`,
+		fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	js := string(data)
+	for _, s := range []string{
+		`"ast":{"kind":"and","children":[{"kind":"string","value":"Développeurs"},` +
+			`{"kind":"not","children":[{"kind":"phrase","value":"les bases de données"}]}]}`,
+		`"must_not":`,
+		`"boost":2`,
+	} {
+		if !strings.Contains(js, s) {
+			t.Fatalf("%s not found in:\n%s", s, js)
+		}
+	}
+	if len(report.Terms) != 2 {
+		t.Fatalf("unexpected terms: %+v", report.Terms)
+	}
+	tokens := func(a TermAnalysis) []string {
+		terms := []string{}
+		for _, token := range a.Tokens {
+			terms = append(terms, token.Term)
+		}
+		return terms
+	}
+	if a := report.Terms[1]; a.Field != "title" || a.Analyzer != "fr" ||
+		!reflect.DeepEqual(tokens(a), []string{"base", "done"}) ||
+		a.Tokens[1].Position != 4 {
+		t.Fatalf("unexpected phrase analysis: %+v", a)
+	}
+
+	_, err = makeQueryReport(m, "a or", nil)
+	if err == nil {
+		t.Fatalf("invalid query did not fail")
+	}
+}
+
+func TestAnalyzeText(t *testing.T) {
+	tests := []struct {
+		Analyzer string
+		Input    string
+		Terms    []string
+	}{
+		{"raw", "Développeurs C++ H/F", []string{"Développeurs", "C++", "H", "F"}},
+		{"fr", "Développeurs C++ H/F", []string{"developeu", "c++"}},
+		{"fr_html", "<p>Les bases de <b>données</b></p>", []string{"base", "done"}},
+	}
+	for _, test := range tests {
+		tokens, err := analyzeText(test.Analyzer, test.Input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		terms := []string{}
+		for _, token := range tokens {
+			terms = append(terms, string(token.Term))
+		}
+		if !reflect.DeepEqual(terms, test.Terms) {
+			t.Fatalf("%s: %q: unexpected terms: %q", test.Analyzer, test.Input, terms)
+		}
+	}
+}
+
+func TestPrintChangesJSON(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	table := &bytes.Buffer{}
+	err := printChanges(table, env.Store, false, outputTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	err = printChanges(buf, env.Store, false, outputJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != strings.Count(table.String(), "\n") {
+		t.Fatalf("table and json outputs differ:\n%s\n%s", table, buf)
+	}
+	added := 0
+	prev := ""
+	for _, line := range lines {
+		ch := &DayChanges{}
+		err := json.Unmarshal([]byte(line), ch)
+		if err != nil {
+			t.Fatalf("invalid json line %q: %s", line, err)
+		}
+		if ch.Date <= prev {
+			t.Fatalf("changes are not sorted: %s <= %s", ch.Date, prev)
+		}
+		prev = ch.Date
+		added += ch.Added
+	}
+	ids, err := env.Store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != len(ids) {
+		t.Fatalf("expected %d added offers, got %d", len(ids), added)
+	}
+}
+
+func TestFilterOfferKeys(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	deletedId, err := env.Store.Delete("apec:1002", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = env.Index.Delete("apec:1002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted, err := env.Deleted.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = syncDeletedIndex(env.Store, deleted, IndexOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deletedKey := deletedDocId("apec:1002", deletedId)
+
+	day := func(s string) time.Time {
+		d, err := parseDay(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	for _, test := range []struct {
+		Filter   OfferFilter
+		Active   bool
+		Expected []string
+	}{
+		{OfferFilter{Query: "python"}, true,
+			[]string{"apec:1001", "apec:1004", "apec:1006"}},
+		{OfferFilter{Query: "python"}, false,
+			[]string{"apec:1001", deletedKey, "apec:1004", "apec:1006"}},
+		{OfferFilter{From: day("2017-01-04"), To: day("2017-01-06")}, true,
+			[]string{"apec:1003", "apec:1004"}},
+		{OfferFilter{Where: "paris"}, false,
+			[]string{"apec:1001", deletedKey}},
+		{OfferFilter{Query: "maintiendrez", Where: "paris"}, false,
+			[]string{deletedKey}},
+		{OfferFilter{Query: "python", To: day("2017-01-03")}, false,
+			[]string{"apec:1001"}},
+	} {
+		keys, err := filterOfferKeys(env.Store, env.Index, deleted, env.Geocoder,
+			nil, test.Active, &test.Filter)
+		if err != nil {
+			t.Fatalf("%+v: %s", test.Filter, err)
+		}
+		found := []string{}
+		for key := range keys {
+			found = append(found, key)
+		}
+		sort.Strings(found)
+		if !reflect.DeepEqual(found, test.Expected) {
+			t.Fatalf("%+v: expected %v, got %v", test.Filter, test.Expected, found)
+		}
+	}
+	_, err = filterOfferKeys(env.Store, env.Index, nil, env.Geocoder, nil,
+		false, &OfferFilter{Query: "python"})
+	if err == nil {
+		t.Fatalf("deleted offers cannot be filtered without their index")
+	}
+}
+
+func TestWriteOfferDump(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	_, err := env.Store.Delete("apec:1002", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "apec-dump-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	readDump := func(files []ManifestFile) []string {
+		lines := []string{}
+		for _, f := range files {
+			err := forEachManifestLine(dir, f, func(line []byte) error {
+				lines = append(lines, string(line))
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return lines
+	}
+
+	// Monthly gzipped dump of every version
+	files, err := writeOfferDump(env.Store, nil, false,
+		filepath.Join(dir, "all"), "gzip", "month")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name != "all-2017-01-000.jsonl.gz" ||
+		files[0].Compression != "gzip" || files[0].Records != 6 {
+		t.Fatalf("unexpected monthly files: %+v", files)
+	}
+	err = verifyManifest(dir, &Manifest{Files: files})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := readDump(files)
+	if len(lines) != 6 || !strings.Contains(lines[0], `"numeroOffre":"1002"`) ||
+		!strings.Contains(lines[0], `"deletionDate"`) {
+		t.Fatalf("unexpected dump: %v", lines)
+	}
+
+	// Selected live offers, zstd compressed
+	files, err = writeOfferDump(env.Store, map[string]bool{"apec:1003": true},
+		true, filepath.Join(dir, "some"), "zstd", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name != "some-000.jsonl.zst" {
+		t.Fatalf("unexpected files: %+v", files)
+	}
+	lines = readDump(files)
+	if len(lines) != 1 || !strings.Contains(lines[0], `"numeroOffre":"1003"`) {
+		t.Fatalf("unexpected dump: %v", lines)
+	}
+}
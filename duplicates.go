@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"sort"
 	"time"
 
 	"github.com/pmezard/apec/jstruct"
@@ -81,6 +83,124 @@ func (s sortedOfferAges) Less(i, j int) bool {
 	return len(s[i]) < len(s[j])
 }
 
+// sortedFirstDates sorts content hashes by first publication date, then
+// hash.
+type sortedFirstDates struct {
+	Hashes []string
+	Dates  map[string]time.Time
+}
+
+func (s *sortedFirstDates) Len() int {
+	return len(s.Hashes)
+}
+
+func (s *sortedFirstDates) Swap(i, j int) {
+	s.Hashes[i], s.Hashes[j] = s.Hashes[j], s.Hashes[i]
+}
+
+func (s *sortedFirstDates) Less(i, j int) bool {
+	a, b := s.Hashes[i], s.Hashes[j]
+	if !s.Dates[a].Equal(s.Dates[b]) {
+		return s.Dates[a].Before(s.Dates[b])
+	}
+	return a < b
+}
+
+// rebuildInitialDates recomputes offers initial dates from scratch, by
+// grouping live and deleted offers by content hash, then near-duplicate
+// contents, from the oldest.
+func rebuildInitialDates(store *Store) error {
+	dateLayout := "2006-01-02T15:04:05.000+0000"
+	deletedLayout := "2006-01-02T15:04:05-07:00"
+
+	collisions := map[string][]OfferAge{}
+	fingerprints := map[string]uint64{}
+	accounts := map[string]string{}
+	firstDates := map[string]time.Time{}
+	indexed := 0
+	progress := NewProgress("enumerate dates", 0)
+	err := enumerateStoredOffers(store, func(offer *jstruct.JsonOffer,
+		do *DeletedOffer) error {
+		indexed++
+		progress.Add(1)
+
+		date, err := time.Parse(dateLayout, offer.Date)
+		if err != nil {
+			return fmt.Errorf("cannot parse offer date: %s", err)
+		}
+		hash := hashOffer(offer)
+		age := OfferAge{
+			Id:              makeOfferId(apecSource, offer.Id),
+			PublicationDate: date,
+		}
+		if do != nil {
+			date, err := time.Parse(deletedLayout, do.Date)
+			if err != nil {
+				return fmt.Errorf("cannot parse deleted offer date: %s", err)
+			}
+			age.DeletedId = do.Id
+			age.DeletionDate = date
+		}
+		collisions[hash] = append(collisions[hash], age)
+		if _, ok := fingerprints[hash]; !ok {
+			fingerprints[hash] = simhashOffer(offer)
+			accounts[hash] = offer.Account
+		}
+		first, ok := firstDates[hash]
+		if !ok || date.Before(first) {
+			firstDates[hash] = date
+		}
+		return nil
+	})
+	progress.Done()
+	if err != nil {
+		return err
+	}
+
+	// Replace all dates in a single transaction, readers never see partial
+	// initial dates.
+	progress = NewProgress("store dates", indexed)
+	defer progress.Done()
+	return store.Update(func(stx *StoreTx) error {
+		progress.Verbosef("removing initial dates\n")
+		err := stx.RemoveInitialDates()
+		if err != nil {
+			return err
+		}
+		sorted := &sortedFirstDates{Dates: firstDates}
+		for hash := range collisions {
+			sorted.Hashes = append(sorted.Hashes, hash)
+		}
+		sort.Sort(sorted)
+		chains := map[string][]OfferAge{}
+		for _, hash := range sorted.Hashes {
+			chain, err := stx.LinkOfferHash(hash, fingerprints[hash],
+				accounts[hash])
+			if err != nil {
+				return err
+			}
+			chains[chain] = append(chains[chain], collisions[hash]...)
+		}
+		for chain, ages := range chains {
+			err = stx.PutOfferDates(chain, ages)
+			if err != nil {
+				return err
+			}
+			progress.Add(len(ages))
+		}
+		return nil
+	})
+}
+
+// DuplicateDates compares an offer publication date with the initial date
+// of its duplicates, empty if unknown.
+type DuplicateDates struct {
+	Id        string `json:"id"`
+	Published string `json:"published"`
+	Initial   string `json:"initial,omitempty"`
+	DeltaDays int    `json:"delta_days"`
+}
+
 var (
 	duplicatesCmd     = app.Command("duplicates", "compute statistics on duplicate offers")
 	duplicatesReindex = duplicatesCmd.Flag("reindex", "reindex initial dates").Bool()
@@ -95,66 +215,17 @@ func duplicatesFn(cfg *Config) error {
 
 	dateLayout := "2006-01-02T15:04:05.000+0000"
 	if *duplicatesReindex {
-		fmt.Println("remove initial")
-		err = store.RemoveInitialDates()
+		err = rebuildInitialDates(store)
 		if err != nil {
 			return err
 		}
-
-		deletedLayout := "2006-01-02T15:04:05-07:00"
-
-		fmt.Println("enumerating")
-		collisions := map[string][]OfferAge{}
-		indexed := 0
-		err = enumerateStoredOffers(store, func(offer *jstruct.JsonOffer,
-			do *DeletedOffer) error {
-			indexed++
-			if (indexed % 500) == 0 {
-				fmt.Printf("%d dates listed\n", indexed)
-			}
-
-			date, err := time.Parse(dateLayout, offer.Date)
-			if err != nil {
-				return fmt.Errorf("cannot parse offer date: %s", err)
-			}
-			hash := hashOffer(offer)
-			age := OfferAge{
-				Id:              offer.Id,
-				PublicationDate: date,
-			}
-			if do != nil {
-				date, err := time.Parse(deletedLayout, do.Date)
-				if err != nil {
-					return fmt.Errorf("cannot parse deleted offer date: %s", err)
-				}
-				age.DeletedId = do.Id
-				age.DeletionDate = date
-			}
-			collisions[hash] = append(collisions[hash], age)
-			return nil
-		})
-		if err != nil {
-			return err
-		}
-
-		prevBlock := indexed / 1000
-		for hash, ages := range collisions {
-			err = store.PutOfferDates(hash, ages)
-			if err != nil {
-				return err
-			}
-			indexed -= len(ages)
-			if (indexed / 1000) < prevBlock {
-				fmt.Printf("remaining %d\n", indexed)
-				prevBlock = indexed / 1000
-			}
-		}
 	}
 
 	ids, err := store.List()
 	if err != nil {
 		return err
 	}
+	out := NewOutputWriter(os.Stdout, *outputFormat)
 	for _, id := range ids {
 		o, err := getStoreJsonOffer(store, id)
 		if err != nil {
@@ -173,7 +244,13 @@ func duplicatesFn(cfg *Config) error {
 			if err != nil {
 				return err
 			}
-			fmt.Printf("cannot get %s initial date, %s %d\n", id, date, len(data))
+			err = out.Write(&DuplicateDates{
+				Id:        id,
+				Published: date,
+			}, "cannot get %s initial date, %s %d\n", id, date, len(data))
+			if err != nil {
+				return err
+			}
 			continue
 		}
 		pub, err := time.Parse(dateLayout, o.Date)
@@ -181,8 +258,16 @@ func duplicatesFn(cfg *Config) error {
 			return err
 		}
 		delta := pub.Sub(d) / (24 * time.Hour)
-		fmt.Printf("%s: pub=%s, init=%s, delta=%dj\n", id,
+		err = out.Write(&DuplicateDates{
+			Id:        id,
+			Published: pub.Format("2006-01-02"),
+			Initial:   d.Format("2006-01-02"),
+			DeltaDays: int(delta),
+		}, "%s: pub=%s, init=%s, delta=%dj\n", id,
 			pub.Format("2006-01-02"), d.Format("2006-01-02"), delta)
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/pmezard/apec/jstruct"
+	"github.com/pquerna/ffjson/ffjson"
+)
+
+// Search results are exported one page at a time. The first page pins the
+// matching offers in the result sets and returns their snapshot token,
+// following pages read the pinned set, so indexing running between requests
+// neither duplicates nor omits offers. Offers deleted in the meantime are
+// exported from their last stored version.
+
+const (
+	exportCSV     = "csv"
+	exportGeoJSON = "geojson"
+
+	defaultExportSize = 1000
+	maxExportSize     = 10000
+)
+
+// exportedOffers sorts offers by decreasing date, then identifier, so pages
+// of the same snapshot never overlap.
+type exportedOffers []datedOffer
+
+func (s exportedOffers) Len() int {
+	return len(s)
+}
+
+func (s exportedOffers) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s exportedOffers) Less(i, j int) bool {
+	if s[i].Date != s[j].Date {
+		return s[i].Date > s[j].Date
+	}
+	return s[i].Id < s[j].Id
+}
+
+type ExportedOffer struct {
+	Id        string
+	Title     string
+	Account   string
+	Date      time.Time
+	URL       string
+	Location  string
+	MinSalary int
+	MaxSalary int
+	// Geocoded location, nil if unknown or nationwide
+	Point *Point
+	// Assigned department and region, nil if unknown
+	Area *OfferArea
+	// True if the offer was deleted after the snapshot was taken
+	Deleted bool
+}
+
+// ExportPage holds offers [Start, Start+len(Offers)) of a snapshot of Total
+// offers.
+type ExportPage struct {
+	Snapshot string
+	Start    int
+	Total    int
+	Offers   []*ExportedOffer
+}
+
+// getExportedOffer loads id from the store, or its last deleted version.
+// It returns nil if the offer is unknown.
+func getExportedOffer(store *Store, id string) (*ExportedOffer, error) {
+	js, err := getStoreJsonOffer(store, id)
+	if err != nil {
+		return nil, err
+	}
+	deleted := false
+	if js == nil {
+		entries, err := store.ListDeletedOffers(id)
+		if err != nil || len(entries) == 0 {
+			return nil, err
+		}
+		data, err := store.GetDeleted(entries[len(entries)-1].Id)
+		if err != nil || data == nil {
+			return nil, err
+		}
+		js = &jstruct.JsonOffer{}
+		err = ffjson.Unmarshal(data, js)
+		if err != nil {
+			return nil, err
+		}
+		deleted = true
+	}
+	offer, err := convertOffer(js)
+	if err != nil {
+		return nil, err
+	}
+	exported := &ExportedOffer{
+		Id:        offer.Id,
+		Title:     offer.Title,
+		Account:   offer.Account,
+		Date:      offer.Date,
+		URL:       offer.URL,
+		Location:  offer.Location,
+		MinSalary: offer.MinSalary,
+		MaxSalary: offer.MaxSalary,
+		Deleted:   deleted,
+	}
+	loc, _, err := store.GetLocation(id)
+	if err != nil {
+		return nil, err
+	}
+	if loc != nil && !loc.Nationwide {
+		exported.Point = &Point{Lat: loc.Lat, Lon: loc.Lon}
+	}
+	exported.Area, err = store.GetOfferArea(id)
+	if err != nil {
+		return nil, err
+	}
+	return exported, nil
+}
+
+// loadExportPage returns at most size offers of snapshot, starting at start.
+func loadExportPage(store *Store, snapshot string, offers []datedOffer,
+	start, size int) (*ExportPage, error) {
+
+	sorted := append(exportedOffers{}, offers...)
+	sort.Sort(sorted)
+	page := &ExportPage{
+		Snapshot: snapshot,
+		Start:    start,
+		Total:    len(sorted),
+		Offers:   []*ExportedOffer{},
+	}
+	if start >= len(sorted) {
+		return page, nil
+	}
+	end := start + size
+	if end > len(sorted) {
+		end = len(sorted)
+	}
+	for _, o := range sorted[start:end] {
+		offer, err := getExportedOffer(store, o.Id)
+		if err != nil {
+			return nil, err
+		}
+		if offer != nil {
+			page.Offers = append(page.Offers, offer)
+		}
+	}
+	return page, nil
+}
+
+func writeExportCSV(w io.Writer, page *ExportPage, header bool) error {
+	cw := csv.NewWriter(w)
+	if header {
+		// New columns are appended, so existing readers keep working
+		err := cw.Write([]string{"id", "date", "title", "account", "location",
+			"lat", "lon", "min_salary", "max_salary", "url", "deleted",
+			"department", "region"})
+		if err != nil {
+			return err
+		}
+	}
+	for _, o := range page.Offers {
+		lat, lon := "", ""
+		if o.Point != nil {
+			lat = strconv.FormatFloat(o.Point.Lat, 'f', -1, 64)
+			lon = strconv.FormatFloat(o.Point.Lon, 'f', -1, 64)
+		}
+		department, region := "", ""
+		if o.Area != nil {
+			department, region = o.Area.Department, o.Area.Region
+		}
+		err := cw.Write([]string{
+			o.Id,
+			o.Date.Format("2006-01-02"),
+			o.Title,
+			o.Account,
+			o.Location,
+			lat,
+			lon,
+			strconv.Itoa(o.MinSalary),
+			strconv.Itoa(o.MaxSalary),
+			o.URL,
+			strconv.FormatBool(o.Deleted),
+			department,
+			region,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+type geoJSONGeometry struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+type geoJSONFeature struct {
+	Type       string                 `json:"type"`
+	Geometry   *geoJSONGeometry       `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type geoJSONCollection struct {
+	Type     string            `json:"type"`
+	Features []*geoJSONFeature `json:"features"`
+}
+
+func makeGeoJSONFeature(o *ExportedOffer) *geoJSONFeature {
+	feature := &geoJSONFeature{
+		Type: "Feature",
+		Properties: map[string]interface{}{
+			"id":         o.Id,
+			"date":       o.Date.Format("2006-01-02"),
+			"title":      o.Title,
+			"account":    o.Account,
+			"location":   o.Location,
+			"min_salary": o.MinSalary,
+			"max_salary": o.MaxSalary,
+			"url":        o.URL,
+			"deleted":    o.Deleted,
+		},
+	}
+	if o.Area != nil {
+		feature.Properties["department"] = o.Area.Department
+		feature.Properties["department_code"] = o.Area.DepartmentCode
+		feature.Properties["region"] = o.Area.Region
+		feature.Properties["region_code"] = o.Area.RegionCode
+	}
+	if o.Point != nil {
+		feature.Geometry = &geoJSONGeometry{
+			Type:        "Point",
+			Coordinates: [2]float64{o.Point.Lon, o.Point.Lat},
+		}
+	}
+	return feature
+}
+
+// writeExportGeoJSON writes page offers as a feature collection. Offers
+// without location have a null geometry.
+func writeExportGeoJSON(w io.Writer, page *ExportPage) error {
+	collection := &geoJSONCollection{
+		Type:     "FeatureCollection",
+		Features: []*geoJSONFeature{},
+	}
+	for _, o := range page.Offers {
+		collection.Features = append(collection.Features, makeGeoJSONFeature(o))
+	}
+	return json.NewEncoder(w).Encode(collection)
+}
+
+// findExportedOffers runs the spatial and text queries like serveQuery,
+// without caching. The age filter of what, if any, applies at now.
+func findExportedOffers(store *Store, index bleve.Index, spatial *SpatialIndex,
+	geocoder *Geocoder, router *Router, limits SearchLimits,
+	fields []SearchField, backend, what, where string, includeRemote bool,
+	now time.Time) ([]datedOffer, error) {
+
+	what, ageFilter, maxAge, err := parseMaxAge(what)
+	if err != nil {
+		return nil, err
+	}
+	offers, err := searchExportedOffers(index, spatial, geocoder, router,
+		limits, fields, backend, what, where, includeRemote)
+	if err != nil || ageFilter == "" {
+		return offers, err
+	}
+	// Exported offers are never deleted ones
+	return filterMaxAge(store, index, nil, offers, maxAge, now)
+}
+
+func searchExportedOffers(index bleve.Index, spatial *SpatialIndex,
+	geocoder *Geocoder, router *Router, limits SearchLimits,
+	fields []SearchField, backend, what, where string, includeRemote bool) (
+	[]datedOffer, error) {
+
+	if useBleveSpatial(backend, where) {
+		var nationwide []string
+		if includeRemote {
+			for _, o := range spatial.FindNationwide() {
+				nationwide = append(nationwide, o.Id)
+			}
+		}
+		offers, _, err := findOffersFromIndex(index, what, where, geocoder,
+			nationwide, fields, limits)
+		return offers, err
+	}
+	offers, err := findOffersFromLocation(where, spatial, geocoder, router,
+		includeRemote)
+	if err != nil || what == "" || len(offers) == 0 {
+		return offers, err
+	}
+	ids := make([]string, len(offers))
+	for i, offer := range offers {
+		ids[i] = offer.Id
+	}
+	sort.Strings(ids)
+	offers, _, err = findOffersFromText(index, what, ids, fields, limits)
+	return offers, err
+}
+
+// parseExportRange returns the "start" and "size" parameters, size defaults
+// to defaultSize and cannot exceed maxSize.
+func parseExportRange(values url.Values, defaultSize, maxSize int) (int, int,
+	error) {
+
+	start, size := 0, defaultSize
+	if s := values.Get("start"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("invalid start: %q", s)
+		}
+		start = n
+	}
+	if s := values.Get("size"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > maxSize {
+			return 0, 0, fmt.Errorf("invalid size, must be in 1-%d: %q",
+				maxSize, s)
+		}
+		size = n
+	}
+	return start, size, nil
+}
+
+// serveExport writes a page of search results as CSV or GeoJSON. Results are
+// read from the "snapshot" result set, or searched with "what", "where" and
+// "include_remote" then pinned. The snapshot token, total count and next page
+// link are returned in X-Export-Snapshot, X-Export-Total and Link headers.
+// With "all=1", all results are written at once, or exported by a job if
+// there are more than jobs threshold, and the job status is returned. Jobs
+// call retain, if not nil, to keep store open until they finish.
+func serveExport(sc *SearchContext, jobs *ExportJobs, retain func() func(),
+	w http.ResponseWriter, r *http.Request) error {
+
+	rep := sc.Replica
+	store, index, results := rep.Store, rep.Index.Get(), sc.Results
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		return err
+	}
+	format := values.Get("format")
+	if format == "" {
+		format = exportCSV
+	}
+	if format != exportCSV && format != exportGeoJSON {
+		return fmt.Errorf("unknown export format: %q", format)
+	}
+	start, size, err := parseExportRange(values, defaultExportSize,
+		maxExportSize)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	snapshot := values.Get("snapshot")
+	var offers []datedOffer
+	if snapshot != "" {
+		offers = results.Get(snapshot, now)
+		if offers == nil {
+			return fmt.Errorf("export snapshot has expired, please export again")
+		}
+	} else {
+		offers, err = findExportedOffers(store, index, rep.Spatial,
+			rep.Geocoder, sc.Router, sc.Limits, sc.Fields, sc.Backend,
+			strings.TrimSpace(values.Get("what")),
+			strings.TrimSpace(values.Get("where")),
+			values.Get("include_remote") == "1", now.In(sc.Loc))
+		if err != nil {
+			return err
+		}
+		snapshot = results.Put(offers, now)
+	}
+	h := w.Header()
+	if values.Get("all") == "1" {
+		if len(offers) > jobs.Threshold {
+			var release func()
+			if retain != nil {
+				release = retain()
+				if release == nil {
+					return fmt.Errorf("offers were updated, please export again")
+				}
+			}
+			status, err := jobs.Start(store, snapshot, offers, format, release)
+			if err != nil {
+				return err
+			}
+			h.Set("Location", status.URL)
+			return writeExportJobStatus(w, http.StatusAccepted, status)
+		}
+		h.Set("X-Export-Snapshot", snapshot)
+		h.Set("X-Export-Total", strconv.Itoa(len(offers)))
+		setExportContentType(h, format)
+		return writeExport(w, store, snapshot, offers, format, nil)
+	}
+	page, err := loadExportPage(store, snapshot, offers, start, size)
+	if err != nil {
+		return err
+	}
+
+	h.Set("X-Export-Snapshot", page.Snapshot)
+	h.Set("X-Export-Total", strconv.Itoa(page.Total))
+	if next := start + size; next < page.Total {
+		u := url.Values{}
+		u.Set("snapshot", page.Snapshot)
+		u.Set("format", format)
+		u.Set("start", strconv.Itoa(next))
+		u.Set("size", strconv.Itoa(size))
+		h.Set("Link", fmt.Sprintf("<%s?%s>; rel=\"next\"", r.URL.Path, u.Encode()))
+	}
+	setExportContentType(h, format)
+	if format == exportGeoJSON {
+		return writeExportGeoJSON(w, page)
+	}
+	return writeExportCSV(w, page, start == 0)
+}
+
+func setExportContentType(h http.Header, format string) {
+	if format == exportGeoJSON {
+		h.Set("Content-Type", "application/geo+json")
+	} else {
+		h.Set("Content-Type", "text/csv; charset=utf-8")
+	}
+	h.Set("Content-Disposition", "attachment; filename=offers."+format)
+}
+
+func handleExport(sc *SearchContext, jobs *ExportJobs, retain func() func(),
+	w http.ResponseWriter, r *http.Request) {
+
+	err := serveExport(sc, jobs, retain, w, r)
+	if err != nil {
+		log.Printf("error: export failed with: %s", err)
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "error: %s\n", err)
+	}
+}
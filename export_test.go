@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func readExportedIds(t *testing.T, env *testEnv, values url.Values) (
+	[]map[string]string, string, int) {
+
+	rsp := env.Export(values)
+	if rsp.Code != 200 {
+		t.Fatalf("export failed: %d %s", rsp.Code, rsp.Body.String())
+	}
+	records, err := csv.NewReader(rsp.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("invalid CSV: %s", err)
+	}
+	header := []string{"id", "date", "title", "account", "location", "lat",
+		"lon", "min_salary", "max_salary", "url", "deleted", "department", "region"}
+	if values.Get("start") == "" {
+		if len(records) == 0 || fmt.Sprint(records[0]) != fmt.Sprint(header) {
+			t.Fatalf("invalid CSV header: %v", records)
+		}
+		records = records[1:]
+	}
+	rows := []map[string]string{}
+	for _, record := range records {
+		row := map[string]string{}
+		for i, name := range header {
+			row[name] = record[i]
+		}
+		rows = append(rows, row)
+	}
+	total, err := strconv.Atoi(rsp.Header().Get("X-Export-Total"))
+	if err != nil {
+		t.Fatalf("invalid total: %s", err)
+	}
+	return rows, rsp.Header().Get("X-Export-Snapshot"), total
+}
+
+func TestExportSnapshot(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	values := url.Values{}
+	values.Set("what", "python")
+	values.Set("size", "2")
+	first, snapshot, total := readExportedIds(t, env, values)
+	if snapshot == "" || total != 3 || len(first) != 2 {
+		t.Fatalf("unexpected first page: %q, %d, %v", snapshot, total, first)
+	}
+
+	// Delete an offer of the next page while exporting
+	values = url.Values{}
+	values.Set("snapshot", snapshot)
+	values.Set("start", "2")
+	values.Set("size", "2")
+	next, _, _ := readExportedIds(t, env, values)
+	deletedId := next[0]["id"]
+	_, err := env.Store.Delete(deletedId, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = env.Index.Delete(deletedId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Spatial.Remove(deletedId)
+
+	second, _, total := readExportedIds(t, env, values)
+	if total != 3 || len(second) != 1 || second[0]["id"] != deletedId ||
+		second[0]["deleted"] != "true" {
+		t.Fatalf("unexpected second page: %d, %v", total, second)
+	}
+	seen := map[string]bool{}
+	for _, row := range append(first, second...) {
+		if seen[row["id"]] {
+			t.Fatalf("duplicate exported offer: %s", row["id"])
+		}
+		seen[row["id"]] = true
+	}
+
+	// New exports see the deletion
+	values = url.Values{}
+	values.Set("what", "python")
+	_, _, total = readExportedIds(t, env, values)
+	if total != 2 {
+		t.Fatalf("deleted offer exported again: %d", total)
+	}
+
+	values = url.Values{}
+	values.Set("snapshot", "unknown")
+	rsp := env.Export(values)
+	if rsp.Code != 400 {
+		t.Fatalf("unknown snapshot exported: %d", rsp.Code)
+	}
+}
+
+func TestExportGeoJSON(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	values := url.Values{}
+	values.Set("what", "python")
+	values.Set("format", "geojson")
+	values.Set("size", "2")
+	rsp := env.Export(values)
+	if rsp.Code != 200 {
+		t.Fatalf("export failed: %d %s", rsp.Code, rsp.Body.String())
+	}
+	link := rsp.Header().Get("Link")
+	if link == "" {
+		t.Fatalf("next page link is missing")
+	}
+	collection := &geoJSONCollection{}
+	err := json.Unmarshal(rsp.Body.Bytes(), collection)
+	if err != nil {
+		t.Fatalf("invalid GeoJSON: %s", err)
+	}
+	if collection.Type != "FeatureCollection" || len(collection.Features) != 2 {
+		t.Fatalf("unexpected collection: %+v", collection)
+	}
+	for _, f := range collection.Features {
+		if f.Geometry == nil || f.Geometry.Type != "Point" || f.Properties["id"] == "" {
+			t.Fatalf("unexpected feature: %+v", f)
+		}
+	}
+}
+
+func TestExportJob(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	// Small exports are written at once
+	values := url.Values{}
+	values.Set("what", "python")
+	values.Set("all", "1")
+	rows, _, total := readExportedIds(t, env, values)
+	if total != 3 || len(rows) != 3 {
+		t.Fatalf("unexpected export: %d, %v", total, rows)
+	}
+
+	env.Exports.Threshold = 2
+	values.Set("format", "geojson")
+	rsp := env.Export(values)
+	if rsp.Code != 202 {
+		t.Fatalf("export job not started: %d %s", rsp.Code, rsp.Body.String())
+	}
+	status := &ExportJobStatus{}
+	err := json.Unmarshal(rsp.Body.Bytes(), status)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Total != 3 || status.URL != "downloads/"+status.Token ||
+		rsp.Header().Get("Location") != status.URL {
+		t.Fatalf("unexpected job status: %+v", status)
+	}
+	download := func() *httptest.ResponseRecorder {
+		return env.Get(func(w http.ResponseWriter, r *http.Request) {
+			handleDownload(env.Exports, w, r)
+		}, "/"+status.URL, nil)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	rsp = download()
+	for rsp.Code == 202 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		rsp = download()
+	}
+	if rsp.Code != 200 {
+		t.Fatalf("download failed: %d %s", rsp.Code, rsp.Body.String())
+	}
+	collection := &geoJSONCollection{}
+	err = json.Unmarshal(rsp.Body.Bytes(), collection)
+	if err != nil {
+		t.Fatalf("invalid GeoJSON: %s\n%s", err, rsp.Body.String())
+	}
+	if len(collection.Features) != 3 {
+		t.Fatalf("unexpected collection: %+v", collection)
+	}
+
+	status.URL = "downloads/unknown"
+	rsp = download()
+	if rsp.Code != 404 {
+		t.Fatalf("unknown export downloaded: %d", rsp.Code)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Exports of more than a threshold of offers run as background jobs writing
+// to temporary files, downloaded once complete from /downloads/TOKEN.
+
+// writeExport writes every offer of snapshot in format, a page at a time.
+// progress is called with the number of offers written so far, if not nil.
+func writeExport(w io.Writer, store *Store, snapshot string,
+	offers []datedOffer, format string, progress func(int)) error {
+
+	if format == exportGeoJSON {
+		_, err := io.WriteString(w, `{"type":"FeatureCollection","features":[`)
+		if err != nil {
+			return err
+		}
+	}
+	written := 0
+	for start := 0; start == 0 || start < len(offers); start += defaultExportSize {
+		page, err := loadExportPage(store, snapshot, offers, start,
+			defaultExportSize)
+		if err != nil {
+			return err
+		}
+		if format == exportGeoJSON {
+			for _, o := range page.Offers {
+				if written > 0 {
+					_, err = io.WriteString(w, ",")
+					if err != nil {
+						return err
+					}
+				}
+				data, err := json.Marshal(makeGeoJSONFeature(o))
+				if err != nil {
+					return err
+				}
+				_, err = w.Write(data)
+				if err != nil {
+					return err
+				}
+				written++
+			}
+		} else {
+			err = writeExportCSV(w, page, start == 0)
+			if err != nil {
+				return err
+			}
+		}
+		if progress != nil {
+			done := start + defaultExportSize
+			if done > len(offers) {
+				done = len(offers)
+			}
+			progress(done)
+		}
+	}
+	if format == exportGeoJSON {
+		_, err := io.WriteString(w, "]}\n")
+		return err
+	}
+	return nil
+}
+
+// ExportJobStatus describes an export job progress.
+type ExportJobStatus struct {
+	Token   string    `json:"token"`
+	Format  string    `json:"format"`
+	Total   int       `json:"total"`
+	Done    int       `json:"done"`
+	Started time.Time `json:"started"`
+	// Zero while the job runs
+	Finished time.Time `json:"finished"`
+	Error    string    `json:"error,omitempty"`
+	// Relative download URL, available once finished
+	URL string `json:"url"`
+}
+
+type exportJob struct {
+	status ExportJobStatus
+	path   string
+}
+
+// ExportJobs runs export jobs and keeps their files until they expire.
+type ExportJobs struct {
+	// Exports of more offers than this run as jobs
+	Threshold int
+
+	lock    sync.Mutex
+	dir     string
+	jobs    map[string]*exportJob
+	ttl     time.Duration
+	maxJobs int
+	wg      sync.WaitGroup
+}
+
+// NewExportJobs creates a job manager writing files in a temporary
+// directory. At most maxJobs run at once, finished jobs are dropped after ttl.
+func NewExportJobs(threshold, maxJobs int, ttl time.Duration) (*ExportJobs, error) {
+	dir, err := ioutil.TempDir("", "apec-exports-")
+	if err != nil {
+		return nil, err
+	}
+	return &ExportJobs{
+		Threshold: threshold,
+		dir:       dir,
+		jobs:      map[string]*exportJob{},
+		ttl:       ttl,
+		maxJobs:   maxJobs,
+	}, nil
+}
+
+func (j *ExportJobs) path(token, format string) string {
+	return filepath.Join(j.dir, token+"."+format)
+}
+
+// Close waits for running jobs and removes exported files.
+func (j *ExportJobs) Close() error {
+	j.wg.Wait()
+	return os.RemoveAll(j.dir)
+}
+
+// expire drops jobs finished for longer than ttl, and returns the number of
+// running ones. The lock must be held.
+func (j *ExportJobs) expire(now time.Time) int {
+	running := 0
+	for token, job := range j.jobs {
+		if job.status.Finished.IsZero() {
+			running++
+			continue
+		}
+		if now.Sub(job.status.Finished) > j.ttl {
+			os.Remove(job.path)
+			delete(j.jobs, token)
+		}
+	}
+	return running
+}
+
+// Start exports offers of snapshot in the background and returns the job
+// status. release, if not nil, is called once store is no longer used.
+func (j *ExportJobs) Start(store *Store, snapshot string, offers []datedOffer,
+	format string, release func()) (*ExportJobStatus, error) {
+
+	if release == nil {
+		release = func() {}
+	}
+	token, err := randomHex(16)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	now := time.Now()
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if j.expire(now) >= j.maxJobs {
+		release()
+		return nil, fmt.Errorf("too many exports are running, please retry later")
+	}
+	job := &exportJob{
+		status: ExportJobStatus{
+			Token:   token,
+			Format:  format,
+			Total:   len(offers),
+			Started: now,
+			URL:     "downloads/" + token,
+		},
+		path: j.path(token, format),
+	}
+	j.jobs[token] = job
+	j.wg.Add(1)
+	go func() {
+		defer j.wg.Done()
+		err := j.run(job, store, snapshot, offers)
+		release()
+		j.lock.Lock()
+		defer j.lock.Unlock()
+		job.status.Finished = time.Now()
+		if err != nil {
+			job.status.Error = err.Error()
+			os.Remove(job.path)
+		}
+	}()
+	status := job.status
+	return &status, nil
+}
+
+func (j *ExportJobs) run(job *exportJob, store *Store, snapshot string,
+	offers []datedOffer) error {
+
+	fp, err := os.Create(job.path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	err = writeExport(fp, store, snapshot, offers, job.status.Format,
+		func(done int) {
+			j.lock.Lock()
+			defer j.lock.Unlock()
+			job.status.Done = done
+		})
+	if err != nil {
+		return err
+	}
+	return fp.Close()
+}
+
+// Status returns the status of job token, or nil if it is unknown or expired.
+func (j *ExportJobs) Status(token string) *ExportJobStatus {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.expire(time.Now())
+	job := j.jobs[token]
+	if job == nil {
+		return nil
+	}
+	status := job.status
+	return &status
+}
+
+func writeExportJobStatus(w http.ResponseWriter, code int,
+	status *ExportJobStatus) error {
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	return writeJsonLine(w, status)
+}
+
+// handleDownload serves the file of the export job identified by the last
+// URL path element once it is complete, or its status with a 202 code while
+// it runs.
+func handleDownload(jobs *ExportJobs, w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	status := jobs.Status(token)
+	if status == nil {
+		http.Error(w, "unknown or expired export", http.StatusNotFound)
+		return
+	}
+	if status.Finished.IsZero() {
+		writeExportJobStatus(w, http.StatusAccepted, status)
+		return
+	}
+	if status.Error != "" {
+		writeExportJobStatus(w, http.StatusInternalServerError, status)
+		return
+	}
+	fp, err := os.Open(jobs.path(token, status.Format))
+	if err != nil {
+		http.Error(w, "export file is missing", http.StatusNotFound)
+		return
+	}
+	defer fp.Close()
+	setExportContentType(w.Header(), status.Format)
+	http.ServeContent(w, r, "", status.Finished, fp)
+}
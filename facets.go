@@ -0,0 +1,331 @@
+package main
+
+import (
+	"html/template"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// Search results are narrowed by facet filters, passed as "company", "salary",
+// "department", "region" and "age" query parameters. Each facet counts the results
+// matching the filters selected on the other facets, so its values tell how
+// many offers selecting them would list.
+
+const (
+	facetCompany    = "company"
+	facetSalary     = "salary"
+	facetDepartment = "department"
+	facetRegion     = "region"
+	facetAge        = "age"
+)
+
+// searchFacets lists the facets query parameters, in display order.
+var searchFacets = []string{
+	facetCompany,
+	facetSalary,
+	facetDepartment,
+	facetRegion,
+	facetAge,
+}
+
+var facetTitles = map[string]string{
+	facetCompany:    "Company",
+	facetSalary:     "Salary",
+	facetDepartment: "Department",
+	facetRegion:     "Region",
+	facetAge:        "Age",
+}
+
+// facetBucket groups offers whose value is at least Min, up to the next
+// bucket Min.
+type facetBucket struct {
+	Key  string
+	Name string
+	Min  int
+}
+
+// Minimum salaries, in kEUR
+var salaryBuckets = []facetBucket{
+	{"0-35", "Less than 35 kEUR", 0},
+	{"35-45", "35 - 45 kEUR", 35},
+	{"45-55", "45 - 55 kEUR", 45},
+	{"55-70", "55 - 70 kEUR", 55},
+	{"70-", "70 kEUR and more", 70},
+}
+
+// Salary facet key of offers without salary
+const noSalaryKey = "none"
+
+// Days since initial publication
+var ageBuckets = []facetBucket{
+	{"0-1", "Today", 0},
+	{"1-7", "This week", 1},
+	{"7-30", "This month", 7},
+	{"30-", "Older", 30},
+}
+
+// bucketValue returns the facet value of the bucket of value, ranked in
+// buckets order.
+func bucketValue(buckets []facetBucket, value int) FacetValue {
+	rank := 0
+	for i, b := range buckets {
+		if value >= b.Min {
+			rank = i
+		}
+	}
+	return FacetValue{
+		Key:  buckets[rank].Key,
+		Name: buckets[rank].Name,
+		rank: rank,
+	}
+}
+
+// FacetValue is a facet entry of search results. URL toggles its filter.
+type FacetValue struct {
+	Key      string
+	Name     string
+	Count    int
+	Selected bool
+	URL      template.URL
+	// Display rank of bucketed values
+	rank int
+}
+
+// sortedFacetValues sorts values by rank, then decreasing count and name.
+type sortedFacetValues []FacetValue
+
+func (s sortedFacetValues) Len() int {
+	return len(s)
+}
+
+func (s sortedFacetValues) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s sortedFacetValues) Less(i, j int) bool {
+	if s[i].rank != s[j].rank {
+		return s[i].rank < s[j].rank
+	}
+	if s[i].Count != s[j].Count {
+		return s[i].Count > s[j].Count
+	}
+	return s[i].Name < s[j].Name
+}
+
+// Facet lists the values of a facet over search results, and the selected
+// one if any.
+type Facet struct {
+	Name     string
+	Title    string
+	Selected string
+	Values   []FacetValue
+}
+
+// facetFields holds the fields of a search result facets values are
+// computed from, cached in FacetCache.
+type facetFields struct {
+	Account   string
+	MinSalary int
+	// Department and region facets keys and names, empty if unknown
+	DepartmentKey string
+	Department    string
+	RegionKey     string
+	Region        string
+	Published     time.Time
+}
+
+// getFacetFields returns the facet fields of a search result, or nil if it
+// no longer exists.
+func getFacetFields(store *Store, doc datedOffer) (*facetFields, error) {
+	js, _, err := loadDatedOffer(store, doc)
+	if err != nil || js == nil {
+		return nil, err
+	}
+	offer, err := convertOffer(js)
+	if err != nil {
+		return nil, err
+	}
+	fields := &facetFields{
+		Account:   offer.Account,
+		MinSalary: offer.MinSalary,
+	}
+	area, err := store.GetOfferArea(resultOfferId(doc))
+	if err != nil {
+		return nil, err
+	}
+	if area != nil {
+		fields.DepartmentKey = areaFacetKey(area.Department, area.DepartmentCode)
+		fields.Department = area.Department
+		fields.RegionKey = areaFacetKey(area.Region, area.RegionCode)
+		fields.Region = area.Region
+	}
+	fields.Published, err = getPublishedDate(store, doc, offer.Date)
+	if err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// areaFacetKey returns the facet key of an area, its code if known, or an
+// empty string if name is empty.
+func areaFacetKey(name, code string) string {
+	if name == "" {
+		return ""
+	}
+	if code == "" {
+		return normalizeAreaTerm(name)
+	}
+	return normalizeAreaTerm(code)
+}
+
+// getOfferFacets returns the facets values of a search result, indexed like
+// searchFacets, or nil if it no longer exists. Values with an empty Key are
+// unknown. Facet fields are read from cache if possible, and added to it
+// if they were computed during generation gen.
+func getOfferFacets(store *Store, cache *FacetCache, gen uint64,
+	doc datedOffer, now time.Time) ([]FacetValue, error) {
+
+	fields, ok := cache.Get(doc.Id)
+	if !ok {
+		var err error
+		fields, err = getFacetFields(store, doc)
+		if err != nil {
+			return nil, err
+		}
+		cache.Put(doc.Id, gen, fields)
+	}
+	if fields == nil {
+		return nil, nil
+	}
+	values := make([]FacetValue, len(searchFacets))
+	values[0] = FacetValue{Key: fields.Account, Name: fields.Account}
+
+	values[1] = FacetValue{
+		Key:  noSalaryKey,
+		Name: "Not specified",
+		rank: len(salaryBuckets),
+	}
+	if fields.MinSalary > 0 {
+		values[1] = bucketValue(salaryBuckets, fields.MinSalary)
+	}
+	if fields.DepartmentKey != "" {
+		values[2] = FacetValue{
+			Key:  fields.DepartmentKey,
+			Name: fields.Department,
+		}
+	}
+	if fields.RegionKey != "" {
+		values[3] = FacetValue{
+			Key:  fields.RegionKey,
+			Name: fields.Region,
+		}
+	}
+	values[4] = bucketValue(ageBuckets, offerAgeDays(fields.Published, now))
+	return values, nil
+}
+
+// facetURL returns the relative URL of the search requested with values,
+// with facet name filter toggled on key, from the first page.
+func facetURL(values url.Values, name, key string) template.URL {
+	toggled := url.Values{}
+	for k, v := range values {
+		toggled[k] = v
+	}
+	toggled.Del("page")
+	if values.Get(name) == key {
+		toggled.Del(name)
+	} else {
+		toggled.Set(name, key)
+	}
+	return template.URL("?" + toggled.Encode())
+}
+
+// filterFacets returns the search results matching the facet filters of
+// values, and the facets of offers, keeping the max largest values of each
+// if max is positive. Results which no longer exist are dropped. Their facet
+// fields are cached in cache.
+func filterFacets(store *Store, cache *FacetCache, offers []datedOffer,
+	values url.Values, max int, now time.Time) ([]Facet, []datedOffer,
+	error) {
+
+	gen := cache.Generation()
+	selected := make([]string, len(searchFacets))
+	for i, name := range searchFacets {
+		selected[i] = values.Get(name)
+	}
+	counts := make([]map[string]*FacetValue, len(searchFacets))
+	for i := range counts {
+		counts[i] = map[string]*FacetValue{}
+	}
+	add := func(i int, v FacetValue) {
+		if v.Key == "" {
+			return
+		}
+		c := counts[i][v.Key]
+		if c == nil {
+			c = &v
+			counts[i][v.Key] = c
+		}
+		c.Count++
+	}
+	filtered := []datedOffer{}
+	for _, o := range offers {
+		facets, err := getOfferFacets(store, cache, gen, o, now)
+		if err != nil {
+			return nil, nil, err
+		}
+		if facets == nil {
+			continue
+		}
+		mismatched := []int{}
+		for i, v := range facets {
+			if selected[i] != "" && v.Key != selected[i] {
+				mismatched = append(mismatched, i)
+			}
+		}
+		switch len(mismatched) {
+		case 0:
+			filtered = append(filtered, o)
+			for i, v := range facets {
+				add(i, v)
+			}
+		case 1:
+			// Matches if the mismatched facet filter were changed
+			i := mismatched[0]
+			add(i, facets[i])
+		}
+	}
+	result := []Facet{}
+	for i, name := range searchFacets {
+		facet := Facet{
+			Name:     name,
+			Title:    facetTitles[name],
+			Selected: selected[i],
+		}
+		if selected[i] != "" && counts[i][selected[i]] == nil {
+			// Keep unmatched filters visible so they can be removed
+			counts[i][selected[i]] = &FacetValue{
+				Key:  selected[i],
+				Name: selected[i],
+			}
+		}
+		for _, v := range counts[i] {
+			v.Selected = v.Key == selected[i]
+			v.URL = facetURL(values, name, v.Key)
+			facet.Values = append(facet.Values, *v)
+		}
+		sort.Sort(sortedFacetValues(facet.Values))
+		if max > 0 && len(facet.Values) > max {
+			kept := append([]FacetValue{}, facet.Values[:max]...)
+			for _, v := range facet.Values[max:] {
+				if v.Selected {
+					kept = append(kept, v)
+				}
+			}
+			facet.Values = kept
+		}
+		result = append(result, facet)
+	}
+	return result, filtered, nil
+}
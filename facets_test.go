@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFilterFacets(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	for _, id := range []string{"apec:1001", "apec:1002"} {
+		err := env.Store.PutOfferArea(id, &OfferArea{
+			Department:     "Paris",
+			DepartmentCode: "75",
+			Region:         "Île-de-France",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	offers := []datedOffer{}
+	for i := 1001; i <= 1006; i++ {
+		offers = append(offers, datedOffer{Id: fmt.Sprintf("apec:%d", i)})
+	}
+	now := time.Date(2017, 1, 9, 12, 0, 0, 0, time.UTC)
+
+	// Returns filtered identifiers and "facet:key=count" entries
+	filter := func(values url.Values) ([]string, []string) {
+		facets, filtered, err := filterFacets(env.Store, env.Facets, offers, values, 0,
+			now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := []string{}
+		for _, o := range filtered {
+			ids = append(ids, o.Id)
+		}
+		counts := []string{}
+		for _, f := range facets {
+			for _, v := range f.Values {
+				c := fmt.Sprintf("%s:%s=%d", f.Name, v.Key, v.Count)
+				if v.Selected {
+					c += "*"
+				}
+				counts = append(counts, c)
+			}
+		}
+		sort.Strings(counts)
+		return ids, counts
+	}
+
+	ids, counts := filter(url.Values{})
+	if len(ids) != 6 {
+		t.Fatalf("unexpected unfiltered offers: %v", ids)
+	}
+	expected := []string{
+		"age:1-7=5",
+		"age:7-30=1",
+		"company:ACME=1",
+		"company:Globex=1",
+		"company:Hooli=1",
+		"company:Initech=2",
+		"company:Umbrella=1",
+		"department:75=2",
+		"department:gironde=1",
+		"department:rhone=1",
+		"region:auvergne-rhone-alpes=1",
+		"region:ile-de-france=2",
+		"region:nouvelle-aquitaine=1",
+		"salary:35-45=1",
+		"salary:45-55=3",
+		"salary:70-=1",
+		"salary:none=1",
+	}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Fatalf("unexpected facets:\n%v\n!=\n%v", counts, expected)
+	}
+
+	// Facets count offers matching the other facets filters
+	ids, counts = filter(url.Values{
+		"company": {"Initech"},
+		"salary":  {"45-55"},
+	})
+	if !reflect.DeepEqual(ids, []string{"apec:1006"}) {
+		t.Fatalf("unexpected filtered offers: %v", ids)
+	}
+	expected = []string{
+		"age:1-7=1",
+		"company:ACME=1",
+		"company:Globex=1",
+		"company:Initech=1*",
+		"salary:35-45=1",
+		"salary:45-55=1*",
+	}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Fatalf("unexpected facets:\n%v\n!=\n%v", counts, expected)
+	}
+
+	// Unmatched filters are listed so they can be removed
+	ids, counts = filter(url.Values{"department": {"75"}, "company": {"Hooli"}})
+	if len(ids) != 0 {
+		t.Fatalf("unexpected filtered offers: %v", ids)
+	}
+	expected = []string{
+		"company:ACME=1",
+		"company:Hooli=0*",
+		"company:Initech=1",
+		"department:75=0*",
+	}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Fatalf("unexpected facets:\n%v\n!=\n%v", counts, expected)
+	}
+
+	// Links toggle filters and reset pagination
+	values := url.Values{"what": {"go"}, "company": {"ACME"}, "page": {"2"}}
+	if u := facetURL(values, "company", "ACME"); u != "?what=go" {
+		t.Fatalf("unexpected deselection URL: %s", u)
+	}
+	if u := facetURL(values, "salary", "70-"); u != "?company=ACME&salary=70-&what=go" {
+		t.Fatalf("unexpected selection URL: %s", u)
+	}
+
+	// Facet fields are cached until the index generation changes
+	err := env.Store.PutOfferArea("apec:1002", &OfferArea{
+		Department:     "Gironde",
+		DepartmentCode: "33",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	department := url.Values{"department": {"75"}}
+	ids, _ = filter(department)
+	if !reflect.DeepEqual(ids, []string{"apec:1001", "apec:1002"}) {
+		t.Fatalf("facet fields were not cached: %v", ids)
+	}
+	env.Generation.Bump()
+	ids, _ = filter(department)
+	if !reflect.DeepEqual(ids, []string{"apec:1001"}) {
+		t.Fatalf("facet fields were not refreshed: %v", ids)
+	}
+}
+
+func TestSearchFacets(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	w := env.QueryValues(url.Values{
+		"company":        {"Initech"},
+		"include_remote": {"1"},
+	})
+	body := w.Body.String()
+	if w.Code != 200 || !strings.Contains(body, "2/2 offers") ||
+		!strings.Contains(body, "<b>Initech</b> [x]") ||
+		strings.Contains(body, "Développeur Go") {
+		t.Fatalf("unexpected filtered results: %d %s", w.Code, body)
+	}
+	if !strings.Contains(body, `<input type="hidden" name="company" value="Initech">`) {
+		t.Fatalf("refining should keep facet filters: %s", body)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pmezard/apec/jstruct"
+)
+
+// A gazetteer is a JSON lines file of geocoding queries and their locations.
+// It is built from a geocoder cache and seeds others, so new datasets locate
+// most offers without geocoding key. Only queries shared by several offers
+// are kept, without provider responses nor offers identifiers. The shipped
+// gazetteer locates major French cities, gazetteer.sh regenerates it from a
+// geocoded dataset.
+
+const defaultGazetteerPath = "gazetteer.jsonl"
+
+type GazetteerEntry struct {
+	Query    string    `json:"query"`
+	Location *Location `json:"location"`
+}
+
+type sortedGazetteer []*GazetteerEntry
+
+func (s sortedGazetteer) Len() int {
+	return len(s)
+}
+
+func (s sortedGazetteer) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s sortedGazetteer) Less(i, j int) bool {
+	return s[i].Query < s[j].Query
+}
+
+// buildGazetteer returns the cached locations of geocoding candidates of
+// offer locations shared by at least minOffers offers, sorted by query.
+func buildGazetteer(store *Store, geocoder *Geocoder, minOffers int) (
+	[]*GazetteerEntry, error) {
+
+	stats, err := collectLocationStats(store)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	entries := sortedGazetteer{}
+	for _, st := range stats {
+		if st.Offers < minOffers {
+			continue
+		}
+		for _, c := range fixLocation(st.Location) {
+			if c == nationwideCandidate || seen[c] {
+				continue
+			}
+			seen[c] = true
+			loc, _, err := geocoder.GetCachedLocation(c, "fr")
+			if err != nil {
+				return nil, err
+			}
+			if loc != nil {
+				entries = append(entries, &GazetteerEntry{
+					Query:    c,
+					Location: loc,
+				})
+			}
+		}
+	}
+	sort.Sort(entries)
+	return entries, nil
+}
+
+// readGazetteer parses and validates gazetteer entries.
+func readGazetteer(r io.Reader) ([]*GazetteerEntry, error) {
+	entries := []*GazetteerEntry{}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		data := scanner.Bytes()
+		if len(strings.TrimSpace(string(data))) == 0 {
+			continue
+		}
+		e := &GazetteerEntry{}
+		err := json.Unmarshal(data, e)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err)
+		}
+		e.Query = nfcString(strings.ToLower(strings.TrimSpace(e.Query)))[0]
+		if e.Query == "" || e.Location == nil {
+			return nil, fmt.Errorf("line %d: query or location is missing", line)
+		}
+		if e.Location.Lat < -90 || e.Location.Lat > 90 ||
+			e.Location.Lon < -180 || e.Location.Lon > 180 {
+			return nil, fmt.Errorf("line %d: invalid coordinates for %q", line,
+				e.Query)
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// makeGazetteerResponse returns a geocoding response locating loc, cached in
+// place of the provider one.
+func makeGazetteerResponse(loc *Location) ([]byte, error) {
+	return json.Marshal(&jstruct.Location{
+		Results: []jstruct.LocResult{
+			{
+				Component: jstruct.LocComponent{
+					City:     loc.City,
+					PostCode: loc.PostCode,
+					County:   loc.County,
+					State:    loc.State,
+					Country:  loc.Country,
+				},
+				Geometry: &jstruct.LocGeom{
+					Lat: loc.Lat,
+					Lon: loc.Lon,
+				},
+			},
+		},
+	})
+}
+
+// seedGeocoder caches gazetteer entries, except queries already located. It
+// returns the number of seeded and skipped entries.
+func seedGeocoder(geocoder *Geocoder, entries []*GazetteerEntry) (
+	int, int, error) {
+
+	seeded, skipped := 0, 0
+	for _, e := range entries {
+		key, _ := geocoder.cache.makeKey(e.Query, "fr")
+		loc, _, err := geocoder.cache.GetLocation(key)
+		if err != nil {
+			return seeded, skipped, err
+		}
+		if loc != nil {
+			skipped++
+			continue
+		}
+		data, err := makeGazetteerResponse(e.Location)
+		if err != nil {
+			return seeded, skipped, err
+		}
+		err = geocoder.cache.Put(key, data, e.Location)
+		if err != nil {
+			return seeded, skipped, err
+		}
+		seeded++
+	}
+	return seeded, skipped, nil
+}
+
+// locateFromCache sets the location of stored offers without one, which can
+// be resolved from the geocoder cache. It returns the number of located
+// offers.
+func locateFromCache(store *Store, geocoder *Geocoder) (int, error) {
+	ids, err := store.List()
+	if err != nil {
+		return 0, err
+	}
+	located := 0
+	for _, id := range ids {
+		loc, _, err := store.GetLocation(id)
+		if err != nil {
+			return located, err
+		}
+		if loc != nil {
+			continue
+		}
+		offer, err := getStoreOffer(store, id)
+		if err != nil {
+			return located, err
+		}
+		if offer == nil {
+			continue
+		}
+		pos, _, _, err := geocodeOffer(geocoder, offer.Location, true, 0)
+		if err != nil {
+			return located, err
+		}
+		if pos == nil {
+			continue
+		}
+		err = store.PutLocation(id, pos, offer.Date)
+		if err != nil {
+			return located, err
+		}
+		err = recordGeocodingAttempt(store, id, time.Now(), GeocodingOK)
+		if err != nil {
+			return located, err
+		}
+		located++
+	}
+	return located, nil
+}
+
+var (
+	geocacheCmd     = app.Command("geocache", "manage the geocoder cache")
+	geocacheSeedCmd = geocacheCmd.Command("seed", `seed the geocoder cache from a gazetteer
+
+Caches the gazetteer locations, except queries already located, then locates
+stored offers resolved by the cache. No geocoding key is required. Run
+"apec index" afterwards to update the indexes.
+`)
+	geocacheSeedPath = geocacheSeedCmd.Arg("path", "gazetteer path").
+				Default(defaultGazetteerPath).String()
+	geocacheBuildCmd = geocacheCmd.Command("build", `print a gazetteer built from the geocoder cache
+
+Writes the cached locations of queries shared by at least --min-offers offers
+as JSON lines, without provider responses nor offers identifiers.
+`)
+	geocacheBuildMinOffers = geocacheBuildCmd.Flag("min-offers",
+		"minimum number of offers sharing a location").Default("3").Int()
+)
+
+func geocacheSeedFn(cfg *Config) error {
+	fp, err := os.Open(*geocacheSeedPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%s not found, generate it with gazetteer.sh "+
+				"from a geocoded dataset", *geocacheSeedPath)
+		}
+		return err
+	}
+	defer fp.Close()
+	entries, err := readGazetteer(fp)
+	if err != nil {
+		return fmt.Errorf("cannot read %s: %s", *geocacheSeedPath, err)
+	}
+	geocoder, err := openGeocoder(cfg)
+	if err != nil {
+		return err
+	}
+	defer geocoder.Close()
+	store, err := OpenStore(cfg.Store())
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	seeded, skipped, err := seedGeocoder(geocoder, entries)
+	if err != nil {
+		return err
+	}
+	located, err := locateFromCache(store, geocoder)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d locations seeded, %d already cached, %d offers located\n",
+		seeded, skipped, located)
+	return nil
+}
+
+func geocacheBuildFn(cfg *Config) error {
+	geocoder, err := openGeocoder(cfg)
+	if err != nil {
+		return err
+	}
+	defer geocoder.Close()
+	store, err := OpenStore(cfg.Store())
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	entries, err := buildGazetteer(store, geocoder, *geocacheBuildMinOffers)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		err = writeJsonLine(os.Stdout, e)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
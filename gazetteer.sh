@@ -0,0 +1,30 @@
+#!/bin/sh
+# Builds gazetteer.jsonl from the geocoder cache of a real dataset, crawled
+# and geocoded with a key:
+#
+#   ./gazetteer.sh /path/to/data
+#
+# Only locations shared by at least MIN_OFFERS offers, 3 by default, are
+# kept, without provider responses nor offers identifiers. Review the diff
+# before committing the result.
+set -e
+
+if [ $# -ne 1 ]; then
+	echo "usage: $0 DATADIR" >&2
+	exit 1
+fi
+data=$(cd "$1" && pwd)
+if [ ! -e "$data/geocoder" ]; then
+	echo "error: no geocoder cache in $data" >&2
+	exit 1
+fi
+cd "$(dirname "$0")"
+go run . --data "$data" geocache build --min-offers "${MIN_OFFERS:-3}" \
+	> gazetteer.jsonl.tmp
+if [ ! -s gazetteer.jsonl.tmp ]; then
+	rm -f gazetteer.jsonl.tmp
+	echo "error: no location is shared by enough offers" >&2
+	exit 1
+fi
+mv gazetteer.jsonl.tmp gazetteer.jsonl
+echo "$(wc -l < gazetteer.jsonl) locations written to gazetteer.jsonl"
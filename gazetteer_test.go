@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGazetteerBuildAndSeed(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	entries, err := buildGazetteer(env.Store, env.Geocoder, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Query != "paris" {
+		t.Fatalf("unexpected shared locations: %+v", entries)
+	}
+	entries, err = buildGazetteer(env.Store, env.Geocoder, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	for _, e := range entries {
+		err = writeJsonLine(buf, e)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if strings.Contains(buf.String(), "apec:") {
+		t.Fatalf("gazetteer leaks offer identifiers: %s", buf.String())
+	}
+	entries, err = readGazetteer(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queries := []string{}
+	for _, e := range entries {
+		queries = append(queries, e.Query)
+	}
+	if strings.Join(queries, ",") != "bordeaux,lyon,paris" {
+		t.Fatalf("unexpected gazetteer queries: %v", queries)
+	}
+
+	// Seed a dataset without locations
+	store := openTempStore(t)
+	defer closeAndDeleteStore(t, store)
+	ids, err := env.Store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		data, err := env.Store.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.Put(id, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tmpDir, err := ioutil.TempDir("", "apec-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	geocoder, err := NewGeocoder("", filepath.Join(tmpDir, "geocoder"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer geocoder.Close()
+
+	seeded, skipped, err := seedGeocoder(geocoder, entries)
+	if err != nil || seeded != 3 || skipped != 0 {
+		t.Fatalf("unexpected seeding: %d seeded, %d skipped, %v", seeded,
+			skipped, err)
+	}
+	seeded, skipped, err = seedGeocoder(geocoder, entries)
+	if err != nil || seeded != 0 || skipped != 3 {
+		t.Fatalf("unexpected reseeding: %d seeded, %d skipped, %v", seeded,
+			skipped, err)
+	}
+	res, err := geocoder.Geocode("lyon", "fr", true)
+	if err != nil || res == nil || !res.Cached || len(res.Results) != 1 {
+		t.Fatalf("seeded location is not cached: %+v, %v", res, err)
+	}
+	// Nationwide offers are located without geocoding
+	located, err := locateFromCache(store, geocoder)
+	if err != nil || located != 5 {
+		t.Fatalf("expected 5 located offers, got %d, %v", located, err)
+	}
+	loc, _, err := store.GetLocation(ids[0])
+	if err != nil || loc == nil || loc.City != "Paris" {
+		t.Fatalf("unexpected location for %s: %+v, %v", ids[0], loc, err)
+	}
+}
+
+func TestReadGazetteer(t *testing.T) {
+	tests := []struct {
+		Data  string
+		Error string
+	}{
+		{`{"query":" Brest ","location":{"City":"Brest","Lat":48.39,"Lon":-4.48}}` +
+			"\n\n", ""},
+		{`{"query":"brest"}`, "line 1: query or location is missing"},
+		{"\n" + `{"query":"x","location":{"Lat":91}}`, "line 2: invalid coordinates"},
+		{`{"query":`, "line 1:"},
+	}
+	for _, test := range tests {
+		entries, err := readGazetteer(strings.NewReader(test.Data))
+		if test.Error == "" {
+			if err != nil || len(entries) != 1 || entries[0].Query != "brest" {
+				t.Fatalf("%q: unexpected entries: %+v, %v", test.Data, entries, err)
+			}
+			continue
+		}
+		if err == nil || !strings.HasPrefix(err.Error(), test.Error) {
+			t.Fatalf("%q: expected %q error, got %v", test.Data, test.Error, err)
+		}
+	}
+
+	// The shipped gazetteer is valid and sorted
+	fp, err := os.Open(defaultGazetteerPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	entries, err := readGazetteer(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) == 0 {
+		t.Fatalf("%s is empty", defaultGazetteerPath)
+	}
+	for i := 1; i < len(entries); i++ {
+		if entries[i-1].Query >= entries[i].Query {
+			t.Fatalf("%s is not sorted at %q", defaultGazetteerPath,
+				entries[i].Query)
+		}
+	}
+}
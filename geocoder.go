@@ -3,36 +3,133 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"net/url"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/pmezard/apec/jstruct"
 	"github.com/pquerna/ffjson/ffjson"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
 )
 
 var (
 	QuotaError = errors.New("payment required")
+	// KeyError is returned when the provider rejects the geocoding key
+	KeyError = errors.New("geocoding key is invalid or disabled")
 
 	geoCacheBucket = []byte("c")
 	geoPointBucket = []byte("p")
 	geoMetaBucket  = []byte("m")
+	// Time negative entries, without result, were cached
+	geoMissBucket = []byte("n")
 
 	geoBuckets = [][]byte{
 		geoCacheBucket,
 		geoPointBucket,
 		geoMetaBucket,
+		geoMissBucket,
 	}
 
-	geocoderVersion = 2
+	// 3: keys are normalized by makeKeyAndCountryCode
+	geocoderVersion = 3
+
+	// geocodingURL is the OpenCage geocoding endpoint
+	geocodingURL = "http://api.opencagedata.com/geocode/v1/json"
+)
+
+const (
+	// Locations without result are geocoded again after this delay
+	defaultNegativeTTL = 30 * 24 * time.Hour
 )
 
+const (
+	// Geocoding requests are retried with exponential backoff, like crawling
+	// ones, starting with this delay
+	geocodingBaseDelay = time.Second
+	geocodingLoops     = 4
+)
+
+// OutageError is returned when the geocoding provider is unavailable, after
+// retries.
+type OutageError struct {
+	Reason string
+}
+
+func (e *OutageError) Error() string {
+	return fmt.Sprintf("geocoding provider is unavailable: %s", e.Reason)
+}
+
+// ResponseError is returned for responses not matching the expected
+// geocoding schema.
+type ResponseError struct {
+	Reason string
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("invalid geocoding response: %s", e.Reason)
+}
+
+// geocodingStatusError categorizes the failed geocoding status code.
+func geocodingStatusError(code int, status string) error {
+	switch {
+	case code == http.StatusPaymentRequired:
+		return QuotaError
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		return KeyError
+	case code == http.StatusTooManyRequests || code >= 500:
+		return &OutageError{Reason: status}
+	}
+	return fmt.Errorf("geocoding failed with %s", status)
+}
+
+// geocodingEnvelope holds the response fields checked by parseGeocoding.
+type geocodingEnvelope struct {
+	Status *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"status"`
+	Results *json.RawMessage `json:"results"`
+}
+
+// parseGeocoding decodes a geocoding response. Error documents and
+// responses without status or results are rejected instead of decoding to
+// zero values. Responses without rate block, from unlimited accounts, have
+// a zero rate limit.
+func parseGeocoding(data []byte) (*jstruct.Location, error) {
+	env := &geocodingEnvelope{}
+	err := json.Unmarshal(data, env)
+	if err != nil {
+		return nil, &ResponseError{Reason: err.Error()}
+	}
+	if env.Status == nil {
+		return nil, &ResponseError{Reason: "status is missing"}
+	}
+	if env.Status.Code != http.StatusOK {
+		return nil, geocodingStatusError(env.Status.Code,
+			fmt.Sprintf("%d %s", env.Status.Code, env.Status.Message))
+	}
+	if env.Results == nil || bytes.Equal(*env.Results, []byte("null")) {
+		return nil, &ResponseError{Reason: "results are missing"}
+	}
+	res := &jstruct.Location{}
+	err = ffjson.Unmarshal(data, res)
+	if err != nil {
+		return nil, &ResponseError{Reason: err.Error()}
+	}
+	return res, nil
+}
+
 type Location struct {
 	City     string
 	County   string
@@ -41,6 +138,9 @@ type Location struct {
 	PostCode string
 	Lat      float64
 	Lon      float64
+	// Nationwide is true for locations covering the whole country, like remote
+	// work offers. Lat and Lon are meaningless then.
+	Nationwide bool
 }
 
 func (l *Location) String() string {
@@ -89,6 +189,8 @@ func buildLocation(loc *jstruct.Location) *Location {
 
 type Cache struct {
 	db *bolt.DB
+	// Keys ignore diacritics, see makeKeyAndCountryCode
+	foldAccents bool
 }
 
 func OpenCache(path string) (*Cache, error) {
@@ -123,6 +225,11 @@ func OpenCache(path string) (*Cache, error) {
 			return nil, err
 		}
 	}
+	c.foldAccents, err = c.FoldAccents()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
 	return c, nil
 }
 
@@ -130,6 +237,13 @@ func (c *Cache) Close() error {
 	return c.db.Close()
 }
 
+// Copy writes a consistent copy of the cache at path.
+func (c *Cache) Copy(path string) error {
+	return c.db.View(func(tx *bolt.Tx) error {
+		return tx.CopyFile(path, 0644)
+	})
+}
+
 func writeBinaryString(w io.Writer, buf []byte, s string) error {
 	binary.PutVarint(buf, int64(len(s)))
 	_, err := w.Write(buf[:binary.MaxVarintLen32])
@@ -215,11 +329,65 @@ func (c *Cache) Put(key string, data []byte, pos *Location) error {
 			if err != nil {
 				return err
 			}
+			err = tx.Bucket(geoMissBucket).Delete(k)
+		} else {
+			buf := make([]byte, binary.MaxVarintLen64)
+			n := binary.PutVarint(buf, time.Now().Unix())
+			err = tx.Bucket(geoMissBucket).Put(k, buf[:n])
+		}
+		if err != nil {
+			return err
 		}
 		return tx.Bucket(geoPointBucket).Put(k, w.Bytes())
 	})
 }
 
+// StampMisses records now as the caching time of entries without result
+// cached before those times were recorded, and returns their number.
+func (c *Cache) StampMisses(now time.Time) (int, error) {
+	stamped := 0
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutVarint(buf, now.Unix())
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		misses := tx.Bucket(geoMissBucket)
+		return tx.Bucket(geoPointBucket).ForEach(func(k, v []byte) error {
+			if len(v) > 0 || misses.Get(k) != nil {
+				return nil
+			}
+			stamped++
+			return misses.Put(k, buf[:n])
+		})
+	})
+	return stamped, err
+}
+
+// Expired returns true if key is cached without result for more than ttl.
+// Entries without caching time, see StampMisses, are considered fresh rather
+// than all geocoded again at once. Nothing expires if ttl is zero.
+func (c *Cache) Expired(key string, ttl time.Duration, now time.Time) (
+	bool, error) {
+
+	expired := false
+	err := c.db.View(func(tx *bolt.Tx) error {
+		k := []byte(key)
+		point := tx.Bucket(geoPointBucket).Get(k)
+		if ttl <= 0 || point == nil || len(point) > 0 {
+			return nil
+		}
+		data := tx.Bucket(geoMissBucket).Get(k)
+		if data == nil {
+			return nil
+		}
+		t, n := binary.Varint(data)
+		if n <= 0 {
+			return fmt.Errorf("invalid negative entry time for %s", key)
+		}
+		expired = now.Sub(time.Unix(t, 0)) > ttl
+		return nil
+	})
+	return expired, err
+}
+
 func (c *Cache) Get(key string) ([]byte, error) {
 	var data []byte
 	err := c.db.View(func(tx *bolt.Tx) error {
@@ -248,6 +416,21 @@ func (c *Cache) GetLocation(key string) (*Location, bool, error) {
 	return p, found, err
 }
 
+func (c *Cache) Delete(key string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		k := []byte(key)
+		err := tx.Bucket(geoCacheBucket).Delete(k)
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket(geoMissBucket).Delete(k)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(geoPointBucket).Delete(k)
+	})
+}
+
 func (c *Cache) List() ([]string, error) {
 	keys := []string{}
 	err := c.db.View(func(tx *bolt.Tx) error {
@@ -285,11 +468,129 @@ func (c *Cache) SetVersion(version int) error {
 	})
 }
 
+// FoldAccents returns true if cache keys ignore diacritics.
+func (c *Cache) FoldAccents() (bool, error) {
+	fold := false
+	err := c.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(geoMetaBucket).Get([]byte("fold_accents"))
+		fold = len(data) > 0 && data[0] != 0
+		return nil
+	})
+	return fold, err
+}
+
+// makeKey returns the cache key and normalized country code of query q.
+func (c *Cache) makeKey(q, code string) (string, string) {
+	return makeKeyAndCountryCode(q, code, c.foldAccents)
+}
+
+// normalizeCacheKey returns the normalized version of a key built before
+// makeKeyAndCountryCode normalized them.
+func normalizeCacheKey(key string, foldAccents bool) string {
+	q, code := key, ""
+	if i := strings.LastIndex(key, "-"); i >= 0 {
+		q, code = key[:i], key[i+1:]
+	}
+	normalized, _ := makeKeyAndCountryCode(q, code, foldAccents)
+	return normalized
+}
+
+// NormalizeKeys renames cache entries after their normalized keys, ignoring
+// diacritics if foldAccents is true, and records the setting. Entries with
+// the same normalized key are deduplicated, located ones are kept over
+// entries without result, then the first keys in lexicographic order. It
+// returns the number of removed entries.
+func (c *Cache) NormalizeKeys(foldAccents bool) (int, error) {
+	keys, err := c.List()
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	err = c.db.Update(func(tx *bolt.Tx) error {
+		cacheBucket := tx.Bucket(geoCacheBucket)
+		pointBucket := tx.Bucket(geoPointBucket)
+		missBucket := tx.Bucket(geoMissBucket)
+		// Keys are listed in lexicographic order
+		kept := map[string]string{}
+		for _, key := range keys {
+			normalized := normalizeCacheKey(key, foldAccents)
+			prev, ok := kept[normalized]
+			if !ok || len(pointBucket.Get([]byte(prev))) == 0 &&
+				len(pointBucket.Get([]byte(key))) > 0 {
+				kept[normalized] = key
+			}
+		}
+		buckets := []*bolt.Bucket{cacheBucket, pointBucket, missBucket}
+		// Drop duplicates first, so renamed entries do not overwrite them
+		for _, key := range keys {
+			if kept[normalizeCacheKey(key, foldAccents)] == key {
+				continue
+			}
+			for _, b := range buckets {
+				err := b.Delete([]byte(key))
+				if err != nil {
+					return err
+				}
+			}
+			removed++
+		}
+		for normalized, key := range kept {
+			if normalized == key {
+				continue
+			}
+			for _, b := range buckets {
+				k := []byte(key)
+				v := b.Get(k)
+				if v == nil {
+					continue
+				}
+				// Values are invalidated by bucket updates
+				v = append([]byte{}, v...)
+				err := b.Delete(k)
+				if err != nil {
+					return err
+				}
+				err = b.Put([]byte(normalized), v)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		fold := []byte{0}
+		if foldAccents {
+			fold[0] = 1
+		}
+		return tx.Bucket(geoMetaBucket).Put([]byte("fold_accents"), fold)
+	})
+	if err != nil {
+		return 0, err
+	}
+	c.foldAccents = foldAccents
+	return removed, nil
+}
+
+// Geocoding counters: cache hits and misses, remote calls and their errors
+var geocoderStats = expvar.NewMap("geocoder")
+
 type Geocoder struct {
+	// Cached locations without result expire after NegativeTTL, or never if
+	// zero
+	NegativeTTL time.Duration
+
 	key   string
 	cache *Cache
 }
 
+// openGeocoder opens the geocoder configured by cfg.
+func openGeocoder(cfg *Config) (*Geocoder, error) {
+	g, err := NewGeocoder(cfg.GeocodingKey(), cfg.Geocoder())
+	if err != nil {
+		return nil, err
+	}
+	g.NegativeTTL = cfg.NegativeTTL
+	return g, nil
+}
+
 func NewGeocoder(key, cacheDir string) (*Geocoder, error) {
 	cache, err := OpenCache(cacheDir)
 	if err != nil {
@@ -309,8 +610,9 @@ func NewGeocoder(key, cacheDir string) (*Geocoder, error) {
 			version, geocoderVersion)
 	}
 	g := &Geocoder{
-		key:   key,
-		cache: cache,
+		NegativeTTL: defaultNegativeTTL,
+		key:         key,
+		cache:       cache,
 	}
 	cache = nil
 	return g, nil
@@ -346,16 +648,34 @@ func (g *Geocoder) Close() error {
 	return g.cache.Close()
 }
 
-func makeKeyAndCountryCode(q, code string) (string, string) {
-	code = strings.ToLower(code)
+// CopyCache writes a copy of the geocoder cache at path.
+func (g *Geocoder) CopyCache(path string) error {
+	return g.cache.Copy(path)
+}
+
+// makeKeyAndCountryCode returns the cache key of query q in country code,
+// and the normalized country code. Queries are trimmed, lowercased, their
+// spaces collapsed and NFC normalized, so "Vélizy " and "vélizy" share the
+// same entry. Diacritics are removed too if foldAccents is true.
+func makeKeyAndCountryCode(q, code string, foldAccents bool) (string, string) {
+	code = strings.ToLower(strings.TrimSpace(code))
 	if code == "" {
 		code = "unk"
 	}
+	q = strings.ToLower(strings.Join(strings.Fields(q), " "))
+	if foldAccents {
+		q = removeDiacritics(nfdString(q))
+	}
+	q, _, _ = transform.String(norm.NFC, q)
 	return q + "-" + code, code
 }
 
 func (g *Geocoder) geocodeFromCache(q, countryCode string) (*jstruct.Location, error) {
-	key, countryCode := makeKeyAndCountryCode(q, countryCode)
+	key, countryCode := g.cache.makeKey(q, countryCode)
+	expired, err := g.cache.Expired(key, g.NegativeTTL, time.Now())
+	if err != nil || expired {
+		return nil, err
+	}
 	data, err := g.cache.Get(key)
 	if err != nil {
 		return nil, err
@@ -369,8 +689,15 @@ func (g *Geocoder) geocodeFromCache(q, countryCode string) (*jstruct.Location, e
 	return res, err
 }
 
+// GetCachedLocation returns the cached location of q, and true if it was
+// cached, even without result. Expired entries without result are reported
+// as not cached.
 func (g *Geocoder) GetCachedLocation(q, countryCode string) (*Location, bool, error) {
-	key, _ := makeKeyAndCountryCode(q, countryCode)
+	key, _ := g.cache.makeKey(q, countryCode)
+	expired, err := g.cache.Expired(key, g.NegativeTTL, time.Now())
+	if err != nil || expired {
+		return nil, false, err
+	}
 	return g.cache.GetLocation(key)
 }
 
@@ -378,11 +705,20 @@ func (g *Geocoder) Geocode(q, countryCode string, offline bool) (
 	*jstruct.Location, error) {
 
 	res, err := g.geocodeFromCache(q, countryCode)
+	if err == nil {
+		if res != nil {
+			geocoderStats.Add("cache_hits", 1)
+		} else {
+			geocoderStats.Add("cache_misses", 1)
+		}
+	}
 	if err != nil || res != nil || offline {
 		return res, err
 	}
+	geocoderStats.Add("calls", 1)
 	r, err := g.rawGeocode(q, countryCode)
 	if err != nil {
+		geocoderStats.Add("errors", 1)
 		return nil, err
 	}
 	defer r.Close()
@@ -393,12 +729,11 @@ func (g *Geocoder) Geocode(q, countryCode string, offline bool) (
 	if err != nil {
 		return nil, err
 	}
-	res = &jstruct.Location{}
-	err = ffjson.Unmarshal(data, res)
+	res, err = parseGeocoding(data)
 	if err != nil {
 		return nil, err
 	}
-	key, _ := makeKeyAndCountryCode(q, countryCode)
+	key, _ := g.cache.makeKey(q, countryCode)
 	err = g.cache.Put(key, data, buildLocation(res))
 	if err != nil {
 		return nil, err
@@ -406,36 +741,193 @@ func (g *Geocoder) Geocode(q, countryCode string, offline bool) (
 	return res, err
 }
 
+// redact hides the geocoding key in s.
+func (g *Geocoder) redact(s string) string {
+	if g.key == "" {
+		return s
+	}
+	return strings.Replace(s, url.QueryEscape(g.key), "<key>", -1)
+}
+
 func (g *Geocoder) rawGeocode(q, countryCode string) (io.ReadCloser, error) {
-	u := fmt.Sprintf("http://api.opencagedata.com/geocode/v1/json?q=%s&key=%s",
-		url.QueryEscape(q), url.QueryEscape(g.key))
+	u := fmt.Sprintf("%s?q=%s&key=%s", geocodingURL, url.QueryEscape(q),
+		url.QueryEscape(g.key))
 	if countryCode != "" {
 		u += "&countrycode=" + url.QueryEscape(countryCode)
 	}
-	rsp, err := http.Get(u)
+	r, err := retryHTTP(u, geocodingBaseDelay, geocodingLoops, nil,
+		&retryPolicy{
+			Permanent: func(h *HTTPError) error {
+				if h.Code == http.StatusTooManyRequests ||
+					h.Code == http.StatusRequestTimeout ||
+					h.Code >= 500 {
+					return nil
+				}
+				return geocodingStatusError(h.Code, h.Status)
+			},
+			Redact: g.redact,
+		})
 	if err != nil {
-		return nil, err
-	}
-	if rsp.StatusCode != 200 {
-		rsp.Body.Close()
-		if rsp.StatusCode == 402 {
-			return nil, QuotaError
+		if h, ok := err.(*HTTPError); ok {
+			return nil, geocodingStatusError(h.Code, h.Status)
+		}
+		if _, ok := err.(*url.Error); ok {
+			return nil, &OutageError{Reason: g.redact(err.Error())}
 		}
-		return nil, fmt.Errorf("geocoding failed with %s", rsp.Status)
+		return nil, err
 	}
-	return rsp.Body, nil
+	return r, nil
 }
 
-func shuffle(values []string) {
+func shuffle(r *rand.Rand, values []string) {
 	if len(values) < 2 {
 		return
 	}
 	for i := len(values) - 1; i > 0; i-- {
-		j := rand.Intn(i + 1)
+		j := r.Intn(i + 1)
 		values[i], values[j] = values[j], values[i]
 	}
 }
 
+type sortedGeocodingIds struct {
+	Ids      []string
+	Attempts map[string]*GeocodingAttempt
+}
+
+func (s sortedGeocodingIds) Len() int {
+	return len(s.Ids)
+}
+
+func (s sortedGeocodingIds) Swap(i, j int) {
+	s.Ids[i], s.Ids[j] = s.Ids[j], s.Ids[i]
+}
+
+func (s sortedGeocodingIds) Less(i, j int) bool {
+	var ti, tj time.Time
+	if a := s.Attempts[s.Ids[i]]; a != nil {
+		ti = a.Last
+	}
+	if a := s.Attempts[s.Ids[j]]; a != nil {
+		tj = a.Last
+	}
+	return ti.Before(tj)
+}
+
+// listGeocodingCandidates returns stored offers identifiers in geocoding
+// order: offers never geocoded first, then by last attempt date, so retries
+// rotate fairly across runs. Offers with equal dates are shuffled. Offers
+// whose retry date is after now are skipped, their count is returned.
+func listGeocodingCandidates(store *Store, r *rand.Rand, now time.Time) (
+	[]string, int, error) {
+
+	ids, err := store.List()
+	if err != nil {
+		return nil, 0, err
+	}
+	attempts, err := store.ListGeocodingAttempts()
+	if err != nil {
+		return nil, 0, err
+	}
+	kept := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if a := attempts[id]; a != nil && a.Next.After(now) {
+			continue
+		}
+		kept = append(kept, id)
+	}
+	shuffle(r, kept)
+	sort.Stable(sortedGeocodingIds{
+		Ids:      kept,
+		Attempts: attempts,
+	})
+	return kept, len(ids) - len(kept), nil
+}
+
+const (
+	GeocodingOK       = "ok"
+	GeocodingNoResult = "noresult"
+	GeocodingQuota    = "quota"
+	GeocodingError    = "error"
+)
+
+var (
+	geocodingRetryBase = 6 * time.Hour
+	geocodingRetryMax  = 30 * 24 * time.Hour
+)
+
+// geocodingRetryDelay returns the delay before retrying to geocode an offer
+// after failures consecutive failures.
+func geocodingRetryDelay(failures int) time.Duration {
+	delay := geocodingRetryBase
+	for i := 1; i < failures && delay < geocodingRetryMax; i++ {
+		delay *= 2
+	}
+	if delay > geocodingRetryMax {
+		delay = geocodingRetryMax
+	}
+	return delay
+}
+
+// recordGeocodingAttempt updates offer id geocoding attempt with outcome.
+// Exhausted quotas are not held against the offer.
+func recordGeocodingAttempt(store *Store, id string, now time.Time,
+	outcome string) error {
+
+	attempt, err := store.GetGeocodingAttempt(id)
+	if err != nil {
+		return err
+	}
+	attempt.Last = now
+	attempt.Count++
+	attempt.Outcome = outcome
+	switch outcome {
+	case GeocodingOK:
+		attempt.Failures = 0
+		attempt.Next = time.Time{}
+	case GeocodingQuota:
+		attempt.Next = time.Time{}
+	default:
+		attempt.Failures++
+		attempt.Next = now.Add(geocodingRetryDelay(attempt.Failures))
+	}
+	return store.PutGeocodingAttempt(id, attempt)
+}
+
+// geocodeStoredOffer geocodes a stored offer without location and records
+// the attempt. It returns the offer and its location if any, and whether
+// the quota is exhausted and geocoding should stop. Nil offer is returned
+// for unknown or already located offers.
+func geocodeStoredOffer(store *Store, geocoder *Geocoder, id string,
+	minQuota int) (*Offer, *Location, bool, error) {
+
+	loc, _, err := store.GetLocation(id)
+	if err != nil || loc != nil {
+		return nil, nil, false, err
+	}
+	offer, err := getStoreOffer(store, id)
+	if err != nil || offer == nil {
+		return nil, nil, false, err
+	}
+	pos, _, off, err := geocodeOffer(geocoder, offer.Location, false, minQuota)
+	outcome := GeocodingOK
+	if err != nil {
+		outcome = GeocodingError
+	} else if pos == nil {
+		outcome = GeocodingNoResult
+		if off {
+			outcome = GeocodingQuota
+		}
+	}
+	e := recordGeocodingAttempt(store, id, time.Now(), outcome)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if e != nil {
+		return nil, nil, false, e
+	}
+	return offer, pos, off, nil
+}
+
 var (
 	geocodeCmd = app.Command("geocode", "geocode offers without location")
 )
@@ -445,7 +937,7 @@ func geocode(cfg *Config) error {
 	if key == "" {
 		return fmt.Errorf("geocoding key is not set, please configure APEC_GEOCODING_KEY")
 	}
-	geocoder, err := NewGeocoder(key, cfg.Geocoder())
+	geocoder, err := openGeocoder(cfg)
 	if err != nil {
 		return err
 	}
@@ -457,41 +949,31 @@ func geocode(cfg *Config) error {
 	}
 	defer store.Close()
 
-	ids, err := store.List()
+	ids, skipped, err := listGeocodingCandidates(store,
+		rand.New(rand.NewSource(time.Now().UnixNano())), time.Now())
 	if err != nil {
 		return err
 	}
-	shuffle(ids)
+	fmt.Printf("%d offers skipped until their next geocoding attempt\n", skipped)
+	progress := NewProgress("geocode", len(ids))
 	for _, id := range ids {
-		loc, _, err := store.GetLocation(id)
-		if err != nil {
-			return err
-		}
-		if loc != nil {
-			continue
-		}
-		offer, err := getStoreOffer(store, id)
+		progress.Add(1)
+		offer, pos, stop, err := geocodeStoredOffer(store, geocoder, id, 100)
 		if err != nil {
 			return err
 		}
-		if offer == nil {
-			continue
-		}
-		pos, _, off, err := geocodeOffer(geocoder, offer.Location, false, 100)
-		if err != nil {
-			return err
-		}
-		if pos == nil {
-			continue
+		if pos != nil {
+			err = store.PutLocation(id, pos, offer.Date)
+			if err != nil {
+				return err
+			}
 		}
-		if off {
+		if stop {
+			progress.Printf("geocoding quota exhausted\n")
 			break
 		}
-		err = store.PutLocation(id, pos, offer.Date)
-		if err != nil {
-			return err
-		}
 	}
+	progress.Done()
 	err = store.Close()
 	if err != nil {
 		return err
@@ -2,11 +2,17 @@ package main
 
 import (
 	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/boltdb/bolt"
 	"github.com/pmezard/apec/jstruct"
 	"github.com/pquerna/ffjson/ffjson"
 )
@@ -83,6 +89,83 @@ func TestGeocoderCacheLocation(t *testing.T) {
 	checkCacheLocation(t, cache, "missing", false, nil)
 }
 
+func TestGeocoderNegativeExpiry(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "apec-")
+	if err != nil {
+		t.Fatalf("could not create geocoder cache directory: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	g, err := NewGeocoder("", filepath.Join(tmpDir, "geocoder"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	cache := g.cache
+	addCacheEntry(t, cache, "results-fr", "geo_results.json")
+	addCacheEntry(t, cache, "noresult-fr", "geo_noresult.json")
+	addCacheEntry(t, cache, "legacy-fr", "geo_noresult.json")
+	err = cache.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(geoMissBucket).Delete([]byte("legacy-fr"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	ttl := 30 * 24 * time.Hour
+	tests := []struct {
+		Key     string
+		TTL     time.Duration
+		Now     time.Time
+		Expired bool
+	}{
+		{"results-fr", ttl, now.Add(2 * ttl), false},
+		{"noresult-fr", ttl, now, false},
+		{"noresult-fr", ttl, now.Add(ttl + time.Minute), true},
+		{"noresult-fr", 0, now.Add(2 * ttl), false},
+		{"legacy-fr", ttl, now.Add(2 * ttl), false},
+		{"legacy-fr", 0, now, false},
+		{"missing-fr", ttl, now, false},
+	}
+	for _, test := range tests {
+		expired, err := cache.Expired(test.Key, test.TTL, test.Now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expired != test.Expired {
+			t.Fatalf("%s with %s ttl: expected expired=%v", test.Key, test.TTL,
+				test.Expired)
+		}
+	}
+
+	// Expired entries are not served by the geocoder
+	_, ok, err := g.GetCachedLocation("noresult", "fr")
+	if err != nil || !ok {
+		t.Fatalf("noresult should be cached: %v", err)
+	}
+	_, ok, err = g.GetCachedLocation("legacy", "fr")
+	if err != nil || !ok {
+		t.Fatalf("legacy should be cached: %v", err)
+	}
+
+	// Stamped legacy entries expire
+	stamped, err := cache.StampMisses(now)
+	if err != nil || stamped != 1 {
+		t.Fatalf("unexpected stamped entries: %d, %v", stamped, err)
+	}
+	expired, err := cache.Expired("legacy-fr", ttl, now.Add(ttl+time.Minute))
+	if err != nil || !expired {
+		t.Fatalf("stamped legacy entry did not expire: %v", err)
+	}
+
+	// Results clear expiry information
+	addCacheEntry(t, cache, "noresult-fr", "geo_results.json")
+	expired, err = cache.Expired("noresult-fr", ttl, now.Add(2*ttl))
+	if err != nil || expired {
+		t.Fatalf("located entry expired: %v", err)
+	}
+}
+
 func TestGeocoderNew(t *testing.T) {
 	tmpDir, err := ioutil.TempDir("", "apec-")
 	if err != nil {
@@ -97,3 +180,309 @@ func TestGeocoderNew(t *testing.T) {
 	}
 	g.Close()
 }
+
+func TestGeocoderRetries(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "apec-")
+	if err != nil {
+		t.Fatalf("could not create geocoder cache directory: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	g, err := NewGeocoder("secret", filepath.Join(tmpDir, "geocoder"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	codes := []int{}
+	requests := 0
+	body := `{"status":{"code":200,"message":"OK"},"results":[]}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code := codes[requests%len(codes)]
+		requests++
+		w.WriteHeader(code)
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+	baseURL, sleep := geocodingURL, crawlSleep
+	defer func() {
+		geocodingURL, crawlSleep = baseURL, sleep
+	}()
+	geocodingURL = server.URL
+	sleeps := []time.Duration{}
+	crawlSleep = func(d time.Duration) {
+		sleeps = append(sleeps, d)
+	}
+
+	// Transient failures are retried with backoff
+	codes = []int{500, 502, 200}
+	res, err := g.Geocode("Paris", "fr", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Cached || len(res.Results) != 0 || requests != 3 ||
+		!reflect.DeepEqual(sleeps, []time.Duration{time.Second, 2 * time.Second}) {
+		t.Fatalf("unexpected retries: %+v, %d requests, %v", res, requests, sleeps)
+	}
+
+	// Quota and client errors are not
+	codes, requests = []int{402}, 0
+	_, err = g.Geocode("Lyon", "fr", false)
+	if err != QuotaError || requests != 1 {
+		t.Fatalf("expected quota error after 1 request, got %v after %d",
+			err, requests)
+	}
+	codes, requests = []int{401}, 0
+	_, err = g.Geocode("Lyon", "fr", false)
+	if err != KeyError || requests != 1 {
+		t.Fatalf("expected key error after 1 request, got %v after %d", err,
+			requests)
+	}
+
+	// Error documents are not cached
+	codes, requests = []int{200}, 0
+	body = `{"status":{"code":402,"message":"quota exceeded"}}`
+	_, err = g.Geocode("Brest", "fr", false)
+	if err != QuotaError {
+		t.Fatalf("expected quota error, got %v", err)
+	}
+	_, ok, err := g.GetCachedLocation("Brest", "fr")
+	if err != nil || ok {
+		t.Fatalf("error document was cached: %v", err)
+	}
+
+	// Persistent failures give up without leaking the key
+	codes, requests = []int{503}, 0
+	_, err = g.Geocode("Lyon", "fr", false)
+	if _, ok := err.(*OutageError); !ok || requests != geocodingLoops ||
+		strings.Contains(err.Error(), "secret") {
+		t.Fatalf("unexpected error after %d requests: %v", requests, err)
+	}
+}
+
+func TestParseGeocoding(t *testing.T) {
+	results, err := ioutil.ReadFile("testdata/geo_results.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := parseGeocoding(results)
+	if err != nil || len(res.Results) == 0 || res.Rate.Limit != 2500 {
+		t.Fatalf("unexpected parsed results: %+v, %v", res, err)
+	}
+	tests := []struct {
+		Data  string
+		Error string
+	}{
+		{`{"status":{"code":200},"results":[]}`, ""},
+		{`{"status":{"code":402,"message":"quota exceeded"},"results":[]}`,
+			"quota"},
+		{`{"status":{"code":403,"message":"disabled"},"results":[]}`, "key"},
+		{`{"status":{"code":503,"message":"down"}}`, "outage"},
+		{`{"status":{"code":400,"message":"bad query"}}`, "other"},
+		{`{"results":[]}`, "response"},
+		{`{"status":{"code":200},"results":null}`, "response"},
+		{`{"status":{"code":200}}`, "response"},
+		{`<html>`, "response"},
+	}
+	for _, test := range tests {
+		res, err := parseGeocoding([]byte(test.Data))
+		kind := ""
+		switch err.(type) {
+		case nil:
+		case *OutageError:
+			kind = "outage"
+		case *ResponseError:
+			kind = "response"
+		default:
+			kind = "other"
+			if err == QuotaError {
+				kind = "quota"
+			} else if err == KeyError {
+				kind = "key"
+			}
+		}
+		if kind != test.Error {
+			t.Fatalf("%s: expected %q error, got %v", test.Data, test.Error, err)
+		}
+		if err == nil && (res == nil || res.Results == nil || res.Rate.Limit != 0) {
+			t.Fatalf("%s: unexpected result: %+v", test.Data, res)
+		}
+	}
+}
+
+func TestGeocodingCandidatesOrder(t *testing.T) {
+	store := openTempStore(t)
+	defer closeAndDeleteStore(t, store)
+
+	for _, id := range []string{"1", "2", "3", "4", "5"} {
+		err := store.Put(id, []byte("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	for i, id := range []string{"4", "2"} {
+		err := store.PutGeocodingAttempt(id, &GeocodingAttempt{
+			Last: now.Add(time.Duration(i) * time.Hour),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	orders := map[string]bool{}
+	for seed := int64(0); seed < 20; seed++ {
+		ids, _, err := listGeocodingCandidates(store, rand.New(rand.NewSource(seed)),
+			now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ids) != 5 || ids[3] != "4" || ids[4] != "2" {
+			t.Fatalf("unexpected geocoding order: %v", ids)
+		}
+		orders[strings.Join(ids[:3], ",")] = true
+	}
+	if len(orders) < 2 {
+		t.Fatalf("never attempted offers were not shuffled: %v", orders)
+	}
+}
+
+func TestGeocodingAttemptRetries(t *testing.T) {
+	store := openTempStore(t)
+	defer closeAndDeleteStore(t, store)
+
+	err := store.Put("1", []byte("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		Outcome  string
+		Failures int
+		Delay    time.Duration
+	}{
+		{GeocodingNoResult, 1, 6 * time.Hour},
+		{GeocodingError, 2, 12 * time.Hour},
+		{GeocodingQuota, 2, 0},
+		{GeocodingNoResult, 3, 24 * time.Hour},
+		{GeocodingOK, 0, 0},
+	}
+	for i, test := range tests {
+		err = recordGeocodingAttempt(store, "1", now, test.Outcome)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, err := store.GetGeocodingAttempt("1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a.Count != i+1 || a.Outcome != test.Outcome || a.Failures != test.Failures {
+			t.Fatalf("unexpected attempt after %s: %+v", test.Outcome, a)
+		}
+		if test.Delay == 0 && !a.Next.IsZero() ||
+			test.Delay != 0 && !a.Next.Equal(now.Add(test.Delay)) {
+			t.Fatalf("unexpected next attempt after %s: %s", test.Outcome, a.Next)
+		}
+		ids, skipped, err := listGeocodingCandidates(store,
+			rand.New(rand.NewSource(0)), now.Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (test.Delay == 0) != (len(ids) == 1 && skipped == 0) {
+			t.Fatalf("unexpected candidates after %s: %v, %d skipped",
+				test.Outcome, ids, skipped)
+		}
+	}
+	if d := geocodingRetryDelay(20); d != geocodingRetryMax {
+		t.Fatalf("retry delay is not capped: %s", d)
+	}
+}
+
+func TestMakeKeyAndCountryCode(t *testing.T) {
+	for _, test := range []struct {
+		Query    string
+		Code     string
+		Fold     bool
+		Expected string
+	}{
+		{"paris", "fr", false, "paris-fr"},
+		{" Vélizy  Villacoublay ", "FR", false, "vélizy villacoublay-fr"},
+		// NFD input
+		{"Ve\u0301lizy", "fr", false, "vélizy-fr"},
+		{"Vélizy", "fr", true, "velizy-fr"},
+		{"saint-denis", "", false, "saint-denis-unk"},
+	} {
+		key, _ := makeKeyAndCountryCode(test.Query, test.Code, test.Fold)
+		if key != test.Expected {
+			t.Fatalf("%q, %q: expected %q, got %q", test.Query, test.Code,
+				test.Expected, key)
+		}
+	}
+}
+
+func TestUpgradeGeocoderKeys(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "apec-")
+	if err != nil {
+		t.Fatalf("could not create geocoder cache directory: %s", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "geocoder")
+
+	cache, err := OpenCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addCacheEntry(t, cache, "Vélizy-fr", "geo_noresult.json")
+	addCacheEntry(t, cache, "vélizy -fr", "geo_results.json")
+	addCacheEntry(t, cache, "velizy-fr", "geo_noresult.json")
+	addCacheEntry(t, cache, "Paris-fr", "geo_results.json")
+	err = cache.SetVersion(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Close()
+
+	checkKeys := func(expected string) *Cache {
+		cache, err := OpenCache(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys, err := cache.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := strings.Join(keys, ","); s != expected {
+			t.Fatalf("expected %s keys, got %s", expected, s)
+		}
+		return cache
+	}
+
+	// Located entries are kept over ones without result
+	err = upgradeGeocoderCache(path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache = checkKeys("paris-fr,velizy-fr,vélizy-fr")
+	loc, _, err := cache.GetLocation("vélizy-fr")
+	if err != nil || loc == nil {
+		t.Fatalf("vélizy should be located: %v", err)
+	}
+	version, err := cache.Version()
+	if err != nil || version != geocoderVersion {
+		t.Fatalf("unexpected version %d: %v", version, err)
+	}
+	cache.Close()
+
+	err = upgradeGeocoderCache(path, "fold")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache = checkKeys("paris-fr,velizy-fr")
+	defer cache.Close()
+	loc, _, err = cache.GetLocation("velizy-fr")
+	if err != nil || loc == nil || !cache.foldAccents {
+		t.Fatalf("velizy should be located: %v", err)
+	}
+	key, _ := cache.makeKey("Vélizy", "fr")
+	if key != "velizy-fr" {
+		t.Fatalf("unexpected folded key: %s", key)
+	}
+}
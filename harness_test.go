@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/pmezard/apec/jstruct"
+)
+
+// testEnv is a temporary data directory populated with the fixture corpus
+// of testdata/fixtures: offers are stored, geocoded from fixture geocoder
+// cache entries, then indexed in the full text and spatial indexes.
+type testEnv struct {
+	t          testing.TB
+	Config     *Config
+	Store      *Store
+	Index      bleve.Index
+	Deleted    *DeletedIndex
+	Spatial    *SpatialIndex
+	Geocoder   *Geocoder
+	Router     *Router
+	Templates  *Templates
+	Results    *ResultSets
+	Exports    *ExportJobs
+	Generation *IndexGeneration
+	Cache      *QueryCache
+	Facets     *FacetCache
+	Images     *BytesCache
+	Limits     SearchLimits
+	Fields     []SearchField
+	// Corrects search page queries when set
+	Speller *Speller
+	Backend string
+}
+
+type geocoderFixture struct {
+	Query  string          `json:"query"`
+	Result json.RawMessage `json:"result"`
+}
+
+func readFixture(t testing.TB, name string, output interface{}) {
+	path := filepath.Join("testdata", "fixtures", name)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("could not read fixture %s: %s", path, err)
+	}
+	err = json.Unmarshal(data, output)
+	if err != nil {
+		t.Fatalf("could not decode fixture %s: %s", path, err)
+	}
+}
+
+func newTestEnv(t testing.TB) *testEnv {
+	dir, err := ioutil.TempDir("", "apec-")
+	if err != nil {
+		t.Fatalf("could not create data directory: %s", err)
+	}
+	env := &testEnv{
+		t:      t,
+		Config: NewConfig(dir),
+	}
+	ok := false
+	defer func() {
+		if !ok {
+			env.Close()
+		}
+	}()
+	env.Store, err = OpenStore(env.Config.Store())
+	if err != nil {
+		t.Fatalf("could not open store: %s", err)
+	}
+	env.Geocoder, err = NewGeocoder("", env.Config.Geocoder())
+	if err != nil {
+		t.Fatalf("could not open geocoder: %s", err)
+	}
+	env.Router, err = NewRouter("", env.Config.Routing())
+	if err != nil {
+		t.Fatalf("could not open router: %s", err)
+	}
+	env.Index, err = NewOfferIndex(env.Config.Index())
+	if err != nil {
+		t.Fatalf("could not create index: %s", err)
+	}
+	env.Deleted = NewDeletedIndex(env.Config.DeletedIndex())
+	env.Templates, err = loadTemplates(env.Config.TemplatesDir)
+	if err != nil {
+		t.Fatalf("could not load templates: %s", err)
+	}
+	env.Spatial = NewSpatialIndex()
+	env.Results = NewResultSets(100, time.Hour)
+	env.Exports, err = NewExportJobs(1000, 2, time.Hour)
+	if err != nil {
+		t.Fatalf("could not create export jobs: %s", err)
+	}
+	env.Generation = &IndexGeneration{}
+	env.Cache = NewQueryCache(env.Generation, 100)
+	env.Facets = NewFacetCache(env.Generation, 100)
+	env.Images = NewBytesCache(env.Generation, 100)
+	env.Limits = defaultSearchLimits
+	env.Backend = spatialRTree
+
+	// Fill the geocoder cache, so geocoding never hits the network
+	geocoded := []geocoderFixture{}
+	readFixture(t, "geocoder.json", &geocoded)
+	for _, g := range geocoded {
+		loc := &jstruct.Location{}
+		err = json.Unmarshal(g.Result, loc)
+		if err != nil {
+			t.Fatalf("could not decode %s location: %s", g.Query, err)
+		}
+		key, _ := env.Geocoder.cache.makeKey(g.Query, "fr")
+		err = env.Geocoder.cache.Put(key, g.Result, buildLocation(loc))
+		if err != nil {
+			t.Fatalf("could not cache %s location: %s", g.Query, err)
+		}
+	}
+
+	offers := []json.RawMessage{}
+	readFixture(t, "offers.json", &offers)
+	for _, data := range offers {
+		js := &jstruct.JsonOffer{}
+		err = json.Unmarshal(data, js)
+		if err != nil {
+			t.Fatalf("could not decode offer: %s", err)
+		}
+		err = env.Store.Put(makeOfferId(apecSource, js.Id), data)
+		if err != nil {
+			t.Fatalf("could not store %s: %s", js.Id, err)
+		}
+	}
+	env.Reindex()
+	ok = true
+	return env
+}
+
+// Reindex geocodes stored offers and rebuilds full text and spatial indexes
+// from scratch.
+func (env *testEnv) Reindex() {
+	t := env.t
+	rawOffers, err := loadOffers(env.Store)
+	if err != nil {
+		t.Fatalf("could not load offers: %s", err)
+	}
+	offers, err := convertOffers(rawOffers)
+	if err != nil {
+		t.Fatalf("could not convert offers: %s", err)
+	}
+	_, err = geocodeOffers(env.Store, env.Geocoder, offers, 0)
+	if err != nil {
+		t.Fatalf("could not geocode offers: %s", err)
+	}
+	for _, id := range env.Spatial.List() {
+		env.Spatial.Remove(id)
+	}
+	for _, offer := range offers {
+		err = setOfferGeo(env.Store, offer)
+		if err != nil {
+			t.Fatalf("could not set %s geopoint: %s", offer.Id, err)
+		}
+		err = setOfferArea(env.Store, nil, offer)
+		if err != nil {
+			t.Fatalf("could not set %s area: %s", offer.Id, err)
+		}
+		prepareIndexedOffer(offer, IndexOptions{})
+		err = env.Index.Index(offer.Id, offer)
+		if err != nil {
+			t.Fatalf("could not index %s: %s", offer.Id, err)
+		}
+		loc, err := getOfferLocation(env.Store, env.Geocoder, offer.Id)
+		if err != nil {
+			t.Fatalf("could not get %s location: %s", offer.Id, err)
+		}
+		if loc != nil {
+			env.Spatial.Add(loc)
+		}
+	}
+	env.Generation.Bump()
+}
+
+func (env *testEnv) Close() {
+	if env.Exports != nil {
+		env.Exports.Close()
+	}
+	if env.Index != nil {
+		env.Index.Close()
+	}
+	if env.Deleted != nil {
+		env.Deleted.Close()
+	}
+	if env.Router != nil {
+		env.Router.Close()
+	}
+	if env.Geocoder != nil {
+		env.Geocoder.Close()
+	}
+	if env.Store != nil {
+		env.Store.Close()
+	}
+	os.RemoveAll(env.Config.RootDir)
+}
+
+// Get calls handler on a GET request for path with supplied query parameters.
+func (env *testEnv) Get(handler http.HandlerFunc, path string,
+	values url.Values) *httptest.ResponseRecorder {
+
+	u := path
+	if len(values) > 0 {
+		u += "?" + values.Encode()
+	}
+	rq := httptest.NewRequest("GET", u, nil)
+	w := httptest.NewRecorder()
+	handler(w, rq)
+	return w
+}
+
+// Query runs a search like the public search page does.
+func (env *testEnv) Query(what, where string) *httptest.ResponseRecorder {
+	values := url.Values{}
+	if what != "" {
+		values.Set("what", what)
+	}
+	if where != "" {
+		values.Set("where", where)
+	}
+	return env.QueryValues(values)
+}
+
+// QueryValues runs a search with arbitrary search page parameters.
+func (env *testEnv) QueryValues(values url.Values) *httptest.ResponseRecorder {
+	return env.Get(func(w http.ResponseWriter, r *http.Request) {
+		handleQuery(env.SearchContext(), w, r)
+	}, "/search", values)
+}
+
+// SearchContext returns the dependencies of search pages, in UTC.
+func (env *testEnv) SearchContext() *SearchContext {
+	return &SearchContext{
+		Templates: env.Templates,
+		Replica: &Replica{
+			Store:    env.Store,
+			Index:    NewIndexHolder(env.Index),
+			Spatial:  env.Spatial,
+			Geocoder: env.Geocoder,
+			Deleted:  env.Deleted,
+		},
+		Router:  env.Router,
+		Results: env.Results,
+		Cache:   env.Cache,
+		Facets:  env.Facets,
+		Limits:  env.Limits,
+		Fields:  env.Fields,
+		Speller: env.Speller,
+		Backend: env.Backend,
+		Loc:     time.UTC,
+	}
+}
+
+// Export exports search results like the public export handler does.
+func (env *testEnv) Export(values url.Values) *httptest.ResponseRecorder {
+	return env.Get(func(w http.ResponseWriter, r *http.Request) {
+		handleExport(env.SearchContext(), env.Exports, nil, w, r)
+	}, "/export", values)
+}
+
+// SearchAPI searches offers like the public JSON search handler does.
+func (env *testEnv) SearchAPI(values url.Values) *httptest.ResponseRecorder {
+	return env.Get(func(w http.ResponseWriter, r *http.Request) {
+		handleSearchAPI(env.SearchContext(), w, r)
+	}, "/api/search", values)
+}
+
+// DensityMap renders the density map of offers matching what.
+func (env *testEnv) DensityMap(what string, size int) *httptest.ResponseRecorder {
+	values := url.Values{}
+	if what != "" {
+		values.Set("what", what)
+	}
+	values.Set("size", strconv.Itoa(size))
+	return env.Get(func(w http.ResponseWriter, r *http.Request) {
+		err := handleDensityMap(env.Templates, env.Store, env.Index, env.Spatial,
+			makeFranceBox(), nil, env.Images, w, r)
+		if err != nil {
+			env.t.Fatalf("density map failed: %s", err)
+		}
+	}, "/densitymap", values)
+}
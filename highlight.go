@@ -0,0 +1,46 @@
+package main
+
+import (
+	"html/template"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search/highlight/highlighter/html"
+)
+
+// Search results display a snippet of their description, with the terms
+// matched by the text query highlighted. Descriptions plain text is stored
+// in the snippetField of the full text index. Indexes built before schema
+// version 10 have no snippets.
+
+const snippetField = "text"
+
+// highlightOffers returns the snippets of the descriptions of offers ids
+// matching the text query what, keyed by identifier. Offers matched on
+// other fields only have none.
+func highlightOffers(index bleve.Index, what string, ids []string) (
+	map[string]template.HTML, error) {
+
+	if index == nil || what == "" || len(ids) == 0 {
+		return nil, nil
+	}
+	q, err := makeSearchQuery(what, ids, []SearchField{{Name: snippetField}})
+	if err != nil {
+		return nil, err
+	}
+	rq := bleve.NewSearchRequestOptions(q, len(ids), 0, false)
+	rq.Highlight = bleve.NewHighlightWithStyle(html.Name)
+	rq.Highlight.AddField(snippetField)
+	res, err := index.Search(rq)
+	if err != nil {
+		return nil, err
+	}
+	snippets := map[string]template.HTML{}
+	for _, hit := range res.Hits {
+		fragments := hit.Fragments[snippetField]
+		if len(fragments) > 0 {
+			// Fragments are escaped by the highlighter
+			snippets[hit.ID] = template.HTML(fragments[0])
+		}
+	}
+	return snippets, nil
+}
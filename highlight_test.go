@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestHighlightOffers(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	snippets, err := highlightOffers(env.Index, "python",
+		[]string{"apec:1001", "apec:1003"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snippets) != 1 || !strings.Contains(string(snippets["apec:1001"]),
+		"en golang et <mark>python</mark>.") {
+		t.Fatalf("unexpected snippets: %v", snippets)
+	}
+
+	w := env.QueryValues(url.Values{"what": {"golang"}})
+	body := w.Body.String()
+	if w.Code != 200 || !strings.Contains(body,
+		`<div class="snippet">Vous développerez des services en <mark>golang</mark>`) {
+		t.Fatalf("snippet not found: %d %s", w.Code, body)
+	}
+	// Location only searches have no snippet
+	w = env.QueryValues(url.Values{"where": {"paris"}})
+	if strings.Contains(w.Body.String(), `class="snippet"`) {
+		t.Fatalf("unexpected snippets: %s", w.Body.String())
+	}
+}
@@ -1,5 +1,15 @@
 package main
 
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/blevesearch/bleve"
+)
+
 type TermCount struct {
 	Term  string
 	Count uint64
@@ -66,67 +76,151 @@ var (
 	indexStatsCmd = app.Command("indexstats",
 		`collect and display full text index statistics
 
-Each output line contains statistics about a bleve index row type. See:
+Each output line contains statistics about a bleve index row type, then term
+and dictionary rows are detailed by field. See:
 
   http://www.blevesearch.com/docs/Index-Structure/
 
-For more details about bleve index structure.
+For more details about bleve index structure. Use the "index" section of
+search.json to reduce the index footprint.
 `)
 	indexPathArg = indexStatsCmd.Arg("path", "index path").String()
 )
 
-func indexStatsFn(cfg *Config) error {
-	return nil
-	/*
-		path := *indexPathArg
-		if path == "" {
-			path = cfg.Index()
+type RowStats struct {
+	Count int
+	Size  int
+}
+
+func (s *RowStats) Add(key, value []byte) {
+	s.Count++
+	s.Size += len(key) + len(value)
+}
+
+// IndexStats accounts bleve upsidedown rows by type, and term and dictionary
+// rows by field.
+type IndexStats struct {
+	Kinds  map[byte]*RowStats
+	Fields map[string]*RowStats
+	Total  RowStats
+	// On-disk size of the index directory
+	DiskSize int64
+}
+
+func collectIndexStats(index bleve.Index) (*IndexStats, error) {
+	_, kv, err := index.Advanced()
+	if err != nil {
+		return nil, err
+	}
+	reader, err := kv.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	// Field rows are 'f' + uint16 index -> name + 0xff
+	names := map[uint16]string{}
+	it := reader.PrefixIterator([]byte{'f'})
+	for ; it.Valid(); it.Next() {
+		key, value, _ := it.Current()
+		if len(key) == 3 && len(value) > 0 {
+			names[binary.LittleEndian.Uint16(key[1:])] = string(value[:len(value)-1])
 		}
-		index, err := OpenOfferIndex(path)
-		if err != nil {
-			return err
+	}
+	err = it.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &IndexStats{
+		Kinds:  map[byte]*RowStats{},
+		Fields: map[string]*RowStats{},
+	}
+	it = reader.RangeIterator(nil, nil)
+	defer it.Close()
+	for ; it.Valid(); it.Next() {
+		key, value, _ := it.Current()
+		if len(key) == 0 {
+			continue
 		}
-		kinds := map[byte]struct {
-			Count int
-			Size  int
-		}{}
-		unknown := 0
-		rows := index.DumpAll()
-		var failed error
-		for item := range rows {
-			if failed != nil {
-				continue
-			}
-			switch item.(type) {
-			case error:
-				failed = item.(error)
-			case upsidedown.UpsideDownCouchRow:
-				row := item.(upsidedown.UpsideDownCouchRow)
-				key := row.Key()
-				st := kinds[key[0]]
-				st.Count++
-				st.Size += row.KeySize() + row.ValueSize()
-				kinds[key[0]] = st
-			default:
-				unknown++
-			}
+		kind := stats.Kinds[key[0]]
+		if kind == nil {
+			kind = &RowStats{}
+			stats.Kinds[key[0]] = kind
 		}
-		totalCount := 0
-		totalSize := 0
-		for i := 0; i < 256; i++ {
-			st, ok := kinds[byte(i)]
+		kind.Add(key, value)
+		stats.Total.Add(key, value)
+		// Term frequency and dictionary rows keys start with the field index
+		if (key[0] == 't' || key[0] == 'd') && len(key) >= 3 {
+			name, ok := names[binary.LittleEndian.Uint16(key[1:3])]
 			if !ok {
-				continue
+				name = "unknown"
+			}
+			field := stats.Fields[name]
+			if field == nil {
+				field = &RowStats{}
+				stats.Fields[name] = field
 			}
-			fmt.Printf("%s: count: %d, size: %.1fkB\n", string([]byte{byte(i)}),
-				st.Count, float64(st.Size)/1024.)
-			totalCount += st.Count
-			totalSize += st.Size
+			field.Add(key, value)
 		}
-		fmt.Printf("total: count: %d, size: %.1fkB\n", totalCount, float64(totalSize)/1024.)
-		if unknown > 0 {
-			fmt.Printf("unknown rows: %d\n", unknown)
+	}
+	return stats, nil
+}
+
+func dirSize(path string) (int64, error) {
+	size := int64(0)
+	err := filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			size += fi.Size()
 		}
 		return nil
-	*/
+	})
+	return size, err
+}
+
+func indexStatsFn(cfg *Config) error {
+	path := *indexPathArg
+	if path == "" {
+		path = cfg.Index()
+	}
+	index, err := OpenOfferIndex(path)
+	if err != nil {
+		return err
+	}
+	defer index.Close()
+	stats, err := collectIndexStats(index)
+	if err != nil {
+		return err
+	}
+	stats.DiskSize, err = dirSize(path)
+	if err != nil {
+		return err
+	}
+	kb := func(n int) float64 {
+		return float64(n) / 1024.
+	}
+	for i := 0; i < 256; i++ {
+		st, ok := stats.Kinds[byte(i)]
+		if !ok {
+			continue
+		}
+		fmt.Printf("%s: count: %d, size: %.1fkB\n", string([]byte{byte(i)}),
+			st.Count, kb(st.Size))
+	}
+	fmt.Printf("total: count: %d, size: %.1fkB\n", stats.Total.Count,
+		kb(stats.Total.Size))
+	fields := []string{}
+	for name := range stats.Fields {
+		fields = append(fields, name)
+	}
+	sort.Strings(fields)
+	for _, name := range fields {
+		st := stats.Fields[name]
+		fmt.Printf("field %s: terms: %d, size: %.1fkB\n", name, st.Count, kb(st.Size))
+	}
+	fmt.Printf("disk: %.1fkB\n", float64(stats.DiskSize)/1024.)
+	return nil
 }
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/pmezard/apec/jstruct"
+)
+
+const (
+	offerDateLayout = "2006-01-02T15:04:05.000+0000"
+)
+
+// listOffersAsOf reconstructs the set of offers which were active on
+// specified day, from live offers and deleted offer records. An offer is
+// active if it was published before the end of the day and not deleted
+// before the day started. If several versions of an offer match, the most
+// recent one is returned.
+func listOffersAsOf(store *Store, day time.Time) ([]*jstruct.JsonOffer, error) {
+	start := day
+	end := day.Add(24 * time.Hour)
+	active := map[string]*jstruct.JsonOffer{}
+	err := enumerateStoredOffers(store, func(offer *jstruct.JsonOffer,
+		do *DeletedOffer) error {
+
+		published, err := time.Parse(offerDateLayout, offer.Date)
+		if err != nil {
+			return fmt.Errorf("cannot parse %s publication date: %s", offer.Id, err)
+		}
+		if !published.Before(end) {
+			return nil
+		}
+		if do != nil {
+			deleted, err := time.Parse(time.RFC3339, do.Date)
+			if err != nil {
+				return fmt.Errorf("cannot parse %s deletion date: %s", offer.Id, err)
+			}
+			if deleted.Before(start) {
+				return nil
+			}
+		}
+		// Deleted offers are enumerated first, live ones override them
+		active[offer.Id] = offer
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	offers := make([]*jstruct.JsonOffer, 0, len(active))
+	for _, offer := range active {
+		offers = append(offers, offer)
+	}
+	return offers, nil
+}
+
+// snapshotName returns the file name of the snapshot taken during ISO week
+// of year.
+func snapshotName(year, week int) string {
+	return fmt.Sprintf("offers-%04d-W%02d", year, week)
+}
+
+// isoWeekStart returns the Monday starting ISO week of year, in UTC.
+func isoWeekStart(year, week int) time.Time {
+	// January 4th is always in the first week
+	jan4 := time.Date(year, 1, 4, 0, 0, 0, 0, time.UTC)
+	monday := jan4.AddDate(0, 0, -((int(jan4.Weekday()) + 6) % 7))
+	return monday.AddDate(0, 0, 7*(week-1))
+}
+
+// listSnapshots returns the paths of the snapshots of dir, in name order.
+func listSnapshots(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	paths := []string{}
+	for _, e := range entries {
+		year, week := 0, 0
+		n, err := fmt.Sscanf(e.Name(), "offers-%d-W%d", &year, &week)
+		if err != nil || n != 2 || e.Name() != snapshotName(year, week) {
+			continue
+		}
+		paths = append(paths, filepath.Join(dir, e.Name()))
+	}
+	return paths, nil
+}
+
+// findSnapshotAfter returns the path of the earliest snapshot in dir taken
+// after day ended, or an empty string if there is none.
+func findSnapshotAfter(dir string, day time.Time) (string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	end := day.Add(24 * time.Hour)
+	found := ""
+	var foundStart time.Time
+	for _, e := range entries {
+		year, week := 0, 0
+		n, err := fmt.Sscanf(e.Name(), "offers-%d-W%d", &year, &week)
+		if err != nil || n != 2 || e.Name() != snapshotName(year, week) {
+			continue
+		}
+		// The snapshot was taken sometime during the week
+		start := isoWeekStart(year, week)
+		if start.Before(end) {
+			continue
+		}
+		if found == "" || start.Before(foundStart) {
+			found = filepath.Join(dir, e.Name())
+			foundStart = start
+		}
+	}
+	return found, nil
+}
+
+// listArchivedOffersAsOf works like listOffersAsOf, and also returns offers
+// active on day from the earliest snapshot of snapshotsDir taken after it,
+// so offers pruned from the live store since are still listed.
+// Live offers versions take precedence.
+func listArchivedOffersAsOf(store *Store, snapshotsDir string,
+	day time.Time) ([]*jstruct.JsonOffer, error) {
+
+	offers, err := listOffersAsOf(store, day)
+	if err != nil {
+		return nil, err
+	}
+	path, err := findSnapshotAfter(snapshotsDir, day)
+	if err != nil || path == "" {
+		return offers, err
+	}
+	snapshot, err := OpenStoreReadOnly(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open snapshot %s: %s", path, err)
+	}
+	defer snapshot.Close()
+	archived, err := listOffersAsOf(snapshot, day)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	for _, offer := range offers {
+		seen[offer.Id] = true
+	}
+	for _, offer := range archived {
+		if !seen[offer.Id] {
+			offers = append(offers, offer)
+		}
+	}
+	return offers, nil
+}
+
+// newMemOfferIndex returns an in-memory index of supplied offers, using the
+// regular offer mapping.
+func newMemOfferIndex(offers []*jstruct.JsonOffer) (bleve.Index, error) {
+	m, err := NewOfferMapping()
+	if err != nil {
+		return nil, err
+	}
+	index, err := bleve.NewMemOnly(m)
+	if err != nil {
+		return nil, err
+	}
+	converted, err := convertOffers(offers)
+	if err != nil {
+		index.Close()
+		return nil, err
+	}
+	batch := index.NewBatch()
+	for _, offer := range converted {
+		err = batch.Index(offer.Id, offer)
+		if err != nil {
+			index.Close()
+			return nil, err
+		}
+	}
+	err = index.Batch(batch)
+	if err != nil {
+		index.Close()
+		return nil, err
+	}
+	return index, nil
+}
+
+func parseDay(s string) (time.Time, error) {
+	d, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q, expected YYYY-MM-DD", s)
+	}
+	return d, nil
+}
+
+var (
+	snapshotCmd = app.Command("snapshot", `archive a compacted copy of the store
+
+Snapshots are named after the ISO week they were taken, only the first one is
+kept for a given week unless --force is passed. Combined with deleted offers
+records, they allow longitudinal studies even if the live store is damaged or
+pruned.
+`)
+	snapshotForce = snapshotCmd.Flag("force", "replace existing snapshot for this week").
+			Bool()
+)
+
+func snapshotFn(cfg *Config) error {
+	store, err := OpenStore(cfg.Store())
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	err = os.MkdirAll(cfg.Snapshots(), 0755)
+	if err != nil {
+		return err
+	}
+	year, week := time.Now().ISOWeek()
+	path := filepath.Join(cfg.Snapshots(), snapshotName(year, week))
+	exists, err := isFile(path)
+	if err != nil {
+		return err
+	}
+	if exists {
+		if !*snapshotForce {
+			fmt.Printf("snapshot %s already exists\n", path)
+			return nil
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return err
+		}
+	}
+	start := time.Now()
+	tmpPath := path + ".tmp"
+	os.Remove(tmpPath)
+	err = store.Compact(tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("snapshot written to %s in %s\n", path, ftime(time.Since(start)))
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func putTestOffer(t *testing.T, store *Store, id, date string) {
+	data := []byte(fmt.Sprintf(`{"numeroOffre":%q,"intitule":"offer %s",`+
+		`"datePublication":%q}`, id, id, date))
+	err := store.Put(id, data)
+	if err != nil {
+		t.Fatalf("could not store %s: %s", id, err)
+	}
+}
+
+func TestListOffersAsOf(t *testing.T) {
+	store := openTempStore(t)
+	defer closeAndDeleteStore(t, store)
+
+	putTestOffer(t, store, "1", "2017-01-01T10:00:00.000+0000")
+	putTestOffer(t, store, "2", "2017-01-05T10:00:00.000+0000")
+	deletion, _ := time.Parse(time.RFC3339, "2017-01-10T08:00:00Z")
+	_, err := store.Delete("1", deletion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		Day      string
+		Expected []string
+	}{
+		{"2016-12-31", []string{}},
+		{"2017-01-03", []string{"1"}},
+		{"2017-01-06", []string{"1", "2"}},
+		{"2017-01-10", []string{"1", "2"}},
+		{"2017-01-11", []string{"2"}},
+	}
+	for _, test := range tests {
+		day, err := parseDay(test.Day)
+		if err != nil {
+			t.Fatal(err)
+		}
+		offers, err := listOffersAsOf(store, day)
+		if err != nil {
+			t.Fatalf("could not list offers as of %s: %s", test.Day, err)
+		}
+		ids := []string{}
+		for _, o := range offers {
+			ids = append(ids, o.Id)
+		}
+		sort.Strings(ids)
+		if fmt.Sprint(ids) != fmt.Sprint(test.Expected) {
+			t.Fatalf("unexpected offers as of %s: %v != %v", test.Day, ids,
+				test.Expected)
+		}
+	}
+}
+
+func TestIsoWeekStart(t *testing.T) {
+	for _, test := range []struct {
+		Year, Week int
+		Expected   string
+	}{
+		{2017, 1, "2017-01-02"},
+		{2017, 2, "2017-01-09"},
+		{2020, 53, "2020-12-28"},
+		{2021, 1, "2021-01-04"},
+	} {
+		start := isoWeekStart(test.Year, test.Week)
+		if s := start.Format("2006-01-02"); s != test.Expected {
+			t.Fatalf("%d-W%02d: expected %s, got %s", test.Year, test.Week,
+				test.Expected, s)
+		}
+		year, week := start.ISOWeek()
+		if year != test.Year || week != test.Week {
+			t.Fatalf("%d-W%02d: start is in %d-W%02d", test.Year, test.Week,
+				year, week)
+		}
+	}
+}
+
+func TestListArchivedOffersAsOf(t *testing.T) {
+	archived := openTempStore(t)
+	defer closeAndDeleteStore(t, archived)
+	putTestOffer(t, archived, "1", "2017-01-01T10:00:00.000+0000")
+	putTestOffer(t, archived, "3", "2017-01-02T10:00:00.000+0000")
+
+	// Offers 1 and 3 were pruned from the live store after the snapshot
+	store := openTempStore(t)
+	defer closeAndDeleteStore(t, store)
+	putTestOffer(t, store, "2", "2017-01-05T10:00:00.000+0000")
+
+	dir, err := ioutil.TempDir("", "apec-snapshots-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = archived.Compact(filepath.Join(dir, snapshotName(2017, 2)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "offers-2017-W02.tmp"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		Day      string
+		Expected []string
+	}{
+		{"2017-01-06", []string{"1", "2", "3"}},
+		// The snapshot may have been taken on Monday, before the day ended
+		{"2017-01-09", []string{"2"}},
+	} {
+		day, err := parseDay(test.Day)
+		if err != nil {
+			t.Fatal(err)
+		}
+		offers, err := listArchivedOffersAsOf(store, dir, day)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := []string{}
+		for _, o := range offers {
+			ids = append(ids, o.Id)
+		}
+		sort.Strings(ids)
+		if fmt.Sprint(ids) != fmt.Sprint(test.Expected) {
+			t.Fatalf("unexpected offers as of %s: %v != %v", test.Day, ids,
+				test.Expected)
+		}
+	}
+
+	day, err := parseDay("2017-01-06")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deletion, _ := time.Parse(time.RFC3339, "2017-01-08T08:00:00Z")
+	_, err = store.Delete("2", deletion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := collectDatasetStatsAsOf(store, dir, day, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Offers != 3 || stats.Deletions != 0 || stats.Indexed != -1 ||
+		fmt.Sprint(stats.Monthly) != "[{2017-01 3}]" {
+		t.Fatalf("unexpected stats as of %s: %+v", day, stats)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// getOfferHTML returns the public HTML page of an offer. Like getOffer, it
+// returns nil without an error if the offer does not exist.
+func getOfferHTML(id string) ([]byte, error) {
+	_, apecId := splitOfferId(id)
+	output, err := tryHTTP(ApecURL+apecId, time.Second, 5, nil)
+	if err != nil {
+		if h, ok := err.(*HTTPError); ok && h.Code == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer output.Close()
+	return ioutil.ReadAll(output)
+}
+
+// crawlOfferHTML fetches and stores the HTML page of an offer unless it was
+// already fetched. The JSON webservice remains the primary source, failures
+// are reported but not fatal.
+func crawlOfferHTML(store *Store, id string) error {
+	ok, err := store.HasHTML(id)
+	if err != nil || ok {
+		return err
+	}
+	fmt.Printf("fetching %s HTML page\n", id)
+	data, err := getOfferHTML(id)
+	crawlSleep(time.Second)
+	if err != nil {
+		if _, ok := err.(*BlockedError); ok {
+			return err
+		}
+		fmt.Printf("could not fetch %s HTML page: %s\n", id, err)
+		return nil
+	}
+	if data == nil {
+		fmt.Printf("could not find %s HTML page\n", id)
+		return nil
+	}
+	return store.PutHTML(id, data)
+}
+
+type HTMLSection struct {
+	Title string `json:"title"`
+	Text  string `json:"text"`
+}
+
+// HTMLOffer holds the information extracted from an offer HTML page.
+type HTMLOffer struct {
+	Title    string        `json:"title"`
+	Logo     string        `json:"logo"`
+	Sections []HTMLSection `json:"sections"`
+}
+
+var (
+	reHTMLMetaTitle = regexp.MustCompile(
+		`(?is)<meta[^>]+property="og:title"[^>]+content="([^"]*)"`)
+	reHTMLH1     = regexp.MustCompile(`(?is)<h1[^>]*>(.*?)</h1>`)
+	reHTMLLogo   = regexp.MustCompile(`(?is)<img[^>]+class="[^"]*logo[^"]*"[^>]*>`)
+	reHTMLSrc    = regexp.MustCompile(`(?is)\ssrc="([^"]*)"`)
+	reHTMLH2     = regexp.MustCompile(`(?is)<h2[^>]*>(.*?)</h2>`)
+	reHTMLIgnore = regexp.MustCompile(`(?is)<(script|style)[^>]*>.*?</(script|style)>`)
+	reHTMLTag    = regexp.MustCompile(`(?s)<[^>]*>`)
+	reHTMLSpaces = regexp.MustCompile(`\s+`)
+)
+
+// htmlText strips tags from an HTML fragment, unescapes entities and
+// collapses whitespaces.
+func htmlText(s string) string {
+	s = reHTMLIgnore.ReplaceAllString(s, " ")
+	s = reHTMLTag.ReplaceAllString(s, " ")
+	s = html.UnescapeString(s)
+	return strings.TrimSpace(reHTMLSpaces.ReplaceAllString(s, " "))
+}
+
+// parseOfferHTML extracts the title, company logo and text sections of an
+// offer page. Sections are delimited by <h2> headings. The parser is
+// deliberately lenient, missing elements are left empty.
+func parseOfferHTML(data []byte) *HTMLOffer {
+	page := reHTMLIgnore.ReplaceAllString(string(data), " ")
+	offer := &HTMLOffer{}
+	if m := reHTMLMetaTitle.FindStringSubmatch(page); m != nil {
+		offer.Title = htmlText(m[1])
+	} else if m := reHTMLH1.FindStringSubmatch(page); m != nil {
+		offer.Title = htmlText(m[1])
+	}
+	if img := reHTMLLogo.FindString(page); img != "" {
+		if m := reHTMLSrc.FindStringSubmatch(img); m != nil {
+			offer.Logo = html.UnescapeString(m[1])
+		}
+	}
+	headings := reHTMLH2.FindAllStringSubmatchIndex(page, -1)
+	for i, h := range headings {
+		end := len(page)
+		if i+1 < len(headings) {
+			end = headings[i+1][0]
+		}
+		offer.Sections = append(offer.Sections, HTMLSection{
+			Title: htmlText(page[h[2]:h[3]]),
+			Text:  htmlText(page[h[1]:end]),
+		})
+	}
+	return offer
+}
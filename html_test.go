@@ -0,0 +1,38 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseOfferHTML(t *testing.T) {
+	page := `<html><head>
+<meta property="og:title" content="D&eacute;veloppeur Go H/F">
+<script>var h2 = "<h2>ignored</h2>";</script>
+</head><body>
+<div class="header"><img src="/logo.png" alt="home"></div>
+<img alt="ACME" class="company-logo big" src="https://cdn.example.com/acme.png?w=1&amp;h=2">
+<h1>Other title</h1>
+<h2 class="title">Descriptif du poste</h2>
+<p>Vous <b>développerez</b>
+  des services.</p>
+<h2>Profil recherché</h2><ul><li>Go</li><li>SQL</li></ul>
+</body></html>`
+	expected := &HTMLOffer{
+		Title: "Développeur Go H/F",
+		Logo:  "https://cdn.example.com/acme.png?w=1&h=2",
+		Sections: []HTMLSection{
+			{"Descriptif du poste", "Vous développerez des services."},
+			{"Profil recherché", "Go SQL"},
+		},
+	}
+	offer := parseOfferHTML([]byte(page))
+	if !reflect.DeepEqual(offer, expected) {
+		t.Fatalf("unexpected offer:\n%+v\n!=\n%+v", offer, expected)
+	}
+
+	offer = parseOfferHTML([]byte(`<h1>Title &amp; more</h1>`))
+	if offer.Title != "Title & more" || offer.Logo != "" || len(offer.Sections) != 0 {
+		t.Fatalf("unexpected offer: %+v", offer)
+	}
+}
@@ -4,15 +4,20 @@ import (
 	"fmt"
 	"os"
 	"regexp"
+	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/blevesearch/bleve"
 	"github.com/blevesearch/bleve/analysis/analyzer/custom"
+	"github.com/blevesearch/bleve/analysis/analyzer/keyword"
 	"github.com/blevesearch/bleve/analysis/char/html"
 	"github.com/blevesearch/bleve/analysis/lang/fr"
+	"github.com/blevesearch/bleve/analysis/token/edgengram"
 	"github.com/blevesearch/bleve/analysis/token/lowercase"
 	"github.com/blevesearch/bleve/analysis/token/stop"
 	"github.com/blevesearch/bleve/analysis/tokenizer/exception"
@@ -20,6 +25,7 @@ import (
 	"github.com/blevesearch/bleve/analysis/tokenmap"
 	"github.com/blevesearch/bleve/index/store/boltdb"
 	"github.com/blevesearch/bleve/index/upsidedown"
+	"github.com/blevesearch/bleve/mapping"
 	"github.com/pmezard/apec/jstruct"
 	"github.com/pquerna/ffjson/ffjson"
 )
@@ -79,15 +85,112 @@ func loadOffers(store *Store) ([]*jstruct.JsonOffer, error) {
 }
 
 type Offer struct {
-	Account   string
-	Id        string    `json:"id"`
-	HTML      string    `json:"html"`
+	Account string
+	Id      string `json:"id"`
+	HTML    string `json:"html"`
+	// Plain text of HTML, stored for search results snippets
+	Text      string    `json:"text,omitempty"`
 	Title     string    `json:"title"`
 	MinSalary int       `json:"min_salary"`
 	MaxSalary int       `json:"max_salary"`
 	Date      time.Time `json:"date"`
 	URL       string
-	Location  string `json:"location"`
+	Location  string    `json:"location"`
+	Geo       *GeoPoint `json:"geo,omitempty"`
+	Skills    []string  `json:"skills,omitempty"`
+	Tags      []string  `json:"tags,omitempty"`
+	// Department and region names and codes, see areaTerms
+	Departments []string `json:"department,omitempty"`
+	Regions     []string `json:"region,omitempty"`
+	// Normalized title, see normalizeJobTitle
+	JobTitle string `json:"job_title,omitempty"`
+	// Lowercased account sorting results, empty if unknown so those come
+	// last
+	Company []string `json:"company,omitempty"`
+	// Deletion date of deleted offers versions, see deletedindex.go
+	Deleted *time.Time `json:"deleted,omitempty"`
+}
+
+// GeoPoint is an offer geocoded location, indexed as a bleve geopoint.
+type GeoPoint struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+// prepareIndexedOffer fills offer fields only used by the full text index and
+// applies options size limits. The offer must not be displayed afterwards.
+func prepareIndexedOffer(offer *Offer, options IndexOptions) {
+	offer.Skills = extractSkills(offer.Title + "\n" + htmlParagraphs(offer.HTML))
+	offer.JobTitle = normalizeJobTitle(offer.Title)
+	offer.Company = nil
+	if offer.Account != "" {
+		offer.Company = []string{strings.ToLower(offer.Account)}
+	}
+	if options.SkipHTML {
+		offer.HTML = ""
+	} else if max := options.MaxHTMLKB * 1024; max > 0 && len(offer.HTML) > max {
+		// Do not split UTF-8 sequences
+		for max > 0 && !utf8.RuneStart(offer.HTML[max]) {
+			max--
+		}
+		offer.HTML = offer.HTML[:max]
+	}
+	offer.Text = ""
+	if offer.HTML != "" {
+		offer.Text = htmlParagraphs(offer.HTML)
+	}
+}
+
+// setOfferGeo sets offer geopoint from its cached location, if any.
+// Nationwide offers have no geopoint.
+func setOfferGeo(store *Store, offer *Offer) error {
+	loc, _, err := store.GetLocation(offer.Id)
+	if err != nil {
+		return err
+	}
+	offer.Geo = nil
+	if loc != nil && !loc.Nationwide {
+		offer.Geo = &GeoPoint{Lat: loc.Lat, Lon: loc.Lon}
+	}
+	return nil
+}
+
+// setOfferTags sets offer tags from the store.
+func setOfferTags(store *Store, offer *Offer) error {
+	tags, err := store.GetTags(offer.Id)
+	if err != nil {
+		return err
+	}
+	offer.Tags = nil
+	if len(tags) > 0 {
+		offer.Tags = tags
+	}
+	return nil
+}
+
+// setOfferArea sets offer department and region terms, assigning its area
+// with areas if necessary.
+func setOfferArea(store *Store, areas *Areas, offer *Offer) error {
+	area, err := updateOfferArea(store, areas, offer.Id, false)
+	if err != nil {
+		return err
+	}
+	setAreaTerms(offer, area)
+	return nil
+}
+
+// setAreaTerms sets offer department and region terms from area, if any.
+func setAreaTerms(offer *Offer, area *OfferArea) {
+	offer.Departments = nil
+	offer.Regions = nil
+	if area != nil {
+		if terms := areaTerms(area.Department, area.DepartmentCode); len(terms) > 0 {
+			offer.Departments = terms
+		}
+		if terms := areaTerms(area.Region, area.RegionCode); len(terms) > 0 {
+			offer.Regions = terms
+		}
+	}
 }
 
 const (
@@ -98,7 +201,7 @@ const (
 func convertOffer(offer *jstruct.JsonOffer) (*Offer, error) {
 	r := &Offer{
 		Account:  offer.Account,
-		Id:       offer.Id,
+		Id:       makeOfferId(apecSource, offer.Id),
 		HTML:     offer.HTML,
 		Title:    offer.Title,
 		URL:      ApecURL + offer.Id,
@@ -170,12 +273,19 @@ var (
 	}
 )
 
-func NewOfferIndex(dir string) (bleve.Index, error) {
-	err := os.RemoveAll(dir)
-	if err != nil && !os.IsNotExist(err) {
-		return nil, err
-	}
+const (
+	// Unicode tokenizer keeping indexExceptions as single tokens
+	apecTokenizer = "apec"
+)
 
+// exactField returns the name of the unstemmed field indexing the same text
+// as field.
+func exactField(field string) string {
+	return field + "_exact"
+}
+
+// NewOfferMapping returns the index mapping used for offer documents.
+func NewOfferMapping() (*mapping.IndexMappingImpl, error) {
 	parts := []string{}
 	for _, exc := range indexExceptions {
 		parts = append(parts, regexp.QuoteMeta(exc))
@@ -184,8 +294,7 @@ func NewOfferIndex(dir string) (bleve.Index, error) {
 	pattern = "(?i)(?:" + pattern + ")"
 
 	m := bleve.NewIndexMapping()
-	apecTokenizer := "apec"
-	err = m.AddCustomTokenizer(apecTokenizer, map[string]interface{}{
+	err := m.AddCustomTokenizer(apecTokenizer, map[string]interface{}{
 		"type":       exception.Name,
 		"exceptions": []string{pattern},
 		"tokenizer":  bleveuni.Name,
@@ -219,6 +328,12 @@ func NewOfferIndex(dir string) (bleve.Index, error) {
 		fr.LightStemmerName,
 		apecStop,
 	}
+	// Exact analyzers keep words as typed, modulo case and elisions, to
+	// tell apart words sharing the same stem.
+	exactTokens := []string{
+		lowercase.Name,
+		fr.ElisionName,
+	}
 	fr := map[string]interface{}{
 		"type":          custom.Name,
 		"tokenizer":     apecTokenizer,
@@ -240,39 +355,186 @@ func NewOfferIndex(dir string) (bleve.Index, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to register analyzer fr_html: %s", err)
 	}
+	err = m.AddCustomAnalyzer("fr_exact", map[string]interface{}{
+		"type":          custom.Name,
+		"tokenizer":     apecTokenizer,
+		"token_filters": exactTokens,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to register analyzer fr_exact: %s", err)
+	}
+	err = m.AddCustomAnalyzer("fr_html_exact", map[string]interface{}{
+		"type": custom.Name,
+		"char_filters": []string{
+			html.Name,
+		},
+		"tokenizer":     apecTokenizer,
+		"token_filters": exactTokens,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to register analyzer fr_html_exact: %s", err)
+	}
+	// Prefix analyzers index the leading characters of exact words, so
+	// partially typed words match without prefix or fuzzy queries.
+	apecPrefix := "apec_prefix"
+	err = m.AddCustomTokenFilter(apecPrefix, map[string]interface{}{
+		"type": edgengram.Name,
+		"back": false,
+		"min":  float64(minPrefixLength),
+		"max":  float64(maxPrefixLength),
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = m.AddCustomAnalyzer("fr_prefix", map[string]interface{}{
+		"type":          custom.Name,
+		"tokenizer":     apecTokenizer,
+		"token_filters": append(exactTokens, apecPrefix),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to register analyzer fr_prefix: %s", err)
+	}
 
 	htmlFr := bleve.NewTextFieldMapping()
 	htmlFr.Store = false
 	htmlFr.IncludeInAll = false
-	htmlFr.IncludeTermVectors = false
+	// Term positions are required by phrase and NEAR queries
+	htmlFr.IncludeTermVectors = true
 	htmlFr.Analyzer = "fr_html"
 
 	textFr := bleve.NewTextFieldMapping()
 	textFr.Store = false
 	textFr.IncludeInAll = false
-	textFr.IncludeTermVectors = false
+	textFr.IncludeTermVectors = true
 	textFr.Analyzer = "fr"
 
+	// Stored with term positions for highlighting, see highlightOffers
+	snippetFr := bleve.NewTextFieldMapping()
+	snippetFr.Store = true
+	snippetFr.IncludeInAll = false
+	snippetFr.IncludeTermVectors = true
+	snippetFr.Analyzer = "fr"
+
+	// Unstemmed shadow fields, see exactField
+	htmlExact := bleve.NewTextFieldMapping()
+	htmlExact.Name = exactField("html")
+	htmlExact.Store = false
+	htmlExact.IncludeInAll = false
+	htmlExact.IncludeTermVectors = false
+	htmlExact.Analyzer = "fr_html_exact"
+
+	textExact := bleve.NewTextFieldMapping()
+	textExact.Name = exactField("title")
+	textExact.Store = false
+	textExact.IncludeInAll = false
+	textExact.IncludeTermVectors = false
+	textExact.Analyzer = "fr_exact"
+
+	// Title prefixes shadow field, see prefixField
+	textPrefix := bleve.NewTextFieldMapping()
+	textPrefix.Name = prefixField("title")
+	textPrefix.Store = false
+	textPrefix.IncludeInAll = false
+	textPrefix.IncludeTermVectors = false
+	textPrefix.Analyzer = "fr_prefix"
+
+	skillsFr := bleve.NewTextFieldMapping()
+	skillsFr.Store = false
+	skillsFr.IncludeInAll = false
+	skillsFr.IncludeTermVectors = true
+	skillsFr.Analyzer = "fr"
+
+	skillsExact := bleve.NewTextFieldMapping()
+	skillsExact.Name = exactField("skills")
+	skillsExact.Store = false
+	skillsExact.IncludeInAll = false
+	skillsExact.IncludeTermVectors = false
+	skillsExact.Analyzer = "fr_exact"
+
 	textAll := bleve.NewTextFieldMapping()
 	textAll.Store = false
 	textAll.IncludeInAll = true
 	textAll.IncludeTermVectors = false
 
+	// Tags are matched as typed, see tagQueryPrefix
+	tags := bleve.NewTextFieldMapping()
+	tags.Store = false
+	tags.IncludeInAll = false
+	tags.IncludeTermVectors = false
+	tags.Analyzer = keyword.Name
+
+	// Areas are matched like tags, see departmentQueryPrefix
+	area := bleve.NewTextFieldMapping()
+	area.Store = false
+	area.IncludeInAll = false
+	area.IncludeTermVectors = false
+	area.Analyzer = keyword.Name
+
+	// Job titles are completed as a whole, see suggestJobTitles
+	jobTitle := bleve.NewTextFieldMapping()
+	jobTitle.Store = false
+	jobTitle.IncludeInAll = false
+	jobTitle.IncludeTermVectors = false
+	jobTitle.Analyzer = keyword.Name
+
+	// Results are sorted by salaries and companies, see sortByIndex
+	salary := bleve.NewNumericFieldMapping()
+	salary.Store = false
+	salary.IncludeInAll = false
+	salary.IncludeTermVectors = false
+
+	company := bleve.NewTextFieldMapping()
+	company.Store = false
+	company.IncludeInAll = false
+	company.IncludeTermVectors = false
+	company.Analyzer = keyword.Name
+
+	// Dates are indexed to sort quick searches and results
 	date := bleve.NewDateTimeFieldMapping()
-	date.Index = false
 	date.Store = true
 	date.IncludeInAll = false
 	date.IncludeTermVectors = false
 
+	geo := mapping.NewGeoPointFieldMapping()
+	geo.Store = false
+	geo.IncludeInAll = false
+
 	offer := bleve.NewDocumentStaticMapping()
 	offer.Dynamic = false
-	offer.AddFieldMappingsAt("html", htmlFr)
-	offer.AddFieldMappingsAt("title", textFr)
+	offer.AddFieldMappingsAt("html", htmlFr, htmlExact)
+	offer.AddFieldMappingsAt("title", textFr, textExact, textPrefix)
+	offer.AddFieldMappingsAt(snippetField, snippetFr)
+	offer.AddFieldMappingsAt("skills", skillsFr, skillsExact)
+	offer.AddFieldMappingsAt("tags", tags)
+	offer.AddFieldMappingsAt(departmentField, area)
+	offer.AddFieldMappingsAt(regionField, area)
+	offer.AddFieldMappingsAt(jobTitleField, jobTitle)
+	offer.AddFieldMappingsAt("min_salary", salary)
+	offer.AddFieldMappingsAt("max_salary", salary)
+	offer.AddFieldMappingsAt("company", company)
 	offer.AddFieldMappingsAt("date", date)
+	offer.AddFieldMappingsAt("geo", geo)
 
 	m.AddDocumentMapping("offer", offer)
 	m.DefaultMapping = offer
+	return m, nil
+}
+
+func NewOfferIndex(dir string) (bleve.Index, error) {
+	m, err := NewOfferMapping()
+	if err != nil {
+		return nil, err
+	}
+	return newIndexUsing(dir, m)
+}
 
+// newIndexUsing creates an empty index with mapping m in dir, replacing the
+// existing one if any.
+func newIndexUsing(dir string, m *mapping.IndexMappingImpl) (bleve.Index, error) {
+	err := os.RemoveAll(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
 	index, err := bleve.NewUsing(dir, m, upsidedown.Name, boltdb.Name,
 		map[string]interface{}{
 			"nosync": true,
@@ -280,6 +542,11 @@ func NewOfferIndex(dir string) (bleve.Index, error) {
 	if err != nil {
 		return nil, err
 	}
+	err = setIndexSchemaVersion(index, indexSchemaVersion)
+	if err != nil {
+		index.Close()
+		return nil, err
+	}
 	return index, nil
 }
 
@@ -289,6 +556,12 @@ func OpenOfferIndex(path string) (bleve.Index, error) {
 	})
 }
 
+func OpenOfferIndexReadOnly(path string) (bleve.Index, error) {
+	return bleve.OpenUsing(path, map[string]interface{}{
+		"read_only": true,
+	})
+}
+
 var (
 	indexCmd     = app.Command("index", "index APEC offers")
 	indexMaxSize = indexCmd.Flag("max-count", "maximum number of items to index").
@@ -299,6 +572,10 @@ var (
 	indexMinQuota = indexCmd.Flag("min-quota",
 		"stop geocoding when call quota moves below supplied value").Default("500").Int()
 	indexDocId = indexCmd.Flag("id", "index only specified document").String()
+	indexJobs  = indexCmd.Flag("index-jobs", "number of offers decoding workers").
+			Default(strconv.Itoa(runtime.NumCPU())).Int()
+	indexBatchSize = indexCmd.Flag("batch-size", "number of offers indexed "+
+		"per batch").Default(strconv.Itoa(defaultIndexBatchSize)).Int()
 )
 
 func indexOffers(cfg *Config) error {
@@ -307,35 +584,36 @@ func indexOffers(cfg *Config) error {
 		return err
 	}
 	defer store.Close()
-	rawOffers, err := loadOffers(store)
+	ids, err := store.List()
 	if err != nil {
 		return err
 	}
+	sort.Strings(ids)
 	if *indexDocId != "" {
-		kept := []*jstruct.JsonOffer{}
-		for _, o := range rawOffers {
-			if o.Id == *indexDocId {
-				kept = append(kept, o)
+		kept := []string{}
+		for _, id := range ids {
+			if id == normalizeOfferId(*indexDocId) {
+				kept = append(kept, id)
 			}
 		}
-		rawOffers = kept
-	}
-	offers, err := convertOffers(rawOffers)
-	if err != nil {
-		return err
+		ids = kept
 	}
-	if *indexMaxSize > 0 && len(offers) > *indexMaxSize {
-		offers = offers[:*indexMaxSize]
+	if *indexMaxSize > 0 && len(ids) > *indexMaxSize {
+		ids = ids[:*indexMaxSize]
 	}
 
 	rejected := 0
 	geocodingKey := cfg.GeocodingKey()
 	if geocodingKey != "" {
-		geocoder, err := NewGeocoder(geocodingKey, cfg.Geocoder())
+		geocoder, err := openGeocoder(cfg)
 		if err != nil {
 			return err
 		}
 		defer geocoder.Close()
+		offers, err := convertOffers(loadOffersById(store, ids))
+		if err != nil {
+			return err
+		}
 		rejected, err = geocodeOffers(store, geocoder, offers, *indexMinQuota)
 		if err != nil {
 			return err
@@ -343,30 +621,43 @@ func indexOffers(cfg *Config) error {
 		fmt.Printf("%d rejected geocoding\n", rejected)
 	}
 	if *indexIndex {
-		index, err := NewOfferIndex(cfg.Index())
+		searchCfg, err := loadSearchConfig(cfg.Search())
 		if err != nil {
 			return err
 		}
+		areas, err := LoadAreas(cfg.ShapesDir)
+		if err != nil {
+			return err
+		}
+		// Interrupted runs are resumed from tempDir
+		dir := cfg.Index()
+		tempDir := dir + ".rebuild"
 		start := time.Now()
-		indexed := 0
-		for i, offer := range offers {
-			if (i+1)%500 == 0 {
-				now := time.Now()
-				elapsed := float64(now.Sub(start)) / float64(time.Second)
-				fmt.Printf("%d indexed, %.1f/s\n", i+1, float64(i+1)/elapsed)
-			}
-			err = index.Index(offer.Id, offer)
-			if err != nil {
-				return err
-			}
-			indexed += 1
+		progress := NewProgress("index", len(ids))
+		reported := 0
+		pipeline := NewIndexPipeline(searchCfg.Index, areas)
+		pipeline.Jobs = *indexJobs
+		pipeline.BatchSize = *indexBatchSize
+		pipeline.Progress = func(done, total int) {
+			progress.Add(done - reported)
+			reported = done
+		}
+		indexed, err := pipeline.Rebuild(store, tempDir, ids)
+		if err != nil {
+			return err
+		}
+		progress.Done()
+		oldDir := dir + ".old"
+		err = replaceIndexDir(dir, tempDir, oldDir)
+		if err != nil {
+			return err
 		}
-		err = index.Close()
+		err = os.RemoveAll(oldDir)
 		if err != nil {
 			return err
 		}
 		end := time.Now()
-		fmt.Printf("%d/%d documents indexed in %.2fs\n", indexed, len(offers),
+		fmt.Printf("%d/%d documents indexed in %.2fs\n", indexed, len(ids),
 			float64(end.Sub(start))/float64(time.Second))
 	}
 	return nil
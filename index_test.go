@@ -0,0 +1,82 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPrepareIndexedOffer(t *testing.T) {
+	html := "<p>Vous développerez en golang et python sous linux.</p>" + strings.Repeat("é", 1024)
+	tests := []struct {
+		Options IndexOptions
+		HTMLLen int
+	}{
+		{IndexOptions{}, len(html)},
+		{IndexOptions{SkipHTML: true}, 0},
+		// Truncating at 1024 bytes would split a two bytes rune
+		{IndexOptions{MaxHTMLKB: 1}, 1023},
+		{IndexOptions{MaxHTMLKB: 4}, len(html)},
+	}
+	for _, test := range tests {
+		offer := &Offer{Title: "Développeur Go", HTML: html}
+		prepareIndexedOffer(offer, test.Options)
+		if len(offer.HTML) != test.HTMLLen {
+			t.Fatalf("%+v: expected %d bytes of HTML, got %d", test.Options,
+				test.HTMLLen, len(offer.HTML))
+		}
+		if !strings.HasPrefix(html, offer.HTML) {
+			t.Fatalf("%+v: HTML is not a prefix of the original one", test.Options)
+		}
+		skills := []string{"Go", "Python", "Linux"}
+		if !reflect.DeepEqual(offer.Skills, skills) {
+			t.Fatalf("%+v: unexpected skills: %v", test.Options, offer.Skills)
+		}
+	}
+}
+
+func TestSkipHTMLQuery(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	env.Fields = noHTMLSearchFields
+	w := env.Query("python", "")
+	body := w.Body.String()
+	if w.Code != 200 {
+		t.Fatalf("query failed with %d: %s", w.Code, body)
+	}
+	// 1001 and 1004 mention python in their description only, which is
+	// still found in extracted skills.
+	for _, id := range []string{"1001", "1002", "1004"} {
+		if !strings.Contains(body, id) {
+			t.Fatalf("%s not found in:\n%s", id, body)
+		}
+	}
+}
+
+func TestCollectIndexStats(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	stats, err := collectIndexStats(env.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for _, st := range stats.Kinds {
+		count += st.Count
+	}
+	if count == 0 || count != stats.Total.Count {
+		t.Fatalf("row counts do not match total: %d != %d", count,
+			stats.Total.Count)
+	}
+	for _, name := range []string{"html", "html_exact", "title", "skills"} {
+		st := stats.Fields[name]
+		if st == nil || st.Count == 0 || st.Size == 0 {
+			t.Fatalf("no term rows for field %s: %+v", name, stats.Fields)
+		}
+	}
+	if _, ok := stats.Fields["unknown"]; ok {
+		t.Fatalf("rows with unknown fields: %+v", stats.Fields)
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/blevesearch/bleve"
+)
+
+// Full reindexes run as a pipeline: decode workers read offers from the
+// store and prepare their indexed documents, a single writer indexes them by
+// batches. bleve analyzes batch documents concurrently, and batches amortize
+// index writes. Channels are bounded so memory usage does not grow with the
+// store size.
+
+const defaultIndexBatchSize = 500
+
+// Internal key of the identifier of the last processed offer, while the
+// index is being rebuilt
+var indexCheckpointKey = []byte("rebuild_checkpoint")
+
+// IndexPipeline indexes stored offers with Jobs decode workers and batches
+// of BatchSize documents.
+type IndexPipeline struct {
+	Jobs      int
+	BatchSize int
+	Options   IndexOptions
+	Areas     *Areas
+	// Called after each batch with the number of processed offers, if set
+	Progress func(done, total int)
+	// Closed to interrupt the indexing, if set
+	Stop <-chan struct{}
+}
+
+func NewIndexPipeline(options IndexOptions, areas *Areas) *IndexPipeline {
+	return &IndexPipeline{
+		Jobs:      runtime.NumCPU(),
+		BatchSize: defaultIndexBatchSize,
+		Options:   options,
+		Areas:     areas,
+	}
+}
+
+// preparedOffer is the indexed document of the offer at Pos in the indexed
+// identifiers, or nil if it does not exist or cannot be read.
+type preparedOffer struct {
+	Pos   int
+	Offer *Offer
+	// Area to cache for Offer if AreaChanged is set
+	Area        *OfferArea
+	AreaChanged bool
+	Err         error
+}
+
+// prepareStoredOffer prepares the indexed document of stored offer id. Its
+// area is assigned but not cached, so caches can be updated by batches.
+func prepareStoredOffer(store *Store, areas *Areas, options IndexOptions,
+	id string) preparedOffer {
+
+	prepared := preparedOffer{}
+	js, err := getStoreJsonOffer(store, id)
+	if err != nil {
+		// Like loadOffers, unreadable offers are reported and skipped
+		log.Printf("loading error for %s: %s", id, err)
+		return prepared
+	}
+	if js == nil {
+		return prepared
+	}
+	offer, err := convertOffer(js)
+	if err == nil {
+		err = setOfferGeo(store, offer)
+	}
+	if err == nil {
+		err = setOfferTags(store, offer)
+	}
+	if err == nil {
+		prepared.Area, prepared.AreaChanged, err = computeOfferArea(store,
+			areas, offer.Id, false)
+	}
+	if err != nil {
+		prepared.Err = err
+		return prepared
+	}
+	setAreaTerms(offer, prepared.Area)
+	prepareIndexedOffer(offer, options)
+	prepared.Offer = offer
+	return prepared
+}
+
+// Run indexes stored offers ids, sorted, into index and returns the number
+// of indexed offers. Each batch records the last identifier such that it and
+// all previous ones were processed, so interrupted runs can be resumed after
+// it. It stops at the first error or once p.Stop is closed.
+func (p *IndexPipeline) Run(store *Store, index bleve.Index, ids []string) (
+	int, error) {
+
+	jobs := p.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	batchSize := p.BatchSize
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	// Closed to stop workers on error
+	stop := make(chan struct{})
+	pending := make(chan int, batchSize)
+	go func() {
+		defer close(pending)
+		for i := range ids {
+			select {
+			case <-p.Stop:
+				return
+			default:
+			}
+			select {
+			case pending <- i:
+			case <-stop:
+				return
+			case <-p.Stop:
+				return
+			}
+		}
+	}()
+
+	prepared := make(chan preparedOffer, batchSize)
+	running := &sync.WaitGroup{}
+	for i := 0; i < jobs; i++ {
+		running.Add(1)
+		go func() {
+			defer running.Done()
+			for pos := range pending {
+				offer := prepareStoredOffer(store, p.Areas, p.Options, ids[pos])
+				offer.Pos = pos
+				select {
+				case prepared <- offer:
+				case <-stop:
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		running.Wait()
+		close(prepared)
+	}()
+
+	// Workers complete offers out of order, the checkpoint is the end of the
+	// processed prefix of ids.
+	processed := make([]bool, len(ids))
+	checkpoint := 0
+	count := 0
+	indexed := 0
+	batched := 0
+	batch := index.NewBatch()
+	// Areas assigned to batched offers, cached with the batch
+	areas := map[string]*OfferArea{}
+	flush := func() error {
+		last := checkpoint
+		for checkpoint < len(ids) && processed[checkpoint] {
+			checkpoint++
+		}
+		if checkpoint > last {
+			batch.SetInternal(indexCheckpointKey, []byte(ids[checkpoint-1]))
+		}
+		if len(areas) > 0 {
+			err := store.PutOfferAreas(areas)
+			if err != nil {
+				return err
+			}
+			areas = map[string]*OfferArea{}
+		}
+		if batch.Size() > 0 {
+			err := index.Batch(batch)
+			if err != nil {
+				return err
+			}
+			batch.Reset()
+		}
+		batched = 0
+		if p.Progress != nil {
+			p.Progress(count, len(ids))
+		}
+		return nil
+	}
+	var err error
+	for r := range prepared {
+		if err != nil {
+			// Drain workers until they notice they must stop
+			continue
+		}
+		count++
+		processed[r.Pos] = true
+		err = r.Err
+		if err == nil && r.Offer != nil {
+			err = batch.Index(r.Offer.Id, r.Offer)
+			if r.AreaChanged {
+				areas[r.Offer.Id] = r.Area
+			}
+			indexed++
+			batched++
+		}
+		if err == nil && batched >= batchSize {
+			err = flush()
+		}
+		if err != nil {
+			close(stop)
+		}
+	}
+	if err != nil {
+		return indexed, err
+	}
+	err = flush()
+	if err != nil {
+		return indexed, err
+	}
+	if count < len(ids) {
+		return indexed, fmt.Errorf("indexing was interrupted after %d/%d offers",
+			count, len(ids))
+	}
+	return indexed, nil
+}
+
+// openRebuildIndex opens the index being rebuilt in dir and returns it with
+// its checkpoint, the identifier of the last processed offer. Missing,
+// unreadable or outdated indexes, or those without checkpoint, are replaced
+// with an empty index and an empty checkpoint.
+func openRebuildIndex(dir string) (bleve.Index, string, error) {
+	exists, err := isFile(dir)
+	if err != nil {
+		return nil, "", err
+	}
+	if exists {
+		index, err := OpenOfferIndex(dir)
+		if err == nil {
+			checkpoint, err := index.GetInternal(indexCheckpointKey)
+			if err == nil && len(checkpoint) > 0 {
+				version, err := getIndexSchemaVersion(index)
+				if err == nil && version == indexSchemaVersion {
+					return index, string(checkpoint), nil
+				}
+			}
+			index.Close()
+		}
+		log.Printf("discarding partially rebuilt index %s", dir)
+	}
+	index, err := NewOfferIndex(dir)
+	return index, "", err
+}
+
+// Rebuild indexes stored offers ids in dir, resuming the interrupted rebuild
+// there if any, and returns the number of indexed offers. The index is
+// closed and can then replace the live one. Failed rebuilds leave dir in
+// place, to be resumed.
+func (p *IndexPipeline) Rebuild(store *Store, dir string, ids []string) (
+	int, error) {
+
+	index, checkpoint, err := openRebuildIndex(dir)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if index != nil {
+			index.Close()
+		}
+	}()
+	ids = append([]string{}, ids...)
+	sort.Strings(ids)
+	missing := ids
+	if checkpoint != "" {
+		// Offers may have been added on either side of the checkpoint, or
+		// deleted, since the interruption
+		indexed, err := listIndexIds(index)
+		if err != nil {
+			return 0, err
+		}
+		added, removed := diffIds(append([]string{}, ids...), indexed)
+		batch := index.NewBatch()
+		for _, id := range removed {
+			batch.Delete(id)
+		}
+		err = index.Batch(batch)
+		if err != nil {
+			return 0, err
+		}
+		missing = added
+		log.Printf("resuming index rebuild after %s, %d/%d offers remaining",
+			checkpoint, len(missing), len(ids))
+	}
+	start := len(ids) - len(missing)
+	pipeline := *p
+	if p.Progress != nil {
+		pipeline.Progress = func(done, total int) {
+			p.Progress(start+done, len(ids))
+		}
+	}
+	_, err = pipeline.Run(store, index, missing)
+	if err != nil {
+		return 0, err
+	}
+	err = index.DeleteInternal(indexCheckpointKey)
+	if err != nil {
+		return 0, err
+	}
+	count, err := index.DocCount()
+	if err != nil {
+		return 0, err
+	}
+	err = index.Close()
+	index = nil
+	return int(count), err
+}
+
+// replaceIndexDir moves the index in dir, if any, to oldDir and the one in
+// newDir to dir.
+func replaceIndexDir(dir, newDir, oldDir string) error {
+	err := os.RemoveAll(oldDir)
+	if err != nil {
+		return err
+	}
+	exists, err := isFile(dir)
+	if err != nil {
+		return err
+	}
+	if exists {
+		err = os.Rename(dir, oldDir)
+		if err != nil {
+			return err
+		}
+	}
+	return os.Rename(newDir, dir)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve"
+)
+
+func TestIndexPipeline(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	m, err := NewOfferMapping()
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := bleve.NewMemOnly(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	ids, err := env.Store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Missing offers are skipped
+	ids = append(ids, "apec:9999")
+	// Missing areas are cached with batches
+	err = env.Store.PutOfferArea("apec:1003", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	progress := []int{}
+	pipeline := NewIndexPipeline(IndexOptions{}, nil)
+	pipeline.Jobs = 3
+	pipeline.BatchSize = 2
+	pipeline.Progress = func(done, total int) {
+		if total != len(ids) {
+			t.Fatalf("unexpected total: %d", total)
+		}
+		progress = append(progress, done)
+	}
+	indexed, err := pipeline.Run(env.Store, index, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := index.DocCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if indexed != 6 || count != 6 {
+		t.Fatalf("unexpected indexed offers: %d, %d", indexed, count)
+	}
+	if !sort.IntsAreSorted(progress) || len(progress) < 3 ||
+		progress[len(progress)-1] != len(ids) {
+		t.Fatalf("unexpected progress: %v", progress)
+	}
+	area, err := env.Store.GetOfferArea("apec:1003")
+	if err != nil || area == nil || area.Department != "Rhône" {
+		t.Fatalf("offer area was not cached: %+v, %v", area, err)
+	}
+
+	// Documents match the sequentially indexed ones
+	search := func(index bleve.Index) string {
+		q, err := makeSearchQuery("python", nil, env.Fields)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rq := bleve.NewSearchRequestOptions(q, 10, 0, false)
+		rq.SortBy([]string{"_id"})
+		res, err := index.Search(rq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := []string{}
+		for _, doc := range res.Hits {
+			found = append(found, doc.ID)
+		}
+		return fmt.Sprint(found)
+	}
+	if s, expected := search(index), search(env.Index); s != expected {
+		t.Fatalf("expected %s, got %s", expected, s)
+	}
+
+	// Stopped pipelines report the interruption
+	stop := make(chan struct{})
+	close(stop)
+	pipeline.Stop = stop
+	pipeline.Progress = nil
+	_, err = pipeline.Run(env.Store, index, ids)
+	if err == nil {
+		t.Fatal("stopped pipeline should fail")
+	}
+	pipeline.Stop = nil
+
+	// Indexing errors stop the pipeline
+	index.Close()
+	_, err = pipeline.Run(env.Store, index, ids)
+	if err == nil {
+		t.Fatal("indexing into a closed index should fail")
+	}
+}
+
+func TestIndexPipelineResume(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	ids, err := env.Store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(ids)
+	dir := env.Config.Index() + ".rebuild"
+
+	// Simulate a rebuild interrupted after the first 3 offers
+	index, err := NewOfferIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline := NewIndexPipeline(IndexOptions{}, nil)
+	pipeline.BatchSize = 2
+	_, err = pipeline.Run(env.Store, index, ids[:3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkpoint, err := index.GetInternal(indexCheckpointKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(checkpoint) != ids[2] {
+		t.Fatalf("unexpected checkpoint: %q", checkpoint)
+	}
+	err = index.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Offers deleted meanwhile are removed from the resumed index, those added
+	// before the checkpoint are indexed
+	js, err := getStoreJsonOffer(env.Store, "apec:1003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	added := *js
+	added.Id = "0999"
+	data, err := json.Marshal(&added)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = env.Store.Put("apec:0999", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = env.Store.Delete("apec:1002", time.Date(2017, 1, 8, 10, 0, 0, 0,
+		time.FixedZone("CET", 3600)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err = env.Store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	progress := []int{}
+	pipeline.Progress = func(done, total int) {
+		if total != len(ids) {
+			t.Fatalf("unexpected total: %d", total)
+		}
+		progress = append(progress, done)
+	}
+	indexed, err := pipeline.Rebuild(env.Store, dir, ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if indexed != 6 {
+		t.Fatalf("unexpected indexed offers: %d", indexed)
+	}
+	// Only the remaining offers were processed
+	if len(progress) == 0 || progress[0] <= 2 ||
+		progress[len(progress)-1] != len(ids) {
+		t.Fatalf("unexpected progress: %v", progress)
+	}
+
+	index, err = OpenOfferIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	checkpoint, err = index.GetInternal(indexCheckpointKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkpoint != nil {
+		t.Fatalf("checkpoint was not removed: %q", checkpoint)
+	}
+	indexedIds, err := listIndexIds(index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(indexedIds)
+	if s := fmt.Sprint(indexedIds); s != "[apec:0999 apec:1001 apec:1003 "+
+		"apec:1004 apec:1005 apec:1006]" {
+		t.Fatalf("unexpected indexed offers: %s", s)
+	}
+}
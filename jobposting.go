@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+)
+
+// Offers are described with schema.org JobPosting structured data, embedded
+// as JSON-LD in HTML pages, so search engines index offers published by
+// public deployments as job postings.
+
+type jsonldOrganization struct {
+	Type string `json:"@type"`
+	Name string `json:"name"`
+}
+
+type jsonldAddress struct {
+	Type       string `json:"@type"`
+	Locality   string `json:"addressLocality,omitempty"`
+	PostalCode string `json:"postalCode,omitempty"`
+	Region     string `json:"addressRegion,omitempty"`
+	Country    string `json:"addressCountry"`
+}
+
+type jsonldGeo struct {
+	Type      string  `json:"@type"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+type jsonldPlace struct {
+	Type    string         `json:"@type"`
+	Address *jsonldAddress `json:"address"`
+	Geo     *jsonldGeo     `json:"geo,omitempty"`
+}
+
+type jsonldCountry struct {
+	Type string `json:"@type"`
+	Name string `json:"name"`
+}
+
+type jsonldQuantity struct {
+	Type     string `json:"@type"`
+	MinValue int    `json:"minValue"`
+	MaxValue int    `json:"maxValue"`
+	UnitText string `json:"unitText"`
+}
+
+type jsonldAmount struct {
+	Type     string          `json:"@type"`
+	Currency string          `json:"currency"`
+	Value    *jsonldQuantity `json:"value"`
+}
+
+type jsonldIdentifier struct {
+	Type  string `json:"@type"`
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// JobPosting is the schema.org description of an offer.
+type JobPosting struct {
+	Context            string              `json:"@context"`
+	Type               string              `json:"@type"`
+	Title              string              `json:"title"`
+	Description        string              `json:"description"`
+	DatePosted         string              `json:"datePosted"`
+	URL                string              `json:"url"`
+	Identifier         *jsonldIdentifier   `json:"identifier"`
+	HiringOrganization *jsonldOrganization `json:"hiringOrganization"`
+	// Remote offers have a location type instead of a location, they and
+	// nationwide ones require applicants to live in the country
+	JobLocation           *jsonldPlace   `json:"jobLocation,omitempty"`
+	JobLocationType       string         `json:"jobLocationType,omitempty"`
+	ApplicantRequirements *jsonldCountry `json:"applicantLocationRequirements,omitempty"`
+	BaseSalary            *jsonldAmount  `json:"baseSalary,omitempty"`
+}
+
+// makeJobPosting returns the JobPosting of offer id, or nil if it does not
+// exist. Geocoded offers are located with their coordinates, nationwide ones
+// with the country only. Salaries are yearly amounts in EUR.
+func makeJobPosting(store *Store, id string) (*JobPosting, error) {
+	js, err := getStoreJsonOffer(store, id)
+	if err != nil || js == nil {
+		return nil, err
+	}
+	offer, err := convertOffer(js)
+	if err != nil {
+		return nil, err
+	}
+	p := &JobPosting{
+		Context:     "https://schema.org/",
+		Type:        "JobPosting",
+		Title:       offer.Title,
+		Description: offer.HTML,
+		DatePosted:  offer.Date.Format("2006-01-02"),
+		URL:         offer.URL,
+		Identifier: &jsonldIdentifier{
+			Type:  "PropertyValue",
+			Name:  "APEC",
+			Value: js.Id,
+		},
+		HiringOrganization: &jsonldOrganization{
+			Type: "Organization",
+			Name: offer.Account,
+		},
+	}
+	if offer.MinSalary > 0 {
+		p.BaseSalary = &jsonldAmount{
+			Type:     "MonetaryAmount",
+			Currency: "EUR",
+			Value: &jsonldQuantity{
+				Type:     "QuantitativeValue",
+				MinValue: 1000 * offer.MinSalary,
+				MaxValue: 1000 * offer.MaxSalary,
+				UnitText: "YEAR",
+			},
+		}
+	}
+	loc, _, err := store.GetLocation(id)
+	if err != nil {
+		return nil, err
+	}
+	place := &jsonldPlace{
+		Type: "Place",
+		Address: &jsonldAddress{
+			Type:     "PostalAddress",
+			Locality: offer.Location,
+			Country:  "FR",
+		},
+	}
+	country := &jsonldCountry{
+		Type: "Country",
+		Name: "France",
+	}
+	switch {
+	case isRemoteLocation(offer.Location):
+		p.JobLocationType = "TELECOMMUTE"
+		p.ApplicantRequirements = country
+	case loc != nil && loc.Nationwide:
+		place.Address.Locality = ""
+		p.JobLocation = place
+		p.ApplicantRequirements = country
+	case loc != nil:
+		if loc.City != "" {
+			place.Address.Locality = loc.City
+		}
+		place.Address.PostalCode = loc.PostCode
+		place.Address.Region = loc.State
+		place.Geo = &jsonldGeo{
+			Type:      "GeoCoordinates",
+			Latitude:  loc.Lat,
+			Longitude: loc.Lon,
+		}
+		p.JobLocation = place
+	default:
+		p.JobLocation = place
+	}
+	return p, nil
+}
+
+// jobPostingScript returns p as a JSON-LD script element. JSON encoding
+// escapes angle brackets, so offers HTML cannot close the element.
+func jobPostingScript(p *JobPosting) (template.HTML, error) {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+	return template.HTML(`<script type="application/ld+json">` + string(data) +
+		`</script>`), nil
+}
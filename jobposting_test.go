@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJobPosting(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	p, err := makeJobPosting(env.Store, "apec:1001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Title != "Développeur Go H/F" || p.DatePosted != "2017-01-02" ||
+		p.HiringOrganization.Name != "ACME" || p.Identifier.Value != "1001" {
+		t.Fatalf("unexpected posting: %+v", p)
+	}
+	if p.BaseSalary == nil || p.BaseSalary.Value.MinValue != 45000 ||
+		p.BaseSalary.Value.MaxValue != 55000 {
+		t.Fatalf("unexpected salary: %+v", p.BaseSalary)
+	}
+	if p.JobLocation == nil || p.JobLocation.Geo == nil ||
+		p.JobLocation.Address.Region != "Ile-de-France" {
+		t.Fatalf("unexpected location: %+v", p.JobLocation)
+	}
+
+	// Remote offers, unknown locations and salaries
+	p, err = makeJobPosting(env.Store, "apec:1006")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.JobLocation != nil || p.JobLocationType != "TELECOMMUTE" ||
+		p.ApplicantRequirements == nil {
+		t.Fatalf("unexpected remote posting: %+v", p)
+	}
+	// Nationwide offers are located in the country
+	err = env.Store.Put("apec:1007", []byte(`{"numeroOffre": "1007",
+		"intitule": "Auditeur H/F",
+		"datePublication": "2017-01-08T10:00:00.000+0000",
+		"lieuTexte": "France", "texteHtml": "<p>Audits</p>",
+		"nomCompteEtablissement": "Initech"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = env.Store.PutLocation("apec:1007",
+		&Location{Country: "France", Nationwide: true}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err = makeJobPosting(env.Store, "apec:1007")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.JobLocationType != "" || p.JobLocation == nil ||
+		p.JobLocation.Geo != nil || p.JobLocation.Address.Locality != "" ||
+		p.JobLocation.Address.Country != "FR" || p.ApplicantRequirements == nil {
+		t.Fatalf("unexpected nationwide posting: %+v", p)
+	}
+	p, err = makeJobPosting(env.Store, "apec:1004")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.BaseSalary != nil {
+		t.Fatalf("unexpected salary: %+v", p.BaseSalary)
+	}
+	p, err = makeJobPosting(env.Store, "apec:1005")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.JobLocation == nil || p.JobLocation.Geo != nil ||
+		p.JobLocation.Address.Locality != "Atlantide" {
+		t.Fatalf("unexpected ungeocoded location: %+v", p.JobLocation)
+	}
+	p, err = makeJobPosting(env.Store, "apec:9999")
+	if err != nil || p != nil {
+		t.Fatalf("unknown offer returned %+v, %v", p, err)
+	}
+
+	// Offers HTML cannot escape the script element
+	p, err = makeJobPosting(env.Store, "apec:1002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Description = "</script><script>alert(1)</script>"
+	script, err := jobPostingScript(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := string(script)
+	prefix := `<script type="application/ld+json">`
+	if !strings.HasPrefix(s, prefix) || strings.Count(s, "</script>") != 1 {
+		t.Fatalf("unexpected script: %s", s)
+	}
+	decoded := map[string]interface{}{}
+	err = json.Unmarshal([]byte(strings.TrimSuffix(strings.TrimPrefix(s, prefix),
+		"</script>")), &decoded)
+	if err != nil || decoded["@type"] != "JobPosting" ||
+		decoded["description"] != p.Description {
+		t.Fatalf("invalid JSON-LD: %v, %v", decoded, err)
+	}
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// SQLite stores map every bucket to a table of the same name, with key and
+// value BLOB columns, sorted by key. The buckets table lists them with their
+// sequence. Databases are in WAL mode: readers, including other processes,
+// run concurrently with a single writer.
+
+var (
+	errSQLiteBucketExists   = errors.New("bucket already exists")
+	errSQLiteBucketNotFound = errors.New("bucket not found")
+	errSQLiteKeyRequired    = errors.New("key required")
+	errSQLiteTxNotWritable  = errors.New("tx not writable")
+	errSQLiteNotOpen        = errors.New("database not open")
+)
+
+type sqliteDB struct {
+	path string
+	// Readers pool, and the single writer connection of read-write databases
+	reader *sql.DB
+	writer *sql.DB
+}
+
+// sqliteURI returns the URI opening path with the driver parameters in query.
+func sqliteURI(path, query string) string {
+	escaped := strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23").
+		Replace(path)
+	return "file:" + escaped + "?" + query
+}
+
+func openSQLite(path string, readOnly bool) (kvDB, error) {
+	db := &sqliteDB{
+		path: path,
+	}
+	ok := false
+	defer func() {
+		if !ok {
+			db.Close()
+		}
+	}()
+	if !readOnly {
+		// Writers take the database lock when they begin, so they wait for
+		// each other instead of failing on their first write.
+		writer, err := sql.Open("sqlite3", sqliteURI(path,
+			"_busy_timeout=5000&_journal_mode=WAL&_txlock=immediate"))
+		if err != nil {
+			return nil, err
+		}
+		writer.SetMaxOpenConns(1)
+		db.writer = writer
+		_, err = writer.Exec(`CREATE TABLE IF NOT EXISTS buckets (
+			name TEXT PRIMARY KEY,
+			sequence INTEGER NOT NULL DEFAULT 0)`)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open %s: %s", path, err)
+		}
+	}
+	query := "_busy_timeout=5000"
+	if readOnly {
+		query += "&mode=ro"
+	}
+	reader, err := sql.Open("sqlite3", sqliteURI(path, query))
+	if err != nil {
+		return nil, err
+	}
+	db.reader = reader
+	err = reader.Ping()
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %s: %s", path, err)
+	}
+	ok = true
+	return db, nil
+}
+
+func (db *sqliteDB) Backend() string {
+	return sqliteBackend
+}
+
+func (db *sqliteDB) Path() string {
+	return db.path
+}
+
+func (db *sqliteDB) Close() error {
+	var err error
+	if db.reader != nil {
+		err = db.reader.Close()
+		db.reader = nil
+	}
+	if db.writer != nil {
+		// Closing the last connection checkpoints and removes the WAL
+		e := db.writer.Close()
+		if err == nil {
+			err = e
+		}
+		db.writer = nil
+	}
+	return err
+}
+
+func (db *sqliteDB) Update(fn func(tx kvTx) error) error {
+	if db.reader == nil {
+		return errSQLiteNotOpen
+	}
+	if db.writer == nil {
+		return errSQLiteTxNotWritable
+	}
+	return db.run(db.writer, true, fn)
+}
+
+func (db *sqliteDB) View(fn func(tx kvTx) error) error {
+	if db.reader == nil {
+		return errSQLiteNotOpen
+	}
+	return db.run(db.reader, false, fn)
+}
+
+func (db *sqliteDB) run(pool *sql.DB, writable bool, fn func(tx kvTx) error) error {
+	sqlTx, err := pool.Begin()
+	if err != nil {
+		return err
+	}
+	tx := &sqliteTx{
+		tx:       sqlTx,
+		writable: writable,
+	}
+	err = fn(tx)
+	if err == nil {
+		err = tx.err
+	}
+	if err != nil || !writable {
+		sqlTx.Rollback()
+		return err
+	}
+	return sqlTx.Commit()
+}
+
+// sqliteTx records the first error of operations which cannot return one,
+// like Get, and fails the transaction with it.
+type sqliteTx struct {
+	tx       *sql.Tx
+	writable bool
+	// Existing buckets, loaded on first use
+	buckets map[string]bool
+	err     error
+}
+
+func (tx *sqliteTx) fail(err error) {
+	if tx.err == nil {
+		tx.err = err
+	}
+}
+
+func (tx *sqliteTx) loadBuckets() error {
+	if tx.buckets != nil {
+		return nil
+	}
+	rows, err := tx.tx.Query(`SELECT name FROM buckets`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	buckets := map[string]bool{}
+	for rows.Next() {
+		name := ""
+		err = rows.Scan(&name)
+		if err != nil {
+			return err
+		}
+		buckets[name] = true
+	}
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+	tx.buckets = buckets
+	return nil
+}
+
+func (tx *sqliteTx) Bucket(name []byte) kvBucket {
+	err := tx.loadBuckets()
+	if err != nil {
+		tx.fail(err)
+		return nil
+	}
+	if !tx.buckets[string(name)] {
+		return nil
+	}
+	return &sqliteBucket{
+		tx:    tx,
+		name:  string(name),
+		table: quoteSQLiteName(string(name)),
+	}
+}
+
+func (tx *sqliteTx) CreateBucket(name []byte) (kvBucket, error) {
+	if !tx.writable {
+		return nil, errSQLiteTxNotWritable
+	}
+	if tx.Bucket(name) != nil {
+		return nil, errSQLiteBucketExists
+	}
+	if tx.err != nil {
+		return nil, tx.err
+	}
+	_, err := tx.tx.Exec(`CREATE TABLE ` + quoteSQLiteName(string(name)) + ` (
+		key BLOB PRIMARY KEY,
+		value BLOB NOT NULL) WITHOUT ROWID`)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.tx.Exec(`INSERT INTO buckets (name) VALUES (?)`, string(name))
+	if err != nil {
+		return nil, err
+	}
+	tx.buckets[string(name)] = true
+	return tx.Bucket(name), nil
+}
+
+func (tx *sqliteTx) CreateBucketIfNotExists(name []byte) (kvBucket, error) {
+	b := tx.Bucket(name)
+	if b != nil {
+		return b, nil
+	}
+	return tx.CreateBucket(name)
+}
+
+func (tx *sqliteTx) DeleteBucket(name []byte) error {
+	if !tx.writable {
+		return errSQLiteTxNotWritable
+	}
+	if tx.Bucket(name) == nil {
+		if tx.err != nil {
+			return tx.err
+		}
+		return errSQLiteBucketNotFound
+	}
+	_, err := tx.tx.Exec(`DROP TABLE ` + quoteSQLiteName(string(name)))
+	if err != nil {
+		return err
+	}
+	_, err = tx.tx.Exec(`DELETE FROM buckets WHERE name = ?`, string(name))
+	if err != nil {
+		return err
+	}
+	delete(tx.buckets, string(name))
+	return nil
+}
+
+func (tx *sqliteTx) ForEach(fn func(name []byte, b kvBucket) error) error {
+	err := tx.loadBuckets()
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	for name := range tx.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		err := fn([]byte(name), tx.Bucket([]byte(name)))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.err
+}
+
+func quoteSQLiteName(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+type sqliteBucket struct {
+	tx    *sqliteTx
+	name  string
+	table string
+}
+
+// queryRow returns the key and value of the first row returned by query, or
+// nil keys if there is none.
+func (b *sqliteBucket) queryRow(query string, args ...interface{}) ([]byte, []byte) {
+	var k, v []byte
+	err := b.tx.tx.QueryRow(`SELECT key, value FROM `+b.table+` `+query,
+		args...).Scan(&k, &v)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			b.tx.fail(err)
+		}
+		return nil, nil
+	}
+	if v == nil {
+		v = []byte{}
+	}
+	return k, v
+}
+
+func (b *sqliteBucket) Get(key []byte) []byte {
+	_, v := b.queryRow(`WHERE key = ?`, key)
+	return v
+}
+
+func (b *sqliteBucket) Put(key []byte, value []byte) error {
+	if !b.tx.writable {
+		return errSQLiteTxNotWritable
+	}
+	if len(key) == 0 {
+		return errSQLiteKeyRequired
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	_, err := b.tx.tx.Exec(`INSERT OR REPLACE INTO `+b.table+
+		` (key, value) VALUES (?, ?)`, key, value)
+	return err
+}
+
+func (b *sqliteBucket) Delete(key []byte) error {
+	if !b.tx.writable {
+		return errSQLiteTxNotWritable
+	}
+	_, err := b.tx.tx.Exec(`DELETE FROM `+b.table+` WHERE key = ?`, key)
+	return err
+}
+
+func (b *sqliteBucket) ForEach(fn func(k, v []byte) error) error {
+	rows, err := b.tx.tx.Query(`SELECT key, value FROM ` + b.table +
+		` ORDER BY key`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var k, v []byte
+		err = rows.Scan(&k, &v)
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			v = []byte{}
+		}
+		err = fn(k, v)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (b *sqliteBucket) Cursor() kvCursor {
+	return &sqliteCursor{b: b}
+}
+
+func (b *sqliteBucket) NextSequence() (uint64, error) {
+	if !b.tx.writable {
+		return 0, errSQLiteTxNotWritable
+	}
+	seq := b.Sequence() + 1
+	if b.tx.err != nil {
+		return 0, b.tx.err
+	}
+	return seq, b.SetSequence(seq)
+}
+
+func (b *sqliteBucket) Sequence() uint64 {
+	seq := int64(0)
+	err := b.tx.tx.QueryRow(`SELECT sequence FROM buckets WHERE name = ?`,
+		b.name).Scan(&seq)
+	if err != nil {
+		b.tx.fail(err)
+		return 0
+	}
+	return uint64(seq)
+}
+
+func (b *sqliteBucket) SetSequence(seq uint64) error {
+	if !b.tx.writable {
+		return errSQLiteTxNotWritable
+	}
+	_, err := b.tx.tx.Exec(`UPDATE buckets SET sequence = ? WHERE name = ?`,
+		int64(seq), b.name)
+	return err
+}
+
+func (b *sqliteBucket) KeyN() int {
+	n := 0
+	err := b.tx.tx.QueryRow(`SELECT COUNT(*) FROM ` + b.table).Scan(&n)
+	if err != nil {
+		b.tx.fail(err)
+	}
+	return n
+}
+
+// sqliteCursor runs one query per move, from the current key.
+type sqliteCursor struct {
+	b   *sqliteBucket
+	key []byte
+}
+
+func (c *sqliteCursor) move(query string, args ...interface{}) ([]byte, []byte) {
+	k, v := c.b.queryRow(query, args...)
+	c.key = k
+	return k, v
+}
+
+func (c *sqliteCursor) First() ([]byte, []byte) {
+	return c.move(`ORDER BY key LIMIT 1`)
+}
+
+func (c *sqliteCursor) Last() ([]byte, []byte) {
+	return c.move(`ORDER BY key DESC LIMIT 1`)
+}
+
+func (c *sqliteCursor) Next() ([]byte, []byte) {
+	if c.key == nil {
+		return nil, nil
+	}
+	return c.move(`WHERE key > ? ORDER BY key LIMIT 1`, c.key)
+}
+
+func (c *sqliteCursor) Prev() ([]byte, []byte) {
+	if c.key == nil {
+		return nil, nil
+	}
+	return c.move(`WHERE key < ? ORDER BY key DESC LIMIT 1`, c.key)
+}
+
+func (c *sqliteCursor) Seek(seek []byte) ([]byte, []byte) {
+	if seek == nil {
+		// nil binds as NULL, which no key is greater than
+		seek = []byte{}
+	}
+	return c.move(`WHERE key >= ? ORDER BY key LIMIT 1`, seek)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Store data lives in an ordered key/value storage made of named buckets.
+// The storage backend is either bolt, the default, or SQLite. New stores use
+// the backend configured in the store.json file of their directory:
+//
+//	{"backend": "sqlite"}
+//
+// Existing stores are opened with the backend they were created with, "apec
+// upgrade" migrates them to the configured one.
+
+const (
+	boltBackend   = "bolt"
+	sqliteBackend = "sqlite"
+)
+
+// kvDB is the storage backend of a Store.
+type kvDB interface {
+	// Update runs fn in a read-write transaction, committed if fn returns
+	// nil and rolled back otherwise.
+	Update(fn func(tx kvTx) error) error
+	// View runs fn in a read-only transaction.
+	View(fn func(tx kvTx) error) error
+	// Backend returns boltBackend or sqliteBackend.
+	Backend() string
+	Path() string
+	Close() error
+}
+
+// kvTx is a storage transaction. Buckets, cursors, and keys and values they
+// return are only valid until the transaction ends.
+type kvTx interface {
+	// Bucket returns the named bucket, or nil if it does not exist.
+	Bucket(name []byte) kvBucket
+	CreateBucket(name []byte) (kvBucket, error)
+	CreateBucketIfNotExists(name []byte) (kvBucket, error)
+	DeleteBucket(name []byte) error
+	// ForEach calls fn on every bucket, by name order.
+	ForEach(fn func(name []byte, b kvBucket) error) error
+}
+
+// kvBucket is a set of keys and values, sorted by bytes order of the keys.
+type kvBucket interface {
+	// Get returns the value of key, or nil if it does not exist.
+	Get(key []byte) []byte
+	Put(key []byte, value []byte) error
+	Delete(key []byte) error
+	// ForEach calls fn on every key and value, by key order. The bucket must
+	// not be modified by fn.
+	ForEach(fn func(k, v []byte) error) error
+	Cursor() kvCursor
+	// NextSequence increments and returns the bucket sequence.
+	NextSequence() (uint64, error)
+	Sequence() uint64
+	SetSequence(seq uint64) error
+	// KeyN returns the number of keys.
+	KeyN() int
+}
+
+// kvCursor iterates over bucket keys. Moves return a nil key past the first
+// or last key.
+type kvCursor interface {
+	First() ([]byte, []byte)
+	Last() ([]byte, []byte)
+	Next() ([]byte, []byte)
+	Prev() ([]byte, []byte)
+	// Seek moves to the first key greater than or equal to seek.
+	Seek(seek []byte) ([]byte, []byte)
+}
+
+type boltDB struct {
+	*bolt.DB
+}
+
+func (db boltDB) Backend() string {
+	return boltBackend
+}
+
+func (db boltDB) Update(fn func(tx kvTx) error) error {
+	return db.DB.Update(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (db boltDB) View(fn func(tx kvTx) error) error {
+	return db.DB.View(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+type boltTx struct {
+	*bolt.Tx
+}
+
+func (tx boltTx) Bucket(name []byte) kvBucket {
+	b := tx.Tx.Bucket(name)
+	if b == nil {
+		return nil
+	}
+	return boltBucket{b}
+}
+
+func (tx boltTx) CreateBucket(name []byte) (kvBucket, error) {
+	b, err := tx.Tx.CreateBucket(name)
+	if err != nil {
+		return nil, err
+	}
+	return boltBucket{b}, nil
+}
+
+func (tx boltTx) CreateBucketIfNotExists(name []byte) (kvBucket, error) {
+	b, err := tx.Tx.CreateBucketIfNotExists(name)
+	if err != nil {
+		return nil, err
+	}
+	return boltBucket{b}, nil
+}
+
+func (tx boltTx) ForEach(fn func(name []byte, b kvBucket) error) error {
+	return tx.Tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+		return fn(name, boltBucket{b})
+	})
+}
+
+type boltBucket struct {
+	*bolt.Bucket
+}
+
+func (b boltBucket) Cursor() kvCursor {
+	return b.Bucket.Cursor()
+}
+
+func (b boltBucket) KeyN() int {
+	return b.Stats().KeyN
+}
+
+// openBolt opens the bolt database at path. Read-only databases wait for
+// writers locking them at most timeout.
+func openBolt(path string, readOnly bool, timeout time.Duration) (kvDB, error) {
+	mode := os.FileMode(0666)
+	options := &bolt.Options{}
+	if readOnly {
+		mode = 0444
+		options.ReadOnly = true
+		options.Timeout = timeout
+	}
+	db, err := bolt.Open(path, mode, options)
+	if err != nil {
+		if err == bolt.ErrTimeout {
+			return nil, fmt.Errorf("store %s is locked by another process, "+
+				"use --server to query it", path)
+		}
+		return nil, err
+	}
+	return boltDB{db}, nil
+}
+
+var sqliteHeader = []byte("SQLite format 3\x00")
+
+// detectBackend returns the backend of the store file at path, or an empty
+// string if it does not exist.
+func detectBackend(path string) (string, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	defer fp.Close()
+	header := make([]byte, len(sqliteHeader))
+	_, err = io.ReadFull(fp, header)
+	if err == nil && bytes.Equal(header, sqliteHeader) {
+		return sqliteBackend, nil
+	}
+	return boltBackend, nil
+}
+
+// openKV opens the store file at path with its backend. Missing files are
+// created with backend.
+func openKV(path, backend string, readOnly bool) (kvDB, error) {
+	detected, err := detectBackend(path)
+	if err != nil {
+		return nil, err
+	}
+	if detected != "" {
+		backend = detected
+	}
+	if backend == sqliteBackend {
+		return openSQLite(path, readOnly)
+	}
+	return openBolt(path, readOnly, 5*time.Second)
+}
+
+// copyKV copies every bucket of src, with its sequence, in dst.
+func copyKV(src, dst kvDB) error {
+	return src.View(func(srcTx kvTx) error {
+		return dst.Update(func(dstTx kvTx) error {
+			return srcTx.ForEach(func(name []byte, b kvBucket) error {
+				copied, err := dstTx.CreateBucketIfNotExists(name)
+				if err != nil {
+					return err
+				}
+				// Keys and values point into the source storage. Put
+				// requires them to stay valid until dst commits, which the
+				// enclosing read transaction guarantees.
+				err = b.ForEach(func(k, v []byte) error {
+					return copied.Put(k, v)
+				})
+				if err != nil {
+					return err
+				}
+				return copied.SetSequence(b.Sequence())
+			})
+		})
+	})
+}
+
+// StoreConfig is read from the store.json file of the data directory.
+type StoreConfig struct {
+	// Backend of new stores, bolt or sqlite
+	Backend string `json:"backend"`
+}
+
+// loadStoreConfig reads the store configuration at path. Missing files get
+// default values.
+func loadStoreConfig(path string) (*StoreConfig, error) {
+	cfg := &StoreConfig{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	} else {
+		err = json.Unmarshal(data, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse store configuration %s: %s",
+				path, err)
+		}
+	}
+	switch cfg.Backend {
+	case "":
+		cfg.Backend = boltBackend
+	case boltBackend, sqliteBackend:
+	default:
+		return nil, fmt.Errorf("invalid store configuration %s: unknown "+
+			"backend %q", path, cfg.Backend)
+	}
+	return cfg, nil
+}
+
+// storeConfigPath returns the store.json file applying to the store at path.
+func storeConfigPath(path string) string {
+	return filepath.Join(filepath.Dir(path), "store.json")
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// openTempBackendStore opens a new store created with backend in a
+// temporary directory.
+func openTempBackendStore(t *testing.T, backend string) *Store {
+	dir, err := ioutil.TempDir("", "apec-")
+	if err != nil {
+		t.Fatalf("could not create store temporary directory: %s", err)
+	}
+	path := filepath.Join(dir, "store")
+	err = ioutil.WriteFile(storeConfigPath(path),
+		[]byte(`{"backend": "`+backend+`"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := OpenStore(path)
+	if err != nil {
+		t.Fatalf("could not open store on %s: %s", path, err)
+	}
+	return store
+}
+
+// dumpStore returns the keys, values and sequence of every store bucket.
+func dumpStore(t *testing.T, store *Store) map[string]map[string]string {
+	buckets := map[string]map[string]string{}
+	err := store.db.View(func(tx kvTx) error {
+		return tx.ForEach(func(name []byte, b kvBucket) error {
+			values := map[string]string{
+				"sequence": fmt.Sprint(b.Sequence()),
+			}
+			buckets[string(name)] = values
+			return b.ForEach(func(k, v []byte) error {
+				values["key:"+string(k)] = string(v)
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buckets
+}
+
+func TestSQLiteStore(t *testing.T) {
+	store := openTempBackendStore(t, sqliteBackend)
+	defer closeAndDeleteStore(t, store)
+	if store.Backend() != sqliteBackend {
+		t.Fatalf("unexpected backend: %s", store.Backend())
+	}
+	backend, err := detectBackend(store.Path())
+	if err != nil || backend != sqliteBackend {
+		t.Fatalf("unexpected detected backend: %s, %v", backend, err)
+	}
+
+	now := time.Date(2017, 1, 2, 10, 0, 0, 0, time.UTC)
+	err = store.PutMany(map[string][]byte{
+		"apec:1": []byte("one"),
+		"apec:2": []byte("two"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		deletedId, err := store.Delete("apec:1", now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deletedId != uint64(i+1) {
+			t.Fatalf("unexpected deleted identifier: %d", deletedId)
+		}
+		err = store.Put("apec:1", []byte("one"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := store.Get("apec:3")
+	if err != nil || data != nil {
+		t.Fatalf("unexpected missing offer: %q, %v", data, err)
+	}
+	data, err = store.GetDeleted(2)
+	if err != nil || string(data) != "one" {
+		t.Fatalf("unexpected deleted offer: %q, %v", data, err)
+	}
+	ids, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, []string{"apec:1", "apec:2"}) ||
+		store.Size() != 2 {
+		t.Fatalf("unexpected offers: %v, %d", ids, store.Size())
+	}
+
+	// Cursors
+	for i := 0; i < 3; i++ {
+		err = store.AppendAudit(&AuditEntry{Action: fmt.Sprintf("action%d", i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := store.ListAudit(3, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Id != 2 || entries[1].Id != 1 {
+		t.Fatalf("unexpected audit entries: %+v", entries)
+	}
+
+	// Bucket removal
+	err = store.PutQuarantined(&QuarantinedOffer{Id: "apec:4", Time: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleared, err := store.ClearQuarantined()
+	if err != nil || cleared != 1 {
+		t.Fatalf("unexpected cleared offers: %d, %v", cleared, err)
+	}
+	quarantined, err := store.IsQuarantined("apec:4")
+	if err != nil || quarantined {
+		t.Fatalf("offer is still quarantined: %v", err)
+	}
+}
+
+func TestSQLiteStoreReader(t *testing.T) {
+	store := openTempBackendStore(t, sqliteBackend)
+	defer closeAndDeleteStore(t, store)
+	err := store.Put("apec:1", []byte("one"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Readers do not wait for the writer to close the store
+	reader, err := OpenStoreReadOnly(store.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	err = store.Put("apec:2", []byte("two"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := reader.Get("apec:2")
+	if err != nil || string(data) != "two" {
+		t.Fatalf("unexpected offer: %q, %v", data, err)
+	}
+	err = reader.Put("apec:3", []byte("three"))
+	if err == nil {
+		t.Fatalf("read-only store was updated")
+	}
+}
+
+func TestMigrateStoreBackend(t *testing.T) {
+	store := openTempBackendStore(t, boltBackend)
+	path := store.Path()
+	now := time.Date(2017, 1, 2, 10, 0, 0, 0, time.UTC)
+	err := store.PutMany(map[string][]byte{
+		"apec:1": []byte("one"),
+		"apec:2": []byte("two"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.Delete("apec:1", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.AppendAudit(&AuditEntry{Action: "delete"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := dumpStore(t, store)
+	closeAndDeleteStore(t, store)
+
+	// Nothing to migrate
+	err = migrateStoreBackend(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend, err := detectBackend(path)
+	if err != nil || backend != boltBackend {
+		t.Fatalf("unexpected backend: %s, %v", backend, err)
+	}
+
+	err = ioutil.WriteFile(storeConfigPath(path),
+		[]byte(`{"backend": "sqlite"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = migrateStoreBackend(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend, err = detectBackend(path + ".bolt")
+	if err != nil || backend != boltBackend {
+		t.Fatalf("previous store was not kept: %s, %v", backend, err)
+	}
+	migrated, err := OpenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeAndDeleteStore(t, migrated)
+	if migrated.Backend() != sqliteBackend {
+		t.Fatalf("unexpected backend: %s", migrated.Backend())
+	}
+	after := dumpStore(t, migrated)
+	if !reflect.DeepEqual(before, after) {
+		t.Fatalf("migrated store differs:\n%v\n!=\n%v", after, before)
+	}
+	// Deleted identifiers continue the previous sequence
+	deletedId, err := migrated.Delete("apec:2", now)
+	if err != nil || deletedId != 2 {
+		t.Fatalf("unexpected deleted identifier: %d, %v", deletedId, err)
+	}
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"fmt"
 	"log"
+	"math"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 	"unicode"
@@ -155,7 +158,90 @@ func nfcString(s string) []string {
 	return []string{result}
 }
 
+var (
+	// nationwideWords are the only words allowed in locations like "France",
+	// "Télétravail - France entière" or "National", which do not designate a
+	// place but the whole country. At least one of them must be significant.
+	nationwideWords = map[string]bool{
+		"france":         true,
+		"national":       true,
+		"nationale":      true,
+		"teletravail":    true,
+		"remote":         true,
+		"entiere":        false,
+		"metropolitaine": false,
+		"full":           false,
+		"toute":          false,
+		"tout":           false,
+		"la":             false,
+		"le":             false,
+		"territoire":     false,
+		"100":            false,
+	}
+	// remoteWords mark nationwide locations designating remote work
+	remoteWords = map[string]bool{
+		"teletravail": true,
+		"remote":      true,
+	}
+	reNationwideSep = regexp.MustCompile(`[^a-z0-9]+`)
+	// nationwideCandidate is returned by fixLocation for nationwide locations.
+	nationwideCandidate = "france entière"
+)
+
+// franceCentroid is where geocoding "France" and the like placed offers
+// before nationwide locations were detected.
+var franceCentroid = Location{
+	Country: "France",
+	Lat:     46.603354,
+	Lon:     1.8883335,
+}
+
+// isFranceCentroid returns true if loc is a regular location at
+// franceCentroid.
+func isFranceCentroid(loc *Location) bool {
+	return !loc.Nationwide &&
+		math.Abs(loc.Lat-franceCentroid.Lat) < 1e-4 &&
+		math.Abs(loc.Lon-franceCentroid.Lon) < 1e-4
+}
+
+// isNationwideLocation returns true if s designates the whole country or
+// remote work rather than a place.
+func isNationwideLocation(s string) bool {
+	s = removeDiacritics(nfdString(strings.ToLower(s)))
+	found := false
+	for _, w := range reNationwideSep.Split(s, -1) {
+		if w == "" {
+			continue
+		}
+		significant, ok := nationwideWords[w]
+		if !ok {
+			return false
+		}
+		found = found || significant
+	}
+	return found
+}
+
+// isRemoteLocation returns true if s designates remote work, like
+// "Télétravail - France entière". Other nationwide locations, like "France",
+// are offers in several places of the country.
+func isRemoteLocation(s string) bool {
+	if !isNationwideLocation(s) {
+		return false
+	}
+	s = removeDiacritics(nfdString(strings.ToLower(s)))
+	for _, w := range reNationwideSep.Split(s, -1) {
+		if remoteWords[w] {
+			return true
+		}
+	}
+	return false
+}
+
 func fixLocation(s string) []string {
+	if isNationwideLocation(s) {
+		return []string{nationwideCandidate}
+	}
 	result := []string{nfdString(strings.TrimSpace(strings.ToLower(s)))}
 	result = apply(result, splitAlternatives)
 	result = apply(result, stripPrefixes)
@@ -173,6 +259,13 @@ func geocodeOffer(geocoder *Geocoder, location string, offline bool,
 
 	candidates := fixLocation(location)
 	for _, c := range candidates {
+		if c == nationwideCandidate {
+			// Geocoding would land on an arbitrary centroid
+			return &Location{
+				Country:    "France",
+				Nationwide: true,
+			}, false, offline, nil
+		}
 		// Resolve from cache
 		pos, ok, err := geocoder.GetCachedLocation(c, "fr")
 		if err != nil {
@@ -193,7 +286,7 @@ func geocodeOffer(geocoder *Geocoder, location string, offline bool,
 			offline = true
 			continue
 		}
-		if loc.Rate.Remaining <= minQuota {
+		if loc.Rate.Limit > 0 && loc.Rate.Remaining <= minQuota {
 			// Try to preserve quota for test purpose. This is not
 			// perfect as it consumes one geocoding token per function
 			// call. I do not know how to query quota directly yet.
@@ -219,7 +312,10 @@ func geocodeOffers(store *Store, geocoder *Geocoder, offers []*Offer,
 
 	rejected := 0
 	offline := false
+	progress := NewProgress("geocode", len(offers))
+	defer progress.Done()
 	for _, offer := range offers {
+		progress.Add(1)
 		pos, _, off, err := geocodeOffer(geocoder, offer.Location,
 			offline, minQuota)
 		if err != nil {
@@ -238,3 +334,117 @@ func geocodeOffers(store *Store, geocoder *Geocoder, offers []*Offer,
 	}
 	return rejected, nil
 }
+
+// LocationStat summarizes the geocoding status of offers sharing the same
+// raw location string.
+type LocationStat struct {
+	Location string
+	Offers   int
+	Geocoded int
+	Rejected int
+	Pending  int
+}
+
+// Failed returns the number of offers without a location.
+func (s *LocationStat) Failed() int {
+	return s.Rejected + s.Pending
+}
+
+type sortedLocationStats []*LocationStat
+
+func (s sortedLocationStats) Len() int {
+	return len(s)
+}
+
+func (s sortedLocationStats) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s sortedLocationStats) Less(i, j int) bool {
+	if s[i].Offers != s[j].Offers {
+		return s[i].Offers > s[j].Offers
+	}
+	return s[i].Location < s[j].Location
+}
+
+// collectLocationStats groups live offers by location string, most frequent
+// first. Offers rejected by the geocoder have an empty cached location,
+// pending ones were never geocoded.
+func collectLocationStats(store *Store) ([]*LocationStat, error) {
+	rawOffers, err := loadOffers(store)
+	if err != nil {
+		return nil, err
+	}
+	offers, err := convertOffers(rawOffers)
+	if err != nil {
+		return nil, err
+	}
+	stats := map[string]*LocationStat{}
+	for _, offer := range offers {
+		st := stats[offer.Location]
+		if st == nil {
+			st = &LocationStat{Location: offer.Location}
+			stats[offer.Location] = st
+		}
+		st.Offers++
+		loc, date, err := store.GetLocation(offer.Id)
+		if err != nil {
+			return nil, err
+		}
+		if loc != nil {
+			st.Geocoded++
+		} else if !date.IsZero() {
+			st.Rejected++
+		} else {
+			st.Pending++
+		}
+	}
+	result := []*LocationStat{}
+	for _, st := range stats {
+		result = append(result, st)
+	}
+	sort.Sort(sortedLocationStats(result))
+	return result, nil
+}
+
+var (
+	locationsCmd    = app.Command("locations", "inspect offers locations")
+	locationsTopCmd = locationsCmd.Command("top", `list most frequent offer locations
+
+Raw location strings are listed with their number of offers, how many of them
+were geocoded, rejected by the geocoder or not geocoded yet, and the
+normalized candidates passed to the geocoder.
+`)
+	locationsTopCount = locationsTopCmd.Flag("count", "number of locations to list").
+				Default("50").Int()
+	locationsTopFailed = locationsTopCmd.Flag("failed",
+		"only list locations with offers which could not be geocoded").Bool()
+)
+
+func locationsTopFn(cfg *Config) error {
+	store, err := OpenStore(cfg.Store())
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	stats, err := collectLocationStats(store)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%8s %8s %8s %8s  %s\n", "offers", "geocoded", "rejected", "pending",
+		"location")
+	listed := 0
+	for _, st := range stats {
+		if *locationsTopCount > 0 && listed >= *locationsTopCount {
+			break
+		}
+		if *locationsTopFailed && st.Failed() == 0 {
+			continue
+		}
+		listed++
+		fmt.Printf("%8d %8d %8d %8d  %q => %q\n", st.Offers, st.Geocoded,
+			st.Rejected, st.Pending, st.Location, fixLocation(st.Location))
+	}
+	return nil
+}
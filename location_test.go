@@ -1,6 +1,8 @@
 package main
 
 import (
+	"fmt"
+	"reflect"
 	"testing"
 )
 
@@ -61,3 +63,68 @@ func TestFixLocation(t *testing.T) {
 		}
 	}
 }
+
+func TestIsNationwideLocation(t *testing.T) {
+	tests := []struct {
+		Input      string
+		Nationwide bool
+		Remote     bool
+	}{
+		{"France", true, false},
+		{"Télétravail - France entière", true, true},
+		{"TOUTE LA FRANCE", true, false},
+		{"National", true, false},
+		{"Full remote", true, true},
+		{"Paris, France", false, false},
+		{"Ile-de-France", false, false},
+		{"Télétravail partiel Lyon", false, false},
+		{"Toute la", false, false},
+		{"", false, false},
+	}
+	for _, test := range tests {
+		nationwide := isNationwideLocation(test.Input)
+		if nationwide != test.Nationwide {
+			t.Fatalf("%q: expected nationwide=%v, got %v", test.Input,
+				test.Nationwide, nationwide)
+		}
+		remote := isRemoteLocation(test.Input)
+		if remote != test.Remote {
+			t.Fatalf("%q: expected remote=%v, got %v", test.Input, test.Remote,
+				remote)
+		}
+	}
+}
+
+func TestCollectLocationStats(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	// Storing an offer invalidates its cached location
+	data, err := env.Store.Get("apec:1002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = env.Store.Put("apec:1002", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := collectLocationStats(env.Store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := []string{}
+	for _, st := range stats {
+		result = append(result, fmt.Sprintf("%s: %d/%d/%d/%d", st.Location,
+			st.Offers, st.Geocoded, st.Rejected, st.Pending))
+	}
+	expected := []string{
+		"Paris: 2/1/0/1",
+		"Atlantide: 1/0/1/0",
+		"Bordeaux: 1/1/0/0",
+		"Lyon: 1/1/0/0",
+		"Télétravail - France entière: 1/1/0/0",
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Fatalf("unexpected stats:\n%v\n!=\n%v", result, expected)
+	}
+}
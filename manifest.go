@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pmezard/apec/jstruct"
+)
+
+const (
+	manifestVersion = 1
+)
+
+// ManifestFile describes one jsonl part of an offers dump. SHA256 is computed
+// on the file content as stored on disk, after compression.
+type ManifestFile struct {
+	Name        string `json:"name"`
+	Records     int    `json:"records"`
+	SHA256      string `json:"sha256"`
+	Compression string `json:"compression,omitempty"`
+}
+
+type ManifestParameters struct {
+	Active  bool   `json:"active"`
+	Query   string `json:"query,omitempty"`
+	Where   string `json:"where,omitempty"`
+	From    string `json:"from,omitempty"`
+	To      string `json:"to,omitempty"`
+	SplitBy string `json:"split_by,omitempty"`
+}
+
+// Manifest is written next to offers dumps so they can be verified and
+// imported elsewhere. File names are relative to the manifest directory.
+type Manifest struct {
+	Version      int                `json:"version"`
+	Created      time.Time          `json:"created"`
+	StoreVersion int                `json:"store_version"`
+	Parameters   ManifestParameters `json:"parameters"`
+	Files        []ManifestFile     `json:"files"`
+}
+
+func writeManifest(path string, manifest *Manifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(data, '\n'), 0644)
+}
+
+func readManifest(path string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &Manifest{}
+	err = json.Unmarshal(data, manifest)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode manifest %s: %s", path, err)
+	}
+	if manifest.Version != manifestVersion {
+		return nil, fmt.Errorf("unsupported manifest version %d, expected %d",
+			manifest.Version, manifestVersion)
+	}
+	return manifest, nil
+}
+
+// openManifestFile returns a reader on the decompressed content of a dump
+// part.
+func openManifestFile(dir string, f ManifestFile) (io.ReadCloser, error) {
+	fp, err := os.Open(filepath.Join(dir, f.Name))
+	if err != nil {
+		return nil, err
+	}
+	switch f.Compression {
+	case "":
+		return fp, nil
+	case "gzip":
+		r, err := gzip.NewReader(fp)
+		if err != nil {
+			fp.Close()
+			return nil, err
+		}
+		return &closingReader{Reader: r, closers: []io.Closer{r, fp}}, nil
+	case "zstd":
+		r, err := zstd.NewReader(fp)
+		if err != nil {
+			fp.Close()
+			return nil, err
+		}
+		rc := r.IOReadCloser()
+		return &closingReader{Reader: rc, closers: []io.Closer{rc, fp}}, nil
+	}
+	fp.Close()
+	return nil, fmt.Errorf("unknown compression for %s: %s", f.Name, f.Compression)
+}
+
+type closingReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *closingReader) Close() error {
+	var err error
+	for _, c := range r.closers {
+		e := c.Close()
+		if err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// forEachManifestLine calls callback with every line of a dump part.
+func forEachManifestLine(dir string, f ManifestFile, callback func([]byte) error) error {
+	r, err := openManifestFile(dir, f)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		err = callback(scanner.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+	err = scanner.Err()
+	if err != nil {
+		return fmt.Errorf("cannot read %s: %s", f.Name, err)
+	}
+	return r.Close()
+}
+
+// verifyManifest checks dump parts checksums and records count.
+func verifyManifest(dir string, manifest *Manifest) error {
+	for _, f := range manifest.Files {
+		fp, err := os.Open(filepath.Join(dir, f.Name))
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, fp)
+		fp.Close()
+		if err != nil {
+			return err
+		}
+		sum := hex.EncodeToString(h.Sum(nil))
+		if sum != f.SHA256 {
+			return fmt.Errorf("checksum mismatch for %s: expected %s, got %s",
+				f.Name, f.SHA256, sum)
+		}
+		records := 0
+		err = forEachManifestLine(dir, f, func([]byte) error {
+			records++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if records != f.Records {
+			return fmt.Errorf("records count mismatch for %s: expected %d, got %d",
+				f.Name, f.Records, records)
+		}
+	}
+	return nil
+}
+
+var (
+	importCmd = app.Command("import", `import offers dumped with the offers command
+
+The dump manifest is verified before anything is imported. Offers are
+imported in an empty store, deleted versions are recorded as deleted at their
+original deletion date, then initial dates are rebuilt.
+`)
+	importManifest = importCmd.Arg("manifest", "dump manifest path").Required().String()
+	importVerify   = importCmd.Flag("verify-only", "only verify the dump").Bool()
+)
+
+func importOffer(store *Store, line []byte) error {
+	doc := map[string]interface{}{}
+	err := json.Unmarshal(line, &doc)
+	if err != nil {
+		return err
+	}
+	deletionDate, _ := doc["deletionDate"].(string)
+	delete(doc, "deletionDate")
+	data, err := json.Marshal(&doc)
+	if err != nil {
+		return err
+	}
+	js := &jstruct.JsonOffer{}
+	err = json.Unmarshal(data, js)
+	if err != nil {
+		return err
+	}
+	if js.Id == "" {
+		return fmt.Errorf("offer without identifier: %s", string(line))
+	}
+	id := makeOfferId(apecSource, js.Id)
+	if deletionDate == "" {
+		return store.Put(id, data)
+	}
+	date, err := time.Parse(time.RFC3339, deletionDate)
+	if err != nil {
+		return fmt.Errorf("cannot parse %s deletion date: %s", js.Id, err)
+	}
+	// Deleted versions are dumped before live ones, there is no live version
+	// to preserve yet.
+	err = store.Put(id, data)
+	if err != nil {
+		return err
+	}
+	_, err = store.Delete(id, date)
+	return err
+}
+
+func importFn(cfg *Config) error {
+	manifest, err := readManifest(*importManifest)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(*importManifest)
+	err = verifyManifest(dir, manifest)
+	if err != nil {
+		return fmt.Errorf("dump verification failed: %s", err)
+	}
+	total := 0
+	for _, f := range manifest.Files {
+		total += f.Records
+	}
+	fmt.Printf("dump verified: %d files, %d records, store version %d\n",
+		len(manifest.Files), total, manifest.StoreVersion)
+	if *importVerify {
+		return nil
+	}
+	if manifest.StoreVersion != storeVersion {
+		return fmt.Errorf("cannot import dump from store version %d into version %d",
+			manifest.StoreVersion, storeVersion)
+	}
+
+	store, err := OpenStore(cfg.Store())
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	if store.Size() > 0 {
+		return fmt.Errorf("cannot import into non-empty store %s", store.Path())
+	}
+	ids, err := store.ListDeletedIds()
+	if err != nil {
+		return err
+	}
+	if len(ids) > 0 {
+		return fmt.Errorf("cannot import into non-empty store %s", store.Path())
+	}
+
+	imported := 0
+	for _, f := range manifest.Files {
+		err = forEachManifestLine(dir, f, func(line []byte) error {
+			imported++
+			if imported%1000 == 0 {
+				fmt.Printf("%d/%d offers imported\n", imported, total)
+			}
+			return importOffer(store, line)
+		})
+		if err != nil {
+			return fmt.Errorf("could not import %s: %s", f.Name, err)
+		}
+	}
+	fmt.Printf("%d offers imported\n", imported)
+	err = rebuildInitialDates(store)
+	if err != nil {
+		return err
+	}
+	return store.Close()
+}
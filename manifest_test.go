@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestManifestVerifyAndImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apec-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, err := NewOfferWriter(filepath.Join(dir, "offers"), ".json", "gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := []string{
+		`{"numeroOffre":"1","intitule":"old","datePublication":"2017-01-01T10:00:00.000+0000","deletionDate":"2017-01-10T08:00:00Z"}`,
+		`{"numeroOffre":"1","intitule":"new","datePublication":"2017-01-11T10:00:00.000+0000"}`,
+		`{"numeroOffre":"2","intitule":"other","datePublication":"2017-01-05T10:00:00.000+0000"}`,
+	}
+	for _, line := range lines {
+		err = w.WriteBytes([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "offers-manifest.json")
+	err = writeManifest(path, &Manifest{
+		Version:      manifestVersion,
+		StoreVersion: storeVersion,
+		Files:        w.Files(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := readManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Files) != 1 || manifest.Files[0].Records != 3 {
+		t.Fatalf("unexpected manifest files: %+v", manifest.Files)
+	}
+	err = verifyManifest(dir, manifest)
+	if err != nil {
+		t.Fatalf("could not verify dump: %s", err)
+	}
+
+	store := openTempStore(t)
+	defer closeAndDeleteStore(t, store)
+	err = forEachManifestLine(dir, manifest.Files[0], func(line []byte) error {
+		return importOffer(store, line)
+	})
+	if err != nil {
+		t.Fatalf("could not import dump: %s", err)
+	}
+	if store.Size() != 2 {
+		t.Fatalf("unexpected live offers: %d", store.Size())
+	}
+	deleted, err := store.ListDeletedOffers("apec:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 || deleted[0].Date != "2017-01-10T08:00:00Z" {
+		t.Fatalf("unexpected deleted offers: %+v", deleted)
+	}
+
+	// Corrupt the dump
+	manifest.Files[0].SHA256 = "0000"
+	err = verifyManifest(dir, manifest)
+	if err == nil {
+		t.Fatalf("corrupted dump was verified")
+	}
+}
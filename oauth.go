@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Users can log in with an OAuth 2.0 provider instead of a password, with
+// the authorization code flow of RFC 6749. The provider must return the
+// user email from an OpenID Connect like userinfo endpoint. Emails are
+// matched against existing accounts, unknown ones get a viewer account only
+// if signup is enabled. Accounts created this way have no password.
+
+const (
+	oauthStateCookie   = "apec_oauth_state"
+	oauthStateLifetime = 10 * time.Minute
+)
+
+type OAuthProvider struct {
+	// Name is displayed on the login page
+	Name        string
+	AuthURL     string
+	TokenURL    string
+	UserInfoURL string
+	ClientId    string
+	Secret      string
+	// RedirectURL is the callback URL registered with the provider, like
+	// https://example.com/apec/login/oauth/callback
+	RedirectURL string
+	// Signup creates viewer accounts for unknown verified emails
+	Signup bool
+	client *http.Client
+}
+
+func NewOAuthProvider(name, authURL, tokenURL, userInfoURL, clientId, secret,
+	redirectURL string, signup bool) (*OAuthProvider, error) {
+
+	for _, v := range []struct {
+		Name  string
+		Value string
+	}{
+		{"authorization URL", authURL},
+		{"token URL", tokenURL},
+		{"userinfo URL", userInfoURL},
+		{"client identifier", clientId},
+		{"client secret", secret},
+		{"redirect URL", redirectURL},
+	} {
+		if v.Value == "" {
+			return nil, fmt.Errorf("OAuth %s is missing", v.Name)
+		}
+	}
+	return &OAuthProvider{
+		Name:        name,
+		AuthURL:     authURL,
+		TokenURL:    tokenURL,
+		UserInfoURL: userInfoURL,
+		ClientId:    clientId,
+		Secret:      secret,
+		RedirectURL: redirectURL,
+		Signup:      signup,
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+	}, nil
+}
+
+// AuthCodeURL returns the provider URL users are sent to, carrying state.
+func (p *OAuthProvider) AuthCodeURL(state string) string {
+	values := url.Values{
+		"response_type": {"code"},
+		"client_id":     {p.ClientId},
+		"redirect_uri":  {p.RedirectURL},
+		"scope":         {"openid email"},
+		"state":         {state},
+	}
+	sep := "?"
+	if strings.Contains(p.AuthURL, "?") {
+		sep = "&"
+	}
+	return p.AuthURL + sep + values.Encode()
+}
+
+// readJSON decodes rsp JSON body into result, or fails with its status.
+func readJSON(rsp *http.Response, result interface{}) error {
+	defer rsp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(rsp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", rsp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.Unmarshal(body, result)
+}
+
+// Exchange trades an authorization code for an access token.
+func (p *OAuthProvider) Exchange(code string) (string, error) {
+	values := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {p.RedirectURL},
+	}
+	rq, err := http.NewRequest("POST", p.TokenURL,
+		strings.NewReader(values.Encode()))
+	if err != nil {
+		return "", err
+	}
+	rq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rq.Header.Set("Accept", "application/json")
+	rq.SetBasicAuth(url.QueryEscape(p.ClientId), url.QueryEscape(p.Secret))
+	rsp, err := p.client.Do(rq)
+	if err != nil {
+		return "", err
+	}
+	token := &struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+	}{}
+	err = readJSON(rsp, token)
+	if err != nil {
+		return "", fmt.Errorf("could not exchange OAuth code: %s", err)
+	}
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("OAuth token response has no access token")
+	}
+	return token.AccessToken, nil
+}
+
+// GetEmail returns the verified email of the user granting token.
+func (p *OAuthProvider) GetEmail(token string) (string, error) {
+	rq, err := http.NewRequest("GET", p.UserInfoURL, nil)
+	if err != nil {
+		return "", err
+	}
+	rq.Header.Set("Authorization", "Bearer "+token)
+	rq.Header.Set("Accept", "application/json")
+	rsp, err := p.client.Do(rq)
+	if err != nil {
+		return "", err
+	}
+	info := &struct {
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}{}
+	err = readJSON(rsp, info)
+	if err != nil {
+		return "", fmt.Errorf("could not get OAuth user information: %s", err)
+	}
+	// Providers omitting the claim do not vouch for the address
+	if !info.EmailVerified {
+		return "", fmt.Errorf("OAuth email is not verified: %s", info.Email)
+	}
+	return normalizeEmail(info.Email)
+}
+
+// handleOAuthLogin sends the user to the provider, remembering the next
+// parameter and a random state in a short-lived cookie.
+func handleOAuthLogin(provider *OAuthProvider, publicURL string,
+	w http.ResponseWriter, r *http.Request) error {
+
+	state, err := randomHex(16)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name: oauthStateCookie,
+		Value: url.Values{
+			"state": {state},
+			"next":  {r.FormValue("next")},
+		}.Encode(),
+		Path:     publicURL + "/login/oauth",
+		MaxAge:   int(oauthStateLifetime / time.Second),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, provider.AuthCodeURL(state), http.StatusSeeOther)
+	return nil
+}
+
+// oauthUser returns the account of the user who authorized the callback
+// request r, creating it if signup is enabled, or nil if there is none.
+func oauthUser(provider *OAuthProvider, accounts *Accounts,
+	r *http.Request) (*User, string, error) {
+
+	if e := r.FormValue("error"); e != "" {
+		return nil, "", fmt.Errorf("OAuth authorization failed: %s", e)
+	}
+	cookie, err := r.Cookie(oauthStateCookie)
+	if err != nil {
+		return nil, "", fmt.Errorf("OAuth state cookie is missing")
+	}
+	saved, err := url.ParseQuery(cookie.Value)
+	if err != nil {
+		return nil, "", err
+	}
+	state := saved.Get("state")
+	if state == "" || !hmac.Equal([]byte(state), []byte(r.FormValue("state"))) {
+		return nil, "", fmt.Errorf("OAuth state does not match")
+	}
+	next := saved.Get("next")
+	token, err := provider.Exchange(r.FormValue("code"))
+	if err != nil {
+		return nil, next, err
+	}
+	email, err := provider.GetEmail(token)
+	if err != nil {
+		return nil, next, err
+	}
+	user, err := accounts.GetUser(email)
+	if err != nil || user != nil || !provider.Signup {
+		if user == nil && err == nil {
+			log.Printf("OAuth login refused for unknown user %s", email)
+		}
+		return user, next, err
+	}
+	user = &User{
+		Email:   email,
+		Created: time.Now(),
+	}
+	err = accounts.PutUser(user)
+	if err != nil {
+		return nil, next, err
+	}
+	log.Printf("user %s signed up with %s", email, provider.Name)
+	return user, next, nil
+}
+
+// handleOAuthCallback opens a session for the user returned by the provider
+// and redirects to the next parameter of the login request.
+func handleOAuthCallback(provider *OAuthProvider, accounts *Accounts,
+	publicURL string, w http.ResponseWriter, r *http.Request) error {
+
+	http.SetCookie(w, &http.Cookie{
+		Name:   oauthStateCookie,
+		Path:   publicURL + "/login/oauth",
+		MaxAge: -1,
+	})
+	user, next, err := oauthUser(provider, accounts, r)
+	if err != nil {
+		log.Printf("OAuth login failed: %s", err)
+		http.Error(w, "login failed", http.StatusForbidden)
+		return nil
+	}
+	if user == nil {
+		http.Error(w, "no account for this user", http.StatusForbidden)
+		return nil
+	}
+	token, err := accounts.CreateSession(user.Email, time.Now())
+	if err != nil {
+		return err
+	}
+	setSessionCookie(w, r, publicURL, token, int(sessionLifetime/time.Second))
+	http.Redirect(w, r, loginRedirect(publicURL, next), http.StatusSeeOther)
+	return nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestOAuthServer returns a provider granting code to the owner of email.
+func newTestOAuthServer(t *testing.T, code, email string) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, ok := r.BasicAuth()
+		if !ok || id != "apec" || secret != "s3cret" ||
+			r.FormValue("code") != code ||
+			r.FormValue("grant_type") != "authorization_code" {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		fmt.Fprint(w, `{"access_token":"token-1","token_type":"Bearer"}`)
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token-1" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, `{"email":%q,"email_verified":true}`, email)
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestOAuthLogin(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+	accounts := openTempAccounts(t, env)
+	defer accounts.Close()
+
+	user, err := NewUser("jane@example.com", "correct horse", roleViewer,
+		time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = accounts.PutUser(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	email := "Jane@example.com"
+	server := newTestOAuthServer(t, "code-1", email)
+	defer server.Close()
+	provider, err := NewOAuthProvider("Example", "https://auth.example.com/auth",
+		server.URL+"/token", server.URL+"/userinfo", "apec", "s3cret",
+		"https://apec.example.com/apec/login/oauth/callback", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Start the flow and return the callback response
+	login := func(code string, tamper bool) *httptest.ResponseRecorder {
+		rq := httptest.NewRequest("GET",
+			"/apec/login/oauth?next=/apec/search%3Fwhat%3Dpython", nil)
+		w := httptest.NewRecorder()
+		err := handleOAuthLogin(provider, "/apec", w, rq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != http.StatusSeeOther {
+			t.Fatalf("unexpected OAuth redirection: %d", w.Code)
+		}
+		u, err := url.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := u.Query()
+		if u.Host != "auth.example.com" || values.Get("client_id") != "apec" ||
+			values.Get("redirect_uri") != provider.RedirectURL {
+			t.Fatalf("unexpected authorization URL: %s", u)
+		}
+		state := values.Get("state")
+		if tamper {
+			state += "0"
+		}
+		rq = httptest.NewRequest("GET", "/apec/login/oauth/callback?"+
+			url.Values{"code": {code}, "state": {state}}.Encode(), nil)
+		for _, c := range w.Result().Cookies() {
+			rq.AddCookie(c)
+		}
+		w = httptest.NewRecorder()
+		err = handleOAuthCallback(provider, accounts, "/apec", w, rq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+
+	for _, test := range []struct {
+		Code   string
+		Tamper bool
+	}{
+		{"code-2", false},
+		{"code-1", true},
+	} {
+		w := login(test.Code, test.Tamper)
+		for _, c := range w.Result().Cookies() {
+			if c.Name == sessionCookie {
+				t.Fatalf("%+v: unexpected session", test)
+			}
+		}
+		if w.Code != http.StatusForbidden {
+			t.Fatalf("%+v: invalid login accepted: %d", test, w.Code)
+		}
+	}
+
+	w := login("code-1", false)
+	if w.Code != http.StatusSeeOther ||
+		w.Header().Get("Location") != "/apec/search?what=python" {
+		t.Fatalf("unexpected login redirection: %d %s", w.Code,
+			w.Header().Get("Location"))
+	}
+	rq := httptest.NewRequest("GET", "/apec/search", nil)
+	for _, c := range w.Result().Cookies() {
+		if c.Name == sessionCookie {
+			rq.AddCookie(c)
+		}
+	}
+	logged, err := sessionUser(accounts, rq)
+	if err != nil || logged == nil || logged.Email != "jane@example.com" {
+		t.Fatalf("session user not found: %+v, %v", logged, err)
+	}
+
+	// Unknown users are refused, unless signup is enabled
+	server.Close()
+	server = newTestOAuthServer(t, "code-1", "john@example.com")
+	defer server.Close()
+	provider.TokenURL = server.URL + "/token"
+	provider.UserInfoURL = server.URL + "/userinfo"
+	w = login("code-1", false)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("unknown user logged in: %d", w.Code)
+	}
+	provider.Signup = true
+	w = login("code-1", false)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("unknown user did not sign up: %d", w.Code)
+	}
+	john, err := accounts.GetUser("john@example.com")
+	if err != nil || john == nil || john.GetRole() != roleViewer {
+		t.Fatalf("signed up user not created: %+v, %v", john, err)
+	}
+	if john.CheckPassword("") {
+		t.Fatalf("OAuth users must not log in with an empty password")
+	}
+}
+
+func TestOAuthUnverifiedEmail(t *testing.T) {
+	for _, body := range []string{
+		`{"email":"jane@example.com","email_verified":false}`,
+		`{"email":"jane@example.com"}`,
+	} {
+		server := httptest.NewServer(http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, body)
+			}))
+		provider, err := NewOAuthProvider("Example",
+			"https://auth.example.com/auth", server.URL+"/token",
+			server.URL+"/userinfo", "apec", "s3cret",
+			"https://apec.example.com/apec/login/oauth/callback", false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		email, err := provider.GetEmail("token-1")
+		server.Close()
+		if err == nil {
+			t.Fatalf("unverified email was accepted: %s: %s", body, email)
+		}
+	}
+}
+
+func TestLoginPageOAuthLink(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+	accounts := openTempAccounts(t, env)
+	defer accounts.Close()
+
+	provider := &OAuthProvider{Name: "Example"}
+	rq := httptest.NewRequest("GET", "/apec/login?next=/apec/search", nil)
+	w := httptest.NewRecorder()
+	err := handleLogin(env.Templates, accounts, provider, "/apec", w, rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(w.Body.String(), "Log in with Example") {
+		t.Fatalf("OAuth link not found:\n%s", w.Body.String())
+	}
+}
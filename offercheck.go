@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/hmac"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/pmezard/apec/jstruct"
+	"github.com/pquerna/ffjson/ffjson"
+)
+
+// Browser extensions and bookmarklets annotate apec.fr offer pages with the
+// history recorded by a deployment, fetched by APEC identifier from the
+// by-apec-id handler. apec.fr pages are allowed to call it without
+// credentials. Private deployments serve it only to requests carrying the
+// offer check token as a bearer token, session cookies are not accepted.
+
+const apecIdPath = "/api/offer/by-apec-id/"
+
+var (
+	reApecId     = regexp.MustCompile(`^[0-9A-Za-z]+$`)
+	reApecOrigin = regexp.MustCompile(`^https://([a-z0-9-]+\.)*apec\.fr$`)
+)
+
+// OfferCheck is the history of an APEC offer.
+type OfferCheck struct {
+	ApecId string `json:"apec_id"`
+	Id     string `json:"id"`
+	// Stored is true for live offers. Deleted is true if it was deleted at
+	// least once, other fields come from its last version then.
+	Stored  bool   `json:"stored"`
+	Deleted bool   `json:"deleted"`
+	Title   string `json:"title,omitempty"`
+	// Publication date of this version, and of the first offer with the same
+	// content, YYYY-MM-DD
+	Published   string `json:"published,omitempty"`
+	InitialDate string `json:"initial_date,omitempty"`
+	// Number of other live or deleted offers with the same content
+	Reposts   int    `json:"reposts"`
+	Salary    string `json:"salary,omitempty"`
+	MinSalary int    `json:"min_salary"`
+	MaxSalary int    `json:"max_salary"`
+}
+
+// getLastDeletedOffer returns the most recently deleted version of offer id
+// and its deleted identifier, or nil.
+func getLastDeletedOffer(store *Store, id string) (*jstruct.JsonOffer,
+	uint64, error) {
+
+	deleted, err := store.ListDeletedOffers(id)
+	if err != nil || len(deleted) == 0 {
+		return nil, 0, err
+	}
+	deletedId := deleted[len(deleted)-1].Id
+	data, err := store.GetDeleted(deletedId)
+	if err != nil || data == nil {
+		return nil, 0, err
+	}
+	js := &jstruct.JsonOffer{}
+	err = ffjson.Unmarshal(data, js)
+	return js, deletedId, err
+}
+
+// checkApecOffer returns the history of APEC offer apecId. Unknown offers
+// are reported as neither stored nor deleted.
+func checkApecOffer(store *Store, apecId string) (*OfferCheck, error) {
+	id := makeOfferId(apecSource, apecId)
+	check := &OfferCheck{
+		ApecId: apecId,
+		Id:     id,
+	}
+	js, err := getStoreJsonOffer(store, id)
+	if err != nil {
+		return nil, err
+	}
+	check.Stored = js != nil
+	last, deletedId, err := getLastDeletedOffer(store, id)
+	if err != nil {
+		return nil, err
+	}
+	check.Deleted = last != nil
+	if js == nil {
+		js = last
+	}
+	if js == nil {
+		return check, nil
+	}
+	offer, err := convertOffer(js)
+	if err != nil {
+		return nil, err
+	}
+	check.Title = offer.Title
+	check.Published = offer.Date.Format("2006-01-02")
+	check.Salary = js.Salary
+	check.MinSalary = offer.MinSalary
+	check.MaxSalary = offer.MaxSalary
+
+	if check.Stored {
+		deletedId = 0
+	}
+	reposts, initial, err := getOfferReposts(store, id, js, deletedId,
+		offer.Date)
+	if err != nil {
+		return nil, err
+	}
+	check.Reposts = reposts
+	check.InitialDate = initial.Format("2006-01-02")
+	return check, nil
+}
+
+// hasOfferCheckToken returns true if r carries token as a bearer token.
+func hasOfferCheckToken(token string, r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if token == "" || !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return hmac.Equal([]byte(auth[len("Bearer "):]), []byte(token))
+}
+
+// handleApecOfferCheck writes the history of the APEC offer identified by
+// the last path element as JSON. On private deployments, requests must
+// present token, and are all refused if it is empty.
+func handleApecOfferCheck(store *Store, private bool, token string,
+	w http.ResponseWriter, r *http.Request) error {
+
+	if origin := r.Header.Get("Origin"); reApecOrigin.MatchString(origin) {
+		h := w.Header()
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Set("Vary", "Origin")
+		if r.Method == "OPTIONS" {
+			h.Set("Access-Control-Allow-Methods", "GET")
+			h.Set("Access-Control-Allow-Headers", "Authorization")
+			w.WriteHeader(http.StatusNoContent)
+			return nil
+		}
+	}
+	if private && !hasOfferCheckToken(token, r) {
+		http.Error(w, "offer check token required", http.StatusUnauthorized)
+		return nil
+	}
+	path := r.URL.Path
+	apecId := path[strings.Index(path, apecIdPath)+len(apecIdPath):]
+	if !reApecId.MatchString(apecId) {
+		return fmt.Errorf("invalid APEC offer identifier: %q", apecId)
+	}
+	check, err := checkApecOffer(store, apecId)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return writeJsonLine(w, check)
+}
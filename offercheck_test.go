@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestApecOfferCheck(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	// Lyon offer was first published the week before
+	js, err := getStoreJsonOffer(env.Store, "apec:1003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reposted := *js
+	reposted.Id = "1008"
+	reposted.Date = "2016-12-28T10:00:00.000+0000"
+	data, err := json.Marshal(&reposted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = env.Store.Put("apec:1008", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = env.Store.Delete("apec:1005", time.Date(2017, 1, 8, 12, 0, 0, 0,
+		time.FixedZone("CET", 3600)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rebuildInitialDates(env.Store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		Id       string
+		Stored   bool
+		Deleted  bool
+		Initial  string
+		Reposts  int
+		Min, Max int
+	}{
+		{"1001", true, false, "2017-01-02", 0, 45, 55},
+		{"1003", true, false, "2016-12-28", 1, 50, 60},
+		{"1004", true, false, "2017-01-05", 0, 0, 0},
+		{"1005", false, true, "2017-01-06", 0, 70, 70},
+		{"9999", false, false, "", 0, 0, 0},
+	} {
+		rsp := env.Get(func(w http.ResponseWriter, r *http.Request) {
+			r.Header.Set("Origin", "https://cadres.apec.fr")
+			err := handleApecOfferCheck(env.Store, false, "", w, r)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}, "/apec"+apecIdPath+test.Id, nil)
+		if rsp.Header().Get("Access-Control-Allow-Origin") !=
+			"https://cadres.apec.fr" {
+			t.Fatalf("%s: apec.fr origin is not allowed", test.Id)
+		}
+		if rsp.Header().Get("Access-Control-Allow-Credentials") != "" {
+			t.Fatalf("%s: credentials are allowed", test.Id)
+		}
+		check := &OfferCheck{}
+		err := json.Unmarshal(rsp.Body.Bytes(), check)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if check.ApecId != test.Id || check.Id != "apec:"+test.Id ||
+			check.Stored != test.Stored || check.Deleted != test.Deleted ||
+			check.InitialDate != test.Initial || check.Reposts != test.Reposts ||
+			check.MinSalary != test.Min || check.MaxSalary != test.Max {
+			t.Fatalf("%s: unexpected check: %s", test.Id, rsp.Body.String())
+		}
+	}
+
+	rsp := env.Get(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("Origin", "https://apec.fr.example.com")
+		err := handleApecOfferCheck(env.Store, false, "", w, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}, apecIdPath+"1001", nil)
+	if rsp.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("unexpected allowed origin")
+	}
+	env.Get(func(w http.ResponseWriter, r *http.Request) {
+		err := handleApecOfferCheck(env.Store, false, "", w, r)
+		if err == nil {
+			t.Fatalf("invalid identifier was accepted")
+		}
+	}, apecIdPath+"apec:1001", nil)
+}
+
+func TestApecOfferCheckPrivate(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	for _, test := range []struct {
+		Token  string
+		Header string
+		Code   int
+	}{
+		{"", "", 401},
+		{"", "Bearer ", 401},
+		{"s3cret", "", 401},
+		{"s3cret", "Bearer s3cre", 401},
+		{"s3cret", "s3cret", 401},
+		{"s3cret", "Bearer s3cret", 200},
+	} {
+		rsp := env.Get(func(w http.ResponseWriter, r *http.Request) {
+			r.Header.Set("Origin", "https://cadres.apec.fr")
+			if test.Header != "" {
+				r.Header.Set("Authorization", test.Header)
+			}
+			err := handleApecOfferCheck(env.Store, true, test.Token, w, r)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}, apecIdPath+"1001", nil)
+		if rsp.Code != test.Code {
+			t.Fatalf("%+v: expected %d, got %d", test, test.Code, rsp.Code)
+		}
+	}
+
+	// Preflight requests are answered without token
+	rq := httptest.NewRequest("OPTIONS", apecIdPath+"1001", nil)
+	rq.Header.Set("Origin", "https://cadres.apec.fr")
+	w := httptest.NewRecorder()
+	err := handleApecOfferCheck(env.Store, true, "s3cret", w, rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusNoContent ||
+		w.Header().Get("Access-Control-Allow-Headers") != "Authorization" {
+		t.Fatalf("unexpected preflight response: %d %v", w.Code, w.Header())
+	}
+}
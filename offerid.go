@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+)
+
+// Offers may come from several job boards. Their identifiers are namespaced
+// by source, like "apec:123456W", in store keys, full text and spatial
+// indexes, and URLs. Identifiers without namespace, used before namespaces
+// were introduced, are APEC ones.
+
+const (
+	apecSource = "apec"
+)
+
+// makeOfferId returns the namespaced identifier of offer id from source.
+func makeOfferId(source, id string) string {
+	return source + ":" + id
+}
+
+// splitOfferId returns the source of id and the offer identifier within this
+// source.
+func splitOfferId(id string) (string, string) {
+	i := strings.IndexByte(id, ':')
+	if i < 0 {
+		return apecSource, id
+	}
+	return id[:i], id[i+1:]
+}
+
+// normalizeOfferId namespaces identifiers supplied by users, which can omit
+// the APEC namespace.
+func normalizeOfferId(id string) string {
+	source, local := splitOfferId(id)
+	return makeOfferId(source, local)
+}
+
+func normalizeOfferIds(ids []string) []string {
+	normalized := make([]string, len(ids))
+	for i, id := range ids {
+		normalized[i] = normalizeOfferId(id)
+	}
+	return normalized
+}
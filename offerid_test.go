@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSplitOfferId(t *testing.T) {
+	tests := []struct {
+		Id         string
+		Source     string
+		Local      string
+		Normalized string
+	}{
+		{"apec:123456W", "apec", "123456W", "apec:123456W"},
+		{"pe:ABC", "pe", "ABC", "pe:ABC"},
+		{"123456W", "apec", "123456W", "apec:123456W"},
+		{"pe:A:B", "pe", "A:B", "pe:A:B"},
+	}
+	for _, test := range tests {
+		source, local := splitOfferId(test.Id)
+		if source != test.Source || local != test.Local {
+			t.Fatalf("%s: expected %s, %s, got %s, %s", test.Id, test.Source,
+				test.Local, source, local)
+		}
+		normalized := normalizeOfferId(test.Id)
+		if normalized != test.Normalized {
+			t.Fatalf("%s: expected %s, got %s", test.Id, test.Normalized,
+				normalized)
+		}
+	}
+}
+
+func TestNamespaceOfferIds(t *testing.T) {
+	store := openTempStore(t)
+	defer closeAndDeleteStore(t, store)
+
+	now := time.Date(2017, 1, 2, 0, 0, 0, 0, time.UTC)
+	for _, id := range []string{"1001", "pe:ABC"} {
+		err := store.Put(id, []byte("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.PutLocation(id, &Location{City: "Paris"}, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.PutOfferDate("hash-"+id, OfferAge{
+			Id:              id,
+			PublicationDate: now,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := store.PutSchemaFields("1001", []string{"x"}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.NamespaceOfferIds()
+	if err != nil {
+		t.Fatalf("could not namespace identifiers: %s", err)
+	}
+	ids, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(ids) != "[apec:1001 pe:ABC]" {
+		t.Fatalf("unexpected offers: %v", ids)
+	}
+	for _, id := range ids {
+		loc, _, err := store.GetLocation(id)
+		if err != nil || loc == nil || loc.City != "Paris" {
+			t.Fatalf("%s: location was not migrated: %+v, %v", id, loc, err)
+		}
+		date, err := store.GetInitialDate(id)
+		if err != nil || !date.Equal(now) {
+			t.Fatalf("%s: initial date was not migrated: %s, %v", id, date, err)
+		}
+	}
+	fields, err := store.ListSchemaFields()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) != 1 || fields[0].FirstId != "apec:1001" ||
+		fields[0].LastId != "apec:1001" {
+		t.Fatalf("unexpected schema fields: %+v", fields)
+	}
+	// Offer dates records were updated, a new version replaces the old one
+	err = store.PutOfferDate("hash-1001", OfferAge{
+		Id:              "apec:1001",
+		PublicationDate: now.Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	date, err := store.GetInitialDate("apec:1001")
+	if err != nil || !date.Equal(now.Add(time.Hour)) {
+		t.Fatalf("offer dates were not migrated: %s, %v", date, err)
+	}
+}
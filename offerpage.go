@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"html/template"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pmezard/apec/jstruct"
+	"github.com/pquerna/ffjson/ffjson"
+)
+
+// Offers have their own page rendered from the store, so they can still be
+// read once removed from APEC site. Deleted offers display their last stored
+// version.
+
+const offerPagePrefix = "/offer/"
+
+var (
+	reHTMLElement = regexp.MustCompile(`^<(/?)([a-zA-Z][a-zA-Z0-9]*)`)
+	// Elements kept by sanitizeOfferHTML, without their attributes. Void
+	// elements have no closing tag.
+	allowedOfferElements = map[string]bool{
+		"p": true, "br": true, "ul": true, "ol": true, "li": true,
+		"b": true, "strong": true, "i": true, "em": true, "u": true,
+		"h3": true, "h4": true,
+	}
+	voidOfferElements = map[string]bool{"br": true}
+)
+
+// offerPagePath returns the path of offer id page, relative to the public URL.
+func offerPagePath(id string) string {
+	return strings.TrimPrefix(offerPagePrefix, "/") + url.PathEscape(id)
+}
+
+// sanitizeOfferHTML returns offer description s with scripts, attributes and
+// every element but basic formatting ones removed. Text is escaped again and
+// kept elements are balanced, so the result can be embedded in pages.
+func sanitizeOfferHTML(s string) template.HTML {
+	s = reHTMLIgnore.ReplaceAllString(s, " ")
+	buf := &bytes.Buffer{}
+	open := []string{}
+	writeText := func(text string) {
+		buf.WriteString(html.EscapeString(html.UnescapeString(text)))
+	}
+	pos := 0
+	for _, m := range reHTMLTag.FindAllStringIndex(s, -1) {
+		writeText(s[pos:m[0]])
+		pos = m[1]
+		e := reHTMLElement.FindStringSubmatch(s[m[0]:m[1]])
+		if e == nil {
+			continue
+		}
+		name := strings.ToLower(e[2])
+		if !allowedOfferElements[name] {
+			buf.WriteString(" ")
+			continue
+		}
+		if e[1] == "" {
+			buf.WriteString("<" + name + ">")
+			if !voidOfferElements[name] {
+				open = append(open, name)
+			}
+			continue
+		}
+		// Close elements opened after name, ignore unopened ones
+		for i := len(open) - 1; i >= 0; i-- {
+			if open[i] != name {
+				continue
+			}
+			for j := len(open) - 1; j >= i; j-- {
+				buf.WriteString("</" + open[j] + ">")
+			}
+			open = open[:i]
+			break
+		}
+	}
+	writeText(s[pos:])
+	for i := len(open) - 1; i >= 0; i-- {
+		buf.WriteString("</" + open[i] + ">")
+	}
+	return template.HTML(buf.String())
+}
+
+type offerVersion struct {
+	Published string
+	Deleted   string
+	Title     string
+}
+
+type offerPageData struct {
+	Id       string
+	Title    string
+	Account  string
+	Location string
+	Salary   string
+	URL      string
+	// Publication date, and of the first offer with the same content
+	Published   string
+	InitialDate string
+	// True if the offer is still published
+	Stored bool
+	// Deleted versions, the oldest first
+	Deletions []offerVersion
+	// Number of other live or deleted offers with the same content
+	Reposts    int
+	HTML       template.HTML
+	JobPosting template.HTML
+}
+
+// formatDeletionDate returns the day of a deletion date, or the date itself
+// if it cannot be parsed.
+func formatDeletionDate(date string) string {
+	d, err := time.Parse(time.RFC3339, date)
+	if err != nil {
+		return date
+	}
+	return d.Format("2006-01-02")
+}
+
+// getOfferReposts returns the number of other live or deleted offers with
+// the content of js, and the initial publication date of js, or published if
+// it is unknown. js is the live version of offer id if deletedId is zero,
+// its deleted version deletedId otherwise.
+func getOfferReposts(store *Store, id string, js *jstruct.JsonOffer,
+	deletedId uint64, published time.Time) (int, time.Time, error) {
+
+	ages, err := store.GetOfferDates(hashOffer(js))
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	reposts := 0
+	if len(ages) > 1 {
+		reposts = len(ages) - 1
+	}
+	initial := published
+	if deletedId == 0 {
+		date, err := store.GetInitialDate(id)
+		if err != nil {
+			return 0, time.Time{}, err
+		}
+		if !date.IsZero() {
+			initial = date
+		}
+	} else {
+		for _, age := range ages {
+			if age.DeletedId == deletedId && !age.InitialDate.IsZero() {
+				initial = age.InitialDate
+			}
+		}
+	}
+	return reposts, initial, nil
+}
+
+// makeOfferPage returns the page data of offer id, from its live version or
+// its most recently deleted one, or nil if it is unknown.
+func makeOfferPage(store *Store, id string) (*offerPageData, error) {
+	js, err := getStoreJsonOffer(store, id)
+	if err != nil {
+		return nil, err
+	}
+	page := &offerPageData{
+		Id:        id,
+		Stored:    js != nil,
+		Deletions: []offerVersion{},
+	}
+	deleted, err := store.ListDeletedOffers(id)
+	if err != nil {
+		return nil, err
+	}
+	var lastDeletedId uint64
+	for _, d := range deleted {
+		data, err := store.GetDeleted(d.Id)
+		if err != nil {
+			return nil, err
+		}
+		if data == nil {
+			continue
+		}
+		version := &jstruct.JsonOffer{}
+		err = ffjson.Unmarshal(data, version)
+		if err != nil {
+			return nil, err
+		}
+		offer, err := convertOffer(version)
+		if err != nil {
+			return nil, err
+		}
+		page.Deletions = append(page.Deletions, offerVersion{
+			Published: offer.Date.Format("2006-01-02"),
+			Deleted:   formatDeletionDate(d.Date),
+			Title:     offer.Title,
+		})
+		if !page.Stored {
+			js = version
+			lastDeletedId = d.Id
+		}
+	}
+	if js == nil {
+		return nil, nil
+	}
+	offer, err := convertOffer(js)
+	if err != nil {
+		return nil, err
+	}
+	page.Title = offer.Title
+	page.Account = offer.Account
+	page.Location = offer.Location
+	page.URL = offer.URL
+	page.Published = offer.Date.Format("2006-01-02")
+	page.HTML = sanitizeOfferHTML(offer.HTML)
+	if offer.MinSalary > 0 {
+		page.Salary = formatSalaryLine(&Offer{
+			MinSalary: offer.MinSalary,
+			MaxSalary: offer.MaxSalary,
+		})
+	} else {
+		page.Salary = js.Salary
+	}
+
+	reposts, initial, err := getOfferReposts(store, id, js, lastDeletedId,
+		offer.Date)
+	if err != nil {
+		return nil, err
+	}
+	page.Reposts = reposts
+	if page.Stored {
+		posting, err := makeJobPosting(store, id)
+		if err != nil {
+			return nil, err
+		}
+		if posting != nil {
+			page.JobPosting, err = jobPostingScript(posting)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	page.InitialDate = initial.Format("2006-01-02")
+	return page, nil
+}
+
+// handleOfferPage renders the page of the offer identified by the path
+// element following prefix.
+func handleOfferPage(templ *Templates, store *Store, prefix string,
+	w http.ResponseWriter, r *http.Request) error {
+
+	id := strings.TrimPrefix(r.URL.Path, prefix)
+	if id == "" || strings.Contains(id, "/") {
+		return fmt.Errorf("invalid offer identifier: %q", id)
+	}
+	page, err := makeOfferPage(store, normalizeOfferId(id))
+	if err != nil {
+		return err
+	}
+	if page == nil {
+		http.NotFound(w, r)
+		return nil
+	}
+	w.Header().Set("Content-Type", "text/html")
+	return templ.Offer.Execute(w, page)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSanitizeOfferHTML(t *testing.T) {
+	for _, test := range []struct {
+		Input    string
+		Expected string
+	}{
+		{`<p class="x">R&amp;D <b>Go</B></p>`, `<p>R&amp;D <b>Go</b></p>`},
+		{`<script>alert(1)</script><a href="javascript:x()">link</a>`, `  link `},
+		{`<img src=x onerror=alert(1)>a < b`, ` a &lt; b`},
+		{`<ul><li>one<li>two</ul></p><b>bold`,
+			`<ul><li>one<li>two</li></li></ul><b>bold</b>`},
+		{`line<br/>break`, `line<br>break`},
+	} {
+		s := string(sanitizeOfferHTML(test.Input))
+		if s != test.Expected {
+			t.Fatalf("%s: expected %q, got %q", test.Input, test.Expected, s)
+		}
+	}
+}
+
+func TestOfferPage(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	cet := time.FixedZone("CET", 3600)
+	_, err := env.Store.Delete("apec:1002", time.Date(2017, 1, 9, 12, 0, 0, 0, cet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(id string) (int, string) {
+		rsp := env.Get(func(w http.ResponseWriter, r *http.Request) {
+			err := handleOfferPage(env.Templates, env.Store, "/apec/offer/", w, r)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}, "/apec/offer/"+id, nil)
+		return rsp.Code, rsp.Body.String()
+	}
+
+	code, body := get("apec:1001")
+	for _, s := range []string{
+		"<h3>Développeur Go H/F</h3>",
+		"(Paris), 45-55 kEUR<br/>",
+		"Published on 2017-01-02<br/>",
+		`<a href="` + ApecURL + `1001">Offer on APEC</a>`,
+		`<script type="application/ld+json">`,
+		"<p>Vous développerez des services en golang et python.</p>",
+	} {
+		if code != 200 || !strings.Contains(body, s) {
+			t.Fatalf("%q is missing from %d:\n%s", s, code, body)
+		}
+	}
+
+	// Deleted offers display their last version
+	code, body = get("1002")
+	for _, s := range []string{
+		"<h3>Développeur Python H/F</h3>",
+		"This offer is no longer published on APEC.",
+		"<tr><td>2017-01-03</td><td>2017-01-09</td><td>Développeur Python H/F</td></tr>",
+	} {
+		if code != 200 || !strings.Contains(body, s) {
+			t.Fatalf("%q is missing from %d:\n%s", s, code, body)
+		}
+	}
+	if strings.Contains(body, "application/ld+json") {
+		t.Fatalf("deleted offers have no structured data:\n%s", body)
+	}
+
+	code, _ = get("apec:9999")
+	if code != 404 {
+		t.Fatalf("unknown offer returned %d", code)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Browsers register the search engine described by opensearch.xml, and send
+// keyword searches like "golang nantes" to the opensearch handler, which
+// splits them into what and where parameters before redirecting to the
+// search page.
+
+const (
+	openSearchXmlns = "http://a9.com/-/spec/opensearch/1.1/"
+	// Longest location, in words, recognized at the end of keyword searches
+	maxLocationWords = 3
+)
+
+type openSearchURL struct {
+	Type     string `xml:"type,attr"`
+	Method   string `xml:"method,attr"`
+	Template string `xml:"template,attr"`
+}
+
+type openSearchDescription struct {
+	XMLName       xml.Name        `xml:"OpenSearchDescription"`
+	Xmlns         string          `xml:"xmlns,attr"`
+	ShortName     string          `xml:"ShortName"`
+	Description   string          `xml:"Description"`
+	InputEncoding string          `xml:"InputEncoding"`
+	URLs          []openSearchURL `xml:"Url"`
+}
+
+// requestBaseURL returns the absolute URL of publicURL on the host serving r,
+// honoring reverse proxies X-Forwarded-Proto header.
+func requestBaseURL(r *http.Request, publicURL string) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host + publicURL
+}
+
+// splitSearchTerms splits keyword searches into a full text query and the
+// longest trailing location known to the geocoder cache, if any.
+func splitSearchTerms(terms string, geocoder *Geocoder) (string, string,
+	error) {
+
+	words := strings.Fields(terms)
+	for n := maxLocationWords; n > 0; n-- {
+		if n > len(words) {
+			continue
+		}
+		where := strings.Join(words[len(words)-n:], " ")
+		loc, ok, err := geocoder.GetCachedLocation(strings.ToLower(where), "fr")
+		if err != nil {
+			return "", "", err
+		}
+		if ok && loc != nil && !loc.Nationwide {
+			return strings.Join(words[:len(words)-n], " "), where, nil
+		}
+	}
+	return strings.Join(words, " "), "", nil
+}
+
+// handleOpenSearch redirects keyword searches in the "q" parameter to the
+// search page.
+func handleOpenSearch(geocoder *Geocoder, w http.ResponseWriter,
+	r *http.Request) error {
+
+	what, where, err := splitSearchTerms(r.FormValue("q"), geocoder)
+	if err != nil {
+		return err
+	}
+	values := url.Values{}
+	values.Set("what", what)
+	values.Set("where", where)
+	http.Redirect(w, r, "search?"+values.Encode(), http.StatusFound)
+	return nil
+}
+
+func writeOpenSearchDescription(w io.Writer, baseURL string) error {
+	desc := &openSearchDescription{
+		Xmlns:         openSearchXmlns,
+		ShortName:     "APEC",
+		Description:   "Search APEC job offers",
+		InputEncoding: "UTF-8",
+		URLs: []openSearchURL{{
+			Type:     "text/html",
+			Method:   "get",
+			Template: baseURL + "/opensearch?q={searchTerms}",
+		}},
+	}
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	err = enc.Encode(desc)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
+
+// handleOpenSearchDescription describes the search engine of the deployment
+// published at baseURL, or at publicURL on the requested host if it is empty.
+func handleOpenSearchDescription(baseURL, publicURL string,
+	w http.ResponseWriter, r *http.Request) error {
+
+	if baseURL == "" {
+		baseURL = requestBaseURL(r, publicURL)
+	}
+	w.Header().Set("Content-Type",
+		"application/opensearchdescription+xml; charset=utf-8")
+	return writeOpenSearchDescription(w, strings.TrimRight(baseURL, "/"))
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestOpenSearch(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	for _, test := range []struct {
+		Query string
+		What  string
+		Where string
+	}{
+		{"golang paris", "golang", "paris"},
+		{"  python and java   Bordeaux ", "python and java", "Bordeaux"},
+		{"lyon", "", "lyon"},
+		{"golang atlantide", "golang atlantide", ""},
+		{"", "", ""},
+	} {
+		rsp := env.Get(func(w http.ResponseWriter, r *http.Request) {
+			err := handleOpenSearch(env.Geocoder, w, r)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}, "/opensearch", url.Values{"q": {test.Query}})
+		if rsp.Code != http.StatusFound {
+			t.Fatalf("%q: unexpected status %d", test.Query, rsp.Code)
+		}
+		u, err := url.Parse(rsp.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := u.Query()
+		if u.Path != "/search" || values.Get("what") != test.What ||
+			values.Get("where") != test.Where {
+			t.Fatalf("%q: unexpected redirection to %s", test.Query, u)
+		}
+	}
+
+	rsp := env.Get(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("X-Forwarded-Proto", "https")
+		err := handleOpenSearchDescription("", "/apec", w, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}, "/apec/opensearch.xml", nil)
+	desc := &openSearchDescription{}
+	err := xml.Unmarshal(rsp.Body.Bytes(), desc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(desc.URLs) != 1 || desc.URLs[0].Template !=
+		"https://example.com/apec/opensearch?q={searchTerms}" {
+		t.Fatalf("unexpected description:\n%s", rsp.Body.String())
+	}
+}
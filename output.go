@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+const (
+	// Human readable lines
+	outputTable = "table"
+	// One JSON object per line, for jq and scripts
+	outputJSON = "json"
+)
+
+// OutputWriter prints inspection commands records in the format selected
+// by --output.
+type OutputWriter struct {
+	w      io.Writer
+	format string
+}
+
+func NewOutputWriter(w io.Writer, format string) *OutputWriter {
+	return &OutputWriter{
+		w:      w,
+		format: format,
+	}
+}
+
+// Write prints record as a JSON line, or formats args with layout
+// otherwise.
+func (o *OutputWriter) Write(record interface{}, layout string,
+	args ...interface{}) error {
+
+	if o.format == outputJSON {
+		return writeJsonLine(o.w, record)
+	}
+	_, err := fmt.Fprintf(o.w, layout, args...)
+	return err
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// Only errors and commands summaries
+	verbosityQuiet = iota
+	// Progress reports and notable events
+	verbosityNormal
+	// Every processed item
+	verbosityVerbose
+)
+
+var (
+	quietFlag = app.Flag("quiet", "only print summaries of long running commands").
+			Short('q').Bool()
+	verboseFlag = app.Flag("verbose", "print every item processed by long running commands").
+			Short('v').Bool()
+
+	// verbosity of progress reports, set from command line flags
+	verbosity = verbosityNormal
+	// progressOutput receives progress reports and messages
+	progressOutput io.Writer = os.Stderr
+)
+
+// setVerbosity sets the verbosity from --quiet and --verbose.
+func setVerbosity(quiet, verbose bool) error {
+	if quiet && verbose {
+		return fmt.Errorf("--quiet and --verbose are mutually exclusive")
+	}
+	if quiet {
+		verbosity = verbosityQuiet
+	} else if verbose {
+		verbosity = verbosityVerbose
+	}
+	return nil
+}
+
+// isTerminal returns true if w is a character device, like a terminal.
+func isTerminal(w io.Writer) bool {
+	fp, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	st, err := fp.Stat()
+	if err != nil {
+		return false
+	}
+	return st.Mode()&os.ModeCharDevice != 0
+}
+
+// Progress reports the advancement of a long running task, with counts, rate
+// and estimated remaining time. On terminals, the report is a single line
+// refreshed in place, otherwise a line is printed every interval. Progress
+// is safe for concurrent use.
+type Progress struct {
+	lock     sync.Mutex
+	w        io.Writer
+	tty      bool
+	level    int
+	name     string
+	total    int
+	done     int
+	start    time.Time
+	reported time.Time
+	// A status line is displayed and must be cleared before messages
+	shown bool
+	// Time source, replaced in tests
+	now      func() time.Time
+	interval time.Duration
+}
+
+// NewProgress returns a progress report for name, writing to progressOutput
+// at the configured verbosity. total is the number of items to process,
+// zero if unknown.
+func NewProgress(name string, total int) *Progress {
+	return newProgress(progressOutput, isTerminal(progressOutput), verbosity,
+		name, total, time.Now)
+}
+
+func newProgress(w io.Writer, tty bool, level int, name string, total int,
+	now func() time.Time) *Progress {
+
+	interval := 10 * time.Second
+	if tty {
+		interval = 200 * time.Millisecond
+	}
+	start := now()
+	return &Progress{
+		w:        w,
+		tty:      tty,
+		level:    level,
+		name:     name,
+		total:    total,
+		start:    start,
+		reported: start,
+		now:      now,
+		interval: interval,
+	}
+}
+
+// SetTotal updates the number of items to process, when it is discovered
+// while processing them.
+func (p *Progress) SetTotal(total int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.total = total
+}
+
+// Add records n processed items and reports progress if necessary.
+func (p *Progress) Add(n int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.done += n
+	now := p.now()
+	if p.level == verbosityQuiet || now.Sub(p.reported) < p.interval {
+		return
+	}
+	p.reported = now
+	if p.tty {
+		fmt.Fprintf(p.w, "\r\033[K%s", p.status(now))
+		p.shown = true
+	} else {
+		fmt.Fprintf(p.w, "%s\n", p.status(now))
+	}
+}
+
+func (p *Progress) status(now time.Time) string {
+	elapsed := now.Sub(p.start)
+	rate := 0.
+	if elapsed > 0 {
+		rate = float64(p.done) / elapsed.Seconds()
+	}
+	if p.total <= 0 {
+		return fmt.Sprintf("%s: %d, %.1f/s", p.name, p.done, rate)
+	}
+	s := fmt.Sprintf("%s: %d/%d (%.0f%%), %.1f/s", p.name, p.done, p.total,
+		100*float64(p.done)/float64(p.total), rate)
+	if rate > 0 && p.done < p.total {
+		eta := time.Duration(float64(p.total-p.done)/rate) * time.Second
+		s += fmt.Sprintf(", ETA %s", eta)
+	}
+	return s
+}
+
+func (p *Progress) printf(level int, format string, args ...interface{}) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.level < level {
+		return
+	}
+	if p.shown {
+		fmt.Fprintf(p.w, "\r\033[K")
+		p.shown = false
+	}
+	fmt.Fprintf(p.w, format, args...)
+}
+
+// Printf prints a notable message, unless quiet.
+func (p *Progress) Printf(format string, args ...interface{}) {
+	p.printf(verbosityNormal, format, args...)
+}
+
+// Verbosef prints a message about a single item, in verbose mode only.
+func (p *Progress) Verbosef(format string, args ...interface{}) {
+	p.printf(verbosityVerbose, format, args...)
+}
+
+// Done ends the report. Tasks lasting longer than the report interval get
+// a final status line.
+func (p *Progress) Done() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.level == verbosityQuiet || p.reported == p.start {
+		return
+	}
+	if p.tty {
+		fmt.Fprintf(p.w, "\r\033[K")
+		p.shown = false
+	}
+	now := p.now()
+	fmt.Fprintf(p.w, "%s, done in %s\n", p.status(now),
+		now.Sub(p.start).Truncate(time.Second))
+}
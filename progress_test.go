@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestProgress(t *testing.T) {
+	start := time.Date(2017, 1, 2, 0, 0, 0, 0, time.UTC)
+	run := func(tty bool, level, total int) string {
+		now := start
+		clock := func() time.Time {
+			return now
+		}
+		buf := &bytes.Buffer{}
+		p := newProgress(buf, tty, level, "crawl", total, clock)
+		for i := 0; i < 30; i++ {
+			now = now.Add(time.Second)
+			if i == 14 {
+				p.Printf("quota exhausted\n")
+			}
+			p.Verbosef("fetching %d\n", i)
+			p.Add(1)
+		}
+		p.Done()
+		return buf.String()
+	}
+
+	tests := []struct {
+		Tty      bool
+		Level    int
+		Total    int
+		Expected string
+	}{
+		{false, verbosityNormal, 40,
+			"crawl: 10/40 (25%), 1.0/s, ETA 30s\n" +
+				"quota exhausted\n" +
+				"crawl: 20/40 (50%), 1.0/s, ETA 20s\n" +
+				"crawl: 30/40 (75%), 1.0/s, ETA 10s\n" +
+				"crawl: 30/40 (75%), 1.0/s, ETA 10s, done in 30s\n"},
+		{false, verbosityNormal, 0,
+			"crawl: 10, 1.0/s\n" +
+				"quota exhausted\n" +
+				"crawl: 20, 1.0/s\n" +
+				"crawl: 30, 1.0/s\n" +
+				"crawl: 30, 1.0/s, done in 30s\n"},
+		{false, verbosityQuiet, 40, ""},
+	}
+	for _, test := range tests {
+		output := run(test.Tty, test.Level, test.Total)
+		if output != test.Expected {
+			t.Fatalf("%v, %d, %d: expected:\n%s\ngot:\n%s", test.Tty, test.Level,
+				test.Total, test.Expected, output)
+		}
+	}
+
+	output := run(false, verbosityVerbose, 30)
+	if !bytes.Contains([]byte(output), []byte("fetching 29\ncrawl: 30/30 (100%), 1.0/s\n")) {
+		t.Fatalf("unexpected verbose output:\n%s", output)
+	}
+	output = run(true, verbosityNormal, 30)
+	expected := "\r\033[Kcrawl: 14/30 (47%), 1.0/s, ETA 16s\r\033[Kquota exhausted\n" +
+		"\r\033[Kcrawl: 15/30 (50%), 1.0/s, ETA 15s"
+	if !bytes.Contains([]byte(output), []byte(expected)) ||
+		!bytes.HasSuffix([]byte(output), []byte("\r\033[Kcrawl: 30/30 (100%), 1.0/s, done in 30s\n")) {
+		t.Fatalf("unexpected terminal output:\n%q", output)
+	}
+
+	err := setVerbosity(true, true)
+	if err == nil {
+		t.Fatalf("--quiet and --verbose accepted together")
+	}
+}
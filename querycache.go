@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// IndexGeneration counts full text and spatial index updates. Anything
+// derived from indexes content, like cached query results, is stale once it
+// changes. A nil generation is never updated.
+type IndexGeneration struct {
+	n uint64
+}
+
+func (g *IndexGeneration) Get() uint64 {
+	if g == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&g.n)
+}
+
+func (g *IndexGeneration) Bump() {
+	if g != nil {
+		atomic.AddUint64(&g.n, 1)
+	}
+}
+
+// GenerationCache keeps values derived from the current index generation.
+// It is emptied when the generation changes, or when it holds max entries.
+type GenerationCache struct {
+	lock       sync.Mutex
+	generation *IndexGeneration
+	current    uint64
+	entries    map[string]interface{}
+	max        int
+}
+
+func NewGenerationCache(generation *IndexGeneration,
+	max int) *GenerationCache {
+
+	return &GenerationCache{
+		generation: generation,
+		current:    generation.Get(),
+		entries:    map[string]interface{}{},
+		max:        max,
+	}
+}
+
+// sync drops entries of previous generations. Must be called with lock held.
+func (c *GenerationCache) sync() {
+	gen := c.generation.Get()
+	if gen != c.current {
+		c.entries = map[string]interface{}{}
+		c.current = gen
+	}
+}
+
+// Get returns the value cached under key, and true if there is one.
+func (c *GenerationCache) Get(key string) (interface{}, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.sync()
+	value, ok := c.entries[key]
+	return value, ok
+}
+
+// Put caches value under key, computed while the index generation was gen.
+// It is ignored if the indexes were updated in the meantime.
+func (c *GenerationCache) Put(key string, gen uint64, value interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.sync()
+	if gen != c.current {
+		return
+	}
+	if len(c.entries) >= c.max {
+		c.entries = map[string]interface{}{}
+	}
+	c.entries[key] = value
+}
+
+// Generation returns the current index generation.
+func (c *GenerationCache) Generation() uint64 {
+	return c.generation.Get()
+}
+
+// QueryCache keeps search results, so popular queries do not run the
+// spatial and text phases again.
+type QueryCache struct {
+	*GenerationCache
+}
+
+func NewQueryCache(generation *IndexGeneration, max int) *QueryCache {
+	return &QueryCache{NewGenerationCache(generation, max)}
+}
+
+func makeQueryCacheKey(what, where string, includeRemote bool) string {
+	return fmt.Sprintf("%s\x00%s\x00%v", what, where, includeRemote)
+}
+
+// Get returns a copy of cached results, or nil.
+func (c *QueryCache) Get(what, where string, includeRemote bool) []datedOffer {
+	offers, ok := c.GenerationCache.Get(makeQueryCacheKey(what, where,
+		includeRemote))
+	if !ok {
+		searchStats.Add("cache_misses", 1)
+		return nil
+	}
+	searchStats.Add("cache_hits", 1)
+	return append([]datedOffer{}, offers.([]datedOffer)...)
+}
+
+// Put caches results computed while the index generation was gen.
+func (c *QueryCache) Put(what, where string, includeRemote bool, gen uint64,
+	offers []datedOffer) {
+
+	c.GenerationCache.Put(makeQueryCacheKey(what, where, includeRemote), gen,
+		append([]datedOffer{}, offers...))
+}
+
+// BytesCache keeps rendered documents, like unfiltered density maps or
+// sitemaps.
+type BytesCache struct {
+	*GenerationCache
+}
+
+func NewBytesCache(generation *IndexGeneration, max int) *BytesCache {
+	return &BytesCache{NewGenerationCache(generation, max)}
+}
+
+// Get returns the document cached under key, or nil.
+func (c *BytesCache) Get(key string) []byte {
+	data, ok := c.GenerationCache.Get(key)
+	if !ok {
+		return nil
+	}
+	return data.([]byte)
+}
+
+// Put caches data rendered while the index generation was gen.
+func (c *BytesCache) Put(key string, gen uint64, data []byte) {
+	c.GenerationCache.Put(key, gen, data)
+}
+
+// FacetCache keeps the facet fields of search results, so facets of large
+// result sets do not load every offer again.
+type FacetCache struct {
+	*GenerationCache
+}
+
+func NewFacetCache(generation *IndexGeneration, max int) *FacetCache {
+	return &FacetCache{NewGenerationCache(generation, max)}
+}
+
+// Get returns the facet fields of search result id, nil if it no longer
+// exists, and true if they were cached.
+func (c *FacetCache) Get(id string) (*facetFields, bool) {
+	fields, ok := c.GenerationCache.Get(id)
+	if !ok {
+		return nil, false
+	}
+	return fields.(*facetFields), true
+}
+
+// Put caches the facet fields of search result id computed while the index
+// generation was gen.
+func (c *FacetCache) Put(id string, gen uint64, fields *facetFields) {
+	c.GenerationCache.Put(id, gen, fields)
+}
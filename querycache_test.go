@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestGenerationCache(t *testing.T) {
+	generation := &IndexGeneration{}
+	cache := NewGenerationCache(generation, 2)
+	gen := cache.Generation()
+	cache.Put("a", gen, 1)
+	cache.Put("b", gen, 2)
+	if v, ok := cache.Get("a"); !ok || v.(int) != 1 {
+		t.Fatalf("unexpected cached value: %v, %v", v, ok)
+	}
+	// Full caches are emptied
+	cache.Put("c", gen, 3)
+	if _, ok := cache.Get("a"); ok {
+		t.Fatalf("full cache was not emptied")
+	}
+	if v, ok := cache.Get("c"); !ok || v.(int) != 3 {
+		t.Fatalf("unexpected cached value: %v, %v", v, ok)
+	}
+	// Values of previous generations are dropped or ignored
+	generation.Bump()
+	if _, ok := cache.Get("c"); ok {
+		t.Fatalf("stale value was returned")
+	}
+	cache.Put("d", gen, 4)
+	if _, ok := cache.Get("d"); ok {
+		t.Fatalf("stale value was cached")
+	}
+	cache.Put("d", cache.Generation(), 5)
+	if v, ok := cache.Get("d"); !ok || v.(int) != 5 {
+		t.Fatalf("unexpected cached value: %v, %v", v, ok)
+	}
+}
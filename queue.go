@@ -3,6 +3,8 @@ package main
 import (
 	"encoding/binary"
 	"encoding/json"
+	"expvar"
+	"time"
 
 	"github.com/boltdb/bolt"
 )
@@ -13,10 +15,15 @@ type IndexQueue struct {
 	db *bolt.DB
 }
 
+// Queued and dequeued operations counters
+var queueStats = expvar.NewMap("queue")
+
 var (
 	queuedBucket = []byte("q")
 	minSeqBucket = []byte("s")
 	minSeqKey    = []byte("m")
+	// Time since which the queue has not been empty, in minSeqBucket
+	sinceKey = []byte("t")
 
 	queueBuckets = [][]byte{
 		queuedBucket,
@@ -57,6 +64,10 @@ type Op uint8
 const (
 	AddOp Op = iota
 	RemoveOp
+	// Indexes the deleted versions of an offer in the deleted offers index
+	DeletedOp
+	// Recomputes the offer dates of the content groups of an offer versions
+	DatesOp
 )
 
 // Queued describes a single indexing operation on a specified document. Seq
@@ -82,7 +93,17 @@ func (q *IndexQueue) putMinSeq(tx *bolt.Tx, seqBytes []byte) error {
 }
 
 func (q *IndexQueue) QueueMany(items []Queued) error {
-	return q.db.Update(func(tx *bolt.Tx) error {
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		if len(items) > 0 && tx.Bucket(minSeqBucket).Get(sinceKey) == nil {
+			data, err := time.Now().MarshalBinary()
+			if err != nil {
+				return err
+			}
+			err = tx.Bucket(minSeqBucket).Put(sinceKey, data)
+			if err != nil {
+				return err
+			}
+		}
 		for i, item := range items {
 			seq, err := tx.Bucket(queuedBucket).NextSequence()
 			if err != nil {
@@ -112,6 +133,11 @@ func (q *IndexQueue) QueueMany(items []Queued) error {
 		}
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+	queueStats.Add("queued", int64(len(items)))
+	return nil
 }
 
 func (q *IndexQueue) FetchMany(count int) ([]Queued, error) {
@@ -143,7 +169,8 @@ func (q *IndexQueue) FetchMany(count int) ([]Queued, error) {
 }
 
 func (q *IndexQueue) DeleteMany(count int) error {
-	return q.db.Update(func(tx *bolt.Tx) error {
+	deleted := 0
+	err := q.db.Update(func(tx *bolt.Tx) error {
 		minSeq, ok := q.getMinSeq(tx)
 		if !ok {
 			return nil
@@ -160,11 +187,23 @@ func (q *IndexQueue) DeleteMany(count int) error {
 				return err
 			}
 			minSeq++
+			deleted++
+		}
+		if k, _ := tx.Bucket(queuedBucket).Cursor().First(); k == nil {
+			err := tx.Bucket(minSeqBucket).Delete(sinceKey)
+			if err != nil {
+				return err
+			}
 		}
 		buf := make([]byte, binary.MaxVarintLen64)
 		n := binary.PutUvarint(buf, minSeq)
 		return q.putMinSeq(tx, buf[:n])
 	})
+	if err != nil {
+		return err
+	}
+	queueStats.Add("dequeued", int64(deleted))
+	return nil
 }
 
 func (q *IndexQueue) Size() int {
@@ -179,6 +218,20 @@ func (q *IndexQueue) Size() int {
 	return size
 }
 
+// Since returns the time since which the queue has not been empty, or a
+// zero time if it is empty.
+func (q *IndexQueue) Since() (time.Time, error) {
+	since := time.Time{}
+	err := q.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(minSeqBucket).Get(sinceKey)
+		if data == nil {
+			return nil
+		}
+		return since.UnmarshalBinary(data)
+	})
+	return since, err
+}
+
 func (q *IndexQueue) Path() string {
 	return q.db.Path()
 }
@@ -5,6 +5,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func createTempQueue(t *testing.T) *IndexQueue {
@@ -152,3 +153,66 @@ func TestQueueOperations(t *testing.T) {
 		t.Fatalf("could not close queue: %s", err)
 	}
 }
+
+func TestQueueSince(t *testing.T) {
+	queue := createTempQueue(t)
+	defer deleteTempQueue(t, queue)
+
+	since, err := queue.Since()
+	if err != nil || !since.IsZero() {
+		t.Fatalf("empty queue has a start time: %s, %v", since, err)
+	}
+	start := time.Now()
+	err = queue.QueueMany([]Queued{{Id: "0", Op: AddOp}, {Id: "1", Op: AddOp}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	since, err = queue.Since()
+	if err != nil || since.Before(start.Add(-time.Second)) || since.After(time.Now()) {
+		t.Fatalf("unexpected start time: %s, %v", since, err)
+	}
+	// Partial deletions and additions do not reset it
+	err = queue.DeleteMany(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = queue.QueueMany([]Queued{{Id: "2", Op: AddOp}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	since2, err := queue.Since()
+	if err != nil || !since2.Equal(since) {
+		t.Fatalf("start time changed: %s != %s, %v", since2, since, err)
+	}
+	err = queue.DeleteMany(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	since, err = queue.Since()
+	if err != nil || !since.IsZero() {
+		t.Fatalf("drained queue has a start time: %s, %v", since, err)
+	}
+}
+
+func TestQueueStats(t *testing.T) {
+	queue := createTempQueue(t)
+	defer deleteTempQueue(t, queue)
+
+	queued := statsCounter(queueStats, "queued")
+	dequeued := statsCounter(queueStats, "dequeued")
+	err := queue.QueueMany([]Queued{{Id: "0", Op: AddOp}, {Id: "1", Op: AddOp}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only actually removed operations are counted
+	err = queue.DeleteMany(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := statsCounter(queueStats, "queued") - queued; n != 2 {
+		t.Fatalf("unexpected queued counter: %d", n)
+	}
+	if n := statsCounter(queueStats, "dequeued") - dequeued; n != 2 {
+		t.Fatalf("unexpected dequeued counter: %d", n)
+	}
+}
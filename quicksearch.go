@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search/query"
+)
+
+// Quick searches match offers titles against partially typed words, like
+// "kuber" for "Kubernetes". Titles words prefixes are indexed in a shadow
+// field, so they are plain term lookups instead of prefix or fuzzy queries.
+
+const (
+	// Indexed prefixes lengths, longer words are matched by their first
+	// maxPrefixLength characters.
+	minPrefixLength = 2
+	maxPrefixLength = 15
+
+	defaultQuickSearchSize = 10
+	maxQuickSearchSize     = 50
+)
+
+// prefixField returns the name of the field indexing words prefixes of field.
+func prefixField(field string) string {
+	return field + "_prefix"
+}
+
+// makeTitlePrefixQuery returns a query matching offers with titles words
+// starting with every word of text, or nil if text has no word long enough.
+func makeTitlePrefixQuery(text string) query.Query {
+	queries := []query.Query{}
+	for _, word := range strings.Fields(text) {
+		runes := []rune(word)
+		if len(runes) < minPrefixLength {
+			continue
+		}
+		if len(runes) > maxPrefixLength {
+			runes = runes[:maxPrefixLength]
+		}
+		q := bleve.NewMatchQuery(string(runes))
+		q.SetField(prefixField("title"))
+		q.Analyzer = "fr_exact"
+		queries = append(queries, q)
+	}
+	if len(queries) == 0 {
+		return nil
+	}
+	return bleve.NewConjunctionQuery(queries...)
+}
+
+// findOffersFromTitlePrefix returns the size most recent offers matching
+// text words prefixes. Hits are sorted by the index and only the first ones
+// are collected, within limits.Timeout.
+func findOffersFromTitlePrefix(index bleve.Index, text string, size int,
+	limits SearchLimits) ([]datedOffer, error) {
+
+	q := makeTitlePrefixQuery(text)
+	if q == nil {
+		return nil, nil
+	}
+	searchStats.Add("searches", 1)
+	rq := bleve.NewSearchRequest(q)
+	rq.Size = size
+	rq.Fields = []string{"date"}
+	rq.SortBy([]string{"-date", "_id"})
+	ctx := context.Background()
+	if limits.Timeout > 0 {
+		timeoutCtx, cancel := context.WithTimeout(ctx, limits.Timeout)
+		defer cancel()
+		ctx = timeoutCtx
+	}
+	res, err := index.SearchInContext(ctx, rq)
+	if err != nil {
+		if err == context.DeadlineExceeded {
+			searchStats.Add("timeouts", 1)
+		}
+		return nil, err
+	}
+	offers := []datedOffer{}
+	for _, doc := range res.Hits {
+		date, ok := doc.Fields["date"].(string)
+		if !ok {
+			return nil, fmt.Errorf("could not retrieve date for %s", doc.ID)
+		}
+		offers = append(offers, datedOffer{Date: date, Id: doc.ID})
+	}
+	return offers, nil
+}
+
+type QuickSearchResult struct {
+	Id      string `json:"id"`
+	Title   string `json:"title"`
+	Account string `json:"account"`
+	Date    string `json:"date"`
+	URL     string `json:"url"`
+}
+
+// handleQuickSearch writes as JSON the most recent offers with titles
+// matching the partially typed words of the "q" parameter, at most "size".
+func handleQuickSearch(store *Store, index bleve.Index, limits SearchLimits,
+	w http.ResponseWriter, r *http.Request) error {
+
+	text := strings.TrimSpace(r.FormValue("q"))
+	size := defaultQuickSearchSize
+	if s := r.FormValue("size"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > maxQuickSearchSize {
+			return fmt.Errorf("invalid size, must be in 1-%d: %q",
+				maxQuickSearchSize, s)
+		}
+		size = n
+	}
+	offers, err := findOffersFromTitlePrefix(index, text, size, limits)
+	if err != nil {
+		return err
+	}
+	results := []*QuickSearchResult{}
+	for _, o := range offers {
+		offer, err := getStoreOffer(store, o.Id)
+		if err != nil {
+			return err
+		}
+		if offer == nil {
+			continue
+		}
+		results = append(results, &QuickSearchResult{
+			Id:      offer.Id,
+			Title:   offer.Title,
+			Account: offer.Account,
+			Date:    offer.Date.Format("2006-01-02"),
+			URL:     offer.URL,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(&struct {
+		Query  string               `json:"q"`
+		Offers []*QuickSearchResult `json:"offers"`
+	}{
+		Query:  text,
+		Offers: results,
+	})
+}
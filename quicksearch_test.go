@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestQuickSearch(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	for _, test := range []struct {
+		Query    string
+		Size     int
+		Expected string
+	}{
+		{"dév", 10, "[apec:1002 apec:1001]"},
+		{"dév", 1, "[apec:1002]"},
+		{"DÉVELOPPEUR py", 10, "[apec:1002]"},
+		{"pyth", 10, "[apec:1006 apec:1002]"},
+		{"consultant pythonista", 10, "[]"},
+		{"ingénieurs", 10, "[]"},
+		{"j", 10, "[]"},
+		{"", 10, "[]"},
+	} {
+		offers, err := findOffersFromTitlePrefix(env.Index, test.Query,
+			test.Size, env.Limits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := []string{}
+		for _, o := range offers {
+			ids = append(ids, o.Id)
+		}
+		if fmt.Sprint(ids) != test.Expected {
+			t.Fatalf("%q: expected %s, got %v", test.Query, test.Expected, ids)
+		}
+	}
+
+	rsp := env.Get(func(w http.ResponseWriter, r *http.Request) {
+		err := handleQuickSearch(env.Store, env.Index, env.Limits, w, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}, "/api/quicksearch", url.Values{"q": {"pyth"}, "size": {"1"}})
+	result := &struct {
+		Offers []*QuickSearchResult
+	}{}
+	err := json.Unmarshal(rsp.Body.Bytes(), result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Offers) != 1 || result.Offers[0].Title != "Consultant Python H/F" ||
+		result.Offers[0].Date != "2017-01-07" {
+		t.Fatalf("unexpected results:\n%s", rsp.Body.String())
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/blevesearch/bleve"
+)
+
+// The full text index mapping version is stored in the index itself. Indexes
+// built by older binaries keep working but may miss fields, the web frontend
+// reports them and can rebuild them in the background.
+
+const (
+	// indexSchemaVersion must be incremented when NewOfferMapping or indexed
+	// documents change in a way requiring indexes to be rebuilt.
+	// 1: initial version
+	// 2: offers geopoints
+	// 3: text fields term vectors, for NEAR queries
+	// 4: unstemmed text fields, for exact queries
+	// 5: extracted skills
+	// 6: namespaced document identifiers
+	// 7: offer tags
+	// 8: offer departments and regions
+	// 9: title prefixes, for quick searches
+	// 10: stored plain text descriptions, for snippets
+	// 11: normalized job titles, for suggestions
+	// 12: indexed dates, for sorted quick searches
+	// 13: salaries and companies, for sorted results
+	indexSchemaVersion = 13
+	indexSchemaKey     = "apec_schema_version"
+)
+
+func setIndexSchemaVersion(index bleve.Index, version int) error {
+	return index.SetInternal([]byte(indexSchemaKey), []byte(strconv.Itoa(version)))
+}
+
+// getIndexSchemaVersion returns the schema version of index, or 1 for
+// indexes created before versioning.
+func getIndexSchemaVersion(index bleve.Index) (int, error) {
+	data, err := index.GetInternal([]byte(indexSchemaKey))
+	if err != nil {
+		return 0, err
+	}
+	if len(data) == 0 {
+		return 1, nil
+	}
+	version, err := strconv.Atoi(string(data))
+	if err != nil {
+		return 0, fmt.Errorf("invalid index schema version %q: %s", data, err)
+	}
+	return version, nil
+}
+
+// IndexHolder references the live full text index, which can be replaced
+// with a rebuilt one while serving requests.
+type IndexHolder struct {
+	lock  sync.RWMutex
+	index bleve.Index
+}
+
+func NewIndexHolder(index bleve.Index) *IndexHolder {
+	return &IndexHolder{
+		index: index,
+	}
+}
+
+func (h *IndexHolder) Get() bleve.Index {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.index
+}
+
+// Swap replaces the live index and returns the previous one.
+func (h *IndexHolder) Swap(index bleve.Index) bleve.Index {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	old := h.index
+	h.index = index
+	return old
+}
+
+// IndexRebuilder rebuilds the full text index from the store in a temporary
+// directory, then replaces the live one.
+type IndexRebuilder struct {
+	store      *Store
+	holder     *IndexHolder
+	dir        string
+	generation *IndexGeneration
+	options    IndexOptions
+	areas      *Areas
+	// Called once the new index is live
+	done func()
+	// Requests may still be using the replaced index for a while
+	closeDelay time.Duration
+	// Closed to interrupt the running rebuild
+	stop chan struct{}
+	// Waits for the rebuild goroutine
+	wait sync.WaitGroup
+
+	lock     sync.Mutex
+	closed   bool
+	running  bool
+	started  time.Time
+	finished time.Time
+	indexed  int
+	total    int
+	err      error
+}
+
+func NewIndexRebuilder(store *Store, holder *IndexHolder, dir string,
+	generation *IndexGeneration, options IndexOptions, areas *Areas,
+	done func()) *IndexRebuilder {
+
+	return &IndexRebuilder{
+		store:      store,
+		holder:     holder,
+		dir:        dir,
+		generation: generation,
+		options:    options,
+		areas:      areas,
+		done:       done,
+		closeDelay: time.Minute,
+		stop:       make(chan struct{}),
+	}
+}
+
+// Start rebuilds the index in the background, unless it is already being
+// rebuilt. It returns true if a rebuild was started, finished is then called
+// with its outcome.
+func (r *IndexRebuilder) Start(finished func(error)) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.running || r.closed {
+		return false
+	}
+	r.running = true
+	r.started = time.Now()
+	r.indexed = 0
+	r.total = 0
+	r.err = nil
+	r.wait.Add(1)
+	go func() {
+		defer r.wait.Done()
+		err := r.rebuild()
+		if err != nil {
+			log.Printf("error: index rebuild failed: %s", err)
+		}
+		r.lock.Lock()
+		r.running = false
+		r.finished = time.Now()
+		r.err = err
+		r.lock.Unlock()
+		finished(err)
+	}()
+	return true
+}
+
+// Close interrupts the running rebuild, if any, and waits for it to stop.
+// The next rebuild resumes it.
+func (r *IndexRebuilder) Close() {
+	r.lock.Lock()
+	if !r.closed {
+		r.closed = true
+		close(r.stop)
+	}
+	r.lock.Unlock()
+	r.wait.Wait()
+}
+
+func (r *IndexRebuilder) progress(indexed, total int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.indexed = indexed
+	r.total = total
+}
+
+func (r *IndexRebuilder) rebuild() error {
+	log.Printf("rebuilding index")
+	// Interrupted rebuilds are resumed from tempDir
+	tempDir := r.dir + ".rebuild"
+	ids, err := r.store.List()
+	if err != nil {
+		return err
+	}
+	pipeline := NewIndexPipeline(r.options, r.areas)
+	pipeline.Progress = r.progress
+	pipeline.Stop = r.stop
+	indexed, err := pipeline.Rebuild(r.store, tempDir, ids)
+	if err != nil {
+		return err
+	}
+
+	// Open index files remain usable after being moved
+	oldDir := r.dir + ".old"
+	err = replaceIndexDir(r.dir, tempDir, oldDir)
+	if err != nil {
+		return err
+	}
+	newIndex, err := OpenOfferIndex(r.dir)
+	if err != nil {
+		return err
+	}
+	old := r.holder.Swap(newIndex)
+	r.generation.Bump()
+	closeOld := func() {
+		old.Close()
+		os.RemoveAll(oldDir)
+	}
+	if r.closeDelay > 0 {
+		time.AfterFunc(r.closeDelay, closeOld)
+	} else {
+		closeOld()
+	}
+	log.Printf("index rebuilt, %d offers", indexed)
+	if r.done != nil {
+		r.done()
+	}
+	return nil
+}
+
+// IndexRebuildStatus describes the current or last index rebuild.
+type IndexRebuildStatus struct {
+	Running  bool
+	Started  time.Time
+	Finished time.Time
+	Indexed  int
+	Total    int
+	Err      error
+}
+
+func (r *IndexRebuilder) Status() IndexRebuildStatus {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return IndexRebuildStatus{
+		Running:  r.running,
+		Started:  r.started,
+		Finished: r.finished,
+		Indexed:  r.indexed,
+		Total:    r.total,
+		Err:      r.err,
+	}
+}
+
+func handleAdminStatus(store *Store, holder *IndexHolder, queue *IndexQueue,
+	spatial *SpatialIndex, rebuilder *IndexRebuilder, reindexURL string,
+	w http.ResponseWriter, r *http.Request) error {
+
+	version, err := getIndexSchemaVersion(holder.Get())
+	if err != nil {
+		return err
+	}
+	docCount, err := holder.Get().DocCount()
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "version: %s\n", getBuildInfo())
+	fmt.Fprintf(w, "offers: %d\n", store.Size())
+	fmt.Fprintf(w, "indexed offers: %d\n", docCount)
+	fmt.Fprintf(w, "index queue: %d\n", queue.Size())
+	fmt.Fprintf(w, "spatially indexed offers: %d\n", len(spatial.List()))
+	fmt.Fprintf(w, "index schema: %d, expected %d\n", version, indexSchemaVersion)
+	breaker := crawlBreaker.Status()
+	if breaker.Open {
+		fmt.Fprintf(w, "warning: crawling is paused until %s after repeated %s "+
+			"responses\n", breaker.Until.Format(time.RFC3339), breaker.Status)
+	} else if breaker.Failures > 0 {
+		fmt.Fprintf(w, "crawl blocking responses: %d consecutive, last %s\n",
+			breaker.Failures, breaker.Status)
+	}
+	status := rebuilder.Status()
+	if version != indexSchemaVersion && !status.Running {
+		fmt.Fprintf(w, "warning: index schema is outdated, search results may "+
+			"be incomplete, POST to %s to rebuild it\n", reindexURL)
+	}
+	if status.Running {
+		fmt.Fprintf(w, "index rebuild: started at %s, %d/%d offers\n",
+			status.Started.Format(time.RFC3339), status.Indexed, status.Total)
+	} else if !status.Finished.IsZero() {
+		result := "succeeded"
+		if status.Err != nil {
+			result = "failed: " + status.Err.Error()
+		}
+		fmt.Fprintf(w, "last index rebuild: finished at %s, %s\n",
+			status.Finished.Format(time.RFC3339), result)
+	}
+	return nil
+}
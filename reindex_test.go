@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestIndexRebuild(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	version, err := getIndexSchemaVersion(env.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != indexSchemaVersion {
+		t.Fatalf("unexpected new index schema version: %d", version)
+	}
+	// Pretend the index was built by an older binary
+	err = env.Index.DeleteInternal([]byte(indexSchemaKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err = getIndexSchemaVersion(env.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 1 {
+		t.Fatalf("unversioned index should be at version 1, got %d", version)
+	}
+
+	queue, err := OpenIndexQueue(env.Config.Queue())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Close()
+	holder := NewIndexHolder(env.Index)
+	synced := false
+	rebuilder := NewIndexRebuilder(env.Store, holder, env.Config.Index(),
+		env.Generation, IndexOptions{}, nil, func() { synced = true })
+	rebuilder.closeDelay = 0
+	status := func() string {
+		w := env.Get(func(w http.ResponseWriter, r *http.Request) {
+			err := handleAdminStatus(env.Store, holder, queue, env.Spatial,
+				rebuilder, "/admin/reindex", w, r)
+			if err != nil {
+				t.Fatalf("status failed: %s", err)
+			}
+		}, "/admin/status", nil)
+		return w.Body.String()
+	}
+	body := status()
+	if !strings.HasPrefix(body, "version: apec dev") ||
+		!strings.Contains(body, "index schema: 1, expected 13\n") ||
+		!strings.Contains(body, "warning: index schema is outdated") {
+		t.Fatalf("outdated schema not reported:\n%s", body)
+	}
+
+	gen := env.Generation.Get()
+	err = rebuilder.rebuild()
+	env.Index = holder.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !synced || env.Generation.Get() == gen {
+		t.Fatalf("rebuild completion was not signaled")
+	}
+	version, err = getIndexSchemaVersion(env.Index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != indexSchemaVersion {
+		t.Fatalf("unexpected rebuilt index schema version: %d", version)
+	}
+	count, err := env.Index.DocCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(count) != env.Store.Size() {
+		t.Fatalf("expected %d indexed offers, got %d", env.Store.Size(), count)
+	}
+	body = status()
+	if strings.Contains(body, "warning:") {
+		t.Fatalf("rebuilt index reported as outdated:\n%s", body)
+	}
+	w := env.Query("golang", "")
+	if !strings.Contains(w.Body.String(), "1001") {
+		t.Fatalf("rebuilt index search failed:\n%s", w.Body.String())
+	}
+}
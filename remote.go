@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pmezard/apec/jstruct"
+)
+
+// RemoteClient queries the admin handlers of a running "apec web" or
+// "apec worker", so inspection commands can run without access to the data
+// directory.
+type RemoteClient struct {
+	base    url.URL
+	session string
+	client  *http.Client
+}
+
+// NewRemoteClient returns a client for the admin handlers under serverURL.
+// session is sent as session cookie if not empty.
+func NewRemoteClient(serverURL, session string) (*RemoteClient, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server URL: %s", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid server URL: %s", serverURL)
+	}
+	u.Path = strings.TrimRight(u.Path, "/")
+	return &RemoteClient{
+		base:    *u,
+		session: session,
+		client: &http.Client{
+			Timeout: 5 * time.Minute,
+			// Report login redirections instead of parsing login pages
+			CheckRedirect: func(rq *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}, nil
+}
+
+// Get fetches path, relative to the server URL, with values as query
+// string. The caller must close the returned body.
+func (c *RemoteClient) Get(path string, values url.Values) (io.ReadCloser, error) {
+	u := c.base
+	u.Path += path
+	u.RawQuery = values.Encode()
+	rq, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.session != "" {
+		rq.AddCookie(&http.Cookie{Name: sessionCookie, Value: c.session})
+	}
+	rsp, err := c.client.Do(rq)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode == http.StatusOK {
+		return rsp.Body, nil
+	}
+	defer rsp.Body.Close()
+	switch rsp.StatusCode {
+	case http.StatusSeeOther, http.StatusUnauthorized, http.StatusForbidden:
+		return nil, fmt.Errorf("%s requires an admin session, set APEC_SESSION: %s",
+			u.String(), rsp.Status)
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(rsp.Body, 1024))
+	return nil, fmt.Errorf("%s failed with %s: %s", u.String(), rsp.Status,
+		strings.TrimSpace(string(msg)))
+}
+
+// getJsonLines fetches path and decodes its JSON lines with decode, which
+// is called until the body is exhausted.
+func (c *RemoteClient) getJsonLines(path string, values url.Values,
+	decode func(*json.Decoder) error) error {
+
+	body, err := c.Get(path, values)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	decoder := json.NewDecoder(body)
+	for decoder.More() {
+		err = decode(decoder)
+		if err != nil {
+			return fmt.Errorf("cannot decode %s response: %s", path, err)
+		}
+	}
+	return nil
+}
+
+// Search returns offers matching query, like "apec search".
+func (c *RemoteClient) Search(query, asOf string) ([]*jstruct.JsonOffer, error) {
+	values := url.Values{}
+	values.Set("q", query)
+	if asOf != "" {
+		values.Set("as-of", asOf)
+	}
+	offers := []*jstruct.JsonOffer{}
+	err := c.getJsonLines("/offers", values, func(d *json.Decoder) error {
+		offer := &jstruct.JsonOffer{}
+		err := d.Decode(offer)
+		offers = append(offers, offer)
+		return err
+	})
+	return offers, err
+}
+
+// Geocoded returns stored offers geocoding results.
+func (c *RemoteClient) Geocoded() ([]*GeocodedOffer, error) {
+	geocoded := []*GeocodedOffer{}
+	err := c.getJsonLines("/geocoded", nil, func(d *json.Decoder) error {
+		g := &GeocodedOffer{}
+		err := d.Decode(g)
+		geocoded = append(geocoded, g)
+		return err
+	})
+	return geocoded, err
+}
+
+// Stats returns dataset statistics with the top accounts top accounts, of
+// offers active on asOf if not empty.
+func (c *RemoteClient) Stats(accounts int, asOf string) (*DatasetStats, error) {
+	values := url.Values{}
+	values.Set("accounts", strconv.Itoa(accounts))
+	if asOf != "" {
+		values.Set("as-of", asOf)
+	}
+	stats := &DatasetStats{}
+	err := c.getJsonLines("/stats", values, func(d *json.Decoder) error {
+		return d.Decode(stats)
+	})
+	return stats, err
+}
+
+// Changes writes offers changes per day to w, in ascending date order and
+// in format.
+func (c *RemoteClient) Changes(w io.Writer, format string) error {
+	values := url.Values{}
+	values.Set("order", "asc")
+	values.Set("format", format)
+	body, err := c.Get("/changes", values)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	_, err = io.Copy(w, body)
+	return err
+}
+
+// writeJsonLine writes v as JSON followed by a newline.
+func writeJsonLine(w io.Writer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestRemoteClient(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	index := NewIndexHolder(env.Index)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/offers", func(w http.ResponseWriter, r *http.Request) {
+		err := handleAdminOffers(env.Store, index, nil,
+			env.Config.Snapshots(), w, r)
+		if err != nil {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "error: %s\n", err)
+		}
+	})
+	mux.HandleFunc("/admin/geocoded", func(w http.ResponseWriter, r *http.Request) {
+		err := handleAdminGeocoded(env.Store, w, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	mux.HandleFunc("/admin/changes", func(w http.ResponseWriter, r *http.Request) {
+		handleChanges(env.Store, w, r)
+	})
+	mux.HandleFunc("/admin/stats", func(w http.ResponseWriter, r *http.Request) {
+		err := handleAdminStats(env.Config, env.Store, index, w, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	mux.HandleFunc("/admin/status", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	for _, u := range []string{"localhost:8081", "ftp://localhost/admin", "http:///admin"} {
+		_, err := NewRemoteClient(u, "")
+		if err == nil {
+			t.Fatalf("invalid server URL accepted: %s", u)
+		}
+	}
+	client, err := NewRemoteClient(server.URL+"/admin/", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offers, err := client.Search("python", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for _, offer := range offers {
+		ids = append(ids, offer.Id)
+	}
+	sort.Strings(ids)
+	if fmt.Sprint(ids) != "[1001 1002 1004 1006]" {
+		t.Fatalf("unexpected remote search results: %v", ids)
+	}
+	_, err = client.Search("(python", "")
+	if err == nil || !strings.Contains(err.Error(), "400 Bad Request: error: ") {
+		t.Fatalf("invalid query did not fail: %v", err)
+	}
+
+	geocoded, err := client.Geocoded()
+	if err != nil {
+		t.Fatal(err)
+	}
+	storeIds, err := env.Store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(geocoded) != len(storeIds) || geocoded[0].Id != storeIds[0] ||
+		geocoded[0].Place == "" {
+		t.Fatalf("unexpected geocoded offers: %d != %d, %+v", len(geocoded),
+			len(storeIds), geocoded[0])
+	}
+
+	buf := &bytes.Buffer{}
+	err = client.Changes(buf, outputTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := &bytes.Buffer{}
+	err = printChanges(local, env.Store, false, outputTable)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() == 0 || buf.String() != local.String() {
+		t.Fatalf("unexpected remote changes:\n%s\n!=\n%s", buf.String(),
+			local.String())
+	}
+
+	stats, err := client.Stats(1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Offers != len(storeIds) || stats.Indexed != int64(len(storeIds)) ||
+		len(stats.Accounts) != 1 || stats.StoreSize <= 0 {
+		t.Fatalf("unexpected remote stats: %+v", stats)
+	}
+
+	_, err = client.Get("/status", nil)
+	if err == nil || !strings.Contains(err.Error(), "APEC_SESSION") {
+		t.Fatalf("login redirection was not reported: %v", err)
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ReplayExchange is a recorded HTTP exchange in JSON fixtures. Request and
+// Response are bodies, either as JSON strings or as raw JSON documents. An
+// empty Request matches any request body.
+type ReplayExchange struct {
+	Method   string          `json:"method"`
+	URL      string          `json:"url"`
+	Request  json.RawMessage `json:"request,omitempty"`
+	Status   int             `json:"status"`
+	Response json.RawMessage `json:"response"`
+}
+
+func decodeFixtureBody(raw json.RawMessage) ([]byte, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return nil, nil
+	}
+	if raw[0] != '"' {
+		return raw, nil
+	}
+	s := ""
+	err := json.Unmarshal(raw, &s)
+	return []byte(s), err
+}
+
+type replayedResponse struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// ReplayTransport is an http.RoundTripper serving recorded responses instead
+// of performing requests. Responses recorded several times for the same
+// request are served in order, the last one being repeated. Unknown requests
+// fail.
+type ReplayTransport struct {
+	lock      sync.Mutex
+	responses map[string][]*replayedResponse
+}
+
+func NewReplayTransport() *ReplayTransport {
+	return &ReplayTransport{
+		responses: map[string][]*replayedResponse{},
+	}
+}
+
+func replayKey(method, url string, body []byte) string {
+	return method + " " + url + "\n" + string(bytes.TrimSpace(body))
+}
+
+// Add records a response for supplied request. A nil request body matches
+// any request body.
+func (t *ReplayTransport) Add(method, url string, request []byte, status int,
+	header http.Header, body []byte) {
+
+	if method == "" {
+		method = "GET"
+	}
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if header == nil {
+		header = http.Header{}
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	key := replayKey(method, url, request)
+	t.responses[key] = append(t.responses[key], &replayedResponse{
+		Status: status,
+		Header: header,
+		Body:   body,
+	})
+}
+
+// Size returns the number of recorded requests.
+func (t *ReplayTransport) Size() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.responses)
+}
+
+func (t *ReplayTransport) next(method, url string, body []byte) *replayedResponse {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, key := range []string{
+		replayKey(method, url, body),
+		replayKey(method, url, nil),
+	} {
+		responses := t.responses[key]
+		if len(responses) == 0 {
+			continue
+		}
+		if len(responses) > 1 {
+			t.responses[key] = responses[1:]
+		}
+		return responses[0]
+	}
+	return nil
+}
+
+func (t *ReplayTransport) RoundTrip(rq *http.Request) (*http.Response, error) {
+	var body []byte
+	if rq.Body != nil {
+		data, err := ioutil.ReadAll(rq.Body)
+		rq.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		body = data
+	}
+	url := rq.URL.String()
+	r := t.next(rq.Method, url, body)
+	if r == nil {
+		return nil, fmt.Errorf("no recorded response for %s %s", rq.Method, url)
+	}
+	header := http.Header{}
+	for k, v := range r.Header {
+		header[k] = v
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", r.Status, http.StatusText(r.Status)),
+		StatusCode:    r.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(r.Body)),
+		ContentLength: int64(len(r.Body)),
+		Request:       rq,
+	}, nil
+}
+
+func (t *ReplayTransport) loadJSON(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	exchanges := []ReplayExchange{}
+	err = json.Unmarshal(data, &exchanges)
+	if err != nil {
+		return fmt.Errorf("cannot decode %s: %s", path, err)
+	}
+	for _, e := range exchanges {
+		request, err := decodeFixtureBody(e.Request)
+		if err != nil {
+			return fmt.Errorf("cannot decode %s request in %s: %s", e.URL, path, err)
+		}
+		response, err := decodeFixtureBody(e.Response)
+		if err != nil {
+			return fmt.Errorf("cannot decode %s response in %s: %s", e.URL, path, err)
+		}
+		t.Add(e.Method, e.URL, request, e.Status, nil, response)
+	}
+	return nil
+}
+
+type warcRecord struct {
+	Header textproto.MIMEHeader
+	Block  []byte
+}
+
+// readWARCRecords calls callback with every record of a WARC file.
+func readWARCRecords(r io.Reader, callback func(rec *warcRecord) error) error {
+	reader := bufio.NewReader(r)
+	for {
+		_, err := reader.Peek(1)
+		if err == io.EOF {
+			return nil
+		}
+		tp := textproto.NewReader(reader)
+		version, err := tp.ReadLine()
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(version, "WARC/") {
+			return fmt.Errorf("invalid WARC record version: %q", version)
+		}
+		header, err := tp.ReadMIMEHeader()
+		if err != nil {
+			return err
+		}
+		length, err := strconv.Atoi(header.Get("Content-Length"))
+		if err != nil {
+			return fmt.Errorf("invalid WARC record length: %s", err)
+		}
+		block := make([]byte, length)
+		_, err = io.ReadFull(reader, block)
+		if err != nil {
+			return err
+		}
+		end := make([]byte, 4)
+		_, err = io.ReadFull(reader, end)
+		if err != nil || string(end) != "\r\n\r\n" {
+			return fmt.Errorf("invalid WARC record end")
+		}
+		err = callback(&warcRecord{
+			Header: header,
+			Block:  block,
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (t *ReplayTransport) loadWARC(path string) error {
+	fp, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	var r io.Reader = fp
+	if strings.HasSuffix(path, ".gz") {
+		z, err := gzip.NewReader(fp)
+		if err != nil {
+			return err
+		}
+		defer z.Close()
+		r = z
+	}
+	responseIds := []string{}
+	responses := map[string]*warcRecord{}
+	requests := map[string]*warcRecord{}
+	err = readWARCRecords(r, func(rec *warcRecord) error {
+		switch rec.Header.Get("WARC-Type") {
+		case "response":
+			id := rec.Header.Get("WARC-Record-ID")
+			responseIds = append(responseIds, id)
+			responses[id] = rec
+		case "request":
+			requests[rec.Header.Get("WARC-Concurrent-To")] = rec
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("cannot read %s: %s", path, err)
+	}
+	for _, id := range responseIds {
+		response := responses[id]
+		url := response.Header.Get("WARC-Target-URI")
+		method := "GET"
+		var body []byte
+		if request := requests[id]; request != nil {
+			rq, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(request.Block)))
+			if err != nil {
+				return fmt.Errorf("cannot parse %s request in %s: %s", url, path, err)
+			}
+			method = rq.Method
+			body, err = ioutil.ReadAll(rq.Body)
+			if err != nil {
+				return err
+			}
+		}
+		rsp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(response.Block)), nil)
+		if err != nil {
+			return fmt.Errorf("cannot parse %s response in %s: %s", url, path, err)
+		}
+		data, err := ioutil.ReadAll(rsp.Body)
+		if err != nil {
+			return err
+		}
+		t.Add(method, url, body, rsp.StatusCode, rsp.Header, data)
+	}
+	return nil
+}
+
+// LoadReplayTransport returns a ReplayTransport serving the exchanges found
+// in dir, in *.json fixtures and *.warc or *.warc.gz files, loaded in file
+// name order.
+func LoadReplayTransport(dir string) (*ReplayTransport, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, e := range entries {
+		if !e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	t := NewReplayTransport()
+	for _, name := range names {
+		path := filepath.Join(dir, name)
+		if strings.HasSuffix(name, ".json") {
+			err = t.loadJSON(path)
+		} else if strings.HasSuffix(name, ".warc") || strings.HasSuffix(name, ".warc.gz") {
+			err = t.loadWARC(path)
+		} else {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if t.Size() == 0 {
+		return nil, fmt.Errorf("no recorded exchange found in %s", dir)
+	}
+	return t, nil
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/mapping"
+)
+
+// Bolt databases can only be opened by one process at a time. When crawling
+// and indexing run in "apec worker", it periodically publishes replicas,
+// read-only copies of the store, full text indexes and geocoder cache, which
+// "apec web" serves and replaces as new ones appear. Each replica is a
+// numbered directory of the replicas directory, the CURRENT file names the
+// last complete one.
+
+const (
+	replicaCurrent = "CURRENT"
+	// Published replicas kept in addition to the current one, for web
+	// processes which have not switched yet
+	replicaKeep = 1
+)
+
+// Replica groups the data served by public handlers.
+type Replica struct {
+	Name      string
+	Store     *Store
+	Index     *IndexHolder
+	Spatial   *SpatialIndex
+	Geocoder  *Geocoder
+	Lifetimes *LifetimesCache
+	// Deleted offers index, nil if unavailable
+	Deleted *DeletedIndex
+
+	lock    sync.Mutex
+	refs    int
+	closing bool
+	closed  bool
+}
+
+// Retain keeps the replica open until the returned function is called, even
+// if it is closed meanwhile. It returns nil if the replica is already closed.
+func (r *Replica) Retain() func() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.closed {
+		return nil
+	}
+	r.refs++
+	once := sync.Once{}
+	return func() {
+		once.Do(func() {
+			r.lock.Lock()
+			defer r.lock.Unlock()
+			r.refs--
+			if r.closing && r.refs == 0 {
+				r.close()
+			}
+		})
+	}
+}
+
+// Close closes the replica, or once it is no longer retained.
+func (r *Replica) Close() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.closing = true
+	if r.refs == 0 {
+		r.close()
+	}
+}
+
+// close releases the replica resources. The lock must be held.
+func (r *Replica) close() {
+	if r.closed {
+		return
+	}
+	r.closed = true
+	r.Index.Get().Close()
+	if r.Deleted != nil {
+		r.Deleted.Close()
+	}
+	r.Geocoder.Close()
+	r.Store.Close()
+}
+
+// ReplicaHolder references the served replica.
+type ReplicaHolder struct {
+	lock    sync.RWMutex
+	replica *Replica
+}
+
+func NewReplicaHolder(replica *Replica) *ReplicaHolder {
+	return &ReplicaHolder{
+		replica: replica,
+	}
+}
+
+func (h *ReplicaHolder) Get() *Replica {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	return h.replica
+}
+
+// Swap replaces the served replica and returns the previous one.
+func (h *ReplicaHolder) Swap(replica *Replica) *Replica {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	old := h.replica
+	h.replica = replica
+	return old
+}
+
+// readCurrentReplica returns the name of the last replica published in dir,
+// or an empty string.
+func readCurrentReplica(dir string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, replicaCurrent))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// copyIndex writes a copy of index rows in a new index at dir, with the same
+// mapping.
+func copyIndex(index bleve.Index, dir string) error {
+	m, ok := index.Mapping().(*mapping.IndexMappingImpl)
+	if !ok {
+		return fmt.Errorf("unsupported index mapping %T", index.Mapping())
+	}
+	copied, err := newIndexUsing(dir, m)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if copied != nil {
+			copied.Close()
+		}
+	}()
+	_, src, err := index.Advanced()
+	if err != nil {
+		return err
+	}
+	_, dst, err := copied.Advanced()
+	if err != nil {
+		return err
+	}
+	reader, err := src.Reader()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	writer, err := dst.Writer()
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+	it := reader.RangeIterator(nil, nil)
+	defer it.Close()
+	batch := writer.NewBatch()
+	n := 0
+	for ; it.Valid(); it.Next() {
+		key, value, _ := it.Current()
+		// Iterator buffers are reused
+		batch.Set(append([]byte{}, key...), append([]byte{}, value...))
+		n++
+		if n%10000 == 0 {
+			err = writer.ExecuteBatch(batch)
+			if err != nil {
+				return err
+			}
+			batch = writer.NewBatch()
+		}
+	}
+	err = writer.ExecuteBatch(batch)
+	if err != nil {
+		return err
+	}
+	err = copied.Close()
+	copied = nil
+	return err
+}
+
+// publishReplica copies store, index, deleted offers index if not nil, and
+// geocoder cache in a new replica of dir, makes it the current one and
+// removes older ones. It returns the new replica name.
+func publishReplica(store *Store, index bleve.Index, deleted *DeletedIndex,
+	geocoder *Geocoder, dir string) (string, error) {
+
+	start := time.Now()
+	current, err := readCurrentReplica(dir)
+	if err != nil {
+		return "", err
+	}
+	seq := 0
+	if current != "" {
+		seq, err = strconv.Atoi(current)
+		if err != nil {
+			return "", fmt.Errorf("invalid current replica %q: %s", current, err)
+		}
+	}
+	name := fmt.Sprintf("%06d", seq+1)
+	tempDir := filepath.Join(dir, name+".tmp")
+	err = os.RemoveAll(tempDir)
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(tempDir, 0755)
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tempDir)
+	err = store.Compact(filepath.Join(tempDir, "offers"))
+	if err != nil {
+		return "", fmt.Errorf("cannot copy store: %s", err)
+	}
+	err = copyIndex(index, filepath.Join(tempDir, "index"))
+	if err != nil {
+		return "", fmt.Errorf("cannot copy index: %s", err)
+	}
+	if deleted != nil {
+		deletedIndex, err := deleted.Get()
+		if err != nil {
+			return "", err
+		}
+		err = copyIndex(deletedIndex, filepath.Join(tempDir, "deleted"))
+		if err != nil {
+			return "", fmt.Errorf("cannot copy deleted offers index: %s", err)
+		}
+	}
+	err = geocoder.CopyCache(filepath.Join(tempDir, "geocoder"))
+	if err != nil {
+		return "", fmt.Errorf("cannot copy geocoder cache: %s", err)
+	}
+	err = os.Rename(tempDir, filepath.Join(dir, name))
+	if err != nil {
+		return "", err
+	}
+	currentPath := filepath.Join(dir, replicaCurrent)
+	err = ioutil.WriteFile(currentPath+".tmp", []byte(name+"\n"), 0644)
+	if err != nil {
+		return "", err
+	}
+	err = os.Rename(currentPath+".tmp", currentPath)
+	if err != nil {
+		return "", err
+	}
+	err = removeOldReplicas(dir, name)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("replica %s published in %s", name, ftime(time.Since(start)))
+	return name, nil
+}
+
+// removeOldReplicas removes replicas older than current, except the
+// replicaKeep most recent ones. Removed replicas files remain usable by
+// processes which opened them.
+func removeOldReplicas(dir, current string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	for _, e := range entries {
+		_, err := strconv.Atoi(e.Name())
+		if err == nil && e.IsDir() && e.Name() < current {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	for i := 0; i < len(names)-replicaKeep; i++ {
+		err := os.RemoveAll(filepath.Join(dir, names[i]))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openReplica opens the name replica published in cfg replicas directory.
+// Replicas are laid out like data directories, and their geocoder is
+// configured like cfg one. The deleted offers index is opened on first use.
+func openReplica(cfg *Config, name string) (*Replica, error) {
+	replicaCfg := *cfg
+	replicaCfg.RootDir = filepath.Join(cfg.Replicas(), name)
+	store, err := OpenStoreReadOnly(replicaCfg.Store())
+	if err != nil {
+		return nil, err
+	}
+	index, err := OpenOfferIndexReadOnly(replicaCfg.Index())
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	geocoder, err := openGeocoder(&replicaCfg)
+	if err != nil {
+		index.Close()
+		store.Close()
+		return nil, err
+	}
+	spatial, err := buildSpatialIndex(store, geocoder)
+	if err != nil {
+		geocoder.Close()
+		index.Close()
+		store.Close()
+		return nil, err
+	}
+	deleted := NewDeletedIndex(replicaCfg.DeletedIndex())
+	deleted.ReadOnly = true
+	return &Replica{
+		Name:      name,
+		Store:     store,
+		Index:     NewIndexHolder(index),
+		Spatial:   spatial,
+		Geocoder:  geocoder,
+		Lifetimes: NewLifetimesCache(store),
+		Deleted:   deleted,
+	}, nil
+}
+
+// ReplicaWatcher replaces the replica of holder when a new one is published
+// in the replicas directory.
+type ReplicaWatcher struct {
+	cfg        *Config
+	holder     *ReplicaHolder
+	generation *IndexGeneration
+	closeDelay time.Duration
+	// Closed to stop watching
+	stop chan struct{}
+
+	lock   sync.Mutex
+	closed bool
+}
+
+// NewReplicaWatcher opens the current replica of cfg and returns a watcher
+// serving it.
+func NewReplicaWatcher(cfg *Config, generation *IndexGeneration) (
+	*ReplicaWatcher, error) {
+
+	dir := cfg.Replicas()
+	name, err := readCurrentReplica(dir)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return nil, fmt.Errorf("no replica published in %s, is the worker running?",
+			dir)
+	}
+	replica, err := openReplica(cfg, name)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open replica %s: %s", name, err)
+	}
+	log.Printf("serving replica %s", name)
+	return &ReplicaWatcher{
+		cfg:        cfg,
+		holder:     NewReplicaHolder(replica),
+		generation: generation,
+		closeDelay: time.Minute,
+		stop:       make(chan struct{}),
+	}, nil
+}
+
+func (w *ReplicaWatcher) Holder() *ReplicaHolder {
+	return w.holder
+}
+
+// Update switches to the current replica, if it changed.
+func (w *ReplicaWatcher) Update() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return nil
+	}
+	name, err := readCurrentReplica(w.cfg.Replicas())
+	if err != nil {
+		return err
+	}
+	if name == "" || name == w.holder.Get().Name {
+		return nil
+	}
+	replica, err := openReplica(w.cfg, name)
+	if err != nil {
+		return fmt.Errorf("cannot open replica %s: %s", name, err)
+	}
+	old := w.holder.Swap(replica)
+	w.generation.Bump()
+	if w.closeDelay > 0 {
+		time.AfterFunc(w.closeDelay, old.Close)
+	} else {
+		old.Close()
+	}
+	log.Printf("serving replica %s", name)
+	return nil
+}
+
+// Watch checks for new replicas every interval, until the watcher is closed.
+func (w *ReplicaWatcher) Watch(interval time.Duration) {
+	for {
+		select {
+		case <-time.After(interval):
+		case <-w.stop:
+			return
+		}
+		err := w.Update()
+		if err != nil {
+			log.Printf("error: cannot update replica: %s", err)
+		}
+	}
+}
+
+// Close stops watching, waiting for a running update, and closes the served
+// replica.
+func (w *ReplicaWatcher) Close() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return
+	}
+	w.closed = true
+	close(w.stop)
+	w.holder.Get().Close()
+}
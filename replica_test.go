@@ -0,0 +1,150 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplicas(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	// Deleted offers are published with their own index
+	id := "apec:1002"
+	_, err := env.Store.Delete(id, time.Date(2017, 1, 9, 12, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = env.Index.Delete(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Spatial.Remove(id)
+	deleted, err := env.Deleted.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = syncDeletedIndex(env.Store, deleted, IndexOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := env.Config.Replicas()
+	_, err = NewReplicaWatcher(env.Config, env.Generation)
+	if err == nil {
+		t.Fatalf("opening missing replicas should have failed")
+	}
+	name, err := publishReplica(env.Store, env.Index, env.Deleted, env.Geocoder,
+		dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	watcher, err := NewReplicaWatcher(env.Config, env.Generation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+	watcher.closeDelay = 0
+	replica := watcher.Holder().Get()
+	if replica.Name != name {
+		t.Fatalf("unexpected replica: %s != %s", replica.Name, name)
+	}
+	if replica.Store.Size() != env.Store.Size() {
+		t.Fatalf("replica store has %d offers, expected %d", replica.Store.Size(),
+			env.Store.Size())
+	}
+	count, err := replica.Index.Get().DocCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(count) != env.Store.Size() {
+		t.Fatalf("replica index has %d offers, expected %d", count,
+			env.Store.Size())
+	}
+	if len(replica.Spatial.List()) != len(env.Spatial.List()) {
+		t.Fatalf("replica spatial index has %d offers, expected %d",
+			len(replica.Spatial.List()), len(env.Spatial.List()))
+	}
+	if replica.Deleted.Opened() != nil {
+		t.Fatalf("replica deleted offers index should be opened on first use")
+	}
+	err = replica.Store.Put("2000", []byte("{}"))
+	if err == nil {
+		t.Fatalf("replica store should be read-only")
+	}
+
+	// Replicas serve searches
+	w := env.Get(func(w http.ResponseWriter, r *http.Request) {
+		sc := env.SearchContext()
+		sc.Replica = replica
+		sc.Speller = nil
+		handleQuery(sc, w, r)
+	}, "/search", url.Values{"what": {"python"}, "where": {"paris"},
+		"include_deleted": {"1"}})
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "2/2 offers") ||
+		!strings.Contains(w.Body.String(), "[deleted 2017-01-09]") {
+		t.Fatalf("replica query failed with %d: %s", w.Code, w.Body.String())
+	}
+
+	// Retained replicas stay open after being replaced
+	release := replica.Retain()
+	if release == nil {
+		t.Fatalf("served replica could not be retained")
+	}
+
+	// Publish more and check the watcher switches to the last one and older
+	// ones are removed
+	for i := 0; i < 2; i++ {
+		_, err = publishReplica(env.Store, env.Index, env.Deleted, env.Geocoder,
+			dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	gen := env.Generation.Get()
+	err = watcher.Update()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if watcher.Holder().Get().Name != "000003" || env.Generation.Get() == gen {
+		t.Fatalf("replica was not updated: %s", watcher.Holder().Get().Name)
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	if len(names) != 3 || names[0] != "000002" || names[1] != "000003" ||
+		names[2] != replicaCurrent {
+		t.Fatalf("unexpected replicas: %v", names)
+	}
+	_, err = os.Stat(filepath.Join(dir, "000003", "index"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = replica.Store.Get("1001")
+	if err != nil {
+		t.Fatalf("retained replica was closed: %s", err)
+	}
+	release()
+	release()
+	_, err = replica.Store.Get("1001")
+	if err == nil {
+		t.Fatalf("released replica is still open")
+	}
+	if replica.Retain() != nil {
+		t.Fatalf("closed replica was retained")
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/blevesearch/bleve"
+)
+
+// Salary reports compare the salaries of offers matching a query across
+// regions. Offers are assigned to regions like in areas.go, and reposted
+// offers, sharing the same content hash, are counted once. Salaries are the
+// middle of offers salary ranges, in kEUR.
+
+const (
+	reportMarkdown = "markdown"
+	reportCSV      = "csv"
+	// Region of offers without area, and of the summary row
+	unknownRegion = "unknown"
+	allRegions    = "all"
+)
+
+// quantileInt returns the q quantile of sorted values, interpolated between
+// closest ranks and rounded.
+func quantileInt(sorted []int, q float64) int {
+	if len(sorted) == 0 {
+		return 0
+	}
+	pos := q * float64(len(sorted)-1)
+	i := int(pos)
+	if i+1 >= len(sorted) {
+		return sorted[len(sorted)-1]
+	}
+	v := float64(sorted[i]) + (pos-float64(i))*float64(sorted[i+1]-sorted[i])
+	return int(v + 0.5)
+}
+
+type RegionSalaries struct {
+	Region string
+	Code   string
+	Offers int
+	// Offers with a salary, and their salaries distribution
+	WithSalary int
+	Min        int
+	Q1         int
+	Median     int
+	Q3         int
+	Max        int
+
+	salaries []int
+}
+
+func (r *RegionSalaries) add(salary int) {
+	r.Offers++
+	if salary > 0 {
+		r.WithSalary++
+		r.salaries = append(r.salaries, salary)
+	}
+}
+
+func (r *RegionSalaries) summarize() {
+	sort.Ints(r.salaries)
+	r.Min = quantileInt(r.salaries, 0)
+	r.Q1 = quantileInt(r.salaries, 0.25)
+	r.Median = quantileInt(r.salaries, 0.5)
+	r.Q3 = quantileInt(r.salaries, 0.75)
+	r.Max = quantileInt(r.salaries, 1)
+}
+
+// sortedRegionSalaries sorts regions by decreasing median salary, then
+// decreasing number of offers and name. Regions without salary come last.
+type sortedRegionSalaries []*RegionSalaries
+
+func (s sortedRegionSalaries) Len() int {
+	return len(s)
+}
+
+func (s sortedRegionSalaries) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s sortedRegionSalaries) Less(i, j int) bool {
+	if s[i].Median != s[j].Median {
+		return s[i].Median > s[j].Median
+	}
+	if s[i].Offers != s[j].Offers {
+		return s[i].Offers > s[j].Offers
+	}
+	return s[i].Region < s[j].Region
+}
+
+type SalaryReport struct {
+	Query string
+	// Matching offers, and those skipped as duplicates of another one
+	Matched    int
+	Duplicates int
+	Regions    []*RegionSalaries
+	// All unique offers, including those without region
+	All *RegionSalaries
+}
+
+// collectRegionSalaries reports the salaries of offers matching query by
+// region. Offers without cached area are assigned one from areas, which can
+// be nil.
+func collectRegionSalaries(store *Store, index bleve.Index, areas *Areas,
+	query string) (*SalaryReport, error) {
+
+	ids, err := listQueryIds(store, index, query)
+	if err != nil {
+		return nil, err
+	}
+	return summarizeRegionSalaries(store, areas, query, ids)
+}
+
+// summarizeRegionSalaries reports the salaries of offers ids, matching query,
+// by region.
+func summarizeRegionSalaries(store *Store, areas *Areas, query string,
+	ids []string) (*SalaryReport, error) {
+
+	ids = append([]string{}, ids...)
+	sort.Strings(ids)
+	report := &SalaryReport{
+		Query: query,
+		All:   &RegionSalaries{Region: allRegions},
+	}
+	seen := map[string]bool{}
+	regions := map[string]*RegionSalaries{}
+	for _, id := range ids {
+		js, err := getStoreJsonOffer(store, id)
+		if err != nil {
+			return nil, err
+		}
+		if js == nil {
+			continue
+		}
+		report.Matched++
+		hash := hashOffer(js)
+		if seen[hash] {
+			report.Duplicates++
+			continue
+		}
+		seen[hash] = true
+		offer, err := convertOffer(js)
+		if err != nil {
+			return nil, err
+		}
+		area, err := store.GetOfferArea(id)
+		if err != nil {
+			return nil, err
+		}
+		if area == nil {
+			loc, _, err := store.GetLocation(id)
+			if err != nil {
+				return nil, err
+			}
+			area = assignArea(areas, loc)
+		}
+		name, code := unknownRegion, ""
+		if area != nil && area.Region != "" {
+			name, code = area.Region, area.RegionCode
+		}
+		r := regions[name]
+		if r == nil {
+			r = &RegionSalaries{Region: name, Code: code}
+			regions[name] = r
+		}
+		salary := 0
+		if offer.MinSalary > 0 {
+			salary = (offer.MinSalary + offer.MaxSalary) / 2
+		}
+		r.add(salary)
+		report.All.add(salary)
+	}
+	for _, r := range regions {
+		r.summarize()
+		report.Regions = append(report.Regions, r)
+	}
+	sort.Sort(sortedRegionSalaries(report.Regions))
+	report.All.summarize()
+	return report, nil
+}
+
+func (r *RegionSalaries) columns() []string {
+	cols := []string{r.Region, r.Code, strconv.Itoa(r.Offers),
+		strconv.Itoa(r.WithSalary)}
+	for _, v := range []int{r.Min, r.Q1, r.Median, r.Q3, r.Max} {
+		s := ""
+		if r.WithSalary > 0 {
+			s = strconv.Itoa(v)
+		}
+		cols = append(cols, s)
+	}
+	return cols
+}
+
+var salaryReportHeader = []string{"region", "region_code", "offers",
+	"with_salary", "min", "q1", "median", "q3", "max"}
+
+func writeSalaryReportCSV(w io.Writer, report *SalaryReport) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write(salaryReportHeader)
+	if err != nil {
+		return err
+	}
+	for _, r := range append(report.Regions, report.All) {
+		err = cw.Write(r.columns())
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeSalaryReportMarkdown(w io.Writer, report *SalaryReport) error {
+	query := report.Query
+	if query == "" {
+		query = "all offers"
+	}
+	_, err := fmt.Fprintf(w, "# Salaries by region: %s\n\n"+
+		"%d offers, %d duplicates skipped, %d with salary. Salaries are "+
+		"offers salary range middles in kEUR.\n\n", query,
+		report.Matched, report.Duplicates, report.All.WithSalary)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "| Region | Offers | With salary | Min | Q1 | Median | Q3 | Max |\n")
+	fmt.Fprintf(w, "|---|---:|---:|---:|---:|---:|---:|---:|\n")
+	for _, r := range append(report.Regions, report.All) {
+		cols := r.columns()
+		name := cols[0]
+		if r == report.All {
+			name = "**" + name + "**"
+		} else if r.Code != "" {
+			name += " (" + r.Code + ")"
+		}
+		_, err = fmt.Fprintf(w, "| %s | %s | %s | %s | %s | %s | %s | %s |\n",
+			name, cols[2], cols[3], cols[4], cols[5], cols[6], cols[7], cols[8])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var (
+	reportCmd               = app.Command("report", "generate reports")
+	reportSalaryByRegionCmd = reportCmd.Command("salary-by-region",
+		`compare salaries across regions
+
+Offers matching the query, or all offers, are grouped by region and their
+salaries summarized by quartiles. Regions come from the areas assigned to
+offers, see the areas command, reposted offers are counted once.
+`)
+	reportSalaryQuery = reportSalaryByRegionCmd.Arg("query", "search query").
+				String()
+	reportSalaryFormat = reportSalaryByRegionCmd.Flag("format",
+		"report format, markdown or csv").Default(reportMarkdown).
+		Enum(reportMarkdown, reportCSV)
+)
+
+func reportSalaryByRegionFn(cfg *Config) error {
+	areas, err := LoadAreas(cfg.ShapesDir)
+	if err != nil {
+		return err
+	}
+	store, err := OpenStore(cfg.Store())
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	var index bleve.Index
+	if *reportSalaryQuery != "" {
+		index, err = OpenOfferIndex(cfg.Index())
+		if err != nil {
+			return err
+		}
+		defer index.Close()
+	}
+	report, err := collectRegionSalaries(store, index, areas, *reportSalaryQuery)
+	if err != nil {
+		return err
+	}
+	if *reportSalaryFormat == reportCSV {
+		return writeSalaryReportCSV(os.Stdout, report)
+	}
+	return writeSalaryReportMarkdown(os.Stdout, report)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestSalaryByRegionReport(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	// Repost an offer under another identifier
+	js, err := getStoreJsonOffer(env.Store, "apec:1002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reposted := *js
+	reposted.Id = "1007"
+	reposted.Date = "2017-01-09T10:00:00.000+0000"
+	data, err := json.Marshal(&reposted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = env.Store.Put("apec:1007", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Reindex()
+
+	report, err := collectRegionSalaries(env.Store, env.Index, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Matched != 7 || report.Duplicates != 1 {
+		t.Fatalf("unexpected counts: %d matched, %d duplicates", report.Matched,
+			report.Duplicates)
+	}
+	buf := &bytes.Buffer{}
+	err = writeSalaryReportCSV(buf, report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `region,region_code,offers,with_salary,min,q1,median,q3,max
+unknown,,2,2,50,55,60,65,70
+Auvergne-Rhône-Alpes,,1,1,55,55,55,55,55
+Ile-de-France,,2,2,40,43,45,48,50
+Nouvelle-Aquitaine,,1,0,,,,,
+all,,6,5,40,50,50,55,70
+`
+	if buf.String() != expected {
+		t.Fatalf("unexpected report:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+
+	report, err = collectRegionSalaries(env.Store, env.Index, nil, "python")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	err = writeSalaryReportMarkdown(buf, report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"# Salaries by region: python\n",
+		"5 offers, 1 duplicates skipped, 3 with salary.",
+		"| Ile-de-France | 2 | 2 | 40 | 43 | 45 | 48 | 50 |\n",
+		"| Nouvelle-Aquitaine | 1 | 0 |  |  |  |  |  |\n",
+		"| **all** | 4 | 3 | 40 | 45 | 50 | 50 | 50 |\n",
+	} {
+		if !strings.Contains(buf.String(), s) {
+			t.Fatalf("%q is missing from report:\n%s", s, buf.String())
+		}
+	}
+
+	for _, test := range []struct {
+		Values   []int
+		Q        float64
+		Expected int
+	}{
+		{nil, 0.5, 0},
+		{[]int{40}, 0.25, 40},
+		{[]int{40, 50}, 0.5, 45},
+		{[]int{40, 50, 60, 80}, 0.75, 65},
+		{[]int{40, 50, 60, 80}, 1, 80},
+	} {
+		if q := quantileInt(test.Values, test.Q); q != test.Expected {
+			t.Fatalf("%v quantile of %v: expected %d, got %d", test.Q, test.Values,
+				test.Expected, q)
+		}
+	}
+}
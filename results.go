@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Search results are kept server-side for a while, identified by a token, so
+// following queries can be restricted to them without running the spatial
+// phase again. Tokens are derived from result identifiers: identical result
+// sets share the same token.
+
+type resultSet struct {
+	Offers []datedOffer
+	Used   time.Time
+}
+
+type ResultSets struct {
+	lock sync.Mutex
+	sets map[string]*resultSet
+	max  int
+	ttl  time.Duration
+}
+
+// NewResultSets returns a cache holding at most max result sets, each of them
+// expiring after ttl without being used.
+func NewResultSets(max int, ttl time.Duration) *ResultSets {
+	return &ResultSets{
+		sets: map[string]*resultSet{},
+		max:  max,
+		ttl:  ttl,
+	}
+}
+
+func makeResultsToken(offers []datedOffer) string {
+	ids := make([]string, len(offers))
+	for i, o := range offers {
+		ids[i] = o.Id
+	}
+	sort.Strings(ids)
+	h := sha1.New()
+	for _, id := range ids {
+		h.Write([]byte(id))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// Put stores offers and returns their token. Expired sets are dropped, then
+// the least recently used ones if the cache is full.
+func (r *ResultSets) Put(offers []datedOffer, now time.Time) string {
+	token := makeResultsToken(offers)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for k, set := range r.sets {
+		if now.Sub(set.Used) > r.ttl {
+			delete(r.sets, k)
+		}
+	}
+	if _, ok := r.sets[token]; !ok {
+		for len(r.sets) > 0 && len(r.sets) >= r.max {
+			oldest := ""
+			for k, set := range r.sets {
+				if oldest == "" || set.Used.Before(r.sets[oldest].Used) {
+					oldest = k
+				}
+			}
+			delete(r.sets, oldest)
+		}
+		r.sets[token] = &resultSet{
+			Offers: append([]datedOffer{}, offers...),
+		}
+	}
+	r.sets[token].Used = now
+	return token
+}
+
+// Get returns the offers of token, or nil if they expired.
+func (r *ResultSets) Get(token string, now time.Time) []datedOffer {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	set := r.sets[token]
+	if set == nil || now.Sub(set.Used) > r.ttl {
+		return nil
+	}
+	set.Used = now
+	return append([]datedOffer{}, set.Offers...)
+}
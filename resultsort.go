@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	blevesearch "github.com/blevesearch/bleve/search"
+	"github.com/blevesearch/bleve/search/query"
+)
+
+// Search results are sorted by the "sort" parameter, by decreasing
+// publication date by default.
+const (
+	resultsByDate      = "date"
+	resultsByRelevance = "relevance"
+	resultsByTransit   = "transit"
+	resultsByMinSalary = "min_salary"
+	resultsByMaxSalary = "max_salary"
+	resultsByAge       = "age"
+	resultsByCompany   = "company"
+)
+
+var resultsSorts = []string{resultsByDate, resultsByRelevance, resultsByTransit,
+	resultsByMinSalary, resultsByMaxSalary, resultsByAge, resultsByCompany}
+
+// offerSortKey is the value a search result is sorted by. Results without
+// one come last.
+type offerSortKey struct {
+	Known  bool
+	Number float64
+}
+
+// sortedKeyedOffers sorts offers by decreasing key numbers, then by date.
+// Keys are indexed like Offers.
+type sortedKeyedOffers struct {
+	Offers []datedOffer
+	Keys   []offerSortKey
+}
+
+func (s *sortedKeyedOffers) Len() int {
+	return len(s.Offers)
+}
+
+func (s *sortedKeyedOffers) Swap(i, j int) {
+	s.Offers[i], s.Offers[j] = s.Offers[j], s.Offers[i]
+	s.Keys[i], s.Keys[j] = s.Keys[j], s.Keys[i]
+}
+
+func (s *sortedKeyedOffers) Less(i, j int) bool {
+	a, b := s.Keys[i], s.Keys[j]
+	if a.Known != b.Known {
+		return a.Known
+	}
+	if a.Number != b.Number {
+		return a.Number > b.Number
+	}
+	return s.Offers[i].Date > s.Offers[j].Date
+}
+
+// indexSortFields maps results sorts to the index fields sorting them, ties
+// are broken by decreasing date.
+var indexSortFields = map[string]string{
+	resultsByMinSalary: "-min_salary",
+	resultsByMaxSalary: "-max_salary",
+	resultsByCompany:   "company",
+}
+
+// sortedHits sorts search hits like order.
+type sortedHits struct {
+	Hits  blevesearch.DocumentMatchCollection
+	Order blevesearch.SortOrder
+}
+
+func (s *sortedHits) Len() int {
+	return len(s.Hits)
+}
+
+func (s *sortedHits) Swap(i, j int) {
+	s.Hits[i], s.Hits[j] = s.Hits[j], s.Hits[i]
+}
+
+func (s *sortedHits) Less(i, j int) bool {
+	return s.Order.Compare(s.Order.CacheIsScore(), s.Order.CacheDescending(),
+		s.Hits[i], s.Hits[j]) < 0
+}
+
+// sortByIndex sorts offers in place by the index field of sort by, live ones
+// from index and deleted ones from deleted. Offers missing from the indexes
+// come last, by decreasing date.
+func sortByIndex(index bleve.Index, deleted *DeletedIndex,
+	offers []datedOffer, by string) error {
+
+	ids, deletedIds := []string{}, []string{}
+	byId := map[string]datedOffer{}
+	for _, o := range offers {
+		if o.Deleted {
+			deletedIds = append(deletedIds, o.Id)
+		} else {
+			ids = append(ids, o.Id)
+		}
+		byId[o.Id] = o
+	}
+	var order blevesearch.SortOrder
+	hits := blevesearch.DocumentMatchCollection{}
+	for i, docIds := range [][]string{ids, deletedIds} {
+		if len(docIds) == 0 {
+			continue
+		}
+		idx := index
+		if i == 1 {
+			var err error
+			idx, err = deleted.Get()
+			if err != nil {
+				return err
+			}
+		}
+		rq := bleve.NewSearchRequest(query.NewDocIDQuery(docIds))
+		rq.Size = len(docIds)
+		rq.SortBy([]string{indexSortFields[by], "-date"})
+		res, err := idx.Search(rq)
+		if err != nil {
+			return err
+		}
+		order = rq.Sort
+		hits = append(hits, res.Hits...)
+	}
+	// Merge live and deleted versions hits
+	sort.Stable(&sortedHits{Hits: hits, Order: order})
+	sorted := []datedOffer{}
+	for _, hit := range hits {
+		if o, ok := byId[hit.ID]; ok {
+			sorted = append(sorted, o)
+			delete(byId, hit.ID)
+		}
+	}
+	missing := []datedOffer{}
+	for _, o := range byId {
+		missing = append(missing, o)
+	}
+	sort.Sort(sortedDatedOffers(missing))
+	copy(offers, append(sorted, missing...))
+	return nil
+}
+
+// getOfferAgeKey returns the key of doc when sorting by age.
+func getOfferAgeKey(store *Store, doc datedOffer) (offerSortKey, error) {
+	date, err := time.Parse(time.RFC3339, doc.Date)
+	if err != nil {
+		return offerSortKey{}, fmt.Errorf("cannot parse %s date: %s", doc.Id,
+			err)
+	}
+	published, err := getPublishedDate(store, doc, date)
+	if err != nil {
+		return offerSortKey{}, err
+	}
+	return offerSortKey{Known: true, Number: float64(published.Unix())}, nil
+}
+
+// sortSearchResults sorts offers in place according to by:
+//   - date: decreasing publication date
+//   - relevance: decreasing text query score, offers matched by location
+//     only are scored alike
+//   - transit: increasing distance to the nearest station
+//   - min_salary, max_salary: decreasing salary, unknown salaries last
+//   - age: increasing age since the initial publication, so reposts of old
+//     offers come after really new ones
+//   - company: company name
+//
+// Ties are broken by decreasing publication date. Salaries and companies are
+// sorted by index, or deleted for deleted offers versions.
+func sortSearchResults(store *Store, index bleve.Index, deleted *DeletedIndex,
+	offers []datedOffer, by string) error {
+
+	switch by {
+	case "", resultsByDate:
+		sort.Sort(sortedDatedOffers(offers))
+		return nil
+	case resultsByTransit:
+		return sortByTransit(store, offers)
+	case resultsByRelevance:
+		keys := make([]offerSortKey, len(offers))
+		for i, o := range offers {
+			keys[i] = offerSortKey{Known: true, Number: o.Score}
+		}
+		sort.Sort(&sortedKeyedOffers{Offers: offers, Keys: keys})
+		return nil
+	case resultsByMinSalary, resultsByMaxSalary, resultsByCompany:
+		return sortByIndex(index, deleted, offers, by)
+	case resultsByAge:
+		keys := make([]offerSortKey, len(offers))
+		for i, o := range offers {
+			key, err := getOfferAgeKey(store, o)
+			if err != nil {
+				return err
+			}
+			keys[i] = key
+		}
+		sort.Sort(&sortedKeyedOffers{Offers: offers, Keys: keys})
+		return nil
+	}
+	return fmt.Errorf("unknown sort %q, expected one of %s", by,
+		strings.Join(resultsSorts, ", "))
+}
+
+// getPublishedDate returns the initial publication date of doc, or date if
+// unknown. Deleted versions have no initial date.
+func getPublishedDate(store *Store, doc datedOffer, date time.Time) (
+	time.Time, error) {
+
+	if doc.Deleted {
+		return date, nil
+	}
+	initialDate, err := store.GetInitialDate(doc.Id)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if initialDate.IsZero() {
+		return date, nil
+	}
+	return initialDate, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/pmezard/apec/jstruct"
+)
+
+func TestSortSearchResults(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	reOffer := regexp.MustCompile(`name="id" value="apec:(\d+)"`)
+	for _, test := range []struct {
+		Sort     string
+		Expected string
+	}{
+		{"", "[1006 1004 1003 1002 1001]"},
+		{"date", "[1006 1004 1003 1002 1001]"},
+		// Ties are sorted by date, unknown salaries last
+		{"min_salary", "[1006 1003 1001 1002 1004]"},
+		{"max_salary", "[1003 1001 1006 1002 1004]"},
+		{"company", "[1001 1003 1006 1002 1004]"},
+	} {
+		w := env.QueryValues(url.Values{
+			"sort":           {test.Sort},
+			"include_remote": {"1"},
+		})
+		body := w.Body.String()
+		if w.Code != 200 {
+			t.Fatalf("sort %q failed with %d: %s", test.Sort, w.Code, body)
+		}
+		ids := []string{}
+		for _, m := range reOffer.FindAllStringSubmatch(body, -1) {
+			ids = append(ids, m[1])
+		}
+		if fmt.Sprint(ids) != test.Expected {
+			t.Fatalf("sort %q: expected %s, got %v", test.Sort, test.Expected, ids)
+		}
+	}
+
+	w := env.QueryValues(url.Values{"sort": {"random"}})
+	if w.Code != 400 {
+		t.Fatalf("unknown sort should fail: %d", w.Code)
+	}
+
+	offers := []datedOffer{
+		{Id: "apec:1001", Date: "2017-01-02", Score: 0.5},
+		{Id: "apec:1002", Date: "2017-01-03", Score: 1.5},
+		{Id: "apec:1003", Date: "2017-01-04", Score: 0.5},
+	}
+	err := sortSearchResults(env.Store, env.Index, env.Deleted, offers,
+		resultsByRelevance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for _, o := range offers {
+		ids = append(ids, o.Id)
+	}
+	if fmt.Sprint(ids) != "[apec:1002 apec:1003 apec:1001]" {
+		t.Fatalf("unexpected relevance order: %v", ids)
+	}
+
+	// Reposts are sorted by their initial publication date
+	data, err := env.Store.Get("apec:1004")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = putOfferDate(env.Store, data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	js := &jstruct.JsonOffer{}
+	err = json.Unmarshal(data, js)
+	if err != nil {
+		t.Fatal(err)
+	}
+	js.Id = "1000"
+	js.Date = "2016-12-30T10:00:00.000+0000"
+	data, err = json.Marshal(js)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = putOfferDate(env.Store, data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offers = []datedOffer{}
+	for i, id := range []string{"1001", "1003", "1004", "1006"} {
+		offers = append(offers, datedOffer{
+			Id:   "apec:" + id,
+			Date: fmt.Sprintf("2017-01-0%dT10:00:00Z", i+1),
+		})
+	}
+	err = sortSearchResults(env.Store, env.Index, env.Deleted, offers,
+		resultsByAge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids = []string{}
+	for _, o := range offers {
+		ids = append(ids, o.Id)
+	}
+	if fmt.Sprint(ids) != "[apec:1006 apec:1003 apec:1001 apec:1004]" {
+		t.Fatalf("unexpected age order: %v", ids)
+	}
+
+	// Deleted versions are sorted along live offers, offers missing from the
+	// indexes come last
+	_, err = env.Store.Delete("apec:1005", time.Date(2017, 1, 8, 12, 0, 0, 0,
+		time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted, err := env.Deleted.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = syncDeletedIndex(env.Store, deleted, IndexOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	offers = []datedOffer{
+		{Id: "apec:9999", Date: "2017-01-08T10:00:00Z"},
+		{Id: "apec:1001", Date: "2017-01-02T10:00:00Z"},
+		{Id: "apec:1005/1", Date: "2017-01-06T10:00:00Z", Deleted: true},
+		{Id: "apec:1003", Date: "2017-01-04T10:00:00Z"},
+	}
+	err = sortSearchResults(env.Store, env.Index, env.Deleted, offers,
+		resultsByMinSalary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids = []string{}
+	for _, o := range offers {
+		ids = append(ids, o.Id)
+	}
+	if fmt.Sprint(ids) != "[apec:1005/1 apec:1003 apec:1001 apec:9999]" {
+		t.Fatalf("unexpected salary order: %v", ids)
+	}
+}
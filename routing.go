@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Commute time searches rely on an external routing provider computing
+// isochrones, the areas reachable from a point within a travel time. The
+// provider must implement Valhalla isochrone API and return GeoJSON polygons.
+// Isochrones are cached forever in a local database.
+
+var (
+	isochronesBucket = []byte("isochrones")
+)
+
+// Polygon is a set of rings, the first point of a ring is not repeated at
+// its end. Points are inside the polygon if they are inside an odd number of
+// rings, which handles both holes and multipolygons.
+type Polygon struct {
+	Rings [][]Point
+}
+
+func ringContains(ring []Point, lat, lon float64) bool {
+	inside := false
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		a, b := ring[i], ring[j]
+		if (a.Lat > lat) != (b.Lat > lat) &&
+			lon < (b.Lon-a.Lon)*(lat-a.Lat)/(b.Lat-a.Lat)+a.Lon {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+func (p *Polygon) Contains(lat, lon float64) bool {
+	inside := false
+	for _, ring := range p.Rings {
+		if ringContains(ring, lat, lon) {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// Bounds returns the polygon bounding box lower left and upper right corners.
+func (p *Polygon) Bounds() (Point, Point) {
+	min := Point{Lat: 90, Lon: 180}
+	max := Point{Lat: -90, Lon: -180}
+	for _, ring := range p.Rings {
+		for _, pt := range ring {
+			if pt.Lat < min.Lat {
+				min.Lat = pt.Lat
+			}
+			if pt.Lon < min.Lon {
+				min.Lon = pt.Lon
+			}
+			if pt.Lat > max.Lat {
+				max.Lat = pt.Lat
+			}
+			if pt.Lon > max.Lon {
+				max.Lon = pt.Lon
+			}
+		}
+	}
+	return min, max
+}
+
+func makeRing(coords [][2]float64) []Point {
+	ring := make([]Point, 0, len(coords))
+	for _, c := range coords {
+		ring = append(ring, Point{Lon: c[0], Lat: c[1]})
+	}
+	if len(ring) > 1 && ring[0] == ring[len(ring)-1] {
+		ring = ring[:len(ring)-1]
+	}
+	return ring
+}
+
+// parseGeoJSONPolygon builds a polygon from every Polygon and MultiPolygon
+// geometry of a GeoJSON feature collection.
+func parseGeoJSONPolygon(data []byte) (*Polygon, error) {
+	collection := struct {
+		Features []struct {
+			Geometry struct {
+				Type        string          `json:"type"`
+				Coordinates json.RawMessage `json:"coordinates"`
+			} `json:"geometry"`
+		} `json:"features"`
+	}{}
+	err := json.Unmarshal(data, &collection)
+	if err != nil {
+		return nil, err
+	}
+	poly := &Polygon{}
+	for _, f := range collection.Features {
+		polygons := [][][][2]float64{}
+		switch f.Geometry.Type {
+		case "Polygon":
+			rings := [][][2]float64{}
+			err = json.Unmarshal(f.Geometry.Coordinates, &rings)
+			polygons = append(polygons, rings)
+		case "MultiPolygon":
+			err = json.Unmarshal(f.Geometry.Coordinates, &polygons)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s coordinates: %s", f.Geometry.Type, err)
+		}
+		for _, rings := range polygons {
+			for _, coords := range rings {
+				ring := makeRing(coords)
+				if len(ring) >= 3 {
+					poly.Rings = append(poly.Rings, ring)
+				}
+			}
+		}
+	}
+	if len(poly.Rings) == 0 {
+		return nil, fmt.Errorf("no polygon found in isochrone")
+	}
+	return poly, nil
+}
+
+type Router struct {
+	url    string
+	client *http.Client
+	db     *bolt.DB
+}
+
+// NewRouter opens the isochrone cache at path. baseURL is the routing
+// provider endpoint, when empty only cached isochrones are available.
+func NewRouter(baseURL, path string) (*Router, error) {
+	db, err := bolt.Open(path, 0666, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(isochronesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Router{
+		url: strings.TrimRight(baseURL, "/"),
+		client: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+		db: db,
+	}, nil
+}
+
+func (r *Router) Close() error {
+	return r.db.Close()
+}
+
+// isochroneKey rounds coordinates to about 100m so close queries share
+// cached isochrones.
+func isochroneKey(lat, lon float64, minutes int) string {
+	return fmt.Sprintf("%.3f,%.3f,%d", lat, lon, minutes)
+}
+
+func (r *Router) getCachedIsochrone(key string) (*Polygon, error) {
+	var poly *Polygon
+	err := r.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(isochronesBucket).Get([]byte(key))
+		if data == nil {
+			return nil
+		}
+		poly = &Polygon{}
+		return json.Unmarshal(data, poly)
+	})
+	return poly, err
+}
+
+func (r *Router) putCachedIsochrone(key string, poly *Polygon) error {
+	data, err := json.Marshal(poly)
+	if err != nil {
+		return err
+	}
+	return r.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(isochronesBucket).Put([]byte(key), data)
+	})
+}
+
+func (r *Router) rawIsochrone(lat, lon float64, minutes int) ([]byte, error) {
+	if r.url == "" {
+		return nil, fmt.Errorf("no routing provider configured, set APEC_ROUTING_URL")
+	}
+	query := map[string]interface{}{
+		"locations": []map[string]float64{
+			{"lat": lat, "lon": lon},
+		},
+		"costing": "auto",
+		"contours": []map[string]int{
+			{"time": minutes},
+		},
+		"polygons": true,
+	}
+	js, err := json.Marshal(query)
+	if err != nil {
+		return nil, err
+	}
+	u := r.url + "/isochrone?json=" + url.QueryEscape(string(js))
+	rsp, err := r.client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	data, err := ioutil.ReadAll(&io.LimitedReader{
+		R: rsp.Body,
+		N: 16 * 1024 * 1024,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if rsp.StatusCode != 200 {
+		return nil, fmt.Errorf("isochrone request failed with %d: %s",
+			rsp.StatusCode, string(data))
+	}
+	return data, nil
+}
+
+// Isochrone returns the area reachable by car from lat/lon within minutes.
+func (r *Router) Isochrone(lat, lon float64, minutes int) (*Polygon, error) {
+	key := isochroneKey(lat, lon, minutes)
+	poly, err := r.getCachedIsochrone(key)
+	if err != nil || poly != nil {
+		return poly, err
+	}
+	data, err := r.rawIsochrone(lat, lon, minutes)
+	if err != nil {
+		return nil, err
+	}
+	poly, err = parseGeoJSONPolygon(data)
+	if err != nil {
+		return nil, err
+	}
+	err = r.putCachedIsochrone(key, poly)
+	return poly, err
+}
+
+// parseTravelTime parses travel times like "45", "45min", "1h30m" into
+// minutes.
+func parseTravelTime(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasSuffix(s, "min") {
+		s = s[:len(s)-len("min")] + "m"
+	}
+	if _, err := strconv.Atoi(s); err == nil {
+		s += "m"
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid travel time: %s", s)
+	}
+	if d < time.Minute || d%time.Minute != 0 {
+		return 0, fmt.Errorf("travel time must be a positive number of minutes: %s", s)
+	}
+	return int(d / time.Minute), nil
+}
+
+// parseIsochroneQuery parses "lat,lon,time" isochrone queries.
+func parseIsochroneQuery(query string) (float64, float64, int, error) {
+	parts := strings.Split(query, ",")
+	if len(parts) != 3 {
+		return 0, 0, 0, fmt.Errorf("invalid isochrone: %s", query)
+	}
+	lat, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	lon, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	minutes, err := parseTravelTime(parts[2])
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return lat, lon, minutes, nil
+}
+
+var (
+	isochroneCmd = app.Command("isochrone", `compute and cache isochrones
+
+Fetch the areas reachable within travel times from the routing provider
+configured by APEC_ROUTING_URL and cache them, so later isochrone searches do
+not wait for the provider.
+`)
+	isochroneQueries = isochroneCmd.Arg("isochrones", "lat,lon,time isochrones like "+
+		"48.85,2.35,45min").Required().Strings()
+)
+
+func isochroneFn(cfg *Config) error {
+	store, err := OpenStore(cfg.Store())
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	geocoder, err := openGeocoder(cfg)
+	if err != nil {
+		return err
+	}
+	defer geocoder.Close()
+	router, err := NewRouter(cfg.RoutingURL(), cfg.Routing())
+	if err != nil {
+		return err
+	}
+	defer router.Close()
+	spatial, err := buildSpatialIndex(store, geocoder)
+	if err != nil {
+		return err
+	}
+	for _, q := range *isochroneQueries {
+		lat, lon, minutes, err := parseIsochroneQuery(q)
+		if err != nil {
+			return err
+		}
+		poly, err := router.Isochrone(lat, lon, minutes)
+		if err != nil {
+			return fmt.Errorf("could not compute %s isochrone: %s", q, err)
+		}
+		offers, err := spatial.FindInPolygon(poly)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: %d rings, %d offers\n", q, len(poly.Rings), len(offers))
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseTravelTime(t *testing.T) {
+	tests := []struct {
+		Input   string
+		Minutes int
+	}{
+		{"45", 45},
+		{"45min", 45},
+		{"45m", 45},
+		{" 1h30m", 90},
+		{"0", -1},
+		{"30s", -1},
+		{"-10min", -1},
+		{"soon", -1},
+	}
+	for _, test := range tests {
+		minutes, err := parseTravelTime(test.Input)
+		if test.Minutes < 0 {
+			if err == nil {
+				t.Fatalf("%q: error expected, got %d", test.Input, minutes)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %s", test.Input, err)
+		}
+		if minutes != test.Minutes {
+			t.Fatalf("%q: expected %d minutes, got %d", test.Input, test.Minutes,
+				minutes)
+		}
+	}
+}
+
+func TestPolygonContains(t *testing.T) {
+	// A square with a square hole, and a disjoint triangle
+	poly, err := parseGeoJSONPolygon([]byte(`{"features": [
+		{"geometry": {"type": "Polygon", "coordinates": [
+			[[0, 0], [10, 0], [10, 10], [0, 10], [0, 0]],
+			[[4, 4], [6, 4], [6, 6], [4, 6], [4, 4]]]}},
+		{"geometry": {"type": "LineString", "coordinates": [[0, 0], [1, 1]]}},
+		{"geometry": {"type": "MultiPolygon", "coordinates": [
+			[[[20, 0], [30, 0], [20, 10]]]]}}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(poly.Rings) != 3 {
+		t.Fatalf("unexpected rings: %+v", poly.Rings)
+	}
+	tests := []struct {
+		Lon    float64
+		Lat    float64
+		Inside bool
+	}{
+		{1, 1, true},
+		{5, 5, false},
+		{9, 5, true},
+		{15, 5, false},
+		{21, 1, true},
+		{29, 9, false},
+		{-1, 5, false},
+	}
+	for _, test := range tests {
+		inside := poly.Contains(test.Lat, test.Lon)
+		if inside != test.Inside {
+			t.Fatalf("%v,%v: expected inside=%v", test.Lon, test.Lat, test.Inside)
+		}
+	}
+	min, max := poly.Bounds()
+	if min != (Point{Lon: 0, Lat: 0}) || max != (Point{Lon: 30, Lat: 10}) {
+		t.Fatalf("unexpected bounds: %+v %+v", min, max)
+	}
+
+	_, err = parseGeoJSONPolygon([]byte(`{"features": []}`))
+	if err == nil {
+		t.Fatalf("empty isochrone succeeded")
+	}
+}
+
+// newIsochroneServer returns a routing provider returning a small square
+// around Paris, and a pointer to its request counter.
+func newIsochroneServer(t *testing.T) (*httptest.Server, *int) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			if r.URL.Path != "/isochrone" ||
+				!strings.Contains(r.FormValue("json"), `"time":45`) {
+				t.Errorf("unexpected isochrone request: %s", r.URL)
+			}
+			w.Write([]byte(`{"type": "FeatureCollection", "features": [
+				{"type": "Feature", "geometry": {"type": "Polygon", "coordinates": [
+					[[2.3, 48.8], [2.4, 48.8], [2.4, 48.9], [2.3, 48.9], [2.3, 48.8]]
+				]}}]}`))
+		}))
+	return server, &calls
+}
+
+func TestRouterIsochroneCache(t *testing.T) {
+	server, calls := newIsochroneServer(t)
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "apec-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "routing")
+	router, err := NewRouter(server.URL+"/", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		poly, err := router.Isochrone(48.8565056, 2.3521334, 45)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !poly.Contains(48.85, 2.35) || poly.Contains(45.75, 4.83) {
+			t.Fatalf("unexpected isochrone: %+v", poly)
+		}
+	}
+	if *calls != 1 {
+		t.Fatalf("isochrone was fetched %d times", *calls)
+	}
+	router.Close()
+
+	// Cached isochrones remain available without a provider
+	router, err = NewRouter("", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.Close()
+	_, err = router.Isochrone(48.8571, 2.3519, 45)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = router.Isochrone(48.8571, 2.3519, 30)
+	if err == nil {
+		t.Fatalf("uncached isochrone succeeded without provider")
+	}
+}
+
+func TestHandleQueryIsochrone(t *testing.T) {
+	server, _ := newIsochroneServer(t)
+	defer server.Close()
+	env := newTestEnv(t)
+	defer env.Close()
+	env.Router.url = server.URL
+
+	values := url.Values{}
+	values.Set("where", "isochrone:48.8565,2.3521,45min")
+	w := env.QueryValues(values)
+	body := w.Body.String()
+	if w.Code != 200 {
+		t.Fatalf("isochrone query failed with %d: %s", w.Code, body)
+	}
+	if !strings.Contains(body, "2/2 offers") {
+		t.Fatalf("unexpected isochrone results:\n%s", body)
+	}
+	for _, id := range []string{"1001", "1002"} {
+		if !strings.Contains(body, ApecURL+id+`"`) {
+			t.Fatalf("%s not found in:\n%s", id, body)
+		}
+	}
+
+	values.Set("where", "isochrone:48.8565,2.3521")
+	w = env.QueryValues(values)
+	if w.Code != 400 {
+		t.Fatalf("invalid isochrone query succeeded: %d", w.Code)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pmezard/apec/jstruct"
+)
+
+// Accounts salary histories list the salary ranges advertised by an account
+// over time, from live and deleted offers. Reposted offers share their
+// content hash and appear once, from their initial publication date until
+// their last deletion.
+
+const salaryHistorySuffix = "/salary-history"
+
+// SalaryRange is the salary range advertised by reposts of an offer.
+type SalaryRange struct {
+	Id    string `json:"id"`
+	Title string `json:"title"`
+	// Initial publication and last deletion dates, YYYY-MM-DD. Live offers
+	// have no end date.
+	Start   string `json:"start"`
+	End     string `json:"end,omitempty"`
+	Reposts int    `json:"reposts"`
+	Min     int    `json:"min_salary"`
+	Max     int    `json:"max_salary"`
+}
+
+type sortedSalaryRanges []*SalaryRange
+
+func (s sortedSalaryRanges) Len() int {
+	return len(s)
+}
+
+func (s sortedSalaryRanges) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s sortedSalaryRanges) Less(i, j int) bool {
+	if s[i].Start != s[j].Start {
+		return s[i].Start < s[j].Start
+	}
+	return s[i].Id < s[j].Id
+}
+
+// SalaryMonth summarizes the salary ranges published during a month.
+// Median is the median of ranges middles.
+type SalaryMonth struct {
+	Month  string `json:"month"`
+	Offers int    `json:"offers"`
+	Min    int    `json:"min_salary"`
+	Median int    `json:"median_salary"`
+	Max    int    `json:"max_salary"`
+}
+
+type SalaryHistory struct {
+	Account string `json:"account"`
+	// Distinct offers, with or without salary
+	Offers int            `json:"offers"`
+	Ranges []*SalaryRange `json:"ranges"`
+	Months []*SalaryMonth `json:"months"`
+}
+
+// offerDatesRange returns the earliest initial date of ages and their latest
+// deletion date, or a zero time if one of them is still live.
+func offerDatesRange(ages []OfferAge) (time.Time, time.Time) {
+	start, end := time.Time{}, time.Time{}
+	for _, age := range ages {
+		date := age.InitialDate
+		if date.IsZero() {
+			date = age.PublicationDate
+		}
+		if start.IsZero() || date.Before(start) {
+			start = date
+		}
+	}
+	for _, age := range ages {
+		if age.DeletionDate.IsZero() {
+			return start, time.Time{}
+		}
+		if age.DeletionDate.After(end) {
+			end = age.DeletionDate
+		}
+	}
+	return start, end
+}
+
+// summarizeSalaryMonths groups sorted ranges by publication month.
+func summarizeSalaryMonths(ranges []*SalaryRange) []*SalaryMonth {
+	months := []*SalaryMonth{}
+	middles := []int{}
+	for i, r := range ranges {
+		month := r.Start[:7]
+		if i == 0 || months[len(months)-1].Month != month {
+			middles = middles[:0]
+			months = append(months, &SalaryMonth{
+				Month: month,
+				Min:   r.Min,
+				Max:   r.Max,
+			})
+		}
+		m := months[len(months)-1]
+		m.Offers++
+		if r.Min < m.Min {
+			m.Min = r.Min
+		}
+		if r.Max > m.Max {
+			m.Max = r.Max
+		}
+		middles = append(middles, (r.Min+r.Max)/2)
+		m.Median = medianInt(middles)
+	}
+	return months
+}
+
+// collectSalaryHistory returns the salary history of account, compared
+// case-insensitively with offers accounts.
+func collectSalaryHistory(store *Store, account string) (*SalaryHistory,
+	error) {
+
+	account = strings.TrimSpace(account)
+	offers := map[string]*jstruct.JsonOffer{}
+	err := enumerateStoredOffers(store, func(offer *jstruct.JsonOffer,
+		do *DeletedOffer) error {
+		if !strings.EqualFold(strings.TrimSpace(offer.Account), account) {
+			return nil
+		}
+		hash := hashOffer(offer)
+		if offers[hash] == nil || do == nil {
+			offers[hash] = offer
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	history := &SalaryHistory{
+		Account: account,
+		Offers:  len(offers),
+		Ranges:  []*SalaryRange{},
+	}
+	for hash, js := range offers {
+		offer, err := convertOffer(js)
+		if err != nil {
+			return nil, err
+		}
+		history.Account = offer.Account
+		if offer.MinSalary <= 0 {
+			continue
+		}
+		ages, err := store.GetOfferDates(hash)
+		if err != nil {
+			return nil, err
+		}
+		start, end := offerDatesRange(ages)
+		if start.IsZero() {
+			start = offer.Date
+		}
+		r := &SalaryRange{
+			Id:    offer.Id,
+			Title: offer.Title,
+			Start: start.Format("2006-01-02"),
+			Min:   offer.MinSalary,
+			Max:   offer.MaxSalary,
+		}
+		if !end.IsZero() {
+			r.End = end.Format("2006-01-02")
+		}
+		if len(ages) > 1 {
+			r.Reposts = len(ages) - 1
+		}
+		history.Ranges = append(history.Ranges, r)
+	}
+	sort.Sort(sortedSalaryRanges(history.Ranges))
+	history.Months = summarizeSalaryMonths(history.Ranges)
+	return history, nil
+}
+
+// handleSalaryHistory writes the salary history of the account named by
+// the path element preceding "salary-history" as JSON.
+func handleSalaryHistory(store *Store, prefix string, w http.ResponseWriter,
+	r *http.Request) error {
+
+	path := strings.TrimPrefix(r.URL.Path, prefix)
+	if !strings.HasSuffix(path, salaryHistorySuffix) {
+		return fmt.Errorf("unknown account resource: %q", path)
+	}
+	account := strings.TrimSuffix(path, salaryHistorySuffix)
+	if strings.TrimSpace(account) == "" {
+		return fmt.Errorf("account name is missing")
+	}
+	history, err := collectSalaryHistory(store, account)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(history)
+}
+
+// handleAccount renders the page of the account in the "name" parameter.
+func handleAccount(templ *Templates, w http.ResponseWriter,
+	r *http.Request) error {
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		return fmt.Errorf("account name is missing")
+	}
+	data := struct {
+		Name    string
+		History string
+	}{
+		Name:    name,
+		History: "api/accounts/" + url.PathEscape(name) + salaryHistorySuffix,
+	}
+	w.Header().Set("Content-Type", "text/html")
+	return templ.Account.Execute(w, &data)
+}
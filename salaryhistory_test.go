@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSalaryHistory(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	cet := time.FixedZone("CET", 3600)
+	js, err := getStoreJsonOffer(env.Store, "apec:1002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A deleted earlier version of the Python offer, and a deleted offer
+	// advertising a lower salary.
+	versions := []struct {
+		Id      string
+		Date    string
+		Salary  string
+		Deleted time.Time
+	}{
+		{"1007", "2016-12-20T10:00:00.000+0000", js.Salary,
+			time.Date(2016, 12, 25, 12, 0, 0, 0, cet)},
+		{"1009", "2016-11-10T10:00:00.000+0000", "35 k€ brut annuel",
+			time.Date(2016, 11, 30, 12, 0, 0, 0, cet)},
+	}
+	for _, v := range versions {
+		offer := *js
+		offer.Id = v.Id
+		offer.Date = v.Date
+		offer.Salary = v.Salary
+		data, err := json.Marshal(&offer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = env.Store.Put("apec:"+v.Id, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = env.Store.Delete("apec:"+v.Id, v.Deleted)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = rebuildInitialDates(env.Store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	history, err := collectSalaryHistory(env.Store, " initech")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ranges := []string{}
+	for _, r := range history.Ranges {
+		ranges = append(ranges, fmt.Sprintf("%s:%s:%s:%d:%d-%d", r.Id, r.Start,
+			r.End, r.Reposts, r.Min, r.Max))
+	}
+	if history.Account != "Initech" || history.Offers != 3 ||
+		strings.Join(ranges, " ") != "apec:1009:2016-11-10:2016-11-30:0:35-35 "+
+			"apec:1002:2016-12-20::1:40-40 apec:1006:2017-01-07::0:50-50" {
+		t.Fatalf("unexpected history: %s %d %v", history.Account, history.Offers,
+			ranges)
+	}
+	months := []string{}
+	for _, m := range history.Months {
+		months = append(months, fmt.Sprintf("%s:%d:%d-%d-%d", m.Month, m.Offers,
+			m.Min, m.Median, m.Max))
+	}
+	if strings.Join(months, " ") != "2016-11:1:35-35-35 2016-12:1:40-40-40 "+
+		"2017-01:1:50-50-50" {
+		t.Fatalf("unexpected months: %v", months)
+	}
+
+	rsp := env.Get(func(w http.ResponseWriter, r *http.Request) {
+		err := handleSalaryHistory(env.Store, "/apec/api/accounts/", w, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}, "/apec/api/accounts/Globex/salary-history", nil)
+	history = &SalaryHistory{}
+	err = json.Unmarshal(rsp.Body.Bytes(), history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if history.Account != "Globex" || len(history.Ranges) != 1 ||
+		history.Ranges[0].Min != 50 || history.Ranges[0].Max != 60 {
+		t.Fatalf("unexpected history:\n%s", rsp.Body.String())
+	}
+	env.Get(func(w http.ResponseWriter, r *http.Request) {
+		err := handleSalaryHistory(env.Store, "/apec/api/accounts/", w, r)
+		if err == nil {
+			t.Fatalf("unknown resource was accepted")
+		}
+	}, "/apec/api/accounts/Globex", nil)
+
+	rsp = env.Get(func(w http.ResponseWriter, r *http.Request) {
+		err := handleAccount(env.Templates, w, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}, "/apec/account", url.Values{"name": {"Initech SA/FR"}})
+	if !strings.Contains(rsp.Body.String(),
+		`"api/accounts/Initech%20SA%2FFR/salary-history"`) {
+		t.Fatalf("salary history is missing:\n%s", rsp.Body.String())
+	}
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pmezard/apec/jstruct"
+)
+
+// Offer fields are identified by dotted paths, array elements are suffixed
+// with "[]", like "lieux[].libelleLieu". Field kinds are JSON kinds: object,
+// array, string, number, bool or null.
+
+func collectJsonPaths(prefix string, value interface{}, paths map[string]string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if prefix != "" {
+			paths[prefix] = "object"
+			prefix += "."
+		}
+		for k, child := range v {
+			collectJsonPaths(prefix+k, child, paths)
+		}
+	case []interface{}:
+		paths[prefix] = "array"
+		for _, child := range v {
+			collectJsonPaths(prefix+"[]", child, paths)
+		}
+	case string:
+		paths[prefix] = "string"
+	case float64:
+		paths[prefix] = "number"
+	case bool:
+		paths[prefix] = "bool"
+	case nil:
+		if _, ok := paths[prefix]; !ok {
+			paths[prefix] = "null"
+		}
+	}
+}
+
+// offerFieldPaths returns the field paths and kinds of a JSON offer.
+func offerFieldPaths(data []byte) (map[string]string, error) {
+	var doc interface{}
+	err := json.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := doc.(map[string]interface{}); !ok {
+		return nil, fmt.Errorf("offer is not a JSON object")
+	}
+	paths := map[string]string{}
+	collectJsonPaths("", doc, paths)
+	return paths, nil
+}
+
+func collectStructPaths(prefix string, t reflect.Type, paths map[string]string) {
+	switch t.Kind() {
+	case reflect.Struct:
+		if prefix != "" {
+			paths[prefix] = "object"
+			prefix += "."
+		}
+		for i := 0; i < t.NumField(); i++ {
+			name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+			if name == "" || name == "-" {
+				continue
+			}
+			collectStructPaths(prefix+name, t.Field(i).Type, paths)
+		}
+	case reflect.Slice, reflect.Array:
+		paths[prefix] = "array"
+		collectStructPaths(prefix+"[]", t.Elem(), paths)
+	case reflect.Ptr:
+		collectStructPaths(prefix, t.Elem(), paths)
+	case reflect.String:
+		paths[prefix] = "string"
+	case reflect.Bool:
+		paths[prefix] = "bool"
+	case reflect.Int, reflect.Int64, reflect.Float64:
+		paths[prefix] = "number"
+	}
+}
+
+var (
+	knownOfferFields = func() map[string]string {
+		paths := map[string]string{}
+		collectStructPaths("", reflect.TypeOf(jstruct.JsonOffer{}), paths)
+		return paths
+	}()
+	requiredOfferFields = []string{"numeroOffre", "intitule", "datePublication"}
+)
+
+// SchemaCheck is the result of validating an offer against jstruct schema.
+type SchemaCheck struct {
+	// Unknown fields paths, only the outermost unknown path is reported.
+	Unknown []string
+	// Errors lists missing required fields or kind mismatches.
+	Errors []string
+}
+
+func isUnknownField(path string) bool {
+	if _, ok := knownOfferFields[path]; ok {
+		return false
+	}
+	for i := len(path) - 1; i > 0; i-- {
+		if path[i] != '.' && path[i] != '[' {
+			continue
+		}
+		if _, ok := knownOfferFields[path[:i]]; !ok {
+			// The parent is unknown as well
+			return false
+		}
+		break
+	}
+	return true
+}
+
+// checkOfferSchema validates a fetched offer against jstruct.JsonOffer
+// definition. It only fails if the offer cannot be decoded at all.
+func checkOfferSchema(id string, data []byte) (*SchemaCheck, error) {
+	paths, err := offerFieldPaths(data)
+	if err != nil {
+		return nil, err
+	}
+	check := &SchemaCheck{}
+	for path, kind := range paths {
+		expected, ok := knownOfferFields[path]
+		if !ok {
+			if isUnknownField(path) {
+				check.Unknown = append(check.Unknown, path)
+			}
+			continue
+		}
+		if kind != expected && kind != "null" {
+			check.Errors = append(check.Errors, fmt.Sprintf(
+				"%s: expected %s, got %s", path, expected, kind))
+		}
+	}
+	for _, path := range requiredOfferFields {
+		if _, ok := paths[path]; !ok {
+			check.Errors = append(check.Errors, fmt.Sprintf("%s: missing", path))
+		}
+	}
+	if len(check.Errors) == 0 {
+		js := &jstruct.JsonOffer{}
+		err = json.Unmarshal(data, js)
+		if err != nil {
+			check.Errors = append(check.Errors, err.Error())
+		} else {
+			if _, apecId := splitOfferId(id); js.Id != apecId {
+				check.Errors = append(check.Errors, fmt.Sprintf(
+					"numeroOffre: expected %s, got %s", apecId, js.Id))
+			}
+			_, err = time.Parse(offerDateLayout, js.Date)
+			if err != nil {
+				check.Errors = append(check.Errors, fmt.Sprintf(
+					"datePublication: %s", err))
+			}
+		}
+	}
+	sort.Strings(check.Unknown)
+	sort.Strings(check.Errors)
+	return check, nil
+}
+
+// checkCrawledOffer checks a fetched offer and returns its unknown fields, to
+// be recorded in the store. Validation failures are reported but not fatal,
+// the raw offer is stored anyway.
+func checkCrawledOffer(id string, data []byte) []string {
+	check, err := checkOfferSchema(id, data)
+	if err != nil {
+		fmt.Printf("schema: %s: %s\n", id, err)
+		return nil
+	}
+	for _, e := range check.Errors {
+		fmt.Printf("schema: %s: %s\n", id, e)
+	}
+	for _, path := range check.Unknown {
+		fmt.Printf("schema: %s: unknown field %s\n", id, path)
+	}
+	return check.Unknown
+}
+
+type fieldUsage struct {
+	Path   string
+	Kinds  map[string]int
+	Count  int
+	First  time.Time
+	Last   time.Time
+	Mapped bool
+}
+
+func (u *fieldUsage) KindsString() string {
+	kinds := []string{}
+	for k := range u.Kinds {
+		kinds = append(kinds, k)
+	}
+	sort.Strings(kinds)
+	return strings.Join(kinds, ",")
+}
+
+type sortedFieldUsages []*fieldUsage
+
+func (s sortedFieldUsages) Len() int {
+	return len(s)
+}
+
+func (s sortedFieldUsages) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s sortedFieldUsages) Less(i, j int) bool {
+	return s[i].Path < s[j].Path
+}
+
+// collectFieldUsages returns the usage of every field path in stored offers,
+// including deleted ones, along with the publication dates range.
+func collectFieldUsages(store *Store) ([]*fieldUsage, time.Time, time.Time, error) {
+	var minDate, maxDate time.Time
+	usages := map[string]*fieldUsage{}
+	for path := range knownOfferFields {
+		usages[path] = &fieldUsage{
+			Path:   path,
+			Kinds:  map[string]int{},
+			Mapped: true,
+		}
+	}
+	err := enumerateOffersBytes(store, false, func(key string, data []byte,
+		deleted *DeletedOffer) error {
+
+		js := &jstruct.JsonOffer{}
+		err := json.Unmarshal(data, js)
+		if err != nil {
+			return fmt.Errorf("cannot decode %s: %s", key, err)
+		}
+		date, err := time.Parse(offerDateLayout, js.Date)
+		if err != nil {
+			return fmt.Errorf("cannot parse %s publication date: %s", key, err)
+		}
+		if minDate.IsZero() || date.Before(minDate) {
+			minDate = date
+		}
+		if date.After(maxDate) {
+			maxDate = date
+		}
+		paths, err := offerFieldPaths(data)
+		if err != nil {
+			return fmt.Errorf("cannot decode %s: %s", key, err)
+		}
+		for path, kind := range paths {
+			u := usages[path]
+			if u == nil {
+				u = &fieldUsage{
+					Path:  path,
+					Kinds: map[string]int{},
+				}
+				usages[path] = u
+			}
+			u.Kinds[kind]++
+			u.Count++
+			if u.First.IsZero() || date.Before(u.First) {
+				u.First = date
+			}
+			if date.After(u.Last) {
+				u.Last = date
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, minDate, maxDate, err
+	}
+	result := []*fieldUsage{}
+	for _, u := range usages {
+		result = append(result, u)
+	}
+	sort.Sort(sortedFieldUsages(result))
+	return result, minDate, maxDate, nil
+}
+
+var (
+	schemaCmd       = app.Command("schema", "inspect stored offers JSON schema")
+	schemaReportCmd = schemaCmd.Command("report", `summarize offer fields across the corpus
+
+Every field path found in live and deleted offers is listed with the range of
+publication dates it was seen in. Fields first seen in the last --window days
+of the corpus are reported as new, fields not seen during this period as
+disappeared. Unmapped fields are not decoded by jstruct. Fields recorded as
+unknown while crawling are listed last.
+`)
+	schemaReportWindow = schemaReportCmd.Flag("window",
+		"period in days used to detect new and disappeared fields").
+		Default("30").Int()
+	schemaReportAll = schemaReportCmd.Flag("all", "list all fields").Bool()
+)
+
+func printFieldUsages(title string, usages []*fieldUsage) {
+	fmt.Printf("%s (%d):\n", title, len(usages))
+	for _, u := range usages {
+		mapped := "unmapped"
+		if u.Mapped {
+			mapped = "mapped"
+		}
+		if u.Count == 0 {
+			fmt.Printf("  %-40s %8d %-8s never seen\n", u.Path, 0, mapped)
+			continue
+		}
+		fmt.Printf("  %-40s %8d %-8s %s -> %s %s\n", u.Path, u.Count, mapped,
+			u.First.Format("2006-01-02"), u.Last.Format("2006-01-02"),
+			u.KindsString())
+	}
+}
+
+func schemaReportFn(cfg *Config) error {
+	store, err := OpenStore(cfg.Store())
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	usages, minDate, maxDate, err := collectFieldUsages(store)
+	if err != nil {
+		return err
+	}
+	recorded, err := store.ListSchemaFields()
+	if err != nil {
+		return err
+	}
+	if minDate.IsZero() {
+		fmt.Println("no offer found")
+		return nil
+	}
+	fmt.Printf("offers published from %s to %s\n\n", minDate.Format("2006-01-02"),
+		maxDate.Format("2006-01-02"))
+
+	recent := maxDate.Add(-time.Duration(*schemaReportWindow) * 24 * time.Hour)
+	added := []*fieldUsage{}
+	disappeared := []*fieldUsage{}
+	unmapped := []*fieldUsage{}
+	for _, u := range usages {
+		if u.Count > 0 && u.First.After(recent) && u.First.After(minDate) {
+			added = append(added, u)
+		}
+		if u.Count == 0 || u.Last.Before(recent) {
+			disappeared = append(disappeared, u)
+		}
+		if !u.Mapped && isUnknownField(u.Path) {
+			unmapped = append(unmapped, u)
+		}
+	}
+	printFieldUsages("new fields", added)
+	fmt.Println()
+	printFieldUsages("disappeared fields", disappeared)
+	fmt.Println()
+	printFieldUsages("unmapped fields", unmapped)
+	if *schemaReportAll {
+		fmt.Println()
+		printFieldUsages("all fields", usages)
+	}
+	fmt.Printf("\nunknown fields recorded while crawling (%d):\n", len(recorded))
+	for _, f := range recorded {
+		fmt.Printf("  %-40s %8d %s -> %s (%s, %s)\n", f.Path, f.Count,
+			f.FirstSeen.Format("2006-01-02"), f.LastSeen.Format("2006-01-02"),
+			f.FirstId, f.LastId)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCheckOfferSchema(t *testing.T) {
+	tests := []struct {
+		Data    string
+		Unknown []string
+		Errors  []string
+	}{
+		{
+			`{"numeroOffre":"1","intitule":"t","datePublication":"2017-01-01T10:00:00.000+0000",
+			"lieux":[{"libelleLieu":"Paris"}]}`,
+			[]string{},
+			[]string{},
+		},
+		{
+			`{"numeroOffre":"1","intitule":"t","datePublication":"2017-01-01T10:00:00.000+0000",
+			"lieux":[{"libelleLieu":"Paris","code":{"a":1}}],"teletravail":{"jours":2}}`,
+			[]string{"lieux[].code", "teletravail"},
+			[]string{},
+		},
+		{
+			`{"numeroOffre":"1","intitule":null,"tempsPartiel":"non"}`,
+			[]string{},
+			[]string{
+				"datePublication: missing",
+				"tempsPartiel: expected bool, got string",
+			},
+		},
+		{
+			`{"numeroOffre":"2","intitule":"t","datePublication":"2017-01-01T10:00:00.000+0000"}`,
+			[]string{},
+			[]string{"numeroOffre: expected 1, got 2"},
+		},
+	}
+	for _, test := range tests {
+		check, err := checkOfferSchema("1", []byte(test.Data))
+		if err != nil {
+			t.Fatalf("could not check %s: %s", test.Data, err)
+		}
+		unknown := append([]string{}, check.Unknown...)
+		errors := append([]string{}, check.Errors...)
+		if fmt.Sprint(unknown) != fmt.Sprint(test.Unknown) {
+			t.Fatalf("unexpected unknown fields: %v != %v", unknown, test.Unknown)
+		}
+		if fmt.Sprint(errors) != fmt.Sprint(test.Errors) {
+			t.Fatalf("unexpected errors: %v != %v", errors, test.Errors)
+		}
+	}
+}
@@ -0,0 +1,621 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/pmezard/apec/jstruct"
+)
+
+var (
+	scrubCmd = app.Command("scrub", `remove or redact offers for retention purposes
+
+Selected offers are removed from every location they can be found: live and
+deleted versions, cached locations, initial dates, full text and deleted
+offers indexes, geocoder cache entries which are not used by remaining
+offers, store snapshots and the WARC files of --warc. With --redact, offers
+are kept but their account, title, text and salary are erased.
+
+The full text index is locked by the web process, stop it before scrubbing.
+`)
+	scrubAccount = scrubCmd.Flag("account", "select offers published by this account").
+			String()
+	scrubBefore = scrubCmd.Flag("before",
+		"select offers last published before this date (YYYY-MM-DD)").String()
+	scrubIds    = scrubCmd.Flag("id", "select offer by identifier").Strings()
+	scrubRedact = scrubCmd.Flag("redact", "redact offers instead of removing them").Bool()
+	scrubDryRun = scrubCmd.Flag("dry-run", "only report what would be scrubbed").Bool()
+	scrubWARC   = scrubCmd.Flag("warc",
+		"also scrub the WARC files recorded by crawl --warc in this directory").
+		String()
+)
+
+type scrubbedOffer struct {
+	Id        string
+	Account   string
+	Published time.Time
+	Locations []string
+}
+
+type sortedScrubbedOffers []*scrubbedOffer
+
+func (s sortedScrubbedOffers) Len() int {
+	return len(s)
+}
+
+func (s sortedScrubbedOffers) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s sortedScrubbedOffers) Less(i, j int) bool {
+	return s[i].Id < s[j].Id
+}
+
+const (
+	redactedText = "[redacted]"
+)
+
+// redactOffer erases the account, title, text and salary of offer data.
+// Titles keep the offer number, so redacted offers are not mistaken for
+// reposts of each other by their content hash.
+func redactOffer(data []byte) ([]byte, error) {
+	doc := map[string]interface{}{}
+	err := json.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, err
+	}
+	for _, field := range []string{"nomCompteEtablissement", "intitule",
+		"texteHtml", "salaireTexte"} {
+		if _, ok := doc[field]; ok {
+			doc[field] = redactedText
+		}
+	}
+	if _, ok := doc["intitule"]; ok {
+		doc["intitule"] = fmt.Sprintf("%s %v", redactedText, doc["numeroOffre"])
+	}
+	return json.Marshal(&doc)
+}
+
+// redactStoredOffer redacts the live and deleted versions of offer id,
+// moves them to the offer dates chains of their new content and reindexes
+// the live version in index, and deleted ones in deleted if not nil. It
+// returns the number of redacted versions.
+func redactStoredOffer(store *Store, index, deleted bleve.Index,
+	options IndexOptions, id string) (int, error) {
+
+	n, err := store.RewriteOffer(id, redactOffer)
+	if err != nil {
+		return 0, err
+	}
+	_, err = store.RefreshOfferDates(id)
+	if err != nil {
+		return 0, err
+	}
+	offer, err := getStoreOffer(store, id)
+	if err != nil {
+		return 0, err
+	}
+	if offer != nil {
+		err = index.Index(offer.Id, offer)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if deleted != nil {
+		err = syncDeletedOffer(store, deleted, options, id)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// purgeStoredOffer purges offer id from store, its live version from index
+// and its deleted versions from deleted if not nil.
+func purgeStoredOffer(store *Store, index, deleted bleve.Index,
+	options IndexOptions, id string) (*PurgeReport, error) {
+
+	report, err := store.Purge(id)
+	if err != nil {
+		return nil, err
+	}
+	err = index.Delete(id)
+	if err != nil {
+		return nil, err
+	}
+	if deleted != nil {
+		// Purged versions are no longer listed and get unindexed
+		err = syncDeletedOffer(store, deleted, options, id)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// makeScrubSelector returns a predicate matching offers published by
+// account, last published before before and listed in ids. Empty criteria
+// match every offer.
+func makeScrubSelector(account string, before time.Time,
+	ids []string) func(o *scrubbedOffer) bool {
+
+	selectedIds := map[string]bool{}
+	for _, id := range normalizeOfferIds(ids) {
+		selectedIds[id] = true
+	}
+	return func(o *scrubbedOffer) bool {
+		if len(selectedIds) > 0 && !selectedIds[o.Id] {
+			return false
+		}
+		if account != "" && !strings.EqualFold(o.Account, account) {
+			return false
+		}
+		if !before.IsZero() && !o.Published.Before(before) {
+			return false
+		}
+		return true
+	}
+}
+
+// listScrubbedOffers groups stored offer versions by identifier, and splits
+// them between selected ones and others.
+func listScrubbedOffers(store *Store, selected func(o *scrubbedOffer) bool) (
+	[]*scrubbedOffer, []*scrubbedOffer, error) {
+
+	offers := map[string]*scrubbedOffer{}
+	err := enumerateStoredOffers(store, func(js *jstruct.JsonOffer,
+		do *DeletedOffer) error {
+
+		published, err := time.Parse(offerDateLayout, js.Date)
+		if err != nil {
+			return fmt.Errorf("cannot parse %s publication date: %s", js.Id, err)
+		}
+		id := makeOfferId(apecSource, js.Id)
+		o := offers[id]
+		if o == nil {
+			o = &scrubbedOffer{
+				Id: id,
+			}
+			offers[id] = o
+		}
+		if published.After(o.Published) {
+			o.Published = published
+			o.Account = js.Account
+		}
+		o.Locations = append(o.Locations, js.Location)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	matched := []*scrubbedOffer{}
+	others := []*scrubbedOffer{}
+	for _, o := range offers {
+		if selected(o) {
+			matched = append(matched, o)
+		} else {
+			others = append(others, o)
+		}
+	}
+	sort.Sort(sortedScrubbedOffers(matched))
+	return matched, others, nil
+}
+
+func scrubFn(cfg *Config) error {
+	var before time.Time
+	if *scrubBefore != "" {
+		d, err := parseDay(*scrubBefore)
+		if err != nil {
+			return err
+		}
+		before = d
+	}
+	if *scrubAccount == "" && before.IsZero() && len(*scrubIds) == 0 {
+		return fmt.Errorf("no offer selected, use --account, --before or --id")
+	}
+	selected := makeScrubSelector(*scrubAccount, before, *scrubIds)
+
+	store, err := OpenStore(cfg.Store())
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	matched, others, err := listScrubbedOffers(store, selected)
+	if err != nil {
+		return err
+	}
+	if *scrubDryRun {
+		for _, o := range matched {
+			fmt.Printf("%s: %s, %s\n", o.Id, o.Account, o.Published.Format("2006-01-02"))
+		}
+		fmt.Printf("%d offers would be scrubbed\n", len(matched))
+		return nil
+	}
+
+	err = scrubOffers(cfg, store, matched, others)
+	auditErr := store.AppendAudit(NewAuditEntry(cliActor(), "scrub",
+		strings.Join(os.Args[1:], " "), err, time.Now()))
+	if err != nil {
+		return err
+	}
+	if auditErr != nil {
+		return auditErr
+	}
+	return store.Close()
+}
+
+// scrubOffers purges or redacts matched offers from store, the full text
+// and deleted offers indexes, snapshots and WARC files. Geocoder cache entries only used by purged
+// offers are removed.
+func scrubOffers(cfg *Config, store *Store, matched,
+	others []*scrubbedOffer) error {
+
+	searchCfg, err := loadSearchConfig(cfg.Search())
+	if err != nil {
+		return err
+	}
+	index, err := OpenOfferIndex(cfg.Index())
+	if err != nil {
+		return fmt.Errorf("cannot open index: %s", err)
+	}
+	defer index.Close()
+	// Deleted versions are indexed separately, if ever searched
+	var deleted bleve.Index
+	exists, err := isFile(cfg.DeletedIndex())
+	if err != nil {
+		return err
+	}
+	if exists {
+		deleted, err = OpenOfferIndex(cfg.DeletedIndex())
+		if err != nil {
+			return fmt.Errorf("cannot open deleted offers index: %s", err)
+		}
+		defer deleted.Close()
+	}
+
+	purged := &PurgeReport{}
+	for _, o := range matched {
+		if *scrubRedact {
+			n, err := redactStoredOffer(store, index, deleted,
+				searchCfg.Index, o.Id)
+			if err != nil {
+				return fmt.Errorf("could not redact %s: %s", o.Id, err)
+			}
+			fmt.Printf("%s: %d versions redacted\n", o.Id, n)
+			continue
+		}
+		report, err := purgeStoredOffer(store, index, deleted, searchCfg.Index,
+			o.Id)
+		if err != nil {
+			return fmt.Errorf("could not purge %s: %s", o.Id, err)
+		}
+		fmt.Printf("%s: live: %v, deleted versions: %d, location: %v, "+
+			"initial date: %v, dates: %d\n", o.Id, report.Live, report.Deleted,
+			report.Location, report.InitialDate, report.OfferDates)
+		if report.Live {
+			purged.Deleted++
+		}
+		purged.Deleted += report.Deleted
+		purged.OfferDates += report.OfferDates
+		purged.RemainingIds = append(purged.RemainingIds, report.RemainingIds...)
+	}
+	if *scrubRedact {
+		fmt.Printf("%d offers redacted\n", len(matched))
+	} else {
+		removedKeys, err := scrubGeocoderKeys(cfg, matched, others)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d offers scrubbed, %d versions, %d date records, %d "+
+			"geocoder entries, %d initial dates recomputed\n", len(matched),
+			purged.Deleted, purged.OfferDates, removedKeys,
+			len(purged.RemainingIds))
+	}
+	// Archived copies would come back in --as-of queries
+	err = scrubArchives(cfg.Snapshots(), *scrubWARC, matched, *scrubRedact)
+	if err != nil {
+		return err
+	}
+	if deleted != nil {
+		err = deleted.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return index.Close()
+}
+
+// scrubGeocoderKeys removes geocoder cache entries only used by matched
+// offers and returns their number.
+func scrubGeocoderKeys(cfg *Config, matched, others []*scrubbedOffer) (int,
+	error) {
+
+	geocoder, err := openGeocoder(cfg)
+	if err != nil {
+		return 0, err
+	}
+	defer geocoder.Close()
+	used := map[string]bool{}
+	for _, o := range others {
+		for _, loc := range o.Locations {
+			for _, c := range fixLocation(loc) {
+				used[c] = true
+			}
+		}
+	}
+	removedKeys := 0
+	for _, o := range matched {
+		for _, loc := range o.Locations {
+			for _, c := range fixLocation(loc) {
+				if used[c] {
+					continue
+				}
+				used[c] = true
+				key, _ := geocoder.cache.makeKey(c, "fr")
+				err = geocoder.cache.Delete(key)
+				if err != nil {
+					return 0, err
+				}
+				removedKeys++
+			}
+		}
+	}
+	return removedKeys, geocoder.Close()
+}
+
+// scrubArchives purges or redacts matched offers in the store snapshots of
+// snapshotsDir and in the WARC files of warcDir, if not empty.
+func scrubArchives(snapshotsDir, warcDir string, matched []*scrubbedOffer,
+	redact bool) error {
+
+	ids := map[string]bool{}
+	for _, o := range matched {
+		ids[o.Id] = true
+	}
+	paths, err := listSnapshots(snapshotsDir)
+	if err != nil {
+		return err
+	}
+	snapshots, versions := 0, 0
+	for _, path := range paths {
+		n, err := scrubSnapshot(path, ids, redact)
+		if err != nil {
+			return fmt.Errorf("could not scrub snapshot %s: %s", path, err)
+		}
+		if n > 0 {
+			snapshots++
+			versions += n
+		}
+	}
+	fmt.Printf("%d snapshots scrubbed, %d versions\n", snapshots, versions)
+	if warcDir == "" {
+		return nil
+	}
+	entries, err := ioutil.ReadDir(warcDir)
+	if err != nil {
+		return err
+	}
+	files, exchanges := 0, 0
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !(strings.HasSuffix(name, ".warc") ||
+			strings.HasSuffix(name, ".warc.gz")) {
+			continue
+		}
+		path := filepath.Join(warcDir, name)
+		n, err := scrubWARCFile(path, ids, redact)
+		if err != nil {
+			return fmt.Errorf("could not scrub %s: %s", path, err)
+		}
+		if n > 0 {
+			files++
+			exchanges += n
+		}
+	}
+	fmt.Printf("%d WARC files scrubbed, %d exchanges\n", files, exchanges)
+	return nil
+}
+
+// scrubSnapshot purges or redacts offers ids in the store snapshot at path
+// and returns the number of scrubbed versions. Scrubbed snapshots are
+// compacted, so erased data does not linger in free pages.
+func scrubSnapshot(path string, ids map[string]bool, redact bool) (int,
+	error) {
+
+	snapshot, err := OpenStore(path)
+	if err != nil {
+		return 0, err
+	}
+	defer snapshot.Close()
+	scrubbed := 0
+	for id := range ids {
+		if redact {
+			n, err := snapshot.RewriteOffer(id, redactOffer)
+			if err != nil {
+				return 0, err
+			}
+			if n > 0 {
+				_, err = snapshot.RefreshOfferDates(id)
+				if err != nil {
+					return 0, err
+				}
+			}
+			scrubbed += n
+			continue
+		}
+		report, err := snapshot.Purge(id)
+		if err != nil {
+			return 0, err
+		}
+		if report.Live {
+			scrubbed++
+		}
+		scrubbed += report.Deleted
+	}
+	if scrubbed == 0 {
+		return 0, snapshot.Close()
+	}
+	tmpPath := path + ".tmp"
+	os.Remove(tmpPath)
+	err = snapshot.Compact(tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+	err = snapshot.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+	return scrubbed, os.Rename(tmpPath, path)
+}
+
+// warcHeaderNames are WARC headers written by WARCWriter, in their order.
+// Read headers keys are canonicalized like MIME ones.
+var warcHeaderNames = []string{"WARC-Type", "WARC-Record-ID", "WARC-Date",
+	"WARC-Filename", "WARC-Target-URI", "WARC-Concurrent-To"}
+
+// getWARCOfferId returns the identifier of the offer fetched by uri, or an
+// empty string if it does not fetch an offer.
+func getWARCOfferId(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || !strings.HasSuffix(u.Path, "/offre/public") {
+		return ""
+	}
+	apecId := u.Query().Get("numeroOffre")
+	if apecId == "" {
+		return ""
+	}
+	return makeOfferId(apecSource, apecId)
+}
+
+// redactWARCResponse redacts the offer in a recorded HTTP response.
+func redactWARCResponse(block []byte) ([]byte, error) {
+	rsp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(block)), nil)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, err
+	}
+	redacted, err := redactOffer(body)
+	if err != nil {
+		return nil, err
+	}
+	rsp.Body = ioutil.NopCloser(bytes.NewReader(redacted))
+	rsp.ContentLength = int64(len(redacted))
+	rsp.Header.Set("Content-Length", strconv.Itoa(len(redacted)))
+	return httputil.DumpResponse(rsp, true)
+}
+
+// scrubWARCFile removes the exchanges fetching offers ids from the WARC file
+// at path, or redacts their responses, and returns their number. Responses
+// which cannot be redacted are removed. Scrubbed files are rewritten.
+func scrubWARCFile(path string, ids map[string]bool, redact bool) (int,
+	error) {
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	compressed := strings.HasSuffix(path, ".gz")
+	var r io.Reader = bytes.NewReader(data)
+	if compressed {
+		z, err := gzip.NewReader(r)
+		if err != nil {
+			return 0, err
+		}
+		defer z.Close()
+		r = z
+	}
+	records := []*warcRecord{}
+	err = readWARCRecords(r, func(rec *warcRecord) error {
+		records = append(records, rec)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	// Requests follow their responses
+	scrubbed := 0
+	removed := map[string]bool{}
+	output := &bytes.Buffer{}
+	for _, rec := range records {
+		switch rec.Header.Get("WARC-Type") {
+		case "response":
+			if !ids[getWARCOfferId(rec.Header.Get("WARC-Target-URI"))] {
+				break
+			}
+			scrubbed++
+			if redact {
+				block, err := redactWARCResponse(rec.Block)
+				if err == nil {
+					rec.Block = block
+					break
+				}
+			}
+			removed[rec.Header.Get("WARC-Record-ID")] = true
+			continue
+		case "request":
+			if removed[rec.Header.Get("WARC-Concurrent-To")] {
+				continue
+			}
+		}
+		headers := []warcHeader{}
+		known := map[string]bool{}
+		for _, name := range warcHeaderNames {
+			known[textproto.CanonicalMIMEHeaderKey(name)] = true
+			if v := rec.Header.Get(name); v != "" {
+				headers = append(headers, warcHeader{name, v})
+			}
+		}
+		names := []string{}
+		for name := range rec.Header {
+			switch name {
+			case "Warc-Block-Digest", "Content-Type", "Content-Length":
+			default:
+				if !known[name] {
+					names = append(names, name)
+				}
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			headers = append(headers, warcHeader{name, rec.Header.Get(name)})
+		}
+		formatted, err := formatWARCRecord(headers,
+			rec.Header.Get("Content-Type"), rec.Block, compressed)
+		if err != nil {
+			return 0, err
+		}
+		output.Write(formatted)
+	}
+	if scrubbed == 0 {
+		return 0, nil
+	}
+	tmpPath := path + ".tmp"
+	err = ioutil.WriteFile(tmpPath, output.Bytes(), 0644)
+	if err != nil {
+		os.Remove(tmpPath)
+		return 0, err
+	}
+	return scrubbed, os.Rename(tmpPath, path)
+}
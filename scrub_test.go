@@ -0,0 +1,318 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedactOffer(t *testing.T) {
+	data := []byte(`{"numeroOffre":"1001","intitule":"Développeur Go H/F",` +
+		`"nomCompteEtablissement":"ACME","texteHtml":"<p>golang</p>",` +
+		`"salaireTexte":"45 k€","lieuTexte":"Paris"}`)
+	redacted, err := redactOffer(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := string(redacted)
+	for _, erased := range []string{"Développeur", "ACME", "golang", "45"} {
+		if strings.Contains(s, erased) {
+			t.Fatalf("%q was not redacted: %s", erased, s)
+		}
+	}
+	if !strings.Contains(s, `"intitule":"[redacted] 1001"`) ||
+		!strings.Contains(s, `"lieuTexte":"Paris"`) {
+		t.Fatalf("unexpected redacted offer: %s", s)
+	}
+}
+
+func TestScrubSelector(t *testing.T) {
+	day := func(s string) time.Time {
+		d, err := parseDay(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	offers := []*scrubbedOffer{
+		{Id: "apec:1", Account: "ACME", Published: day("2017-01-01")},
+		{Id: "apec:2", Account: "acme", Published: day("2017-01-05")},
+		{Id: "apec:3", Account: "Initech", Published: day("2017-01-02")},
+	}
+	for _, test := range []struct {
+		Account  string
+		Before   string
+		Ids      []string
+		Expected string
+	}{
+		{"acme", "", nil, "apec:1 apec:2"},
+		{"", "2017-01-05", nil, "apec:1 apec:3"},
+		{"ACME", "2017-01-05", nil, "apec:1"},
+		{"", "2017-01-05", []string{"3"}, "apec:3"},
+		{"Globex", "", nil, ""},
+	} {
+		var before time.Time
+		if test.Before != "" {
+			before = day(test.Before)
+		}
+		selected := makeScrubSelector(test.Account, before, test.Ids)
+		ids := []string{}
+		for _, o := range offers {
+			if selected(o) {
+				ids = append(ids, o.Id)
+			}
+		}
+		if s := strings.Join(ids, " "); s != test.Expected {
+			t.Fatalf("%+v: expected %q, got %q", test, test.Expected, s)
+		}
+	}
+}
+
+func TestRedactStoredOffer(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	id := "apec:1001"
+	data, err := env.Store.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldHash, _, err := makeOfferAge(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = putOfferDate(env.Store, data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := makeSearchQuery("golang", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := searchIds(env.Index, q)
+	if err != nil || fmt.Sprint(ids) != "[apec:1001]" {
+		t.Fatalf("unexpected matches before redaction: %v, %v", ids, err)
+	}
+	n, err := redactStoredOffer(env.Store, env.Index, nil, IndexOptions{}, id)
+	if err != nil || n != 1 {
+		t.Fatalf("unexpected redaction: %d, %v", n, err)
+	}
+	data, err = env.Store.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newHash, _, err := makeOfferAge(data, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Offer dates follow the redacted content
+	ages, err := env.Store.GetOfferDates(oldHash)
+	if err != nil || len(ages) != 0 {
+		t.Fatalf("stale offer dates: %+v, %v", ages, err)
+	}
+	ages, err = env.Store.GetOfferDates(newHash)
+	if err != nil || len(ages) != 1 || ages[0].Id != id {
+		t.Fatalf("unexpected offer dates: %+v, %v", ages, err)
+	}
+	ids, err = searchIds(env.Index, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, found := range ids {
+		if found == id {
+			t.Fatalf("redacted offer is still indexed: %v", ids)
+		}
+	}
+}
+
+func TestScrubDeletedIndex(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	for _, id := range []string{"apec:1001", "apec:1002"} {
+		_, err := env.Store.Delete(id, time.Date(2017, 1, 8, 12, 0, 0, 0,
+			time.UTC))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	deleted, err := env.Deleted.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = syncDeletedIndex(env.Store, deleted, IndexOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	search := func(what string) string {
+		q, err := makeSearchQuery(what, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids, err := searchIds(deleted, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(ids)
+		return fmt.Sprint(ids)
+	}
+	if s := search("golang or python"); s != "[apec:1001/1 apec:1002/2]" {
+		t.Fatalf("unexpected deleted offers: %s", s)
+	}
+
+	_, err = redactStoredOffer(env.Store, env.Index, deleted, IndexOptions{},
+		"apec:1001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = purgeStoredOffer(env.Store, env.Index, deleted, IndexOptions{},
+		"apec:1002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := search("golang or python"); s != "[]" {
+		t.Fatalf("scrubbed versions are still searchable: %s", s)
+	}
+	if s := search("redacted"); s != "[apec:1001/1]" {
+		t.Fatalf("redacted version is not indexed: %s", s)
+	}
+}
+
+func TestScrubSnapshot(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	dir, err := ioutil.TempDir("", "apec-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, snapshotName(2017, 1))
+	err = env.Store.Compact(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Not a snapshot
+	err = ioutil.WriteFile(filepath.Join(dir, "notes.txt"), nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matched := []*scrubbedOffer{{Id: "apec:1001"}, {Id: "apec:1002"}}
+	err = scrubArchives(dir, "", matched[1:], true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = scrubArchives(dir, "", matched[:1], false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := OpenStoreReadOnly(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.Close()
+	for _, test := range []struct {
+		Id       string
+		Expected string
+	}{
+		{"apec:1001", ""},
+		{"apec:1002", "[redacted] 1002"},
+		{"apec:1003", "Chef de projet"},
+	} {
+		data, err := snapshot.Get(test.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.Expected == "" && data != nil ||
+			!strings.Contains(string(data), test.Expected) {
+			t.Fatalf("%s: unexpected snapshot version: %s", test.Id, data)
+		}
+	}
+}
+
+func TestScrubWARCFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apec-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writer, err := NewWARCWriter(dir, "apec", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	offerURL := func(id string) string {
+		return "https://cadres.apec.fr/cms/webservices/offre/public?" +
+			"numeroOffre=" + id
+	}
+	for _, id := range []string{"1001", "1002"} {
+		body := `{"numeroOffre":"` + id + `","intitule":"Développeur Go",` +
+			`"nomCompteEtablissement":"ACME"}`
+		err = writer.WriteExchange(offerURL(id), time.Now(),
+			[]byte("GET /cms/webservices/offre/public?numeroOffre="+id+
+				" HTTP/1.1\r\nHost: cadres.apec.fr\r\n\r\n"),
+			[]byte(fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s",
+				len(body), body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "apec-*.warc.gz"))
+	if err != nil || len(paths) != 1 {
+		t.Fatalf("unexpected WARC files: %v, %v", paths, err)
+	}
+
+	// Return the replayed body of offer id, or an empty string
+	replay := func(id string) string {
+		transport, err := LoadReplayTransport(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rq, err := http.NewRequest("GET", offerURL(id), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsp, err := transport.RoundTrip(rq)
+		if err != nil {
+			return ""
+		}
+		defer rsp.Body.Close()
+		body, err := ioutil.ReadAll(rsp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+	n, err := scrubWARCFile(paths[0], map[string]bool{"apec:1001": true}, true)
+	if err != nil || n != 1 {
+		t.Fatalf("unexpected redaction: %d, %v", n, err)
+	}
+	if body := replay("1001"); strings.Contains(body, "ACME") ||
+		!strings.Contains(body, `"intitule":"[redacted] 1001"`) {
+		t.Fatalf("unexpected redacted response: %s", body)
+	}
+	n, err = scrubWARCFile(paths[0], map[string]bool{"apec:1002": true}, false)
+	if err != nil || n != 1 {
+		t.Fatalf("unexpected purge: %d, %v", n, err)
+	}
+	if body := replay("1002"); body != "" {
+		t.Fatalf("purged response is still recorded: %s", body)
+	}
+	if body := replay("1001"); !strings.Contains(body, "[redacted] 1001") {
+		t.Fatalf("redacted response was lost: %s", body)
+	}
+	n, err = scrubWARCFile(paths[0], map[string]bool{"apec:1002": true}, false)
+	if err != nil || n != 0 {
+		t.Fatalf("unexpected second purge: %d, %v", n, err)
+	}
+}
@@ -2,10 +2,13 @@ package main
 
 import (
 	"fmt"
+	"net/http"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search/query"
 	"github.com/pmezard/apec/jstruct"
 )
 
@@ -28,8 +31,8 @@ func formatDate(s string) string {
 	return parts[0]
 }
 
-func printOffers(store *Store, ids []string) error {
-	// Load offer documents
+// loadOffersById returns the stored offers of ids, skipping missing ones.
+func loadOffersById(store *Store, ids []string) []*jstruct.JsonOffer {
 	offers := []*jstruct.JsonOffer{}
 	for _, id := range ids {
 		offer, err := getStoreJsonOffer(store, id)
@@ -38,6 +41,10 @@ func printOffers(store *Store, ids []string) error {
 		}
 		offers = append(offers, offer)
 	}
+	return offers
+}
+
+func printJsonOffers(offers []*jstruct.JsonOffer) {
 	// Sort by ascending publication date
 	sorted := offersByDate(offers)
 	sort.Sort(sorted)
@@ -47,43 +54,164 @@ func printOffers(store *Store, ids []string) error {
 		fmt.Printf("    https://cadres.apec.fr/offres-emploi-cadres/offre.html?numIdOffre=%s\n",
 			offer.Id)
 	}
-	return nil
 }
 
 var (
 	searchCmd   = app.Command("search", "search APEC index")
 	searchQuery = searchCmd.Arg("query", "search query").Required().String()
+	searchAsOf  = searchCmd.Flag("as-of",
+		"search offers active on specified date (YYYY-MM-DD), including deleted ones").
+		String()
+	searchIncludeDeleted = searchCmd.Flag("include-deleted",
+		"search deleted offers versions as well").Bool()
 )
 
+// searchIds returns the identifiers of all documents matching the query. They
+// are fetched by a single search, paging through results with several of
+// them would duplicate or omit documents indexed concurrently.
+func searchIds(index bleve.Index, q query.Query) ([]string, error) {
+	count, err := index.DocCount()
+	if err != nil {
+		return nil, err
+	}
+	rq := bleve.NewSearchRequest(q)
+	rq.Size = int(count)
+	res, err := index.Search(rq)
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, doc := range res.Hits {
+		ids = append(ids, doc.ID)
+	}
+	return ids, nil
+}
+
+// searchOffersAsOf returns offers active on day and matching q, including
+// deleted ones and those archived in snapshotsDir.
+func searchOffersAsOf(store *Store, snapshotsDir string, day time.Time,
+	q query.Query) ([]*jstruct.JsonOffer, error) {
+
+	offers, err := listArchivedOffersAsOf(store, snapshotsDir, day)
+	if err != nil {
+		return nil, err
+	}
+	index, err := newMemOfferIndex(offers)
+	if err != nil {
+		return nil, err
+	}
+	defer index.Close()
+	ids, err := searchIds(index, q)
+	if err != nil {
+		return nil, err
+	}
+	byId := map[string]*jstruct.JsonOffer{}
+	for _, offer := range offers {
+		byId[makeOfferId(apecSource, offer.Id)] = offer
+	}
+	matched := []*jstruct.JsonOffer{}
+	for _, id := range ids {
+		matched = append(matched, byId[id])
+	}
+	return matched, nil
+}
+
+// findOffers returns offers matching queryString, active on asOf if not
+// empty, or in the full text index otherwise. Past offers are also looked up
+// in snapshotsDir snapshots.
+func findOffers(store *Store, index bleve.Index, fields []SearchField,
+	snapshotsDir, queryString, asOf string) ([]*jstruct.JsonOffer, error) {
+
+	q, err := makeSearchQuery(queryString, nil, fields)
+	if err != nil {
+		return nil, err
+	}
+	if asOf != "" {
+		day, err := parseDay(asOf)
+		if err != nil {
+			return nil, err
+		}
+		return searchOffersAsOf(store, snapshotsDir, day, q)
+	}
+	ids, err := searchIds(index, q)
+	if err != nil {
+		return nil, err
+	}
+	return loadOffersById(store, ids), nil
+}
+
+// handleAdminOffers writes offers matching the "q" query as JSON lines. The
+// optional "as-of" parameter works like search --as-of.
+func handleAdminOffers(store *Store, index *IndexHolder, fields []SearchField,
+	snapshotsDir string, w http.ResponseWriter, r *http.Request) error {
+
+	offers, err := findOffers(store, index.Get(), fields, snapshotsDir,
+		r.FormValue("q"), r.FormValue("as-of"))
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	for _, offer := range offers {
+		err = writeJsonLine(w, offer)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func search(cfg *Config) error {
+	if *searchIncludeDeleted && (*serverURL != "" || *searchAsOf != "") {
+		return fmt.Errorf("--include-deleted cannot be combined with " +
+			"--server or --as-of")
+	}
+	if *serverURL != "" {
+		client, err := NewRemoteClient(*serverURL, cfg.SessionToken())
+		if err != nil {
+			return err
+		}
+		offers, err := client.Search(*searchQuery, *searchAsOf)
+		if err != nil {
+			return err
+		}
+		printJsonOffers(offers)
+		return nil
+	}
 	store, err := OpenStore(cfg.Store())
 	if err != nil {
 		return err
 	}
-	index, err := bleve.Open(cfg.Index())
+	searchCfg, err := loadSearchConfig(cfg.Search())
 	if err != nil {
 		return err
 	}
-	defer index.Close()
-	q, err := makeSearchQuery(*searchQuery, nil)
+	var index bleve.Index
+	if *searchAsOf == "" {
+		index, err = bleve.Open(cfg.Index())
+		if err != nil {
+			return err
+		}
+		defer index.Close()
+	}
+	offers, err := findOffers(store, index, searchCfg.Fields, cfg.Snapshots(),
+		*searchQuery, *searchAsOf)
 	if err != nil {
 		return err
 	}
-	rq := bleve.NewSearchRequest(q)
-	rq.Size = 100
-	ids := []string{}
-	for {
-		res, err := index.Search(rq)
+	if *searchIncludeDeleted {
+		deleted := NewDeletedIndex(cfg.DeletedIndex())
+		defer deleted.Close()
+		deletedIndex, err := deleted.Get()
 		if err != nil {
 			return err
 		}
-		for _, doc := range res.Hits {
-			ids = append(ids, doc.ID)
-		}
-		if len(res.Hits) < rq.Size {
-			break
+		found, err := findDeletedJsonOffers(store, deletedIndex,
+			searchCfg.Fields, *searchQuery)
+		if err != nil {
+			return err
 		}
-		rq.From += rq.Size
+		offers = append(offers, found...)
 	}
-	return printOffers(store, ids)
+	printJsonOffers(offers)
+	return nil
 }
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The search API returns search results as JSON pages. Like exports, the
+// first page pins the results in a snapshot, and following pages are read
+// from it with the "snapshot" parameter, returned in the next page link.
+
+const (
+	defaultSearchPageSize = 50
+	maxSearchPageSize     = 1000
+)
+
+type SearchResult struct {
+	Id        string `json:"id"`
+	Title     string `json:"title"`
+	Account   string `json:"account"`
+	Location  string `json:"location"`
+	URL       string `json:"url"`
+	MinSalary int    `json:"min_salary"`
+	MaxSalary int    `json:"max_salary"`
+	// Publication date, and publication date of the first offer with the
+	// same content, YYYY-MM-DD
+	Date        string `json:"date"`
+	InitialDate string `json:"initial_date,omitempty"`
+	// True if the offer was deleted after the snapshot was taken
+	Deleted bool `json:"deleted"`
+}
+
+type SearchResultsPage struct {
+	What     string          `json:"what"`
+	Where    string          `json:"where"`
+	Snapshot string          `json:"snapshot"`
+	Start    int             `json:"start"`
+	Size     int             `json:"size"`
+	Total    int             `json:"total"`
+	Next     string          `json:"next,omitempty"`
+	Offers   []*SearchResult `json:"offers"`
+}
+
+// makeSearchResultsPage converts an export page into search results.
+func makeSearchResultsPage(store *Store, page *ExportPage, size int) (
+	*SearchResultsPage, error) {
+
+	results := &SearchResultsPage{
+		Snapshot: page.Snapshot,
+		Start:    page.Start,
+		Size:     size,
+		Total:    page.Total,
+		Offers:   []*SearchResult{},
+	}
+	for _, o := range page.Offers {
+		result := &SearchResult{
+			Id:        o.Id,
+			Title:     o.Title,
+			Account:   o.Account,
+			Location:  o.Location,
+			URL:       o.URL,
+			MinSalary: o.MinSalary,
+			MaxSalary: o.MaxSalary,
+			Date:      o.Date.Format("2006-01-02"),
+			Deleted:   o.Deleted,
+		}
+		initial, err := store.GetInitialDate(o.Id)
+		if err != nil {
+			return nil, err
+		}
+		if !initial.IsZero() {
+			result.InitialDate = initial.Format("2006-01-02")
+		}
+		results.Offers = append(results.Offers, result)
+	}
+	return results, nil
+}
+
+// serveSearchAPI writes a page of search results as JSON. Results are read
+// from the "snapshot" result set, or searched with "what", "where" and
+// "include_remote" then pinned. They are sorted by decreasing publication
+// date.
+func serveSearchAPI(sc *SearchContext, w http.ResponseWriter,
+	r *http.Request) error {
+
+	rep := sc.Replica
+	store, index, results := rep.Store, rep.Index.Get(), sc.Results
+
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		return err
+	}
+	start, size, err := parseExportRange(values, defaultSearchPageSize,
+		maxSearchPageSize)
+	if err != nil {
+		return err
+	}
+	what := strings.TrimSpace(values.Get("what"))
+	where := strings.TrimSpace(values.Get("where"))
+	now := time.Now()
+	snapshot := values.Get("snapshot")
+	var offers []datedOffer
+	if snapshot != "" {
+		offers = results.Get(snapshot, now)
+		if offers == nil {
+			return fmt.Errorf("search snapshot has expired, please search again")
+		}
+	} else {
+		offers, err = findExportedOffers(store, index, rep.Spatial,
+			rep.Geocoder, sc.Router, sc.Limits, sc.Fields, sc.Backend, what,
+			where, values.Get("include_remote") == "1", now.In(sc.Loc))
+		if err != nil {
+			return err
+		}
+		snapshot = results.Put(offers, now)
+	}
+	page, err := loadExportPage(store, snapshot, offers, start, size)
+	if err != nil {
+		return err
+	}
+	data, err := makeSearchResultsPage(store, page, size)
+	if err != nil {
+		return err
+	}
+	data.What = what
+	data.Where = where
+	if next := start + size; next < page.Total {
+		u := url.Values{}
+		u.Set("snapshot", page.Snapshot)
+		u.Set("start", strconv.Itoa(next))
+		u.Set("size", strconv.Itoa(size))
+		if what != "" {
+			u.Set("what", what)
+		}
+		if where != "" {
+			u.Set("where", where)
+		}
+		data.Next = r.URL.Path + "?" + u.Encode()
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", data.Next))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(data)
+}
+
+func handleSearchAPI(sc *SearchContext, w http.ResponseWriter,
+	r *http.Request) {
+
+	err := serveSearchAPI(sc, w, r)
+	if err != nil {
+		log.Printf("error: search api failed with: %s", err)
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "error: %s\n", err)
+	}
+}
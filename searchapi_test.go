@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"testing"
+)
+
+func readSearchAPI(t *testing.T, env *testEnv, values url.Values) *SearchResultsPage {
+	rsp := env.SearchAPI(values)
+	if rsp.Code != 200 {
+		t.Fatalf("search failed: %d %s", rsp.Code, rsp.Body.String())
+	}
+	page := &SearchResultsPage{}
+	err := json.Unmarshal(rsp.Body.Bytes(), page)
+	if err != nil {
+		t.Fatalf("invalid JSON: %s", err)
+	}
+	return page
+}
+
+func TestSearchAPI(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	err := rebuildInitialDates(env.Store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := readSearchAPI(t, env, url.Values{
+		"what": {"python"},
+		"size": {"2"},
+	})
+	if first.Snapshot == "" || first.Total != 3 || first.Start != 0 ||
+		first.Size != 2 || len(first.Offers) != 2 || first.Next == "" {
+		t.Fatalf("unexpected first page: %+v", first)
+	}
+	o := first.Offers[1]
+	if o.Id != "apec:1002" || o.Title != "Développeur Python H/F" ||
+		o.Account != "Initech" || o.Location != "Paris" || o.MinSalary != 40 ||
+		o.MaxSalary != 40 || o.Date != "2017-01-03" ||
+		o.InitialDate != "2017-01-03" || o.Deleted {
+		t.Fatalf("unexpected offer: %+v", o)
+	}
+
+	u, err := url.Parse(first.Next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := u.Query()
+	if u.Path != "/api/search" || values.Get("snapshot") != first.Snapshot ||
+		values.Get("start") != "2" {
+		t.Fatalf("unexpected next page: %s", first.Next)
+	}
+	second := readSearchAPI(t, env, values)
+	ids := []string{}
+	for _, o := range append(first.Offers, second.Offers...) {
+		ids = append(ids, o.Id)
+	}
+	if fmt.Sprint(ids) != "[apec:1004 apec:1002 apec:1001]" ||
+		second.Next != "" || second.What != "python" {
+		t.Fatalf("unexpected pages: %v, %+v", ids, second)
+	}
+
+	for _, values := range []url.Values{
+		{"size": {"0"}},
+		{"start": {"-1"}},
+		{"snapshot": {"unknown"}},
+	} {
+		rsp := env.SearchAPI(values)
+		if rsp.Code != 400 {
+			t.Fatalf("%v: unexpected status %d", values, rsp.Code)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Full text queries match every configured field, with an optional per-field
+// boost. Fields and boosts are read from the "fields" section of search.json
+// in the data directory, so relevance can be tuned without code changes. The
+// "index" section bounds the size of indexed descriptions, for small hosts.
+// The optional "spelling" section enables query words correction with a
+// dictionary, relative to the data directory:
+//
+//	{
+//	  "fields": [
+//	    {"name": "title", "boost": 3},
+//	    {"name": "html"}
+//	  ],
+//	  "index": {"max_html_kb": 4},
+//	  "spelling": {"dictionary": "fr.dic", "max_distance": 1}
+//	}
+
+// SearchField is a full text field matched by search queries. Zero boosts
+// leave matches unboosted.
+type SearchField struct {
+	Name  string  `json:"name"`
+	Boost float64 `json:"boost,omitempty"`
+}
+
+// IndexOptions trade search quality for smaller full text indexes. Indexes
+// must be rebuilt after changing them.
+type IndexOptions struct {
+	// Index titles and extracted skills only
+	SkipHTML bool `json:"skip_html"`
+	// Truncate indexed descriptions to this size, zero means no limit
+	MaxHTMLKB int `json:"max_html_kb"`
+}
+
+// SpellingOptions configure query words correction, disabled without
+// dictionary.
+type SpellingOptions struct {
+	Dictionary string `json:"dictionary"`
+	// Maximum number of edits, defaults to 1
+	MaxDistance int `json:"max_distance"`
+	// Shorter words are not corrected, defaults to 4
+	MinLength int `json:"min_length"`
+}
+
+type SearchConfig struct {
+	Fields   []SearchField   `json:"fields"`
+	Index    IndexOptions    `json:"index"`
+	Spelling SpellingOptions `json:"spelling"`
+}
+
+var (
+	defaultSearchFields = []SearchField{
+		{Name: "html"},
+		{Name: "title"},
+	}
+	// Default fields when descriptions are not indexed
+	noHTMLSearchFields = []SearchField{
+		{Name: "title"},
+		{Name: "skills"},
+	}
+	// Text fields of NewOfferMapping
+	searchableFields = map[string]bool{
+		"html":   true,
+		"title":  true,
+		"skills": true,
+	}
+)
+
+func (c *SearchConfig) Validate() error {
+	seen := map[string]bool{}
+	for _, f := range c.Fields {
+		if !searchableFields[f.Name] {
+			return fmt.Errorf("unknown search field: %q", f.Name)
+		}
+		if seen[f.Name] {
+			return fmt.Errorf("duplicate search field: %q", f.Name)
+		}
+		seen[f.Name] = true
+		if f.Boost < 0 {
+			return fmt.Errorf("negative boost for search field %s: %f", f.Name, f.Boost)
+		}
+	}
+	if c.Index.MaxHTMLKB < 0 {
+		return fmt.Errorf("negative max_html_kb: %d", c.Index.MaxHTMLKB)
+	}
+	if c.Spelling.MaxDistance < 0 {
+		return fmt.Errorf("negative spelling max_distance: %d",
+			c.Spelling.MaxDistance)
+	}
+	if c.Spelling.MinLength < 0 {
+		return fmt.Errorf("negative spelling min_length: %d",
+			c.Spelling.MinLength)
+	}
+	return nil
+}
+
+// loadSearchConfig reads the search configuration at path. Missing files or
+// sections get default values.
+func loadSearchConfig(path string) (*SearchConfig, error) {
+	cfg := &SearchConfig{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	} else {
+		err = json.Unmarshal(data, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse search configuration %s: %s",
+				path, err)
+		}
+	}
+	if len(cfg.Fields) == 0 {
+		cfg.Fields = defaultSearchFields
+		if cfg.Index.SkipHTML {
+			cfg.Fields = noHTMLSearchFields
+		}
+	}
+	if cfg.Spelling.Dictionary != "" {
+		if !filepath.IsAbs(cfg.Spelling.Dictionary) {
+			cfg.Spelling.Dictionary = filepath.Join(filepath.Dir(path),
+				cfg.Spelling.Dictionary)
+		}
+		if cfg.Spelling.MaxDistance == 0 {
+			cfg.Spelling.MaxDistance = defaultSpellingDistance
+		}
+		if cfg.Spelling.MinLength == 0 {
+			cfg.Spelling.MinLength = defaultSpellingMinLength
+		}
+	}
+	err = cfg.Validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid search configuration %s: %s", path, err)
+	}
+	return cfg, nil
+}
+
+// loadConfigSpeller returns the speller configured by cfg, or nil if spelling
+// correction is disabled.
+func loadConfigSpeller(cfg *SearchConfig) (*Speller, error) {
+	opts := cfg.Spelling
+	if opts.Dictionary == "" {
+		return nil, nil
+	}
+	speller, err := loadSpeller(opts.Dictionary, opts.MaxDistance, opts.MinLength)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load spelling dictionary: %s", err)
+	}
+	return speller, nil
+}
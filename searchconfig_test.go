@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadSearchConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apec-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "search.json")
+
+	cfg, err := loadSearchConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cfg.Fields, defaultSearchFields) {
+		t.Fatalf("unexpected default fields: %+v", cfg.Fields)
+	}
+
+	tests := []struct {
+		Data   string
+		Fields []SearchField
+		Err    string
+	}{
+		{`{}`, defaultSearchFields, ""},
+		{`{"fields": [{"name": "title", "boost": 3}, {"name": "html"}]}`,
+			[]SearchField{{Name: "title", Boost: 3}, {Name: "html"}}, ""},
+		{`{"fields": [{"name": "account"}]}`, nil, "unknown search field"},
+		{`{"fields": [{"name": "title"}, {"name": "title"}]}`, nil,
+			"duplicate search field"},
+		{`{"fields": [{"name": "title", "boost": -1}]}`, nil, "negative boost"},
+		{`{"index": {"skip_html": true}}`, noHTMLSearchFields, ""},
+		{`{"index": {"max_html_kb": -1}}`, nil, "negative max_html_kb"},
+		{`{"spelling": {"max_distance": -1}}`, nil, "negative spelling max_distance"},
+		{`{"fields": `, nil, "cannot parse"},
+	}
+	for _, test := range tests {
+		err := ioutil.WriteFile(path, []byte(test.Data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := loadSearchConfig(path)
+		if test.Err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.Err) {
+				t.Fatalf("%s: expected %q error, got %v", test.Data, test.Err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %s", test.Data, err)
+		}
+		if !reflect.DeepEqual(cfg.Fields, test.Fields) {
+			t.Fatalf("%s: unexpected fields: %+v", test.Data, cfg.Fields)
+		}
+	}
+}
+
+func TestHandleQuerySearchFields(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	tests := []struct {
+		Fields   []SearchField
+		Count    string
+		Expected []string
+	}{
+		{nil, "3/3 offers", []string{"1001", "1002", "1004"}},
+		{[]SearchField{{Name: "title", Boost: 2}}, "1/1 offers", []string{"1002"}},
+	}
+	for _, test := range tests {
+		env.Fields = test.Fields
+		env.Generation.Bump()
+		w := env.Query("python", "")
+		body := w.Body.String()
+		if w.Code != 200 {
+			t.Fatalf("%+v: query failed with %d: %s", test.Fields, w.Code, body)
+		}
+		if !strings.Contains(body, test.Count) {
+			t.Fatalf("%+v: %q not found in:\n%s", test.Fields, test.Count, body)
+		}
+		for _, id := range test.Expected {
+			if !strings.Contains(body, id) {
+				t.Fatalf("%+v: %s not found in:\n%s", test.Fields, id, body)
+			}
+		}
+	}
+}
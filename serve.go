@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// serve runs servers on listeners until one of them fails or stop receives a
+// signal, then stops accepting connections and waits up to timeout for
+// in-flight requests to complete. Servers with a TLSConfig serve HTTPS. It
+// returns nil once the servers were shut down after a signal.
+func serve(servers []*http.Server, listeners []net.Listener,
+	stop <-chan os.Signal, timeout time.Duration) error {
+
+	failed := make(chan error, len(servers))
+	for i, server := range servers {
+		go func(server *http.Server, listener net.Listener) {
+			if server.TLSConfig != nil {
+				failed <- server.ServeTLS(listener, "", "")
+			} else {
+				failed <- server.Serve(listener)
+			}
+		}(server, listeners[i])
+	}
+	var err error
+	select {
+	case err = <-failed:
+	case sig := <-stop:
+		log.Printf("received %s, shutting down", sig)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, server := range servers {
+		e := server.Shutdown(ctx)
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// serveUntilSignal runs servers on their addresses until SIGINT or SIGTERM
+// is received, so callers can release their resources before exiting.
+func serveUntilSignal(servers []*http.Server, timeout time.Duration) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	listeners := []net.Listener{}
+	defer func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}()
+	for _, server := range servers {
+		listener, err := net.Listen("tcp", server.Addr)
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, listener)
+	}
+	return serve(servers, listeners, signals, timeout)
+}
+
+// newTLSServer returns a server of handler on addr over TLS, with the
+// certificate and key of certFile and keyFile, or a certificate for acmeHost
+// obtained from Let's Encrypt and cached in cacheDir. It also returns the
+// handler to serve over plain HTTP, which answers ACME challenges.
+func newTLSServer(addr string, handler http.Handler, certFile, keyFile,
+	acmeHost, cacheDir string) (*http.Server, http.Handler, error) {
+
+	server := &http.Server{
+		Addr:    addr,
+		Handler: handler,
+	}
+	if acmeHost != "" {
+		if certFile != "" || keyFile != "" {
+			return nil, nil, fmt.Errorf("--acme-host cannot be combined with " +
+				"--cert and --key")
+		}
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(acmeHost),
+			Cache:      autocert.DirCache(cacheDir),
+		}
+		server.TLSConfig = manager.TLSConfig()
+		return server, manager.HTTPHandler(handler), nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, nil, fmt.Errorf("--https requires --cert and --key, " +
+			"or --acme-host")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot load TLS certificate: %s", err)
+	}
+	server.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	return server, handler, nil
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestServeShutdown(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan bool)
+	release := make(chan bool)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+			w.Write([]byte("done"))
+		}),
+	}
+	stop := make(chan os.Signal, 1)
+	served := make(chan error, 1)
+	go func() {
+		served <- serve([]*http.Server{server}, []net.Listener{listener}, stop,
+			time.Minute)
+	}()
+
+	type response struct {
+		Body string
+		Err  error
+	}
+	responses := make(chan response, 1)
+	go func() {
+		rsp, err := http.Get("http://" + listener.Addr().String() + "/")
+		if err != nil {
+			responses <- response{Err: err}
+			return
+		}
+		defer rsp.Body.Close()
+		body, err := ioutil.ReadAll(rsp.Body)
+		responses <- response{Body: string(body), Err: err}
+	}()
+	<-started
+	stop <- syscall.SIGTERM
+
+	// In-flight requests complete before serve returns
+	select {
+	case err := <-served:
+		t.Fatalf("server stopped before in-flight request: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	rsp := <-responses
+	if rsp.Err != nil || rsp.Body != "done" {
+		t.Fatalf("unexpected response: %q, %v", rsp.Body, rsp.Err)
+	}
+	err = <-served
+	if err != nil {
+		t.Fatalf("shutdown failed: %s", err)
+	}
+}
+
+// writeTestCertificate writes a self-signed certificate for 127.0.0.1 and its
+// key in dir, and returns their paths.
+func writeTestCertificate(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "apec"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template,
+		&key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	err = ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{
+		Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+func TestServeTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apec-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certPath, keyPath := writeTestCertificate(t, dir)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			w.Write([]byte("https"))
+		} else {
+			w.Write([]byte("http"))
+		}
+	})
+	_, _, err = newTLSServer("", handler, certPath, "", "", "")
+	if err == nil {
+		t.Fatalf("missing key was accepted")
+	}
+	_, _, err = newTLSServer("", handler, certPath, keyPath, "example.com", dir)
+	if err == nil {
+		t.Fatalf("--acme-host was accepted with --cert")
+	}
+	server, plain, err := newTLSServer("", handler, certPath, keyPath, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers := []*http.Server{server, {Handler: plain}}
+	listeners := []net.Listener{}
+	for range servers {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners = append(listeners, listener)
+	}
+	stop := make(chan os.Signal, 1)
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(servers, listeners, stop, time.Minute)
+	}()
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+	get := func(u string) string {
+		rsp, err := client.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rsp.Body.Close()
+		body, err := ioutil.ReadAll(rsp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+	if s := get("https://" + listeners[0].Addr().String() + "/"); s != "https" {
+		t.Fatalf("unexpected HTTPS response: %q", s)
+	}
+	if s := get("http://" + listeners[1].Addr().String() + "/"); s != "http" {
+		t.Fatalf("unexpected HTTP response: %q", s)
+	}
+	stop <- syscall.SIGTERM
+	err = <-served
+	if err != nil {
+		t.Fatalf("shutdown failed: %s", err)
+	}
+
+	// Plain HTTP answers ACME challenges, and serves other requests
+	_, plain, err = newTLSServer("", handler, "", "", "example.com", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	plain.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/search",
+		nil))
+	if w.Body.String() != "http" {
+		t.Fatalf("unexpected response: %q", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	plain.ServeHTTP(w, httptest.NewRequest("GET",
+		"http://example.com/.well-known/acme-challenge/token", nil))
+	if w.Code == 200 || w.Body.String() == "http" {
+		t.Fatalf("challenge was not handled: %d %q", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jonas-p/go-shp"
+	"github.com/pmezard/apec/shpdraw"
+)
+
+// Density maps draw borders from shapefiles, made of .shp, .shx and .dbf
+// files sharing the same base name. They are downloaded as zip archives by
+// "apec fetch-shapes" and their checksums recorded in a .sha256 file next to
+// them, in the format of sha256sum.
+
+const (
+	defaultShapesDir = "shp"
+	defaultBorders   = "world"
+)
+
+var shapeExtensions = []string{".shp", ".shx", ".dbf"}
+
+type ShapeSource struct {
+	Name string
+	// Zip archive containing the shapefile
+	URL string
+	// Base name of the shapefile, in the archive and the shapes directory
+	Base string
+	// Expected checksums by extension, the first downloaded files are
+	// trusted if empty.
+	SHA256 map[string]string
+}
+
+var shapeSources = []*ShapeSource{
+	{
+		Name: "world",
+		URL:  "http://thematicmapping.org/downloads/TM_WORLD_BORDERS-0.3.zip",
+		Base: "TM_WORLD_BORDERS-0.3",
+		SHA256: map[string]string{
+			".shp": "47069d9f8728ad3729a75a7d62b3f1b6f79e2dc38c06f9cc54a77a791da27458",
+			".shx": "95d3e6c1d88b3ea6d2031b3cd5166654698f921efd041eabd9ae5c58fccedb16",
+			".dbf": "a969cefda0ec0b285f6ce5aeceb647e275162bcda6b652e5b107246bf0df627a",
+		},
+	},
+	{
+		Name: "departements",
+		URL: "http://osm13.openstreetmap.fr/~cquest/openfla/export/" +
+			"departements-20180101-shp.zip",
+		Base: "departements-20180101",
+	},
+	{
+		Name: "regions",
+		URL: "http://osm13.openstreetmap.fr/~cquest/openfla/export/" +
+			"regions-20180101-shp.zip",
+		Base: "regions-20180101",
+	},
+}
+
+func shapeSourceNames() []string {
+	names := []string{}
+	for _, s := range shapeSources {
+		names = append(names, s.Name)
+	}
+	return names
+}
+
+func findShapeSource(name string) (*ShapeSource, error) {
+	for _, s := range shapeSources {
+		if s.Name == name {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown shapes %q, expected one of %s", name,
+		strings.Join(shapeSourceNames(), ", "))
+}
+
+// Path returns the path of the shapefile part with ext extension in dir.
+func (s *ShapeSource) Path(dir, ext string) string {
+	return filepath.Join(dir, s.Base+ext)
+}
+
+func (s *ShapeSource) checksumsPath(dir string) string {
+	return s.Path(dir, ".sha256")
+}
+
+func hashFile(path string) (string, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fp.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, fp)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// readShapeChecksums returns the checksums recorded for s files in dir by
+// extension, or nil if there are none.
+func readShapeChecksums(dir string, s *ShapeSource) (map[string]string, error) {
+	fp, err := os.Open(s.checksumsPath(dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer fp.Close()
+	sums := map[string]string{}
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid checksum line in %s: %q",
+				s.checksumsPath(dir), scanner.Text())
+		}
+		sums[filepath.Ext(fields[1])] = fields[0]
+	}
+	return sums, scanner.Err()
+}
+
+func writeShapeChecksums(dir string, s *ShapeSource, sums map[string]string) error {
+	exts := []string{}
+	for ext := range sums {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+	lines := []string{}
+	for _, ext := range exts {
+		lines = append(lines, fmt.Sprintf("%s  %s\n", sums[ext], s.Base+ext))
+	}
+	return ioutil.WriteFile(s.checksumsPath(dir), []byte(strings.Join(lines, "")),
+		0644)
+}
+
+// expectedChecksums returns the pinned checksums of s, or those recorded in
+// dir, or nil if there are none.
+func expectedChecksums(dir string, s *ShapeSource) (map[string]string, error) {
+	if len(s.SHA256) > 0 {
+		return s.SHA256, nil
+	}
+	return readShapeChecksums(dir, s)
+}
+
+// verifyShapes checks s files exist in dir and match their checksums, if
+// any.
+func verifyShapes(dir string, s *ShapeSource) error {
+	expected, err := expectedChecksums(dir, s)
+	if err != nil {
+		return err
+	}
+	for _, ext := range shapeExtensions {
+		path := s.Path(dir, ext)
+		sum, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+		if expected == nil {
+			continue
+		}
+		if sum != expected[ext] {
+			return fmt.Errorf("checksum mismatch for %s: expected %s, got %s",
+				path, expected[ext], sum)
+		}
+	}
+	return nil
+}
+
+// extractShapes writes s files from zip archive at path into dir, with a
+// .tmp suffix, and returns their checksums by extension.
+func extractShapes(path, dir string, s *ShapeSource) (map[string]string, error) {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+	sums := map[string]string{}
+	for _, f := range archive.File {
+		name := filepath.Base(f.Name)
+		ext := filepath.Ext(name)
+		if !strings.EqualFold(name, s.Base+ext) {
+			continue
+		}
+		ext = strings.ToLower(ext)
+		found := false
+		for _, e := range shapeExtensions {
+			found = found || e == ext
+		}
+		if !found {
+			continue
+		}
+		sum, err := extractZipFile(f, s.Path(dir, ext)+".tmp")
+		if err != nil {
+			return nil, err
+		}
+		sums[ext] = sum
+	}
+	for _, ext := range shapeExtensions {
+		if sums[ext] == "" {
+			return nil, fmt.Errorf("%s not found in %s", s.Base+ext, s.URL)
+		}
+	}
+	return sums, nil
+}
+
+func extractZipFile(f *zip.File, path string) (string, error) {
+	r, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	fp, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer fp.Close()
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(fp, h), r)
+	if err != nil {
+		return "", err
+	}
+	err = fp.Close()
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// downloadShapes stores s archive in a temporary file of dir and returns its
+// path. It is the caller responsibility to remove it.
+func downloadShapes(dir string, s *ShapeSource) (string, error) {
+	rsp, err := retryHTTP(s.URL, time.Second, 3, nil, &retryPolicy{})
+	if err != nil {
+		return "", err
+	}
+	defer rsp.Close()
+	fp, err := ioutil.TempFile(dir, "download-")
+	if err != nil {
+		return "", err
+	}
+	defer fp.Close()
+	_, err = io.Copy(fp, rsp)
+	if err == nil {
+		err = fp.Close()
+	}
+	if err != nil {
+		os.Remove(fp.Name())
+		return "", err
+	}
+	return fp.Name(), nil
+}
+
+// fetchShapes downloads s files into dir, unless they are already there and
+// valid or force is set. Extracted files are checked against s pinned
+// checksums, then the checksums are recorded. It returns true if files were
+// downloaded.
+func fetchShapes(dir string, s *ShapeSource, force bool) (bool, error) {
+	if !force && verifyShapes(dir, s) == nil {
+		return false, nil
+	}
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return false, err
+	}
+	path, err := downloadShapes(dir, s)
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(path)
+	sums, err := extractShapes(path, dir, s)
+	defer func() {
+		for _, ext := range shapeExtensions {
+			os.Remove(s.Path(dir, ext) + ".tmp")
+		}
+	}()
+	if err != nil {
+		return false, err
+	}
+	if len(s.SHA256) > 0 {
+		for _, ext := range shapeExtensions {
+			if sums[ext] != s.SHA256[ext] {
+				return false, fmt.Errorf("checksum mismatch for %s: expected %s, "+
+					"got %s", s.Base+ext, s.SHA256[ext], sums[ext])
+			}
+		}
+	}
+	for _, ext := range shapeExtensions {
+		err = os.Rename(s.Path(dir, ext)+".tmp", s.Path(dir, ext))
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, writeShapeChecksums(dir, s, sums)
+}
+
+var (
+	fetchShapesCmd = app.Command("fetch-shapes", `download border shapefiles
+
+Download and extract the shapefiles drawn on density maps into the --shapes
+directory, by default those selected with --borders. Files already there are
+kept if they match their checksums, unless --force is set.
+`)
+	fetchShapesNames = fetchShapesCmd.Arg("names", "shapes to fetch, among "+
+		strings.Join(shapeSourceNames(), ", ")).Strings()
+	fetchShapesForce = fetchShapesCmd.Flag("force", "download files even if "+
+		"they are valid").Bool()
+)
+
+func fetchShapesFn(cfg *Config) error {
+	names := *fetchShapesNames
+	if len(names) == 0 {
+		names = []string{cfg.Borders}
+	}
+	sources := []*ShapeSource{}
+	for _, name := range names {
+		s, err := findShapeSource(name)
+		if err != nil {
+			return err
+		}
+		sources = append(sources, s)
+	}
+	for _, s := range sources {
+		fetched, err := fetchShapes(cfg.ShapesDir, s, *fetchShapesForce)
+		if err != nil {
+			return fmt.Errorf("cannot fetch %s shapes: %s", s.Name, err)
+		}
+		if fetched {
+			fmt.Printf("%s: downloaded %s\n", s.Name, s.Path(cfg.ShapesDir, ".shp"))
+		} else {
+			fmt.Printf("%s: %s is up to date\n", s.Name, s.Path(cfg.ShapesDir, ".shp"))
+		}
+	}
+	return nil
+}
+
+// loadBorders returns cfg border shapes intersecting box.
+func loadBorders(cfg *Config, box shp.Box) ([]shp.Shape, error) {
+	s, err := findShapeSource(cfg.Borders)
+	if err != nil {
+		return nil, err
+	}
+	path := s.Path(cfg.ShapesDir, ".shp")
+	shapes, err := shpdraw.LoadAndFilterShapes(path, box)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s not found, run \"apec fetch-shapes %s\"",
+				path, s.Name)
+		}
+		return nil, err
+	}
+	return shapes, nil
+}
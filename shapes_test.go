@@ -0,0 +1,124 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func makeShapesArchive(t *testing.T, files map[string]string) []byte {
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+	for name, data := range files {
+		fp, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = fp.Write([]byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestFetchShapes(t *testing.T) {
+	archive := makeShapesArchive(t, map[string]string{
+		"dept/dept.shp":    "shp",
+		"dept/dept.shx":    "shx",
+		"dept/DEPT.DBF":    "dbf",
+		"dept/dept.prj":    "prj",
+		"dept/README.txt":  "readme",
+		"other/dept-2.shp": "other",
+	})
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			w.Write(archive)
+		}))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "apec-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Pinned checksums are enforced
+	s := &ShapeSource{
+		Name:   "dept",
+		URL:    server.URL,
+		Base:   "dept",
+		SHA256: map[string]string{".shp": "x", ".shx": "y", ".dbf": "z"},
+	}
+	_, err = fetchShapes(dir, s, false)
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("expected a checksum mismatch, got %v", err)
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil || len(names) != 0 {
+		t.Fatalf("failed download left files: %v, %v", names, err)
+	}
+
+	// First downloaded files are trusted and their checksums recorded
+	s.SHA256 = nil
+	fetched, err := fetchShapes(dir, s, false)
+	if err != nil || !fetched {
+		t.Fatalf("shapes were not fetched: %v", err)
+	}
+	data, err := ioutil.ReadFile(s.Path(dir, ".dbf"))
+	if err != nil || string(data) != "dbf" {
+		t.Fatalf("unexpected dbf content: %q, %v", data, err)
+	}
+	sums, err := readShapeChecksums(dir, s)
+	if err != nil || len(sums) != 3 || sums[".shp"] == "" {
+		t.Fatalf("unexpected recorded checksums: %v, %v", sums, err)
+	}
+	fetched, err = fetchShapes(dir, s, false)
+	if err != nil || fetched || requests != 2 {
+		t.Fatalf("valid shapes were downloaded again: %v", err)
+	}
+
+	// Altered files are detected and replaced
+	err = ioutil.WriteFile(s.Path(dir, ".shx"), []byte("altered"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := checkShapes(dir, "world")
+	if c.Status != doctorError {
+		t.Fatalf("missing shapes were not reported: %+v", c)
+	}
+	err = verifyShapes(dir, s)
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("altered shapes were not detected: %v", err)
+	}
+	fetched, err = fetchShapes(dir, s, false)
+	if err != nil || !fetched || verifyShapes(dir, s) != nil {
+		t.Fatalf("altered shapes were not fetched again: %v", err)
+	}
+}
+
+func TestShippedShapes(t *testing.T) {
+	s, err := findShapeSource(defaultBorders)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = verifyShapes(defaultShapesDir, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = findShapeSource("cantons")
+	if err == nil {
+		t.Fatalf("unknown shapes were accepted")
+	}
+}
@@ -33,20 +33,13 @@ func LoadAndFilterShapes(path string, box shp.Box) ([]shp.Shape, error) {
 	return kept, nil
 }
 
-func Draw(img *image.RGBA, col color.RGBA, box shp.Box, shape shp.Shape) error {
-	poly, ok := shape.(*shp.Polygon)
-	if !ok {
-		return fmt.Errorf("cannot draw non-polygon shape")
-	}
-
-	gc := draw2dimg.NewGraphicContext(img)
-	gc.SetStrokeColor(col)
-	gc.SetLineWidth(1)
-
+// partPaths returns the paths of polygon parts, projected from box to img.
+func partPaths(img *image.RGBA, box shp.Box, poly *shp.Polygon) []*draw2d.Path {
 	rect := img.Bounds()
 	dx := float64(rect.Max.X-rect.Min.X) / (box.MaxX - box.MinX)
 	dy := float64(rect.Max.Y-rect.Min.Y) / (box.MaxY - box.MinY)
 
+	paths := []*draw2d.Path{}
 	for i, start := range poly.Parts {
 		end := len(poly.Points)
 		if i+1 < len(poly.Parts) {
@@ -54,7 +47,7 @@ func Draw(img *image.RGBA, col color.RGBA, box shp.Box, shape shp.Shape) error {
 		}
 		part := poly.Points[start:end]
 
-		path := draw2d.Path{}
+		path := &draw2d.Path{}
 		for j, p := range part {
 			x := ((p.X - box.MinX) * dx)
 			y := ((box.MaxY - p.Y) * dy)
@@ -65,7 +58,37 @@ func Draw(img *image.RGBA, col color.RGBA, box shp.Box, shape shp.Shape) error {
 			}
 		}
 		path.Close()
-		gc.Stroke(&path)
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+func Draw(img *image.RGBA, col color.RGBA, box shp.Box, shape shp.Shape) error {
+	poly, ok := shape.(*shp.Polygon)
+	if !ok {
+		return fmt.Errorf("cannot draw non-polygon shape")
+	}
+
+	gc := draw2dimg.NewGraphicContext(img)
+	gc.SetStrokeColor(col)
+	gc.SetLineWidth(1)
+	for _, path := range partPaths(img, box, poly) {
+		gc.Stroke(path)
 	}
 	return nil
 }
+
+// Fill paints the inside of a polygon shape, parts being combined with the
+// even-odd rule so holes are left untouched.
+func Fill(img *image.RGBA, col color.RGBA, box shp.Box, shape shp.Shape) error {
+	poly, ok := shape.(*shp.Polygon)
+	if !ok {
+		return fmt.Errorf("cannot fill non-polygon shape")
+	}
+
+	gc := draw2dimg.NewGraphicContext(img)
+	gc.SetFillColor(col)
+	gc.SetFillRule(draw2d.FillRuleEvenOdd)
+	gc.Fill(partPaths(img, box, poly)...)
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"hash/fnv"
+	"regexp"
+	"strings"
+
+	"github.com/pmezard/apec/jstruct"
+)
+
+// Companies often repost offers after tweaking a sentence, which changes
+// their content hash. Offers contents are also fingerprinted with a 64 bits
+// simhash of their word bigrams: similar texts get fingerprints differing
+// by a few bits only. A new content whose fingerprint is within
+// nearDuplicateDistance bits of a known content of the same account joins
+// its offer dates chain, so reposts keep their initial date.
+//
+// Fingerprints are split in simhashBands bands, two fingerprints within
+// nearDuplicateDistance bits share at least one of them. Candidates are
+// looked up by band in the store simhashes bucket.
+
+const (
+	// Maximum number of differing bits between near-duplicates. Rewording a
+	// sentence of a typical offer changes 2 to 7 bits, unrelated offers of
+	// the same field differ by more than 20.
+	nearDuplicateDistance = 6
+	// Must be greater than nearDuplicateDistance and divide 64, into bands of
+	// at most 16 bits
+	simhashBands = 8
+	simhashWords = 2
+)
+
+var reSimhashWords = regexp.MustCompile(`[\p{L}\p{N}]+`)
+
+// simhashText returns the simhash of text word bigrams, ignoring case and
+// diacritics.
+func simhashText(text string) uint64 {
+	text = strings.ToLower(removeDiacritics(nfdString(text)))
+	words := reSimhashWords.FindAllString(text, -1)
+	n := simhashWords
+	if len(words) < n {
+		n = len(words)
+	}
+	weights := [64]int{}
+	for i := 0; i+n <= len(words) && n > 0; i++ {
+		h := fnv.New64a()
+		h.Write([]byte(strings.Join(words[i:i+n], " ")))
+		sum := h.Sum64()
+		for bit := uint(0); bit < 64; bit++ {
+			if sum&(1<<bit) != 0 {
+				weights[bit]++
+			} else {
+				weights[bit]--
+			}
+		}
+	}
+	fingerprint := uint64(0)
+	for bit := uint(0); bit < 64; bit++ {
+		if weights[bit] > 0 {
+			fingerprint |= 1 << bit
+		}
+	}
+	return fingerprint
+}
+
+// simhashOffer returns the simhash of the offer fields hashed by hashOffer,
+// except the account.
+func simhashOffer(js *jstruct.JsonOffer) uint64 {
+	return simhashText(strings.Join([]string{js.Title, htmlParagraphs(js.HTML),
+		js.Location, js.Salary}, "\n"))
+}
+
+// simhashDistance returns the number of bits differing between a and b.
+func simhashDistance(a, b uint64) int {
+	n := 0
+	for x := a ^ b; x != 0; x &= x - 1 {
+		n++
+	}
+	return n
+}
+
+// simhashBand returns band i of fingerprint.
+func simhashBand(fingerprint uint64, i int) uint16 {
+	width := uint(64 / simhashBands)
+	return uint16((fingerprint >> (width * uint(i))) & (1<<width - 1))
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/pmezard/apec/jstruct"
+)
+
+const simhashTestHTML = `<p>Rattaché au directeur technique, vous concevez et développez les
+services de notre plateforme de réservation en ligne, utilisée chaque jour
+par des milliers de voyageurs.</p>
+<p>Vous participez aux choix d'architecture, à la revue de code et à
+l'amélioration continue de nos outils de déploiement. Vous travaillez en
+équipe avec les développeurs frontend, les product managers et l'équipe
+d'exploitation pour livrer des fonctionnalités fiables et performantes.</p>
+<p>Profil recherché : diplômé d'une école d'ingénieur ou équivalent, vous
+justifiez d'au moins trois ans d'expérience en développement backend. Vous
+maîtrisez Go ou Python, les bases de données relationnelles et les
+architectures orientées services. Curieux et rigoureux, vous aimez partager
+vos connaissances.</p>`
+
+func TestSimhashText(t *testing.T) {
+	a := simhashText(simhashTestHTML)
+	if d := simhashDistance(a, simhashText(strings.ToUpper(simhashTestHTML))); d != 0 {
+		t.Fatalf("case changed the simhash: %d", d)
+	}
+	tweaked := strings.Replace(simhashTestHTML, "trois ans", "quatre ans", 1)
+	if d := simhashDistance(a, simhashText(tweaked)); d > nearDuplicateDistance {
+		t.Fatalf("tweaked text is too far: %d", d)
+	}
+	other := simhashText(`Nous recherchons un développeur backend pour
+	rejoindre notre équipe à Lyon. Vous développerez nos services en Java et
+	participerez à la conception de notre plateforme de paiement. Trois ans
+	d'expérience minimum, maîtrise de Spring et des bases de données
+	relationnelles.`)
+	if d := simhashDistance(a, other); d <= 2*nearDuplicateDistance {
+		t.Fatalf("different texts are too close: %d", d)
+	}
+	if simhashDistance(0, 7) != 3 {
+		t.Fatalf("invalid simhash distance")
+	}
+}
+
+func TestNearDuplicateReposts(t *testing.T) {
+	store := openTempStore(t)
+	defer closeAndDeleteStore(t, store)
+
+	put := func(id, date, account, html string) {
+		data, err := json.Marshal(&jstruct.JsonOffer{
+			Id:      id,
+			Title:   "Développeur backend H/F",
+			Date:    date + "T10:00:00.000+0000",
+			HTML:    html,
+			Account: account,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.Put(makeOfferId(apecSource, id), data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = putOfferDate(store, data, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(id, expected string) {
+		d, err := store.GetInitialDate(makeOfferId(apecSource, id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.Format("2006-01-02") != expected {
+			t.Fatalf("unexpected %s initial date: %s != %s", id, d, expected)
+		}
+	}
+	tweaked := strings.Replace(simhashTestHTML, "trois ans", "quatre ans", 1)
+	put("1", "2017-01-01", "ACME", simhashTestHTML)
+	put("2", "2017-01-05", "ACME", tweaked)
+	put("3", "2017-01-06", "Globex", tweaked)
+	put("4", "2017-01-07", "ACME", "<p>Un tout autre poste.</p>")
+	expected := func() {
+		check("1", "2017-01-01")
+		// Tweaked repost of the same account
+		check("2", "2017-01-01")
+		check("3", "2017-01-06")
+		check("4", "2017-01-07")
+	}
+	expected()
+	data, err := store.Get(makeOfferId(apecSource, "2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	js := &jstruct.JsonOffer{}
+	err = json.Unmarshal(data, js)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ages, err := store.GetOfferDates(hashOffer(js))
+	if err != nil || len(ages) != 2 {
+		t.Fatalf("unexpected near-duplicate dates: %+v, %v", ages, err)
+	}
+
+	err = rebuildInitialDates(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected()
+
+	// Purged contents are forgotten
+	for _, id := range []string{"1", "2"} {
+		_, err = store.Purge(makeOfferId(apecSource, id))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	put("5", "2017-01-08", "ACME", tweaked)
+	check("5", "2017-01-08")
+	check("4", "2017-01-07")
+}
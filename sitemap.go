@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Public deployments publish a robots.txt allowing search engines to crawl
+// their pages, and a sitemap.xml listing them with absolute URLs built from
+// the deployment base URL. Other deployments disallow crawling altogether.
+// Crawlers only read robots.txt at the host root, so it is served there even
+// with a public path prefix. Sitemaps are rendered once per index
+// generation.
+
+const (
+	sitemapXmlns = "http://www.sitemaps.org/schemas/sitemap/0.9"
+	// Sitemaps cannot list more URLs
+	maxSitemapURLs = 50000
+)
+
+// Pages listed in the sitemap, relative to the public URL
+var sitemapPages = []string{"", "density", "departments"}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+// sortedSitemapURLs sorts URLs by decreasing modification date, then
+// location.
+type sortedSitemapURLs []sitemapURL
+
+func (s sortedSitemapURLs) Len() int {
+	return len(s)
+}
+
+func (s sortedSitemapURLs) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s sortedSitemapURLs) Less(i, j int) bool {
+	if s[i].LastMod != s[j].LastMod {
+		return s[i].LastMod > s[j].LastMod
+	}
+	return s[i].Loc < s[j].Loc
+}
+
+// buildSitemap lists public pages under baseURL, then offers pages, the most
+// recent first, if offerPath is not nil. offerPath returns the path of an
+// offer page relative to baseURL. Offers pages are last modified when their
+// offer was published.
+func buildSitemap(store *Store, baseURL string,
+	offerPath func(id string) string) (*sitemapURLSet, error) {
+
+	baseURL = strings.TrimRight(baseURL, "/")
+	set := &sitemapURLSet{Xmlns: sitemapXmlns}
+	for _, page := range sitemapPages {
+		set.URLs = append(set.URLs, sitemapURL{Loc: baseURL + "/" + page})
+	}
+	if offerPath == nil {
+		return set, nil
+	}
+	ids, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	offers := []sitemapURL{}
+	for _, id := range ids {
+		offer, err := getStoreOffer(store, id)
+		if err != nil {
+			return nil, err
+		}
+		if offer == nil {
+			continue
+		}
+		offers = append(offers, sitemapURL{
+			Loc:     baseURL + "/" + offerPath(id),
+			LastMod: offer.Date.Format("2006-01-02"),
+		})
+	}
+	sort.Sort(sortedSitemapURLs(offers))
+	if max := maxSitemapURLs - len(set.URLs); len(offers) > max {
+		offers = offers[:max]
+	}
+	set.URLs = append(set.URLs, offers...)
+	return set, nil
+}
+
+func writeSitemap(w io.Writer, set *sitemapURLSet) error {
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	err = enc.Encode(set)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
+
+// handleSitemap writes the sitemap of the deployment published at baseURL,
+// rendering it unless cache holds one of the current index generation.
+func handleSitemap(store *Store, baseURL string,
+	offerPath func(id string) string, cache *BytesCache,
+	w http.ResponseWriter, r *http.Request) error {
+
+	key := "sitemap"
+	data := cache.Get(key)
+	if data == nil {
+		generation := cache.Generation()
+		set, err := buildSitemap(store, baseURL, offerPath)
+		if err != nil {
+			return err
+		}
+		buf := &bytes.Buffer{}
+		err = writeSitemap(buf, set)
+		if err != nil {
+			return err
+		}
+		data = buf.Bytes()
+		cache.Put(key, generation, data)
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	_, err := w.Write(data)
+	return err
+}
+
+// handleRobots allows crawling public pages under publicURL and points to the
+// sitemap if baseURL is set, and disallows everything otherwise. It must be
+// served at the host root.
+func handleRobots(baseURL, publicURL string, w http.ResponseWriter,
+	r *http.Request) {
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if baseURL == "" {
+		fmt.Fprintf(w, "User-agent: *\nDisallow: /\n")
+		return
+	}
+	fmt.Fprintf(w, "User-agent: *\n")
+	for _, path := range []string{"/api/", "/export", "/downloads/",
+		"/calendar.ics", "/densitymap", "/departmentsmap", "/opensearch",
+		"/login", "/logout"} {
+		fmt.Fprintf(w, "Disallow: %s%s\n", publicURL, path)
+	}
+	fmt.Fprintf(w, "Allow: %s/\n\nSitemap: %s/sitemap.xml\n", publicURL,
+		strings.TrimRight(baseURL, "/"))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSitemap(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	set, err := buildSitemap(env.Store, "https://example.com/apec/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(set.URLs) != 3 || set.URLs[0].Loc != "https://example.com/apec/" ||
+		set.URLs[2].Loc != "https://example.com/apec/departments" {
+		t.Fatalf("unexpected pages: %+v", set.URLs)
+	}
+
+	set, err = buildSitemap(env.Store, "https://example.com/apec",
+		offerPagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(set.URLs) != 9 {
+		t.Fatalf("unexpected URLs: %+v", set.URLs)
+	}
+	if u := set.URLs[3]; u.Loc != "https://example.com/apec/offer/apec:1006" ||
+		u.LastMod != "2017-01-07" {
+		t.Fatalf("unexpected most recent offer: %+v", u)
+	}
+	buf := &bytes.Buffer{}
+	err = writeSitemap(buf, set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed := &sitemapURLSet{}
+	err = xml.Unmarshal(buf.Bytes(), parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), "<?xml") || len(parsed.URLs) != 9 ||
+		parsed.URLs[8].LastMod != "2017-01-02" {
+		t.Fatalf("unexpected sitemap:\n%s", buf.String())
+	}
+
+	// Sitemaps are cached until the index generation changes
+	cache := NewBytesCache(env.Generation, 100)
+	sitemap := func() string {
+		return env.Get(func(w http.ResponseWriter, r *http.Request) {
+			err := handleSitemap(env.Store, "https://example.com/apec",
+				offerPagePath, cache, w, r)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}, "/apec/sitemap.xml", nil).Body.String()
+	}
+	first := sitemap()
+	if first != buf.String() {
+		t.Fatalf("unexpected served sitemap:\n%s", first)
+	}
+	_, err = env.Store.Delete("apec:1006", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sitemap() != first {
+		t.Fatalf("cached sitemap was rendered again")
+	}
+	env.Generation.Bump()
+	if strings.Contains(sitemap(), "apec:1006") {
+		t.Fatalf("sitemap was not updated")
+	}
+
+	robots := func(baseURL string) string {
+		return env.Get(func(w http.ResponseWriter, r *http.Request) {
+			handleRobots(baseURL, "/apec", w, r)
+		}, "/apec/robots.txt", nil).Body.String()
+	}
+	if s := robots(""); s != "User-agent: *\nDisallow: /\n" {
+		t.Fatalf("private robots.txt allows crawling:\n%s", s)
+	}
+	s := robots("https://example.com/apec/")
+	if !strings.Contains(s, "Disallow: /apec/api/\n") ||
+		!strings.Contains(s, "Allow: /apec/\n") ||
+		!strings.HasSuffix(s, "Sitemap: https://example.com/apec/sitemap.xml\n") {
+		t.Fatalf("unexpected robots.txt:\n%s", s)
+	}
+}
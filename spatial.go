@@ -15,6 +15,8 @@ type OfferLoc struct {
 	Date  time.Time
 	Point Point
 	Loc   rtreego.Rect
+	// Nationwide offers have no point and are kept out of the rtree.
+	Nationwide bool
 }
 
 func (l *OfferLoc) Bounds() *rtreego.Rect {
@@ -31,6 +33,13 @@ func makeOfferLocation(id string, date time.Time, loc *Location) (
 	if loc == nil {
 		return nil, nil
 	}
+	if loc.Nationwide {
+		return &OfferLoc{
+			Id:         id,
+			Date:       date,
+			Nationwide: true,
+		}, nil
+	}
 	lon := loc.Lon - locExtent[0]/2
 	lat := loc.Lat - locExtent[1]/2
 	rect, err := rtreego.NewRect(rtreego.Point{lon, lat}, locExtent)
@@ -73,10 +82,12 @@ func (s *SpatialIndex) Add(o *OfferLoc) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 	prev := s.known[o.Id]
-	if prev != nil {
+	if prev != nil && !prev.Nationwide {
 		s.rtree.Delete(prev)
 	}
-	s.rtree.Insert(o)
+	if !o.Nationwide {
+		s.rtree.Insert(o)
+	}
 	s.known[o.Id] = o
 }
 
@@ -85,7 +96,9 @@ func (s *SpatialIndex) Remove(id string) {
 	defer s.lock.Unlock()
 	o := s.known[id]
 	if o != nil {
-		s.rtree.Delete(o)
+		if !o.Nationwide {
+			s.rtree.Delete(o)
+		}
 		delete(s.known, id)
 	}
 }
@@ -136,11 +149,53 @@ func (s *SpatialIndex) FindNearest(lat, lon, maxDist float64) ([]datedOffer, err
 	return offers, nil
 }
 
+// FindInPolygon returns offers located inside poly.
+func (s *SpatialIndex) FindInPolygon(poly *Polygon) ([]datedOffer, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	offers := []datedOffer{}
+	min, max := poly.Bounds()
+	if max.Lon <= min.Lon || max.Lat <= min.Lat {
+		return offers, nil
+	}
+	query, err := rtreego.NewRect(rtreego.Point{min.Lon, min.Lat},
+		[2]float64{max.Lon - min.Lon, max.Lat - min.Lat})
+	if err != nil {
+		return nil, err
+	}
+	results := s.rtree.SearchIntersect(&query)
+	for _, r := range results {
+		loc := r.(*OfferLoc)
+		if !poly.Contains(loc.Point.Lat, loc.Point.Lon) {
+			continue
+		}
+		offers = append(offers, datedOffer{
+			Date: loc.Date.Format(time.RFC3339),
+			Id:   loc.Id,
+		})
+	}
+	return offers, nil
+}
+
+// FindAll returns all located offers, nationwide ones excluded.
 func (s *SpatialIndex) FindAll() []datedOffer {
+	return s.find(false)
+}
+
+// FindNationwide returns all nationwide offers.
+func (s *SpatialIndex) FindNationwide() []datedOffer {
+	return s.find(true)
+}
+
+func (s *SpatialIndex) find(nationwide bool) []datedOffer {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
-	offers := make([]datedOffer, 0, len(s.known))
+	offers := []datedOffer{}
 	for _, loc := range s.known {
+		if loc.Nationwide != nationwide {
+			continue
+		}
 		offers = append(offers, datedOffer{
 			Date: loc.Date.Format(time.RFC3339),
 			Id:   loc.Id,
@@ -159,14 +214,20 @@ func spatialFn(cfg *Config) error {
 		return err
 	}
 	defer store.Close()
-	geocoder, err := NewGeocoder(cfg.GeocodingKey(), cfg.Geocoder())
+	geocoder, err := openGeocoder(cfg)
 	if err != nil {
 		return err
 	}
 	defer geocoder.Close()
+	_, err = buildSpatialIndex(store, geocoder)
+	return err
+}
+
+// buildSpatialIndex returns a spatial index of all stored offers locations.
+func buildSpatialIndex(store *Store, geocoder *Geocoder) (*SpatialIndex, error) {
 	ids, err := store.List()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	spatial := NewSpatialIndex()
 	for i, id := range ids {
@@ -175,11 +236,11 @@ func spatialFn(cfg *Config) error {
 		}
 		loc, err := getOfferLocation(store, geocoder, id)
 		if err != nil {
-			return fmt.Errorf("could not get offer location for %s: %s", id, err)
+			return nil, fmt.Errorf("could not get offer location for %s: %s", id, err)
 		}
 		if loc != nil {
 			spatial.Add(loc)
 		}
 	}
-	return nil
+	return spatial, nil
 }
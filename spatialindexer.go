@@ -6,22 +6,32 @@ import (
 )
 
 type SpatialIndexer struct {
-	store    *Store
-	index    *SpatialIndex
-	geocoder *Geocoder
-	reset    chan bool
-	stop     chan chan bool
+	store      *Store
+	index      *SpatialIndex
+	geocoder   *Geocoder
+	stations   *Stations
+	generation *IndexGeneration
+	reset      chan bool
+	wait       chan chan bool
+	stop       chan chan bool
 }
 
+// NewSpatialIndexer returns an indexer keeping index in sync with stored
+// offers. Transit scores of indexed offers are updated if stations is not nil.
+// generation is bumped after index updates.
 func NewSpatialIndexer(store *Store, index *SpatialIndex,
-	geocoder *Geocoder) *SpatialIndexer {
+	geocoder *Geocoder, stations *Stations,
+	generation *IndexGeneration) *SpatialIndexer {
 
 	idx := &SpatialIndexer{
-		store:    store,
-		index:    index,
-		geocoder: geocoder,
-		reset:    make(chan bool, 1),
-		stop:     make(chan chan bool),
+		store:      store,
+		index:      index,
+		geocoder:   geocoder,
+		stations:   stations,
+		generation: generation,
+		reset:      make(chan bool, 1),
+		wait:       make(chan chan bool),
+		stop:       make(chan chan bool),
 	}
 	go idx.dispatch()
 	return idx
@@ -40,6 +50,13 @@ func (idx *SpatialIndexer) Sync() {
 	}
 }
 
+// SyncAndWait updates the index and returns once it is done.
+func (idx *SpatialIndexer) SyncAndWait() {
+	done := make(chan bool)
+	idx.wait <- done
+	<-done
+}
+
 func (idx *SpatialIndexer) dispatch() {
 	for {
 		select {
@@ -49,6 +66,12 @@ func (idx *SpatialIndexer) dispatch() {
 				log.Printf("error: spatial indexer reset failed: %s", err)
 				continue
 			}
+		case done := <-idx.wait:
+			err := idx.sync()
+			if err != nil {
+				log.Printf("error: spatial indexer sync failed: %s", err)
+			}
+			close(done)
 		case done := <-idx.stop:
 			close(done)
 			return
@@ -87,12 +110,16 @@ func (idx *SpatialIndexer) sync() error {
 	added, removed := diffIds(stored, indexed)
 
 	log.Printf("spatially indexing %d, removing %d", len(added), len(removed))
+	if len(added) > 0 || len(removed) > 0 {
+		defer idx.generation.Bump()
+	}
 	for i, id := range removed {
 		if (i+1)%500 == 0 {
 			log.Printf("%d spatially removed", i+1)
 		}
 		idx.index.Remove(id)
 	}
+	locs := []*OfferLoc{}
 	for i, id := range added {
 		if (i+1)%500 == 0 {
 			log.Printf("%d spatially indexed", i+1)
@@ -103,8 +130,16 @@ func (idx *SpatialIndexer) sync() error {
 		}
 		if loc != nil {
 			idx.index.Add(loc)
+			locs = append(locs, loc)
 		}
 	}
 	log.Printf("spatial indexation done")
+	if idx.stations != nil {
+		n, err := updateTransitScores(idx.store, idx.stations, locs, false)
+		if err != nil {
+			return err
+		}
+		log.Printf("%d transit scores computed", n)
+	}
 	return nil
 }
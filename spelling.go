@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/blevesearch/bleve"
+	"github.com/pmezard/apec/blevext"
+)
+
+// Misspelled query words can be replaced with the closest words of a French
+// dictionary before searching. The dictionary is a plain list of words, one
+// per line, or a hunspell .dic file whose affix flags are ignored. Only words
+// missing from both the dictionary and the index are corrected.
+
+const (
+	defaultSpellingDistance  = 1
+	defaultSpellingMinLength = 4
+)
+
+type Speller struct {
+	words map[string]bool
+	// Dictionary words by length in runes, sorted
+	byLength map[int][]string
+	// Maximum number of edits between a word and its correction
+	maxDistance int
+	// Shorter words are left unchanged
+	minLength int
+}
+
+// loadSpeller reads the dictionary at path.
+func loadSpeller(path string, maxDistance, minLength int) (*Speller, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	speller := &Speller{
+		words:       map[string]bool{},
+		byLength:    map[int][]string{},
+		maxDistance: maxDistance,
+		minLength:   minLength,
+	}
+	scanner := bufio.NewScanner(fp)
+	first := true
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		isFirst := first
+		first = false
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// hunspell dictionaries start with their approximate word count
+		if isFirst && strings.TrimFunc(line, unicode.IsDigit) == "" {
+			continue
+		}
+		// Drop hunspell flags and morphological fields
+		if i := strings.IndexAny(line, "/\t "); i >= 0 {
+			line = line[:i]
+		}
+		word := strings.ToLower(line)
+		if word == "" || speller.words[word] {
+			continue
+		}
+		speller.words[word] = true
+		n := utf8.RuneCountInString(word)
+		speller.byLength[n] = append(speller.byLength[n], word)
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read dictionary %s: %s", path, err)
+	}
+	for _, words := range speller.byLength {
+		sort.Strings(words)
+	}
+	return speller, nil
+}
+
+// editDistance returns the number of insertions, deletions, substitutions or
+// transpositions of adjacent runes turning a into b, or max+1 if it exceeds
+// max.
+func editDistance(a, b []rune, max int) int {
+	if d := len(a) - len(b); d > max || -d > max {
+		return max + 1
+	}
+	prev2 := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		rowMin := cur[0]
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d := prev[j-1] + cost
+			if prev[j]+1 < d {
+				d = prev[j] + 1
+			}
+			if cur[j-1]+1 < d {
+				d = cur[j-1] + 1
+			}
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] &&
+				prev2[j-2]+1 < d {
+				d = prev2[j-2] + 1
+			}
+			cur[j] = d
+			if d < rowMin {
+				rowMin = d
+			}
+		}
+		if rowMin > max {
+			return max + 1
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	if prev[len(b)] > max {
+		return max + 1
+	}
+	return prev[len(b)]
+}
+
+// isSpellable returns true if word is made of letters only. Words with
+// digits or symbols, like "c++", "s3" or keyword terms, are not corrected.
+func isSpellable(word string) bool {
+	for _, r := range word {
+		if !unicode.IsLetter(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// Correct returns the closest dictionary word to word and true, or word and
+// false if it is known, too short or has no close enough dictionary word.
+// Ties are broken by favoring words of the same length, then shorter ones,
+// then alphabetically.
+func (s *Speller) Correct(word string) (string, bool) {
+	word = strings.ToLower(word)
+	runes := []rune(word)
+	if len(runes) < s.minLength || !isSpellable(word) || s.words[word] {
+		return word, false
+	}
+	best := ""
+	bestDistance := s.maxDistance + 1
+	for delta := 0; delta <= s.maxDistance; delta++ {
+		lengths := []int{len(runes) - delta}
+		if delta > 0 {
+			lengths = append(lengths, len(runes)+delta)
+		}
+		for _, n := range lengths {
+			for _, candidate := range s.byLength[n] {
+				d := editDistance(runes, []rune(candidate), bestDistance-1)
+				if d < bestDistance {
+					best = candidate
+					bestDistance = d
+				}
+			}
+		}
+	}
+	if best == "" {
+		return word, false
+	}
+	return best, true
+}
+
+// hasTextMatches returns true if word matches any indexed offer.
+func hasTextMatches(index bleve.Index, word string, fields []SearchField) (
+	bool, error) {
+
+	q, err := makeSearchQuery(word, nil, fields)
+	if err != nil {
+		return false, err
+	}
+	rq := bleve.NewSearchRequestOptions(q, 0, 0, false)
+	res, err := index.Search(rq)
+	if err != nil {
+		return false, err
+	}
+	return res.Total > 0, nil
+}
+
+// correctQuery returns query with its misspelled plain words replaced by
+// their corrections, and true if any was replaced. Phrases, exact words and
+// operators are left unchanged, as are invalid queries.
+func correctQuery(index bleve.Index, speller *Speller, query string,
+	fields []SearchField) (string, bool, error) {
+
+	if speller == nil {
+		return query, false, nil
+	}
+	terms, err := blevext.Terms(query)
+	if err != nil {
+		return query, false, nil
+	}
+	corrected := query
+	changed := false
+	// Replace from the end so preceding terms offsets remain valid
+	for i := len(terms) - 1; i >= 0; i-- {
+		term := terms[i]
+		fixed, ok := speller.Correct(term.Value)
+		if !ok {
+			continue
+		}
+		known, err := hasTextMatches(index, term.Value, fields)
+		if err != nil {
+			return query, false, err
+		}
+		if known {
+			continue
+		}
+		corrected = corrected[:term.Pos] + fixed +
+			corrected[term.Pos+len(term.Value):]
+		changed = true
+	}
+	return corrected, changed, nil
+}
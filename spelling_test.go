@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEditDistance(t *testing.T) {
+	for _, test := range []struct {
+		A        string
+		B        string
+		Max      int
+		Expected int
+	}{
+		{"python", "python", 1, 0},
+		{"pyhton", "python", 1, 1},
+		{"pythn", "python", 1, 1},
+		{"dévelopeur", "développeur", 1, 1},
+		{"java", "jade", 1, 2},
+		{"java", "jade", 2, 2},
+		{"go", "golang", 2, 3},
+	} {
+		d := editDistance([]rune(test.A), []rune(test.B), test.Max)
+		if d != test.Expected {
+			t.Fatalf("%s/%s: expected %d, got %d", test.A, test.B, test.Expected, d)
+		}
+	}
+}
+
+func writeTestDictionary(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "apec-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "fr.dic")
+	err = ioutil.WriteFile(path, []byte(`5
+développeur/S.
+Ingénieur/S. po:nom
+python
+lava
+chef/S.
+`), 0644)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestSpeller(t *testing.T) {
+	path := writeTestDictionary(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	speller, err := loadSpeller(path, 1, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		Word     string
+		Expected string
+	}{
+		{"Dévelopeur", "développeur"},
+		{"ingenieur", "ingénieur"},
+		{"pyhton", "python"},
+		{"python", ""},
+		{"chf", ""},
+		{"lave", "lava"},
+		{"c++", ""},
+		{"5", ""},
+	} {
+		fixed, ok := speller.Correct(test.Word)
+		if !ok {
+			fixed = ""
+		}
+		if fixed != test.Expected {
+			t.Fatalf("%s: expected %q, got %q", test.Word, test.Expected, fixed)
+		}
+	}
+}
+
+func TestHandleQuerySpelling(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+	path := writeTestDictionary(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	speller, err := loadSpeller(path, 1, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Words known to the index are not corrected
+	corrected, changed, err := correctQuery(env.Index, speller,
+		`pyhton and not ("dévelopeur" or =pyhton) or java`, env.Fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed ||
+		corrected != `python and not ("dévelopeur" or =pyhton) or java` {
+		t.Fatalf("unexpected correction: %q", corrected)
+	}
+
+	env.Speller = speller
+	body := env.Query("pyhton", "paris").Body.String()
+	for _, s := range []string{
+		"2/2 offers",
+		"Showing results for <b>python</b>",
+		`href="search?what=pyhton&amp;where=paris&amp;spelling=0"`,
+	} {
+		if !strings.Contains(body, s) {
+			t.Fatalf("%q is missing from:\n%s", s, body)
+		}
+	}
+	body = env.QueryValues(map[string][]string{
+		"what":     {"pyhton"},
+		"where":    {"paris"},
+		"spelling": {"0"},
+	}).Body.String()
+	if !strings.Contains(body, "0/0 offers") ||
+		strings.Contains(body, "Showing results for") {
+		t.Fatalf("query should not be corrected:\n%s", body)
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/pmezard/apec/jstruct"
+)
+
+type MonthCount struct {
+	Month string `json:"month"`
+	Count int    `json:"count"`
+}
+
+type AccountCount struct {
+	Account string `json:"account"`
+	Count   int    `json:"count"`
+}
+
+type sortedAccountCounts []AccountCount
+
+func (s sortedAccountCounts) Len() int {
+	return len(s)
+}
+
+func (s sortedAccountCounts) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s sortedAccountCounts) Less(i, j int) bool {
+	if s[i].Count != s[j].Count {
+		return s[i].Count > s[j].Count
+	}
+	return s[i].Account < s[j].Account
+}
+
+// DatasetStats summarizes the store, indexes and their disk usage.
+type DatasetStats struct {
+	Offers int `json:"offers"`
+	// Offers with at least one deletion, and deletions count
+	DeletedOffers int `json:"deleted_offers"`
+	Deletions     int `json:"deletions"`
+	// Live offers by publication month, ascending
+	Monthly  []MonthCount `json:"monthly"`
+	Geocoded int          `json:"geocoded"`
+	// Live offers with a parsed salary
+	WithSalary int `json:"with_salary"`
+	// Full text index documents, -1 if unknown
+	Indexed  int64          `json:"indexed"`
+	Accounts []AccountCount `json:"top_accounts"`
+	// Disk usage in bytes, -1 if unknown
+	StoreSize    int64 `json:"store_size"`
+	IndexSize    int64 `json:"index_size"`
+	GeocoderSize int64 `json:"geocoder_size"`
+}
+
+// collectDatasetStats computes store statistics, with the maxAccounts
+// accounts publishing the most offers. index is optional.
+func collectDatasetStats(store *Store, index bleve.Index,
+	maxAccounts int) (*DatasetStats, error) {
+
+	rawOffers, err := loadOffers(store)
+	if err != nil {
+		return nil, err
+	}
+	stats, err := summarizeOffers(store, rawOffers, maxAccounts)
+	if err != nil {
+		return nil, err
+	}
+	deleted, err := store.ListDeletedIds()
+	if err != nil {
+		return nil, err
+	}
+	stats.DeletedOffers = len(deleted)
+	for _, id := range deleted {
+		entries, err := store.ListDeletedOffers(id)
+		if err != nil {
+			return nil, err
+		}
+		stats.Deletions += len(entries)
+	}
+	if index != nil {
+		count, err := index.DocCount()
+		if err != nil {
+			return nil, err
+		}
+		stats.Indexed = int64(count)
+	}
+	return stats, nil
+}
+
+// collectDatasetStatsAsOf works like collectDatasetStats on offers active on
+// day, see listArchivedOffersAsOf. Deletions are those which happened before
+// the end of the day. The index reflects the present and is not counted.
+func collectDatasetStatsAsOf(store *Store, snapshotsDir string, day time.Time,
+	maxAccounts int) (*DatasetStats, error) {
+
+	rawOffers, err := listArchivedOffersAsOf(store, snapshotsDir, day)
+	if err != nil {
+		return nil, err
+	}
+	stats, err := summarizeOffers(store, rawOffers, maxAccounts)
+	if err != nil {
+		return nil, err
+	}
+	end := day.Add(24 * time.Hour)
+	deleted, err := store.ListDeletedIds()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range deleted {
+		entries, err := store.ListDeletedOffers(id)
+		if err != nil {
+			return nil, err
+		}
+		n := 0
+		for _, entry := range entries {
+			date, err := time.Parse(time.RFC3339, entry.Date)
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse %s deletion date: %s",
+					id, err)
+			}
+			if date.Before(end) {
+				n++
+			}
+		}
+		if n > 0 {
+			stats.DeletedOffers++
+			stats.Deletions += n
+		}
+	}
+	return stats, nil
+}
+
+// summarizeOffers returns statistics about rawOffers, with the maxAccounts
+// accounts publishing the most offers. Deletions and index statistics are
+// left unknown.
+func summarizeOffers(store *Store, rawOffers []*jstruct.JsonOffer,
+	maxAccounts int) (*DatasetStats, error) {
+
+	stats := &DatasetStats{
+		Indexed:      -1,
+		StoreSize:    -1,
+		IndexSize:    -1,
+		GeocoderSize: -1,
+	}
+	offers, err := convertOffers(rawOffers)
+	if err != nil {
+		return nil, err
+	}
+	stats.Offers = len(offers)
+	months := map[string]int{}
+	accounts := map[string]int{}
+	for _, offer := range offers {
+		months[offer.Date.Format("2006-01")]++
+		accounts[offer.Account]++
+		if offer.MinSalary > 0 || offer.MaxSalary > 0 {
+			stats.WithSalary++
+		}
+		loc, _, err := store.GetLocation(offer.Id)
+		if err != nil {
+			return nil, err
+		}
+		if loc != nil {
+			stats.Geocoded++
+		}
+	}
+	keys := []string{}
+	for month := range months {
+		keys = append(keys, month)
+	}
+	sort.Strings(keys)
+	stats.Monthly = []MonthCount{}
+	for _, month := range keys {
+		stats.Monthly = append(stats.Monthly, MonthCount{
+			Month: month,
+			Count: months[month],
+		})
+	}
+	top := sortedAccountCounts{}
+	for account, count := range accounts {
+		top = append(top, AccountCount{
+			Account: account,
+			Count:   count,
+		})
+	}
+	sort.Sort(top)
+	if len(top) > maxAccounts {
+		top = top[:maxAccounts]
+	}
+	stats.Accounts = top
+	return stats, nil
+}
+
+// setDiskSizes fills stats disk usages from cfg, ignoring missing paths.
+func setDiskSizes(stats *DatasetStats, cfg *Config) {
+	size := func(path string) int64 {
+		n, err := dirSize(path)
+		if err != nil {
+			return -1
+		}
+		return n
+	}
+	stats.StoreSize = size(cfg.Store())
+	stats.IndexSize = size(cfg.Index())
+	stats.GeocoderSize = size(cfg.Geocoder())
+}
+
+func percent(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(total)
+}
+
+func formatSize(n int64) string {
+	if n < 0 {
+		return "?"
+	}
+	return fmt.Sprintf("%.1fMB", float64(n)/(1024*1024))
+}
+
+func printDatasetStats(w io.Writer, stats *DatasetStats) {
+	fmt.Fprintf(w, "offers: %d\n", stats.Offers)
+	fmt.Fprintf(w, "deleted: %d offers, %d deletions\n", stats.DeletedOffers,
+		stats.Deletions)
+	fmt.Fprintf(w, "geocoded: %d (%.1f%%)\n", stats.Geocoded,
+		percent(stats.Geocoded, stats.Offers))
+	fmt.Fprintf(w, "with salary: %d (%.1f%%)\n", stats.WithSalary,
+		percent(stats.WithSalary, stats.Offers))
+	if stats.Indexed >= 0 {
+		fmt.Fprintf(w, "indexed: %d\n", stats.Indexed)
+	} else {
+		fmt.Fprintf(w, "indexed: ?\n")
+	}
+	fmt.Fprintf(w, "disk: store %s, index %s, geocoder %s\n",
+		formatSize(stats.StoreSize), formatSize(stats.IndexSize),
+		formatSize(stats.GeocoderSize))
+	fmt.Fprintf(w, "\nadditions per month:\n")
+	for _, m := range stats.Monthly {
+		fmt.Fprintf(w, "  %s: %d\n", m.Month, m.Count)
+	}
+	fmt.Fprintf(w, "\ntop accounts:\n")
+	for _, a := range stats.Accounts {
+		fmt.Fprintf(w, "  %d %s\n", a.Count, a.Account)
+	}
+}
+
+// handleAdminStats writes dataset statistics as JSON, with "accounts" top
+// accounts, 10 by default. The optional "as-of" parameter works like stats
+// --as-of.
+func handleAdminStats(cfg *Config, store *Store, index *IndexHolder,
+	w http.ResponseWriter, r *http.Request) error {
+
+	accounts := 10
+	if s := r.FormValue("accounts"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid accounts: %q", s)
+		}
+		accounts = n
+	}
+	stats, err := collectStats(cfg, store, index.Get(), accounts,
+		r.FormValue("as-of"))
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return writeJsonLine(w, stats)
+}
+
+var (
+	statsCmd = app.Command("stats", `print a summary of the dataset
+
+Prints live and deleted offers counts, additions per month, geocoding and
+salary coverage, full text index documents, disk usage and top accounts.
+`)
+	statsAccounts = statsCmd.Flag("accounts", "number of top accounts").
+			Default("10").Int()
+	statsAsOf = statsCmd.Flag("as-of",
+		"summarize offers active on date, YYYY-MM-DD").String()
+)
+
+// collectStats returns the statistics of the dataset, or of offers active on
+// asOf if not empty, with disk usages.
+func collectStats(cfg *Config, store *Store, index bleve.Index,
+	maxAccounts int, asOf string) (*DatasetStats, error) {
+
+	var stats *DatasetStats
+	if asOf != "" {
+		day, err := parseDay(asOf)
+		if err != nil {
+			return nil, err
+		}
+		stats, err = collectDatasetStatsAsOf(store, cfg.Snapshots(), day,
+			maxAccounts)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		stats, err = collectDatasetStats(store, index, maxAccounts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	setDiskSizes(stats, cfg)
+	return stats, nil
+}
+
+func statsFn(cfg *Config) error {
+	var stats *DatasetStats
+	if *serverURL != "" {
+		client, err := NewRemoteClient(*serverURL, cfg.SessionToken())
+		if err != nil {
+			return err
+		}
+		stats, err = client.Stats(*statsAccounts, *statsAsOf)
+		if err != nil {
+			return err
+		}
+	} else {
+		store, err := OpenStoreReadOnly(cfg.Store())
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+		var index bleve.Index
+		ok, err := isFile(cfg.Index())
+		if err != nil {
+			return err
+		}
+		if ok {
+			index, err = OpenOfferIndexReadOnly(cfg.Index())
+			if err != nil {
+				return err
+			}
+			defer index.Close()
+		}
+		stats, err = collectStats(cfg, store, index, *statsAccounts, *statsAsOf)
+		if err != nil {
+			return err
+		}
+	}
+	if *outputFormat == outputJSON {
+		return writeJsonLine(os.Stdout, stats)
+	}
+	printDatasetStats(os.Stdout, stats)
+	return nil
+}
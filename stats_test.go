@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDatasetStats(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	_, err := env.Store.Delete("apec:1005", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := collectDatasetStats(env.Store, env.Index, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Offers != 5 || stats.DeletedOffers != 1 || stats.Deletions != 1 ||
+		stats.Indexed != 6 || len(stats.Accounts) != 2 || stats.StoreSize != -1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	monthly := 0
+	for _, m := range stats.Monthly {
+		monthly += m.Count
+	}
+	if monthly != stats.Offers || stats.Geocoded > stats.Offers ||
+		stats.WithSalary > stats.Offers ||
+		stats.Accounts[0].Count < stats.Accounts[1].Count {
+		t.Fatalf("inconsistent stats: %+v", stats)
+	}
+
+	setDiskSizes(stats, env.Config)
+	if stats.StoreSize <= 0 || stats.IndexSize <= 0 {
+		t.Fatalf("disk sizes not set: %+v", stats)
+	}
+	buf := &bytes.Buffer{}
+	printDatasetStats(buf, stats)
+	for _, s := range []string{"offers: 5\n", "deleted: 1 offers, 1 deletions\n",
+		"indexed: 6\n", "\ntop accounts:\n"} {
+		if !strings.Contains(buf.String(), s) {
+			t.Fatalf("%q not found in:\n%s", s, buf.String())
+		}
+	}
+}
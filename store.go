@@ -6,19 +6,22 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"expvar"
 	"fmt"
 	"os"
 	"sort"
 	"time"
 
-	"github.com/boltdb/bolt"
 	"github.com/pmezard/apec/jstruct"
 )
 
 type Store struct {
-	db *bolt.DB
+	db kvDB
 }
 
+// Offers operations counters, of every store of the process
+var storeStats = expvar.NewMap("store")
+
 var (
 	metaBucket         = []byte("meta")
 	offersBucket       = []byte("offers")
@@ -27,6 +30,19 @@ var (
 	locationsBucket    = []byte("locations")
 	offerDatesBucket   = []byte("dates")
 	initialDatesBucket = []byte("initialdates")
+	schemaBucket       = []byte("schema")
+	htmlBucket         = []byte("html")
+	geocodingBucket    = []byte("geocoding")
+	transitBucket      = []byte("transit")
+	areasBucket        = []byte("areas")
+	tagsBucket         = []byte("tags")
+	auditBucket        = []byte("audit")
+	quarantineBucket   = []byte("quarantine")
+	searchesBucket     = []byte("searches")
+	// Content hash to the content hash keying its offer dates
+	offerChainsBucket = []byte("chains")
+	// Simhash band, content hash to simhash and account
+	simhashesBucket = []byte("simhashes")
 
 	buckets = [][]byte{
 		metaBucket,
@@ -36,9 +52,20 @@ var (
 		locationsBucket,
 		offerDatesBucket,
 		initialDatesBucket,
+		schemaBucket,
+		htmlBucket,
+		geocodingBucket,
+		transitBucket,
+		areasBucket,
+		tagsBucket,
+		auditBucket,
+		quarantineBucket,
+		searchesBucket,
+		offerChainsBucket,
+		simhashesBucket,
 	}
 
-	storeVersion = 3
+	storeVersion = 4
 )
 
 func isFile(path string) (bool, error) {
@@ -52,12 +79,22 @@ func isFile(path string) (bool, error) {
 	return true, nil
 }
 
+// UpgradeStore opens the store at path, creating it with the backend of its
+// store.json if missing, and adds missing buckets.
 func UpgradeStore(path string) (*Store, error) {
 	exists, err := isFile(path)
 	if err != nil {
 		return nil, err
 	}
-	db, err := bolt.Open(path, 0666, nil)
+	backend := boltBackend
+	if !exists {
+		cfg, err := loadStoreConfig(storeConfigPath(path))
+		if err != nil {
+			return nil, err
+		}
+		backend = cfg.Backend
+	}
+	db, err := openKV(path, backend, false)
 	if err != nil {
 		return nil, err
 	}
@@ -69,7 +106,7 @@ func UpgradeStore(path string) (*Store, error) {
 	store := &Store{
 		db: db,
 	}
-	err = store.db.Update(func(tx *bolt.Tx) error {
+	err = store.db.Update(func(tx kvTx) error {
 		for _, bucket := range buckets {
 			_, err := tx.CreateBucketIfNotExists(bucket)
 			if err != nil {
@@ -78,6 +115,9 @@ func UpgradeStore(path string) (*Store, error) {
 		}
 		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
 	if !exists {
 		err = store.SetVersion(storeVersion)
 		if err != nil {
@@ -110,6 +150,30 @@ func OpenStore(dir string) (*Store, error) {
 	return store, nil
 }
 
+// OpenStoreReadOnly opens the store at path for reading, like published
+// replicas, or commands which only read it. Store updates fail. Readers can
+// share the store with each other, and with a writer like a running "apec
+// web" if it is a SQLite store.
+func OpenStoreReadOnly(path string) (*Store, error) {
+	db, err := openKV(path, boltBackend, true)
+	if err != nil {
+		return nil, err
+	}
+	store := &Store{
+		db: db,
+	}
+	version, err := store.Version()
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	if version != storeVersion {
+		store.Close()
+		return nil, fmt.Errorf("expected store version %d, got %d", storeVersion, version)
+	}
+	return store, nil
+}
+
 func (s *Store) Close() error {
 	return s.db.Close()
 }
@@ -118,7 +182,40 @@ func (s *Store) Path() string {
 	return s.db.Path()
 }
 
-func (s *Store) getJson(tx *bolt.Tx, bucket []byte, key []byte,
+// Backend returns the storage backend of the store, bolt or sqlite.
+func (s *Store) Backend() string {
+	return s.db.Backend()
+}
+
+// Compact writes a compacted copy of the store at path, which must not exist.
+func (s *Store) Compact(path string) error {
+	return s.CopyTo(path, s.Backend())
+}
+
+// CopyTo writes a copy of the store at path, which must not exist, with the
+// specified backend. Bucket sequences are preserved so deleted offer
+// identifiers remain valid.
+func (s *Store) CopyTo(path, backend string) error {
+	exists, err := isFile(path)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("cannot copy store, %s already exists", path)
+	}
+	db, err := openKV(path, backend, false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	err = copyKV(s.db, db)
+	if err != nil {
+		return err
+	}
+	return db.Close()
+}
+
+func (s *Store) getJson(tx kvTx, bucket []byte, key []byte,
 	output interface{}) (bool, error) {
 	data := tx.Bucket(bucket).Get(key)
 	if data == nil {
@@ -127,7 +224,7 @@ func (s *Store) getJson(tx *bolt.Tx, bucket []byte, key []byte,
 	return true, json.Unmarshal(data, output)
 }
 
-func (s *Store) putJson(tx *bolt.Tx, bucket []byte, key []byte,
+func (s *Store) putJson(tx kvTx, bucket []byte, key []byte,
 	input interface{}) error {
 	data, err := json.Marshal(input)
 	if err != nil {
@@ -136,21 +233,65 @@ func (s *Store) putJson(tx *bolt.Tx, bucket []byte, key []byte,
 	return tx.Bucket(bucket).Put(key, data)
 }
 
+// StoreTx exposes Store operations within a single read-write transaction,
+// so compound updates like storing an offer and its dates are atomic. It is
+// only valid during the Store.Update callback.
+type StoreTx struct {
+	s  *Store
+	tx kvTx
+}
+
+// Update runs fn in a read-write transaction, which is committed if fn
+// returns nil and rolled back otherwise.
+func (s *Store) Update(fn func(stx *StoreTx) error) error {
+	return s.db.Update(func(tx kvTx) error {
+		return fn(&StoreTx{s: s, tx: tx})
+	})
+}
+
+func (stx *StoreTx) Put(id string, data []byte) error {
+	storeStats.Add("puts", 1)
+	key := []byte(id)
+	// Invalidate cached location
+	err := stx.tx.Bucket(locationsBucket).Delete(key)
+	if err != nil {
+		return err
+	}
+	return stx.tx.Bucket(offersBucket).Put(key, data)
+}
+
 func (s *Store) Put(id string, data []byte) error {
-	return s.db.Update(func(tx *bolt.Tx) error {
-		key := []byte(id)
-		// Invalidate cached location
-		err := tx.Bucket(locationsBucket).Delete(key)
+	return s.Update(func(stx *StoreTx) error {
+		return stx.Put(id, data)
+	})
+}
+
+// PutMany stores several offers at once, keyed by identifier.
+func (stx *StoreTx) PutMany(offers map[string][]byte) error {
+	for id, data := range offers {
+		err := stx.Put(id, data)
 		if err != nil {
 			return err
 		}
-		return tx.Bucket(offersBucket).Put(key, data)
+	}
+	return nil
+}
+
+// PutMany stores several offers in a single transaction, which is much
+// faster than calling Put for each of them.
+func (s *Store) PutMany(offers map[string][]byte) error {
+	return s.Update(func(stx *StoreTx) error {
+		return stx.PutMany(offers)
 	})
 }
 
+func (stx *StoreTx) Has(id string) bool {
+	return len(stx.tx.Bucket(offersBucket).Get([]byte(id))) > 0
+}
+
 func (s *Store) Has(id string) (bool, error) {
 	ok := false
-	err := s.db.View(func(tx *bolt.Tx) error {
+	err := s.db.View(func(tx kvTx) error {
 		temp := tx.Bucket(offersBucket).Get([]byte(id))
 		ok = len(temp) > 0
 		return nil
@@ -158,9 +299,23 @@ func (s *Store) Has(id string) (bool, error) {
 	return ok, err
 }
 
+// Get returns a copy of offer data, which remains valid after the
+// transaction ends.
+func (stx *StoreTx) Get(id string) []byte {
+	storeStats.Add("gets", 1)
+	var data []byte
+	temp := stx.tx.Bucket(offersBucket).Get([]byte(id))
+	if temp != nil {
+		data = make([]byte, len(temp))
+		copy(data, temp)
+	}
+	return data
+}
+
 func (s *Store) Get(id string) ([]byte, error) {
+	storeStats.Add("gets", 1)
 	var data []byte
-	err := s.db.View(func(tx *bolt.Tx) error {
+	err := s.db.View(func(tx kvTx) error {
 		temp := tx.Bucket(offersBucket).Get([]byte(id))
 		if temp != nil {
 			data = make([]byte, len(temp))
@@ -189,53 +344,324 @@ type deletedOffers struct {
 	Ids []DeletedOffer `json:"ids"`
 }
 
+// Delete moves the live offer to the deleted offers and returns its deleted
+// identifier, or zero if the offer does not exist.
+func (stx *StoreTx) Delete(id string, now time.Time) (uint64, error) {
+	key := []byte(id)
+	data := stx.tx.Bucket(offersBucket).Get(key)
+	if data == nil {
+		return 0, nil
+	}
+	storeStats.Add("deletes", 1)
+	// Move data in "deleted" table
+	deleted := stx.tx.Bucket(deletedBucket)
+	deletedId, err := deleted.NextSequence()
+	if err != nil {
+		return 0, err
+	}
+	err = stx.tx.Bucket(deletedBucket).Put(uintToBytes(deletedId), data)
+	if err != nil {
+		return 0, err
+	}
+	// Update offer id to deleted virtual ids mapping
+	deletedKeys := &deletedOffers{}
+	_, err = stx.s.getJson(stx.tx, deletedKeysBucket, key, deletedKeys)
+	if err != nil {
+		return 0, err
+	}
+	deletedKeys.Ids = append(deletedKeys.Ids, DeletedOffer{
+		Id:   deletedId,
+		Date: now.Format(time.RFC3339),
+	})
+	err = stx.s.putJson(stx.tx, deletedKeysBucket, key, deletedKeys)
+	if err != nil {
+		return 0, err
+	}
+	// Delete cached location
+	err = stx.tx.Bucket(locationsBucket).Delete(key)
+	if err != nil {
+		return 0, err
+	}
+	// Delete the live offer
+	return deletedId, stx.tx.Bucket(offersBucket).Delete(key)
+}
+
 func (s *Store) Delete(id string, now time.Time) (uint64, error) {
 	removedId := uint64(0)
-	err := s.db.Update(func(tx *bolt.Tx) error {
+	err := s.Update(func(stx *StoreTx) error {
+		deletedId, err := stx.Delete(id, now)
+		removedId = deletedId
+		return err
+	})
+	return removedId, err
+}
+
+// Undelete restores the most recently deleted version of an offer and
+// returns its deleted identifier, or zero if the offer was never deleted. It
+// fails if the offer is live. Offer dates are updated accordingly.
+func (s *Store) Undelete(id string) (uint64, error) {
+	restoredId := uint64(0)
+	err := s.db.Update(func(tx kvTx) error {
 		key := []byte(id)
-		data := tx.Bucket(offersBucket).Get(key)
+		if tx.Bucket(offersBucket).Get(key) != nil {
+			return fmt.Errorf("offer %s is not deleted", id)
+		}
+		deletedKeys := &deletedOffers{}
+		ok, err := s.getJson(tx, deletedKeysBucket, key, deletedKeys)
+		if err != nil || !ok || len(deletedKeys.Ids) == 0 {
+			return err
+		}
+		last := deletedKeys.Ids[len(deletedKeys.Ids)-1]
+		deletedKey := uintToBytes(last.Id)
+		data := tx.Bucket(deletedBucket).Get(deletedKey)
 		if data == nil {
-			return nil
+			return fmt.Errorf("deleted version %d of %s is missing", last.Id, id)
 		}
-		// Move data in "deleted" table
-		deleted := tx.Bucket(deletedBucket)
-		deletedId, err := deleted.NextSequence()
+		data = append([]byte{}, data...)
+		js := &jstruct.JsonOffer{}
+		err = json.Unmarshal(data, js)
 		if err != nil {
 			return err
 		}
-		removedId = deletedId
-		err = tx.Bucket(deletedBucket).Put(uintToBytes(deletedId), data)
+		published, err := time.Parse(offerDateLayout, js.Date)
+		if err != nil {
+			return fmt.Errorf("cannot parse offer date: %s", err)
+		}
+		err = tx.Bucket(offersBucket).Put(key, data)
 		if err != nil {
 			return err
 		}
-		// Update offer id to deleted virtual ids mapping
-		deletedKeys := &deletedOffers{}
-		_, err = s.getJson(tx, deletedKeysBucket, key, deletedKeys)
+		err = tx.Bucket(deletedBucket).Delete(deletedKey)
+		if err != nil {
+			return err
+		}
+		deletedKeys.Ids = deletedKeys.Ids[:len(deletedKeys.Ids)-1]
+		if len(deletedKeys.Ids) > 0 {
+			err = s.putJson(tx, deletedKeysBucket, key, deletedKeys)
+		} else {
+			err = tx.Bucket(deletedKeysBucket).Delete(key)
+		}
 		if err != nil {
 			return err
 		}
-		deletedKeys.Ids = append(deletedKeys.Ids, DeletedOffer{
-			Id:   deletedId,
-			Date: now.Format(time.RFC3339),
+		// The restored version is live again
+		err = s.updateOfferDates(tx, hashOffer(js), func(ages []OfferAge) []OfferAge {
+			kept := []OfferAge{}
+			for _, a := range ages {
+				if a.Id == id && (a.DeletedId == last.Id || a.DeletedId == 0) {
+					continue
+				}
+				kept = append(kept, a)
+			}
+			return append(kept, OfferAge{
+				Id:              id,
+				PublicationDate: published,
+			})
 		})
-		err = s.putJson(tx, deletedKeysBucket, key, deletedKeys)
 		if err != nil {
 			return err
 		}
-		// Delete cached location
-		err = tx.Bucket(locationsBucket).Delete(key)
+		restoredId = last.Id
+		return nil
+	})
+	return restoredId, err
+}
+
+// PurgeReport describes what Purge removed for a given offer.
+type PurgeReport struct {
+	Live         bool
+	Deleted      int
+	Location     bool
+	InitialDate  bool
+	HTML         bool
+	OfferDates   int
+	RemainingIds []string
+}
+
+// Purge removes every trace of an offer: live and deleted versions, cached
+// location, transit score and area, HTML page, initial date and offer dates
+// records. Initial dates of other offers sharing the same content hash are
+// recomputed. RemainingIds lists those offers.
+func (s *Store) Purge(id string) (*PurgeReport, error) {
+	report := &PurgeReport{}
+	err := s.db.Update(func(tx kvTx) error {
+		key := []byte(id)
+		versions := [][]byte{}
+		data := tx.Bucket(offersBucket).Get(key)
+		if data != nil {
+			report.Live = true
+			versions = append(versions, data)
+		}
+		deletedKeys := &deletedOffers{}
+		_, err := s.getJson(tx, deletedKeysBucket, key, deletedKeys)
+		if err != nil {
+			return err
+		}
+		for _, d := range deletedKeys.Ids {
+			k := uintToBytes(d.Id)
+			data := tx.Bucket(deletedBucket).Get(k)
+			if data != nil {
+				versions = append(versions, data)
+			}
+			err = tx.Bucket(deletedBucket).Delete(k)
+			if err != nil {
+				return err
+			}
+			report.Deleted++
+		}
+		// Remove the offer from content hash groups
+		hashes := map[string]uint64{}
+		chains := map[string]bool{}
+		for _, data := range versions {
+			js := &jstruct.JsonOffer{}
+			if json.Unmarshal(data, js) == nil {
+				hash := hashOffer(js)
+				hashes[hash] = simhashOffer(js)
+				chains[s.getOfferChain(tx, hash)] = true
+			}
+		}
+		for hash := range chains {
+			ages, err := s.getOfferDates(tx, hash)
+			if err != nil {
+				return err
+			}
+			kept := []OfferAge{}
+			for _, a := range ages {
+				if a.Id == id {
+					report.OfferDates++
+					continue
+				}
+				kept = append(kept, a)
+			}
+			if len(kept) == 0 {
+				err = tx.Bucket(offerDatesBucket).Delete([]byte(hash))
+				if err != nil {
+					return err
+				}
+				delete(chains, hash)
+				continue
+			}
+			kept = computeInitialDate(kept)
+			err = s.putOfferDates(tx, hash, kept)
+			if err != nil {
+				return err
+			}
+			for _, a := range kept {
+				if a.DeletedId != 0 {
+					continue
+				}
+				err = s.putInitialDate(tx, a.Id, hash, a.InitialDate)
+				if err != nil {
+					return err
+				}
+				report.RemainingIds = append(report.RemainingIds, a.Id)
+			}
+		}
+		// Contents of emptied chains are forgotten
+		for hash, fingerprint := range hashes {
+			if chains[s.getOfferChain(tx, hash)] {
+				continue
+			}
+			err = s.unlinkOfferHash(tx, hash, fingerprint)
+			if err != nil {
+				return err
+			}
+		}
+		report.Location = tx.Bucket(locationsBucket).Get(key) != nil
+		report.InitialDate = tx.Bucket(initialDatesBucket).Get(key) != nil
+		report.HTML = tx.Bucket(htmlBucket).Get(key) != nil
+		for _, bucket := range [][]byte{deletedKeysBucket, locationsBucket,
+			initialDatesBucket, htmlBucket, geocodingBucket, transitBucket,
+			areasBucket, tagsBucket, offersBucket} {
+			err = tx.Bucket(bucket).Delete(key)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return report, err
+}
+
+// RewriteOffer replaces live and deleted versions of an offer with the output
+// of fn. The cached location and the HTML page, which cannot be rewritten,
+// are removed. It returns the number of rewritten versions.
+func (s *Store) RewriteOffer(id string, fn func(data []byte) ([]byte, error)) (
+	int, error) {
+
+	rewritten := 0
+	err := s.db.Update(func(tx kvTx) error {
+		rewrite := func(bucket kvBucket, key []byte) error {
+			data := bucket.Get(key)
+			if data == nil {
+				return nil
+			}
+			updated, err := fn(data)
+			if err != nil {
+				return err
+			}
+			rewritten++
+			return bucket.Put(key, updated)
+		}
+		key := []byte(id)
+		err := rewrite(tx.Bucket(offersBucket), key)
+		if err != nil {
+			return err
+		}
+		deletedKeys := &deletedOffers{}
+		_, err = s.getJson(tx, deletedKeysBucket, key, deletedKeys)
+		if err != nil {
+			return err
+		}
+		for _, d := range deletedKeys.Ids {
+			err = rewrite(tx.Bucket(deletedBucket), uintToBytes(d.Id))
+			if err != nil {
+				return err
+			}
+		}
+		err = tx.Bucket(htmlBucket).Delete(key)
 		if err != nil {
 			return err
 		}
-		// Delete the live offer
-		return tx.Bucket(offersBucket).Delete(key)
+		return tx.Bucket(locationsBucket).Delete(key)
 	})
-	return removedId, err
+	return rewritten, err
+}
+
+// PutHTML stores the HTML page of an offer. Pages are kept when offers are
+// deleted.
+func (s *Store) PutHTML(id string, data []byte) error {
+	return s.db.Update(func(tx kvTx) error {
+		return tx.Bucket(htmlBucket).Put([]byte(id), data)
+	})
+}
+
+// GetHTML returns the HTML page of an offer, or nil if it was not fetched.
+func (s *Store) GetHTML(id string) ([]byte, error) {
+	var data []byte
+	err := s.db.View(func(tx kvTx) error {
+		temp := tx.Bucket(htmlBucket).Get([]byte(id))
+		if temp != nil {
+			data = make([]byte, len(temp))
+			copy(data, temp)
+		}
+		return nil
+	})
+	return data, err
+}
+
+func (s *Store) HasHTML(id string) (bool, error) {
+	ok := false
+	err := s.db.View(func(tx kvTx) error {
+		ok = tx.Bucket(htmlBucket).Get([]byte(id)) != nil
+		return nil
+	})
+	return ok, err
 }
 
 func (s *Store) ListDeletedIds() ([]string, error) {
 	ids := []string{}
-	err := s.db.View(func(tx *bolt.Tx) error {
+	err := s.db.View(func(tx kvTx) error {
 		deleted := tx.Bucket(deletedKeysBucket)
 		return deleted.ForEach(func(k, v []byte) error {
 			ids = append(ids, string(k))
@@ -247,7 +673,7 @@ func (s *Store) ListDeletedIds() ([]string, error) {
 
 func (s *Store) ListDeletedOffers(id string) ([]DeletedOffer, error) {
 	deletedKeys := &deletedOffers{}
-	err := s.db.View(func(tx *bolt.Tx) error {
+	err := s.db.View(func(tx kvTx) error {
 		deleted := tx.Bucket(deletedKeysBucket)
 		data := deleted.Get([]byte(id))
 		if data == nil {
@@ -260,7 +686,7 @@ func (s *Store) ListDeletedOffers(id string) ([]DeletedOffer, error) {
 
 func (s *Store) GetDeleted(id uint64) ([]byte, error) {
 	var data []byte
-	err := s.db.View(func(tx *bolt.Tx) error {
+	err := s.db.View(func(tx kvTx) error {
 		temp := tx.Bucket(deletedBucket).Get(uintToBytes(id))
 		if temp != nil {
 			data = make([]byte, len(temp))
@@ -273,9 +699,9 @@ func (s *Store) GetDeleted(id uint64) ([]byte, error) {
 
 func (s *Store) List() ([]string, error) {
 	var ids []string
-	err := s.db.View(func(tx *bolt.Tx) error {
+	err := s.db.View(func(tx kvTx) error {
 		bucket := tx.Bucket(offersBucket)
-		size := bucket.Stats().KeyN
+		size := bucket.KeyN()
 		ids = make([]string, 0, size)
 		return bucket.ForEach(func(k, v []byte) error {
 			ids = append(ids, string(k))
@@ -287,65 +713,519 @@ func (s *Store) List() ([]string, error) {
 
 func (s *Store) Size() int {
 	n := 0
-	s.db.View(func(tx *bolt.Tx) error {
-		n = tx.Bucket(offersBucket).Stats().KeyN
+	s.db.View(func(tx kvTx) error {
+		n = tx.Bucket(offersBucket).KeyN()
 		return nil
 	})
 	return n
 }
 
-type storeMeta struct {
-	Version int `json:"version"`
+// SchemaField records when an offer field unknown to jstruct was seen while
+// crawling.
+type SchemaField struct {
+	Path      string    `json:"path"`
+	Count     int       `json:"count"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	FirstId   string    `json:"first_id"`
+	LastId    string    `json:"last_id"`
 }
 
-func (s *Store) Version() (int, error) {
-	version := 0
-	err := s.db.View(func(tx *bolt.Tx) error {
-		meta := &storeMeta{}
-		_, err := s.getJson(tx, metaBucket, []byte("version"), meta)
-		version = meta.Version
-		return err
+// PutSchemaFields records fields paths seen in offer id at specified date.
+func (stx *StoreTx) PutSchemaFields(id string, paths []string, now time.Time) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	for _, path := range paths {
+		field := &SchemaField{}
+		ok, err := stx.s.getJson(stx.tx, schemaBucket, []byte(path), field)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			field.Path = path
+			field.FirstSeen = now
+			field.FirstId = id
+		}
+		field.Count++
+		field.LastSeen = now
+		field.LastId = id
+		err = stx.s.putJson(stx.tx, schemaBucket, []byte(path), field)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) PutSchemaFields(id string, paths []string, now time.Time) error {
+	return s.Update(func(stx *StoreTx) error {
+		return stx.PutSchemaFields(id, paths, now)
 	})
-	return version, err
 }
 
-func (s *Store) SetVersion(version int) error {
-	return s.db.Update(func(tx *bolt.Tx) error {
-		meta := &storeMeta{
-			Version: version,
-		}
-		return s.putJson(tx, metaBucket, []byte("version"), meta)
+func (s *Store) ListSchemaFields() ([]SchemaField, error) {
+	fields := []SchemaField{}
+	err := s.db.View(func(tx kvTx) error {
+		return tx.Bucket(schemaBucket).ForEach(func(k, v []byte) error {
+			field := SchemaField{}
+			err := json.Unmarshal(v, &field)
+			if err != nil {
+				return err
+			}
+			fields = append(fields, field)
+			return nil
+		})
 	})
+	return fields, err
 }
 
-func (s *Store) PutLocation(id string, loc *Location, date time.Time) error {
-	return s.db.Update(func(tx *bolt.Tx) error {
-		k := []byte(id)
-		data := tx.Bucket(offersBucket).Get(k)
-		if data == nil {
-			return fmt.Errorf("cannot add location for unknown offer %s", id)
-		}
+// GeocodingAttempt records when an offer location was last geocoded, its
+// outcome and when it may be retried.
+type GeocodingAttempt struct {
+	Last     time.Time `json:"last"`
+	Count    int       `json:"count"`
+	Outcome  string    `json:"outcome"`
+	Failures int       `json:"failures"`
+	Next     time.Time `json:"next"`
+}
+
+func (s *Store) GetGeocodingAttempt(id string) (*GeocodingAttempt, error) {
+	attempt := &GeocodingAttempt{}
+	err := s.db.View(func(tx kvTx) error {
+		_, err := s.getJson(tx, geocodingBucket, []byte(id), attempt)
+		return err
+	})
+	return attempt, err
+}
+
+func (s *Store) PutGeocodingAttempt(id string, attempt *GeocodingAttempt) error {
+	return s.db.Update(func(tx kvTx) error {
+		return s.putJson(tx, geocodingBucket, []byte(id), attempt)
+	})
+}
 
-		w := bytes.NewBuffer(nil)
-		if loc != nil {
-			err := writeBinaryLocation(w, loc)
+func (s *Store) ListGeocodingAttempts() (map[string]*GeocodingAttempt, error) {
+	attempts := map[string]*GeocodingAttempt{}
+	err := s.db.View(func(tx kvTx) error {
+		return tx.Bucket(geocodingBucket).ForEach(func(k, v []byte) error {
+			attempt := &GeocodingAttempt{}
+			err := json.Unmarshal(v, attempt)
 			if err != nil {
 				return err
 			}
-			ts := date.Unix()
-			err = binary.Write(w, binary.LittleEndian, &ts)
+			attempts[string(k)] = attempt
+			return nil
+		})
+	})
+	return attempts, err
+}
+
+// TransitScore caches the nearest public transport station of an offer
+// location. Lat and Lon are the offer coordinates it was computed for.
+type TransitScore struct {
+	Station  string  `json:"station"`
+	Distance float64 `json:"distance"`
+	Lat      float64 `json:"lat"`
+	Lon      float64 `json:"lon"`
+}
+
+// GetTransitScore returns the cached transit score of an offer, or nil.
+func (s *Store) GetTransitScore(id string) (*TransitScore, error) {
+	var score *TransitScore
+	err := s.db.View(func(tx kvTx) error {
+		sc := &TransitScore{}
+		ok, err := s.getJson(tx, transitBucket, []byte(id), sc)
+		if ok {
+			score = sc
+		}
+		return err
+	})
+	return score, err
+}
+
+// PutTransitScores caches transit scores, in a single transaction.
+func (s *Store) PutTransitScores(scores map[string]*TransitScore) error {
+	return s.db.Update(func(tx kvTx) error {
+		for id, score := range scores {
+			err := s.putJson(tx, transitBucket, []byte(id), score)
 			if err != nil {
 				return err
 			}
 		}
-		return tx.Bucket(locationsBucket).Put(k, w.Bytes())
+		return nil
 	})
 }
 
-func (s *Store) GetLocation(id string) (*Location, time.Time, error) {
-	var p *Location
+// OfferArea caches the department and region of an offer location. Lat and
+// Lon are the offer coordinates they were assigned for.
+type OfferArea struct {
+	Department     string  `json:"department"`
+	DepartmentCode string  `json:"department_code,omitempty"`
+	Region         string  `json:"region"`
+	RegionCode     string  `json:"region_code,omitempty"`
+	Lat            float64 `json:"lat"`
+	Lon            float64 `json:"lon"`
+}
+
+// GetOfferArea returns the cached area of an offer, or nil.
+func (s *Store) GetOfferArea(id string) (*OfferArea, error) {
+	var area *OfferArea
+	err := s.db.View(func(tx kvTx) error {
+		a := &OfferArea{}
+		ok, err := s.getJson(tx, areasBucket, []byte(id), a)
+		if ok {
+			area = a
+		}
+		return err
+	})
+	return area, err
+}
+
+// PutOfferArea caches the area of an offer, or removes it if area is nil.
+func (s *Store) PutOfferArea(id string, area *OfferArea) error {
+	return s.PutOfferAreas(map[string]*OfferArea{id: area})
+}
+
+// PutOfferAreas caches the areas of several offers in one transaction, nil
+// areas are removed.
+func (s *Store) PutOfferAreas(areas map[string]*OfferArea) error {
+	return s.db.Update(func(tx kvTx) error {
+		for id, area := range areas {
+			var err error
+			if area == nil {
+				err = tx.Bucket(areasBucket).Delete([]byte(id))
+			} else {
+				err = s.putJson(tx, areasBucket, []byte(id), area)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetTags returns the sorted tags attached to an offer.
+func (s *Store) GetTags(id string) ([]string, error) {
+	tags := []string{}
+	err := s.db.View(func(tx kvTx) error {
+		_, err := s.getJson(tx, tagsBucket, []byte(id), &tags)
+		return err
+	})
+	return tags, err
+}
+
+// UpdateTags attaches tag to offers ids if add is true, or detaches it, in a
+// single transaction. Unknown offers are ignored. It returns the identifiers
+// of updated offers.
+func (s *Store) UpdateTags(ids []string, tag string, add bool) ([]string, error) {
+	updated := []string{}
+	err := s.db.Update(func(tx kvTx) error {
+		for _, id := range ids {
+			key := []byte(id)
+			if tx.Bucket(offersBucket).Get(key) == nil &&
+				tx.Bucket(deletedKeysBucket).Get(key) == nil {
+				continue
+			}
+			tags := []string{}
+			_, err := s.getJson(tx, tagsBucket, key, &tags)
+			if err != nil {
+				return err
+			}
+			i := sort.SearchStrings(tags, tag)
+			found := i < len(tags) && tags[i] == tag
+			if found == add {
+				continue
+			}
+			if add {
+				tags = append(tags, "")
+				copy(tags[i+1:], tags[i:])
+				tags[i] = tag
+			} else {
+				tags = append(tags[:i], tags[i+1:]...)
+			}
+			if len(tags) == 0 {
+				err = tx.Bucket(tagsBucket).Delete(key)
+			} else {
+				err = s.putJson(tx, tagsBucket, key, tags)
+			}
+			if err != nil {
+				return err
+			}
+			updated = append(updated, id)
+		}
+		return nil
+	})
+	return updated, err
+}
+
+// ListTags returns the number of offers carrying each tag.
+func (s *Store) ListTags() (map[string]int, error) {
+	counts := map[string]int{}
+	err := s.db.View(func(tx kvTx) error {
+		return tx.Bucket(tagsBucket).ForEach(func(k, v []byte) error {
+			tags := []string{}
+			err := json.Unmarshal(v, &tags)
+			if err != nil {
+				return err
+			}
+			for _, tag := range tags {
+				counts[tag]++
+			}
+			return nil
+		})
+	})
+	return counts, err
+}
+
+// AppendAudit records entry in the audit log and sets its identifier.
+// Entries are never updated or removed.
+func (s *Store) AppendAudit(entry *AuditEntry) error {
+	return s.db.Update(func(tx kvTx) error {
+		return appendAuditEntry(tx.Bucket(auditBucket), entry)
+	})
+}
+
+// ListAudit returns at most max audit entries older than before, most
+// recent first. before and max are ignored when zero.
+func (s *Store) ListAudit(before uint64, max int) ([]*AuditEntry, error) {
+	var entries []*AuditEntry
+	err := s.db.View(func(tx kvTx) error {
+		var err error
+		entries, err = listAuditEntries(tx.Bucket(auditBucket), before, max)
+		return err
+	})
+	return entries, err
+}
+
+// PutSavedSearch stores search, assigning its identifier if zero.
+func (s *Store) PutSavedSearch(search *SavedSearch) error {
+	return s.db.Update(func(tx kvTx) error {
+		if search.Id == 0 {
+			id, err := tx.Bucket(searchesBucket).NextSequence()
+			if err != nil {
+				return err
+			}
+			search.Id = id
+		}
+		return s.putJson(tx, searchesBucket, uintToBytes(search.Id), search)
+	})
+}
+
+// GetSavedSearch returns saved search id, or nil.
+func (s *Store) GetSavedSearch(id uint64) (*SavedSearch, error) {
+	var search *SavedSearch
+	err := s.db.View(func(tx kvTx) error {
+		saved := &SavedSearch{}
+		ok, err := s.getJson(tx, searchesBucket, uintToBytes(id), saved)
+		if ok {
+			search = saved
+		}
+		return err
+	})
+	return search, err
+}
+
+// UpdateSavedSearch applies update to saved search id and stores it, unless
+// it was deleted meanwhile.
+func (s *Store) UpdateSavedSearch(id uint64,
+	update func(search *SavedSearch) error) error {
+
+	return s.db.Update(func(tx kvTx) error {
+		key := uintToBytes(id)
+		search := &SavedSearch{}
+		ok, err := s.getJson(tx, searchesBucket, key, search)
+		if err != nil || !ok {
+			return err
+		}
+		err = update(search)
+		if err != nil {
+			return err
+		}
+		return s.putJson(tx, searchesBucket, key, search)
+	})
+}
+
+// DeleteSavedSearch removes saved search id and returns true if it existed.
+func (s *Store) DeleteSavedSearch(id uint64) (bool, error) {
+	found := false
+	err := s.db.Update(func(tx kvTx) error {
+		key := uintToBytes(id)
+		b := tx.Bucket(searchesBucket)
+		found = b.Get(key) != nil
+		return b.Delete(key)
+	})
+	return found, err
+}
+
+// ListSavedSearches returns the searches saved by email, or all of them if
+// email is empty, by increasing identifier.
+func (s *Store) ListSavedSearches(email string) ([]*SavedSearch, error) {
+	searches := []*SavedSearch{}
+	err := s.db.View(func(tx kvTx) error {
+		return tx.Bucket(searchesBucket).ForEach(func(k, v []byte) error {
+			search := &SavedSearch{}
+			err := json.Unmarshal(v, search)
+			if err != nil {
+				return err
+			}
+			if email == "" || search.Email == email {
+				searches = append(searches, search)
+			}
+			return nil
+		})
+	})
+	sort.Sort(sortedSavedSearches(searches))
+	return searches, err
+}
+
+// QuarantinedOffer is a fetched offer which was not stored because it
+// looked invalid. Data holds its first bytes.
+type QuarantinedOffer struct {
+	Id     string    `json:"id"`
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason"`
+	Data   []byte    `json:"data"`
+}
+
+// PutQuarantined records offer in quarantine, replacing previous entries of
+// the same offer.
+func (s *Store) PutQuarantined(offer *QuarantinedOffer) error {
+	data, err := json.Marshal(offer)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx kvTx) error {
+		return tx.Bucket(quarantineBucket).Put([]byte(offer.Id), data)
+	})
+}
+
+// IsQuarantined returns true if offer id is quarantined.
+func (s *Store) IsQuarantined(id string) (bool, error) {
+	ok := false
+	err := s.db.View(func(tx kvTx) error {
+		ok = tx.Bucket(quarantineBucket).Get([]byte(id)) != nil
+		return nil
+	})
+	return ok, err
+}
+
+// ClearQuarantined removes every quarantined offer and returns their number.
+func (s *Store) ClearQuarantined() (int, error) {
+	count := 0
+	err := s.db.Update(func(tx kvTx) error {
+		count = tx.Bucket(quarantineBucket).KeyN()
+		err := tx.DeleteBucket(quarantineBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucket(quarantineBucket)
+		return err
+	})
+	return count, err
+}
+
+// ListQuarantined returns quarantined offers sorted by identifier.
+func (s *Store) ListQuarantined() ([]*QuarantinedOffer, error) {
+	offers := []*QuarantinedOffer{}
+	err := s.db.View(func(tx kvTx) error {
+		return tx.Bucket(quarantineBucket).ForEach(func(k, v []byte) error {
+			offer := &QuarantinedOffer{}
+			err := json.Unmarshal(v, offer)
+			if err != nil {
+				return err
+			}
+			offers = append(offers, offer)
+			return nil
+		})
+	})
+	return offers, err
+}
+
+type storeMeta struct {
+	Version int `json:"version"`
+}
+
+func (s *Store) Version() (int, error) {
+	version := 0
+	err := s.db.View(func(tx kvTx) error {
+		meta := &storeMeta{}
+		_, err := s.getJson(tx, metaBucket, []byte("version"), meta)
+		version = meta.Version
+		return err
+	})
+	return version, err
+}
+
+func (s *Store) SetVersion(version int) error {
+	return s.db.Update(func(tx kvTx) error {
+		meta := &storeMeta{
+			Version: version,
+		}
+		return s.putJson(tx, metaBucket, []byte("version"), meta)
+	})
+}
+
+func (stx *StoreTx) PutLocation(id string, loc *Location, date time.Time) error {
+	k := []byte(id)
+	data := stx.tx.Bucket(offersBucket).Get(k)
+	if data == nil {
+		return fmt.Errorf("cannot add location for unknown offer %s", id)
+	}
+
+	w := bytes.NewBuffer(nil)
+	if loc != nil {
+		err := writeBinaryLocation(w, loc)
+		if err != nil {
+			return err
+		}
+		ts := date.Unix()
+		err = binary.Write(w, binary.LittleEndian, &ts)
+		if err != nil {
+			return err
+		}
+		// Older entries end after the date, the flag is only
+		// written when set.
+		if loc.Nationwide {
+			w.WriteByte(1)
+		}
+	}
+	return stx.tx.Bucket(locationsBucket).Put(k, w.Bytes())
+}
+
+func (s *Store) PutLocation(id string, loc *Location, date time.Time) error {
+	return s.Update(func(stx *StoreTx) error {
+		return stx.PutLocation(id, loc, date)
+	})
+}
+
+// decodeLocation decodes a locations bucket record written by PutLocation.
+func decodeLocation(data []byte) (*Location, time.Time, error) {
+	r := bytes.NewBuffer(data)
+	point, err := readBinaryLocation(r)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	ts := int64(0)
+	err = binary.Read(r, binary.LittleEndian, &ts)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if r.Len() > 0 {
+		flag, err := r.ReadByte()
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		point.Nationwide = flag == 1
+	}
+	return point, time.Unix(ts, 0), nil
+}
+
+func (s *Store) GetLocation(id string) (*Location, time.Time, error) {
+	var p *Location
 	var date time.Time
-	err := s.db.View(func(tx *bolt.Tx) error {
+	err := s.db.View(func(tx kvTx) error {
 		data := tx.Bucket(locationsBucket).Get([]byte(id))
 		if len(data) == 0 {
 			if data != nil {
@@ -353,30 +1233,140 @@ func (s *Store) GetLocation(id string) (*Location, time.Time, error) {
 			}
 			return nil
 		}
-		r := bytes.NewBuffer(data)
-		point, err := readBinaryLocation(r)
+		point, d, err := decodeLocation(data)
 		if err != nil {
 			return err
 		}
-		ts := int64(0)
-		err = binary.Read(r, binary.LittleEndian, &ts)
+		p, date = point, d
+		return nil
+	})
+	return p, date, err
+}
+
+// DeleteLocationsIf removes the cached locations matched by match, so offers
+// get geocoded again, and returns how many were removed.
+func (s *Store) DeleteLocationsIf(match func(loc *Location) bool) (int, error) {
+	removed := 0
+	err := s.db.Update(func(tx kvTx) error {
+		bucket := tx.Bucket(locationsBucket)
+		keys := [][]byte{}
+		err := bucket.ForEach(func(k, v []byte) error {
+			if len(v) == 0 {
+				return nil
+			}
+			loc, _, err := decodeLocation(v)
+			if err != nil {
+				return err
+			}
+			if match(loc) {
+				keys = append(keys, append([]byte{}, k...))
+			}
+			return nil
+		})
 		if err != nil {
 			return err
 		}
-		date = time.Unix(ts, 0)
-		p = point
+		for _, k := range keys {
+			err := bucket.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		removed = len(keys)
 		return nil
 	})
-	return p, date, err
+	return removed, err
 }
 
 func (s *Store) DeleteLocations() error {
-	err := s.db.Update(func(tx *bolt.Tx) error {
+	err := s.db.Update(func(tx kvTx) error {
 		return tx.DeleteBucket(locationsBucket)
 	})
 	return err
 }
 
+// NamespaceOfferIds rewrites offer identifiers without namespace, in keys
+// of buckets indexed by offer and in offer dates and schema fields records,
+// to the APEC namespace. Already namespaced identifiers are left unchanged.
+func (s *Store) NamespaceOfferIds() error {
+	return s.db.Update(func(tx kvTx) error {
+		keyed := [][]byte{offersBucket, deletedKeysBucket, locationsBucket,
+			initialDatesBucket, htmlBucket, geocodingBucket, transitBucket}
+		for _, name := range keyed {
+			b := tx.Bucket(name)
+			keys := [][]byte{}
+			err := b.ForEach(func(k, v []byte) error {
+				if !bytes.Contains(k, []byte(":")) {
+					keys = append(keys, append([]byte{}, k...))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for _, k := range keys {
+				v := append([]byte{}, b.Get(k)...)
+				err = b.Delete(k)
+				if err != nil {
+					return err
+				}
+				err = b.Put([]byte(normalizeOfferId(string(k))), v)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		dates := map[string][]OfferAge{}
+		err := tx.Bucket(offerDatesBucket).ForEach(func(k, v []byte) error {
+			ages := []OfferAge{}
+			err := json.Unmarshal(v, &ages)
+			if err != nil {
+				return err
+			}
+			for i := range ages {
+				ages[i].Id = normalizeOfferId(ages[i].Id)
+			}
+			dates[string(k)] = ages
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for hash, ages := range dates {
+			err = s.putOfferDates(tx, hash, ages)
+			if err != nil {
+				return err
+			}
+		}
+		fields := []SchemaField{}
+		err = tx.Bucket(schemaBucket).ForEach(func(k, v []byte) error {
+			field := SchemaField{}
+			err := json.Unmarshal(v, &field)
+			if err != nil {
+				return err
+			}
+			fields = append(fields, field)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, field := range fields {
+			if field.FirstId != "" {
+				field.FirstId = normalizeOfferId(field.FirstId)
+			}
+			if field.LastId != "" {
+				field.LastId = normalizeOfferId(field.LastId)
+			}
+			err = s.putJson(tx, schemaBucket, []byte(field.Path), &field)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 func hashOffer(js *jstruct.JsonOffer) string {
 	data := []byte(js.Title + js.HTML + js.Location + js.Account + js.Salary)
 	h := md5.Sum(data)
@@ -429,7 +1419,116 @@ func computeInitialDate(ages []OfferAge) []OfferAge {
 	return updated
 }
 
-func (s *Store) getOfferDates(tx *bolt.Tx, hash string) ([]OfferAge, error) {
+// getOfferChain returns the content hash keying the offer dates of contents
+// hashing to hash, which differs for near-duplicates of earlier contents.
+func (s *Store) getOfferChain(tx kvTx, hash string) string {
+	chain := tx.Bucket(offerChainsBucket).Get([]byte(hash))
+	if chain == nil {
+		return hash
+	}
+	return string(chain)
+}
+
+func simhashKey(fingerprint uint64, band int, hash string) []byte {
+	key := make([]byte, 3, 3+len(hash))
+	key[0] = byte(band)
+	binary.BigEndian.PutUint16(key[1:], simhashBand(fingerprint, band))
+	return append(key, hash...)
+}
+
+// LinkOfferHash records contents hashing to hash, published by account and
+// whose simhash is fingerprint, and returns the content hash keying their
+// offer dates. New contents join the chain of their closest near-duplicate
+// published by the same account, if any.
+func (stx *StoreTx) LinkOfferHash(hash string, fingerprint uint64,
+	account string) (string, error) {
+
+	tx := stx.tx
+	chains := tx.Bucket(offerChainsBucket)
+	if chain := chains.Get([]byte(hash)); chain != nil {
+		return string(chain), nil
+	}
+	chain := hash
+	// Contents dated before being fingerprinted keep their own chain
+	if tx.Bucket(offerDatesBucket).Get([]byte(hash)) == nil {
+		best := nearDuplicateDistance + 1
+		c := tx.Bucket(simhashesBucket).Cursor()
+		for band := 0; band < simhashBands; band++ {
+			prefix := simhashKey(fingerprint, band, "")
+			for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+				if len(v) < 8 || string(v[8:]) != account {
+					continue
+				}
+				d := simhashDistance(fingerprint, binary.BigEndian.Uint64(v))
+				if d < best {
+					best = d
+					chain = stx.s.getOfferChain(tx, string(k[len(prefix):]))
+				}
+			}
+		}
+	}
+	err := chains.Put([]byte(hash), []byte(chain))
+	if err != nil {
+		return "", err
+	}
+	value := make([]byte, 8, 8+len(account))
+	binary.BigEndian.PutUint64(value, fingerprint)
+	value = append(value, account...)
+	for band := 0; band < simhashBands; band++ {
+		err = tx.Bucket(simhashesBucket).Put(simhashKey(fingerprint, band, hash),
+			value)
+		if err != nil {
+			return "", err
+		}
+	}
+	return chain, nil
+}
+
+// unlinkOfferHash forgets contents hashing to hash, whose simhash is
+// fingerprint.
+func (s *Store) unlinkOfferHash(tx kvTx, hash string, fingerprint uint64) error {
+	err := tx.Bucket(offerChainsBucket).Delete([]byte(hash))
+	if err != nil {
+		return err
+	}
+	for band := 0; band < simhashBands; band++ {
+		err = tx.Bucket(simhashesBucket).Delete(simhashKey(fingerprint, band, hash))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// linkOfferAge links the content of the offer version dated by age, hashing
+// to hash, and returns the content hash keying its offer dates.
+func (stx *StoreTx) linkOfferAge(hash string, age OfferAge) (string, error) {
+	tx := stx.tx
+	if chain := tx.Bucket(offerChainsBucket).Get([]byte(hash)); chain != nil {
+		return string(chain), nil
+	}
+	var data []byte
+	if age.DeletedId == 0 {
+		data = tx.Bucket(offersBucket).Get([]byte(age.Id))
+	} else {
+		data = tx.Bucket(deletedBucket).Get(uintToBytes(age.DeletedId))
+	}
+	if data == nil {
+		return hash, nil
+	}
+	js := &jstruct.JsonOffer{}
+	err := json.Unmarshal(data, js)
+	if err != nil {
+		return "", err
+	}
+	if hashOffer(js) != hash {
+		return hash, nil
+	}
+	return stx.LinkOfferHash(hash, simhashOffer(js), js.Account)
+}
+
+func (s *Store) getOfferDates(tx kvTx, hash string) ([]OfferAge, error) {
+	hash = s.getOfferChain(tx, hash)
 	data := tx.Bucket(offerDatesBucket).Get([]byte(hash))
 	if data == nil {
 		return nil, nil
@@ -439,7 +1538,20 @@ func (s *Store) getOfferDates(tx *bolt.Tx, hash string) ([]OfferAge, error) {
 	return ages, err
 }
 
-func (s *Store) putOfferDates(tx *bolt.Tx, hash string, ages []OfferAge) error {
+// GetOfferDates returns the publication and deletion dates of live and
+// deleted offers sharing content hash, or near-duplicates of it.
+func (s *Store) GetOfferDates(hash string) ([]OfferAge, error) {
+	var ages []OfferAge
+	err := s.db.View(func(tx kvTx) error {
+		a, err := s.getOfferDates(tx, hash)
+		ages = a
+		return err
+	})
+	return ages, err
+}
+
+func (s *Store) putOfferDates(tx kvTx, hash string, ages []OfferAge) error {
+	hash = s.getOfferChain(tx, hash)
 	data, err := json.Marshal(&ages)
 	if err != nil {
 		return err
@@ -452,7 +1564,7 @@ type InitialDate struct {
 	Hash string    `json:"hash"`
 }
 
-func (s *Store) putInitialDate(tx *bolt.Tx, offerId, hash string, date time.Time) error {
+func (s *Store) putInitialDate(tx kvTx, offerId, hash string, date time.Time) error {
 	data, err := json.Marshal(&InitialDate{
 		Date: date,
 		Hash: hash,
@@ -465,7 +1577,7 @@ func (s *Store) putInitialDate(tx *bolt.Tx, offerId, hash string, date time.Time
 
 func (s *Store) GetInitialDate(offerId string) (time.Time, error) {
 	date := time.Time{}
-	err := s.db.View(func(tx *bolt.Tx) error {
+	err := s.db.View(func(tx kvTx) error {
 		data := tx.Bucket(initialDatesBucket).Get([]byte(offerId))
 		if data == nil {
 			return nil
@@ -481,20 +1593,60 @@ func (s *Store) GetInitialDate(offerId string) (time.Time, error) {
 	return date, err
 }
 
-func (s *Store) PutOfferDate(hash string, age OfferAge) error {
-	return s.db.Update(func(tx *bolt.Tx) error {
-		ages, err := s.getOfferDates(tx, hash)
-		if err != nil {
-			return err
+// updateOfferDates replaces the offer dates of hash with the output of fn,
+// recomputes them and updates live offers initial dates.
+func (s *Store) updateOfferDates(tx kvTx, hash string,
+	fn func(ages []OfferAge) []OfferAge) error {
+
+	hash = s.getOfferChain(tx, hash)
+	ages, err := s.getOfferDates(tx, hash)
+	if err != nil {
+		return err
+	}
+	// Collect active offer initial dates before the update
+	before := map[string]time.Time{}
+	for _, a := range ages {
+		if a.DeletedId != 0 {
+			continue
 		}
-		// Collect active offer initial dates before the update
-		before := map[string]time.Time{}
-		for _, a := range ages {
-			if a.DeletedId != 0 {
-				continue
+		before[a.Id] = a.InitialDate
+	}
+	ages = computeInitialDate(fn(ages))
+	err = s.putOfferDates(tx, hash, ages)
+	if err != nil {
+		return err
+	}
+	// Update or delete offers initial dates
+	for _, a := range ages {
+		if a.DeletedId != 0 {
+			continue
+		}
+		d := before[a.Id]
+		if d.IsZero() || !d.Equal(a.InitialDate) {
+			err = s.putInitialDate(tx, a.Id, hash, a.InitialDate)
+			if err != nil {
+				return err
 			}
-			before[a.Id] = a.InitialDate
 		}
+		delete(before, a.Id)
+	}
+	for id := range before {
+		err = tx.Bucket(initialDatesBucket).Delete([]byte(id))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PutOfferDate adds or replaces age in the offer dates of content hash, or of
+// its closest near-duplicate if the content is new.
+func (stx *StoreTx) PutOfferDate(hash string, age OfferAge) error {
+	chain, err := stx.linkOfferAge(hash, age)
+	if err != nil {
+		return err
+	}
+	return stx.s.updateOfferDates(stx.tx, chain, func(ages []OfferAge) []OfferAge {
 		kept := []OfferAge{}
 		for _, a := range ages {
 			if a.Id == age.Id && a.DeletedId == age.DeletedId {
@@ -502,73 +1654,213 @@ func (s *Store) PutOfferDate(hash string, age OfferAge) error {
 			}
 			kept = append(kept, a)
 		}
-		ages = append(kept, age)
-		ages = computeInitialDate(ages)
-		err = s.putOfferDates(tx, hash, ages)
+		return append(kept, age)
+	})
+}
+
+func (s *Store) PutOfferDate(hash string, age OfferAge) error {
+	return s.Update(func(stx *StoreTx) error {
+		return stx.PutOfferDate(hash, age)
+	})
+}
+
+func (stx *StoreTx) PutOfferDates(hash string, ages []OfferAge) error {
+	hash = stx.s.getOfferChain(stx.tx, hash)
+	ages = computeInitialDate(ages)
+	err := stx.s.putOfferDates(stx.tx, hash, ages)
+	if err != nil {
+		return err
+	}
+	// Update or delete offers initial dates
+	for _, a := range ages {
+		if a.DeletedId != 0 {
+			continue
+		}
+		err = stx.s.putInitialDate(stx.tx, a.Id, hash, a.InitialDate)
 		if err != nil {
 			return err
 		}
-		// Update or delete offers initial dates
-		for _, a := range ages {
-			if a.DeletedId != 0 {
-				continue
-			}
-			d := before[a.Id]
-			if d.IsZero() || !d.Equal(a.InitialDate) {
-				err = s.putInitialDate(tx, a.Id, hash, a.InitialDate)
-				if err != nil {
-					return err
-				}
+	}
+	return nil
+}
+
+func (s *Store) PutOfferDates(hash string, ages []OfferAge) error {
+	return s.Update(func(stx *StoreTx) error {
+		return stx.PutOfferDates(hash, ages)
+	})
+}
+
+// sameOfferAges returns true if a and b list the same versions and dates,
+// ignoring initial dates.
+func sameOfferAges(a, b []OfferAge) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, x := range a {
+		found := false
+		for _, y := range b {
+			if x.Id == y.Id && x.DeletedId == y.DeletedId &&
+				x.PublicationDate.Equal(y.PublicationDate) &&
+				x.DeletionDate.Equal(y.DeletionDate) {
+				found = true
+				break
 			}
-			delete(before, a.Id)
 		}
-		for id := range before {
-			err = tx.Bucket(initialDatesBucket).Delete([]byte(id))
-			if err != nil {
-				return err
-			}
+		if !found {
+			return false
 		}
-		return nil
-	})
+	}
+	return true
 }
 
-func (s *Store) PutOfferDates(hash string, ages []OfferAge) error {
-	return s.db.Update(func(tx *bolt.Tx) error {
-		ages = computeInitialDate(ages)
-		err := s.putOfferDates(tx, hash, ages)
+// RefreshOfferDates recomputes the offer dates of the chains listing the live
+// and deleted versions of offer id, and returns the number of updated
+// chains. Versions which no longer exist or whose content changed are
+// dropped from their chains, current versions are added to the chains of
+// their contents.
+func (stx *StoreTx) RefreshOfferDates(id string) (int, error) {
+	tx := stx.tx
+	key := []byte(id)
+	current := map[string][]OfferAge{}
+	addVersion := func(data []byte, deleted *DeletedOffer) error {
+		js := &jstruct.JsonOffer{}
+		err := json.Unmarshal(data, js)
+		if err != nil {
+			return err
+		}
+		published, err := time.Parse(offerDateLayout, js.Date)
+		if err != nil {
+			return fmt.Errorf("cannot parse offer date: %s", err)
+		}
+		age := OfferAge{
+			Id:              id,
+			PublicationDate: published,
+		}
+		if deleted != nil {
+			date, err := time.Parse(time.RFC3339, deleted.Date)
+			if err != nil {
+				return fmt.Errorf("cannot parse deleted offer date: %s", err)
+			}
+			age.DeletedId = deleted.Id
+			age.DeletionDate = date
+		}
+		chain, err := stx.LinkOfferHash(hashOffer(js), simhashOffer(js),
+			js.Account)
 		if err != nil {
 			return err
 		}
-		// Update or delete offers initial dates
+		current[chain] = append(current[chain], age)
+		return nil
+	}
+	if data := tx.Bucket(offersBucket).Get(key); data != nil {
+		err := addVersion(data, nil)
+		if err != nil {
+			return 0, err
+		}
+	}
+	deletedKeys := &deletedOffers{}
+	_, err := stx.s.getJson(tx, deletedKeysBucket, key, deletedKeys)
+	if err != nil {
+		return 0, err
+	}
+	for i, d := range deletedKeys.Ids {
+		data := tx.Bucket(deletedBucket).Get(uintToBytes(d.Id))
+		if data == nil {
+			continue
+		}
+		err = addVersion(data, &deletedKeys.Ids[i])
+		if err != nil {
+			return 0, err
+		}
+	}
+	// The initial date of the live offer records the chain it was dated in,
+	// maybe with an earlier content. It is refreshed first, so moving to
+	// another chain does not delete the new initial date.
+	chains := []string{}
+	data := tx.Bucket(initialDatesBucket).Get(key)
+	if data != nil {
+		d := &InitialDate{}
+		err := json.Unmarshal(data, d)
+		if err != nil {
+			return 0, fmt.Errorf("could not decode initial date: %s", err)
+		}
+		if _, ok := current[d.Hash]; !ok {
+			chains = append(chains, d.Hash)
+		}
+	}
+	for chain := range current {
+		chains = append(chains, chain)
+	}
+	updated := 0
+	for _, chain := range chains {
+		ages, err := stx.s.getOfferDates(tx, chain)
+		if err != nil {
+			return 0, err
+		}
+		previous := []OfferAge{}
 		for _, a := range ages {
-			if a.DeletedId != 0 {
-				continue
+			if a.Id == id {
+				previous = append(previous, a)
 			}
-			err = s.putInitialDate(tx, a.Id, hash, a.InitialDate)
+		}
+		if sameOfferAges(previous, current[chain]) {
+			continue
+		}
+		kept := []OfferAge{}
+		err = stx.s.updateOfferDates(tx, chain, func(ages []OfferAge) []OfferAge {
+			for _, a := range ages {
+				if a.Id != id {
+					kept = append(kept, a)
+				}
+			}
+			kept = append(kept, current[chain]...)
+			return kept
+		})
+		if err != nil {
+			return 0, err
+		}
+		if len(kept) == 0 {
+			err = tx.Bucket(offerDatesBucket).Delete([]byte(chain))
 			if err != nil {
-				return err
+				return 0, err
 			}
 		}
-		return nil
+		updated++
+	}
+	return updated, nil
+}
+
+func (s *Store) RefreshOfferDates(id string) (int, error) {
+	updated := 0
+	err := s.Update(func(stx *StoreTx) error {
+		n, err := stx.RefreshOfferDates(id)
+		updated = n
+		return err
 	})
+	return updated, err
 }
 
-func (s *Store) RemoveInitialDates() error {
-	return s.db.Update(func(tx *bolt.Tx) error {
-		buckets := [][]byte{initialDatesBucket, offerDatesBucket}
-		for _, bucket := range buckets {
-			b := tx.Bucket(bucket)
-			if b != nil {
-				err := tx.DeleteBucket(bucket)
-				if err != nil {
-					return err
-				}
-			}
-			_, err := tx.CreateBucket(bucket)
+func (stx *StoreTx) RemoveInitialDates() error {
+	buckets := [][]byte{initialDatesBucket, offerDatesBucket, offerChainsBucket,
+		simhashesBucket}
+	for _, bucket := range buckets {
+		b := stx.tx.Bucket(bucket)
+		if b != nil {
+			err := stx.tx.DeleteBucket(bucket)
 			if err != nil {
 				return err
 			}
 		}
-		return nil
+		_, err := stx.tx.CreateBucket(bucket)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) RemoveInitialDates() error {
+	return s.Update(func(stx *StoreTx) error {
+		return stx.RemoveInitialDates()
 	})
 }
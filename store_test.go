@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"expvar"
 	"fmt"
 	"io/ioutil"
 	"path/filepath"
@@ -333,3 +334,358 @@ func TestOfferAge(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestOfferPurge(t *testing.T) {
+	store := openTempStore(t)
+	defer closeAndDeleteStore(t, store)
+
+	now := time.Now()
+	putTestOffer(t, store, "1", "2017-01-01T10:00:00.000+0000")
+	_, err := store.Delete("1", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putTestOffer(t, store, "1", "2017-01-05T10:00:00.000+0000")
+	err = store.PutLocation("1", &Location{City: "Paris"}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := store.Purge("1")
+	if err != nil {
+		t.Fatalf("could not purge offer: %s", err)
+	}
+	if !report.Live || report.Deleted != 1 || !report.Location {
+		t.Fatalf("unexpected purge report: %+v", report)
+	}
+	data, err := store.Get("1")
+	if err != nil || data != nil {
+		t.Fatalf("purged offer is still there: %v, %s", data, err)
+	}
+	deleted, err := store.ListDeletedOffers("1")
+	if err != nil || len(deleted) != 0 {
+		t.Fatalf("purged offer deleted versions are still there: %v, %s", deleted, err)
+	}
+	loc, _, err := store.GetLocation("1")
+	if err != nil || loc != nil {
+		t.Fatalf("purged offer location is still there: %v, %s", loc, err)
+	}
+}
+
+func TestOfferUndelete(t *testing.T) {
+	store := openTempStore(t)
+	defer closeAndDeleteStore(t, store)
+
+	now := time.Now()
+	deleteOffer := func(id string) uint64 {
+		data, err := store.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		deletedId, err := store.Delete(id, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = putOfferDate(store, data, deletedId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return deletedId
+	}
+
+	id, err := store.Undelete("1")
+	if err != nil || id != 0 {
+		t.Fatalf("unknown offer was undeleted: %d, %v", id, err)
+	}
+	putTestOffer(t, store, "1", "2017-01-01T10:00:00.000+0000")
+	_, err = store.Undelete("1")
+	if err == nil {
+		t.Fatalf("live offer was undeleted")
+	}
+	deleteOffer("1")
+	putTestOffer(t, store, "1", "2017-01-05T10:00:00.000+0000")
+	second := deleteOffer("1")
+	initialDate, err := store.GetInitialDate("1")
+	if err != nil || !initialDate.IsZero() {
+		t.Fatalf("deleted offer has an initial date: %s, %v", initialDate, err)
+	}
+
+	id, err = store.Undelete("1")
+	if err != nil || id != second {
+		t.Fatalf("could not undelete offer: %d, %v", id, err)
+	}
+	data, err := store.Get("1")
+	if err != nil || !bytes.Contains(data, []byte("2017-01-05")) {
+		t.Fatalf("unexpected undeleted offer: %s, %v", data, err)
+	}
+	deleted, err := store.ListDeletedOffers("1")
+	if err != nil || len(deleted) != 1 || deleted[0].Id == second {
+		t.Fatalf("unexpected deleted versions: %+v, %v", deleted, err)
+	}
+	data, err = store.GetDeleted(second)
+	if err != nil || data != nil {
+		t.Fatalf("undeleted version is still deleted: %s, %v", data, err)
+	}
+	// Both versions share the same content, the first one was deleted after
+	// the second was published.
+	initialDate, err = store.GetInitialDate("1")
+	if err != nil || initialDate.Format("2006-01-02") != "2017-01-01" {
+		t.Fatalf("unexpected initial date: %s, %v", initialDate, err)
+	}
+
+	// Deleting and undeleting again leaves the first version deleted
+	third := deleteOffer("1")
+	id, err = store.Undelete("1")
+	if err != nil || id != third {
+		t.Fatalf("could not undelete offer again: %d, %v", id, err)
+	}
+	deleted, err = store.ListDeletedOffers("1")
+	if err != nil || len(deleted) != 1 {
+		t.Fatalf("unexpected deleted versions: %+v, %v", deleted, err)
+	}
+}
+
+func TestRefreshOfferDates(t *testing.T) {
+	store := openTempStore(t)
+	defer closeAndDeleteStore(t, store)
+
+	// Stores an offer and returns its content hash
+	put := func(id, title, date string) string {
+		data := []byte(fmt.Sprintf(`{"numeroOffre":%q,"intitule":%q,`+
+			`"datePublication":"%sT10:00:00.000+0000"}`, id, title, date))
+		err := store.Put(makeOfferId(apecSource, id), data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hash, _, err := makeOfferAge(data, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}
+	refresh := func(id string, expected int) {
+		n, err := store.RefreshOfferDates(makeOfferId(apecSource, id))
+		if err != nil || n != expected {
+			t.Fatalf("unexpected %s refreshed groups: %d, %v", id, n, err)
+		}
+	}
+	checkInitialDate := func(id, expected string) {
+		d, err := store.GetInitialDate(makeOfferId(apecSource, id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		date := ""
+		if !d.IsZero() {
+			date = d.Format("2006-01-02")
+		}
+		if date != expected {
+			t.Fatalf("unexpected %s initial date: %q != %q", id, date, expected)
+		}
+	}
+
+	first := put("1", "Développeur Go H/F", "2017-01-01")
+	put("2", "Développeur Go H/F", "2017-01-10")
+	refresh("1", 1)
+	refresh("2", 1)
+	checkInitialDate("2", "2017-01-01")
+	refresh("2", 0)
+
+	// Edited offers move to the group of their new content
+	put("2", "Chef de projet H/F", "2017-01-10")
+	refresh("2", 2)
+	checkInitialDate("2", "2017-01-10")
+	ages, err := store.GetOfferDates(first)
+	if err != nil || len(ages) != 1 {
+		t.Fatalf("unexpected offer dates: %+v, %v", ages, err)
+	}
+
+	// Deleted offers lose their initial date
+	_, err = store.Delete(makeOfferId(apecSource, "1"), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	refresh("1", 1)
+	refresh("1", 0)
+	checkInitialDate("1", "")
+	ages, err = store.GetOfferDates(first)
+	if err != nil || len(ages) != 1 || ages[0].DeletedId == 0 {
+		t.Fatalf("unexpected offer dates: %+v, %v", ages, err)
+	}
+}
+
+func TestStoreUpdate(t *testing.T) {
+	store := openTempStore(t)
+	defer closeAndDeleteStore(t, store)
+
+	now := time.Now()
+	putTestOffer(t, store, "1", "2017-01-01T10:00:00.000+0000")
+	data, err := store.Get("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Failed updates are rolled back
+	err = store.Update(func(stx *StoreTx) error {
+		_, err := stx.Delete("1", now)
+		if err != nil {
+			return err
+		}
+		return stx.PutLocation("1", &Location{City: "Paris"}, now)
+	})
+	if err == nil {
+		t.Fatalf("location of deleted offer was stored")
+	}
+	if ok, err := store.Has("1"); err != nil || !ok {
+		t.Fatalf("failed update deleted the offer: %v, %v", ok, err)
+	}
+
+	err = store.Update(func(stx *StoreTx) error {
+		if !bytes.Equal(stx.Get("1"), data) {
+			t.Fatalf("unexpected offer data: %s", stx.Get("1"))
+		}
+		deletedId, err := stx.Delete("1", now)
+		if err != nil {
+			return err
+		}
+		hash, age, err := makeOfferAge(data, deletedId)
+		if err != nil {
+			return err
+		}
+		return stx.PutOfferDate(hash, age)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := store.Has("1"); err != nil || ok {
+		t.Fatalf("offer was not deleted: %v, %v", ok, err)
+	}
+	deleted, err := store.ListDeletedOffers("1")
+	if err != nil || len(deleted) != 1 {
+		t.Fatalf("unexpected deleted offers: %v, %v", deleted, err)
+	}
+}
+
+func TestOfferPutMany(t *testing.T) {
+	store := openTempStore(t)
+	defer closeAndDeleteStore(t, store)
+
+	putTestOffer(t, store, "1", "2017-01-01T10:00:00.000+0000")
+	err := store.PutLocation("1", &Location{City: "Paris"}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.PutMany(map[string][]byte{
+		"1": []byte("one"),
+		"2": []byte("two"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := store.List()
+	if err != nil || fmt.Sprint(ids) != "[1 2]" {
+		t.Fatalf("unexpected offers: %v, %v", ids, err)
+	}
+	data, err := store.Get("1")
+	if err != nil || string(data) != "one" {
+		t.Fatalf("offer was not replaced: %s, %v", data, err)
+	}
+	loc, _, err := store.GetLocation("1")
+	if err != nil || loc != nil {
+		t.Fatalf("cached location was not invalidated: %v, %v", loc, err)
+	}
+}
+
+// statsCounter returns the value of counter name of stats, or zero.
+func statsCounter(stats *expvar.Map, name string) int64 {
+	v, ok := stats.Get(name).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return v.Value()
+}
+
+func TestStoreStats(t *testing.T) {
+	store := openTempStore(t)
+	defer closeAndDeleteStore(t, store)
+
+	counters := []string{"gets", "puts", "deletes"}
+	before := map[string]int64{}
+	for _, name := range counters {
+		before[name] = statsCounter(storeStats, name)
+	}
+	err := store.PutMany(map[string][]byte{
+		"1": []byte("one"),
+		"2": []byte("two"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"1", "3"} {
+		_, err = store.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Missing offers are not counted as deleted
+	for _, id := range []string{"2", "3"} {
+		_, err = store.Delete(id, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := map[string]int64{"gets": 2, "puts": 2, "deletes": 1}
+	for _, name := range counters {
+		if n := statsCounter(storeStats, name) - before[name]; n != expected[name] {
+			t.Fatalf("unexpected %s counter: %d", name, n)
+		}
+	}
+}
+
+func TestClearCentroidLocations(t *testing.T) {
+	store := openTempStore(t)
+	path := store.Path()
+
+	now := time.Now()
+	centroid := franceCentroid
+	locs := map[string]*Location{
+		"1": &centroid,
+		"2": {City: "Paris", Country: "France", Lat: 48.8566, Lon: 2.3522},
+		"3": {Country: "France", Nationwide: true},
+		"4": nil,
+	}
+	for id, loc := range locs {
+		err := store.Put(id, []byte("dummy"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.PutLocation(id, loc, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = clearCentroidLocations(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err = OpenStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeAndDeleteStore(t, store)
+	for _, id := range []string{"1", "2", "3", "4"} {
+		loc, date, err := store.GetLocation(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cleared := loc == nil && date.IsZero()
+		if cleared != (id == "1") {
+			t.Fatalf("%s: unexpected location: %+v at %s", id, loc, date)
+		}
+		if id == "3" && (loc == nil || !loc.Nationwide) {
+			t.Fatalf("nationwide location was lost: %+v", loc)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/blevesearch/bleve"
+)
+
+// Search form "what" field is completed with indexed words and job titles
+// starting with the typed text. Words come from the exact title and
+// description term dictionaries, job titles from a keyword field holding
+// normalized offers titles. Both are ranked by documents frequencies as
+// recorded at index time, so suggestions cost no document search.
+
+const (
+	defaultSuggestSize = 10
+	maxSuggestSize     = 50
+)
+
+var (
+	// Gender marks trailing most titles, like "H/F" or "(F/H)"
+	reTitleGender = regexp.MustCompile(`(?i)[\s(\[-]*\b[hf]\s*/\s*[hf]\b[\s)\]]*$`)
+)
+
+// jobTitleField is the name of the field indexing normalized offers titles,
+// see normalizeJobTitle.
+const jobTitleField = "job_title"
+
+// normalizeJobTitle returns title lowercased, without gender marks and with
+// spaces collapsed, so reposts of the same job have the same indexed title.
+func normalizeJobTitle(title string) string {
+	title = reTitleGender.ReplaceAllString(title, "")
+	return strings.ToLower(strings.Join(strings.Fields(title), " "))
+}
+
+// Suggestion is a completion of the "what" field, and the number of indexed
+// offers it was found in.
+type Suggestion struct {
+	Text  string `json:"text"`
+	Count uint64 `json:"count"`
+}
+
+type sortedSuggestions []Suggestion
+
+func (s sortedSuggestions) Len() int {
+	return len(s)
+}
+
+func (s sortedSuggestions) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s sortedSuggestions) Less(i, j int) bool {
+	if s[i].Count != s[j].Count {
+		return s[i].Count > s[j].Count
+	}
+	return s[i].Text < s[j].Text
+}
+
+// listFieldTerms adds to counts the terms of field dictionary starting with
+// prefix, keeping the highest count of terms indexed in several fields.
+func listFieldTerms(index bleve.Index, field, prefix string,
+	counts map[string]uint64) error {
+
+	dict, err := index.FieldDictPrefix(field, []byte(prefix))
+	if err != nil {
+		return err
+	}
+	defer dict.Close()
+	for {
+		entry, err := dict.Next()
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			break
+		}
+		if entry.Count > counts[entry.Term] {
+			counts[entry.Term] = entry.Count
+		}
+	}
+	return nil
+}
+
+// suggestTerms returns at most size completions of the last word of text,
+// preceded by the other words of text. Stop words are skipped.
+func suggestTerms(index bleve.Index, text string, size int) (
+	[]Suggestion, error) {
+
+	head, word := "", text
+	if n := strings.LastIndexAny(text, " \t'’"); n >= 0 {
+		_, width := utf8.DecodeRuneInString(text[n:])
+		head, word = text[:n+width], text[n+width:]
+	}
+	word = strings.ToLower(word)
+	if len([]rune(word)) < minPrefixLength {
+		return nil, nil
+	}
+	counts := map[string]uint64{}
+	for _, field := range []string{exactField("title"), exactField("html")} {
+		err := listFieldTerms(index, field, word, counts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	terms := []Suggestion{}
+	for term, count := range counts {
+		if count > 0 {
+			terms = append(terms, Suggestion{Text: term, Count: count})
+		}
+	}
+	sort.Sort(sortedSuggestions(terms))
+	analyzer := index.Mapping().AnalyzerNamed("fr")
+	if analyzer == nil {
+		return nil, fmt.Errorf("unknown analyzer: fr")
+	}
+	suggestions := []Suggestion{}
+	for _, term := range terms {
+		if len(suggestions) >= size {
+			break
+		}
+		if len(analyzer.Analyze([]byte(term.Text))) == 0 {
+			continue
+		}
+		term.Text = head + term.Text
+		suggestions = append(suggestions, term)
+	}
+	return suggestions, nil
+}
+
+// suggestJobTitles returns at most size job titles starting with text.
+func suggestJobTitles(index bleve.Index, text string, size int) (
+	[]Suggestion, error) {
+
+	prefix := normalizeJobTitle(text)
+	if len([]rune(prefix)) < minPrefixLength {
+		return nil, nil
+	}
+	counts := map[string]uint64{}
+	err := listFieldTerms(index, jobTitleField, prefix, counts)
+	if err != nil {
+		return nil, err
+	}
+	titles := []Suggestion{}
+	for title, count := range counts {
+		if count > 0 {
+			titles = append(titles, Suggestion{Text: title, Count: count})
+		}
+	}
+	sort.Sort(sortedSuggestions(titles))
+	if len(titles) > size {
+		titles = titles[:size]
+	}
+	return titles, nil
+}
+
+// handleSuggest writes as JSON the most frequent indexed words and job titles
+// completing the "q" parameter, at most "size" of each.
+func handleSuggest(index bleve.Index, w http.ResponseWriter,
+	r *http.Request) error {
+
+	text := strings.TrimLeft(r.FormValue("q"), " \t")
+	size := defaultSuggestSize
+	if s := r.FormValue("size"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > maxSuggestSize {
+			return fmt.Errorf("invalid size, must be in 1-%d: %q",
+				maxSuggestSize, s)
+		}
+		size = n
+	}
+	terms, err := suggestTerms(index, text, size)
+	if err != nil {
+		return err
+	}
+	titles, err := suggestJobTitles(index, text, size)
+	if err != nil {
+		return err
+	}
+	if terms == nil {
+		terms = []Suggestion{}
+	}
+	if titles == nil {
+		titles = []Suggestion{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(&struct {
+		Query  string       `json:"q"`
+		Terms  []Suggestion `json:"terms"`
+		Titles []Suggestion `json:"titles"`
+	}{
+		Query:  text,
+		Terms:  terms,
+		Titles: titles,
+	})
+}
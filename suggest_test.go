@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestNormalizeJobTitle(t *testing.T) {
+	for _, test := range []struct {
+		Title    string
+		Expected string
+	}{
+		{"Développeur Go H/F", "développeur go"},
+		{"Chef de  projet (F/H)", "chef de projet"},
+		{"Architecte - h / f", "architecte"},
+		{"Chef", "chef"},
+	} {
+		title := normalizeJobTitle(test.Title)
+		if title != test.Expected {
+			t.Fatalf("%q: expected %q, got %q", test.Title, test.Expected, title)
+		}
+	}
+}
+
+func formatSuggestions(suggestions []Suggestion) string {
+	s := []string{}
+	for _, sg := range suggestions {
+		s = append(s, fmt.Sprintf("%s:%d", sg.Text, sg.Count))
+	}
+	return fmt.Sprint(s)
+}
+
+func TestSuggest(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	for _, test := range []struct {
+		Query  string
+		Terms  string
+		Titles string
+	}{
+		{"pyth", "[python:4]", "[]"},
+		{"dév", "[développerez:2 développeur:2]", "[développeur go:1 développeur python:1]"},
+		{"Développeur P", "[]", "[développeur python:1]"},
+		{"Développeur py", "[Développeur python:4]", "[développeur python:1]"},
+		{"vous d", "[]", "[]"},
+		{"de", "[]", "[]"},
+		{"golang", "[golang:1]", "[]"},
+	} {
+		terms, err := suggestTerms(env.Index, test.Query, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := formatSuggestions(terms); s != test.Terms {
+			t.Fatalf("%q: expected terms %s, got %s", test.Query, test.Terms, s)
+		}
+		titles, err := suggestJobTitles(env.Index, test.Query, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := formatSuggestions(titles); s != test.Titles {
+			t.Fatalf("%q: expected titles %s, got %s", test.Query, test.Titles, s)
+		}
+	}
+
+	rsp := env.Get(func(w http.ResponseWriter, r *http.Request) {
+		err := handleSuggest(env.Index, w, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}, "/api/suggest", url.Values{"q": {"dév"}, "size": {"1"}})
+	result := &struct {
+		Terms  []Suggestion
+		Titles []Suggestion
+	}{}
+	err := json.Unmarshal(rsp.Body.Bytes(), result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if formatSuggestions(result.Terms) != "[développerez:2]" ||
+		formatSuggestions(result.Titles) != "[développeur go:1]" {
+		t.Fatalf("unexpected suggestions:\n%s", rsp.Body.String())
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pmezard/apec/jstruct"
+)
+
+// Offers survival curves estimate the probability an offer is still online
+// some days after its publication. Deleted offers lifetimes end with their
+// deletion, live offers are censored: they are known to survive until now,
+// not when they will be deleted. Kaplan-Meier estimator accounts for both.
+
+const (
+	survivalByMonth  = "month"
+	survivalByRegion = "region"
+)
+
+// Days at which survival probabilities are reported
+var survivalDays = []int{7, 14, 30, 60, 90}
+
+type offerLifetime struct {
+	Days    int
+	Deleted bool
+}
+
+type sortedLifetimes []offerLifetime
+
+func (s sortedLifetimes) Len() int {
+	return len(s)
+}
+
+func (s sortedLifetimes) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s sortedLifetimes) Less(i, j int) bool {
+	return s[i].Days < s[j].Days
+}
+
+type survivalStep struct {
+	Days     int
+	Survival float64
+}
+
+// estimateSurvival returns Kaplan-Meier survival function steps of
+// lifetimes, which are sorted in place.
+func estimateSurvival(lifetimes []offerLifetime) []survivalStep {
+	sort.Stable(sortedLifetimes(lifetimes))
+	steps := []survivalStep{}
+	survival := 1.0
+	atRisk := len(lifetimes)
+	for i := 0; i < len(lifetimes); {
+		days := lifetimes[i].Days
+		deleted, j := 0, i
+		for ; j < len(lifetimes) && lifetimes[j].Days == days; j++ {
+			if lifetimes[j].Deleted {
+				deleted++
+			}
+		}
+		if deleted > 0 {
+			survival *= 1 - float64(deleted)/float64(atRisk)
+			steps = append(steps, survivalStep{Days: days, Survival: survival})
+		}
+		atRisk -= j - i
+		i = j
+	}
+	return steps
+}
+
+// SurvivalCurve summarizes the survival of a group of offers. Survival
+// holds the probability offers survive survivalDays, or -1 if it is unknown
+// because no offer was observed that long.
+type SurvivalCurve struct {
+	Group    string
+	Offers   int
+	Deleted  int
+	Survival []float64
+	// Median lifetime in days, or -1 if more than half the offers survive
+	Median int
+
+	lifetimes []offerLifetime
+}
+
+func (c *SurvivalCurve) add(l offerLifetime) {
+	c.lifetimes = append(c.lifetimes, l)
+	c.Offers++
+	if l.Deleted {
+		c.Deleted++
+	}
+}
+
+func (c *SurvivalCurve) summarize() {
+	steps := estimateSurvival(c.lifetimes)
+	longest := -1
+	for _, l := range c.lifetimes {
+		if l.Days > longest {
+			longest = l.Days
+		}
+	}
+	c.Survival = nil
+	for _, days := range survivalDays {
+		p := 1.0
+		for _, step := range steps {
+			if step.Days > days {
+				break
+			}
+			p = step.Survival
+		}
+		if days > longest && p > 0 {
+			p = -1
+		}
+		c.Survival = append(c.Survival, p)
+	}
+	c.Median = -1
+	for _, step := range steps {
+		if step.Survival <= 0.5 {
+			c.Median = step.Days
+			break
+		}
+	}
+}
+
+type sortedSurvivalCurves []*SurvivalCurve
+
+func (s sortedSurvivalCurves) Len() int {
+	return len(s)
+}
+
+func (s sortedSurvivalCurves) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s sortedSurvivalCurves) Less(i, j int) bool {
+	return s[i].Group < s[j].Group
+}
+
+type SurvivalReport struct {
+	Query string
+	By    string
+	Date  time.Time
+	// Curves by cohort, and of all offers
+	Groups []*SurvivalCurve
+	All    *SurvivalCurve
+}
+
+type survivalVersion struct {
+	Offer     *jstruct.JsonOffer
+	Published time.Time
+	Lifetime  offerLifetime
+}
+
+// filterOfferVersions returns the versions matching query.
+func filterOfferVersions(versions []*survivalVersion, query string) (
+	[]*survivalVersion, error) {
+
+	if query == "" || len(versions) == 0 {
+		return versions, nil
+	}
+	// Versions of the same offer are indexed under distinct identifiers
+	offers := []*jstruct.JsonOffer{}
+	for i, v := range versions {
+		offer := *v.Offer
+		offer.Id = strconv.Itoa(i)
+		offers = append(offers, &offer)
+	}
+	q, err := makeSearchQuery(query, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	index, err := newMemOfferIndex(offers)
+	if err != nil {
+		return nil, err
+	}
+	defer index.Close()
+	ids, err := searchIds(index, q)
+	if err != nil {
+		return nil, err
+	}
+	matched := []*survivalVersion{}
+	for _, id := range ids {
+		_, n := splitOfferId(id)
+		i, err := strconv.Atoi(n)
+		if err != nil {
+			return nil, err
+		}
+		matched = append(matched, versions[i])
+	}
+	return matched, nil
+}
+
+// collectSurvival estimates the survival of live and deleted offers
+// matching query, grouped by publication month or region. Live offers are
+// censored at now. Offers without cached area are assigned one from areas,
+// which can be nil.
+func collectSurvival(store *Store, areas *Areas, query, by string,
+	now time.Time) (*SurvivalReport, error) {
+
+	versions := []*survivalVersion{}
+	err := enumerateStoredOffers(store, func(offer *jstruct.JsonOffer,
+		do *DeletedOffer) error {
+
+		published, err := time.Parse(offerDateLayout, offer.Date)
+		if err != nil {
+			return fmt.Errorf("cannot parse %s publication date: %s", offer.Id, err)
+		}
+		end := now
+		if do != nil {
+			end, err = time.Parse(time.RFC3339, do.Date)
+			if err != nil {
+				return fmt.Errorf("cannot parse %s deletion date: %s", offer.Id, err)
+			}
+		}
+		days := int(end.Sub(published) / (24 * time.Hour))
+		if days < 0 {
+			days = 0
+		}
+		versions = append(versions, &survivalVersion{
+			Offer:     offer,
+			Published: published,
+			Lifetime:  offerLifetime{Days: days, Deleted: do != nil},
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	versions, err = filterOfferVersions(versions, query)
+	if err != nil {
+		return nil, err
+	}
+	report := &SurvivalReport{
+		Query: query,
+		By:    by,
+		Date:  now,
+		All:   &SurvivalCurve{Group: allRegions},
+	}
+	groups := map[string]*SurvivalCurve{}
+	for _, v := range versions {
+		group := v.Published.Format("2006-01")
+		if by == survivalByRegion {
+			id := makeOfferId(apecSource, v.Offer.Id)
+			area, err := store.GetOfferArea(id)
+			if err != nil {
+				return nil, err
+			}
+			if area == nil {
+				loc, _, err := store.GetLocation(id)
+				if err != nil {
+					return nil, err
+				}
+				area = assignArea(areas, loc)
+			}
+			group = unknownRegion
+			if area != nil && area.Region != "" {
+				group = area.Region
+			}
+		}
+		c := groups[group]
+		if c == nil {
+			c = &SurvivalCurve{Group: group}
+			groups[group] = c
+		}
+		c.add(v.Lifetime)
+		report.All.add(v.Lifetime)
+	}
+	for _, c := range groups {
+		c.summarize()
+		report.Groups = append(report.Groups, c)
+	}
+	sort.Sort(sortedSurvivalCurves(report.Groups))
+	report.All.summarize()
+	return report, nil
+}
+
+func (c *SurvivalCurve) columns() []string {
+	cols := []string{c.Group, strconv.Itoa(c.Offers), strconv.Itoa(c.Deleted)}
+	for _, p := range c.Survival {
+		s := ""
+		if p >= 0 {
+			s = strconv.FormatFloat(100*p, 'f', 0, 64)
+		}
+		cols = append(cols, s)
+	}
+	median := ""
+	if c.Median >= 0 {
+		median = strconv.Itoa(c.Median)
+	}
+	return append(cols, median)
+}
+
+func survivalReportHeader(by string) []string {
+	header := []string{by, "offers", "deleted"}
+	for _, days := range survivalDays {
+		header = append(header, fmt.Sprintf("%dd", days))
+	}
+	return append(header, "median_days")
+}
+
+func writeSurvivalReportCSV(w io.Writer, report *SurvivalReport) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write(survivalReportHeader(report.By))
+	if err != nil {
+		return err
+	}
+	for _, c := range append(report.Groups, report.All) {
+		err = cw.Write(c.columns())
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeSurvivalReportMarkdown(w io.Writer, report *SurvivalReport) error {
+	query := report.Query
+	if query == "" {
+		query = "all offers"
+	}
+	_, err := fmt.Fprintf(w, "# Offers survival by %s: %s\n\n"+
+		"%d offers, %d deleted, as of %s. Columns give the percentage of "+
+		"offers still online after some days, blank when no offer was online "+
+		"that long, and the median lifetime.\n\n", report.By, query,
+		report.All.Offers, report.All.Deleted, report.Date.Format("2006-01-02"))
+	if err != nil {
+		return err
+	}
+	header := survivalReportHeader(report.By)
+	align := []string{"---"}
+	for range header[1:] {
+		align = append(align, "---:")
+	}
+	rows := [][]string{header, align}
+	for _, c := range append(report.Groups, report.All) {
+		cols := c.columns()
+		if c == report.All {
+			cols[0] = "**" + cols[0] + "**"
+		}
+		rows = append(rows, cols)
+	}
+	for _, row := range rows {
+		_, err = fmt.Fprintf(w, "| %s |\n", strings.Join(row, " | "))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var (
+	reportSurvivalCmd = reportCmd.Command("survival",
+		`estimate how long offers stay online
+
+Live and deleted offers matching the query, or all offers, are grouped by
+publication month or region, and the share of them still online after some
+days estimated with Kaplan-Meier estimator. Live offers lifetimes are
+censored at the report date. Reposts are counted as distinct offers.
+`)
+	reportSurvivalQuery = reportSurvivalCmd.Arg("query", "search query").
+				String()
+	reportSurvivalBy = reportSurvivalCmd.Flag("by",
+		"group offers by publication month or region").Default(survivalByMonth).
+		Enum(survivalByMonth, survivalByRegion)
+	reportSurvivalFormat = reportSurvivalCmd.Flag("format",
+		"report format, markdown or csv").Default(reportMarkdown).
+		Enum(reportMarkdown, reportCSV)
+)
+
+func reportSurvivalFn(cfg *Config) error {
+	var areas *Areas
+	if *reportSurvivalBy == survivalByRegion {
+		a, err := LoadAreas(cfg.ShapesDir)
+		if err != nil {
+			return err
+		}
+		areas = a
+	}
+	store, err := OpenStore(cfg.Store())
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	report, err := collectSurvival(store, areas, *reportSurvivalQuery,
+		*reportSurvivalBy, time.Now())
+	if err != nil {
+		return err
+	}
+	if *reportSurvivalFormat == reportCSV {
+		return writeSurvivalReportCSV(os.Stdout, report)
+	}
+	return writeSurvivalReportMarkdown(os.Stdout, report)
+}
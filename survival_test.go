@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEstimateSurvival(t *testing.T) {
+	// Censored lifetimes leave the risk set without lowering survival
+	steps := estimateSurvival([]offerLifetime{
+		{10, true}, {3, false}, {5, true}, {10, false}, {5, true}, {20, true},
+	})
+	s := fmt.Sprintf("%v", steps)
+	if s != "[{5 0.6} {10 0.4} {20 0}]" {
+		t.Fatalf("unexpected steps: %s", s)
+	}
+}
+
+func TestSurvivalReport(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	cet := time.FixedZone("CET", 3600)
+	for id, date := range map[string]time.Time{
+		"apec:1001": time.Date(2017, 1, 9, 12, 0, 0, 0, cet),
+		"apec:1002": time.Date(2017, 1, 13, 12, 0, 0, 0, cet),
+	} {
+		_, err := env.Store.Delete(id, date)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Date(2017, 1, 31, 0, 0, 0, 0, time.UTC)
+	for _, test := range []struct {
+		Query    string
+		By       string
+		Expected []string
+	}{
+		{"", survivalByMonth, []string{
+			"[2017-01 6 2 83 67    ]",
+			"[all 6 2 83 67    ]",
+		}},
+		{"python", survivalByMonth, []string{
+			"[2017-01 4 2 75 50    10]",
+			"[all 4 2 75 50    10]",
+		}},
+		{"", survivalByRegion, []string{
+			"[Auvergne-Rhône-Alpes 1 0 100 100    ]",
+			"[Ile-de-France 2 2 50 0 0 0 0 7]",
+			"[Nouvelle-Aquitaine 1 0 100 100    ]",
+			"[unknown 2 0 100 100    ]",
+			"[all 6 2 83 67    ]",
+		}},
+	} {
+		report, err := collectSurvival(env.Store, nil, test.Query, test.By, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows := []string{}
+		for _, c := range append(report.Groups, report.All) {
+			rows = append(rows, fmt.Sprint(c.columns()))
+		}
+		if strings.Join(rows, "\n") != strings.Join(test.Expected, "\n") {
+			t.Fatalf("%q by %s: unexpected report:\n%s", test.Query, test.By,
+				strings.Join(rows, "\n"))
+		}
+	}
+
+	report, err := collectSurvival(env.Store, nil, "python", survivalByMonth, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	err = writeSurvivalReportMarkdown(buf, report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{
+		"# Offers survival by month: python",
+		"| month | offers | deleted | 7d | 14d | 30d | 60d | 90d | median_days |",
+		"| **all** | 4 | 2 | 75 | 50 |  |  |  | 10 |",
+	} {
+		if !strings.Contains(buf.String(), s) {
+			t.Fatalf("%q is missing from report:\n%s", s, buf.String())
+		}
+	}
+}
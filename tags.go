@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Operators can attach tags like "applied" or "scam" to offers. Tags are
+// stored in the store tags bucket, indexed as keywords in the tags field and
+// matched with "tag:applied" query terms.
+
+const (
+	tagField       = "tags"
+	tagQueryPrefix = "tag:"
+	maxTagLength   = 64
+)
+
+var (
+	reTag = regexp.MustCompile(`^[\p{Ll}\p{N}][\p{Ll}\p{N}_-]*$`)
+)
+
+// normalizeTag returns tag in lowercase, or an error if it contains other
+// characters than letters, digits, dashes and underscores.
+func normalizeTag(tag string) (string, error) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if len(tag) > maxTagLength || !reTag.MatchString(tag) {
+		return "", fmt.Errorf("invalid tag: %q", tag)
+	}
+	return tag, nil
+}
+
+// handleAdminTags lists tags and their offer counts on GET. On POST, it
+// attaches tag to offers with action=tag, or detaches it with action=untag.
+// Offers are selected by identifier with id parameters, or by full text
+// query with query, like "python and tag:interesting-team". Updated offers
+// are reindexed.
+func handleAdminTags(store *Store, index *IndexHolder, indexer *Indexer,
+	w http.ResponseWriter, r *http.Request) error {
+
+	if r.Method != "POST" {
+		counts, err := store.ListTags()
+		if err != nil {
+			return err
+		}
+		tags := []string{}
+		for tag := range counts {
+			tags = append(tags, tag)
+		}
+		sort.Strings(tags)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, tag := range tags {
+			_, err = fmt.Fprintf(w, "%s\t%d\n", tag, counts[tag])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	tag, err := normalizeTag(r.FormValue("tag"))
+	if err != nil {
+		return err
+	}
+	action := r.FormValue("action")
+	if action != "tag" && action != "untag" {
+		return fmt.Errorf("unknown action: %q", action)
+	}
+	ids := normalizeOfferIds(r.Form["id"])
+	queryString := strings.TrimSpace(r.FormValue("query"))
+	if queryString != "" {
+		q, err := makeSearchQuery(queryString, nil, nil)
+		if err != nil {
+			return err
+		}
+		matched, err := searchIds(index.Get(), q)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, matched...)
+	}
+	if len(ids) == 0 {
+		return fmt.Errorf("no offer selected, use id or query")
+	}
+	updated, err := store.UpdateTags(ids, tag, action == "tag")
+	if err != nil {
+		return err
+	}
+	queued := []Queued{}
+	for _, id := range updated {
+		queued = append(queued, Queued{Id: id, Op: AddOp})
+	}
+	err = indexer.Enqueue(queued)
+	if err != nil {
+		return err
+	}
+	verb := "tagged"
+	if action == "untag" {
+		verb = "untagged"
+	}
+	msg := fmt.Sprintf("%s: %d offers %s, %d selected", tag, len(updated), verb,
+		len(ids))
+	log.Printf("admin: %s", msg)
+	w.Header().Set("Content-Type", "text/plain")
+	_, err = fmt.Fprintf(w, "OK: %s\n", msg)
+	return err
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeTag(t *testing.T) {
+	tests := []struct {
+		Tag      string
+		Expected string
+	}{
+		{"applied", "applied"},
+		{" Interesting-Team ", "interesting-team"},
+		{"équipe_2", "équipe_2"},
+		{"", ""},
+		{"-scam", ""},
+		{"two words", ""},
+		{"tag:scam", ""},
+		{strings.Repeat("a", maxTagLength+1), ""},
+	}
+	for _, test := range tests {
+		tag, err := normalizeTag(test.Tag)
+		if test.Expected == "" {
+			if err == nil {
+				t.Fatalf("%q: invalid tag accepted: %q", test.Tag, tag)
+			}
+			continue
+		}
+		if err != nil || tag != test.Expected {
+			t.Fatalf("%q: expected %q, got %q, %v", test.Tag, test.Expected, tag, err)
+		}
+	}
+}
+
+func TestHandleAdminTags(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+	queue, err := OpenIndexQueue(env.Config.Queue())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Close()
+	index := NewIndexHolder(env.Index)
+	indexer := &Indexer{
+		store: env.Store,
+		index: index,
+		queue: queue,
+		work:  make(chan bool, 1),
+	}
+
+	post := func(values url.Values) string {
+		rq := httptest.NewRequest("POST", "/tags",
+			strings.NewReader(values.Encode()))
+		rq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		err := handleAdminTags(env.Store, index, indexer, w, rq)
+		if err != nil {
+			return "error: " + err.Error()
+		}
+		for {
+			n, err := indexer.indexSome()
+			if err != nil {
+				t.Fatalf("could not process index queue: %s", err)
+			}
+			if n == 0 {
+				break
+			}
+		}
+		return w.Body.String()
+	}
+	search := func(queryString string) string {
+		q, err := makeSearchQuery(queryString, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids, err := searchIds(env.Index, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(ids)
+		return fmt.Sprint(ids)
+	}
+
+	body := post(url.Values{"tag": {"Interesting"}, "action": {"tag"},
+		"query": {"python"}})
+	if body != "OK: interesting: 4 offers tagged, 4 selected\n" {
+		t.Fatalf("could not tag by query: %s", body)
+	}
+	body = post(url.Values{"tag": {"applied"}, "action": {"tag"},
+		"id": {"1003", "apec:1004", "9999"}})
+	if body != "OK: applied: 2 offers tagged, 3 selected\n" {
+		t.Fatalf("could not tag by identifier: %s", body)
+	}
+	body = post(url.Values{"tag": {"interesting"}, "action": {"untag"},
+		"id": {"1002", "1003"}})
+	if body != "OK: interesting: 1 offers untagged, 2 selected\n" {
+		t.Fatalf("could not untag: %s", body)
+	}
+	tags, err := env.Store.GetTags("apec:1004")
+	if err != nil || fmt.Sprint(tags) != "[applied interesting]" {
+		t.Fatalf("unexpected stored tags: %v, %v", tags, err)
+	}
+
+	for _, test := range []struct {
+		Query    string
+		Expected string
+	}{
+		{"tag:interesting", "[apec:1001 apec:1004 apec:1006]"},
+		{"tag:Applied", "[apec:1003 apec:1004]"},
+		{"tag:applied and not tag:interesting", "[apec:1003]"},
+		{"golang and tag:interesting", "[apec:1001]"},
+		{"tag:scam", "[]"},
+	} {
+		ids := search(test.Query)
+		if ids != test.Expected {
+			t.Fatalf("%s: expected %s, got %s", test.Query, test.Expected, ids)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	err = handleAdminTags(env.Store, index, indexer, w,
+		httptest.NewRequest("GET", "/tags", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Body.String() != "applied\t2\ninteresting\t3\n" {
+		t.Fatalf("unexpected tags listing:\n%s", w.Body.String())
+	}
+
+	for _, values := range []url.Values{
+		{"tag": {"two words"}, "action": {"tag"}, "id": {"1001"}},
+		{"tag": {"scam"}, "action": {"flag"}, "id": {"1001"}},
+		{"tag": {"scam"}, "action": {"tag"}},
+		{"tag": {"scam"}, "action": {"tag"}, "query": {"(python"}},
+	} {
+		body := post(values)
+		if !strings.HasPrefix(body, "error: ") {
+			t.Fatalf("%v: expected an error, got %s", values, body)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"html/template"
+	"io/ioutil"
+	"path/filepath"
+)
+
+// Pages templates are read from web/, unless the templates directory holds
+// one with the same name. Pages include the "header" and "footer" partials,
+// defined in web/partials.tmpl and replaced by header.tmpl and footer.tmpl
+// files of the templates directory, so deployments can brand every page
+// without copying them.
+
+const defaultTemplatesDir = "web"
+
+var templatePartials = []string{"header", "footer"}
+
+type Templates struct {
+	Search      *template.Template
+	Density     *template.Template
+	Departments *template.Template
+	Login       *template.Template
+	Account     *template.Template
+	Offer       *template.Template
+	Alerts      *template.Template
+}
+
+// templatePath returns the path of template name in dir if it exists there,
+// or in the default directory. dir can be empty.
+func templatePath(dir, name string) (string, error) {
+	if dir != "" {
+		path := filepath.Join(dir, name)
+		ok, err := isFile(path)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return path, nil
+		}
+	}
+	return filepath.Join(defaultTemplatesDir, name), nil
+}
+
+// parsePage parses page template name with its partials.
+func parsePage(dir, name string) (*template.Template, error) {
+	path, err := templatePath(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	t, err := template.New(name).ParseFiles(
+		filepath.Join(defaultTemplatesDir, "partials.tmpl"), path)
+	if err != nil {
+		return nil, err
+	}
+	if dir == "" {
+		return t, nil
+	}
+	for _, partial := range templatePartials {
+		path := filepath.Join(dir, partial+".tmpl")
+		ok, err := isFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		_, err = t.New(partial).Parse(string(data))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// loadTemplates parses web pages templates, overridden by those of dir if
+// not empty.
+func loadTemplates(dir string) (*Templates, error) {
+	var err error
+	t := &Templates{}
+	t.Search, err = parsePage(dir, "search.tmpl")
+	if err != nil {
+		return nil, err
+	}
+	t.Density, err = parsePage(dir, "density.tmpl")
+	if err != nil {
+		return nil, err
+	}
+	t.Departments, err = parsePage(dir, "departments.tmpl")
+	if err != nil {
+		return nil, err
+	}
+	t.Login, err = parsePage(dir, "login.tmpl")
+	if err != nil {
+		return nil, err
+	}
+	t.Account, err = parsePage(dir, "account.tmpl")
+	if err != nil {
+		return nil, err
+	}
+	t.Offer, err = parsePage(dir, "offer.tmpl")
+	if err != nil {
+		return nil, err
+	}
+	t.Alerts, err = parsePage(dir, "alerts.tmpl")
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTemplatesOverride(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	dir, err := ioutil.TempDir("", "apec-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, data := range map[string]string{
+		"header.tmpl": `<h1>Jobs board</h1>`,
+		"footer.tmpl": `<p>Contact: {{.What}}</p>`,
+		"login.tmpl":  `custom login {{template "header" .}}`,
+	} {
+		err = ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	path, err := templatePath(dir, "login.tmpl")
+	if err != nil || path != filepath.Join(dir, "login.tmpl") {
+		t.Fatalf("unexpected login template: %s, %v", path, err)
+	}
+	path, err = templatePath(dir, "home.html")
+	if err != nil || path != filepath.Join("web", "home.html") {
+		t.Fatalf("unexpected home page: %s, %v", path, err)
+	}
+
+	// Default partials
+	body := env.Query("python", "").Body.String()
+	if !strings.Contains(body, `<a href=".">Home</a>`) ||
+		strings.Contains(body, "Jobs board") {
+		t.Fatalf("unexpected default header:\n%s", body)
+	}
+
+	env.Templates, err = loadTemplates(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body = env.Query("python", "").Body.String()
+	if !strings.Contains(body, "<h1>Jobs board</h1>") ||
+		!strings.Contains(body, "<p>Contact: python</p>") ||
+		strings.Contains(body, `<a href=".">Home</a>`) {
+		t.Fatalf("partials were not overridden:\n%s", body)
+	}
+	buf := &bytes.Buffer{}
+	err = env.Templates.Login.Execute(buf, nil)
+	if err != nil || buf.String() != "custom login <h1>Jobs board</h1>" {
+		t.Fatalf("login template was not overridden: %q, %v", buf.String(), err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, "footer.tmpl"), []byte("{{"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadTemplates(dir)
+	if err == nil {
+		t.Fatalf("invalid partial was accepted")
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Throttle bounds the number of concurrent executions of an expensive
+// operation, like full text searches or density maps rendering. Callers
+// exceeding the limit wait in line for a while, then are rejected.
+type Throttle struct {
+	slots chan struct{}
+	wait  time.Duration
+	stats *expvar.Map
+}
+
+// NewThrottle returns a Throttle running at most max operations at once,
+// zero meaning no limit. Pending operations wait at most wait before being
+// rejected.
+func NewThrottle(max int, wait time.Duration) *Throttle {
+	t := &Throttle{
+		wait:  wait,
+		stats: new(expvar.Map).Init(),
+	}
+	if max > 0 {
+		t.slots = make(chan struct{}, max)
+	}
+	return t
+}
+
+// Acquire returns true if the operation can proceed, in which case Release
+// must be called once it completes.
+func (t *Throttle) Acquire() bool {
+	if t.slots == nil {
+		t.stats.Add("running", 1)
+		return true
+	}
+	select {
+	case t.slots <- struct{}{}:
+		t.stats.Add("running", 1)
+		return true
+	default:
+	}
+	t.stats.Add("waiting", 1)
+	defer t.stats.Add("waiting", -1)
+	timer := time.NewTimer(t.wait)
+	defer timer.Stop()
+	select {
+	case t.slots <- struct{}{}:
+		t.stats.Add("running", 1)
+		return true
+	case <-timer.C:
+		t.stats.Add("rejected", 1)
+		return false
+	}
+}
+
+func (t *Throttle) Release() {
+	t.stats.Add("running", -1)
+	t.stats.Add("completed", 1)
+	if t.slots != nil {
+		<-t.slots
+	}
+}
+
+// Stats returns running, waiting, completed and rejected operations counters.
+func (t *Throttle) Stats() *expvar.Map {
+	return t.stats
+}
+
+// Throttled wraps handler so it is run when throttle allows it, or replies
+// with a 503 status.
+func Throttled(throttle *Throttle, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !throttle.Acquire() {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Set("Retry-After", fmt.Sprintf("%d",
+				int(throttle.wait/time.Second)+1))
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("error: server is busy, please try again later\n"))
+			return
+		}
+		defer throttle.Release()
+		handler(w, r)
+	}
+}
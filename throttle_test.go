@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestThrottle(t *testing.T) {
+	throttle := NewThrottle(2, 10*time.Millisecond)
+	if !throttle.Acquire() || !throttle.Acquire() {
+		t.Fatalf("could not acquire free slots")
+	}
+	if throttle.Acquire() {
+		t.Fatalf("acquired more slots than allowed")
+	}
+	released := make(chan bool)
+	go func() {
+		time.Sleep(time.Millisecond)
+		throttle.Release()
+		released <- true
+	}()
+	throttle.wait = time.Minute
+	if !throttle.Acquire() {
+		t.Fatalf("could not acquire a released slot")
+	}
+	<-released
+	stats := throttle.Stats()
+	for name, expected := range map[string]string{
+		"running":   "2",
+		"waiting":   "0",
+		"completed": "1",
+		"rejected":  "1",
+	} {
+		if v := stats.Get(name); v == nil || v.String() != expected {
+			t.Fatalf("unexpected %s counter: %v", name, v)
+		}
+	}
+
+	// Handlers are rejected with 503 when busy
+	throttle.wait = 0
+	called := false
+	handler := Throttled(throttle, func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/search", nil))
+	if called || w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("busy handler was not rejected: %d", w.Code)
+	}
+	throttle.Release()
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/search", nil))
+	if !called || w.Code != 200 {
+		t.Fatalf("handler was not called: %d", w.Code)
+	}
+
+	// Zero disables throttling
+	throttle = NewThrottle(0, 0)
+	for i := 0; i < 10; i++ {
+		if !throttle.Acquire() {
+			t.Fatalf("unlimited throttle rejected operation %d", i)
+		}
+	}
+}
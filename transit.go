@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pmezard/rtreego"
+)
+
+// Offers are scored by the distance from their location to the nearest train
+// or metro station, for candidates without a car. Stations are read from a
+// GTFS stops.txt file, the default one only lists main French stations and
+// can be replaced with a complete feed.
+
+const defaultStationsPath = "stations/stops.txt"
+
+type Station struct {
+	Name  string
+	Point Point
+	Loc   rtreego.Rect
+}
+
+func (s *Station) Bounds() *rtreego.Rect {
+	return &s.Loc
+}
+
+type Stations struct {
+	rtree *rtreego.Rtree
+	count int
+}
+
+func NewStations() *Stations {
+	return &Stations{
+		rtree: rtreego.NewTree(2, 25),
+	}
+}
+
+func (s *Stations) Add(name string, lat, lon float64) error {
+	rect, err := rtreego.NewRect(rtreego.Point{lon - locExtent[0]/2, lat - locExtent[1]/2},
+		locExtent)
+	if err != nil {
+		return err
+	}
+	s.rtree.Insert(&Station{
+		Name:  name,
+		Point: Point{Lat: lat, Lon: lon},
+		Loc:   rect,
+	})
+	s.count++
+	return nil
+}
+
+func (s *Stations) Size() int {
+	return s.count
+}
+
+// LoadStations reads stops and stations of a GTFS stops.txt file. Entrances,
+// nodes and boarding areas are ignored.
+func LoadStations(path string) (*Stations, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	r := csv.NewReader(fp)
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s header: %s", path, err)
+	}
+	columns := map[string]int{}
+	for i, h := range header {
+		columns[strings.TrimPrefix(strings.TrimSpace(h), "\ufeff")] = i
+	}
+	for _, c := range []string{"stop_name", "stop_lat", "stop_lon"} {
+		if _, ok := columns[c]; !ok {
+			return nil, fmt.Errorf("%s has no %s column", path, c)
+		}
+	}
+	stations := NewStations()
+	for line := 2; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if i, ok := columns["location_type"]; ok {
+			t := strings.TrimSpace(record[i])
+			if t != "" && t != "0" && t != "1" {
+				continue
+			}
+		}
+		lat, err := strconv.ParseFloat(record[columns["stop_lat"]], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid latitude at %s:%d: %s", path, line, err)
+		}
+		lon, err := strconv.ParseFloat(record[columns["stop_lon"]], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid longitude at %s:%d: %s", path, line, err)
+		}
+		err = stations.Add(record[columns["stop_name"]], lat, lon)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return stations, nil
+}
+
+// loadOptionalStations is LoadStations returning nil stations, disabling
+// transit scoring, if path does not exist.
+func loadOptionalStations(path string) (*Stations, error) {
+	exists, err := isFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		log.Printf("%s not found, transit scoring is disabled", path)
+		return nil, nil
+	}
+	return LoadStations(path)
+}
+
+// geoDistance returns the great-circle distance between a and b in meters.
+func geoDistance(a, b Point) float64 {
+	earth := float64(6371000)
+	rad := math.Pi / 180
+	dlat := (b.Lat - a.Lat) * rad
+	dlon := (b.Lon - a.Lon) * rad
+	h := math.Sin(dlat/2)*math.Sin(dlat/2) +
+		math.Cos(a.Lat*rad)*math.Cos(b.Lat*rad)*math.Sin(dlon/2)*math.Sin(dlon/2)
+	return 2 * earth * math.Asin(math.Sqrt(h))
+}
+
+// Nearest returns the station closest to lat/lon and its distance in meters,
+// or nil if there are no stations.
+func (s *Stations) Nearest(lat, lon float64) (*Station, float64) {
+	if s.count == 0 {
+		return nil, 0
+	}
+	// The rtree works on degrees, longitudes are shorter than latitudes,
+	// take a few candidates and compare actual distances.
+	p := Point{Lat: lat, Lon: lon}
+	var nearest *Station
+	dist := float64(0)
+	for _, c := range s.rtree.NearestNeighbors(8, rtreego.Point{lon, lat}) {
+		if c == nil {
+			continue
+		}
+		st := c.(*Station)
+		d := geoDistance(p, st.Point)
+		if nearest == nil || d < dist {
+			nearest = st
+			dist = d
+		}
+	}
+	return nearest, dist
+}
+
+var (
+	// A station within transitScoreSteps[i] meters scores 5-i
+	transitScoreSteps = []float64{500, 1000, 2000, 5000, 10000}
+)
+
+// Score returns an accessibility score between 0 (no station nearby) and 5.
+func (t *TransitScore) Score() int {
+	for i, d := range transitScoreSteps {
+		if t.Distance <= d {
+			return len(transitScoreSteps) - i
+		}
+	}
+	return 0
+}
+
+func (t *TransitScore) String() string {
+	dist := fmt.Sprintf("%.0fm", t.Distance)
+	if t.Distance >= 1000 {
+		dist = fmt.Sprintf("%.1fkm", t.Distance/1000)
+	}
+	return fmt.Sprintf("transit %d/5: %s, %s", t.Score(), t.Station, dist)
+}
+
+// updateTransitScores computes and caches transit scores of supplied offer
+// locations, unless an up-to-date score is already cached and force is false.
+// It returns the number of computed scores.
+func updateTransitScores(store *Store, stations *Stations, locs []*OfferLoc,
+	force bool) (int, error) {
+
+	scores := map[string]*TransitScore{}
+	for _, loc := range locs {
+		if loc.Nationwide {
+			continue
+		}
+		if !force {
+			cached, err := store.GetTransitScore(loc.Id)
+			if err != nil {
+				return 0, err
+			}
+			if cached != nil && cached.Lat == loc.Point.Lat &&
+				cached.Lon == loc.Point.Lon {
+				continue
+			}
+		}
+		st, dist := stations.Nearest(loc.Point.Lat, loc.Point.Lon)
+		if st == nil {
+			continue
+		}
+		scores[loc.Id] = &TransitScore{
+			Station:  st.Name,
+			Distance: dist,
+			Lat:      loc.Point.Lat,
+			Lon:      loc.Point.Lon,
+		}
+	}
+	return len(scores), store.PutTransitScores(scores)
+}
+
+var (
+	transitCmd = app.Command("transit", `compute public transport accessibility scores
+
+Cache the distance of every located offer to the nearest station. Scores are
+computed when offers are spatially indexed, run it with --force after changing
+the stations file.
+`)
+	transitStations = transitCmd.Flag("stations", "GTFS stops.txt file").
+			Default(defaultStationsPath).String()
+	transitForce = transitCmd.Flag("force", "recompute cached scores").Bool()
+)
+
+func transitFn(cfg *Config) error {
+	stations, err := LoadStations(*transitStations)
+	if err != nil {
+		return err
+	}
+	store, err := OpenStore(cfg.Store())
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	geocoder, err := openGeocoder(cfg)
+	if err != nil {
+		return err
+	}
+	defer geocoder.Close()
+	spatial, err := buildSpatialIndex(store, geocoder)
+	if err != nil {
+		return err
+	}
+	locs := []*OfferLoc{}
+	for _, id := range spatial.List() {
+		locs = append(locs, spatial.Get(id))
+	}
+	n, err := updateTransitScores(store, stations, locs, *transitForce)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d stations, %d scores computed\n", stations.Size(), n)
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestStationsNearest(t *testing.T) {
+	stations, err := LoadStations(defaultStationsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stations.Size() == 0 {
+		t.Fatalf("no station loaded")
+	}
+	tests := []struct {
+		Lat     float64
+		Lon     float64
+		Station string
+		Score   int
+	}{
+		{48.8565056, 2.3521334, "Châtelet-Les Halles", 4},
+		{45.7578137, 4.8320114, "Lyon Perrache", 3},
+		{48.39, -4.47, "Brest", 4},
+		// Morlaix, 50km away from Brest
+		{48.5775, -3.8267, "Brest", 0},
+	}
+	for _, test := range tests {
+		st, dist := stations.Nearest(test.Lat, test.Lon)
+		if st == nil || st.Name != test.Station {
+			t.Fatalf("%v,%v: expected %s, got %+v", test.Lat, test.Lon,
+				test.Station, st)
+		}
+		score := &TransitScore{Station: st.Name, Distance: dist}
+		if score.Score() != test.Score {
+			t.Fatalf("%v,%v: expected score %d, got %s", test.Lat, test.Lon,
+				test.Score, score)
+		}
+	}
+	if d := geoDistance(Point{48.8443, 2.3744}, Point{45.7606, 4.8594}); d < 390000 ||
+		d > 395000 {
+		t.Fatalf("unexpected Paris-Lyon distance: %f", d)
+	}
+}
+
+func TestLoadOptionalStations(t *testing.T) {
+	stations, err := loadOptionalStations("testdata/missing/stops.txt")
+	if err != nil || stations != nil {
+		t.Fatalf("missing stations should disable scoring: %v, %v",
+			stations, err)
+	}
+	stations, err = loadOptionalStations(defaultStationsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stations == nil || stations.Size() == 0 {
+		t.Fatalf("no station loaded from %s", defaultStationsPath)
+	}
+}
+
+func TestSortByTransit(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	stations := NewStations()
+	stations.Add("Paris", 48.86, 2.35)
+	stations.Add("Bordeaux", 44.82, -0.55)
+	locs := []*OfferLoc{}
+	for _, id := range env.Spatial.List() {
+		locs = append(locs, env.Spatial.Get(id))
+	}
+	n, err := updateTransitScores(env.Store, stations, locs, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Lyon is 390km away from any station but still scored
+	if n != 4 {
+		t.Fatalf("unexpected number of computed scores: %d", n)
+	}
+	n, err = updateTransitScores(env.Store, stations, locs, false)
+	if err != nil || n != 0 {
+		t.Fatalf("cached scores were recomputed: %d, %v", n, err)
+	}
+	n, err = updateTransitScores(env.Store, stations, locs, true)
+	if err != nil || n != 4 {
+		t.Fatalf("scores were not recomputed: %d, %v", n, err)
+	}
+
+	values := url.Values{}
+	values.Set("sort", "transit")
+	values.Set("include_remote", "1")
+	w := env.QueryValues(values)
+	body := w.Body.String()
+	if w.Code != 200 {
+		t.Fatalf("query failed with %d: %s", w.Code, body)
+	}
+	// Paris offers are closer than Bordeaux one, then Lyon, then the remote
+	// offer without score.
+	last := -1
+	for _, id := range []string{"1002", "1001", "1004", "1003", "1006"} {
+		i := strings.Index(body, ApecURL+id+`"`)
+		if i < last {
+			t.Fatalf("%s is not sorted by transit distance:\n%s", id, body)
+		}
+		last = i
+	}
+	if !strings.Contains(body, "(transit 5/5: Paris, 419m)") {
+		t.Fatalf("transit score not displayed:\n%s", body)
+	}
+}
@@ -3,23 +3,59 @@ package main
 import (
 	"fmt"
 	"log"
+	"os"
+	"time"
 )
 
 var (
-	upgradeCmd = app.Command("upgrade", "upgrade dataset schema")
+	upgradeCmd = app.Command("upgrade", `upgrade dataset schema
+
+Also migrates the store to the backend configured in the store.json file of
+the data directory, bolt or sqlite.
+`)
+	upgradeGeocoderAccents = upgradeCmd.Flag("geocoder-accents", "fold to "+
+		"make geocoder cache keys ignore diacritics, or keep them, then "+
+		"deduplicate cache entries").Enum("fold", "keep")
 )
 
-func upgradeGeocoderCache(path string) error {
+// upgradeGeocoderCache migrates the geocoder cache to the current version,
+// normalizing its keys, and timestamps entries without result so they expire.
+// accents switches diacritics handling in keys to "fold" or "keep" them,
+// unchanged if empty.
+func upgradeGeocoderCache(path, accents string) error {
+	exists, err := isFile(path)
+	if err != nil || !exists {
+		return err
+	}
 	cache, err := OpenCache(path)
 	if err != nil {
 		return err
 	}
 	defer cache.Close()
+	stamped, err := cache.StampMisses(time.Now())
+	if err != nil {
+		return err
+	}
+	if stamped > 0 {
+		log.Printf("%d geocoder entries without result will expire", stamped)
+	}
 	version, err := cache.Version()
-	if err != nil || version >= geocoderVersion {
+	if err != nil {
 		return err
 	}
+	fold := cache.foldAccents
+	if accents != "" {
+		fold = accents == "fold"
+	}
+	if version >= geocoderVersion && fold == cache.foldAccents {
+		return nil
+	}
 	log.Printf("migrating geocoder from %d to %d", version, geocoderVersion)
+	removed, err := cache.NormalizeKeys(fold)
+	if err != nil {
+		return err
+	}
+	log.Printf("%d duplicate geocoder entries removed", removed)
 	err = cache.SetVersion(geocoderVersion)
 	if err != nil {
 		return err
@@ -84,6 +120,125 @@ func populateStoreLocations(geocoderDir, storeDir string) error {
 	return store.Close()
 }
 
+// namespaceStoreIds migrates store from version 3 to 4, where offer
+// identifiers are namespaced by source. The full text index must be rebuilt
+// afterwards.
+func namespaceStoreIds(storeDir string) error {
+	store, err := UpgradeStore(storeDir)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	version, err := store.Version()
+	if err != nil || version >= 4 {
+		return err
+	}
+	if version < 3 {
+		return fmt.Errorf("cannot migrate store version %d, expected 3", version)
+	}
+	log.Printf("migrating store from %d to %d", version, 4)
+	err = store.NamespaceOfferIds()
+	if err != nil {
+		return err
+	}
+	err = store.SetVersion(4)
+	if err != nil {
+		return err
+	}
+	return store.Close()
+}
+
+// upgradeSnapshots migrates the store snapshots of dir like the live store,
+// so they can still be read by --as-of queries.
+func upgradeSnapshots(dir string) error {
+	paths, err := listSnapshots(dir)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		err = namespaceStoreIds(path)
+		if err != nil {
+			return fmt.Errorf("cannot upgrade snapshot %s: %s", path, err)
+		}
+	}
+	return nil
+}
+
+// clearCentroidLocations removes offers locations cached at franceCentroid.
+// They were nationwide offers geocoded before these were detected, and are
+// marked as such when geocoded again by "apec index".
+func clearCentroidLocations(storeDir string) error {
+	store, err := UpgradeStore(storeDir)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	removed, err := store.DeleteLocationsIf(isFranceCentroid)
+	if err != nil {
+		return err
+	}
+	if removed > 0 {
+		log.Printf("%d locations at France centroid removed, run \"apec "+
+			"index\" to geocode them again", removed)
+	}
+	return store.Close()
+}
+
+// migrateStoreBackend copies the store at path to the backend configured in
+// its store.json, if it uses another one. The previous store is kept next
+// to it, suffixed with its backend name.
+func migrateStoreBackend(path string) error {
+	cfg, err := loadStoreConfig(storeConfigPath(path))
+	if err != nil {
+		return err
+	}
+	backend, err := detectBackend(path)
+	if err != nil || backend == "" || backend == cfg.Backend {
+		return err
+	}
+	backupPath := path + "." + backend
+	exists, err := isFile(backupPath)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("cannot migrate store, %s already exists", backupPath)
+	}
+	store, err := UpgradeStore(path)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	log.Printf("migrating store from %s to %s", backend, cfg.Backend)
+	// Leftovers of an interrupted migration
+	tmpPath := path + ".tmp"
+	for _, p := range []string{tmpPath, tmpPath + "-wal", tmpPath + "-shm"} {
+		err = os.Remove(p)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	err = store.CopyTo(tmpPath, cfg.Backend)
+	if err != nil {
+		return err
+	}
+	err = store.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(path, backupPath)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return err
+	}
+	log.Printf("previous store kept in %s", backupPath)
+	return nil
+}
+
 /*
 func migrateGeocoder(oldDir, newPath string) error {
 	oldCache, err := OpenOldCache(oldDir)
@@ -232,10 +387,6 @@ func migrateStore(oldDir, newPath string) error {
 
 func upgrade(cfg *Config) error {
 	/*
-				err := upgradeGeocoderCache(cfg.Geocoder())
-				if err != nil {
-					return fmt.Errorf("could not upgrade geocoder: %s", err)
-				}
 			err := migrateGeocoder(cfg.Geocoder(), "newgeocoder")
 				err = populateStoreLocations(cfg.Geocoder(), cfg.Store())
 				if err != nil {
@@ -252,5 +403,25 @@ func upgrade(cfg *Config) error {
 					err = migrateStore("offers/offers", "newstore")
 		return err
 	*/
+	err := upgradeGeocoderCache(cfg.Geocoder(), *upgradeGeocoderAccents)
+	if err != nil {
+		return fmt.Errorf("could not upgrade geocoder: %s", err)
+	}
+	err = namespaceStoreIds(cfg.Store())
+	if err != nil {
+		return fmt.Errorf("could not upgrade store: %s", err)
+	}
+	err = upgradeSnapshots(cfg.Snapshots())
+	if err != nil {
+		return fmt.Errorf("could not upgrade store: %s", err)
+	}
+	err = clearCentroidLocations(cfg.Store())
+	if err != nil {
+		return fmt.Errorf("could not upgrade store: %s", err)
+	}
+	err = migrateStoreBackend(cfg.Store())
+	if err != nil {
+		return fmt.Errorf("could not migrate store: %s", err)
+	}
 	return nil
 }
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUpgradeSnapshots(t *testing.T) {
+	archived := openTempStore(t)
+	defer closeAndDeleteStore(t, archived)
+	putTestOffer(t, archived, "1", "2017-01-01T10:00:00.000+0000")
+	err := archived.SetVersion(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "apec-snapshots-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, snapshotName(2017, 2))
+	err = archived.Compact(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = OpenStoreReadOnly(path)
+	if err == nil {
+		t.Fatalf("version 3 snapshot was opened")
+	}
+
+	err = upgradeSnapshots(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := OpenStoreReadOnly(path)
+	if err != nil {
+		t.Fatalf("upgraded snapshot cannot be opened: %s", err)
+	}
+	defer snapshot.Close()
+	ids, err := snapshot.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(ids) != "[apec:1]" {
+		t.Fatalf("snapshot identifiers were not namespaced: %v", ids)
+	}
+}
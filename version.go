@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build information is set at link time, like:
+//
+//	go build -ldflags "-X main.version=1.2.0 \
+//	  -X main.commit=$(git rev-parse HEAD) \
+//	  -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// Missing commit and date are taken from the version control information
+// recorded by the go tool, when building from a checkout.
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+var (
+	versionCmd = app.Command("version", "print version, commit and build date")
+)
+
+type BuildInfo struct {
+	Version   string
+	Commit    string
+	Date      string
+	GoVersion string
+	// True if built with uncommitted changes
+	Modified bool
+}
+
+func (b *BuildInfo) String() string {
+	s := "apec " + b.Version
+	if b.Commit != "" {
+		s += ", commit " + b.Commit
+		if b.Modified {
+			s += " (modified)"
+		}
+	}
+	if b.Date != "" {
+		s += ", built " + b.Date
+	}
+	return s + ", " + b.GoVersion
+}
+
+// getBuildInfo returns the build information of the running binary.
+func getBuildInfo() *BuildInfo {
+	info := &BuildInfo{
+		Version:   version,
+		Commit:    commit,
+		Date:      buildDate,
+		GoVersion: runtime.Version(),
+	}
+	build, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	for _, setting := range build.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			if info.Commit == "" {
+				info.Commit = setting.Value
+			}
+		case "vcs.time":
+			if info.Date == "" {
+				info.Date = setting.Value
+			}
+		case "vcs.modified":
+			info.Modified = setting.Value == "true"
+		}
+	}
+	return info
+}
+
+// userAgent returns the User-Agent sent by the crawler and the geocoder.
+// APEC is still addressed as a browser, the version identifies apec builds
+// in remote logs.
+func userAgent() string {
+	return fmt.Sprintf("Mozilla/4.0 (compatible; MSIE 7.0; Windows NT 6.0) "+
+		"apec/%s", getBuildInfo().Version)
+}
+
+func versionFn() error {
+	fmt.Println(getBuildInfo().String())
+	return nil
+}
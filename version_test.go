@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBuildInfo(t *testing.T) {
+	info := &BuildInfo{
+		Version:   "1.2.0",
+		Commit:    "4d3b332",
+		Date:      "2017-01-02T10:00:00Z",
+		GoVersion: "go1.8",
+		Modified:  true,
+	}
+	s := info.String()
+	if s != "apec 1.2.0, commit 4d3b332 (modified), built 2017-01-02T10:00:00Z, go1.8" {
+		t.Fatalf("unexpected build information: %s", s)
+	}
+	info = &BuildInfo{Version: "dev", GoVersion: "go1.8"}
+	if s := info.String(); s != "apec dev, go1.8" {
+		t.Fatalf("unexpected build information: %s", s)
+	}
+
+	// Link time values win over version control ones
+	defer func(v, c, d string) {
+		version, commit, buildDate = v, c, d
+	}(version, commit, buildDate)
+	version, commit, buildDate = "1.2.0", "4d3b332", "2017-01-02T10:00:00Z"
+	info = getBuildInfo()
+	if info.Version != version || info.Commit != commit ||
+		info.Date != buildDate || info.GoVersion == "" {
+		t.Fatalf("unexpected build information: %+v", info)
+	}
+	if ua := userAgent(); !strings.HasPrefix(ua, "Mozilla/4.0 ") ||
+		!strings.HasSuffix(ua, " apec/1.2.0") {
+		t.Fatalf("unexpected user agent: %s", ua)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// WARCWriter writes WARC/1.0 records in gzipped files, one gzip member per
+// record as usually done for .warc.gz files. Files are rotated once they
+// exceed maxSize bytes, each one starting with a warcinfo record.
+type WARCWriter struct {
+	lock    sync.Mutex
+	dir     string
+	prefix  string
+	maxSize int64
+	fp      *os.File
+	size    int64
+	index   int
+}
+
+func NewWARCWriter(dir, prefix string, maxSize int64) (*WARCWriter, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &WARCWriter{
+		dir:     dir,
+		prefix:  prefix,
+		maxSize: maxSize,
+	}, nil
+}
+
+func newWARCRecordId() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", b[0:4], b[4:6], b[6:8],
+		b[8:10], b[10:]), nil
+}
+
+type warcHeader struct {
+	Name  string
+	Value string
+}
+
+func (w *WARCWriter) closeFile() error {
+	if w.fp == nil {
+		return nil
+	}
+	err := w.fp.Close()
+	w.fp = nil
+	return err
+}
+
+func (w *WARCWriter) rotate(now time.Time) error {
+	err := w.closeFile()
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s-%05d.warc.gz", w.prefix,
+		now.UTC().Format("20060102150405"), w.index)
+	fp, err := os.Create(filepath.Join(w.dir, name))
+	if err != nil {
+		return err
+	}
+	w.fp = fp
+	w.size = 0
+	w.index++
+	info := "software: apec\r\nformat: WARC File Format 1.0\r\n"
+	return w.writeRecord(now, "warcinfo", "application/warc-fields", []byte(info),
+		warcHeader{"WARC-Filename", name})
+}
+
+func (w *WARCWriter) writeRecord(now time.Time, kind, contentType string,
+	block []byte, headers ...warcHeader) error {
+
+	id, err := newWARCRecordId()
+	if err != nil {
+		return err
+	}
+	return w.writeRecordWithId(id, now, kind, contentType, block, headers...)
+}
+
+func (w *WARCWriter) writeRecordWithId(id string, now time.Time, kind,
+	contentType string, block []byte, headers ...warcHeader) error {
+
+	all := []warcHeader{
+		{"WARC-Type", kind},
+		{"WARC-Record-ID", id},
+		{"WARC-Date", now.UTC().Format(time.RFC3339)},
+	}
+	all = append(all, headers...)
+	data, err := formatWARCRecord(all, contentType, block, true)
+	if err != nil {
+		return err
+	}
+	n, err := w.fp.Write(data)
+	w.size += int64(n)
+	return err
+}
+
+// formatWARCRecord returns a WARC record of block with headers, followed by
+// its digest, content type and length headers. Compressed records are
+// written as a single gzip member.
+func formatWARCRecord(headers []warcHeader, contentType string, block []byte,
+	compress bool) ([]byte, error) {
+
+	digest := sha1.Sum(block)
+	all := append([]warcHeader{}, headers...)
+	all = append(all,
+		warcHeader{"WARC-Block-Digest", "sha1:" +
+			base32.StdEncoding.EncodeToString(digest[:])},
+		warcHeader{"Content-Type", contentType},
+		warcHeader{"Content-Length", strconv.Itoa(len(block))},
+	)
+	buf := &bytes.Buffer{}
+	var z io.WriteCloser = nopWriteCloser{buf}
+	if compress {
+		z = gzip.NewWriter(buf)
+	}
+	fmt.Fprintf(z, "WARC/1.0\r\n")
+	for _, h := range all {
+		fmt.Fprintf(z, "%s: %s\r\n", h.Name, h.Value)
+	}
+	fmt.Fprintf(z, "\r\n")
+	z.Write(block)
+	fmt.Fprintf(z, "\r\n\r\n")
+	err := z.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// WriteExchange records an HTTP request and its response. Both are expected
+// to be serialized in HTTP/1.1 wire format.
+func (w *WARCWriter) WriteExchange(url string, now time.Time, request,
+	response []byte) error {
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.fp == nil || (w.maxSize > 0 && w.size >= w.maxSize) {
+		err := w.rotate(now)
+		if err != nil {
+			return err
+		}
+	}
+	responseId, err := newWARCRecordId()
+	if err != nil {
+		return err
+	}
+	err = w.writeRecordWithId(responseId, now, "response",
+		"application/http; msgtype=response", response,
+		warcHeader{"WARC-Target-URI", url})
+	if err != nil {
+		return err
+	}
+	return w.writeRecord(now, "request", "application/http; msgtype=request",
+		request, warcHeader{"WARC-Target-URI", url},
+		warcHeader{"WARC-Concurrent-To", responseId})
+}
+
+func (w *WARCWriter) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.closeFile()
+}
+
+// warcTransport is an http.RoundTripper recording every exchange performed
+// by its base transport.
+type warcTransport struct {
+	base   http.RoundTripper
+	writer *WARCWriter
+}
+
+func NewWARCTransport(base http.RoundTripper, writer *WARCWriter) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &warcTransport{
+		base:   base,
+		writer: writer,
+	}
+}
+
+func (t *warcTransport) RoundTrip(rq *http.Request) (*http.Response, error) {
+	request, err := httputil.DumpRequestOut(rq, true)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	rsp, err := t.base.RoundTrip(rq)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(rsp.Body)
+	rsp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	// Record the response as if it had been sent uncompressed and without
+	// chunking, since its body was decoded by the transport.
+	rsp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	rsp.ContentLength = int64(len(body))
+	rsp.TransferEncoding = nil
+	if rsp.Uncompressed {
+		rsp.Header.Del("Content-Encoding")
+	}
+	rsp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	response, err := httputil.DumpResponse(rsp, true)
+	if err != nil {
+		return nil, err
+	}
+	err = t.writer.WriteExchange(rq.URL.String(), now, request, response)
+	if err != nil {
+		return nil, fmt.Errorf("could not write WARC record: %s", err)
+	}
+	return rsp, nil
+}
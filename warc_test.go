@@ -0,0 +1,107 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWARCTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"numeroOffre":"` + r.FormValue("id") + `"}`))
+		}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "apec-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writer, err := NewWARCWriter(dir, "test", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{
+		Transport: NewWARCTransport(nil, writer),
+	}
+	for _, id := range []string{"1", "2"} {
+		rsp, err := client.Get(server.URL + "/offer?id=" + id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(rsp.Body)
+		rsp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != `{"numeroOffre":"`+id+`"}` {
+			t.Fatalf("unexpected body: %s", body)
+		}
+	}
+	err = writer.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// maxSize is tiny, every exchange goes to its own file
+	paths, err := filepath.Glob(filepath.Join(dir, "test-*.warc.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 2 {
+		t.Fatalf("unexpected WARC files: %v", paths)
+	}
+	fp, err := os.Open(paths[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fp.Close()
+	z, err := gzip.NewReader(fp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(z)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := string(data)
+	for _, s := range []string{
+		"WARC-Type: warcinfo\r\n",
+		"WARC-Type: response\r\n",
+		"WARC-Type: request\r\n",
+		"WARC-Target-URI: " + server.URL + "/offer?id=2\r\n",
+		"GET /offer?id=2 HTTP/1.1\r\n",
+		`{"numeroOffre":"2"}`,
+	} {
+		if !strings.Contains(content, s) {
+			t.Fatalf("%q not found in WARC file:\n%s", s, content)
+		}
+	}
+
+	// Replay recorded exchanges
+	replay, err := LoadReplayTransport(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client = &http.Client{
+		Transport: replay,
+	}
+	rsp, err := client.Get(server.URL + "/offer?id=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	body, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp.StatusCode != 200 || string(body) != `{"numeroOffre":"1"}` {
+		t.Fatalf("unexpected replayed response: %d %s", rsp.StatusCode, body)
+	}
+}
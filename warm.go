@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Requests issued by warmCaches carry this header, they are not logged
+	warmHeader = "X-Apec-Warm"
+)
+
+// LoggedQuery is a public search as recorded by QueryLog.
+type LoggedQuery struct {
+	What          string `json:"what,omitempty"`
+	Where         string `json:"where,omitempty"`
+	IncludeRemote bool   `json:"include_remote,omitempty"`
+}
+
+// QueryLog appends public searches to a file, one JSON object per line, so
+// popular queries can be replayed to warm caches after a restart. Once the
+// file exceeds maxSize, it is renamed with a ".1" suffix, replacing the
+// previous one, and a new file is started.
+type QueryLog struct {
+	lock    sync.Mutex
+	path    string
+	maxSize int64
+	fp      *os.File
+	size    int64
+}
+
+// OpenQueryLog opens the query log at path. maxSize is in bytes, zero
+// disables rotation.
+func OpenQueryLog(path string, maxSize int64) (*QueryLog, error) {
+	l := &QueryLog{
+		path:    path,
+		maxSize: maxSize,
+	}
+	err := l.open()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *QueryLog) open() error {
+	fp, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	st, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return err
+	}
+	l.fp = fp
+	l.size = st.Size()
+	return nil
+}
+
+func (l *QueryLog) rotate() error {
+	err := l.fp.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(l.path, rotatedQueryLog(l.path))
+	if err != nil {
+		return err
+	}
+	return l.open()
+}
+
+func (l *QueryLog) Close() error {
+	return l.fp.Close()
+}
+
+// rotatedQueryLog returns the path of the previous query log.
+func rotatedQueryLog(path string) string {
+	return path + ".1"
+}
+
+// LogRequest records the search performed by r. Refinements of previous
+// searches are ignored, they cannot be replayed, and so are warming requests.
+func (l *QueryLog) LogRequest(r *http.Request) error {
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil || values.Get("refine") != "" || r.Header.Get(warmHeader) != "" {
+		return nil
+	}
+	q := LoggedQuery{
+		What:          strings.TrimSpace(values.Get("what")),
+		Where:         strings.TrimSpace(values.Get("where")),
+		IncludeRemote: values.Get("include_remote") == "1",
+	}
+	data, err := json.Marshal(&q)
+	if err != nil {
+		return err
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.maxSize > 0 && l.size >= l.maxSize {
+		err = l.rotate()
+		if err != nil {
+			return err
+		}
+	}
+	n, err := l.fp.Write(append(data, '\n'))
+	l.size += int64(n)
+	return err
+}
+
+type queryCount struct {
+	Query LoggedQuery
+	Count int
+}
+
+type sortedQueryCounts []queryCount
+
+func (s sortedQueryCounts) Len() int {
+	return len(s)
+}
+
+func (s sortedQueryCounts) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s sortedQueryCounts) Less(i, j int) bool {
+	if s[i].Count != s[j].Count {
+		return s[i].Count > s[j].Count
+	}
+	if s[i].Query.What != s[j].Query.What {
+		return s[i].Query.What < s[j].Query.What
+	}
+	if s[i].Query.Where != s[j].Query.Where {
+		return s[i].Query.Where < s[j].Query.Where
+	}
+	return !s[i].Query.IncludeRemote && s[j].Query.IncludeRemote
+}
+
+// countQueries adds the queries of the query log at path to counts. Missing
+// logs have no queries and invalid lines, like truncated ones, are ignored.
+func countQueries(path string, counts map[LoggedQuery]int) error {
+	fp, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer fp.Close()
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		q := LoggedQuery{}
+		err := json.Unmarshal(scanner.Bytes(), &q)
+		if err != nil {
+			continue
+		}
+		counts[q]++
+	}
+	return scanner.Err()
+}
+
+// loadTopQueries returns the max most frequent queries of the query log at
+// path and of the previous one, most frequent first.
+func loadTopQueries(path string, max int) ([]LoggedQuery, error) {
+	counts := map[LoggedQuery]int{}
+	for _, p := range []string{rotatedQueryLog(path), path} {
+		err := countQueries(p, counts)
+		if err != nil {
+			return nil, err
+		}
+	}
+	sorted := sortedQueryCounts{}
+	for q, n := range counts {
+		sorted = append(sorted, queryCount{Query: q, Count: n})
+	}
+	sort.Sort(sorted)
+	queries := []LoggedQuery{}
+	for i := 0; i < len(sorted) && i < max; i++ {
+		queries = append(queries, sorted[i].Query)
+	}
+	return queries, nil
+}
+
+// warmCaches runs queries and renders the default density map through get,
+// which requests a path and returns the response status code. prefix is the
+// public URL path.
+func warmCaches(get func(path string) (int, error), prefix string,
+	queries []LoggedQuery) error {
+
+	paths := []string{prefix + "/densitymap"}
+	for _, q := range queries {
+		values := url.Values{}
+		if q.What != "" {
+			values.Set("what", q.What)
+		}
+		if q.Where != "" {
+			values.Set("where", q.Where)
+		}
+		if q.IncludeRemote {
+			values.Set("include_remote", "1")
+		}
+		paths = append(paths, prefix+"/search?"+values.Encode())
+	}
+	start := time.Now()
+	for _, path := range paths {
+		code, err := get(path)
+		if err != nil {
+			return err
+		}
+		if code != http.StatusOK {
+			log.Printf("warning: warming %s failed with %d", path, code)
+		}
+	}
+	log.Printf("%d cache entries warmed in %s", len(paths),
+		ftime(time.Now().Sub(start)))
+	return nil
+}
+
+// discardResponse is an http.ResponseWriter recording only the status code,
+// net/http/httptest would link the testing package into the binary.
+type discardResponse struct {
+	header http.Header
+	Code   int
+}
+
+func newDiscardResponse() *discardResponse {
+	return &discardResponse{
+		header: http.Header{},
+		Code:   http.StatusOK,
+	}
+}
+
+func (w *discardResponse) Header() http.Header {
+	return w.header
+}
+
+func (w *discardResponse) Write(data []byte) (int, error) {
+	return len(data), nil
+}
+
+func (w *discardResponse) WriteHeader(code int) {
+	w.Code = code
+}
+
+// getFromHandler returns a warmCaches getter calling handler in-process.
+func getFromHandler(handler http.Handler) func(string) (int, error) {
+	return func(path string) (int, error) {
+		rq, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			return 0, err
+		}
+		rq.Header.Set(warmHeader, "1")
+		w := newDiscardResponse()
+		handler.ServeHTTP(w, rq)
+		return w.Code, nil
+	}
+}
+
+var (
+	warmCmd = app.Command("warm",
+		"replay popular queries and render the density map on a web server")
+	warmURL = warmCmd.Flag("url", "web server public URL").
+		Default("http://localhost:8081").String()
+	warmQueries = warmCmd.Flag("queries", "number of queries to replay").
+			Default("20").Int()
+)
+
+func warmFn(cfg *Config) error {
+	queries, err := loadTopQueries(cfg.QueryLog(), *warmQueries)
+	if err != nil {
+		return err
+	}
+	base, err := url.Parse(*warmURL)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{}
+	get := func(path string) (int, error) {
+		u := *base
+		rq, err := url.Parse(path)
+		if err != nil {
+			return 0, err
+		}
+		u.Path = rq.Path
+		u.RawQuery = rq.RawQuery
+		req, err := http.NewRequest("GET", u.String(), nil)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set(warmHeader, "1")
+		rsp, err := client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		defer rsp.Body.Close()
+		_, err = io.Copy(ioutil.Discard, rsp.Body)
+		return rsp.StatusCode, err
+	}
+	err = warmCaches(get, strings.TrimRight(base.Path, "/"), queries)
+	if err != nil {
+		return fmt.Errorf("cannot warm %s: %s", *warmURL, err)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestQueryLog(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	path := filepath.Join(env.Config.RootDir, "queries.log")
+	queryLog, err := OpenQueryLog(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range []string{
+		"/search?what=python",
+		"/search?what=golang&where=paris",
+		"/search?what=python",
+		"/search?what=python&refine=abc",
+		"/search?where=lyon&include_remote=1",
+		"/search?what=golang&where=paris",
+		"/search?what=python",
+	} {
+		err := queryLog.LogRequest(httptest.NewRequest("GET", u, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	rq := httptest.NewRequest("GET", "/search?what=java", nil)
+	rq.Header.Set(warmHeader, "1")
+	err = queryLog.LogRequest(rq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = queryLog.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queries, err := loadTopQueries(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []LoggedQuery{
+		{What: "python"},
+		{What: "golang", Where: "paris"},
+	}
+	if !reflect.DeepEqual(queries, expected) {
+		t.Fatalf("unexpected top queries: %+v", queries)
+	}
+
+	// Replay them and check caches are filled
+	mux := http.NewServeMux()
+	mux.HandleFunc("/apec/search", func(w http.ResponseWriter, r *http.Request) {
+		handleQuery(env.SearchContext(), w, r)
+	})
+	mux.HandleFunc("/apec/densitymap", func(w http.ResponseWriter, r *http.Request) {
+		err := handleDensityMap(env.Templates, env.Store, env.Index, env.Spatial,
+			makeFranceBox(), nil, env.Images, w, r)
+		if err != nil {
+			t.Fatalf("density map failed: %s", err)
+		}
+	})
+	err = warmCaches(getFromHandler(mux), "/apec", queries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range queries {
+		if env.Cache.Get(q.What, q.Where, q.IncludeRemote) == nil {
+			t.Fatalf("query was not cached: %+v", q)
+		}
+	}
+	if env.Images.Get("500") == nil {
+		t.Fatalf("density map was not cached")
+	}
+	env.Generation.Bump()
+	if env.Images.Get("500") != nil {
+		t.Fatalf("stale density map was not dropped")
+	}
+}
+
+func TestQueryLogRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apec-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "queries.log")
+	// Logged queries are at most 18 bytes long
+	queryLog, err := OpenQueryLog(path, 40)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, what := range []string{"python", "python", "python", "golang",
+		"golang", "java", "golang"} {
+
+		rq := httptest.NewRequest("GET", "/search?what="+what, nil)
+		err := queryLog.LogRequest(rq)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = queryLog.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{path, rotatedQueryLog(path)} {
+		st, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Size() > 40+18 {
+			t.Fatalf("%s was not rotated: %d bytes", p, st.Size())
+		}
+	}
+	// The oldest python queries were rotated away
+	queries, err := loadTopQueries(path, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []LoggedQuery{
+		{What: "golang"},
+		{What: "java"},
+	}
+	if !reflect.DeepEqual(queries, expected) {
+		t.Fatalf("unexpected top queries: %+v", queries)
+	}
+}
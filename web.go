@@ -1,13 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"expvar"
 	"fmt"
 	"html/template"
-	"image/png"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/http"
-	_ "net/http/pprof"
+	"net/http/pprof"
 	"net/url"
 	"sort"
 	"strconv"
@@ -16,32 +19,16 @@ import (
 	"time"
 
 	"github.com/blevesearch/bleve"
+	blevesearch "github.com/blevesearch/bleve/search"
+	"github.com/blevesearch/bleve/search/collector"
 	"github.com/blevesearch/bleve/search/query"
 	"github.com/jonas-p/go-shp"
 	"github.com/pmezard/apec/blevext"
-	"github.com/pmezard/apec/shpdraw"
+	"github.com/pmezard/apec/jstruct"
 )
 
-type Templates struct {
-	Search  *template.Template
-	Density *template.Template
-}
-
-func loadTemplates() (*Templates, error) {
-	var err error
-	t := &Templates{}
-	t.Search, err = template.ParseFiles("web/search.tmpl")
-	if err != nil {
-		return nil, err
-	}
-	t.Density, err = template.ParseFiles("web/density.tmpl")
-	if err != nil {
-		return nil, err
-	}
-	return t, nil
-}
-
 type offerData struct {
+	Id       string
 	Account  string
 	Title    string
 	Date     string
@@ -49,11 +36,28 @@ type offerData struct {
 	URL      string
 	Location string
 	Age      string
+	Transit  string
+	Skills   []string
+	Tags     []string
+	// Initial publication date and reposts, shown when hovering the age
+	AgeDetails string
+	// Description excerpt highlighting the text query terms
+	Snippet template.HTML
+	// Distance to the closest searched location, empty if unknown
+	Distance string
+	// Number of other offers published with the same content
+	Duplicates int
+	// Deletion day of deleted offers versions
+	Deleted string
 }
 
 type datedOffer struct {
 	Date string
 	Id   string
+	// True for deleted offers versions, identified by deletedDocId
+	Deleted bool
+	// Text query score, zero for offers matched by location only
+	Score float64
 }
 
 type sortedDatedOffers []datedOffer
@@ -70,25 +74,168 @@ func (s sortedDatedOffers) Less(i, j int) bool {
 	return s[i].Date > s[j].Date
 }
 
-func formatOffers(templ *Templates, store *Store, datedOffers []datedOffer,
-	where, what string, spatialDuration, textDuration time.Duration, w http.ResponseWriter,
-	r *http.Request) error {
+// sortedTransitOffers sorts offers by increasing distance to the nearest
+// station, then by date. Offers without transit score come last.
+type sortedTransitOffers struct {
+	Offers    []datedOffer
+	Distances map[string]float64
+}
+
+func (s *sortedTransitOffers) Len() int {
+	return len(s.Offers)
+}
+
+func (s *sortedTransitOffers) Swap(i, j int) {
+	s.Offers[i], s.Offers[j] = s.Offers[j], s.Offers[i]
+}
 
+func (s *sortedTransitOffers) Less(i, j int) bool {
+	a, b := s.Offers[i], s.Offers[j]
+	da, oka := s.Distances[a.Id]
+	db, okb := s.Distances[b.Id]
+	if oka != okb {
+		return oka
+	}
+	if da != db {
+		return da < db
+	}
+	return a.Date > b.Date
+}
+
+func sortByTransit(store *Store, offers []datedOffer) error {
+	distances := map[string]float64{}
+	for _, o := range offers {
+		score, err := store.GetTransitScore(o.Id)
+		if err != nil {
+			return err
+		}
+		if score != nil {
+			distances[o.Id] = score.Distance
+		}
+	}
+	sort.Sort(&sortedTransitOffers{
+		Offers:    offers,
+		Distances: distances,
+	})
+	return nil
+}
+
+// Number of departments, regions and facet values listed with search results
+const maxFacets = 10
+
+// Number of search results displayed per page, by default and at most
+const (
+	defaultSearchPerPage = 100
+	maxSearchPerPage     = 1000
+)
+
+// searchCenters returns the points of coordinates and cities location
+// queries, offers distances are computed from them. Other queries have none.
+func searchCenters(where string, geocoder *Geocoder) []Point {
+	if where == "" || strings.HasPrefix(where, "isochrone:") {
+		return nil
+	}
+	points, _, err := parseLocationQuery(where, geocoder)
+	if err != nil {
+		return nil
+	}
+	return points
+}
+
+// formatDistance returns the distance from offer id to the closest of
+// centers, or an empty string.
+func formatDistance(store *Store, id string, centers []Point) (string, error) {
+	if len(centers) == 0 {
+		return "", nil
+	}
+	loc, _, err := store.GetLocation(id)
+	if err != nil || loc == nil || loc.Nationwide {
+		return "", err
+	}
+	p := Point{Lat: loc.Lat, Lon: loc.Lon}
+	min := -1.0
+	for _, c := range centers {
+		d := geoDistance(p, c)
+		if min < 0 || d < min {
+			min = d
+		}
+	}
+	return fmt.Sprintf("%.0f km", min/1000), nil
+}
+
+// searchResults are the search results rendered by formatOffers and how they
+// were found.
+type searchResults struct {
+	Offers []datedOffer
+	Facets []Facet
+	// Location query and its centers, offers distances are computed to them
+	Where   string
+	Centers []Point
+	// Text query, as typed if it was corrected, and its age filter, if any
+	What      string
+	Typed     string
+	AgeFilter string
+	// Tokens of all results and of facets filtered ones
+	Token    string
+	Snapshot string
+	// Partial is true if results were truncated
+	Partial         bool
+	SpatialDuration time.Duration
+	TextDuration    time.Duration
+}
+
+// formatOffers renders a page of search results. Ages are counted in loc
+// timezone. Live offers matching the text query get snippets from index, if
+// not nil. Results are sorted by index, or deleted for deleted offers
+// versions.
+func formatOffers(templ *Templates, store *Store, index bleve.Index,
+	deleted *DeletedIndex, res *searchResults, loc *time.Location,
+	w http.ResponseWriter, r *http.Request) error {
+
+	datedOffers := res.Offers
 	start := time.Now()
+	now := start.In(loc)
 	offers := []*offerData{}
-	maxDisplayed := 1000
-	sort.Sort(sortedDatedOffers(datedOffers))
-	for _, doc := range datedOffers {
-		if len(offers) >= maxDisplayed {
-			break
+	page, perPage, err := parseSearchPage(r)
+	if err != nil {
+		return err
+	}
+	sortBy := r.FormValue("sort")
+	err = sortSearchResults(store, index, deleted, datedOffers, sortBy)
+	if err != nil {
+		return err
+	}
+	pages := (len(datedOffers) + perPage - 1) / perPage
+	first := (page - 1) * perPage
+	if first > len(datedOffers) {
+		first = len(datedOffers)
+	}
+	last := first + perPage
+	if last > len(datedOffers) {
+		last = len(datedOffers)
+	}
+	ids := []string{}
+	for _, doc := range datedOffers[first:last] {
+		if !doc.Deleted {
+			ids = append(ids, doc.Id)
 		}
-		offer, err := getStoreOffer(store, doc.Id)
+	}
+	snippets, err := highlightOffers(index, res.What, ids)
+	if err != nil {
+		return err
+	}
+	for _, doc := range datedOffers[first:last] {
+		js, deleted, err := loadDatedOffer(store, doc)
 		if err != nil {
 			return err
 		}
-		if offer == nil {
+		if js == nil {
 			continue
 		}
+		offer, err := convertOffer(js)
+		if err != nil {
+			return err
+		}
 		salary := ""
 		if offer.MinSalary > 0 {
 			if offer.MaxSalary != offer.MinSalary {
@@ -98,42 +245,113 @@ func formatOffers(templ *Templates, store *Store, datedOffers []datedOffer,
 				salary = fmt.Sprintf("(%d kEUR)", offer.MinSalary)
 			}
 		}
+		// Deleted offers have no age, transit score or location
 		age := "    "
-		initialDate, err := store.GetInitialDate(doc.Id)
+		transit := ""
+		distance := ""
+		initialDate := time.Time{}
+		if !doc.Deleted {
+			initialDate, err = store.GetInitialDate(doc.Id)
+			if err != nil {
+				return err
+			}
+			if !initialDate.IsZero() {
+				age = formatOfferAge(offerAgeDays(initialDate, now))
+			}
+			score, err := store.GetTransitScore(doc.Id)
+			if err != nil {
+				return err
+			}
+			if score != nil {
+				transit = "(" + score.String() + ")"
+			}
+			distance, err = formatDistance(store, doc.Id, res.Centers)
+			if err != nil {
+				return err
+			}
+		}
+		tags, err := store.GetTags(offer.Id)
 		if err != nil {
 			return err
 		}
+		duplicates := 0
+		ages, err := store.GetOfferDates(hashOffer(js))
+		if err != nil {
+			return err
+		}
+		if len(ages) > 1 {
+			duplicates = len(ages) - 1
+		}
+		ageDetails := ""
 		if !initialDate.IsZero() {
-			age = fmt.Sprintf("%3dj", start.Sub(initialDate)/(24*time.Hour))
+			ageDetails = formatAgeDetails(initialDate, duplicates, now)
 		}
 		offers = append(offers, &offerData{
-			Account:  offer.Account,
-			Title:    offer.Title,
-			Date:     offer.Date.Format("2006-01-02"),
-			URL:      offer.URL,
-			Salary:   salary,
-			Location: offer.Location,
-			Age:      age,
+			Id:         offer.Id,
+			Account:    offer.Account,
+			Title:      offer.Title,
+			Date:       offer.Date.Format("2006-01-02"),
+			URL:        offer.URL,
+			Salary:     salary,
+			Location:   offer.Location,
+			Age:        age,
+			AgeDetails: ageDetails,
+			Snippet:    snippets[doc.Id],
+			Transit:    transit,
+			Skills: extractSkills(offer.Title + "\n" +
+				htmlParagraphs(offer.HTML)),
+			Tags:       tags,
+			Distance:   distance,
+			Duplicates: duplicates,
+			Deleted:    deleted,
 		})
 	}
 	end := time.Now()
 	data := struct {
 		Offers            []*offerData
+		Facets            []Facet
 		Displayed         int
 		Total             int
+		Page              int
+		Pages             int
+		PrevURL           template.URL
+		NextURL           template.URL
+		Partial           bool
 		Where             string
 		What              string
+		Query             string
+		Typed             string
+		Token             string
+		Snapshot          string
+		Refined           bool
+		IncludeRemote     bool
+		IncludeDeleted    bool
+		Sort              string
 		SpatialDuration   string
 		TextDuration      string
 		RenderingDuration string
 	}{
 		Offers:            offers,
+		Facets:            res.Facets,
 		Displayed:         len(offers),
 		Total:             len(datedOffers),
-		Where:             where,
-		What:              what,
-		SpatialDuration:   ftime(spatialDuration),
-		TextDuration:      ftime(textDuration),
+		Page:              page,
+		Pages:             pages,
+		PrevURL:           searchPageURL(r, page-1, pages),
+		NextURL:           searchPageURL(r, page+1, pages),
+		Partial:           res.Partial,
+		Where:             res.Where,
+		What:              res.What,
+		Query:             strings.TrimSpace(res.What + " " + res.AgeFilter),
+		Typed:             res.Typed,
+		Token:             res.Token,
+		Snapshot:          res.Snapshot,
+		Refined:           r.FormValue("refine") != "",
+		IncludeRemote:     r.FormValue("include_remote") == "1",
+		IncludeDeleted:    r.FormValue("include_deleted") == "1",
+		Sort:              sortBy,
+		SpatialDuration:   ftime(res.SpatialDuration),
+		TextDuration:      ftime(res.TextDuration),
 		RenderingDuration: ftime(end.Sub(start)),
 	}
 	h := w.Header()
@@ -142,11 +360,96 @@ func formatOffers(templ *Templates, store *Store, datedOffers []datedOffer,
 	return nil
 }
 
-func makeSearchQuery(queryString string, ids []string) (query.Query, error) {
+// loadDatedOffer returns the live or deleted version of a search result, and
+// the deletion day of deleted ones, or nil if it no longer exists.
+func loadDatedOffer(store *Store, doc datedOffer) (*jstruct.JsonOffer, string,
+	error) {
+
+	if !doc.Deleted {
+		js, err := getStoreJsonOffer(store, doc.Id)
+		return js, "", err
+	}
+	id, deletedId, err := parseDeletedDocId(doc.Id)
+	if err != nil {
+		return nil, "", err
+	}
+	js, date, err := getDeletedJsonOffer(store, id, deletedId)
+	if err != nil || js == nil {
+		return nil, "", err
+	}
+	return js, formatDeletionDate(date), nil
+}
+
+// parseSearchPage returns the 1-based "page" of search results to display,
+// and the "per_page" number of offers per page.
+func parseSearchPage(r *http.Request) (int, int, error) {
+	page, perPage := 1, defaultSearchPerPage
+	if s := r.FormValue("page"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return 0, 0, fmt.Errorf("invalid page: %q", s)
+		}
+		page = n
+	}
+	if s := r.FormValue("per_page"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > maxSearchPerPage {
+			return 0, 0, fmt.Errorf("invalid per_page, must be in 1-%d: %q",
+				maxSearchPerPage, s)
+		}
+		perPage = n
+	}
+	return page, perPage, nil
+}
+
+// searchPageURL returns the relative URL of page of the search requested by
+// r, or an empty string if it is not one of pages.
+func searchPageURL(r *http.Request, page, pages int) template.URL {
+	if page < 1 || page > pages {
+		return ""
+	}
+	values, err := url.ParseQuery(r.URL.RawQuery)
+	if err != nil {
+		return ""
+	}
+	values.Set("page", strconv.Itoa(page))
+	return template.URL("?" + values.Encode())
+}
+
+// fieldQuery is a query which can be restricted to a field and boosted.
+type fieldQuery interface {
+	query.FieldableQuery
+	SetBoost(b float64)
+}
+
+// parseKeywordTerm returns the keyword field and normalized term matched by
+// query terms like "tag:applied" or "department:33", or an empty field.
+func parseKeywordTerm(value string) (string, string) {
+	switch {
+	case strings.HasPrefix(value, tagQueryPrefix):
+		return tagField, strings.ToLower(strings.TrimPrefix(value, tagQueryPrefix))
+	case strings.HasPrefix(value, departmentQueryPrefix):
+		return departmentField, normalizeAreaTerm(
+			strings.TrimPrefix(value, departmentQueryPrefix))
+	case strings.HasPrefix(value, regionQueryPrefix):
+		return regionField, normalizeAreaTerm(
+			strings.TrimPrefix(value, regionQueryPrefix))
+	}
+	return "", ""
+}
+
+// makeSearchQuery parses queryString and returns a query matching its terms in
+// any of fields, defaultSearchFields if nil, restricted to ids if not empty.
+func makeSearchQuery(queryString string, ids []string, fields []SearchField) (
+	query.Query, error) {
+
 	nodes, err := blevext.Parse(queryString)
 	if err != nil {
 		return nil, err
 	}
+	if len(fields) == 0 {
+		fields = defaultSearchFields
+	}
 
 	addIdsFilter := func(q query.Query) query.Query {
 		if len(ids) == 0 {
@@ -179,23 +482,51 @@ func makeSearchQuery(queryString string, ids []string) (query.Query, error) {
 				return q, nil
 			}
 			return query.NewConjunctionQuery([]query.Query{left, right}), nil
-		case blevext.NodeString, blevext.NodePhrase:
-			fn := func(s string) query.FieldableQuery {
-				return bleve.NewMatchQuery(s)
+		case blevext.NodeNot:
+			child, err := makeQuery(n.Children[0])
+			if err != nil {
+				return nil, err
 			}
-			if n.Kind == blevext.NodePhrase {
-				fn = func(s string) query.FieldableQuery {
-					return blevext.NewAllMatchQuery(s)
+			// Negations apply to ids when set, not to the whole index
+			all := addIdsFilter(bleve.NewMatchAllQuery())
+			return query.NewBooleanQuery([]query.Query{all}, nil,
+				[]query.Query{child}), nil
+		case blevext.NodeString, blevext.NodePhrase, blevext.NodeNear,
+			blevext.NodeExact:
+			if n.Kind == blevext.NodeString {
+				field, term := parseKeywordTerm(n.Value)
+				if field != "" {
+					q := bleve.NewTermQuery(term)
+					q.SetField(field)
+					return addIdsFilter(q), nil
 				}
 			}
-			htmlQuery := fn(n.Value)
-			htmlQuery.SetField("html")
-			titleQuery := fn(n.Value)
-			titleQuery.SetField("title")
-			q := query.NewDisjunctionQuery([]query.Query{
-				addIdsFilter(htmlQuery),
-				addIdsFilter(titleQuery),
-			})
+			fn := func() fieldQuery {
+				return bleve.NewMatchQuery(n.Value)
+			}
+			if n.Kind == blevext.NodePhrase || n.Kind == blevext.NodeExact {
+				fn = func() fieldQuery {
+					return blevext.NewAllMatchQuery(n.Value)
+				}
+			} else if n.Kind == blevext.NodeNear {
+				fn = func() fieldQuery {
+					return blevext.NewNearQuery(n.Children[0].Value,
+						n.Children[1].Value, n.Distance)
+				}
+			}
+			queries := []query.Query{}
+			for _, f := range fields {
+				fq := fn()
+				fq.SetField(f.Name)
+				if n.Kind == blevext.NodeExact {
+					fq.SetField(exactField(f.Name))
+				}
+				if f.Boost > 0 {
+					fq.SetBoost(f.Boost)
+				}
+				queries = append(queries, addIdsFilter(fq))
+			}
+			q := query.NewDisjunctionQuery(queries)
 			q.Min = 1
 			return q, nil
 		}
@@ -204,126 +535,601 @@ func makeSearchQuery(queryString string, ids []string) (query.Query, error) {
 	return makeQuery(nodes)
 }
 
-func findOffersFromText(index bleve.Index, query string, ids []string) (
-	[]datedOffer, error) {
+// SearchLimits bounds the work performed by full text searches.
+type SearchLimits struct {
+	// Maximum number of hits returned by a search
+	MaxHits int
+	// Larger sets of identifiers are filtered after the search instead of
+	// being part of the query
+	MaxFilterIds int
+	// Searches are cancelled after this delay, zero means no timeout
+	Timeout time.Duration
+	// Hits are truncated to fit this estimated memory size in bytes, zero
+	// means no limit
+	MaxMemory int64
+}
+
+var (
+	defaultSearchLimits = SearchLimits{
+		MaxHits:      20000,
+		MaxFilterIds: 20000,
+	}
+)
+
+const (
+	// Identifier sets covering a larger fraction of indexed documents are
+	// filtered after the search, the DocID conjunction costs more than it
+	// saves.
+	postFilterRatio = 0.25
+	// Smaller sets are always cheap enough to be part of the query
+	postFilterMinIds = 1000
+	// Rough memory footprint of a search hit, with its date field and
+	// resulting datedOffer
+	searchHitSize = 1024
+)
+
+// usePostFilter returns true if count identifiers should filter text search
+// hits instead of being passed as a DocID query, given docCount indexed
+// documents.
+func usePostFilter(count int, docCount uint64, limits SearchLimits) bool {
+	if count > limits.MaxFilterIds {
+		return true
+	}
+	return count >= postFilterMinIds &&
+		float64(count) > postFilterRatio*float64(docCount)
+}
+
+// findOffersFromText returns offers matching query, restricted to ids if not
+// empty. It also reports whether results were truncated to limits.MaxHits.
+// Depending on their number, ids are part of the query or filter its hits.
+func findOffersFromText(index bleve.Index, query string, ids []string,
+	fields []SearchField, limits SearchLimits) ([]datedOffer, bool, error) {
 
 	if query == "" {
-		return nil, nil
+		return nil, false, nil
 	}
-	datedOffers := []datedOffer{}
-	q, err := makeSearchQuery(query, ids)
+	var filter map[string]bool
+	if len(ids) > 0 {
+		docCount, err := index.DocCount()
+		if err != nil {
+			return nil, false, err
+		}
+		if usePostFilter(len(ids), docCount, limits) {
+			log.Printf("text filter: post-filter for %d/%d candidates", len(ids),
+				docCount)
+			filter = make(map[string]bool, len(ids))
+			for _, id := range ids {
+				filter[id] = true
+			}
+			ids = nil
+		} else {
+			log.Printf("text filter: docid for %d/%d candidates", len(ids), docCount)
+		}
+	}
+	q, err := makeSearchQuery(query, ids, fields)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
-	rq := bleve.NewSearchRequest(q)
-	rq.Size = 20000
+	return searchDatedOffers(index, q, filter, limits)
+}
+
+// Full text searches and timeouts counters, and query cache hits and misses
+var searchStats = expvar.NewMap("search")
+
+// hitRecorder wraps bleve default hit collection to record the identifiers
+// and scores of the first max hits, so they survive a search timeout.
+type hitRecorder struct {
+	max  int
+	hits []datedOffer
+}
+
+func (h *hitRecorder) makeHandler(ctx *blevesearch.SearchContext) (
+	blevesearch.DocumentMatchHandler, bool, error) {
+
+	handler, _, err := collector.MakeTopNDocumentMatchHandler(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	return func(d *blevesearch.DocumentMatch) error {
+		// Collected matches are recycled, copy them first
+		if d != nil && len(h.hits) < h.max {
+			h.hits = append(h.hits, datedOffer{
+				Id:    d.ID,
+				Score: d.Score,
+			})
+		}
+		return handler(d)
+	}, true, nil
+}
+
+// fillOfferDates sets the indexed dates of offers, and drops the ones no
+// longer indexed.
+func fillOfferDates(index bleve.Index, offers []datedOffer) ([]datedOffer, error) {
+	if len(offers) == 0 {
+		return offers, nil
+	}
+	ids := []string{}
+	for _, o := range offers {
+		ids = append(ids, o.Id)
+	}
+	rq := bleve.NewSearchRequest(bleve.NewDocIDQuery(ids))
+	rq.Size = len(ids)
 	rq.Fields = []string{"date"}
 	res, err := index.Search(rq)
 	if err != nil {
 		return nil, err
 	}
+	dates := map[string]string{}
 	for _, doc := range res.Hits {
 		date, ok := doc.Fields["date"].(string)
 		if !ok {
 			return nil, fmt.Errorf("could not retrieve date for %s", doc.ID)
 		}
-		datedOffers = append(datedOffers, datedOffer{
-			Date: date,
-			Id:   doc.ID,
-		})
+		dates[doc.ID] = date
+	}
+	dated := []datedOffer{}
+	for _, o := range offers {
+		date, ok := dates[o.Id]
+		if ok {
+			o.Date = date
+			dated = append(dated, o)
+		}
+	}
+	return dated, nil
+}
+
+// searchDatedOffers returns offers matching q and in filter if not nil. It also
+// reports whether results were truncated to limits.MaxHits, or by
+// limits.Timeout, in which case the hits collected so far are returned.
+// Filtered searches page through hits until limits.MaxHits offers pass the
+// filter, since they can rank anywhere.
+func searchDatedOffers(index bleve.Index, q query.Query, filter map[string]bool,
+	limits SearchLimits) ([]datedOffer, bool, error) {
+
+	searchStats.Add("searches", 1)
+	datedOffers := []datedOffer{}
+	seen := map[string]bool{}
+	add := func(o datedOffer) bool {
+		if seen[o.Id] || (filter != nil && !filter[o.Id]) {
+			return true
+		}
+		if len(datedOffers) >= limits.MaxHits {
+			return false
+		}
+		seen[o.Id] = true
+		datedOffers = append(datedOffers, o)
+		return true
+	}
+	rq := bleve.NewSearchRequest(q)
+	rq.Size = limits.MaxHits
+	if limits.MaxMemory > 0 && limits.MaxMemory/searchHitSize < int64(rq.Size) {
+		rq.Size = int(limits.MaxMemory / searchHitSize)
+		limits.MaxHits = rq.Size
+	}
+	rq.Fields = []string{"date"}
+	ctx := context.Background()
+	recorder := &hitRecorder{max: rq.Size}
+	if limits.Timeout > 0 {
+		timeoutCtx, cancel := context.WithTimeout(ctx, limits.Timeout)
+		defer cancel()
+		ctx = context.WithValue(timeoutCtx,
+			blevesearch.MakeDocumentMatchHandlerKey,
+			blevesearch.MakeDocumentMatchHandler(recorder.makeHandler))
+	}
+	for {
+		recorder.hits = nil
+		res, err := index.SearchInContext(ctx, rq)
+		if err != nil {
+			if err != context.DeadlineExceeded {
+				return nil, false, err
+			}
+			searchStats.Add("timeouts", 1)
+			log.Printf("search did not complete within %s, %d hits collected",
+				limits.Timeout, len(datedOffers)+len(recorder.hits))
+			offers, err := fillOfferDates(index, recorder.hits)
+			if err != nil {
+				return nil, false, err
+			}
+			for _, o := range offers {
+				if !add(o) {
+					break
+				}
+			}
+			return datedOffers, true, nil
+		}
+		for _, doc := range res.Hits {
+			date, ok := doc.Fields["date"].(string)
+			if !ok {
+				return nil, false, fmt.Errorf("could not retrieve date for %s",
+					doc.ID)
+			}
+			if !add(datedOffer{Date: date, Id: doc.ID, Score: doc.Score}) {
+				return datedOffers, true, nil
+			}
+		}
+		rq.From += len(res.Hits)
+		if len(res.Hits) == 0 || res.Total <= uint64(rq.From) {
+			return datedOffers, false, nil
+		}
+		if filter == nil || len(datedOffers) >= len(filter) {
+			return datedOffers, filter == nil, nil
+		}
 	}
-	return datedOffers, nil
 }
 
-func findOffersFromLocation(query string, spatial *SpatialIndex, geocoder *Geocoder) (
-	[]datedOffer, error) {
+// findOffersFromLocation returns offers located around query, or all
+// located offers if query is empty. Nationwide offers are appended when
+// includeNationwide is true.
+func findOffersFromLocation(query string, spatial *SpatialIndex, geocoder *Geocoder,
+	router *Router, includeNationwide bool) ([]datedOffer, error) {
+
+	offers, err := findOffersNearLocation(query, spatial, geocoder, router)
+	if err != nil || !includeNationwide {
+		return offers, err
+	}
+	return append(offers, spatial.FindNationwide()...), nil
+}
+
+// findOffersNearLocation parses and runs spatial queries like:
+//
+//	wgs84:lat,lon[,radius]
+//	city[|city...][,radius]
+//	isochrone:lat,lon,time
+//
+// radius is in meters and defaults to 30km. Offers near any of several cities
+// are returned once. Isochrone queries return offers reachable within a travel
+// time like "45min" and require a router.
+func findOffersNearLocation(query string, spatial *SpatialIndex, geocoder *Geocoder,
+	router *Router) ([]datedOffer, error) {
 
 	if query == "" {
 		return spatial.FindAll(), nil
 	}
-	lat, lon, radius := float64(0), float64(0), float64(0)
+	if strings.HasPrefix(query, "isochrone:") {
+		if router == nil {
+			return nil, fmt.Errorf("isochrone queries are not supported here")
+		}
+		lat, lon, minutes, err := parseIsochroneQuery(query[len("isochrone:"):])
+		if err != nil {
+			return nil, err
+		}
+		poly, err := router.Isochrone(lat, lon, minutes)
+		if err != nil {
+			return nil, err
+		}
+		return spatial.FindInPolygon(poly)
+	}
+	points, radius, err := parseLocationQuery(query, geocoder)
+	if err != nil {
+		return nil, err
+	}
+	if len(points) == 1 {
+		return spatial.FindNearest(points[0].Lat, points[0].Lon, radius)
+	}
+	seen := map[string]bool{}
+	datedOffers := []datedOffer{}
+	for _, p := range points {
+		offers, err := spatial.FindNearest(p.Lat, p.Lon, radius)
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range offers {
+			if !seen[o.Id] {
+				seen[o.Id] = true
+				datedOffers = append(datedOffers, o)
+			}
+		}
+	}
+	return datedOffers, nil
+}
+
+// parseLocationQuery returns the points and radius in meters of wgs84 and
+// city spatial queries.
+func parseLocationQuery(query string, geocoder *Geocoder) ([]Point, float64, error) {
+	points := []Point{}
+	radius := float64(30000)
 	if strings.HasPrefix(query, "wgs84:") {
 		parts := strings.Split(query[len("wgs84:"):], ",")
 		if len(parts) < 2 || len(parts) > 3 {
-			return nil, fmt.Errorf("invalid coordinates: %s", query)
+			return nil, 0, fmt.Errorf("invalid coordinates: %s", query)
 		}
 		floats := []float64{}
 		for _, p := range parts {
 			f, err := strconv.ParseFloat(p, 64)
 			if err != nil {
-				return nil, err
+				return nil, 0, err
 			}
 			floats = append(floats, f)
 		}
-		if len(floats) == 2 {
-			floats = append(floats, float64(30000))
+		if len(floats) == 3 {
+			radius = floats[2]
 		}
-		lat = floats[0]
-		lon = floats[1]
-		radius = floats[2]
+		points = append(points, Point{Lat: floats[0], Lon: floats[1]})
 	} else {
 		parts := strings.Split(query, ",")
 		if len(parts) != 1 && len(parts) != 2 {
-			return nil, fmt.Errorf("invalid location string: %s", query)
+			return nil, 0, fmt.Errorf("invalid location string: %s", query)
 		}
-		loc, ok, err := geocoder.GetCachedLocation(strings.ToLower(parts[0]), "fr")
-		if err != nil {
-			return nil, err
-		}
-		if !ok {
-			return nil, fmt.Errorf("could not geocode %s", query)
+		for _, city := range strings.Split(parts[0], "|") {
+			city = strings.TrimSpace(city)
+			if city == "" {
+				return nil, 0, fmt.Errorf("invalid location string: %s", query)
+			}
+			loc, ok, err := geocoder.GetCachedLocation(strings.ToLower(city), "fr")
+			if err != nil {
+				return nil, 0, err
+			}
+			if !ok || loc == nil {
+				return nil, 0, fmt.Errorf("could not geocode %s", city)
+			}
+			points = append(points, Point{Lat: loc.Lat, Lon: loc.Lon})
 		}
-		lat = loc.Lat
-		lon = loc.Lon
-		radius = float64(30000)
 		if len(parts) == 2 {
-			radius, err = strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+			r, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
 			if err != nil {
-				return nil, err
+				return nil, 0, err
 			}
+			radius = r
 		}
 	}
-	datedOffers, err := spatial.FindNearest(lat, lon, radius)
-	return datedOffers, err
+	return points, radius, nil
 }
 
-func serveQuery(templ *Templates, store *Store, index bleve.Index,
-	spatial *SpatialIndex, geocoder *Geocoder, w http.ResponseWriter, r *http.Request) error {
+// Spatial search backends. The r-tree one queries the in-memory spatial index
+// then restricts the text query to its results. The bleve one runs distance
+// queries on indexed geopoints within the text query.
+const (
+	spatialRTree = "rtree"
+	spatialBleve = "bleve"
+)
+
+// makeGeoQuery returns a query matching offers within radius meters of any
+// of points.
+func makeGeoQuery(points []Point, radius float64) query.Query {
+	distance := strconv.FormatFloat(radius, 'f', -1, 64) + "m"
+	queries := []query.Query{}
+	for _, p := range points {
+		q := query.NewGeoDistanceQuery(p.Lon, p.Lat, distance)
+		q.SetField("geo")
+		queries = append(queries, q)
+	}
+	if len(queries) == 1 {
+		return queries[0]
+	}
+	q := query.NewDisjunctionQuery(queries)
+	q.Min = 1
+	return q
+}
+
+// useBleveSpatial returns true if the where query can be run by the bleve
+// spatial backend. Isochrones and unrestricted queries always use the r-tree.
+func useBleveSpatial(backend, where string) bool {
+	return backend == spatialBleve && where != "" &&
+		!strings.HasPrefix(where, "isochrone:")
+}
+
+// findOffersFromIndex runs the spatial and text queries as a single bleve
+// search. Nationwide offers identifiers are matched whatever the location.
+func findOffersFromIndex(index bleve.Index, what, where string, geocoder *Geocoder,
+	nationwide []string, fields []SearchField, limits SearchLimits) (
+	[]datedOffer, bool, error) {
+
+	points, radius, err := parseLocationQuery(where, geocoder)
+	if err != nil {
+		return nil, false, err
+	}
+	q := makeGeoQuery(points, radius)
+	if len(nationwide) > 0 {
+		d := query.NewDisjunctionQuery([]query.Query{q, query.NewDocIDQuery(nationwide)})
+		d.Min = 1
+		q = d
+	}
+	if what != "" {
+		text, err := makeSearchQuery(what, nil, fields)
+		if err != nil {
+			return nil, false, err
+		}
+		q = query.NewConjunctionQuery([]query.Query{text, q})
+	}
+	return searchDatedOffers(index, q, nil, limits)
+}
+
+// SearchContext groups what search pages depend on, besides the request.
+type SearchContext struct {
+	Templates *Templates
+	// Replica searched, its store, indexes and geocoder
+	Replica *Replica
+	Router  *Router
+	Results *ResultSets
+	Cache   *QueryCache
+	Facets  *FacetCache
+	Limits  SearchLimits
+	Fields  []SearchField
+	// Speller corrects misspelled queries, if not nil
+	Speller *Speller
+	// Spatial search backend, see useBleveSpatial
+	Backend string
+	// Time zone of dates and age filters
+	Loc *time.Location
+}
+
+// serveQuery runs the spatial then the text query and renders the results.
+// When a "refine" token is passed, the text query is applied to the
+// corresponding cached result set instead of the spatial query output. Other
+// queries results are cached until the indexes are updated. With the bleve
+// spatial backend, both queries run in a single search when possible. With
+// "include_deleted", matching deleted offers versions are searched in
+// deleted, then appended to the results.
+func serveQuery(sc *SearchContext, w http.ResponseWriter,
+	r *http.Request) error {
+
+	templ, rep := sc.Templates, sc.Replica
+	store, index, deleted := rep.Store, rep.Index.Get(), rep.Deleted
+	spatial, geocoder := rep.Spatial, rep.Geocoder
+	router, results, cache := sc.Router, sc.Results, sc.Cache
+	limits, fields, loc := sc.Limits, sc.Fields, sc.Loc
 
 	values, err := url.ParseQuery(r.URL.RawQuery)
 	if err != nil {
 		return err
 	}
-	what := strings.TrimSpace(values.Get("what"))
+	what, ageFilter, maxAge, err := parseMaxAge(
+		strings.TrimSpace(values.Get("what")))
+	if err != nil {
+		return err
+	}
 	where := strings.TrimSpace(values.Get("where"))
+	includeRemote := values.Get("include_remote") == "1"
+	includeDeleted := values.Get("include_deleted") == "1"
+	refine := values.Get("refine")
+	// Misspelled words are corrected unless refining results or asked not to
+	typed := ""
+	if refine == "" && values.Get("spelling") != "0" {
+		corrected, changed, err := correctQuery(index, sc.Speller, what,
+			fields)
+		if err != nil {
+			return err
+		}
+		if changed {
+			typed = what
+			what = corrected
+		}
+	}
 
 	whereStart := time.Now()
-	offers, err := findOffersFromLocation(where, spatial, geocoder)
-	if err != nil {
-		return err
+	generation := cache.Generation()
+	var offers []datedOffer
+	if refine == "" && !includeDeleted {
+		offers = cache.Get(what, where, includeRemote)
+	}
+	cached := offers != nil
+	combined := refine == "" && !cached && useBleveSpatial(sc.Backend, where)
+	partial := false
+	if refine != "" {
+		offers = results.Get(refine, whereStart)
+		if offers == nil {
+			return fmt.Errorf("search results have expired, please search again")
+		}
+	} else if combined {
+		var nationwide []string
+		if includeRemote {
+			for _, o := range spatial.FindNationwide() {
+				nationwide = append(nationwide, o.Id)
+			}
+		}
+		offers, partial, err = findOffersFromIndex(index, what, where, geocoder,
+			nationwide, fields, limits)
+		if err != nil {
+			return err
+		}
+	} else if !cached {
+		offers, err = findOffersFromLocation(where, spatial, geocoder, router,
+			includeRemote)
+		if err != nil {
+			return err
+		}
 	}
 	spatialCount := len(offers)
 	whatStart := time.Now()
 	textCount := 0
-	if len(what) > 0 && len(offers) > 0 {
-		ids := make([]string, len(offers))
-		for i, offer := range offers {
-			ids[i] = offer.Id
+	if !cached && !combined && len(what) > 0 && len(offers) > 0 {
+		// Refined results may include deleted offers
+		ids := []string{}
+		deletedIds := []string{}
+		for _, offer := range offers {
+			if offer.Deleted {
+				deletedIds = append(deletedIds, offer.Id)
+			} else {
+				ids = append(ids, offer.Id)
+			}
 		}
 		sort.Strings(ids)
-		offers, err = findOffersFromText(index, what, ids)
+		sort.Strings(deletedIds)
+		offers = []datedOffer{}
+		if len(ids) > 0 {
+			offers, partial, err = findOffersFromText(index, what, ids, fields,
+				limits)
+			if err != nil {
+				return err
+			}
+		}
+		if len(deletedIds) > 0 {
+			deletedIndex, err := deleted.Get()
+			if err != nil {
+				return err
+			}
+			found, truncated, err := findOffersFromText(deletedIndex, what,
+				deletedIds, fields, limits)
+			if err != nil {
+				return err
+			}
+			markDeleted(found)
+			offers = append(offers, found...)
+			partial = partial || truncated
+		}
+		textCount = len(offers)
+	}
+	if refine == "" && includeDeleted {
+		deletedIndex, err := deleted.Get()
 		if err != nil {
 			return err
 		}
-		textCount = len(offers)
+		found, truncated, err := findDeletedOffers(deletedIndex, what, where,
+			geocoder, fields, limits)
+		if err != nil {
+			return err
+		}
+		offers = append(offers, found...)
+		partial = partial || truncated
+	}
+	// Truncated results depend on the query and are not cached, nor are
+	// deleted offers
+	if refine == "" && !cached && !partial && !includeDeleted {
+		cache.Put(what, where, includeRemote, generation, offers)
+	}
+	now := time.Now().In(loc)
+	if ageFilter != "" {
+		offers, err = filterMaxAge(store, index, deleted, offers, maxAge, now)
+		if err != nil {
+			return err
+		}
+	}
+	facets, filtered, err := filterFacets(store, sc.Facets, offers, values,
+		maxFacets, now)
+	if err != nil {
+		return err
 	}
 	formatStart := time.Now()
+	// Refining applies facet filters again, exports do not
+	token := results.Put(offers, formatStart)
+	snapshot := token
+	if len(filtered) != len(offers) {
+		snapshot = results.Put(filtered, formatStart)
+	}
 	spatialDuration := whatStart.Sub(whereStart)
 	textDuration := formatStart.Sub(whatStart)
-	err = formatOffers(templ, store, offers, where, what, spatialDuration,
-		textDuration, w, r)
+	err = formatOffers(templ, store, index, deleted, &searchResults{
+		Offers:          filtered,
+		Facets:          facets,
+		Where:           where,
+		Centers:         searchCenters(where, geocoder),
+		What:            what,
+		Typed:           typed,
+		AgeFilter:       ageFilter,
+		Token:           token,
+		Snapshot:        snapshot,
+		Partial:         partial,
+		SpatialDuration: spatialDuration,
+		TextDuration:    textDuration,
+	}, loc, w, r)
 	end := time.Now()
 	formatDuration := end.Sub(formatStart)
+	if cached {
+		log.Printf("cached '%s', '%s': %d in %s, format: %d in %s\n", where,
+			what, spatialCount, ftime(spatialDuration), len(offers),
+			ftime(formatDuration))
+		return err
+	}
 	log.Printf("spatial '%s': %d in %s, text: '%s': %d in %s, format: %d in %s\n",
 		where, spatialCount, ftime(spatialDuration),
 		what, textCount, ftime(textDuration),
@@ -331,9 +1137,8 @@ func serveQuery(templ *Templates, store *Store, index bleve.Index,
 	return err
 }
 
-func handleQuery(templ *Templates, store *Store, index bleve.Index,
-	spatial *SpatialIndex, geocoder *Geocoder, w http.ResponseWriter, r *http.Request) {
-	err := serveQuery(templ, store, index, spatial, geocoder, w, r)
+func handleQuery(sc *SearchContext, w http.ResponseWriter, r *http.Request) {
+	err := serveQuery(sc, w, r)
 	if err != nil {
 		log.Printf("error: query failed with: %s", err)
 		w.Header().Set("Content-Type", "text/plain")
@@ -350,6 +1155,10 @@ func handleDensity(templ *Templates, store *Store, index bleve.Index,
 		return err
 	}
 	what := strings.TrimSpace(values.Get("what"))
+	opts, err := parseDensityOptions(values)
+	if err != nil {
+		return err
+	}
 	size := strings.TrimSpace(values.Get("size"))
 	if size == "" {
 		size = "500"
@@ -359,20 +1168,33 @@ func handleDensity(templ *Templates, store *Store, index bleve.Index,
 		return err
 	}
 	u := "densitymap?" + r.URL.RawQuery
+	// Clicks are translated relatively to the map inside its frame
+	offset := densityOffset(opts, len(densityLabels(what, opts, time.Now())))
 	data := struct {
-		URL    string
-		What   string
-		Size   string
-		X0, Y0 float64
-		DX, DY float64
+		URL       string
+		What      string
+		Weight    string
+		Weights   []string
+		Contours  int
+		Fill      bool
+		Size      string
+		Left, Top int
+		X0, Y0    float64
+		DX, DY    float64
 	}{
-		URL:  u,
-		What: what,
-		Size: size,
-		X0:   box.MinX,
-		Y0:   box.MaxY,
-		DX:   (box.MaxX - box.MinX) / sz,
-		DY:   -(box.MaxY - box.MinY) / sz,
+		URL:      u,
+		What:     what,
+		Weight:   opts.Weight,
+		Weights:  []string{weightCount, weightSalary, weightRecency},
+		Contours: opts.Contours,
+		Fill:     opts.Fill,
+		Size:     size,
+		Left:     offset.X,
+		Top:      offset.Y,
+		X0:       box.MinX,
+		Y0:       box.MaxY,
+		DX:       (box.MaxX - box.MinX) / sz,
+		DY:       -(box.MaxY - box.MinY) / sz,
 	}
 	h := w.Header()
 	h.Set("Content-Type", "text/html")
@@ -383,8 +1205,11 @@ func ftime(d time.Duration) string {
 	return fmt.Sprintf("%.3fs", float64(d)/float64(time.Second))
 }
 
+// handleDensityMap renders the density map of offers matching the "what"
+// parameter. Unlabeled maps of all offers are cached until the indexes are
+// updated.
 func handleDensityMap(templ *Templates, store *Store, index bleve.Index,
-	spatial *SpatialIndex, box shp.Box, shapes []shp.Shape,
+	spatial *SpatialIndex, box shp.Box, shapes []shp.Shape, cache *BytesCache,
 	w http.ResponseWriter, r *http.Request) error {
 
 	values, err := url.ParseQuery(r.URL.RawQuery)
@@ -392,16 +1217,38 @@ func handleDensityMap(templ *Templates, store *Store, index bleve.Index,
 		return err
 	}
 	what := strings.TrimSpace(values.Get("what"))
+	opts, err := parseDensityOptions(values)
+	if err != nil {
+		return err
+	}
 	gridSize := 500
 	size := strings.TrimSpace(values.Get("size"))
 	if size != "" {
 		n, err := strconv.ParseInt(size, 10, 32)
-		if err == nil {
+		if err == nil && n > 0 {
 			gridSize = int(n)
 		}
+		if gridSize > maxDensitySize {
+			gridSize = maxDensitySize
+		}
 	}
 	start := time.Now()
-	points, err := listPoints(store, index, spatial, what)
+	h := w.Header()
+	labels := densityLabels(what, opts, start)
+	cacheable := what == "" && len(labels) == 0
+	cacheKey := strconv.Itoa(gridSize) + opts.CacheKey()
+	if cacheable {
+		data := cache.Get(cacheKey)
+		if data != nil {
+			h.Set("Content-Type", "image/png")
+			_, err = w.Write(data)
+			log.Printf("densitymap: size: %d, cached in %s", gridSize,
+				ftime(time.Now().Sub(start)))
+			return err
+		}
+	}
+	generation := cache.Generation()
+	points, err := listPoints(store, index, spatial, what, opts.Weight, start)
 	if err != nil {
 		return err
 	}
@@ -409,19 +1256,27 @@ func handleDensityMap(templ *Templates, store *Store, index bleve.Index,
 	grid := makeMapGrid(points, box, gridSize, gridSize)
 	grid = convolveGrid(grid)
 	gridTime := time.Now()
-	img := drawGrid(grid)
+	img := drawDensity(grid, opts)
 	drawTime := time.Now()
 	err = drawShapes(box, shapes, img)
 	if err != nil {
 		return err
 	}
 	shapesTime := time.Now()
-	h := w.Header()
+	buf := &bytes.Buffer{}
+	err = writeDensityPNG(buf, frameDensity(img, labels, opts), opts.DPI)
+	if err != nil {
+		return err
+	}
+	if cacheable {
+		cache.Put(cacheKey, generation, buf.Bytes())
+	}
 	h.Set("Content-Type", "image/png")
-	err = png.Encode(w, img)
+	_, err = w.Write(buf.Bytes())
 	end := time.Now()
-	log.Printf("densitymap: size: %d, '%s': %d points, total: %s, list: %s, grid: %s, "+
-		"draw: %s, shapes: %s, encode: %s", gridSize, what, len(points),
+	log.Printf("densitymap: size: %d, '%s', weight: %s: %d points, total: %s, "+
+		"list: %s, grid: %s, draw: %s, shapes: %s, encode: %s", gridSize, what,
+		opts.Weight, len(points),
 		ftime(end.Sub(start)),
 		ftime(listTime.Sub(start)),
 		ftime(gridTime.Sub(listTime)),
@@ -442,20 +1297,34 @@ func enforcePost(rq *http.Request, w http.ResponseWriter) bool {
 }
 
 type GeocodingHandler struct {
-	geocoder *Geocoder
-	store    *Store
-	spatial  *SpatialIndex
-	lock     sync.Mutex
-	running  bool
+	geocoder   *Geocoder
+	store      *Store
+	spatial    *SpatialIndex
+	indexer    *Indexer
+	generation *IndexGeneration
+	// Closed to interrupt geocoding
+	stop chan struct{}
+	// Waits for the geocoding goroutine
+	wait    sync.WaitGroup
+	lock    sync.Mutex
+	closed  bool
+	running bool
 }
 
+// NewGeocodingHandler returns a handler geocoding offers in the background.
+// Geocoded offers are added to the spatial index and reindexed by indexer,
+// to update their geopoints.
 func NewGeocodingHandler(store *Store, geocoder *Geocoder,
-	spatial *SpatialIndex) *GeocodingHandler {
+	spatial *SpatialIndex, indexer *Indexer,
+	generation *IndexGeneration) *GeocodingHandler {
 
 	return &GeocodingHandler{
-		store:    store,
-		geocoder: geocoder,
-		spatial:  spatial,
+		store:      store,
+		geocoder:   geocoder,
+		spatial:    spatial,
+		indexer:    indexer,
+		generation: generation,
+		stop:       make(chan struct{}),
 	}
 }
 
@@ -470,11 +1339,13 @@ func (h *GeocodingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 func (h *GeocodingHandler) Geocode() {
 	h.lock.Lock()
 	defer h.lock.Unlock()
-	if h.running {
+	if h.running || h.closed {
 		return
 	}
 	h.running = true
+	h.wait.Add(1)
 	go func() {
+		defer h.wait.Done()
 		defer func() {
 			h.lock.Lock()
 			defer h.lock.Unlock()
@@ -489,38 +1360,50 @@ func (h *GeocodingHandler) Geocode() {
 	}()
 }
 
+// Close interrupts geocoding, if running, and waits for it to stop.
+func (h *GeocodingHandler) Close() {
+	h.lock.Lock()
+	if !h.closed {
+		h.closed = true
+		close(h.stop)
+	}
+	h.lock.Unlock()
+	h.wait.Wait()
+}
+
 func (h *GeocodingHandler) geocode(minQuota int) error {
-	ids, err := h.store.List()
+	ids, skipped, err := listGeocodingCandidates(h.store,
+		rand.New(rand.NewSource(time.Now().UnixNano())), time.Now())
 	if err != nil {
 		return err
 	}
-	log.Printf("geocoding %d offers", len(ids))
-	shuffle(ids)
-	for _, id := range ids {
-		loc, _, err := h.store.GetLocation(id)
+	log.Printf("geocoding %d offers, %d skipped", len(ids), skipped)
+	defer h.generation.Bump()
+	ops := []Queued{}
+	defer func() {
+		err := h.indexer.Enqueue(ops)
 		if err != nil {
-			return err
-		}
-		if loc != nil {
-			continue
-		}
-		offer, err := getStoreOffer(h.store, id)
-		if err != nil {
-			return err
+			log.Printf("error: cannot reindex geocoded offers: %s", err)
 		}
-		if offer == nil {
-			continue
+	}()
+	for _, id := range ids {
+		select {
+		case <-h.stop:
+			log.Printf("geocoding interrupted")
+			return nil
+		default:
 		}
-		pos, _, off, err := geocodeOffer(h.geocoder, offer.Location, false, 0)
+		offer, pos, stop, err := geocodeStoredOffer(h.store, h.geocoder, id,
+			minQuota)
 		if err != nil {
 			return err
 		}
 		if pos == nil {
+			if stop {
+				break
+			}
 			continue
 		}
-		if off {
-			break
-		}
 		err = h.store.PutLocation(id, pos, offer.Date)
 		if err != nil {
 			return err
@@ -531,19 +1414,145 @@ func (h *GeocodingHandler) geocode(minQuota int) error {
 		} else if offerLoc != nil {
 			h.spatial.Remove(offer.Id)
 			h.spatial.Add(offerLoc)
+			ops = append(ops, Queued{Id: offer.Id, Op: AddOp})
+		}
+		if stop {
+			break
 		}
 	}
 	return nil
 }
 
+// handleAdminOffer deletes or undeletes the offer whose identifier follows
+// prefix in the request path, depending on the "action" form value, and
+// schedules its indexation.
+func handleAdminOffer(store *Store, indexer *Indexer, prefix string,
+	w http.ResponseWriter, r *http.Request) error {
+
+	id := strings.TrimPrefix(r.URL.Path, prefix)
+	if id == "" || strings.Contains(id, "/") {
+		return fmt.Errorf("invalid offer identifier: %q", id)
+	}
+	id = normalizeOfferId(id)
+	action := r.FormValue("action")
+	var msg string
+	switch action {
+	case "delete":
+		data, err := store.Get(id)
+		if err != nil {
+			return err
+		}
+		if data == nil {
+			return fmt.Errorf("unknown offer: %s", id)
+		}
+		deletedId, err := store.Delete(id, time.Now())
+		if err != nil {
+			return err
+		}
+		err = putOfferDate(store, data, deletedId)
+		if err != nil {
+			return err
+		}
+		err = indexer.Enqueue([]Queued{
+			{Id: id, Op: RemoveOp},
+			{Id: id, Op: DeletedOp},
+			{Id: id, Op: DatesOp},
+		})
+		if err != nil {
+			return err
+		}
+		msg = fmt.Sprintf("%s deleted as %d", id, deletedId)
+	case "undelete":
+		restoredId, err := store.Undelete(id)
+		if err != nil {
+			return err
+		}
+		if restoredId == 0 {
+			return fmt.Errorf("no deleted version of %s", id)
+		}
+		err = indexer.Enqueue([]Queued{
+			{Id: id, Op: AddOp},
+			{Id: id, Op: DeletedOp},
+			{Id: id, Op: DatesOp},
+		})
+		if err != nil {
+			return err
+		}
+		msg = fmt.Sprintf("%s restored from %d", id, restoredId)
+	default:
+		return fmt.Errorf("unknown action: %q", action)
+	}
+	log.Printf("admin: %s", msg)
+	w.Header().Set("Content-Type", "text/plain")
+	_, err := fmt.Fprintf(w, "OK: %s\n", msg)
+	return err
+}
+
+// handleChanges prints offers changes per day, most recent first unless
+// order=asc, as JSON lines if format=json.
 func handleChanges(store *Store, w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	err := printChanges(w, store, true)
+	format := r.FormValue("format")
+	if format == outputJSON {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	err := printChanges(w, store, r.FormValue("order") != "asc", format)
 	if err != nil {
 		log.Printf("error: %s", err)
 	}
 }
 
+// registerProfiler serves net/http/pprof handlers under adminURL in mux.
+func registerProfiler(mux *http.ServeMux, adminURL string) {
+	prefix := adminURL + "/debug/pprof/"
+	profilers := map[string]http.HandlerFunc{
+		"":        pprof.Index,
+		"cmdline": pprof.Cmdline,
+		"profile": pprof.Profile,
+		"symbol":  pprof.Symbol,
+		"trace":   pprof.Trace,
+	}
+	for name, h := range profilers {
+		// pprof.Index expects paths starting with /debug/pprof/
+		mux.Handle(prefix+name, http.StripPrefix(adminURL, h))
+	}
+}
+
+// newWebMuxes returns the mux of public handlers, the mux of admin handlers,
+// restricted to admins, and the mux mounting them in adminURL. The latter is
+// the public mux unless separateAdmin is set, to serve admin handlers on
+// their own listener, away from the public address. Neither serves the
+// handlers net/http/pprof and expvar register in http.DefaultServeMux.
+func newWebMuxes(accounts *Accounts, publicURL, adminURL string,
+	separateAdmin bool) (*http.ServeMux, *http.ServeMux, *http.ServeMux) {
+
+	publicMux := http.NewServeMux()
+	adminMux := http.NewServeMux()
+	adminRoot := publicMux
+	if separateAdmin {
+		adminRoot = http.NewServeMux()
+	}
+	adminPaths := append([]string{"/publish", "/users", "/vars", "/debug/pprof/"},
+		writerPaths...)
+	var checkedAdmin http.Handler = adminMux
+	if accounts != nil {
+		checkedAdmin = RequireRole(accounts, roleAdmin, publicURL, adminMux)
+	}
+	adminHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Only RequireRole can tell who performs admin requests
+		r.Header.Del(actorHeader)
+		checkedAdmin.ServeHTTP(w, r)
+	})
+	for _, path := range adminPaths {
+		adminRoot.Handle(adminURL+path, adminHandler)
+	}
+	// Published counters, including store, geocoder and queue ones
+	adminMux.Handle(adminURL+"/vars", expvar.Handler())
+	registerProfiler(adminMux, adminURL)
+	return publicMux, adminMux, adminRoot
+}
+
 var (
 	webCmd        = app.Command("web", "APEC web frontend")
 	webHttp       = webCmd.Flag("http", "http server address").Default(":8081").String()
@@ -551,127 +1560,623 @@ var (
 			String()
 	webAdminPath = webCmd.Flag("admin-path", "base URL path for admin content").
 			String()
+	webMaxHits = webCmd.Flag("max-hits",
+		"maximum number of full text search hits, more are reported as partial").
+		Default("20000").Int()
+	webMaxFilterIds = webCmd.Flag("max-filter-ids",
+		"maximum number of spatial results passed to full text queries, "+
+			"larger sets are filtered after the search").Default("20000").Int()
+	webSearchTimeout = webCmd.Flag("search-timeout",
+		"full text search timeout, zero to disable").Default("10s").Duration()
+	webSearchMemory = webCmd.Flag("max-search-memory",
+		"estimated memory per full text search in MB, more hits are reported "+
+			"as partial, zero to disable").Default("0").Int()
+	webMaxSearches = webCmd.Flag("max-searches",
+		"maximum number of concurrent searches, zero to disable").
+		Default("4").Int()
+	webMaxRenders = webCmd.Flag("max-renders",
+		"maximum number of concurrent density map renders, zero to disable").
+		Default("1").Int()
+	webBusyTimeout = webCmd.Flag("busy-timeout",
+		"throttled requests wait this long before failing with 503").
+		Default("5s").Duration()
+	webWarmQueries = webCmd.Flag("warm-queries",
+		"number of popular queries replayed on startup, zero to disable").
+		Default("20").Int()
+	webQueryLogSize = webCmd.Flag("query-log-size",
+		"rotate the public searches log after this size in MB, zero to "+
+			"disable").Default("16").Int()
+	webWorkerURL = webCmd.Flag("worker",
+		"serve replicas published by the worker at this URL, and forward "+
+			"admin requests to it").String()
+	webReplicaInterval = webCmd.Flag("replica-interval",
+		"delay between checks for new replicas").Default("30s").Duration()
+	webAccounts = webCmd.Flag("accounts",
+		"enable user accounts, with login and logout pages, admin handlers "+
+			"require the admin role").Bool()
+	webPrivate = webCmd.Flag("private",
+		"restrict public handlers to logged in users, requires --accounts").Bool()
+	webOAuthName = webCmd.Flag("oauth-name",
+		"OAuth provider name displayed on the login page").Default("OAuth").
+		String()
+	webOAuthAuthURL = webCmd.Flag("oauth-auth-url",
+		"OAuth provider authorization endpoint, enables OAuth logins with "+
+			"--accounts").String()
+	webOAuthTokenURL = webCmd.Flag("oauth-token-url",
+		"OAuth provider token endpoint").String()
+	webOAuthUserInfoURL = webCmd.Flag("oauth-userinfo-url",
+		"OAuth provider endpoint returning the user email").String()
+	webOAuthClientId = webCmd.Flag("oauth-client-id",
+		"OAuth client identifier, the secret is read from APEC_OAUTH_SECRET").
+		String()
+	webOAuthRedirectURL = webCmd.Flag("oauth-redirect-url",
+		"callback URL registered with the OAuth provider, ending with "+
+			"/login/oauth/callback").String()
+	webOAuthSignup = webCmd.Flag("oauth-signup",
+		"create viewer accounts for unknown OAuth users").Bool()
+	webSpatialBackend = webCmd.Flag("spatial-backend",
+		"spatial search backend, bleve requires indexes built with geopoints").
+		Default(spatialRTree).Enum(spatialRTree, spatialBleve)
+	webExportThreshold = webCmd.Flag("export-threshold",
+		"exports of more offers run in the background and are downloaded "+
+			"once complete").Default("5000").Int()
+	webMaxExports = webCmd.Flag("max-exports",
+		"maximum number of background exports running at once").
+		Default("2").Int()
+	webMaxDrift = webCmd.Flag("max-drift",
+		"warn and synchronize indexes on startup if their counts differ from "+
+			"stored offers by more than this percentage").Default("1").Float64()
+	webMaxQueueAge = webCmd.Flag("max-queue-age",
+		"warn and synchronize indexes on startup if the indexing queue has "+
+			"been lagging for longer, zero to disable").Default("1h").Duration()
+	webSitemap = webCmd.Flag("sitemap",
+		"public base URL of a public deployment, like https://example.com/apec, "+
+			"publish a sitemap and allow search engines in robots.txt").String()
+	webShutdownTimeout = webCmd.Flag("shutdown-timeout",
+		"on SIGINT or SIGTERM, wait this long for in-flight requests before "+
+			"closing the store").Default("30s").Duration()
+	webHttps = webCmd.Flag("https", "also serve HTTPS on this address, "+
+		"with --cert and --key or --acme-host").String()
+	webCert = webCmd.Flag("cert", "PEM certificate file served over HTTPS").
+		String()
+	webKey      = webCmd.Flag("key", "PEM private key file of --cert").String()
+	webAcmeHost = webCmd.Flag("acme-host", "obtain and renew the HTTPS "+
+		"certificate of this host name from Let's Encrypt, --http must be "+
+		"reachable on port 80 or --https on port 443").String()
+	webCompression = webCmd.Flag("compression",
+		"compress text responses for clients accepting it, gzip or none").
+		Default(compressionGzip).Enum(compressionGzip, compressionNone)
+	webCompressMinSize = webCmd.Flag("compress-min-size",
+		"responses smaller than this many bytes are not compressed").
+		Default(strconv.Itoa(defaultCompressMinSize)).Int()
+	webAdminHttp = webCmd.Flag("admin-http", "serve admin handlers and the "+
+		"profiler on this address only, instead of --http and --https").
+		String()
+	webAgeTimezone = webCmd.Flag("age-timezone",
+		"timezone in which offers ages are counted in days").
+		Default("Europe/Paris").String()
 )
 
 func web(cfg *Config) error {
 	publicURL := *webPublicPath
 	adminURL := *webAdminPath
 
-	home, err := ioutil.ReadFile("web/home.html")
+	homePath, err := templatePath(cfg.TemplatesDir, "home.html")
 	if err != nil {
 		return err
 	}
-	store, err := OpenStore(cfg.Store())
+	home, err := ioutil.ReadFile(homePath)
 	if err != nil {
-		return fmt.Errorf("cannot open data store: %s", err)
+		return err
 	}
-	defer store.Close()
-	index, err := OpenOfferIndex(cfg.Index())
+	templ, err := loadTemplates(cfg.TemplatesDir)
 	if err != nil {
-		return fmt.Errorf("cannot open index: %s", err)
+		return err
 	}
-	defer index.Close()
-	templ, err := loadTemplates()
+	searchCfg, err := loadSearchConfig(cfg.Search())
 	if err != nil {
 		return err
 	}
-	geocoder, err := NewGeocoder(cfg.GeocodingKey(), cfg.Geocoder())
+	speller, err := loadConfigSpeller(searchCfg)
 	if err != nil {
-		return fmt.Errorf("cannot open geocoder: %s", err)
+		return err
 	}
-	spatial := NewSpatialIndex()
-	queue, err := OpenIndexQueue(cfg.Queue())
+	ageLoc, err := time.LoadLocation(*webAgeTimezone)
 	if err != nil {
-		return err
+		return fmt.Errorf("invalid --age-timezone: %s", err)
+	}
+	router, err := NewRouter(cfg.RoutingURL(), cfg.Routing())
+	if err != nil {
+		return fmt.Errorf("cannot open router: %s", err)
+	}
+	defer router.Close()
+	generation := &IndexGeneration{}
+
+	var accounts *Accounts
+	if *webAccounts {
+		accounts, err = OpenAccounts(cfg.Accounts())
+		if err != nil {
+			return fmt.Errorf("cannot open accounts: %s", err)
+		}
+		defer accounts.Close()
+	} else if *webPrivate {
+		return fmt.Errorf("--private requires --accounts")
+	}
+	var oauth *OAuthProvider
+	if *webOAuthAuthURL != "" {
+		if accounts == nil {
+			return fmt.Errorf("--oauth-auth-url requires --accounts")
+		}
+		oauth, err = NewOAuthProvider(*webOAuthName, *webOAuthAuthURL,
+			*webOAuthTokenURL, *webOAuthUserInfoURL, *webOAuthClientId,
+			cfg.OAuthSecret(), *webOAuthRedirectURL, *webOAuthSignup)
+		if err != nil {
+			return err
+		}
+	}
+	if *webPrivate && *webSitemap != "" {
+		return fmt.Errorf("--sitemap cannot publish --private deployments")
+	}
+	if *webHttps == "" && (*webCert != "" || *webKey != "" ||
+		*webAcmeHost != "") {
+		return fmt.Errorf("--cert, --key and --acme-host require --https")
+	}
+
+	if *webAdminHttp != "" && (*webAdminHttp == *webHttp ||
+		*webAdminHttp == *webHttps) {
+		return fmt.Errorf("--admin-http must differ from --http and --https")
 	}
-	defer queue.Close()
-	indexer := NewIndexer(store, index, queue)
-	defer indexer.Close()
-	indexer.Sync()
 
-	spatialIndexer := NewSpatialIndexer(store, spatial, geocoder)
-	defer spatialIndexer.Close()
-	spatialIndexer.Sync()
+	publicMux, adminMux, adminRoot := newWebMuxes(accounts, publicURL,
+		adminURL, *webAdminHttp != "")
 
-	geocodingHandler := NewGeocodingHandler(store, geocoder, spatial)
+	// Either serve replicas published by a worker, or own the store
+	var replicas *ReplicaHolder
+	var writer *Writer
+	if *webWorkerURL != "" {
+		watcher, err := NewReplicaWatcher(cfg, generation)
+		if err != nil {
+			return err
+		}
+		defer watcher.Close()
+		go watcher.Watch(*webReplicaInterval)
+		replicas = watcher.Holder()
+		err = proxyAdmin(adminMux, adminURL, *webWorkerURL)
+		if err != nil {
+			return err
+		}
+	} else {
+		writer, err = OpenWriter(cfg, searchCfg, generation)
+		if err != nil {
+			return err
+		}
+		defer writer.Close()
+		replicas = NewReplicaHolder(writer.Replica())
+		writer.RegisterAdmin(adminMux, adminURL)
+	}
+	schemaVersion, err := getIndexSchemaVersion(replicas.Get().Index.Get())
+	if err != nil {
+		return fmt.Errorf("cannot read index schema version: %s", err)
+	}
+	if schemaVersion != indexSchemaVersion {
+		log.Printf("warning: index schema version is %d, expected %d, "+
+			"rebuild it with POST %s/reindex", schemaVersion, indexSchemaVersion,
+			adminURL)
+	}
+	// Probe in the background, the writer spatial index is filled
+	// asynchronously.
+	go func() {
+		var queue *IndexQueue
+		sync := func() error {
+			return requestWorkerSync(*webWorkerURL, adminURL)
+		}
+		if writer != nil {
+			writer.SpatialIndexer.SyncAndWait()
+			queue = writer.Queue
+			sync = func() error {
+				writer.Indexer.Sync()
+				writer.SpatialIndexer.Sync()
+				return nil
+			}
+		}
+		err := checkConsistency(replicas.Get(), queue, *webMaxDrift,
+			*webMaxQueueAge, sync)
+		if err != nil {
+			log.Printf("error: consistency check failed: %s", err)
+		}
+	}()
 
 	box := makeFranceBox()
-	shapes, err := shpdraw.LoadAndFilterShapes("shp/TM_WORLD_BORDERS-0.3.shp", box)
+	shapes, err := loadBorders(cfg, box)
+	if err != nil {
+		return err
+	}
+	areas, err := LoadAreas(cfg.ShapesDir)
 	if err != nil {
 		return err
 	}
 
 	// Public handlers
-	http.HandleFunc(publicURL+"/", func(w http.ResponseWriter, r *http.Request) {
+	publicMux.HandleFunc(publicURL+"/", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		w.Write(home)
 	})
 	jsPrefix := publicURL + "/js/"
-	http.Handle(jsPrefix, http.StripPrefix(jsPrefix, http.FileServer(http.Dir("web/js"))))
-	http.HandleFunc(publicURL+"/search", func(w http.ResponseWriter, r *http.Request) {
-		handleQuery(templ, store, index, spatial, geocoder, w, r)
+	publicMux.Handle(jsPrefix, http.StripPrefix(jsPrefix, http.FileServer(http.Dir("web/js"))))
+	results := NewResultSets(1000, 30*time.Minute)
+	queryCache := NewQueryCache(generation, 1000)
+	imageCache := NewBytesCache(generation, 100)
+	queryLog, err := OpenQueryLog(cfg.QueryLog(), int64(*webQueryLogSize)<<20)
+	if err != nil {
+		return err
+	}
+	defer queryLog.Close()
+	limits := SearchLimits{
+		MaxHits:      *webMaxHits,
+		MaxFilterIds: *webMaxFilterIds,
+		Timeout:      *webSearchTimeout,
+		MaxMemory:    int64(*webSearchMemory) * 1024 * 1024,
+	}
+	// Search pages query the replica served when they start
+	searchContext := SearchContext{
+		Templates: templ,
+		Router:    router,
+		Results:   results,
+		Cache:     queryCache,
+		Facets:    NewFacetCache(generation, 100000),
+		Limits:    limits,
+		Fields:    searchCfg.Fields,
+		Speller:   speller,
+		Backend:   *webSpatialBackend,
+		Loc:       ageLoc,
+	}
+	// Searches and renders memory grows with their result sets, bound the
+	// number of them running at once.
+	searchThrottle := NewThrottle(*webMaxSearches, *webBusyTimeout)
+	renderThrottle := NewThrottle(*webMaxRenders, *webBusyTimeout)
+	webStats := expvar.NewMap("web")
+	webStats.Set("searches", searchThrottle.Stats())
+	webStats.Set("renders", renderThrottle.Stats())
+	publicMux.HandleFunc(publicURL+"/search", Throttled(searchThrottle,
+		func(w http.ResponseWriter, r *http.Request) {
+			err := queryLog.LogRequest(r)
+			if err != nil {
+				log.Printf("error: cannot log query: %s", err)
+			}
+			sc := searchContext
+			sc.Replica = replicas.Get()
+			handleQuery(&sc, w, r)
+		}))
+	publicMux.HandleFunc(publicURL+"/search.atom", Throttled(searchThrottle,
+		func(w http.ResponseWriter, r *http.Request) {
+			sc := searchContext
+			sc.Replica = replicas.Get()
+			handleSearchFeed(&sc, *webSitemap, publicURL, w, r)
+		}))
+	publicMux.HandleFunc(publicURL+"/api/search", Throttled(searchThrottle,
+		func(w http.ResponseWriter, r *http.Request) {
+			err := queryLog.LogRequest(r)
+			if err != nil {
+				log.Printf("error: cannot log query: %s", err)
+			}
+			sc := searchContext
+			sc.Replica = replicas.Get()
+			handleSearchAPI(&sc, w, r)
+		}))
+	publicMux.HandleFunc(publicURL+"/api/quicksearch", Throttled(searchThrottle,
+		func(w http.ResponseWriter, r *http.Request) {
+			rep := replicas.Get()
+			err := handleQuickSearch(rep.Store, rep.Index.Get(), limits, w, r)
+			if err != nil {
+				log.Printf("error: quick search failed with: %s", err)
+				w.Header().Set("Content-Type", "text/plain")
+				w.WriteHeader(400)
+				fmt.Fprintf(w, "error: %s\n", err)
+			}
+		}))
+	publicMux.HandleFunc(publicURL+"/api/suggest", Throttled(searchThrottle,
+		func(w http.ResponseWriter, r *http.Request) {
+			err := handleSuggest(replicas.Get().Index.Get(), w, r)
+			if err != nil {
+				log.Printf("error: suggest failed with: %s", err)
+				w.Header().Set("Content-Type", "text/plain")
+				w.WriteHeader(400)
+				fmt.Fprintf(w, "error: %s\n", err)
+			}
+		}))
+	publicMux.HandleFunc(publicURL+"/opensearch", func(w http.ResponseWriter, r *http.Request) {
+		err := handleOpenSearch(replicas.Get().Geocoder, w, r)
+		if err != nil {
+			log.Printf("error: opensearch failed with: %s", err)
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "error: %s\n", err)
+		}
 	})
-	http.HandleFunc(publicURL+"/density", func(w http.ResponseWriter, r *http.Request) {
-		err := handleDensity(templ, store, index, box, w, r)
+	publicMux.HandleFunc(publicURL+"/opensearch.xml", func(w http.ResponseWriter, r *http.Request) {
+		err := handleOpenSearchDescription(*webSitemap, publicURL, w, r)
 		if err != nil {
-			log.Printf("error: density failed with: %s", err)
+			log.Printf("error: opensearch description failed with: %s", err)
+		}
+	})
+	exportJobs, err := NewExportJobs(*webExportThreshold, *webMaxExports,
+		time.Hour)
+	if err != nil {
+		return err
+	}
+	defer exportJobs.Close()
+	publicMux.HandleFunc(publicURL+"/export", Throttled(searchThrottle,
+		func(w http.ResponseWriter, r *http.Request) {
+			sc := searchContext
+			sc.Replica = replicas.Get()
+			handleExport(&sc, exportJobs, sc.Replica.Retain, w, r)
+		}))
+	publicMux.HandleFunc(publicURL+"/downloads/", func(w http.ResponseWriter, r *http.Request) {
+		handleDownload(exportJobs, w, r)
+	})
+	publicMux.HandleFunc(publicURL+"/calendar.ics", func(w http.ResponseWriter, r *http.Request) {
+		rep := replicas.Get()
+		err := handleCalendar(rep.Store, rep.Lifetimes, ageLoc, w, r)
+		if err != nil {
+			log.Printf("error: calendar failed with: %s", err)
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "error: %s\n", err)
 		}
 	})
-	http.HandleFunc(publicURL+"/densitymap", func(w http.ResponseWriter, r *http.Request) {
-		err := handleDensityMap(templ, store, index, spatial, box, shapes, w, r)
+	publicMux.HandleFunc(publicURL+"/context", func(w http.ResponseWriter, r *http.Request) {
+		err := handleOfferContext(replicas.Get().Store, w, r)
+		if err != nil {
+			log.Printf("error: context export failed with: %s", err)
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "error: %s\n", err)
+		}
+	})
+	publicMux.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		handleRobots(*webSitemap, publicURL, w, r)
+	})
+	if *webSitemap != "" {
+		sitemapCache := NewBytesCache(generation, 1)
+		publicMux.HandleFunc(publicURL+"/sitemap.xml", Throttled(searchThrottle,
+			func(w http.ResponseWriter, r *http.Request) {
+				err := handleSitemap(replicas.Get().Store, *webSitemap,
+					offerPagePath, sitemapCache, w, r)
+				if err != nil {
+					log.Printf("error: sitemap failed with: %s", err)
+					w.Header().Set("Content-Type", "text/plain")
+					w.WriteHeader(500)
+					fmt.Fprintf(w, "error: %s\n", err)
+				}
+			}))
+	}
+	publicMux.HandleFunc(publicURL+"/density", func(w http.ResponseWriter, r *http.Request) {
+		rep := replicas.Get()
+		err := handleDensity(templ, rep.Store, rep.Index.Get(), box, w, r)
 		if err != nil {
 			log.Printf("error: density failed with: %s", err)
 		}
 	})
-	// Admin handlers
-	http.HandleFunc(adminURL+"/changes", func(w http.ResponseWriter, r *http.Request) {
-		handleChanges(store, w, r)
+	publicMux.HandleFunc(publicURL+"/densitymap", Throttled(renderThrottle,
+		func(w http.ResponseWriter, r *http.Request) {
+			rep := replicas.Get()
+			err := handleDensityMap(templ, rep.Store, rep.Index.Get(), rep.Spatial,
+				box, shapes, imageCache, w, r)
+			if err != nil {
+				log.Printf("error: density failed with: %s", err)
+			}
+		}))
+	publicMux.HandleFunc(publicURL+"/departments", func(w http.ResponseWriter, r *http.Request) {
+		err := handleDepartments(templ, areas, w, r)
+		if err != nil {
+			log.Printf("error: departments failed with: %s", err)
+		}
 	})
-	http.HandleFunc(adminURL+"/sync", func(w http.ResponseWriter, r *http.Request) {
-		if enforcePost(r, w) {
-			return
+	publicMux.HandleFunc(publicURL+"/departmentsmap", Throttled(renderThrottle,
+		func(w http.ResponseWriter, r *http.Request) {
+			rep := replicas.Get()
+			err := handleDepartmentsMap(rep.Store, rep.Index.Get(), areas, box,
+				shapes, w, r)
+			if err != nil {
+				log.Printf("error: departments map failed with: %s", err)
+				w.Header().Set("Content-Type", "text/plain")
+				w.WriteHeader(400)
+				fmt.Fprintf(w, "error: %s\n", err)
+			}
+		}))
+	publicMux.HandleFunc(publicURL+"/api/stats/departments", Throttled(searchThrottle,
+		func(w http.ResponseWriter, r *http.Request) {
+			rep := replicas.Get()
+			err := handleDepartmentStats(rep.Store, rep.Index.Get(), w, r)
+			if err != nil {
+				log.Printf("error: departments stats failed with: %s", err)
+				w.Header().Set("Content-Type", "text/plain")
+				w.WriteHeader(400)
+				fmt.Fprintf(w, "error: %s\n", err)
+			}
+		}))
+	publicMux.HandleFunc(publicURL+"/account", func(w http.ResponseWriter, r *http.Request) {
+		err := handleAccount(templ, w, r)
+		if err != nil {
+			log.Printf("error: account failed with: %s", err)
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "error: %s\n", err)
 		}
-		indexer.Sync()
-		spatialIndexer.Sync()
-		w.Write([]byte("OK"))
 	})
+	publicMux.HandleFunc(publicURL+"/api/accounts/", Throttled(searchThrottle,
+		func(w http.ResponseWriter, r *http.Request) {
+			err := handleSalaryHistory(replicas.Get().Store,
+				publicURL+"/api/accounts/", w, r)
+			if err != nil {
+				log.Printf("error: salary history failed with: %s", err)
+				w.Header().Set("Content-Type", "text/plain")
+				w.WriteHeader(400)
+				fmt.Fprintf(w, "error: %s\n", err)
+			}
+		}))
+	publicMux.HandleFunc(publicURL+offerPagePrefix, Throttled(searchThrottle,
+		func(w http.ResponseWriter, r *http.Request) {
+			err := handleOfferPage(templ, replicas.Get().Store,
+				publicURL+offerPagePrefix, w, r)
+			if err != nil {
+				log.Printf("error: offer page failed with: %s", err)
+				w.Header().Set("Content-Type", "text/plain")
+				w.WriteHeader(400)
+				fmt.Fprintf(w, "error: %s\n", err)
+			}
+		}))
+	publicMux.HandleFunc(publicURL+apecIdPath, Throttled(searchThrottle,
+		func(w http.ResponseWriter, r *http.Request) {
+			err := handleApecOfferCheck(replicas.Get().Store, *webPrivate,
+				cfg.OfferCheckToken(), w, r)
+			if err != nil {
+				log.Printf("error: offer check failed with: %s", err)
+				w.Header().Set("Content-Type", "text/plain")
+				w.WriteHeader(400)
+				fmt.Fprintf(w, "error: %s\n", err)
+			}
+		}))
 
-	crawlingLock := sync.Mutex{}
-	crawling := false
-	http.HandleFunc(adminURL+"/crawl", func(w http.ResponseWriter, r *http.Request) {
-		if enforcePost(r, w) {
-			return
-		}
-		crawlingLock.Lock()
-		defer crawlingLock.Unlock()
-		if !crawling {
-			crawling = true
-			go func() {
-				defer func() {
-					crawlingLock.Lock()
-					crawling = false
-					crawlingLock.Unlock()
-				}()
-				err := crawl(store, 0, nil)
+	if accounts != nil {
+		login := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			err := handleLogin(templ, accounts, oauth, publicURL, w, r)
+			if err != nil {
+				log.Printf("error: login failed with: %s", err)
+			}
+		})
+		logout := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if enforcePost(r, w) {
+				return
+			}
+			err := handleLogout(accounts, publicURL, w, r)
+			if err != nil {
+				log.Printf("error: logout failed with: %s", err)
+			}
+		})
+		publicMux.Handle(publicURL+"/login", login)
+		publicMux.Handle(publicURL+"/logout", logout)
+		if oauth != nil {
+			publicMux.HandleFunc(publicURL+"/login/oauth",
+				func(w http.ResponseWriter, r *http.Request) {
+					err := handleOAuthLogin(oauth, publicURL, w, r)
+					if err != nil {
+						log.Printf("error: OAuth login failed with: %s", err)
+					}
+				})
+			publicMux.HandleFunc(publicURL+"/login/oauth/callback",
+				func(w http.ResponseWriter, r *http.Request) {
+					err := handleOAuthCallback(oauth, accounts, publicURL, w, r)
+					if err != nil {
+						log.Printf("error: OAuth callback failed with: %s", err)
+					}
+				})
+		}
+		if adminRoot != publicMux {
+			// RequireRole redirects admins to the login page of their listener
+			adminRoot.Handle(publicURL+"/login", login)
+			adminRoot.Handle(publicURL+"/logout", logout)
+		}
+		var users http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			err := handleAdminUsers(accounts, w, r)
+			if err != nil {
+				log.Printf("error: users update failed with: %s", err)
+				w.Header().Set("Content-Type", "text/plain")
+				w.WriteHeader(400)
+				fmt.Fprintf(w, "error: %s\n", err)
+			}
+		})
+		if writer != nil {
+			users = Audited(writer.Store, adminURL, users)
+		} else {
+			// Replicas are read-only, users changes are recorded with the
+			// accounts and listed by their own audit handler.
+			users = Audited(accounts, adminURL, users)
+			adminMux.HandleFunc(adminURL+"/audit", func(w http.ResponseWriter, r *http.Request) {
+				err := handleAdminAudit(accounts, w, r)
 				if err != nil {
-					log.Printf("error: crawling failed with: %s", err)
-					return
+					log.Printf("error: audit listing failed with: %s", err)
+					w.Header().Set("Content-Type", "text/plain")
+					w.WriteHeader(400)
+					fmt.Fprintf(w, "error: %s\n", err)
 				}
-				indexer.Sync()
-				spatialIndexer.Sync()
-				geocodingHandler.Geocode()
-			}()
+			})
+		}
+		adminMux.Handle(adminURL+"/users", users)
+	}
+
+	// Saved searches belong to logged in users, the writer stores them
+	var alerts http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var err error
+		if accounts == nil {
+			err = fmt.Errorf("saved searches require --accounts")
+		} else if writer == nil {
+			err = fmt.Errorf("saved searches are not available on replicas")
+		} else {
+			err = handleAlerts(templ, writer.Store, publicURL, writer.Alerts != nil,
+				w, r)
+		}
+		if err != nil {
+			log.Printf("error: alerts failed with: %s", err)
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "error: %s\n", err)
 		}
-		w.Write([]byte("OK"))
 	})
-	http.Handle(adminURL+"/geocode", geocodingHandler)
+	if accounts != nil {
+		alerts = RequireRole(accounts, roleViewer, publicURL, alerts)
+	}
+	publicMux.Handle(publicURL+"/alerts", alerts)
 
-	http.HandleFunc(adminURL+"/panic", func(w http.ResponseWriter, r *http.Request) {
-		// Evade HTTP handler recover
+	if *webWarmQueries > 0 {
+		queries, err := loadTopQueries(cfg.QueryLog(), *webWarmQueries)
+		if err != nil {
+			return err
+		}
 		go func() {
-			panic("now")
+			// Replicas spatial indexes are loaded when opened
+			if writer != nil {
+				writer.SpatialIndexer.SyncAndWait()
+			}
+			err := warmCaches(getFromHandler(publicMux), publicURL,
+				queries)
+			if err != nil {
+				log.Printf("error: cannot warm caches: %s", err)
+			}
 		}()
-	})
+	}
 
-	return http.ListenAndServe(*webHttp, nil)
+	var handler http.Handler = publicMux
+	if *webPrivate {
+		handler = requireViewer(accounts, publicURL, handler)
+	}
+	if *webCompression == compressionGzip {
+		handler = Compressed(*webCompressMinSize, handler)
+	}
+	servers := []*http.Server{}
+	plainHandler := handler
+	if *webHttps != "" {
+		server, h, err := newTLSServer(*webHttps, handler, *webCert, *webKey,
+			*webAcmeHost, cfg.Acme())
+		if err != nil {
+			return err
+		}
+		servers = append(servers, server)
+		plainHandler = h
+	}
+	servers = append(servers, &http.Server{
+		Addr:    *webHttp,
+		Handler: plainHandler,
+	})
+	if *webAdminHttp != "" {
+		// Admin handlers already check roles, and are not compressed so
+		// profiles stream as they are collected
+		servers = append(servers, &http.Server{
+			Addr:    *webAdminHttp,
+			Handler: adminRoot,
+		})
+	}
+	// Deferred calls close the store, indexes and queue once in-flight
+	// requests completed
+	return serveUntilSignal(servers, *webShutdownTimeout)
 }
@@ -0,0 +1,648 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve"
+)
+
+func TestHandleQuery(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	tests := []struct {
+		What     string
+		Where    string
+		Count    string
+		Expected []string
+	}{
+		{"", "", "4/4 offers", []string{"1001", "1002", "1003", "1004"}},
+		{"python", "", "3/3 offers", []string{"1001", "1002", "1004"}},
+		{"python", "paris", "2/2 offers", []string{"1001", "1002"}},
+		{"golang or java", "", "2/2 offers", []string{"1001", "1004"}},
+		{"", "lyon", "1/1 offers", []string{"1003"}},
+		{"", "wgs84:44.84,-0.58,1000", "1/1 offers", []string{"1004"}},
+		{"", "lyon|bordeaux", "2/2 offers", []string{"1003", "1004"}},
+		{"python", "paris | bordeaux,1000", "3/3 offers",
+			[]string{"1001", "1002", "1004"}},
+		{"python near/1 golang", "", "1/1 offers", []string{"1001"}},
+		{"golang near/0 python", "", "0/0 offers", nil},
+		{"python and not golang", "", "2/2 offers", []string{"1002", "1004"}},
+		{"not (python or java)", "lyon", "1/1 offers", []string{"1003"}},
+		{"service", "", "1/1 offers", []string{"1001"}},
+		{"=service", "", "0/0 offers", nil},
+		{"=Services", "", "1/1 offers", []string{"1001"}},
+	}
+	for _, backend := range []string{spatialRTree, spatialBleve} {
+		env.Backend = backend
+		// Cached results do not depend on the backend
+		env.Generation.Bump()
+		for _, test := range tests {
+			w := env.Query(test.What, test.Where)
+			body := w.Body.String()
+			if w.Code != 200 {
+				t.Fatalf("%s: query %q/%q failed with %d: %s", backend, test.What,
+					test.Where, w.Code, body)
+			}
+			if !strings.Contains(body, test.Count) {
+				t.Fatalf("%s: query %q/%q: %q not found in:\n%s", backend,
+					test.What, test.Where, test.Count, body)
+			}
+			for _, id := range test.Expected {
+				if !strings.Contains(body, ApecURL+id+`"`) {
+					t.Fatalf("%s: query %q/%q: %s not found in:\n%s", backend,
+						test.What, test.Where, id, body)
+				}
+			}
+		}
+
+		for _, where := range []string{"unknown place", "paris|unknown place", "paris|"} {
+			w := env.Query("", where)
+			if w.Code != 400 {
+				t.Fatalf("%s: query %q succeeded: %d", backend, where, w.Code)
+			}
+		}
+	}
+}
+
+func TestHandleQueryIncludeRemote(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	loc := env.Spatial.Get("apec:1006")
+	if loc == nil || !loc.Nationwide {
+		t.Fatalf("1006 is not indexed as nationwide: %+v", loc)
+	}
+	tests := []struct {
+		What   string
+		Where  string
+		Remote bool
+		Count  string
+	}{
+		{"python", "", false, "3/3 offers"},
+		{"python", "", true, "4/4 offers"},
+		{"", "lyon", false, "1/1 offers"},
+		{"", "lyon", true, "2/2 offers"},
+		{"golang", "lyon", true, "0/0 offers"},
+	}
+	for _, backend := range []string{spatialRTree, spatialBleve} {
+		env.Backend = backend
+		env.Generation.Bump()
+		for _, test := range tests {
+			values := url.Values{}
+			values.Set("what", test.What)
+			values.Set("where", test.Where)
+			if test.Remote {
+				values.Set("include_remote", "1")
+			}
+			w := env.QueryValues(values)
+			body := w.Body.String()
+			if w.Code != 200 {
+				t.Fatalf("%s: query %v failed with %d: %s", backend, values, w.Code,
+					body)
+			}
+			if !strings.Contains(body, test.Count) {
+				t.Fatalf("%s: query %v: %q not found in:\n%s", backend, values,
+					test.Count, body)
+			}
+			remote := strings.Contains(body, ApecURL+"1006\"")
+			if remote != (test.Remote && test.What != "golang") {
+				t.Fatalf("%s: query %v: unexpected remote offer presence: %v",
+					backend, values, remote)
+			}
+		}
+	}
+}
+
+func TestHandleDensityMap(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	for _, what := range []string{"", "python"} {
+		w := env.DensityMap(what, 100)
+		if w.Code != 200 {
+			t.Fatalf("density map failed with %d: %s", w.Code, w.Body.String())
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "image/png" {
+			t.Fatalf("unexpected content type: %s", ct)
+		}
+		img, err := png.Decode(w.Body)
+		if err != nil {
+			t.Fatalf("could not decode density map: %s", err)
+		}
+		if b := img.Bounds(); b.Dx() != 100 || b.Dy() != 100 {
+			t.Fatalf("unexpected density map size: %v", b)
+		}
+	}
+}
+
+func TestHandleAdminOffer(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+	queue, err := OpenIndexQueue(env.Config.Queue())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queue.Close()
+	indexer := &Indexer{
+		store:   env.Store,
+		index:   NewIndexHolder(env.Index),
+		deleted: env.Deleted,
+		queue:   queue,
+		work:    make(chan bool, 1),
+	}
+
+	post := func(path, action string) (int, string) {
+		rq := httptest.NewRequest("POST", path, strings.NewReader("action="+action))
+		rq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		err := handleAdminOffer(env.Store, indexer, "/offer/", w, rq)
+		if err != nil {
+			return 400, err.Error()
+		}
+		return w.Code, w.Body.String()
+	}
+	// Returns the number of live and deleted indexed offers
+	indexed := func() (uint64, uint64) {
+		n, err := indexer.indexSome()
+		if err != nil || n != 3 {
+			t.Fatalf("could not process index queue: %d, %v", n, err)
+		}
+		count, err := env.Index.DocCount()
+		if err != nil {
+			t.Fatal(err)
+		}
+		deleted, err := env.Deleted.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		deletedCount, err := deleted.DocCount()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return count, deletedCount
+	}
+
+	code, body := post("/offer/1001", "delete")
+	if code != 200 || !strings.HasPrefix(body, "OK: apec:1001 deleted") {
+		t.Fatalf("could not delete offer: %d %s", code, body)
+	}
+	if n, d := indexed(); n != 5 || d != 1 {
+		t.Fatalf("unexpected number of indexed offers after deletion: %d, %d",
+			n, d)
+	}
+	data, err := env.Store.Get("apec:1001")
+	if err != nil || data != nil {
+		t.Fatalf("offer was not deleted: %s, %v", data, err)
+	}
+
+	code, body = post("/offer/1001", "undelete")
+	if code != 200 || !strings.HasPrefix(body, "OK: apec:1001 restored") {
+		t.Fatalf("could not undelete offer: %d %s", code, body)
+	}
+	if n, d := indexed(); n != 6 || d != 0 {
+		t.Fatalf("unexpected number of indexed offers after undeletion: %d, %d",
+			n, d)
+	}
+
+	for _, test := range []struct {
+		Path   string
+		Action string
+	}{
+		{"/offer/1001", "undelete"},
+		{"/offer/9999", "delete"},
+		{"/offer/1002", "purge"},
+		{"/offer/", "delete"},
+	} {
+		code, body = post(test.Path, test.Action)
+		if code == 200 {
+			t.Fatalf("%s %s succeeded: %s", test.Action, test.Path, body)
+		}
+	}
+}
+
+func TestResultSets(t *testing.T) {
+	now := time.Now()
+	results := NewResultSets(2, time.Minute)
+	t1 := results.Put([]datedOffer{{Id: "1"}, {Id: "2"}}, now)
+	if t2 := results.Put([]datedOffer{{Id: "2"}, {Id: "1"}}, now); t2 != t1 {
+		t.Fatalf("identical result sets have different tokens: %s, %s", t1, t2)
+	}
+	t3 := results.Put([]datedOffer{}, now.Add(time.Second))
+	if offers := results.Get(t3, now.Add(time.Second)); offers == nil || len(offers) != 0 {
+		t.Fatalf("unexpected empty result set: %v", offers)
+	}
+	// Evicts t1, the least recently used
+	t4 := results.Put([]datedOffer{{Id: "3"}}, now.Add(2*time.Second))
+	if results.Get(t1, now) != nil {
+		t.Fatalf("least recently used result set was not evicted")
+	}
+	if offers := results.Get(t4, now); len(offers) != 1 || offers[0].Id != "3" {
+		t.Fatalf("unexpected result set: %v", offers)
+	}
+	if results.Get(t4, now.Add(time.Hour)) != nil {
+		t.Fatalf("expired result set was returned")
+	}
+}
+
+func TestHandleQueryRefine(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	reToken := regexp.MustCompile(`name="refine" value="([0-9a-f]+)"`)
+	query := func(values url.Values, count string) string {
+		w := env.QueryValues(values)
+		body := w.Body.String()
+		if w.Code != 200 {
+			t.Fatalf("query %v failed with %d: %s", values, w.Code, body)
+		}
+		if !strings.Contains(body, count) {
+			t.Fatalf("query %v: %q not found in:\n%s", values, count, body)
+		}
+		m := reToken.FindStringSubmatch(body)
+		if m == nil {
+			return ""
+		}
+		return m[1]
+	}
+
+	token := query(url.Values{"where": {"paris"}}, "2/2 offers")
+	if token == "" {
+		t.Fatalf("no refine token found")
+	}
+	// The spatial query is ignored when refining
+	refined := query(url.Values{"refine": {token}, "where": {"lyon"},
+		"what": {"golang"}}, "1/1 offers (refined)")
+	query(url.Values{"refine": {refined}, "what": {"python"}}, "1/1 offers")
+	query(url.Values{"refine": {token}, "what": {"javascript"}}, "0/0 offers")
+
+	// Refined searches keep remote offers, and forward the flag
+	remote := query(url.Values{"what": {"python"}, "include_remote": {"1"}},
+		"4/4 offers")
+	w := env.QueryValues(url.Values{"refine": {remote},
+		"include_remote": {"1"}, "what": {"consultant"}})
+	body := w.Body.String()
+	if w.Code != 200 || !strings.Contains(body, "1/1 offers (refined)") ||
+		!strings.Contains(body,
+			`<input type="hidden" name="include_remote" value="1">`) {
+		t.Fatalf("include_remote was not carried over: %d %s", w.Code, body)
+	}
+
+	w = env.QueryValues(url.Values{"refine": {"unknown"}})
+	if w.Code != 400 {
+		t.Fatalf("unknown token returned %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestHandleQueryPages(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	reOffer := regexp.MustCompile(`name="id" value="apec:(\d+)"`)
+	for _, test := range []struct {
+		Page     string
+		Count    string
+		Expected string
+		Links    []string
+	}{
+		{"", "2/4 offers, page 1 of 2", "[1004 1003]",
+			[]string{`<a href="?page=2&amp;per_page=2&amp;what=">Next</a>`}},
+		{"2", "2/4 offers, page 2 of 2", "[1002 1001]",
+			[]string{`<a href="?page=1&amp;per_page=2&amp;what=">Prev</a>`}},
+		{"3", "0/4 offers, page 3 of 2", "[]", nil},
+	} {
+		values := url.Values{"what": {""}, "per_page": {"2"}}
+		if test.Page != "" {
+			values.Set("page", test.Page)
+		}
+		w := env.QueryValues(values)
+		body := w.Body.String()
+		if w.Code != 200 || !strings.Contains(body, test.Count) {
+			t.Fatalf("page %q: %q not found in:\n%s", test.Page, test.Count, body)
+		}
+		ids := []string{}
+		for _, m := range reOffer.FindAllStringSubmatch(body, -1) {
+			ids = append(ids, m[1])
+		}
+		if fmt.Sprint(ids) != test.Expected {
+			t.Fatalf("page %q: expected %s, got %v", test.Page, test.Expected, ids)
+		}
+		for _, link := range test.Links {
+			if !strings.Contains(body, link) {
+				t.Fatalf("page %q: %s not found in:\n%s", test.Page, link, body)
+			}
+		}
+	}
+
+	for _, values := range []url.Values{
+		{"page": {"0"}},
+		{"per_page": {"1001"}},
+	} {
+		w := env.QueryValues(values)
+		if w.Code != 400 {
+			t.Fatalf("%v: unexpected status %d", values, w.Code)
+		}
+	}
+}
+
+func TestHandleQueryCache(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	if !strings.Contains(env.Query("", "paris").Body.String(), "2/2 offers") {
+		t.Fatalf("unexpected paris offers")
+	}
+	cached := env.Cache.Get("", "paris", false)
+	if len(cached) != 2 {
+		t.Fatalf("query results were not cached: %v", cached)
+	}
+	// Cached results are served until the indexes are updated
+	env.Spatial.Remove("apec:1001")
+	if !strings.Contains(env.Query("", "paris").Body.String(), "2/2 offers") {
+		t.Fatalf("cached results were not used")
+	}
+	env.Generation.Bump()
+	if env.Cache.Get("", "paris", false) != nil {
+		t.Fatalf("stale results were returned")
+	}
+	if !strings.Contains(env.Query("", "paris").Body.String(), "1/1 offers") {
+		t.Fatalf("query was not run again")
+	}
+	// Results computed with a previous generation are not cached
+	gen := env.Cache.Generation()
+	env.Generation.Bump()
+	env.Cache.Put("", "lyon", false, gen, cached)
+	if env.Cache.Get("", "lyon", false) != nil {
+		t.Fatalf("stale results were cached")
+	}
+}
+
+func TestHandleQueryLimits(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	warning := "Too many matching offers"
+	tests := []struct {
+		MaxHits      int
+		MaxFilterIds int
+		MaxMemory    int64
+		What         string
+		Where        string
+		Count        string
+		Partial      bool
+	}{
+		{20000, 20000, 0, "python", "", "3/3 offers", false},
+		{2, 20000, 0, "python", "", "2/2 offers", true},
+		{20000, 20000, 2 * searchHitSize, "python", "", "2/2 offers", true},
+		{20000, 20000, 3 * searchHitSize, "python", "", "3/3 offers", false},
+		// Spatial results are filtered after the search
+		{20000, 1, 0, "python", "paris", "2/2 offers", false},
+		{20000, 1, 0, "golang", "paris", "1/1 offers", false},
+	}
+	for _, test := range tests {
+		env.Limits = SearchLimits{
+			MaxHits:      test.MaxHits,
+			MaxFilterIds: test.MaxFilterIds,
+			MaxMemory:    test.MaxMemory,
+		}
+		// Cached results do not depend on limits
+		env.Generation.Bump()
+		values := url.Values{"what": {test.What}, "where": {test.Where}}
+		w := env.QueryValues(values)
+		body := w.Body.String()
+		if w.Code != 200 {
+			t.Fatalf("query %v failed with %d: %s", values, w.Code, body)
+		}
+		if !strings.Contains(body, test.Count) {
+			t.Fatalf("%+v: %q not found in:\n%s", test, test.Count, body)
+		}
+		if strings.Contains(body, warning) != test.Partial {
+			t.Fatalf("%+v: unexpected partial results warning:\n%s", test, body)
+		}
+	}
+}
+
+func TestUsePostFilter(t *testing.T) {
+	limits := SearchLimits{MaxFilterIds: 1000}
+	tests := []struct {
+		Count    int
+		DocCount uint64
+		Post     bool
+	}{
+		{10, 10000, false},
+		{2500, 10000, true},
+		{1001, 1000000, true},
+		{1000, 1000000, false},
+		{100, 200, false},
+	}
+	for _, test := range tests {
+		post := usePostFilter(test.Count, test.DocCount, limits)
+		if post != test.Post {
+			t.Fatalf("%+v: got %v", test, post)
+		}
+	}
+}
+
+func TestHandleQueryOfferFields(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	// Repost the Lyon offer and tag it
+	js, err := getStoreJsonOffer(env.Store, "apec:1003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reposted := *js
+	reposted.Id = "1008"
+	reposted.Date = "2016-12-28T10:00:00.000+0000"
+	data, err := json.Marshal(&reposted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = env.Store.Put("apec:1008", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rebuildInitialDates(env.Store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = env.Store.UpdateTags([]string{"apec:1003"}, "applied", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.Reindex()
+
+	body := env.Query("", "lyon|paris,500000").Body.String()
+	for _, s := range []string{
+		"(50 - 60 kEUR)  0 km (reposted 1x) [applied]",
+		"(45 - 55 kEUR)  0 km <a",
+		"<div><small>Go, Python</small></div>",
+	} {
+		if !strings.Contains(body, s) {
+			t.Fatalf("%q not found in:\n%s", s, body)
+		}
+	}
+	// Distances are only known for searched locations
+	body = env.Query("", "").Body.String()
+	if strings.Contains(body, " km") {
+		t.Fatalf("unexpected distance in:\n%s", body)
+	}
+}
+
+func TestRegisterProfiler(t *testing.T) {
+	adminMux := http.NewServeMux()
+	registerProfiler(adminMux, "/admin")
+
+	get := func(h http.Handler, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+	w := get(adminMux, "/admin/debug/pprof/")
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "goroutine") {
+		t.Fatalf("unexpected profiles index: %d %s", w.Code, w.Body.String())
+	}
+	w = get(adminMux, "/admin/debug/pprof/goroutine?debug=1")
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "goroutine profile") {
+		t.Fatalf("unexpected goroutine profile: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestWebMuxes(t *testing.T) {
+	get := func(h http.Handler, path string) int {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w.Code
+	}
+	adminPaths := []string{"/admin/vars", "/admin/debug/pprof/"}
+	for _, path := range writerPaths {
+		adminPaths = append(adminPaths, "/admin"+path)
+	}
+
+	// Admin handlers are mounted in the public mux by default
+	publicMux, _, adminRoot := newWebMuxes(nil, "/apec", "/admin", false)
+	if adminRoot != publicMux {
+		t.Fatalf("admin handlers are not served by the public mux")
+	}
+	if code := get(publicMux, "/admin/vars"); code != 200 {
+		t.Fatalf("admin counters are not served: %d", code)
+	}
+
+	// --admin-http serves them on their own listener
+	publicMux, _, adminRoot = newWebMuxes(nil, "/apec", "/admin", true)
+	for _, path := range append(adminPaths, "/debug/pprof/", "/debug/vars") {
+		if code := get(publicMux, path); code != 404 {
+			t.Fatalf("%s is served by the public mux: %d", path, code)
+		}
+	}
+	for _, path := range []string{"/admin/vars", "/admin/debug/pprof/"} {
+		if code := get(adminRoot, path); code != 200 {
+			t.Fatalf("%s is not served by the admin mux: %d", path, code)
+		}
+	}
+	for _, path := range []string{"/debug/pprof/", "/debug/vars"} {
+		if code := get(adminRoot, path); code != 404 {
+			t.Fatalf("%s is served by the admin mux: %d", path, code)
+		}
+	}
+}
+
+type wrappedIndex bleve.Index
+
+// expiringIndex runs searches to completion, then fails them as if their
+// deadline was exceeded.
+type expiringIndex struct {
+	wrappedIndex
+}
+
+func (idx *expiringIndex) SearchInContext(ctx context.Context,
+	rq *bleve.SearchRequest) (*bleve.SearchResult, error) {
+
+	_, err := idx.wrappedIndex.SearchInContext(ctx, rq)
+	if err != nil {
+		return nil, err
+	}
+	return nil, context.DeadlineExceeded
+}
+
+func TestSearchDatedOffersTimeout(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	q, err := makeSearchQuery("python", nil, env.Fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limits := SearchLimits{
+		MaxHits: 2,
+		Timeout: time.Minute,
+	}
+	offers, partial, err := searchDatedOffers(&expiringIndex{env.Index}, q,
+		nil, limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !partial || len(offers) != 2 {
+		t.Fatalf("collected hits not returned: %v %+v", partial, offers)
+	}
+	for _, o := range offers {
+		if o.Date == "" || o.Score == 0 {
+			t.Fatalf("incomplete collected hit: %+v", o)
+		}
+	}
+
+	// Deadline exceeded before the first hit
+	limits.Timeout = time.Nanosecond
+	offers, partial, err = searchDatedOffers(env.Index, q, nil, limits)
+	if err != nil || !partial || len(offers) != 0 {
+		t.Fatalf("unexpected timed out search: %v %+v %v", partial, offers, err)
+	}
+}
+
+func TestFindOffersFromTextPostFilter(t *testing.T) {
+	env := newTestEnv(t)
+	defer env.Close()
+
+	all, partial, err := findOffersFromText(env.Index, "python", nil,
+		env.Fields, defaultSearchLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if partial || len(all) < 3 {
+		t.Fatalf("unexpected python offers: %v %+v", partial, all)
+	}
+	// Candidates are post-filtered and rank beyond MaxHits
+	limits := SearchLimits{
+		MaxHits:      1,
+		MaxFilterIds: 0,
+	}
+	last := all[len(all)-1].Id
+	offers, partial, err := findOffersFromText(env.Index, "python",
+		[]string{last}, env.Fields, limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if partial || len(offers) != 1 || offers[0].Id != last {
+		t.Fatalf("lowest ranked candidate %s not found: %v %+v", last, partial,
+			offers)
+	}
+	offers, partial, err = findOffersFromText(env.Index, "python",
+		[]string{all[len(all)-2].Id, last}, env.Fields, limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !partial || len(offers) != 1 || offers[0].Id != all[len(all)-2].Id {
+		t.Fatalf("truncated candidates not reported: %v %+v", partial, offers)
+	}
+}
@@ -10,25 +10,40 @@ import (
 
 // Indexer is an online asynchronous indexer.
 type Indexer struct {
-	store *Store
-	index bleve.Index
-	queue *IndexQueue
-	reset chan bool
-	work  chan bool
-	stop  chan chan bool
+	store      *Store
+	index      *IndexHolder
+	deleted    *DeletedIndex
+	queue      *IndexQueue
+	generation *IndexGeneration
+	options    IndexOptions
+	areas      *Areas
+	synced     func()
+	reset      chan bool
+	work       chan bool
+	stop       chan chan bool
 }
 
 // NewIndexer creates a new Indexer assuming it is the soler writer for
-// supplied store and index.
-func NewIndexer(store *Store, index bleve.Index, queue *IndexQueue) *Indexer {
+// supplied store and index, and deleted offers index if not nil. generation
+// is bumped after index updates, options prune indexed offers, areas assign
+// them to departments and regions. synced is called, if not nil, once queued
+// updates were indexed.
+func NewIndexer(store *Store, index *IndexHolder, deleted *DeletedIndex,
+	queue *IndexQueue, generation *IndexGeneration, options IndexOptions,
+	areas *Areas, synced func()) *Indexer {
 
 	idx := &Indexer{
-		store: store,
-		index: index,
-		queue: queue,
-		reset: make(chan bool, 1),
-		work:  make(chan bool, 1),
-		stop:  make(chan chan bool),
+		store:      store,
+		index:      index,
+		deleted:    deleted,
+		queue:      queue,
+		generation: generation,
+		options:    options,
+		areas:      areas,
+		synced:     synced,
+		reset:      make(chan bool, 1),
+		work:       make(chan bool, 1),
+		stop:       make(chan chan bool),
 	}
 	go idx.dispatch()
 	return idx
@@ -71,6 +86,10 @@ func (idx *Indexer) dispatch() {
 			}
 			speed := float64(indexed) / (float64(time.Since(start)) / float64(time.Second))
 			log.Printf("indexation done, %.1f/s", speed)
+			if err == nil && indexed > 0 && idx.queue.Size() == 0 &&
+				idx.synced != nil {
+				idx.synced()
+			}
 		case done := <-idx.stop:
 			close(done)
 			return
@@ -119,19 +138,31 @@ func (idx *Indexer) resetQueue() error {
 	if err != nil {
 		return err
 	}
-	indexed, err := listIndexIds(idx.index)
+	indexed, err := listIndexIds(idx.index.Get())
 	if err != nil {
 		return err
 	}
 	added, removed := diffIds(stored, indexed)
 
+	// Offers dates of added and removed offers groups are refreshed as well
 	for _, id := range removed {
 		ops = append(ops, Queued{Id: id, Op: RemoveOp})
+		ops = append(ops, Queued{Id: id, Op: DatesOp})
 	}
 	for _, id := range added {
 		ops = append(ops, Queued{Id: id, Op: AddOp})
+		ops = append(ops, Queued{Id: id, Op: DatesOp})
 	}
 	log.Printf("queuing %d additions, %d removals", len(added), len(removed))
+	if idx.deleted != nil {
+		changed, err := idx.listChangedDeleted(added, removed)
+		if err != nil {
+			return err
+		}
+		for _, id := range changed {
+			ops = append(ops, Queued{Id: id, Op: DeletedOp})
+		}
+	}
 
 	// Update queue
 	err = idx.queue.DeleteMany(idx.queue.Size())
@@ -141,6 +172,42 @@ func (idx *Indexer) resetQueue() error {
 	return idx.queue.QueueMany(ops)
 }
 
+// listChangedDeleted returns the identifiers of offers whose deleted
+// versions must be indexed again. All versions are compared if the deleted
+// offers index is open. Otherwise only offers removed from or added to the
+// live index with deleted versions are returned, so the index is opened
+// when dequeuing them and not before.
+func (idx *Indexer) listChangedDeleted(added, removed []string) (
+	[]string, error) {
+
+	if deleted := idx.deleted.Opened(); deleted != nil {
+		return listChangedDeletedIds(idx.store, deleted)
+	}
+	changed := []string{}
+	for _, ids := range [][]string{removed, added} {
+		for _, id := range ids {
+			versions, err := idx.store.ListDeletedOffers(id)
+			if err != nil {
+				return nil, err
+			}
+			if len(versions) > 0 {
+				changed = append(changed, id)
+			}
+		}
+	}
+	return changed, nil
+}
+
+// Enqueue schedules indexing operations without waiting for the next Sync.
+func (idx *Indexer) Enqueue(ops []Queued) error {
+	err := idx.queue.QueueMany(ops)
+	if err != nil {
+		return err
+	}
+	idx.signalWork()
+	return nil
+}
+
 func (idx *Indexer) signalWork() {
 	select {
 	case idx.work <- true:
@@ -155,16 +222,49 @@ func (idx *Indexer) indexOne(q Queued) error {
 			return err
 		}
 		if offer != nil {
-			err = idx.index.Index(offer.Id, offer)
+			err = setOfferGeo(idx.store, offer)
+			if err != nil {
+				return err
+			}
+			err = setOfferTags(idx.store, offer)
+			if err != nil {
+				return err
+			}
+			err = setOfferArea(idx.store, idx.areas, offer)
+			if err != nil {
+				return err
+			}
+			prepareIndexedOffer(offer, idx.options)
+			err = idx.index.Get().Index(offer.Id, offer)
 			if err != nil {
 				return err
 			}
 		}
 	} else if q.Op == RemoveOp {
-		err := idx.index.Delete(q.Id)
+		err := idx.index.Get().Delete(q.Id)
+		if err != nil {
+			return err
+		}
+	} else if q.Op == DeletedOp {
+		if idx.deleted != nil {
+			// Index deleted versions, drop restored or purged ones
+			deleted, err := idx.deleted.Get()
+			if err != nil {
+				return err
+			}
+			err = syncDeletedOffer(idx.store, deleted, idx.options, q.Id)
+			if err != nil {
+				return err
+			}
+		}
+	} else if q.Op == DatesOp {
+		updated, err := idx.store.RefreshOfferDates(q.Id)
 		if err != nil {
 			return err
 		}
+		if updated > 0 {
+			log.Printf("refreshed %d offer dates groups of %s", updated, q.Id)
+		}
 	} else {
 		return fmt.Errorf("unknown operation: %v", q.Op)
 	}
@@ -181,6 +281,11 @@ func (idx *Indexer) indexSome() (int, error) {
 		idx.signalWork()
 	}
 	indexed := 0
+	defer func() {
+		if indexed > 0 {
+			idx.generation.Bump()
+		}
+	}()
 	for _, q := range queued {
 		err := idx.indexOne(q)
 		if err != nil {
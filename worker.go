@@ -0,0 +1,491 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Writer owns store updates: crawling, geocoding, full text and spatial
+// indexing, and their admin handlers. It runs in "apec web", or in
+// "apec worker" when web serves replicas.
+type Writer struct {
+	Config         *Config
+	Store          *Store
+	Index          *IndexHolder
+	Deleted        *DeletedIndex
+	Queue          *IndexQueue
+	Geocoder       *Geocoder
+	Spatial        *SpatialIndex
+	Generation     *IndexGeneration
+	Indexer        *Indexer
+	SpatialIndexer *SpatialIndexer
+	Geocoding      *GeocodingHandler
+	Rebuilder      *IndexRebuilder
+	// Sends saved searches alerts, nil if no mail server is configured
+	Alerts *AlertScheduler
+	// Full text fields queried by remote searches
+	SearchFields []SearchField
+
+	// Closed to interrupt crawls
+	stop chan struct{}
+	// Waits for the crawling goroutine
+	wait         sync.WaitGroup
+	crawlingLock sync.Mutex
+	crawling     bool
+}
+
+// OpenWriter opens the store, index, queue and geocoder of cfg and starts
+// synchronizing the indexes with the store, as configured by searchCfg.
+// generation is bumped after indexes updates.
+func OpenWriter(cfg *Config, searchCfg *SearchConfig,
+	generation *IndexGeneration) (*Writer, error) {
+
+	options := searchCfg.Index
+	w := &Writer{
+		Config:       cfg,
+		Generation:   generation,
+		Spatial:      NewSpatialIndex(),
+		SearchFields: searchCfg.Fields,
+		stop:         make(chan struct{}),
+	}
+	ok := false
+	defer func() {
+		if !ok {
+			w.Close()
+		}
+	}()
+	var err error
+	w.Store, err = OpenStore(cfg.Store())
+	if err != nil {
+		return nil, fmt.Errorf("cannot open data store: %s", err)
+	}
+	index, err := OpenOfferIndex(cfg.Index())
+	if err != nil {
+		return nil, fmt.Errorf("cannot open index: %s", err)
+	}
+	w.Index = NewIndexHolder(index)
+	w.Deleted = NewDeletedIndex(cfg.DeletedIndex())
+	w.Geocoder, err = openGeocoder(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open geocoder: %s", err)
+	}
+	stations, err := loadOptionalStations(defaultStationsPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load stations: %s", err)
+	}
+	areas, err := LoadAreas(cfg.ShapesDir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load areas: %s", err)
+	}
+	w.Queue, err = OpenIndexQueue(cfg.Queue())
+	if err != nil {
+		return nil, err
+	}
+	// Saved searches are checked once new offers are indexed
+	var synced func()
+	if smtpURL := cfg.SMTPURL(); smtpURL != "" {
+		smtp, err := parseSMTPURL(smtpURL, cfg.AlertsFrom())
+		if err != nil {
+			return nil, err
+		}
+		w.Alerts = NewAlertScheduler(w.Store, w.Index, w.Spatial, w.Geocoder,
+			w.SearchFields, smtp.Send)
+		synced = w.Alerts.Check
+	}
+	w.Indexer = NewIndexer(w.Store, w.Index, w.Deleted, w.Queue, generation,
+		options, areas, synced)
+	w.Indexer.Sync()
+	w.SpatialIndexer = NewSpatialIndexer(w.Store, w.Spatial, w.Geocoder,
+		stations, generation)
+	w.SpatialIndexer.Sync()
+	w.Geocoding = NewGeocodingHandler(w.Store, w.Geocoder, w.Spatial, w.Indexer,
+		generation)
+	w.Rebuilder = NewIndexRebuilder(w.Store, w.Index, cfg.Index(), generation,
+		options, areas, w.Indexer.Sync)
+	ok = true
+	return w, nil
+}
+
+// Close interrupts crawling, geocoding and index rebuilds, waits for them,
+// the indexers and alerts to stop, then closes the store, indexes, queue and
+// geocoder.
+func (w *Writer) Close() {
+	// crawl checks stop and registers with wait under the lock, so no crawl
+	// starts once Wait is called
+	w.crawlingLock.Lock()
+	close(w.stop)
+	w.crawlingLock.Unlock()
+	w.wait.Wait()
+	if w.Geocoding != nil {
+		w.Geocoding.Close()
+	}
+	if w.Rebuilder != nil {
+		w.Rebuilder.Close()
+	}
+	if w.SpatialIndexer != nil {
+		w.SpatialIndexer.Close()
+	}
+	if w.Indexer != nil {
+		w.Indexer.Close()
+	}
+	if w.Alerts != nil {
+		w.Alerts.Close()
+	}
+	if w.Queue != nil {
+		w.Queue.Close()
+	}
+	if w.Geocoder != nil {
+		w.Geocoder.Close()
+	}
+	if w.Index != nil {
+		w.Index.Get().Close()
+	}
+	if w.Deleted != nil {
+		w.Deleted.Close()
+	}
+	if w.Store != nil {
+		w.Store.Close()
+	}
+}
+
+// Replica returns the writer data as a replica, to be served directly.
+func (w *Writer) Replica() *Replica {
+	return &Replica{
+		Store:     w.Store,
+		Index:     w.Index,
+		Spatial:   w.Spatial,
+		Geocoder:  w.Geocoder,
+		Lifetimes: NewLifetimesCache(w.Store),
+		Deleted:   w.Deleted,
+	}
+}
+
+// crawl starts crawling in the background, unless it is already running or
+// the writer is closing, and returns true if it did. finished is called with
+// the crawl outcome.
+func (w *Writer) crawl(fetchHTML bool, finished func(error)) bool {
+	w.crawlingLock.Lock()
+	defer w.crawlingLock.Unlock()
+	if w.crawling {
+		return false
+	}
+	select {
+	case <-w.stop:
+		return false
+	default:
+	}
+	w.crawling = true
+	w.wait.Add(1)
+	go func() {
+		defer w.wait.Done()
+		defer func() {
+			w.crawlingLock.Lock()
+			w.crawling = false
+			w.crawlingLock.Unlock()
+		}()
+		err := crawl(w.Store, 0, nil, fetchHTML, CrawlLimits{
+			MaxOfferSize: defaultMaxOfferKB * 1024,
+			Stop:         w.stop,
+		})
+		if err != nil {
+			log.Printf("error: crawling failed with: %s", err)
+			finished(err)
+			return
+		}
+		select {
+		case <-w.stop:
+			finished(fmt.Errorf("crawl interrupted"))
+			return
+		default:
+		}
+		finished(nil)
+		w.Indexer.Sync()
+		w.SpatialIndexer.Sync()
+		w.Geocoding.Geocode()
+	}()
+	return true
+}
+
+var (
+	// Admin handlers registered by Writer, relative to the admin path
+	writerPaths = []string{
+		"/changes",
+		"/offer/",
+		"/sync",
+		"/crawl",
+		"/geocode",
+		"/status",
+		"/reindex",
+		"/panic",
+		"/tags",
+		"/audit",
+		"/offers",
+		"/geocoded",
+		"/stats",
+	}
+)
+
+// RegisterAdmin registers writerPaths handlers under adminURL in mux. POST
+// requests are recorded in the audit log.
+func (w *Writer) RegisterAdmin(mux *http.ServeMux, adminURL string) {
+	admin := http.NewServeMux()
+	audited := Audited(w.Store, adminURL, admin)
+	for _, path := range writerPaths {
+		mux.Handle(adminURL+path, audited)
+	}
+	admin.HandleFunc(adminURL+"/changes", func(rw http.ResponseWriter, r *http.Request) {
+		handleChanges(w.Store, rw, r)
+	})
+	admin.HandleFunc(adminURL+"/offer/", func(rw http.ResponseWriter, r *http.Request) {
+		if enforcePost(r, rw) {
+			return
+		}
+		err := handleAdminOffer(w.Store, w.Indexer, adminURL+"/offer/", rw, r)
+		if err != nil {
+			log.Printf("error: offer update failed with: %s", err)
+			rw.Header().Set("Content-Type", "text/plain")
+			rw.WriteHeader(400)
+			fmt.Fprintf(rw, "error: %s\n", err)
+			return
+		}
+		w.SpatialIndexer.Sync()
+	})
+	admin.HandleFunc(adminURL+"/sync", func(rw http.ResponseWriter, r *http.Request) {
+		if enforcePost(r, rw) {
+			return
+		}
+		w.Indexer.Sync()
+		w.SpatialIndexer.Sync()
+		rw.Write([]byte("OK"))
+	})
+	admin.HandleFunc(adminURL+"/crawl", func(rw http.ResponseWriter, r *http.Request) {
+		if enforcePost(r, rw) {
+			return
+		}
+		if !w.crawl(r.FormValue("html") == "1", auditJob(w.Store, "crawl", r)) {
+			setAuditOutcome(r, "already running")
+			rw.Write([]byte("already crawling"))
+			return
+		}
+		setAuditOutcome(r, "started")
+		rw.Write([]byte("OK"))
+	})
+	admin.Handle(adminURL+"/geocode", w.Geocoding)
+	admin.HandleFunc(adminURL+"/status", func(rw http.ResponseWriter, r *http.Request) {
+		err := handleAdminStatus(w.Store, w.Index, w.Queue, w.Spatial, w.Rebuilder,
+			adminURL+"/reindex", rw, r)
+		if err != nil {
+			log.Printf("error: status failed with: %s", err)
+			rw.Header().Set("Content-Type", "text/plain")
+			rw.WriteHeader(500)
+			fmt.Fprintf(rw, "error: %s\n", err)
+		}
+	})
+	admin.HandleFunc(adminURL+"/reindex", func(rw http.ResponseWriter, r *http.Request) {
+		if enforcePost(r, rw) {
+			return
+		}
+		if !w.Rebuilder.Start(auditJob(w.Store, "reindex", r)) {
+			setAuditOutcome(r, "already running")
+			rw.Write([]byte("already rebuilding"))
+			return
+		}
+		setAuditOutcome(r, "started")
+		rw.Write([]byte("OK"))
+	})
+	admin.HandleFunc(adminURL+"/tags", func(rw http.ResponseWriter, r *http.Request) {
+		err := handleAdminTags(w.Store, w.Index, w.Indexer, rw, r)
+		if err != nil {
+			log.Printf("error: tags update failed with: %s", err)
+			rw.Header().Set("Content-Type", "text/plain")
+			rw.WriteHeader(400)
+			fmt.Fprintf(rw, "error: %s\n", err)
+		}
+	})
+	admin.HandleFunc(adminURL+"/audit", func(rw http.ResponseWriter, r *http.Request) {
+		err := handleAdminAudit(w.Store, rw, r)
+		if err != nil {
+			log.Printf("error: audit listing failed with: %s", err)
+			rw.Header().Set("Content-Type", "text/plain")
+			rw.WriteHeader(400)
+			fmt.Fprintf(rw, "error: %s\n", err)
+		}
+	})
+	admin.HandleFunc(adminURL+"/offers", func(rw http.ResponseWriter, r *http.Request) {
+		err := handleAdminOffers(w.Store, w.Index, w.SearchFields,
+			w.Config.Snapshots(), rw, r)
+		if err != nil {
+			log.Printf("error: offers search failed with: %s", err)
+			rw.Header().Set("Content-Type", "text/plain")
+			rw.WriteHeader(400)
+			fmt.Fprintf(rw, "error: %s\n", err)
+		}
+	})
+	admin.HandleFunc(adminURL+"/geocoded", func(rw http.ResponseWriter, r *http.Request) {
+		err := handleAdminGeocoded(w.Store, rw, r)
+		if err != nil {
+			log.Printf("error: geocoded listing failed with: %s", err)
+			rw.Header().Set("Content-Type", "text/plain")
+			rw.WriteHeader(500)
+			fmt.Fprintf(rw, "error: %s\n", err)
+		}
+	})
+	admin.HandleFunc(adminURL+"/stats", func(rw http.ResponseWriter, r *http.Request) {
+		err := handleAdminStats(w.Config, w.Store, w.Index, rw, r)
+		if err != nil {
+			log.Printf("error: stats failed with: %s", err)
+			rw.Header().Set("Content-Type", "text/plain")
+			rw.WriteHeader(400)
+			fmt.Fprintf(rw, "error: %s\n", err)
+		}
+	})
+	admin.HandleFunc(adminURL+"/panic", func(rw http.ResponseWriter, r *http.Request) {
+		// Evade HTTP handler recover
+		go func() {
+			panic("now")
+		}()
+	})
+}
+
+// proxyAdmin forwards writerPaths requests under adminURL to the worker
+// listening at workerURL, which must use the same admin path.
+func proxyAdmin(mux *http.ServeMux, adminURL, workerURL string) error {
+	u, err := url.Parse(workerURL)
+	if err != nil {
+		return fmt.Errorf("invalid worker URL: %s", err)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	for _, path := range append(writerPaths, "/publish") {
+		mux.Handle(adminURL+path, proxy)
+	}
+	return nil
+}
+
+// ReplicaPublisher publishes the writer data as replicas when the indexes
+// change.
+type ReplicaPublisher struct {
+	writer *Writer
+	dir    string
+
+	lock      sync.Mutex
+	published bool
+	gen       uint64
+}
+
+func NewReplicaPublisher(writer *Writer, dir string) *ReplicaPublisher {
+	return &ReplicaPublisher{
+		writer: writer,
+		dir:    dir,
+	}
+}
+
+// Publish publishes a replica if the indexes changed since the last one, or
+// if force is true. It returns true if a replica was published.
+func (p *ReplicaPublisher) Publish(force bool) (bool, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	gen := p.writer.Generation.Get()
+	if p.published && gen == p.gen && !force {
+		return false, nil
+	}
+	_, err := publishReplica(p.writer.Store, p.writer.Index.Get(),
+		p.writer.Deleted, p.writer.Geocoder, p.dir)
+	if err != nil {
+		return false, err
+	}
+	p.published = true
+	p.gen = gen
+	return true, nil
+}
+
+// Run publishes replicas every interval if necessary, forever.
+func (p *ReplicaPublisher) Run(interval time.Duration, stop <-chan struct{}) {
+	for {
+		_, err := p.Publish(false)
+		if err != nil {
+			log.Printf("error: cannot publish replica: %s", err)
+		}
+		select {
+		case <-time.After(interval):
+		case <-stop:
+			return
+		}
+	}
+}
+
+var (
+	workerCmd = app.Command("worker", `crawl, geocode and index offers for web
+
+The worker owns the data store and indexes, and periodically publishes
+read-only replicas of them, served by "apec web --worker=URL". Admin requests
+received by web are forwarded to the worker, both must use the same admin
+path.
+`)
+	workerHttp = workerCmd.Flag("http", "admin http server address").
+			Default("localhost:8082").String()
+	workerAdminPath = workerCmd.Flag("admin-path", "base URL path for admin content").
+			String()
+	workerPublishInterval = workerCmd.Flag("publish-interval",
+		"minimum delay between replicas publications").Default("5m").Duration()
+	workerShutdownTimeout = workerCmd.Flag("shutdown-timeout",
+		"on SIGINT or SIGTERM, wait this long for in-flight requests before "+
+			"closing the store").Default("30s").Duration()
+)
+
+func worker(cfg *Config) error {
+	adminURL := *workerAdminPath
+	searchCfg, err := loadSearchConfig(cfg.Search())
+	if err != nil {
+		return err
+	}
+	writer, err := OpenWriter(cfg, searchCfg, &IndexGeneration{})
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+	// Not http.DefaultServeMux, where net/http/pprof and expvar register
+	// their handlers outside adminURL
+	mux := http.NewServeMux()
+	writer.RegisterAdmin(mux, adminURL)
+
+	publisher := NewReplicaPublisher(writer, cfg.Replicas())
+	publish := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if enforcePost(r, w) {
+			return
+		}
+		_, err := publisher.Publish(true)
+		if err != nil {
+			log.Printf("error: publish failed with: %s", err)
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "error: %s\n", err)
+			return
+		}
+		w.Write([]byte("OK"))
+	})
+	mux.Handle(adminURL+"/publish", Audited(writer.Store, adminURL, publish))
+	mux.Handle(adminURL+"/vars", expvar.Handler())
+	registerProfiler(mux, adminURL)
+	// Let the indexers catch up before the first publication
+	writer.SpatialIndexer.SyncAndWait()
+	stop := make(chan struct{})
+	stopped := make(chan bool)
+	go func() {
+		publisher.Run(*workerPublishInterval, stop)
+		close(stopped)
+	}()
+
+	err = serveUntilSignal([]*http.Server{{
+		Addr:    *workerHttp,
+		Handler: mux,
+	}}, *workerShutdownTimeout)
+	close(stop)
+	<-stopped
+	return err
+}